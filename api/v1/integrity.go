@@ -0,0 +1,46 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrChecksumMismatch is returned by VerifyChecksum for a packet whose data doesn't match its Checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// castagnoli is the CRC32C table, computed with the SSE4.2 and ARMv8 CRC instructions when available
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SetChecksum sets the Checksum of the packet to the CRC32C of its data
+func (x *Packet) SetChecksum() {
+	checksum := crc32.Checksum(x.Data, castagnoli)
+	x.Checksum = &checksum
+}
+
+// Retransmission returns a copy of the DATA packet to send again on another stream, with its Checksum set if integrity
+// is on and cleared otherwise. The packet itself is left untouched, the previous stream may still be marshaling it
+func (x *Packet) Retransmission(integrity bool) *Packet {
+	packet := proto.Clone(x).(*Packet)
+	if integrity {
+		packet.SetChecksum()
+	} else {
+		packet.Checksum = nil
+	}
+	return packet
+}
+
+// VerifyChecksum returns an error wrapping ErrChecksumMismatch if the packet has no Checksum or its data doesn't
+// match it
+func (x *Packet) VerifyChecksum() error {
+	if x.Checksum == nil {
+		return fmt.Errorf("%w: DATA packet of conn_id %d has no checksum", ErrChecksumMismatch, x.ConnId)
+	}
+	if checksum := crc32.Checksum(x.Data, castagnoli); checksum != *x.Checksum {
+		return fmt.Errorf("%w: DATA packet of conn_id %d with %d bytes has checksum %08x, expected %08x",
+			ErrChecksumMismatch, x.ConnId, len(x.Data), checksum, *x.Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChecksum(t *testing.T) {
+	packet := &Packet{ConnId: 1, Code: ControlCode_DATA, Data: []byte("GET /api/v1/pods HTTP/1.1\r\n\r\n")}
+	if err := packet.VerifyChecksum(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch without checksum, got %v", err)
+	}
+
+	packet.SetChecksum()
+	if err := packet.VerifyChecksum(); err != nil {
+		t.Fatalf("expected a valid checksum, got %v", err)
+	}
+
+	// The checksum survives the round trip on the wire
+	data, err := proto.Marshal(packet)
+	if err != nil {
+		t.Fatalf("failed to marshal packet: %v", err)
+	}
+	received := &Packet{}
+	if err := proto.Unmarshal(data, received); err != nil {
+		t.Fatalf("failed to unmarshal packet: %v", err)
+	}
+	if err := received.VerifyChecksum(); err != nil {
+		t.Fatalf("expected a valid checksum after the round trip, got %v", err)
+	}
+
+	for bit := range 8 {
+		received.Data[len(received.Data)/2] ^= 1 << bit
+		if err := received.VerifyChecksum(); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("expected ErrChecksumMismatch with bit %d flipped, got %v", bit, err)
+		}
+		received.Data[len(received.Data)/2] ^= 1 << bit
+	}
+
+	// An empty DATA packet has a checksum too
+	empty := &Packet{ConnId: 1, Code: ControlCode_DATA}
+	empty.SetChecksum()
+	if err := empty.VerifyChecksum(); err != nil {
+		t.Errorf("expected a valid checksum for an empty packet, got %v", err)
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	packet := &Packet{ConnId: 1, Code: ControlCode_DATA, Data: []byte("data"), Seq: 3}
+
+	retransmitted := packet.Retransmission(true)
+	if err := retransmitted.VerifyChecksum(); err != nil {
+		t.Errorf("expected a valid checksum on the retransmitted packet, got %v", err)
+	}
+	if packet.Checksum != nil {
+		t.Errorf("expected the packet to be left untouched, got checksum %d", *packet.Checksum)
+	}
+	if retransmitted.Seq != packet.Seq || string(retransmitted.Data) != string(packet.Data) {
+		t.Errorf("expected a copy of the packet, got %v", retransmitted)
+	}
+
+	packet.SetChecksum()
+	if retransmitted := packet.Retransmission(false); retransmitted.Checksum != nil || packet.Checksum == nil {
+		t.Errorf("expected the checksum cleared on the copy only, got %v and %v", retransmitted.Checksum, packet.Checksum)
+	}
+}
+
+// BenchmarkChecksum measures the cost of the integrity check on the path of a DATA packet: marshaling it on the
+// sending side and unmarshaling it on the receiving side, with and without the checksum
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range []int{1024, 32 * 1024} {
+		for _, integrity := range []bool{false, true} {
+			b.Run(fmt.Sprintf("size=%d/integrity=%t", size, integrity), func(b *testing.B) {
+				data := make([]byte, size)
+				for i := range data {
+					data[i] = byte(i)
+				}
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for b.Loop() {
+					packet := &Packet{ConnId: 1, Code: ControlCode_DATA, Data: data}
+					if integrity {
+						packet.SetChecksum()
+					}
+					wire, err := proto.Marshal(packet)
+					if err != nil {
+						b.Fatal(err)
+					}
+					received := &Packet{}
+					if err := proto.Unmarshal(wire, received); err != nil {
+						b.Fatal(err)
+					}
+					if integrity {
+						if err := received.VerifyChecksum(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package v1
+
+import "sync/atomic"
+
+// SeqNumReceiver drops the DATA packets of a packet connection whose SeqNum isn't greater than the last one received,
+// e.g. a packet sent twice. The zero value is ready to use
+type SeqNumReceiver struct {
+	last atomic.Int64
+}
+
+// Accept returns whether the packet should be delivered, the packets without a SeqNum are always accepted
+func (r *SeqNumReceiver) Accept(packet *Packet) bool {
+	if packet.SeqNum == 0 {
+		return true
+	}
+	for {
+		last := r.last.Load()
+		if packet.SeqNum <= last {
+			return false
+		}
+		if r.last.CompareAndSwap(last, packet.SeqNum) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package v1
+
+import "testing"
+
+func TestSeqNumReceiver(t *testing.T) {
+	var receiver SeqNumReceiver
+	for _, c := range []struct {
+		seqNum int64
+		accept bool
+	}{
+		{1, true},
+		{1, false}, // duplicate
+		{3, true},
+		{2, false}, // after a later one
+		{0, true},  // not numbered
+		{4, true},
+	} {
+		if accepted := receiver.Accept(&Packet{Code: ControlCode_DATA, SeqNum: c.seqNum}); accepted != c.accept {
+			t.Errorf("expected SeqNum %d accepted %v, got %v", c.seqNum, c.accept, accepted)
+		}
+	}
+}
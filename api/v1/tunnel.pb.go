@@ -32,7 +32,21 @@ const (
 	// The error_message field should contain error details
 	ControlCode_ERROR ControlCode = 1
 	// Graceful shutdown: Sent by agent to hub to indicate it's about to go offline
+	// Also sent by hub to agent to close the tunnel, the error_message field contains the reason
 	ControlCode_DRAIN ControlCode = 2
+	// Liveness and latency probe, sent on conn_id 0 by either side
+	// The data field carries an opaque timestamp of the sender, which is echoed back in the PONG
+	ControlCode_PING ControlCode = 3
+	// Reply to a PING, sent on conn_id 0 with the data of the PING
+	ControlCode_PONG ControlCode = 4
+	// Acknowledges the DATA packets of conn_id up to the ack field, the sender drops them from its replay buffer
+	// Only sent when the tunnel resumes packet connections, see ProtocolVersionResume
+	ControlCode_ACK ControlCode = 5
+	// Resumes conn_id on a new tunnel after the agent reconnected, the ack field is the seq of the last DATA packet
+	// received in order, the peer retransmits the ones after it. The hub sends one for each packet connection it
+	// resumes, then one on conn_id 0, the agent closes its connections not resumed by then. The agent answers with
+	// its own RESUME, or an ERROR if it can't resume the connection
+	ControlCode_RESUME ControlCode = 6
 )
 
 // Enum value maps for ControlCode.
@@ -41,11 +55,19 @@ var (
 		0: "DATA",
 		1: "ERROR",
 		2: "DRAIN",
+		3: "PING",
+		4: "PONG",
+		5: "ACK",
+		6: "RESUME",
 	}
 	ControlCode_value = map[string]int32{
-		"DATA":  0,
-		"ERROR": 1,
-		"DRAIN": 2,
+		"DATA":   0,
+		"ERROR":  1,
+		"DRAIN":  2,
+		"PING":   3,
+		"PONG":   4,
+		"ACK":    5,
+		"RESUME": 6,
 	}
 )
 
@@ -76,6 +98,56 @@ func (ControlCode) EnumDescriptor() ([]byte, []int) {
 	return file_v1_tunnel_proto_rawDescGZIP(), []int{0}
 }
 
+// ErrorCode is the machine-readable cause of an ERROR packet, the error_message describes it
+type ErrorCode int32
+
+const (
+	// Default value, the cause is only described by the error_message
+	ErrorCode_UNSPECIFIED_ERROR ErrorCode = 0
+	// The checksum of a DATA packet of conn_id didn't match its data, see IntegrityMetadataKey
+	// The receiver closes the connection, the hub answers the client with a 502 Bad Gateway
+	ErrorCode_INTEGRITY_FAILURE ErrorCode = 1
+)
+
+// Enum value maps for ErrorCode.
+var (
+	ErrorCode_name = map[int32]string{
+		0: "UNSPECIFIED_ERROR",
+		1: "INTEGRITY_FAILURE",
+	}
+	ErrorCode_value = map[string]int32{
+		"UNSPECIFIED_ERROR": 0,
+		"INTEGRITY_FAILURE": 1,
+	}
+)
+
+func (x ErrorCode) Enum() *ErrorCode {
+	p := new(ErrorCode)
+	*p = x
+	return p
+}
+
+func (x ErrorCode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ErrorCode) Descriptor() protoreflect.EnumDescriptor {
+	return file_v1_tunnel_proto_enumTypes[1].Descriptor()
+}
+
+func (ErrorCode) Type() protoreflect.EnumType {
+	return &file_v1_tunnel_proto_enumTypes[1]
+}
+
+func (x ErrorCode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ErrorCode.Descriptor instead.
+func (ErrorCode) EnumDescriptor() ([]byte, []int) {
+	return file_v1_tunnel_proto_rawDescGZIP(), []int{1}
+}
+
 // Packet is the atomic unit transmitted in the tunnel
 type Packet struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
@@ -87,7 +159,24 @@ type Packet struct {
 	// Business payload, only meaningful when code = DATA
 	Data []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
 	// Error message, only meaningful when code = ERROR
-	ErrorMessage  string `protobuf:"bytes,4,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+	ErrorMessage string `protobuf:"bytes,4,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+	// Time the packet was created by the sender in Unix nanoseconds, 0 if not set
+	// Used to measure the latency of the packets through the tunnel, it depends on the clocks of the hub and agent
+	Timestamp int64 `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Sequence number of a DATA packet with data within its conn_id and direction, starting at 1
+	// Only set when the tunnel resumes packet connections, 0 otherwise
+	Seq int64 `protobuf:"varint,6,opt,name=seq,proto3" json:"seq,omitempty"`
+	// The seq of the last DATA packet of conn_id received in order, only meaningful when code = ACK or RESUME
+	Ack int64 `protobuf:"varint,7,opt,name=ack,proto3" json:"ack,omitempty"`
+	// CRC32C (Castagnoli) of data, only set on DATA packets when the tunnel negotiated IntegrityMetadataKey
+	// The receiver closes the connection with an ERROR of error_code INTEGRITY_FAILURE when it doesn't match
+	Checksum *uint32 `protobuf:"fixed32,8,opt,name=checksum,proto3,oneof" json:"checksum,omitempty"`
+	// The cause of the error, only meaningful when code = ERROR
+	ErrorCode ErrorCode `protobuf:"varint,9,opt,name=error_code,json=errorCode,proto3,enum=tunnel.v1.ErrorCode" json:"error_code,omitempty"`
+	// Number of a DATA packet within its conn_id and direction, starting at 1, set in every configuration
+	// The receivers drop the DATA packets whose seq_num isn't greater than the last one of conn_id, the resumable
+	// connections are ordered by seq instead. 0 for the peers that don't number them, such packets are never dropped
+	SeqNum        int64 `protobuf:"varint,10,opt,name=seq_num,json=seqNum,proto3" json:"seq_num,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -150,20 +239,79 @@ func (x *Packet) GetErrorMessage() string {
 	return ""
 }
 
+func (x *Packet) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Packet) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Packet) GetAck() int64 {
+	if x != nil {
+		return x.Ack
+	}
+	return 0
+}
+
+func (x *Packet) GetChecksum() uint32 {
+	if x != nil && x.Checksum != nil {
+		return *x.Checksum
+	}
+	return 0
+}
+
+func (x *Packet) GetErrorCode() ErrorCode {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return ErrorCode_UNSPECIFIED_ERROR
+}
+
+func (x *Packet) GetSeqNum() int64 {
+	if x != nil {
+		return x.SeqNum
+	}
+	return 0
+}
+
 var File_v1_tunnel_proto protoreflect.FileDescriptor
 
 const file_v1_tunnel_proto_rawDesc = "" +
 	"\n" +
-	"\x0fv1/tunnel.proto\x12\ttunnel.v1\"\x86\x01\n" +
+	"\x0fv1/tunnel.proto\x12\ttunnel.v1\"\xc4\x02\n" +
 	"\x06Packet\x12\x17\n" +
 	"\aconn_id\x18\x01 \x01(\x03R\x06connId\x12*\n" +
 	"\x04code\x18\x02 \x01(\x0e2\x16.tunnel.v1.ControlCodeR\x04code\x12\x12\n" +
 	"\x04data\x18\x03 \x01(\fR\x04data\x12#\n" +
-	"\rerror_message\x18\x04 \x01(\tR\ferrorMessage*-\n" +
+	"\rerror_message\x18\x04 \x01(\tR\ferrorMessage\x12\x1c\n" +
+	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\x12\x10\n" +
+	"\x03seq\x18\x06 \x01(\x03R\x03seq\x12\x10\n" +
+	"\x03ack\x18\a \x01(\x03R\x03ack\x12\x1f\n" +
+	"\bchecksum\x18\b \x01(\aH\x00R\bchecksum\x88\x01\x01\x123\n" +
+	"\n" +
+	"error_code\x18\t \x01(\x0e2\x14.tunnel.v1.ErrorCodeR\terrorCode\x12\x17\n" +
+	"\aseq_num\x18\n" +
+	" \x01(\x03R\x06seqNumB\v\n" +
+	"\t_checksum*V\n" +
 	"\vControlCode\x12\b\n" +
 	"\x04DATA\x10\x00\x12\t\n" +
 	"\x05ERROR\x10\x01\x12\t\n" +
-	"\x05DRAIN\x10\x022E\n" +
+	"\x05DRAIN\x10\x02\x12\b\n" +
+	"\x04PING\x10\x03\x12\b\n" +
+	"\x04PONG\x10\x04\x12\a\n" +
+	"\x03ACK\x10\x05\x12\n" +
+	"\n" +
+	"\x06RESUME\x10\x06*9\n" +
+	"\tErrorCode\x12\x15\n" +
+	"\x11UNSPECIFIED_ERROR\x10\x00\x12\x15\n" +
+	"\x11INTEGRITY_FAILURE\x10\x012E\n" +
 	"\rTunnelService\x124\n" +
 	"\x06Tunnel\x12\x11.tunnel.v1.Packet\x1a\x11.tunnel.v1.Packet\"\x00(\x010\x01B1Z/github.com/xuezhaojun/multiclustertunnel/api/v1b\x06proto3"
 
@@ -179,21 +327,23 @@ func file_v1_tunnel_proto_rawDescGZIP() []byte {
 	return file_v1_tunnel_proto_rawDescData
 }
 
-var file_v1_tunnel_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_v1_tunnel_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
 var file_v1_tunnel_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
 var file_v1_tunnel_proto_goTypes = []any{
 	(ControlCode)(0), // 0: tunnel.v1.ControlCode
-	(*Packet)(nil),   // 1: tunnel.v1.Packet
+	(ErrorCode)(0),   // 1: tunnel.v1.ErrorCode
+	(*Packet)(nil),   // 2: tunnel.v1.Packet
 }
 var file_v1_tunnel_proto_depIdxs = []int32{
 	0, // 0: tunnel.v1.Packet.code:type_name -> tunnel.v1.ControlCode
-	1, // 1: tunnel.v1.TunnelService.Tunnel:input_type -> tunnel.v1.Packet
-	1, // 2: tunnel.v1.TunnelService.Tunnel:output_type -> tunnel.v1.Packet
-	2, // [2:3] is the sub-list for method output_type
-	1, // [1:2] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	1, // 1: tunnel.v1.Packet.error_code:type_name -> tunnel.v1.ErrorCode
+	2, // 2: tunnel.v1.TunnelService.Tunnel:input_type -> tunnel.v1.Packet
+	2, // 3: tunnel.v1.TunnelService.Tunnel:output_type -> tunnel.v1.Packet
+	3, // [3:4] is the sub-list for method output_type
+	2, // [2:3] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_v1_tunnel_proto_init() }
@@ -201,12 +351,13 @@ func file_v1_tunnel_proto_init() {
 	if File_v1_tunnel_proto != nil {
 		return
 	}
+	file_v1_tunnel_proto_msgTypes[0].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_v1_tunnel_proto_rawDesc), len(file_v1_tunnel_proto_rawDesc)),
-			NumEnums:      1,
+			NumEnums:      2,
 			NumMessages:   1,
 			NumExtensions: 0,
 			NumServices:   1,
@@ -0,0 +1,35 @@
+package v1
+
+// ProtocolVersionMetadataKey is the gRPC metadata key of the tunnel protocol version. The agent sends the highest
+// version it supports in the metadata of the Tunnel call, the hub answers with the negotiated one in the header
+const ProtocolVersionMetadataKey = "tunnel-protocol-version"
+
+// DiagnosticMetadataKey is the gRPC metadata key marking the Tunnel call of an agent diagnosing its connectivity.
+// The hub answers the first PING of the stream with a PONG and ends it, without replacing the tunnel of the
+// cluster. It sends the key back in its header, hubs without it treat the call as a tunnel
+const DiagnosticMetadataKey = "tunnel-diagnostic"
+
+// FirstPacketMetadataKey is the gRPC metadata key of the agents opening a packet connection on its first DATA packet
+// with data, the hub then opens the packet connections with the first data of the client instead of an empty DATA
+// packet, which saves a packet per request. The hub sends the key back in its header, hubs without it keep sending
+// the empty packets. It's negotiated apart from the protocol version, which the agents only send when they resume
+// connections
+const FirstPacketMetadataKey = "tunnel-first-packet"
+
+const (
+	// ProtocolVersionBase is the protocol of the agents and hubs that don't send a version
+	ProtocolVersionBase = 1
+	// ProtocolVersionResume numbers the DATA packets with seq, and adds the ACK and RESUME packets so that the
+	// packet connections of the agent are resumed on its next tunnel instead of failing when it reconnects
+	ProtocolVersionResume = 2
+)
+
+// AgentVersionMetadataKey is the gRPC metadata key of the release of the agent binary, see pkg/version. The hub logs
+// it when the tunnel is established and lists it in /debug/tunnels
+const AgentVersionMetadataKey = "tunnel-agent-version"
+
+// IntegrityMetadataKey is the gRPC metadata key of the agents checking the integrity of the DATA packets, the hub
+// sends it back in its header when it checks them too. Both sides then set the Checksum of the DATA packets they
+// send and close the connection of a DATA packet whose Checksum doesn't match with an ERROR of error code
+// INTEGRITY_FAILURE. The checksums are neither computed nor sent otherwise
+const IntegrityMetadataKey = "tunnel-integrity"
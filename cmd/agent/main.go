@@ -2,119 +2,201 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	grpcinsecure "google.golang.org/grpc/credentials/insecure"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/klog/v2"
 
 	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/config"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
 )
 
 func main() {
+	// The flag defaults are the defaults of the config file, flags set on the command line take precedence over it
+	defaults := config.NewAgentConfig()
+
 	// Command line flags
 	var (
-		hubAddress    = flag.String("hub-address", "localhost:8443", "Address of the hub server")
-		clusterName   = flag.String("cluster-name", "", "Name of the managed cluster (required)")
-		udsSocketPath = flag.String("uds-socket-path", "/tmp/multiclustertunnel.sock", "Path to Unix Domain Socket")
-		insecure      = flag.Bool("insecure", false, "Disable TLS certificate verification (for testing only)")
-		hubKubeConfig = flag.String("hub-kubeconfig", "", "Path to hub cluster kubeconfig file (required)")
+		configFile        = flag.String("config", "", "Path to a YAML AgentConfig file, see pkg/config, it's reloaded on SIGHUP")
+		hubAddress        = flag.String("hub-address", defaults.HubAddress, "Address of the hub server")
+		clusterName       = flag.String("cluster-name", "", "Name of the managed cluster (required)")
+		udsSocketPath     = flag.String("uds-socket-path", defaults.UDSSocketPath, "Path to Unix Domain Socket")
+		abstractSocket    = flag.Bool("uds-abstract-namespace", false, "Bind the Unix Domain Socket in the Linux abstract namespace, no socket file is left behind after a crash, any process of the network namespace can connect to it")
+		insecure          = flag.Bool("insecure", false, "Disable TLS certificate verification (for testing only)")
+		tlsServerName     = flag.String("tls-server-name", "", "Name the certificate of the hub is verified for, e.g. when --hub-address is the IP of a load balancer, defaults to the host of --hub-address")
+		pinnedSPKIHashes  = flag.String("pinned-hub-spki-hashes", "", "Comma-separated base64 SHA-256 of the public keys of the hub, a hub certificate with a pinned key is accepted as well as one verified by the CA, pin the current and the next key while rotating")
+		requireCAAndPin   = flag.Bool("require-hub-ca-and-pin", false, "Require the hub certificate to be both verified by the CA and pinned by --pinned-hub-spki-hashes")
+		requireTLS        = flag.Bool("require-tls", false, "Refuse to connect to the hub without TLS, it can't be set with --insecure")
+		grpcAuthority     = flag.String("grpc-authority", "", "Authority of the gRPC calls to the hub, e.g. for a load balancer routing by it, defaults to --tls-server-name, then to --hub-address")
+		hubKubeConfig     = flag.String("hub-kubeconfig", "", "Path to hub cluster kubeconfig file (required unless --disable-auth is set)")
+		managedKubeConfig = flag.String("managed-kubeconfig", "", "Path to managed cluster kubeconfig file, defaults to in-cluster config")
+		disableAuth       = flag.Bool("disable-auth", false, "Proxy requests without authentication if the kube clients can not be built (for testing only)")
+		logFormat         = flag.String("log-format", defaults.Logging.Format, "Log format of the tunnel hot path, one of: text, json")
+		metricsAddr       = flag.String("metrics-address", "", "Address to serve Prometheus metrics, the JSON status of the connection to the hub, the open connections and the version on, e.g. :9090, disabled if empty")
+		readyFile         = flag.String("ready-file", "", "Path of a file created once the tunnel to the hub is established, for startup/readiness probes")
+		connectTimeout    = flag.Duration("initial-connect-timeout", 0, "Exit if the tunnel to the hub is not established within this duration, 0 means retry forever")
+		maxBuffered       = flag.Int("max-conn-buffered-bytes", 0, "Maximum bytes from the hub buffered for each connection until the target reads them, a connection exceeding it is closed, defaults to 256KB")
+		resumeWindow      = flag.Duration("resume-window", 0, "Resume the connections when the agent reconnects within this long instead of failing them, only with a hub enabling it too, 0 disables it")
+		diagnose          = flag.Bool("diagnose", false, "Check the connectivity to the hub, the proxy sockets and the apiserver, print a PASS/FAIL line for each check and exit, with 1 if a check failed")
+		integrity         = flag.Bool("enable-integrity-check", false, "Check the CRC32C of the data tunneled with the hub and close the connections whose data is corrupted, only with a hub enabling it too")
+		resumeBytes       = flag.Int("resume-max-buffered-bytes", 0, "Maximum bytes sent on each connection kept until the hub acknowledges them when resuming is enabled, defaults to 1MB")
+		bodyTimeout       = flag.Duration("proxy-request-body-timeout", defaults.ProxyRequestBodyTimeout.Duration, "Fail the requests whose body is not read from the proxy socket within this duration with 408, a negative value disables it")
+		headerTimeout     = flag.Duration("proxy-response-header-timeout", defaults.ProxyResponseHeaderTimeout.Duration, "Fail the unary requests whose target service doesn't send the response headers within this duration with 504, watches and other streaming requests are not bounded, a negative value disables it")
+		idleTimeout       = flag.Duration("idle-connection-timeout", defaults.IdleConnectionTimeout.Duration, "Close the connections to the target services that sent no data for this long, e.g. when the hub went away without closing them, watches quiet for longer are closed too, a negative value disables it")
+		showVersion       = flag.Bool("version", false, "Print the version of the agent and exit")
+		requestTimeout    = flag.Duration("proxy-request-timeout", defaults.ProxyRequestTimeout.Duration, "Cancel the unary requests to the target services not completed within this duration, watches and other streaming requests are not bounded, a negative value disables it")
 	)
 
 	klog.InitFlags(nil)
 	flag.Parse()
 
-	if *clusterName == "" {
-		klog.ErrorS(nil, "cluster-name is required")
-		os.Exit(1)
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
+	// applyFlags overrides the config with the flags set on the command line
+	applyFlags := func(c *config.AgentConfig) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "hub-address":
+				c.HubAddress = *hubAddress
+			case "cluster-name":
+				c.ClusterName = *clusterName
+			case "uds-socket-path":
+				c.UDSSocketPath = *udsSocketPath
+			case "uds-abstract-namespace":
+				c.UseAbstractNamespace = *abstractSocket
+			case "insecure":
+				c.TLS.Insecure = *insecure
+			case "tls-server-name":
+				c.TLS.ServerName = *tlsServerName
+			case "pinned-hub-spki-hashes":
+				c.TLS.PinnedSPKIHashes = nil
+				for _, pin := range strings.Split(*pinnedSPKIHashes, ",") {
+					if pin = strings.TrimSpace(pin); pin != "" {
+						c.TLS.PinnedSPKIHashes = append(c.TLS.PinnedSPKIHashes, pin)
+					}
+				}
+			case "require-hub-ca-and-pin":
+				c.TLS.RequireCAAndPin = *requireCAAndPin
+			case "require-tls":
+				c.RequireTLS = *requireTLS
+			case "grpc-authority":
+				c.GRPCAuthority = *grpcAuthority
+			case "hub-kubeconfig":
+				c.Auth.HubKubeConfig = *hubKubeConfig
+			case "managed-kubeconfig":
+				c.Auth.ManagedKubeConfig = *managedKubeConfig
+			case "disable-auth":
+				c.Auth.DisableAuth = *disableAuth
+			case "log-format":
+				c.Logging.Format = *logFormat
+			case "v":
+				c.Logging.Verbosity, _ = strconv.Atoi(f.Value.String())
+			case "metrics-address":
+				c.MetricsAddress = *metricsAddr
+			case "ready-file":
+				c.ReadyFile = *readyFile
+			case "initial-connect-timeout":
+				c.InitialConnectTimeout.Duration = *connectTimeout
+			case "max-conn-buffered-bytes":
+				c.MaxConnBufferedBytes = *maxBuffered
+			case "resume-window":
+				c.ResumeWindow.Duration = *resumeWindow
+			case "resume-max-buffered-bytes":
+				c.ResumeMaxBufferedBytes = *resumeBytes
+			case "enable-integrity-check":
+				c.EnableIntegrityCheck = *integrity
+			case "proxy-request-body-timeout":
+				c.ProxyRequestBodyTimeout.Duration = *bodyTimeout
+			case "proxy-response-header-timeout":
+				c.ProxyResponseHeaderTimeout.Duration = *headerTimeout
+			case "proxy-request-timeout":
+				c.ProxyRequestTimeout.Duration = *requestTimeout
+			case "idle-connection-timeout":
+				c.IdleConnectionTimeout.Duration = *idleTimeout
+			}
+		})
 	}
 
-	if *hubKubeConfig == "" {
-		klog.ErrorS(nil, "hub-kubeconfig is required")
+	cfg, err := loadConfig(*configFile, applyFlags)
+	if err != nil {
+		klog.ErrorS(err, "Invalid configuration")
 		os.Exit(1)
 	}
+	setVerbosity(cfg.Logging.Verbosity)
 
 	klog.InfoS("Starting multiclustertunnel agent",
-		"hub_address", *hubAddress,
-		"cluster_name", *clusterName,
-		"uds_socket_path", *udsSocketPath,
-		"insecure", *insecure)
+		"config_file", *configFile,
+		"hub_address", cfg.HubAddress,
+		"cluster_name", cfg.ClusterName,
+		"uds_socket_path", cfg.UDSSocketPath,
+		"insecure", cfg.TLS.Insecure,
+		"disable_auth", cfg.Auth.DisableAuth)
 
 	// Create agent configuration
-	config := &agent.Config{
-		HubAddress:    *hubAddress,
-		ClusterName:   *clusterName,
-		UDSSocketPath: *udsSocketPath,
+	agentConfig, err := cfg.ToAgentConfig()
+	if err != nil {
+		klog.ErrorS(err, "Failed to create agent configuration")
+		os.Exit(1)
 	}
-
-	// Configure TLS
-	if *insecure {
-		// Use insecure connection (no TLS) for testing only
-		config.DialOptions = append(config.DialOptions,
-			grpc.WithTransportCredentials(grpcinsecure.NewCredentials()))
+	if cfg.TLS.Insecure {
 		klog.InfoS("Using insecure connection (no TLS) - for testing only")
+	} else if len(cfg.TLS.PinnedSPKIHashes) > 0 {
+		klog.InfoS("Using TLS with the public key of the hub pinned", "pins", len(cfg.TLS.PinnedSPKIHashes), "require_ca_and_pin", cfg.TLS.RequireCAAndPin)
 	} else {
-		// Use TLS with proper certificate verification (default)
-		tlsConfig := &tls.Config{}
-		config.DialOptions = append(config.DialOptions,
-			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 		klog.InfoS("Using TLS with certificate verification enabled")
 	}
 
-	// Create Kubernetes clients for RequestProcessor
-	var hubKubeClient, managedClusterKubeClient kubernetes.Interface
-
-	// Create hub cluster client
-	hubConfig, err := clientcmd.BuildConfigFromFlags("", *hubKubeConfig)
-	if err != nil {
-		klog.ErrorS(err, "Failed to build hub kubeconfig")
-		os.Exit(1)
-	}
-	hubKubeClient, err = kubernetes.NewForConfig(hubConfig)
-	if err != nil {
-		klog.ErrorS(err, "Failed to create hub Kubernetes client")
-		os.Exit(1)
+	if *diagnose {
+		os.Exit(runDiagnose(cfg, agentConfig))
 	}
-	klog.InfoS("Hub Kubernetes client created from kubeconfig", "kubeconfig", *hubKubeConfig)
 
-	// Create managed cluster client (in-cluster config)
-	managedClusterConfig, err := rest.InClusterConfig()
-	if err != nil {
-		klog.ErrorS(err, "Failed to get in-cluster config for managed cluster")
-		os.Exit(1)
-	}
-	managedClusterKubeClient, err = kubernetes.NewForConfig(managedClusterConfig)
+	// Create default implementations of the interfaces
+	requestProcessor, certificateProvider, router, err := agent.BuildDefaultComponents(cfg.ComponentOptions())
 	if err != nil {
-		klog.ErrorS(err, "Failed to create managed cluster Kubernetes client")
+		klog.ErrorS(err, "Failed to build agent components")
 		os.Exit(1)
 	}
-	klog.InfoS("Managed cluster Kubernetes client created from in-cluster config")
-
-	// Create default implementations of the interfaces
-	requestProcessor := agent.NewRequestProcessorImplt(hubKubeClient, managedClusterKubeClient)
-
-	certificateProvider := &agent.CertificateProviderImplt{}
-
-	router := &agent.RouterImpl{}
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Create the agent with default implementations
-	agentClient := agent.New(ctx, config, requestProcessor, certificateProvider, router)
+	agentClient := agent.New(ctx, agentConfig, requestProcessor, certificateProvider, router)
 
 	// Setup graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	if *configFile != "" {
+		signal.Notify(hupCh, syscall.SIGHUP)
+	}
+
+	if cfg.ReadyFile != "" {
+		// Remove a stale file left by a previous run, so the pod only becomes ready once connected
+		if err := os.Remove(cfg.ReadyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.ErrorS(err, "Failed to remove ready file", "path", cfg.ReadyFile)
+			os.Exit(1)
+		}
+		go writeReadyFile(ctx, agentClient.ReadyChan(), cfg.ReadyFile)
+	}
+
+	if cfg.MetricsAddress != "" {
+		go serveMetrics(cfg.MetricsAddress, agentClient.StatusHandler(), agentClient.ConnectionsHandler())
+	}
 
 	// Start agent in a goroutine
 	errCh := make(chan error, 1)
@@ -125,16 +207,118 @@ func main() {
 	klog.InfoS("Agent started successfully")
 
 	// Wait for shutdown signal or error
-	select {
-	case <-sigCh:
-		klog.InfoS("Received shutdown signal, stopping agent...")
-		cancel()
-	case err := <-errCh:
-		if err != nil {
-			klog.ErrorS(err, "Agent stopped with error")
-			os.Exit(1)
+	for {
+		select {
+		case <-hupCh:
+			reloadConfig(cfg, *configFile, applyFlags)
+			continue
+		case <-sigCh:
+			klog.InfoS("Received shutdown signal, stopping agent...")
+			cancel()
+		case err := <-errCh:
+			if errors.Is(err, agent.ErrInitialConnectTimeout) {
+				klog.ErrorS(err, "Agent could not connect to the hub", "timeout", cfg.InitialConnectTimeout.String())
+				os.Exit(1)
+			}
+			if err != nil {
+				klog.ErrorS(err, "Agent stopped with error")
+				os.Exit(1)
+			}
 		}
+		break
 	}
 
 	klog.InfoS("Agent stopped")
 }
+
+// loadConfig loads the config file at path, or the defaults if path is empty, and applies the flags to it
+func loadConfig(path string, applyFlags func(*config.AgentConfig)) (*config.AgentConfig, error) {
+	if path != "" {
+		return config.LoadAgentConfig(path, applyFlags)
+	}
+	c := config.NewAgentConfig()
+	applyFlags(c)
+	c.Default()
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid flags: %w", err)
+	}
+	return c, nil
+}
+
+// reloadConfig applies the fields of the config file that can change at runtime, the current config is kept if the
+// file is invalid
+func reloadConfig(cfg *config.AgentConfig, path string, applyFlags func(*config.AgentConfig)) {
+	next, err := config.LoadAgentConfig(path, applyFlags)
+	if err != nil {
+		klog.ErrorS(err, "Failed to reload config, keeping the current one", "path", path)
+		return
+	}
+	if ignored := cfg.Reload(next); len(ignored) > 0 {
+		klog.InfoS("Config fields changed that only take effect after a restart", "path", path, "fields", ignored)
+	}
+	setVerbosity(cfg.Logging.Verbosity)
+	klog.InfoS("Reloaded config", "path", path, "verbosity", cfg.Logging.Verbosity)
+}
+
+// setVerbosity sets the klog verbosity without marking -v as set on the command line
+func setVerbosity(v int) {
+	if err := flag.Lookup("v").Value.Set(strconv.Itoa(v)); err != nil {
+		klog.ErrorS(err, "Failed to set log verbosity", "verbosity", v)
+	}
+}
+
+// runDiagnose prints the results of agent.Diagnose and returns the exit code
+func runDiagnose(cfg *config.AgentConfig, agentConfig *agent.Config) int {
+	hubTLSConfig, err := cfg.HubTLSConfig()
+	if err != nil {
+		klog.ErrorS(err, "Failed to load the TLS config of the hub")
+		return 1
+	}
+	diagnoseConfig := &agent.DiagnoseConfig{Agent: agentConfig, HubTLSConfig: hubTLSConfig}
+	if _, certificateProvider, _, err := agent.BuildDefaultComponents(cfg.ComponentOptions()); err != nil {
+		klog.ErrorS(err, "Failed to build agent components, the apiserver is not checked")
+	} else {
+		diagnoseConfig.CertificateProvider = certificateProvider
+	}
+
+	report, err := agent.Diagnose(context.Background(), diagnoseConfig)
+	if err != nil {
+		klog.ErrorS(err, "Failed to diagnose the agent")
+		return 1
+	}
+	report.Print(os.Stdout)
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
+
+// writeReadyFile creates the ready file once the agent is connected to the hub
+func writeReadyFile(ctx context.Context, ready <-chan struct{}, path string) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+
+	content := []byte(time.Now().UTC().Format(time.RFC3339) + "\n")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		klog.ErrorS(err, "Failed to write ready file", "path", path)
+		return
+	}
+	klog.InfoS("Ready file written", "path", path)
+}
+
+// serveMetrics serves the Prometheus metrics, the status, the open connections and the version of the agent, the
+// process keeps running if it fails
+func serveMetrics(addr string, status, connections http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/status", status)
+	mux.Handle("/debug/connections", connections)
+	mux.Handle("/version", version.Handler())
+	klog.InfoS("Serving metrics", "address", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.ErrorS(err, "Failed to serve metrics", "address", addr)
+	}
+}
@@ -6,14 +6,23 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/xuezhaojun/multiclustertunnel/e2e/utils"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
 )
 
+// defaultServerSANs are the hub service in the e2e hub cluster and the loopback addresses
+const defaultServerSANs = "mctunnel-server,mctunnel-server.mctunnel-hub,mctunnel-server.mctunnel-hub.svc," +
+	"mctunnel-server.mctunnel-hub.svc.cluster.local,localhost,127.0.0.1,::1"
+
 func main() {
 	var (
-		outputDir = flag.String("output-dir", "e2e/certs", "Directory to output certificates")
-		help      = flag.Bool("help", false, "Show help message")
+		outputDir    = flag.String("output-dir", "e2e/certs", "Directory to output certificates")
+		keyAlgorithm = flag.String("key-algorithm", string(certutil.ECDSA256), "Algorithm of the private keys, one of: rsa2048, ecdsa256, ecdsa384")
+		validity     = flag.Duration("validity", certutil.DefaultValidity, "Validity of the certificates")
+		serverSANs   = flag.String("server-sans", defaultServerSANs, "Comma separated DNS names and IP addresses of the server certificate")
+		clientCN     = flag.String("client-cn", "mctunnel-client", "Common name of the client certificate")
+		help         = flag.Bool("help", false, "Show help message")
 	)
 	flag.Parse()
 
@@ -33,6 +42,8 @@ func main() {
 
 	log.Printf("Generating certificates for MultiClusterTunnel e2e testing...")
 	log.Printf("Output directory: %s", *outputDir)
+	log.Printf("Key algorithm: %s", *keyAlgorithm)
+	log.Printf("Validity: %s", *validity)
 
 	// Create output directory
 	if err := os.MkdirAll(*outputDir, 0755); err != nil {
@@ -40,46 +51,65 @@ func main() {
 	}
 
 	// Generate certificates
-	certs, err := utils.GenerateTestCertificates()
+	ca, err := certutil.NewCA(certutil.Options{
+		KeyAlgorithm: certutil.KeyAlgorithm(*keyAlgorithm),
+		Validity:     *validity,
+		Organization: "MultiClusterTunnel E2E Test",
+		CommonName:   "MultiClusterTunnel E2E CA",
+	})
+	if err != nil {
+		log.Fatalf("Failed to generate CA: %v", err)
+	}
+	var sans []string
+	for _, san := range strings.Split(*serverSANs, ",") {
+		if san = strings.TrimSpace(san); san != "" {
+			sans = append(sans, san)
+		}
+	}
+	server, err := ca.IssueServer(sans...)
+	if err != nil {
+		log.Fatalf("Failed to generate certificates: %v", err)
+	}
+	client, err := ca.IssueClient(*clientCN)
 	if err != nil {
 		log.Fatalf("Failed to generate certificates: %v", err)
 	}
 
 	// Write CA certificate and key
 	caCertPath := filepath.Join(*outputDir, "ca-cert.pem")
-	if err := writeFile(caCertPath, certs.CACert, 0644); err != nil {
+	if err := writeFile(caCertPath, ca.CertPEM, 0644); err != nil {
 		log.Fatalf("Failed to write CA certificate: %v", err)
 	}
 	log.Printf("✓ CA certificate written to: %s", caCertPath)
 
 	caKeyPath := filepath.Join(*outputDir, "ca-key.pem")
-	if err := writeFile(caKeyPath, certs.CAKey, 0600); err != nil {
+	if err := writeFile(caKeyPath, ca.KeyPEM, 0600); err != nil {
 		log.Fatalf("Failed to write CA key: %v", err)
 	}
 	log.Printf("✓ CA private key written to: %s", caKeyPath)
 
 	// Write server certificate and key
 	serverCertPath := filepath.Join(*outputDir, "server-cert.pem")
-	if err := writeFile(serverCertPath, certs.ServerCert, 0644); err != nil {
+	if err := writeFile(serverCertPath, server.CertPEM, 0644); err != nil {
 		log.Fatalf("Failed to write server certificate: %v", err)
 	}
 	log.Printf("✓ Server certificate written to: %s", serverCertPath)
 
 	serverKeyPath := filepath.Join(*outputDir, "server-key.pem")
-	if err := writeFile(serverKeyPath, certs.ServerKey, 0600); err != nil {
+	if err := writeFile(serverKeyPath, server.KeyPEM, 0600); err != nil {
 		log.Fatalf("Failed to write server key: %v", err)
 	}
 	log.Printf("✓ Server private key written to: %s", serverKeyPath)
 
 	// Write client certificate and key
 	clientCertPath := filepath.Join(*outputDir, "client-cert.pem")
-	if err := writeFile(clientCertPath, certs.ClientCert, 0644); err != nil {
+	if err := writeFile(clientCertPath, client.CertPEM, 0644); err != nil {
 		log.Fatalf("Failed to write client certificate: %v", err)
 	}
 	log.Printf("✓ Client certificate written to: %s", clientCertPath)
 
 	clientKeyPath := filepath.Join(*outputDir, "client-key.pem")
-	if err := writeFile(clientKeyPath, certs.ClientKey, 0600); err != nil {
+	if err := writeFile(clientKeyPath, client.KeyPEM, 0600); err != nil {
 		log.Fatalf("Failed to write client key: %v", err)
 	}
 	log.Printf("✓ Client private key written to: %s", clientKeyPath)
@@ -94,11 +124,11 @@ func main() {
 	log.Printf("  • Client Certificate: %s", clientCertPath)
 	log.Printf("  • Client Private Key: %s", clientKeyPath)
 	log.Printf("")
-	log.Printf("These certificates are valid for 24 hours and are intended for testing only.")
+	log.Printf("These certificates are valid for %s and are intended for testing only.", *validity)
 	log.Printf("DO NOT use these certificates in production!")
 }
 
 // writeFile writes content to a file with specified permissions
-func writeFile(path, content string, perm os.FileMode) error {
-	return os.WriteFile(path, []byte(content), perm)
+func writeFile(path string, content []byte, perm os.FileMode) error {
+	return os.WriteFile(path, content, perm)
 }
@@ -2,86 +2,214 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 	"k8s.io/klog/v2"
 
+	"github.com/xuezhaojun/multiclustertunnel/pkg/config"
 	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
 )
 
 func main() {
+	// The flag defaults are the defaults of the config file, flags set on the command line take precedence over it
+	defaults := config.NewServerConfig()
+
 	// Command line flags
 	var (
-		grpcAddr     = flag.String("grpc-address", ":8443", "gRPC server address for agent connections")
-		httpAddr     = flag.String("http-address", ":8080", "HTTP server address for client requests")
+		configFile   = flag.String("config", "", "Path to a YAML ServerConfig file, see pkg/config, it's reloaded on SIGHUP")
+		grpcAddr     = flag.String("grpc-address", defaults.GRPC.Address, "gRPC server address for agent connections")
+		httpAddr     = flag.String("http-address", defaults.HTTP.Address, "HTTP server address for client requests")
 		grpcCertFile = flag.String("grpc-cert-file", "", "Path to gRPC TLS certificate file")
 		grpcKeyFile  = flag.String("grpc-key-file", "", "Path to gRPC TLS private key file")
 		httpCertFile = flag.String("http-cert-file", "", "Path to HTTP TLS certificate file")
 		httpKeyFile  = flag.String("http-key-file", "", "Path to HTTP TLS private key file")
+		requireTLS   = flag.Bool("require-tls", false, "Refuse to start unless the gRPC and HTTP servers both have a TLS certificate, the admin server is not covered")
+		minTLS       = flag.String("min-tls-version", "", "Lowest TLS version the gRPC and HTTP servers accept with --require-tls, one of 1.0, 1.1, 1.2, 1.3, defaults to 1.2")
+		logFormat    = flag.String("log-format", defaults.Logging.Format, "Log format of the tunnel hot path, one of: text, json")
+		parseQPS     = flag.Float64("cluster-name-qps", defaults.RateLimit.ClusterNameQPS, "Rate limit of cluster name resolution per second, 0 disables rate limiting")
+		parseBurst   = flag.Int("cluster-name-burst", defaults.RateLimit.ClusterNameBurst, "Burst of cluster name resolution when rate limiting is enabled")
+		handshake    = flag.Duration("tunnel-handshake-timeout", defaults.Tunnel.HandshakeTimeout.Duration, "Close the tunnel of an agent that sends no packet for this long after it connected, a negative value disables it")
+		slowStart    = flag.Duration("slow-start-window", 0, "Cap the rate of new connections to a cluster for this long after its agent (re)connected, 0 disables slow start")
+		slowStartQPS = flag.Float64("slow-start-qps", defaults.Tunnel.SlowStartQPS, "Rate of new connections per second to a cluster during the slow start window")
+		maxConns     = flag.Int("max-conns-per-cluster", 0, "Maximum open connections to each cluster, 0 means unlimited")
+		maxBuffered  = flag.Int("max-conn-buffered-bytes", 0, "Maximum bytes from the agent buffered for each connection until the client reads them, a connection exceeding it is closed, defaults to 256KB")
+		resumeWindow = flag.Duration("resume-window", 0, "Resume the connections of an agent that reconnects within this long instead of failing them, only with agents enabling it too, 0 disables it")
+		resumeBytes  = flag.Int("resume-max-buffered-bytes", 0, "Maximum bytes sent on each connection kept until the agent acknowledges them when resuming is enabled, defaults to 1MB")
+		lastSeen     = flag.Duration("tunnel-last-seen-retention", defaults.Tunnel.LastSeenRetention.Duration, "Remember when the agent of a cluster disconnected for this long, for the lastSeen of the 503 responses to its requests, a negative value disables it")
+		integrity    = flag.Bool("enable-integrity-check", false, "Check the CRC32C of the data tunneled with the agents and close the connections whose data is corrupted, only with agents enabling it too")
+		idleTimeout  = flag.Duration("client-idle-timeout", 0, "Close client connections without traffic in either direction for this long, 0 disables it")
+		writeTimeout = flag.Duration("client-write-timeout", 0, "Give a client that doesn't read the response as fast as the agent sends it this long to catch up before its connection is closed with 504, 0 closes it once --max-conn-buffered-bytes is exceeded")
+		keepAlive    = flag.Duration("client-keepalive-period", defaults.HTTP.ClientKeepAlivePeriod.Duration, "Period of the TCP keepalive probes of client connections, a negative value disables them")
+		readHeader   = flag.Duration("http-read-header-timeout", defaults.HTTP.ReadHeaderTimeout.Duration, "Close the client connections that don't send the headers of a request within this duration, e.g. slow-loris attacks, a negative value disables it")
+		readTimeout  = flag.Duration("http-read-timeout", 0, "Bound reading a whole request, body included, the tunneled HTTP/1.1 connections are not bounded but HTTP/2 streaming requests, e.g. gRPC client streams, break, 0 disables it")
+		respTimeout  = flag.Duration("http-write-timeout", 0, "Bound the time to write the response to a request, the tunneled HTTP/1.1 connections are not bounded but HTTP/2 streaming responses, e.g. gRPC server streams, break, 0 disables it")
+		metricsAddr  = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. :9090, disabled if empty")
+		listenNet    = flag.String("listen-network", "", "Network of the listeners, tcp4 or tcp6 to only listen on IPv4 or IPv6, e.g. with --grpc-address [::1]:8443, defaults to tcp")
+		adminToken   = flag.String("admin-token-file", "", "Path to a file with the bearer token of the admin API, e.g. POST /admin/tunnels/<cluster>/disconnect, disabled if empty")
+		enableDebug  = flag.Bool("enable-debug-endpoints", false, "Serve /debug/tunnels on the HTTP server, it exposes the connected cluster names")
+		singlePort   = flag.Bool("single-port", false, "Serve the HTTP requests on --grpc-address too, e.g. behind a load balancer exposing one port, --http-address is then unused")
+		enableHTTP2  = flag.Bool("enable-http2", false, "Serve HTTP/2 on the HTTP server, with TLS and in cleartext, so that gRPC clients can call gRPC services in the clusters")
+		adminAddr    = flag.String("admin-address", "", "Address of a separate HTTP server for the admin API, /debug/tunnels and /metrics, e.g. 127.0.0.1:9443, they're not served on --http-address then, disabled if empty")
+		identityHdr  = flag.String("identity-header", "", "Header identifying the users allowed into the clusters under maintenance, e.g. X-Remote-User set by an authenticating proxy, see PUT /admin/maintenance/<cluster>?allow=<identity>")
+		enablePprof  = flag.Bool("enable-pprof", false, "Serve the pprof profiles under /debug/pprof/ on the admin server, requires --admin-address")
+		captureDir   = flag.String("capture-dir", "", "Directory to capture the packets of every connection to for debugging, see tunnelcap, disabled if empty")
+		captureData  = flag.Int("capture-max-data-size", 0, "Size of the data prefix captured for each packet, 0 only captures the packet metadata")
+		showVersion  = flag.Bool("version", false, "Print the version of the hub and exit")
+		secHeaders   = flag.String("security-headers", "", `Security headers added to every HTTP response as a JSON map, e.g. {"X-Frame-Options":"DENY"}, "default" adds HSTS, X-Content-Type-Options and X-Frame-Options`)
 	)
 
 	klog.InitFlags(nil)
 	flag.Parse()
 
-	klog.InfoS("Starting multiclustertunnel server",
-		"grpc_address", *grpcAddr,
-		"http_address", *httpAddr,
-		"grpc_tls_enabled", *grpcCertFile != "" && *grpcKeyFile != "",
-		"http_tls_enabled", *httpCertFile != "" && *httpKeyFile != "")
-
-	// Create server configuration
-	config := &server.Config{
-		GRPCListenAddress: *grpcAddr,
-		HTTPListenAddress: *httpAddr,
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
 	}
 
-	// Configure gRPC TLS
-	if *grpcCertFile != "" && *grpcKeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(*grpcCertFile, *grpcKeyFile)
-		if err != nil {
-			klog.ErrorS(err, "Failed to load gRPC TLS certificate")
+	var securityHeaders map[string]string
+	if *secHeaders != "" && *secHeaders != "default" {
+		if err := json.Unmarshal([]byte(*secHeaders), &securityHeaders); err != nil {
+			klog.ErrorS(err, "Failed to parse security headers", "security_headers", *secHeaders)
 			os.Exit(1)
 		}
+	}
 
-		grpcTLSConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.NoClientCert,
-		}
-
-		config.GRPCTLSConfig = grpcTLSConfig
-		klog.InfoS("gRPC TLS enabled", "cert_file", *grpcCertFile, "key_file", *grpcKeyFile)
-	} else {
-		klog.InfoS("gRPC TLS not configured - using insecure connection")
+	// applyFlags overrides the config with the flags set on the command line
+	applyFlags := func(c *config.ServerConfig) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "grpc-address":
+				c.GRPC.Address = *grpcAddr
+			case "http-address":
+				c.HTTP.Address = *httpAddr
+			case "grpc-cert-file":
+				c.GRPC.TLS.CertFile = *grpcCertFile
+			case "grpc-key-file":
+				c.GRPC.TLS.KeyFile = *grpcKeyFile
+			case "http-cert-file":
+				c.HTTP.TLS.CertFile = *httpCertFile
+			case "http-key-file":
+				c.HTTP.TLS.KeyFile = *httpKeyFile
+			case "require-tls":
+				c.RequireTLS = *requireTLS
+			case "min-tls-version":
+				c.MinTLSVersion = *minTLS
+			case "log-format":
+				c.Logging.Format = *logFormat
+			case "v":
+				c.Logging.Verbosity, _ = strconv.Atoi(f.Value.String())
+			case "cluster-name-qps":
+				c.RateLimit.ClusterNameQPS = *parseQPS
+			case "cluster-name-burst":
+				c.RateLimit.ClusterNameBurst = *parseBurst
+			case "tunnel-handshake-timeout":
+				c.Tunnel.HandshakeTimeout.Duration = *handshake
+			case "slow-start-window":
+				c.Tunnel.SlowStartWindow.Duration = *slowStart
+			case "slow-start-qps":
+				c.Tunnel.SlowStartQPS = *slowStartQPS
+			case "max-conns-per-cluster":
+				c.Tunnel.MaxPacketConnsPerCluster = *maxConns
+			case "max-conn-buffered-bytes":
+				c.Tunnel.MaxPacketConnBufferedBytes = *maxBuffered
+			case "resume-window":
+				c.Tunnel.ResumeWindow.Duration = *resumeWindow
+			case "resume-max-buffered-bytes":
+				c.Tunnel.ResumeMaxBufferedBytes = *resumeBytes
+			case "tunnel-last-seen-retention":
+				c.Tunnel.LastSeenRetention.Duration = *lastSeen
+			case "enable-integrity-check":
+				c.Tunnel.EnableIntegrityCheck = *integrity
+			case "client-idle-timeout":
+				c.HTTP.ClientIdleTimeout.Duration = *idleTimeout
+			case "client-write-timeout":
+				c.HTTP.ClientWriteTimeout.Duration = *writeTimeout
+			case "client-keepalive-period":
+				c.HTTP.ClientKeepAlivePeriod.Duration = *keepAlive
+			case "http-read-header-timeout":
+				c.HTTP.ReadHeaderTimeout.Duration = *readHeader
+			case "http-read-timeout":
+				c.HTTP.ReadTimeout.Duration = *readTimeout
+			case "http-write-timeout":
+				c.HTTP.WriteTimeout.Duration = *respTimeout
+			case "metrics-address":
+				c.MetricsAddress = *metricsAddr
+			case "listen-network":
+				c.ListenNetwork = *listenNet
+			case "admin-token-file":
+				c.HTTP.AdminTokenFile = *adminToken
+			case "enable-debug-endpoints":
+				c.HTTP.EnableDebugEndpoints = *enableDebug
+			case "single-port":
+				c.GRPC.SinglePortMode = *singlePort
+			case "enable-http2":
+				c.HTTP.EnableHTTP2 = *enableHTTP2
+			case "admin-address":
+				c.HTTP.AdminAddress = *adminAddr
+			case "identity-header":
+				c.HTTP.IdentityHeader = *identityHdr
+			case "enable-pprof":
+				c.HTTP.EnablePprof = *enablePprof
+			case "capture-dir":
+				c.Capture.Dir = *captureDir
+			case "capture-max-data-size":
+				c.Capture.MaxDataSize = *captureData
+			case "security-headers":
+				c.HTTP.DefaultSecurityHeaders = *secHeaders == "default"
+				c.HTTP.SecurityHeaders = securityHeaders
+			}
+		})
 	}
 
-	// Configure HTTP TLS
-	if *httpCertFile != "" && *httpKeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(*httpCertFile, *httpKeyFile)
-		if err != nil {
-			klog.ErrorS(err, "Failed to load HTTP TLS certificate")
-			os.Exit(1)
-		}
+	cfg, err := loadConfig(*configFile, applyFlags)
+	if err != nil {
+		klog.ErrorS(err, "Invalid configuration")
+		os.Exit(1)
+	}
+	setVerbosity(cfg.Logging.Verbosity)
 
-		httpTLSConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.NoClientCert,
-		}
+	klog.InfoS("Starting multiclustertunnel server",
+		"config_file", *configFile,
+		"grpc_address", cfg.GRPC.Address,
+		"http_address", cfg.HTTP.Address,
+		"grpc_tls_enabled", cfg.GRPC.TLS.Enabled(),
+		"http_tls_enabled", cfg.HTTP.TLS.Enabled())
 
-		config.HTTPTLSConfig = httpTLSConfig
-		klog.InfoS("HTTP TLS enabled", "cert_file", *httpCertFile, "key_file", *httpKeyFile)
-	} else {
-		klog.InfoS("HTTP TLS not configured - using insecure connection")
+	// Create server configuration
+	serverConfig, err := cfg.ToServerConfig()
+	if err != nil {
+		klog.ErrorS(err, "Failed to create server configuration")
+		os.Exit(1)
+	}
+	if serverConfig.AdminAuthenticator != nil {
+		klog.InfoS("Admin API enabled")
 	}
 
-	// Create default implementation of ClusterNameParser
+	// Create default implementation of ClusterNameParser. With a config file the limiter is always installed, so the
+	// rate limit can be enabled by a reload
 	clusterNameParser := server.NewClusterNameParserImplt()
+	var limiter *rate.Limiter
+	if cfg.RateLimit.ClusterNameQPS > 0 || *configFile != "" {
+		limiter = rate.NewLimiter(cfg.RateLimit.Limit(), cfg.RateLimit.ClusterNameBurst)
+		clusterNameParser = server.NewRateLimitingClusterNameParser(clusterNameParser, limiter)
+	}
+	if cfg.RateLimit.ClusterNameQPS > 0 {
+		klog.InfoS("Cluster name rate limiting enabled", "qps", cfg.RateLimit.ClusterNameQPS, "burst", cfg.RateLimit.ClusterNameBurst)
+	}
 
 	// Create the server with default implementation
-	hubServer, err := server.New(config, clusterNameParser)
+	hubServer, err := server.New(serverConfig, clusterNameParser)
 	if err != nil {
 		klog.ErrorS(err, "Failed to create hub server")
 		os.Exit(1)
@@ -91,10 +219,18 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if cfg.MetricsAddress != "" {
+		go serveMetrics(cfg.ListenNetwork, cfg.MetricsAddress)
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	if *configFile != "" {
+		signal.Notify(hupCh, syscall.SIGHUP)
+	}
 
-	klog.InfoS("Server started", "grpc_address", *grpcAddr, "http_address", *httpAddr)
+	klog.InfoS("Server started", "grpc_address", cfg.GRPC.Address, "http_address", cfg.HTTP.Address)
 
 	// Start server in a goroutine
 	errCh := make(chan error, 1)
@@ -103,17 +239,84 @@ func main() {
 	}()
 
 	// Wait for shutdown signal or error
-	select {
-	case <-sigCh:
-		klog.InfoS("Received shutdown signal, stopping server...")
-		cancel()
-		hubServer.Shutdown(context.Background())
-	case err := <-errCh:
-		if err != nil {
-			klog.ErrorS(err, "Server stopped with error")
-			os.Exit(1)
+	for {
+		select {
+		case <-hupCh:
+			reloadConfig(cfg, *configFile, applyFlags, limiter)
+			continue
+		case <-sigCh:
+			klog.InfoS("Received shutdown signal, stopping server...")
+			cancel()
+			hubServer.Shutdown(context.Background())
+		case err := <-errCh:
+			if err != nil {
+				klog.ErrorS(err, "Server stopped with error")
+				os.Exit(1)
+			}
 		}
+		break
 	}
 
 	klog.InfoS("Server stopped")
 }
+
+// loadConfig loads the config file at path, or the defaults if path is empty, and applies the flags to it
+func loadConfig(path string, applyFlags func(*config.ServerConfig)) (*config.ServerConfig, error) {
+	if path != "" {
+		return config.LoadServerConfig(path, applyFlags)
+	}
+	c := config.NewServerConfig()
+	applyFlags(c)
+	c.Default()
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid flags: %w", err)
+	}
+	return c, nil
+}
+
+// reloadConfig applies the fields of the config file that can change at runtime, the current config is kept if the
+// file is invalid
+func reloadConfig(cfg *config.ServerConfig, path string, applyFlags func(*config.ServerConfig), limiter *rate.Limiter) {
+	next, err := config.LoadServerConfig(path, applyFlags)
+	if err != nil {
+		klog.ErrorS(err, "Failed to reload config, keeping the current one", "path", path)
+		return
+	}
+	if ignored := cfg.Reload(next); len(ignored) > 0 {
+		klog.InfoS("Config fields changed that only take effect after a restart", "path", path, "fields", ignored)
+	}
+	setVerbosity(cfg.Logging.Verbosity)
+	limiter.SetLimit(cfg.RateLimit.Limit())
+	limiter.SetBurst(cfg.RateLimit.ClusterNameBurst)
+	klog.InfoS("Reloaded config", "path", path,
+		"verbosity", cfg.Logging.Verbosity,
+		"cluster_name_qps", cfg.RateLimit.ClusterNameQPS,
+		"cluster_name_burst", cfg.RateLimit.ClusterNameBurst)
+}
+
+// setVerbosity sets the klog verbosity without marking -v as set on the command line
+func setVerbosity(v int) {
+	if err := flag.Lookup("v").Value.Set(strconv.Itoa(v)); err != nil {
+		klog.ErrorS(err, "Failed to set log verbosity", "verbosity", v)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics and the version on the network, "tcp" if empty, the process keeps
+// running if it fails
+func serveMetrics(network, addr string) {
+	if network == "" {
+		network = "tcp"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/version", version.Handler())
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		klog.ErrorS(err, "Failed to serve metrics", "address", addr)
+		return
+	}
+	klog.InfoS("Serving metrics", "address", listener.Addr().String())
+	if err := http.Serve(listener, mux); err != nil {
+		klog.ErrorS(err, "Failed to serve metrics", "address", addr)
+	}
+}
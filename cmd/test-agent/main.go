@@ -51,6 +51,7 @@ import (
 	"syscall"
 
 	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
@@ -124,25 +125,33 @@ func (r *TestRouter) ParseTargetService(req *http.Request) (string, string, stri
 
 	klog.V(4).InfoS("Routing request", "method", req.Method, "path", req.URL.Path, "uri", req.RequestURI)
 
-	// Parse the request URI to extract routing information
-	pathParams := strings.Split(req.URL.Path, "/")
+	// Parse the request URI to extract routing information, empty segments of duplicate slashes are skipped
+	var pathParams []string
+	for _, segment := range strings.Split(req.URL.Path, "/") {
+		if segment != "" {
+			pathParams = append(pathParams, segment)
+		}
+	}
+	if len(pathParams) == 0 {
+		return "", "", "", fmt.Errorf("%w: no target identifier in path %s", agent.ErrInvalidPath, req.URL.Path)
+	}
 
 	// Extract the target identifier from the first path segment
-	targetIdentifier := pathParams[1]
+	targetIdentifier := pathParams[0]
 
 	// Route based on the target identifier
 	switch targetIdentifier {
 	case "test-simpler-server":
 		// Route to test-simple-server running on localhost:9090
 		klog.V(4).InfoS("Routing to test-simple-server", "target", "localhost:9090")
-		targetPath := "/" + strings.Join(pathParams[2:], "/") // Remove the target identifier from path
+		targetPath := "/" + strings.Join(pathParams[1:], "/") // Remove the target identifier from path
 		return "http", "localhost:9090", targetPath, nil
 
 	case "test-kind-cluster":
 		// Route to Kubernetes API server in kind cluster (typically localhost:8081 or similar)
 		// For testing purposes, we'll use a common kind cluster API server address
 		klog.V(4).InfoS("Routing to test-kind-cluster", "target", "localhost:8081")
-		targetPath := "/" + strings.Join(pathParams[2:], "/") // Remove the target identifier from path
+		targetPath := "/" + strings.Join(pathParams[1:], "/") // Remove the target identifier from path
 		return "http", "localhost:8081", targetPath, nil
 
 	default:
@@ -157,9 +166,16 @@ func main() {
 		socketPath    = flag.String("socket-path", "/tmp/multiclustertunnel.sock", "Path for Unix Domain Socket")
 		useInsecure   = flag.Bool("insecure", false, "Use insecure connection (no TLS)")
 		skipTLSVerify = flag.Bool("skip-tls-verify", false, "Skip TLS certificate verification (for testing)")
+		diagnose      = flag.Bool("diagnose", false, "Check the connectivity to the hub and the socket, print the results and exit")
+		showVersion   = flag.Bool("version", false, "Print the version and exit")
 	)
 	klog.InitFlags(nil)
 	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
 	klog.InfoS("Starting test-agent-client",
 		"hubAddress", *hubAddress,
 		"clusterName", *clusterName,
@@ -177,6 +193,7 @@ func main() {
 	}
 
 	// Configure TLS options
+	var tlsConfig *tls.Config
 	if *useInsecure {
 		// Use insecure connection (no TLS)
 		config.DialOptions = append(config.DialOptions,
@@ -184,7 +201,7 @@ func main() {
 		klog.InfoS("Using insecure connection (no TLS)")
 	} else if *skipTLSVerify {
 		// Use TLS but skip certificate verification (for testing)
-		tlsConfig := &tls.Config{
+		tlsConfig = &tls.Config{
 			InsecureSkipVerify: true,
 		}
 		config.DialOptions = append(config.DialOptions,
@@ -192,12 +209,26 @@ func main() {
 		klog.InfoS("Using TLS with certificate verification disabled (testing only)")
 	} else {
 		// Use TLS with proper certificate verification (default)
-		tlsConfig := &tls.Config{}
+		tlsConfig = &tls.Config{}
 		config.DialOptions = append(config.DialOptions,
 			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 		klog.InfoS("Using TLS with certificate verification enabled")
 	}
 
+	// The test implementations don't route to an apiserver, it's not checked
+	if *diagnose {
+		report, err := agent.Diagnose(ctx, &agent.DiagnoseConfig{Agent: config, HubTLSConfig: tlsConfig})
+		if err != nil {
+			klog.ErrorS(err, "Failed to diagnose the agent")
+			os.Exit(1)
+		}
+		report.Print(os.Stdout)
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create the agent client with test implementations
 	client := agent.New(ctx, config,
 		&TestRequestProcessor{},
@@ -4,12 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"k8s.io/klog/v2"
@@ -26,12 +28,19 @@ var (
 	// HTTP TLS configuration
 	httpCertFile = flag.String("http-cert-file", "", "Path to TLS certificate file for HTTP server")
 	httpKeyFile  = flag.String("http-key-file", "", "Path to TLS private key file for HTTP server")
+
+	showVersion = flag.Bool("version", false, "Print the version and exit")
 )
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
 	// Create hub server with both HTTP and gRPC
 	config := &server.Config{
 		GRPCListenAddress: *grpcAddr,
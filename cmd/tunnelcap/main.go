@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+)
+
+// previewSize is the size of the data preview of each packet
+const previewSize = 64
+
+func main() {
+	var (
+		reassemble = flag.Bool("reassemble", false, "Print the reassembled request and response streams instead of the packets")
+		help       = flag.Bool("help", false, "Show help message")
+	)
+	flag.Parse()
+
+	if *help || flag.NArg() == 0 {
+		fmt.Println("Packet capture reader for MultiClusterTunnel")
+		fmt.Println("")
+		fmt.Println("Usage:")
+		fmt.Printf("  %s [flags] <capture-file>...\n", os.Args[0])
+		fmt.Println("")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+		fmt.Println("")
+		fmt.Println("The capture files are written by the hub to the directory set with --capture-dir.")
+		fmt.Println("Reassembling requires the hub to capture the whole packets, see --capture-max-data-size.")
+		return
+	}
+
+	for _, path := range flag.Args() {
+		records, err := capture.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+
+		fmt.Printf("==> %s (%d packets) <==\n", path, len(records))
+		if *reassemble {
+			streams, err := capture.Reassemble(records)
+			if err != nil {
+				log.Fatalf("Failed to reassemble %s: %v", path, err)
+			}
+			fmt.Printf("--- %s ---\n%s\n", capture.ToAgent, streams[capture.ToAgent])
+			fmt.Printf("--- %s ---\n%s\n", capture.FromAgent, streams[capture.FromAgent])
+			continue
+		}
+
+		for _, record := range records {
+			printRecord(record)
+		}
+	}
+}
+
+// printRecord prints a packet on a line with a preview of its data
+func printRecord(record capture.Record) {
+	line := fmt.Sprintf("%s %-10s conn_id=%d %-5s len=%d", record.Time.Format("15:04:05.000000"),
+		record.Direction, record.ConnID, record.Code, record.Length)
+	if record.ErrorMessage != "" {
+		line += " error=" + strconv.Quote(record.ErrorMessage)
+	}
+	if len(record.Data) > 0 {
+		preview := record.Data[:min(len(record.Data), previewSize)]
+		line += " data=" + strconv.Quote(string(preview))
+		if len(preview) < record.Length {
+			line += "..."
+		}
+	}
+	fmt.Println(line)
+}
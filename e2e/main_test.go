@@ -155,36 +155,28 @@ func setupCertificates(ctx context.Context, cfg *envconf.Config) (context.Contex
 func setupRBACResources(ctx context.Context, cfg *envconf.Config) (context.Context, error) {
 	log.Printf("Setting up RBAC resources...")
 
-	// Create server RBAC resources
-	serverRBACTemplates := []string{
-		"server/serviceaccount.yaml",
-		"server/clusterrole.yaml",
-		"server/clusterrolebinding.yaml",
+	// Create server RBAC resources, the cluster role and its binding are in one template
+	serverParams := map[string]interface{}{
+		"Namespace": hubNamespace,
+		"Name":      "mctunnel-server",
 	}
-
-	for _, template := range serverRBACTemplates {
-		if err := applyTemplate(ctx, cfg, template, map[string]interface{}{
-			"Namespace": hubNamespace,
-			"Name":      "mctunnel-server",
-		}); err != nil {
-			return ctx, err
-		}
+	if err := applyTemplate(ctx, cfg, "server/serviceaccount.yaml", serverParams); err != nil {
+		return ctx, err
+	}
+	if err := applyTemplateList(ctx, cfg, "server/rbac.yaml", serverParams); err != nil {
+		return ctx, err
 	}
 
 	// Create agent RBAC resources
-	agentRBACTemplates := []string{
-		"agent/serviceaccount.yaml",
-		"agent/clusterrole.yaml",
-		"agent/clusterrolebinding.yaml",
+	agentParams := map[string]interface{}{
+		"Namespace": agentNamespace,
+		"Name":      "mctunnel-agent",
 	}
-
-	for _, template := range agentRBACTemplates {
-		if err := applyTemplate(ctx, cfg, template, map[string]interface{}{
-			"Namespace": agentNamespace,
-			"Name":      "mctunnel-agent",
-		}); err != nil {
-			return ctx, err
-		}
+	if err := applyTemplate(ctx, cfg, "agent/serviceaccount.yaml", agentParams); err != nil {
+		return ctx, err
+	}
+	if err := applyTemplateList(ctx, cfg, "agent/rbac.yaml", agentParams); err != nil {
+		return ctx, err
 	}
 
 	log.Printf("RBAC resources setup completed")
@@ -234,7 +226,7 @@ func createNamespaceFromTemplate(ctx context.Context, cfg *envconf.Config, templ
 
 // generateTestCertificates generates certificates for testing
 func generateTestCertificates() (*utils.CertificateBundle, error) {
-	return utils.GenerateTestCertificates()
+	return utils.GenerateTestCertificates(utils.CertOptions{})
 }
 
 // createCertificateSecret creates a certificate secret
@@ -251,3 +243,8 @@ func createHubKubeConfigSecret(ctx context.Context, cfg *envconf.Config, namespa
 func applyTemplate(ctx context.Context, cfg *envconf.Config, templateFile string, params map[string]interface{}) error {
 	return utils.ApplyTemplate(ctx, cfg, templateFile, params)
 }
+
+// applyTemplateList applies a multi-document template with parameters
+func applyTemplateList(ctx context.Context, cfg *envconf.Config, templateFile string, params map[string]interface{}) error {
+	return utils.ApplyTemplateList(ctx, cfg, templateFile, params)
+}
@@ -2,19 +2,14 @@ package utils
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
-	"math/big"
-	"net"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/e2e-framework/pkg/envconf"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
 )
 
 // CertificateBundle contains all certificates needed for testing
@@ -27,186 +22,70 @@ type CertificateBundle struct {
 	ClientKey  string
 }
 
-// GenerateTestCertificates generates a complete set of certificates for e2e testing
-func GenerateTestCertificates() (*CertificateBundle, error) {
-	// Generate CA certificate and key
-	caCert, caKey, err := generateCACertificate()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate CA certificate: %w", err)
-	}
-
-	// Generate server certificate and key
-	serverCert, serverKey, err := generateServerCertificate(caCert, caKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate server certificate: %w", err)
-	}
+// KeyAlgorithm is the algorithm of the private keys of the test certificates
+type KeyAlgorithm = certutil.KeyAlgorithm
 
-	// Generate client certificate and key
-	clientCert, clientKey, err := generateClientCertificate(caCert, caKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate client certificate: %w", err)
-	}
+const (
+	RSA2048  = certutil.RSA2048
+	ECDSA256 = certutil.ECDSA256
+	ECDSA384 = certutil.ECDSA384
+)
 
-	return &CertificateBundle{
-		CACert:     encodeCertToPEM(caCert),
-		CAKey:      encodeKeyToPEM(caKey),
-		ServerCert: encodeCertToPEM(serverCert),
-		ServerKey:  encodeKeyToPEM(serverKey),
-		ClientCert: encodeCertToPEM(clientCert),
-		ClientKey:  encodeKeyToPEM(clientKey),
-	}, nil
+// ServerSANs are the SANs of the server certificate, the hub service in the hub cluster and the loopback addresses
+var ServerSANs = []string{
+	"mctunnel-server",
+	"mctunnel-server.mctunnel-hub",
+	"mctunnel-server.mctunnel-hub.svc",
+	"mctunnel-server.mctunnel-hub.svc.cluster.local",
+	"localhost",
+	"127.0.0.1",
+	"::1",
 }
 
-// generateCACertificate generates a CA certificate and private key
-func generateCACertificate() (*x509.Certificate, *rsa.PrivateKey, error) {
-	// Generate private key
-	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// Create certificate template
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization:  []string{"MultiClusterTunnel E2E Test"},
-			Country:       []string{"US"},
-			Province:      []string{"CA"},
-			Locality:      []string{"San Francisco"},
-			StreetAddress: []string{""},
-			PostalCode:    []string{""},
-			CommonName:    "MultiClusterTunnel E2E CA",
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(24 * time.Hour), // Valid for 24 hours
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
-
-	// Create certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &caKey.PublicKey, caKey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// Parse certificate
-	cert, err := x509.ParseCertificate(certDER)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return cert, caKey, nil
+// CertOptions configures GenerateTestCertificates
+type CertOptions struct {
+	// KeyAlgorithm of the CA, server and client keys, defaults to ECDSA256
+	KeyAlgorithm KeyAlgorithm
+	// Validity of the certificates, defaults to 24 hours
+	Validity time.Duration
+	// ServerSANs of the server certificate, defaults to ServerSANs
+	ServerSANs []string
 }
 
-// generateServerCertificate generates a server certificate signed by the CA
-func generateServerCertificate(caCert *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
-	// Generate private key
-	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// Create certificate template with SAN entries for Kubernetes services
-	dnsNames := []string{
-		"mctunnel-server",
-		"mctunnel-server.mctunnel-hub",
-		"mctunnel-server.mctunnel-hub.svc",
-		"mctunnel-server.mctunnel-hub.svc.cluster.local",
-		"localhost",
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(2),
-		Subject: pkix.Name{
-			Organization: []string{"MultiClusterTunnel E2E Test"},
-			Country:      []string{"US"},
-			Province:     []string{"CA"},
-			Locality:     []string{"San Francisco"},
-			CommonName:   "mctunnel-server",
-		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(24 * time.Hour),
-		DNSNames:  dnsNames,
-		IPAddresses: []net.IP{
-			net.IPv4(127, 0, 0, 1),
-			net.IPv6loopback,
-		},
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-	}
-
-	// Create certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, caCert, &serverKey.PublicKey, caKey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// Parse certificate
-	cert, err := x509.ParseCertificate(certDER)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return cert, serverKey, nil
-}
-
-// generateClientCertificate generates a client certificate signed by the CA
-func generateClientCertificate(caCert *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
-	// Generate private key
-	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// GenerateTestCertificates generates a complete set of certificates for e2e testing
+func GenerateTestCertificates(opts CertOptions) (*CertificateBundle, error) {
+	ca, err := certutil.NewCA(certutil.Options{
+		KeyAlgorithm: opts.KeyAlgorithm,
+		Validity:     opts.Validity,
+		Organization: "MultiClusterTunnel E2E Test",
+		CommonName:   "MultiClusterTunnel E2E CA",
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Create certificate template
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(3),
-		Subject: pkix.Name{
-			Organization: []string{"MultiClusterTunnel E2E Test"},
-			Country:      []string{"US"},
-			Province:     []string{"CA"},
-			Locality:     []string{"San Francisco"},
-			CommonName:   "mctunnel-client",
-		},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().Add(24 * time.Hour),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
+	sans := opts.ServerSANs
+	if len(sans) == 0 {
+		sans = ServerSANs
 	}
-
-	// Create certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, caCert, &clientKey.PublicKey, caKey)
+	server, err := ca.IssueServer(sans...)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Parse certificate
-	cert, err := x509.ParseCertificate(certDER)
+	client, err := ca.IssueClient("mctunnel-client")
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return cert, clientKey, nil
-}
-
-// encodeCertToPEM encodes a certificate to PEM format
-func encodeCertToPEM(cert *x509.Certificate) string {
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: cert.Raw,
-	})
-	return string(certPEM)
-}
-
-// encodeKeyToPEM encodes a private key to PEM format
-func encodeKeyToPEM(key *rsa.PrivateKey) string {
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
-	return string(keyPEM)
+	return &CertificateBundle{
+		CACert:     string(ca.CertPEM),
+		CAKey:      string(ca.KeyPEM),
+		ServerCert: string(server.CertPEM),
+		ServerKey:  string(server.KeyPEM),
+		ClientCert: string(client.CertPEM),
+		ClientKey:  string(client.KeyPEM),
+	}, nil
 }
 
 // CreateCertificateSecret creates a Kubernetes secret with certificate data
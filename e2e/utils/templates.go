@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"text/template"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -26,60 +28,58 @@ func NewTemplateRenderer(templateDir string) *TemplateRenderer {
 	}
 }
 
+// documentSeparator matches the --- lines separating the documents of a multi-document YAML manifest
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
 // RenderTemplate renders a template file with the given parameters
 func (tr *TemplateRenderer) RenderTemplate(templateFile string, params interface{}) (client.Object, error) {
-	templatePath := filepath.Join(tr.templateDir, templateFile)
-
-	// Create template with helper functions
-	tmpl := template.New(filepath.Base(templateFile)).Funcs(template.FuncMap{
-		"b64enc": func(s string) string {
-			return base64.StdEncoding.EncodeToString([]byte(s))
-		},
-		"b64dec": func(s string) (string, error) {
-			data, err := base64.StdEncoding.DecodeString(s)
-			return string(data), err
-		},
-		"default": func(defaultValue, value interface{}) interface{} {
-			if value == nil || value == "" {
-				return defaultValue
-			}
-			return value
-		},
-		"eq": func(a, b interface{}) bool {
-			return a == b
-		},
-		"ne": func(a, b interface{}) bool {
-			return a != b
-		},
-		"quote": func(s interface{}) string {
-			return fmt.Sprintf("%q", s)
-		},
-	})
-
-	// Parse the template file
-	tmpl, err := tmpl.ParseFiles(templatePath)
+	objs, err := tr.RenderTemplateList(templateFile, params)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse template %s: %w", templateFile, err)
+		return nil, err
+	}
+	// Only applying the first document of a multi-document manifest would leave the others out silently
+	if len(objs) != 1 {
+		return nil, fmt.Errorf("rendered template %s has %d documents, use ApplyTemplateList for multi-document templates", templateFile, len(objs))
 	}
+	return objs[0], nil
+}
 
-	// Execute the template with parameters
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, params); err != nil {
-		return nil, fmt.Errorf("failed to execute template %s: %w", templateFile, err)
+// RenderTemplateList renders a template file of one or more YAML documents separated by ---, the empty documents
+// are skipped
+func (tr *TemplateRenderer) RenderTemplateList(templateFile string, params interface{}) ([]client.Object, error) {
+	rendered, err := tr.RenderTemplateToString(templateFile, params)
+	if err != nil {
+		return nil, err
 	}
 
-	// Decode the rendered YAML into a Kubernetes object
+	// Decode each rendered YAML document into a Kubernetes object
 	decoder := yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
-	obj := &unstructured.Unstructured{}
-
-	if _, _, err := decoder.Decode(buf.Bytes(), nil, obj); err != nil {
-		return nil, fmt.Errorf("failed to decode rendered template %s: %w", templateFile, err)
+	var objs []client.Object
+	for i, document := range documentSeparator.Split(rendered, -1) {
+		if isEmptyDocument(document) {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		if _, _, err := decoder.Decode([]byte(document), nil, obj); err != nil {
+			return nil, fmt.Errorf("failed to decode document %d of rendered template %s: %w", i, templateFile, err)
+		}
+		objs = append(objs, obj)
 	}
+	return objs, nil
+}
 
-	return obj, nil
+// isEmptyDocument returns whether the YAML document only has blank lines and comments
+func isEmptyDocument(document string) bool {
+	for _, line := range strings.Split(document, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
 }
 
-// ApplyTemplate renders and applies a template to the cluster
+// ApplyTemplate renders and applies a template of a single document to the cluster
 func (tr *TemplateRenderer) ApplyTemplate(ctx context.Context, cfg *envconf.Config, templateFile string, params interface{}) error {
 	obj, err := tr.RenderTemplate(templateFile, params)
 	if err != nil {
@@ -94,6 +94,23 @@ func (tr *TemplateRenderer) ApplyTemplate(ctx context.Context, cfg *envconf.Conf
 	return nil
 }
 
+// ApplyTemplateList renders a multi-document template and applies its documents to the cluster in order, e.g. a
+// role and its binding
+func (tr *TemplateRenderer) ApplyTemplateList(ctx context.Context, cfg *envconf.Config, templateFile string, params interface{}) error {
+	objs, err := tr.RenderTemplateList(templateFile, params)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		if err := cfg.Client().Resources().Create(ctx, obj); err != nil {
+			return fmt.Errorf("failed to apply %s %s of template %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName(), templateFile, err)
+		}
+	}
+
+	return nil
+}
+
 // RenderTemplateToString renders a template to a string (useful for debugging)
 func (tr *TemplateRenderer) RenderTemplateToString(templateFile string, params interface{}) (string, error) {
 	templatePath := filepath.Join(tr.templateDir, templateFile)
@@ -124,11 +141,13 @@ func (tr *TemplateRenderer) RenderTemplateToString(templateFile string, params i
 		},
 	})
 
+	// Parse the template file
 	tmpl, err := tmpl.ParseFiles(templatePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse template %s: %w", templateFile, err)
 	}
 
+	// Execute the template with parameters
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, params); err != nil {
 		return "", fmt.Errorf("failed to execute template %s: %w", templateFile, err)
@@ -158,6 +177,14 @@ func ApplyTemplate(ctx context.Context, cfg *envconf.Config, templateFile string
 	return GlobalRenderer.ApplyTemplate(ctx, cfg, templateFile, params)
 }
 
+// ApplyTemplateList applies a multi-document template using the global renderer
+func ApplyTemplateList(ctx context.Context, cfg *envconf.Config, templateFile string, params interface{}) error {
+	if GlobalRenderer == nil {
+		return fmt.Errorf("global template renderer not initialized")
+	}
+	return GlobalRenderer.ApplyTemplateList(ctx, cfg, templateFile, params)
+}
+
 // RenderTemplateToString renders a template to string using the global renderer
 func RenderTemplateToString(templateFile string, params interface{}) (string, error) {
 	if GlobalRenderer == nil {
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const multiDocumentTemplate = `---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+---
+# The role of the service account
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get"]
+---
+---
+# Nothing here
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}
+subjects:
+- kind: ServiceAccount
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+`
+
+func TestRenderTemplateList(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rbac.yaml"), []byte(multiDocumentTemplate), 0o600); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+	tr := NewTemplateRenderer(dir)
+	params := map[string]interface{}{"Name": "reader", "Namespace": "test"}
+
+	objs, err := tr.RenderTemplateList("rbac.yaml", params)
+	if err != nil {
+		t.Fatalf("failed to render template: %v", err)
+	}
+	// The empty documents are skipped, the others are kept in order
+	expectedKinds := []string{"ServiceAccount", "Role", "RoleBinding"}
+	if len(objs) != len(expectedKinds) {
+		t.Fatalf("expected %d objects, got %d", len(expectedKinds), len(objs))
+	}
+	for i, obj := range objs {
+		kind := obj.GetObjectKind().GroupVersionKind().Kind
+		if kind != expectedKinds[i] || obj.GetName() != "reader" || obj.GetNamespace() != "test" {
+			t.Errorf("expected %s test/reader, got %s %s/%s", expectedKinds[i], kind, obj.GetNamespace(), obj.GetName())
+		}
+	}
+
+	// A single object can't be rendered from it without dropping the others
+	if _, err := tr.RenderTemplate("rbac.yaml", params); err == nil {
+		t.Errorf("expected an error rendering a multi-document template as a single object")
+	}
+}
+
+func TestRenderRBACTemplates(t *testing.T) {
+	tr := NewTemplateRenderer(filepath.Join("..", "templates"))
+	for _, component := range []string{"server", "agent"} {
+		objs, err := tr.RenderTemplateList(component+"/rbac.yaml", map[string]interface{}{"Name": "mctunnel-" + component, "Namespace": "test"})
+		if err != nil {
+			t.Fatalf("failed to render the %s RBAC template: %v", component, err)
+		}
+		if len(objs) != 2 || objs[0].GetObjectKind().GroupVersionKind().Kind != "ClusterRole" ||
+			objs[1].GetObjectKind().GroupVersionKind().Kind != "ClusterRoleBinding" {
+			t.Errorf("expected the cluster role and its binding for %s, got %d objects", component, len(objs))
+		}
+	}
+}
@@ -2,25 +2,273 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v5"
 	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/logging"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/rtt"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
 // Config holds all configuration for the Agent.
 type Config struct {
-	HubAddress     string
-	ClusterName    string
-	UDSSocketPath  string                 // Path for Unix Domain Socket, defaults to "/tmp/multiclustertunnel.sock"
-	DialOptions    []grpc.DialOption      // Used to pass gRPC configurations such as TLS, KeepAlive, etc.
-	BackoffFactory func() backoff.BackOff // Allows custom backoff strategy
+	HubAddress    string
+	ClusterName   string
+	UDSSocketPath string            // Path for Unix Domain Socket, defaults to "/tmp/multiclustertunnel.sock"
+	DialOptions   []grpc.DialOption // Used to pass gRPC configurations such as TLS, KeepAlive, etc.
+	// ContextDialer dials the connections to the Hub instead of the dialer of gRPC, e.g. to an in-memory listener of
+	// a test with a "passthrough:///" HubAddress. addr is the address resolved from HubAddress
+	ContextDialer func(ctx context.Context, addr string) (net.Conn, error)
+	// UDSSocketPermissions are the permissions the socket files of the proxies are set to once they're created,
+	// instead of the ones left by the umask. Defaults to DefaultUDSSocketPermissions
+	UDSSocketPermissions os.FileMode
+	// UDSSocketOwnership changes the owner and the group of the socket files of the proxies once they're created,
+	// e.g. when the clients connecting to them run as another user than the agent. It requires the agent to run as
+	// root or with CAP_CHOWN. Nil keeps the user and the group of the agent
+	UDSSocketOwnership *UDSSocketOwnership
+	// UseAbstractNamespace binds and dials the sockets of the proxies in the Linux abstract namespace, at their path
+	// prefixed with a NUL byte, so that no stale socket file is left behind after a crash. UDSSocketPermissions and
+	// UDSSocketOwnership don't apply to them, any process of the network namespace of the agent can connect. Only supported on Linux
+	UseAbstractNamespace bool
+	// TLSServerName is the name the certificate of the Hub is verified for and sent as SNI, e.g. when HubAddress is
+	// the IP or internal name of a load balancer in front of the Hub. It's used by the TLS credentials of DialOptions
+	// whose tls.Config doesn't set a ServerName. Defaults to the host of HubAddress
+	TLSServerName string
+	// PinnedHubSPKIHashes pins the public key of the Hub, e.g. for the edge agents that can't be given a CA bundle:
+	// each is the base64 SHA-256 of a SubjectPublicKeyInfo, see SPKIHash. When set, the agent dials the Hub with TLS
+	// credentials built from HubTLSConfig that accept a certificate whose public key is pinned, or that is verified
+	// by HubTLSConfig.RootCAs if they're set. They replace the transport credentials of DialOptions. Pin the keys of
+	// the current and the next certificate of the Hub while rotating it
+	PinnedHubSPKIHashes []string
+	// RequireHubCAAndPin requires the certificate of the Hub to be both pinned and verified by HubTLSConfig.RootCAs,
+	// the system roots if they're nil, instead of either of them
+	RequireHubCAAndPin bool
+	// HubTLSConfig is the TLS config of the credentials built for PinnedHubSPKIHashes, e.g. with the client
+	// certificate and the RootCAs. Its ServerName defaults to TLSServerName, then to the host of GRPCAuthority, then
+	// to the host of HubAddress
+	HubTLSConfig *tls.Config
+	// RequireTLS refuses to connect to the Hub without TLS, e.g. when DialOptions pass insecure.NewCredentials by
+	// accident: Run fails with ErrTLSRequired instead of connecting in plaintext
+	RequireTLS bool
+	// GRPCAuthority overrides the :authority of the calls to the Hub, e.g. for a gRPC load balancer routing by it.
+	// The TLS credentials of DialOptions whose tls.Config doesn't set a ServerName verify the certificate of the Hub
+	// for it too. Defaults to TLSServerName, then to HubAddress
+	GRPCAuthority  string
+	BackoffFactory func() backoff.BackOff // Allows custom backoff strategy, PermanentErrors are never retried
+	// Logger is the structured logger for the hot path, e.g. JSON logs via slog.NewJSONHandler, defaults to klog.
+	// The logger is process-wide, it's also used by the package outside of the Agent: Run fails if another agent of
+	// the process runs with a different one
+	Logger *slog.Logger
+	// MaxGRPCMsgSize is the maximum message size in bytes the agent can receive from the Hub, defaults to DefaultMaxGRPCMsgSize
+	MaxGRPCMsgSize int
+	// PingInterval is the interval of the PINGs measuring the round-trip time to the Hub,
+	// defaults to DefaultPingInterval, a negative value disables them
+	PingInterval time.Duration
+	// InitialConnectTimeout bounds the time to establish the first tunnel stream to the Hub,
+	// Run returns ErrInitialConnectTimeout when it's exceeded. 0 means retry forever.
+	InitialConnectTimeout time.Duration
+	// DialContextFn dials the target services of the proxy, e.g. NewKubeDNSDialer to resolve services via the
+	// Kubernetes API, or a dialer through a socks5 proxy for egress. Defaults to a net.Dialer
+	DialContextFn DialContextFunc
+	// ProxyRequestBodyTimeout bounds reading the body of a request from the socket of a proxy, e.g. when the client
+	// stalls while uploading it, the request fails with 408 Request Timeout. Upgrade requests are not bounded.
+	// Defaults to DefaultProxyRequestBodyTimeout, a negative value disables it
+	ProxyRequestBodyTimeout time.Duration
+	// ProxyResponseHeaderTimeout bounds the wait for the response headers of the target service to a RouteUnary
+	// request, the request fails with 504 Gateway Timeout. Defaults to DefaultProxyResponseHeaderTimeout, a negative
+	// value disables it
+	ProxyResponseHeaderTimeout time.Duration
+	// ProxyRequestTimeout bounds a RouteUnary request to the target service as a whole, the RouteStreaming requests,
+	// e.g. watches, are not bounded. The Router classifies the requests if it implements RouteClassifier, they're
+	// classified by ClassifyRequest otherwise. Defaults to DefaultProxyRequestTimeout, a negative value disables it
+	ProxyRequestTimeout time.Duration
+	// IdleConnectionTimeout closes the connections to the proxies that sent no data for this long, e.g. when the Hub
+	// went away without closing them. Defaults to DefaultIdleConnectionTimeout, a negative value disables it
+	IdleConnectionTimeout time.Duration
+	// CustomHeaders are set on every request proxied to the target services once the RequestProcessor processed it,
+	// e.g. a tracing header, they replace the headers of the same name of the request
+	CustomHeaders map[string]string
+	// CustomHeadersFn returns the headers to set on a request once the RequestProcessor processed it, they're set
+	// after CustomHeaders and replace them
+	CustomHeadersFn func(r *http.Request) map[string]string
+	// ReplayableNonIdempotentStatusCodes are the status codes of the target services the POST, PUT and PATCH
+	// requests are replayed once on, e.g. 503 from a kube-apiserver during a rolling restart. Only set the codes
+	// the targets return before they act on a request, e.g. 408 and 503 with Retry-After from the kube-apiserver,
+	// or the replay may create a resource twice. The bodies up to 1MB are buffered for the replay, a Retry-After up
+	// to 5s is waited for. Empty by default
+	ReplayableNonIdempotentStatusCodes []int
+	// QoS prioritizes the interactive connections, e.g. API requests and exec sessions, over the bulk transfers:
+	// the packets to the Hub of the connections that sent more than QoS.BulkThreshold are queued separately and sent
+	// in a weighted round robin, see server.Config.QoS for the packets to the agent. nil disables it
+	QoS *qos.Config
+	// Coalesce sends the small writes of the target services, e.g. the output of an exec session, in fewer packets:
+	// the data read within Coalesce.Delay of the last packet of a connection is buffered for up to Coalesce.Delay, or
+	// until Coalesce.MaxBytes are buffered, the data read after the connection was quiet is sent at once. See
+	// server.Config.Coalesce for the packets to the agent. nil disables it
+	Coalesce *coalesce.Config
+	// Proxies run several proxies, each on its own socket, the proxy of a new connection is chosen by their Selectors.
+	// Defaults to a single proxy on UDSSocketPath with the RequestProcessor, CertificateProvider and Router passed to New
+	Proxies []ProxySpec
+	// MaxConnBufferedBytes is the budget of the data from the Hub buffered for each connection until it's written to
+	// its proxy, the connection is closed with "receiver too slow" when it's exceeded. Defaults to packetqueue.DefaultMaxBytes
+	MaxConnBufferedBytes int
+	// ResumeWindow resumes the open connections on the next tunnel stream if the agent reconnects within this long,
+	// e.g. after the TCP connection to the Hub was reset: the packets lost with the previous stream are retransmitted
+	// instead of failing the in-flight requests. Only Hubs enabling it too resume the connections, see
+	// v1.ProtocolVersionResume. 0 disables it
+	ResumeWindow time.Duration
+	// EnableIntegrityCheck checks the integrity of the data tunneled with the Hubs enabling it too, see
+	// v1.IntegrityMetadataKey: each DATA packet carries the CRC32C of its data, a connection whose data doesn't match
+	// is closed with an INTEGRITY_FAILURE error. The failures are counted in
+	// multiclustertunnel_agent_integrity_failures_total
+	EnableIntegrityCheck bool
+	// ResumeMaxBufferedBytes is the budget of the data sent on each connection kept until the Hub acknowledges it,
+	// the target is not read from while it's exceeded. Defaults to resume.DefaultMaxBytes
+	ResumeMaxBufferedBytes int
+	// StatusHistorySize is the number of the last connection attempts reported by Status, defaults to
+	// DefaultStatusHistorySize
+	StatusHistorySize int
+	// LogPayloadSample logs the first bytes of the first packets of each connection in each direction, as hex and
+	// printable text, for debugging e.g. corrupted bodies. Authorization and Cookie headers are redacted, and the
+	// bytes logged per connection are capped. Disabled if not set
+	LogPayloadSample *capture.SampleConfig
+}
+
+// authority returns the :authority of the calls to the Hub, empty for the default. The TLS credentials verify the
+// certificate of the Hub for the authority if their ServerName is empty
+func (c *Config) authority() string {
+	if c.GRPCAuthority != "" {
+		return c.GRPCAuthority
+	}
+	return c.TLSServerName
+}
+
+// proxySpecs returns the proxies of the agent with their names and socket paths defaulted, a single proxy on
+// UDSSocketPath if Proxies is not set
+func proxySpecs(config *Config) []ProxySpec {
+	if len(config.Proxies) == 0 {
+		// Set default UDS socket path if not provided
+		udsSocketPath := config.UDSSocketPath
+		if udsSocketPath == "" {
+			udsSocketPath = "/tmp/multiclustertunnel.sock"
+		}
+		return []ProxySpec{{Name: "default", SocketPath: udsSocketPath}}
+	}
+
+	specs := slices.Clone(config.Proxies)
+	for i := range specs {
+		if specs[i].Name == "" {
+			specs[i].Name = fmt.Sprintf("proxy-%d", i)
+		}
+		if specs[i].SocketPath == "" {
+			specs[i].SocketPath = fmt.Sprintf("/tmp/multiclustertunnel-%s.sock", specs[i].Name)
+		}
+	}
+	return specs
+}
+
+// DefaultUDSSocketPermissions are the default permissions of the socket files of the proxies, only the user of the
+// agent can connect to them
+const DefaultUDSSocketPermissions os.FileMode = 0o600
+
+// UDSSocketOwnership is the owner and the group of the socket files of the proxies, a negative UID or GID is left
+// unchanged
+type UDSSocketOwnership struct {
+	UID int
+	GID int
+}
+
+// DefaultPingInterval is the default interval of the PINGs measuring the round-trip time to the Hub
+const DefaultPingInterval = 10 * time.Second
+
+// DefaultProxyRequestBodyTimeout is the default timeout of reading the body of a request from the socket of a proxy
+const DefaultProxyRequestBodyTimeout = 60 * time.Second
+
+// DefaultProxyResponseHeaderTimeout is the default timeout of the response headers of a unary request to a target service
+const DefaultProxyResponseHeaderTimeout = 60 * time.Second
+
+// DefaultProxyRequestTimeout is the default timeout of a unary request to a target service
+const DefaultProxyRequestTimeout = 5 * time.Minute
+
+// DefaultIdleConnectionTimeout is the default timeout of the connections to the proxies that sent no data
+const DefaultIdleConnectionTimeout = idleConnectionTimeout
+
+// DefaultMaxGRPCMsgSize is the default maximum size of a gRPC message received from the Hub
+const DefaultMaxGRPCMsgSize = 64 * 1024 * 1024 // 64MB
+
+// shutdownTimeout is how long the agent waits for the connections to the proxies to close once it's stopped
+const shutdownTimeout = 30 * time.Second
+
+// ErrInitialConnectTimeout is returned by Run when the first tunnel stream is not established within Config.InitialConnectTimeout
+var ErrInitialConnectTimeout = errors.New("timed out establishing the initial connection to the hub")
+
+// ErrNotTunnelEndpoint is returned by the attempts to connect to a HubAddress that doesn't serve the tunnel gRPC
+// service, e.g. the HTTP address of the Hub, see Status().LastError
+var ErrNotTunnelEndpoint = errors.New("HubAddress is not the tunnel gRPC address of the Hub, e.g. it's its HTTP address")
+
+// notTunnelEndpointErrors are the errors of grpc-go connecting to a server that isn't a gRPC one: a plaintext HTTP/1.x
+// server, an HTTP/2 server answering with another content type than gRPC's, and a TLS server without HTTP/2
+var notTunnelEndpointErrors = []string{
+	"frame header looked like an HTTP/1.1 header",
+	"received unexpected content-type",
+	"tls: no application protocol",
+}
+
+// permanentCodes are the status codes of the Hub rejecting the agent, e.g. for its cluster name or its certificate,
+// reconnecting would be rejected the same way
+var permanentCodes = []codes.Code{codes.PermissionDenied, codes.Unauthenticated, codes.NotFound}
+
+// PermanentError is returned by Run when the Hub rejected the tunnel with one of PermissionDenied, Unauthenticated
+// and NotFound, the agent stops instead of reconnecting
+type PermanentError struct {
+	// Code is the status code of the rejection
+	Code codes.Code
+	Err  error
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("hub rejected the tunnel with %s, not retrying: %v", e.Code, e.Err)
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// controlPacket is a control packet queued for processOutgoing, sent is passed the result of sending it if not nil
+type controlPacket struct {
+	packet *v1.Packet
+	sent   chan<- error
+}
+
+// hubDisconnectError is returned by serve when the Hub sends a DRAIN to close the tunnel
+type hubDisconnectError struct {
+	reason string
+}
+
+func (e *hubDisconnectError) Error() string {
+	return fmt.Sprintf("disconnected by hub: %s", e.reason)
 }
 
 // Agent connects to the tunnel server, establishes a grpc stream connection.
@@ -28,9 +276,25 @@ type Agent struct {
 	config   *Config
 	grpcConn *grpc.ClientConn
 	lcm      packetConnManager
-	proxy    *proxy
+	proxies  []*proxy
+
+	// ready is closed once the first tunnel stream is established
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// controlChan holds the control packets to send to the Hub, e.g. PING/PONG, the ERRORs of the packets that
+	// failed to dispatch and the DRAIN. processOutgoing is the only sender of the tunnel stream
+	controlChan chan controlPacket
+	rtt         rtt.Estimator
+
+	status *statusTracker
+	// draining is set by Drain, the proxies are stopped
+	draining atomic.Bool
 }
 
+// logger is the structured logger of the package, set from Config.Logger
+var logger logging.Logger
+
 func New(ctx context.Context, config *Config,
 	rp RequestProcessor, cp CertificateProvider, router Router) *Agent {
 	// --- Initialize KeepAlive parameters ---
@@ -44,6 +308,25 @@ func New(ctx context.Context, config *Config,
 		config.DialOptions = append(config.DialOptions, grpc.WithKeepaliveParams(kacp))
 	}
 
+	// Bound the message size so a single packet can't overwhelm the agent
+	if config.MaxGRPCMsgSize <= 0 {
+		config.MaxGRPCMsgSize = DefaultMaxGRPCMsgSize
+	}
+	config.DialOptions = append(config.DialOptions, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(config.MaxGRPCMsgSize)))
+
+	if config.ContextDialer != nil {
+		config.DialOptions = append(config.DialOptions, grpc.WithContextDialer(config.ContextDialer))
+	}
+	if authority := config.authority(); authority != "" {
+		config.DialOptions = append(config.DialOptions, grpc.WithAuthority(authority))
+	}
+	if creds := config.pinnedCredentials(); creds != nil {
+		config.DialOptions = append(config.DialOptions, creds)
+	}
+	if config.RequireTLS {
+		config.DialOptions = append(config.DialOptions, grpc.WithPerRPCCredentials(requireTLSCredentials{}))
+	}
+
 	// --- Initialize exponential backoff strategy ---
 	// This is key to handling "first connection failure", "normal reconnection", and "thundering herd effect" (Case 1a, 1b, 3b).
 	// By default, NewExponentialBackOff is used, which provides a jittered exponential backoff.
@@ -63,29 +346,199 @@ func New(ctx context.Context, config *Config,
 		}
 	}
 
-	// Set default UDS socket path if not provided
-	udsSocketPath := config.UDSSocketPath
-	if udsSocketPath == "" {
-		udsSocketPath = "/tmp/multiclustertunnel.sock"
+	if config.PingInterval == 0 {
+		config.PingInterval = DefaultPingInterval
+	}
+
+	var proxies []*proxy
+	var targets []proxyTarget
+	for _, spec := range proxySpecs(config) {
+		if spec.RequestProcessor == nil {
+			spec.RequestProcessor = rp
+		}
+		if spec.CertificateProvider == nil {
+			spec.CertificateProvider = cp
+		}
+		if spec.Router == nil {
+			spec.Router = router
+		}
+
+		p := newProxy(spec.RequestProcessor, spec.CertificateProvider, spec.Router, spec.SocketPath)
+		p.name = spec.Name
+		p.dialContext = config.DialContextFn
+		p.customHeaders = config.CustomHeaders
+		p.customHeadersFn = config.CustomHeadersFn
+		p.replayStatusCodes = config.ReplayableNonIdempotentStatusCodes
+		if config.UDSSocketPermissions != 0 {
+			p.socketPermissions = config.UDSSocketPermissions
+		}
+		if config.UDSSocketOwnership != nil {
+			p.socketUID, p.socketGID = config.UDSSocketOwnership.UID, config.UDSSocketOwnership.GID
+		}
+		p.abstractNamespace = config.UseAbstractNamespace && abstractNamespaceSupported
+		switch {
+		case config.ProxyRequestBodyTimeout > 0:
+			p.requestBodyTimeout = config.ProxyRequestBodyTimeout
+		case config.ProxyRequestBodyTimeout < 0:
+			p.requestBodyTimeout = 0
+		}
+		switch {
+		case config.ProxyResponseHeaderTimeout > 0:
+			p.responseHeaderTimeout = config.ProxyResponseHeaderTimeout
+		case config.ProxyResponseHeaderTimeout < 0:
+			p.responseHeaderTimeout = 0
+		}
+		switch {
+		case config.ProxyRequestTimeout > 0:
+			p.requestTimeout = config.ProxyRequestTimeout
+		case config.ProxyRequestTimeout < 0:
+			p.requestTimeout = 0
+		}
+		proxies = append(proxies, p)
+		targets = append(targets, proxyTarget{name: spec.Name, socketPath: spec.SocketPath, selector: spec.Selector})
+	}
+
+	lcmConfig := DefaultPacketConnManagerConfig()
+	if config.MaxConnBufferedBytes > 0 {
+		lcmConfig.MaxBufferedBytes = config.MaxConnBufferedBytes
+	}
+	lcmConfig.LogPayloadSample = config.LogPayloadSample
+	lcmConfig.UseAbstractNamespace = config.UseAbstractNamespace
+	lcmConfig.QoS = config.QoS
+	lcmConfig.Coalesce = config.Coalesce
+	switch {
+	case config.IdleConnectionTimeout > 0:
+		lcmConfig.IdleConnectionTimeout = config.IdleConnectionTimeout
+	case config.IdleConnectionTimeout < 0:
+		lcmConfig.IdleConnectionTimeout = 0
+	}
+	if config.ResumeWindow > 0 {
+		lcmConfig.ResumeWindow = config.ResumeWindow
+		lcmConfig.MaxReplayBytes = config.ResumeMaxBufferedBytes
 	}
 
 	return &Agent{
-		config: config,
-		lcm:    newPacketConnectionManagerWithSocketPath(ctx, udsSocketPath),
-		proxy:  newProxy(rp, cp, router, udsSocketPath),
+		config:  config,
+		lcm:     newPacketConnectionManagerWithTargets(ctx, lcmConfig, targets),
+		proxies: proxies,
+		ready:   make(chan struct{}),
+
+		controlChan: make(chan controlPacket, 16),
+		status:      newStatusTracker(config.StatusHistorySize),
+	}
+}
+
+// RTT returns the smoothed round-trip time to the Hub, 0 until the first PONG is received
+func (c *Agent) RTT() time.Duration {
+	return c.rtt.RTT()
+}
+
+// PacketConnMetrics returns a snapshot of the stats of the connections forwarded to the proxies, for embedders
+// without Prometheus
+func (c *Agent) PacketConnMetrics() PacketConnManagerMetrics {
+	return c.lcm.Metrics()
+}
+
+// ListConnections returns the stats of the open connections to the proxies, ordered by conn_id
+func (c *Agent) ListConnections() []ConnStats {
+	return c.lcm.ListConnections()
+}
+
+// Version returns the build information of the agent, its release is sent to the Hub with each tunnel
+func (c *Agent) Version() version.Info {
+	return version.Get()
+}
+
+// ReadyChan returns a channel that's closed once the first tunnel stream to the Hub is established
+func (c *Agent) ReadyChan() <-chan struct{} {
+	return c.ready
+}
+
+// Drain stops the agent from taking new requests before it's stopped: it sends a DRAIN to the Hub, which opens no
+// new connection to the agent, stops the proxies once their in-flight requests complete and waits until their
+// responses are sent to the Hub, or ctx is done. The caller then stops the agent by canceling the context of Run.
+// Hubs that don't drain gracefully close the tunnel on the DRAIN, failing the in-flight requests
+func (c *Agent) Drain(ctx context.Context) error {
+	c.draining.Store(true)
+
+	// processOutgoing sends the DRAIN on the current stream, or on the next one if the agent is reconnecting
+	sent := make(chan error, 1)
+	select {
+	case c.controlChan <- controlPacket{packet: &v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_DRAIN}, sent: sent}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			return fmt.Errorf("failed to send DRAIN to Hub: %w", err)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	klog.InfoS("Draining, waiting for the in-flight requests to complete")
+
+	for _, p := range c.proxies {
+		if err := p.shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to drain proxy %s: %w", p.name, err)
+		}
+	}
+
+	// The connections to the proxies are closed, they're removed once their data is read
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for c.lcm.Metrics().ActiveConnections > 0 || len(c.lcm.OutgoingChan()) > 0 || len(c.lcm.BulkOutgoingChan()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	klog.InfoS("Drained")
+	return nil
 }
 
 func (c *Agent) Run(ctx context.Context) error {
+	if err := c.config.Validate(); err != nil {
+		return fmt.Errorf("invalid agent config: %w", err)
+	}
+	if err := logger.Set(c.config.Logger); err != nil {
+		return fmt.Errorf("invalid agent config: Logger: %w", err)
+	}
+	if c.config.RequireTLS {
+		if err := c.config.checkTLSRequired(); err != nil {
+			return err
+		}
+	}
+
 	klog.InfoS("Agent starting")
 	b := c.config.BackoffFactory()
 
-	// Start serviceProxy in a separate goroutine
-	serviceProxyErrCh := make(chan error, 1)
-	go func() {
-		klog.InfoS("Starting serviceProxy")
-		serviceProxyErrCh <- c.proxy.Run(ctx)
-	}()
+	// Stop the serviceProxy and the main loop when Run returns early, e.g. on ErrInitialConnectTimeout
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The proxies would remove each other's socket
+	socketPaths := make(map[string]string, len(c.proxies))
+	for _, p := range c.proxies {
+		if name, ok := socketPaths[p.udsSocketPath]; ok {
+			return fmt.Errorf("proxies %s and %s use the same socket path %s", name, p.name, p.udsSocketPath)
+		}
+		socketPaths[p.udsSocketPath] = p.name
+	}
+
+	// Start each serviceProxy in a separate goroutine
+	serviceProxyErrCh := make(chan error, len(c.proxies))
+	for _, p := range c.proxies {
+		go func() {
+			klog.InfoS("Starting serviceProxy", "name", p.name)
+			if err := p.Run(ctx); err != nil {
+				serviceProxyErrCh <- fmt.Errorf("%s: %w", p.name, err)
+				return
+			}
+			serviceProxyErrCh <- nil
+		}()
+	}
 
 	// Main agent loop for gRPC connection management
 	agentErrCh := make(chan error, 1)
@@ -101,25 +554,45 @@ func (c *Agent) Run(ctx context.Context) error {
 				if c.grpcConn != nil {
 					c.grpcConn.Close()
 				}
+				c.closeConnections(ctx)
 				agentErrCh <- ctx.Err()
 				return
 			default:
+				c.status.attemptStarted(c.config.HubAddress)
 				err := c.establishAndServe(ctx)
+				c.status.attemptEnded(err)
 				if err != nil {
 					// Check context before retrying
 					if ctx.Err() != nil {
+						c.closeConnections(ctx)
 						agentErrCh <- ctx.Err()
 						return
 					}
-					klog.ErrorS(err, "Session failed, retrying")
+					var permanentErr *backoff.PermanentError
+					if errors.As(err, &permanentErr) {
+						klog.ErrorS(permanentErr.Err, "Hub rejected the agent, not retrying")
+						agentErrCh <- permanentErr.Err
+						return
+					}
+					var disconnectErr *hubDisconnectError
+					if errors.As(err, &disconnectErr) {
+						// Reconnect fresh, the Hub is reachable
+						klog.InfoS("Disconnected by Hub, reconnecting", "reason", disconnectErr.reason)
+						b.Reset()
+					} else {
+						klog.ErrorS(err, "Session failed, retrying")
+					}
 				}
 
 				// Use a shorter retry interval that's also context-aware
-				timer := time.NewTimer(b.NextBackOff())
+				retryIn := b.NextBackOff()
+				c.status.backoff(time.Now().Add(retryIn))
+				timer := time.NewTimer(retryIn)
 				defer timer.Stop()
 
 				select {
 				case <-ctx.Done():
+					c.closeConnections(ctx)
 					agentErrCh <- ctx.Err()
 					return
 				case <-timer.C:
@@ -129,18 +602,85 @@ func (c *Agent) Run(ctx context.Context) error {
 		}
 	}()
 
+	var initialConnectTimeout <-chan time.Time
+	if c.config.InitialConnectTimeout > 0 {
+		timer := time.NewTimer(c.config.InitialConnectTimeout)
+		defer timer.Stop()
+		initialConnectTimeout = timer.C
+	}
+
 	// Wait for either serviceProxy or agent to fail/complete
-	select {
-	case err := <-serviceProxyErrCh:
-		klog.ErrorS(err, "ServiceProxy failed")
-		return fmt.Errorf("serviceProxy failed: %w", err)
-	case err := <-agentErrCh:
-		klog.InfoS("Agent main loop completed")
-		return err
+	for {
+		select {
+		case err := <-serviceProxyErrCh:
+			if ctx.Err() != nil {
+				// The proxies stop when the agent is shut down, it's not a failure. The main loop closes the
+				// connections to them before it completes
+				<-agentErrCh
+				klog.InfoS("Agent main loop completed")
+				return ctx.Err()
+			}
+			if err == nil && c.draining.Load() {
+				// Drain stopped the proxy, the tunnel is served until the agent is stopped
+				continue
+			}
+			klog.ErrorS(err, "ServiceProxy failed")
+			return fmt.Errorf("serviceProxy failed: %w", err)
+		case err := <-agentErrCh:
+			klog.InfoS("Agent main loop completed")
+			return err
+		case <-initialConnectTimeout:
+			select {
+			case <-c.ready:
+				initialConnectTimeout = nil
+			default:
+				klog.ErrorS(ErrInitialConnectTimeout, "Failed to connect to Hub", "address", c.config.HubAddress,
+					"timeout", c.config.InitialConnectTimeout)
+				return fmt.Errorf("%w after %s", ErrInitialConnectTimeout, c.config.InitialConnectTimeout)
+			}
+		}
 	}
 }
 
+// closeConnections closes the connections to the proxies once the agent is stopped, it waits up to shutdownTimeout
+// for the open ones to close
+func (c *Agent) closeConnections(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	if err := c.lcm.GracefulClose(ctx); err != nil {
+		klog.ErrorS(err, "Connections to the proxies didn't close in time")
+	}
+}
+
+// establishAndServe connects to the Hub and serves the tunnel until it ends. A rejection of the Hub with one of
+// permanentCodes is returned as a backoff.Permanent PermanentError
 func (c *Agent) establishAndServe(ctx context.Context) error {
+	err := c.connectAndServe(ctx)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if s, ok := status.FromError(err); ok && slices.Contains(permanentCodes, s.Code()) {
+		return backoff.Permanent(&PermanentError{Code: s.Code(), Err: err})
+	}
+	if c.config.RequireTLS && strings.Contains(err.Error(), ErrTLSRequired.Error()) {
+		// The transport credentials of DialOptions connected without TLS, reconnecting would too
+		return backoff.Permanent(fmt.Errorf("%w (hub_address %s): %w", ErrTLSRequired, c.config.HubAddress, err))
+	}
+	if isNotTunnelEndpoint(err) {
+		return fmt.Errorf("%w, connect to its gRPC address instead (hub_address %s): %w", ErrNotTunnelEndpoint, c.config.HubAddress, err)
+	}
+	return err
+}
+
+// isNotTunnelEndpoint returns whether the error is one of a gRPC client connected to a server that isn't a gRPC one
+func isNotTunnelEndpoint(err error) bool {
+	message := err.Error()
+	return slices.ContainsFunc(notTunnelEndpointErrors, func(signature string) bool {
+		return strings.Contains(message, signature)
+	})
+}
+
+func (c *Agent) connectAndServe(ctx context.Context) error {
 	klog.InfoS("Attempting to connect to Hub", "address", c.config.HubAddress)
 
 	// Establish gRPC connection
@@ -155,18 +695,66 @@ func (c *Agent) establishAndServe(ctx context.Context) error {
 
 	// Establish bidirectional grpc stream for tunnel
 	tunnelClient := v1.NewTunnelServiceClient(conn)
-	grpcStreamCtx := metadata.AppendToOutgoingContext(ctx, "cluster-name", c.config.ClusterName)
+	md := []string{"cluster-name", c.config.ClusterName, v1.FirstPacketMetadataKey, "true", v1.AgentVersionMetadataKey, version.Version}
+	if c.config.ResumeWindow > 0 {
+		md = append(md, v1.ProtocolVersionMetadataKey, strconv.Itoa(v1.ProtocolVersionResume))
+	}
+	if c.config.EnableIntegrityCheck {
+		md = append(md, v1.IntegrityMetadataKey, "true")
+	}
+	grpcStreamCtx := metadata.AppendToOutgoingContext(ctx, md...)
 	grpcStream, err := tunnelClient.Tunnel(grpcStreamCtx)
 	if err != nil {
 		return fmt.Errorf("failed to create grpc stream for tunnel: %w", err)
 	}
+	c.status.streamOpen()
+
+	// The first PING is sent right away, the Hub closes the streams without a packet within its handshake timeout.
+	// Hubs without protocol versions send their header with the PONG
+	if err := grpcStream.Send(&v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_PING, Data: rtt.NewPingPayload()}); err != nil {
+		return fmt.Errorf("failed to send initial ping: %w", err)
+	}
+	resumable := false
+	if c.config.ResumeWindow > 0 {
+		if resumable, err = negotiateResume(grpcStream); err != nil {
+			return err
+		}
+	}
+	c.status.connected()
+	c.readyOnce.Do(func() {
+		klog.InfoS("Initial tunnel stream to Hub established")
+		close(c.ready)
+	})
+
+	// The connections of the previous stream are resumed by the Hub or closed
+	c.lcm.StartStream(resumable)
+	defer c.lcm.EndStream()
 
-	return c.serve(ctx, grpcStream)
+	return c.serve(ctx, grpcStream, resumable)
 }
 
-// serve manages a single active gRPC stream for tunnel.
+// negotiateResume waits for the header of the Hub and returns whether it resumes the connections on this stream
+func negotiateResume(grpcStream v1.TunnelService_TunnelClient) (bool, error) {
+	header, err := grpcStream.Header()
+	if err != nil {
+		return false, fmt.Errorf("failed to receive tunnel header: %w", err)
+	}
+	version := v1.ProtocolVersionBase
+	if values := header.Get(v1.ProtocolVersionMetadataKey); len(values) > 0 {
+		if v, err := strconv.Atoi(values[0]); err == nil {
+			version = v
+		}
+	}
+	if version < v1.ProtocolVersionResume {
+		klog.InfoS("Hub doesn't resume connections, they're closed when the tunnel stream ends", "protocol_version", version)
+		return false, nil
+	}
+	return true, nil
+}
+
+// serve manages a single active gRPC stream for tunnel, resumable is whether the Hub resumes the connections.
 // It blocks until the stream is terminated.
-func (c *Agent) serve(ctx context.Context, stream v1.TunnelService_TunnelClient) error {
+func (c *Agent) serve(ctx context.Context, stream v1.TunnelService_TunnelClient, resumable bool) error {
 	klog.InfoS("GRPC stream started")
 	defer klog.InfoS("GRPC stream ended")
 
@@ -174,7 +762,7 @@ func (c *Agent) serve(ctx context.Context, stream v1.TunnelService_TunnelClient)
 
 	// --- Goroutine 1: Handle packets from Hub ---
 	go func() {
-		errCh <- c.processIncoming(stream)
+		errCh <- c.processIncoming(stream, resumable)
 	}()
 
 	// --- Goroutine 2: Handle packets to Hub ---
@@ -182,22 +770,28 @@ func (c *Agent) serve(ctx context.Context, stream v1.TunnelService_TunnelClient)
 		errCh <- c.processOutgoing(stream)
 	}()
 
-	// --- Goroutine 3: Handle graceful shutdown ---
+	// --- Goroutine 3: Measure the round-trip time to Hub ---
+	if c.config.PingInterval > 0 {
+		go c.ping(stream)
+	}
+
+	// --- Goroutine 4: Handle graceful shutdown ---
 	go func() {
 		<-ctx.Done()
 		klog.InfoS("Context canceled, sending DRAIN signal to Hub")
 
 		// Send DRAIN packet to Hub to indicate graceful shutdown
 		drainPacket := &v1.Packet{
-			ConnId: 0, // Use 0 for control messages
+			ConnId: controlConnID,
 			Code:   v1.ControlCode_DRAIN,
 		}
 
-		// Try to send DRAIN packet with a timeout to avoid blocking indefinitely
+		// Try to send DRAIN packet with a timeout to avoid blocking indefinitely, processOutgoing sends it
 		done := make(chan error, 1)
-		go func() {
-			done <- stream.Send(drainPacket)
-		}()
+		select {
+		case c.controlChan <- controlPacket{packet: drainPacket, sent: done}:
+		default:
+		}
 
 		select {
 		case err := <-done:
@@ -218,8 +812,17 @@ func (c *Agent) serve(ctx context.Context, stream v1.TunnelService_TunnelClient)
 	return err
 }
 
-// processIncoming continuously receives Packets from the Hub and dispatches them
-func (c *Agent) processIncoming(grpcStream v1.TunnelService_TunnelClient) error {
+// processIncoming continuously receives Packets from the Hub and dispatches them. The packets of a resumable stream
+// are dispatched in order, the out of order packets of a connection would be dropped as duplicates. Otherwise the
+// packets of the open connections are dispatched in order too, e.g. the frames of an HTTP/2 connection, and the
+// packets opening a connection are dispatched concurrently so that dialing its proxy doesn't block the others
+func (c *Agent) processIncoming(grpcStream v1.TunnelService_TunnelClient, resumable bool) error {
+	// The Hub sends its header at the latest with its first packet, it tells whether the Hub sends an empty packet
+	// to open the connections. Recv returns the error of a stream failing before it
+	header, _ := grpcStream.Header()
+	c.lcm.SetFirstPacket(len(header.Get(v1.FirstPacketMetadataKey)) > 0)
+	c.lcm.SetIntegrity(c.config.EnableIntegrityCheck && len(header.Get(v1.IntegrityMetadataKey)) > 0)
+
 	for {
 		packet, err := grpcStream.Recv()
 		if err != nil {
@@ -227,33 +830,141 @@ func (c *Agent) processIncoming(grpcStream v1.TunnelService_TunnelClient) error
 			return err
 		}
 
-		go func() {
-			if err := c.lcm.Dispatch(packet); err != nil {
-				klog.ErrorS(err, "Failed to dispatch packet", "conn_id", packet.ConnId, "code", packet.Code)
-
-				// Send error response back to Hub for this specific connection
-				errorPacket := &v1.Packet{
-					ConnId:       packet.ConnId,
-					Code:         v1.ControlCode_ERROR,
-					ErrorMessage: err.Error(),
-				}
+		// Control packets are handled here, the packet connection manager rejects conn_id 0
+		switch packet.Code {
+		case v1.ControlCode_PING:
+			c.sendControlPacket(&v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_PONG, Data: packet.Data})
+			continue
+		case v1.ControlCode_PONG:
+			c.handlePongPacket(packet)
+			continue
+		case v1.ControlCode_DRAIN:
+			// The Hub closes the tunnel, e.g. an admin disconnected the cluster
+			return &hubDisconnectError{reason: packet.ErrorMessage}
+		}
 
-				// Best effort to send error response - don't fail the entire stream if this fails
-				if sendErr := grpcStream.Send(errorPacket); sendErr != nil {
-					klog.ErrorS(sendErr, "Failed to send error response to Hub", "conn_id", packet.ConnId)
-				}
-			}
-		}()
+		if resumable || c.lcm.HasConnection(packet.ConnId) {
+			c.dispatch(grpcStream, packet)
+		} else {
+			go c.dispatch(grpcStream, packet)
+		}
+	}
+}
+
+// dispatch passes the packet to the packet connection manager, the Hub is sent an error if it fails
+func (c *Agent) dispatch(grpcStream v1.TunnelService_TunnelClient, packet *v1.Packet) {
+	if err := c.lcm.Dispatch(packet); err != nil {
+		logger.ErrorS(err, "Failed to dispatch packet", "conn_id", packet.ConnId, "code", packet.Code)
+
+		// Never answer on the control conn_id, the Hub has no connection to close for it, nor an ERROR, the Hub
+		// already closed the connection
+		if packet.ConnId == controlConnID || packet.Code == v1.ControlCode_ERROR {
+			return
+		}
+
+		// Send error response back to Hub for this specific connection
+		errorPacket := &v1.Packet{
+			ConnId:       packet.ConnId,
+			Code:         v1.ControlCode_ERROR,
+			ErrorMessage: err.Error(),
+		}
+
+		// Best effort to send error response - don't fail the entire stream if this fails. The packets are
+		// dispatched concurrently, processOutgoing sends it
+		select {
+		case c.controlChan <- controlPacket{packet: errorPacket}:
+		case <-grpcStream.Context().Done():
+			logger.ErrorS(grpcStream.Context().Err(), "Failed to send error response to Hub", "conn_id", packet.ConnId)
+		}
 	}
 }
 
-// processOutgoing continuously sends all Packets generated by local services to the Hub
+// processOutgoing continuously sends all Packets generated by local services to the Hub, and the control packets.
+// It's the only sender of the stream, gRPC streams don't support concurrent sends
 func (c *Agent) processOutgoing(grpcStream v1.TunnelService_TunnelClient) error {
-	// c.connectionManager.OutgoingChan() returns a channel aggregating all Packets to be sent from local services
-	for packet := range c.lcm.OutgoingChan() {
+	// c.connectionManager.OutgoingChan() returns a channel aggregating all Packets to be sent from local services,
+	// BulkOutgoingChan() the ones of the bulk connections if QoS is enabled. The scheduler interleaves them
+	scheduler := qos.NewScheduler(c.config.QoS)
+	for {
+		// The control packets go first, e.g. a PONG isn't delayed by a large response
+		select {
+		case control := <-c.controlChan:
+			if err := sendControl(grpcStream, control); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+
+		packet, err := scheduler.Poll(c.lcm.OutgoingChan(), c.lcm.BulkOutgoingChan())
+		if err != nil {
+			return errors.New("outgoing channel closed")
+		}
+		if packet == nil {
+			var ok bool
+			select {
+			case packet, ok = <-c.lcm.OutgoingChan():
+			case packet, ok = <-c.lcm.BulkOutgoingChan():
+			case control := <-c.controlChan:
+				if err := sendControl(grpcStream, control); err != nil {
+					return err
+				}
+				continue
+			case <-grpcStream.Context().Done():
+				// Stop when the stream ends, so the goroutine doesn't outlive the stream
+				return grpcStream.Context().Err()
+			}
+			if !ok {
+				return errors.New("outgoing channel closed")
+			}
+		}
 		if err := grpcStream.Send(packet); err != nil {
 			return err
 		}
 	}
-	return errors.New("outgoing channel closed")
+}
+
+// sendControl sends the control packet and passes the result to its sent channel
+func sendControl(grpcStream v1.TunnelService_TunnelClient, control controlPacket) error {
+	err := grpcStream.Send(control.packet)
+	if control.sent != nil {
+		control.sent <- err
+	}
+	return err
+}
+
+// ping periodically sends a PING to the Hub until the stream ends
+func (c *Agent) ping(grpcStream v1.TunnelService_TunnelClient) {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sendControlPacket(&v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_PING, Data: rtt.NewPingPayload()})
+		case <-grpcStream.Context().Done():
+			return
+		}
+	}
+}
+
+// handlePongPacket updates the round-trip time with the PONG of a PING sent by ping
+func (c *Agent) handlePongPacket(packet *v1.Packet) {
+	sample, err := rtt.SampleFromPong(packet.Data)
+	if err != nil {
+		logger.Warningf("Dropping invalid PONG from Hub: %v", err)
+		return
+	}
+	estimate := c.rtt.Observe(sample)
+	tunnelRTT.Set(estimate.Seconds())
+	logger.V(5).InfoS("Measured tunnel round-trip time", "sample", sample, "rtt", estimate)
+}
+
+// sendControlPacket queues a control packet for processOutgoing without blocking, it's dropped if the queue is full
+func (c *Agent) sendControlPacket(packet *v1.Packet) {
+	select {
+	case c.controlChan <- controlPacket{packet: packet}:
+	default:
+		logger.V(4).InfoS("Control channel is full, dropping control packet", "code", packet.Code)
+	}
 }
@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// benchRequest is the request the Hub of BenchmarkRequestLatency sends on each connection
+var benchRequest = []byte("GET /healthz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+// benchHub is a Hub passing the tunnel stream of the agent to the benchmark, it opens the connections on their
+// first packet if firstPacket is set
+type benchHub struct {
+	v1.UnimplementedTunnelServiceServer
+	firstPacket bool
+	streams     chan grpc.BidiStreamingServer[v1.Packet, v1.Packet]
+}
+
+func (h *benchHub) Tunnel(stream grpc.BidiStreamingServer[v1.Packet, v1.Packet]) error {
+	header := metadata.Pairs(v1.ProtocolVersionMetadataKey, "1")
+	if h.firstPacket {
+		header.Set(v1.FirstPacketMetadataKey, "true")
+	}
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+	h.streams <- stream
+	<-stream.Context().Done()
+	return nil
+}
+
+// serveBenchProxy answers each request on the connections of the listener with an empty response
+func serveBenchProxy(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// BenchmarkRequestLatency measures the latency of a request through the tunnel of an agent, from the Hub opening the
+// connection until it receives the response. EmptyInitialPacket opens the connections with an empty packet like the
+// Hubs without v1.FirstPacketMetadataKey, FirstPacket with the request
+func BenchmarkRequestLatency(b *testing.B) {
+	for _, c := range []struct {
+		name        string
+		firstPacket bool
+	}{
+		{name: "EmptyInitialPacket"},
+		{name: "FirstPacket", firstPacket: true},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			socketPath := filepath.Join(b.TempDir(), "proxy.sock")
+			proxyListener, err := net.Listen("unix", socketPath)
+			if err != nil {
+				b.Fatalf("failed to listen: %v", err)
+			}
+			defer proxyListener.Close()
+			go serveBenchProxy(proxyListener)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("failed to listen: %v", err)
+			}
+			hub := &benchHub{firstPacket: c.firstPacket, streams: make(chan grpc.BidiStreamingServer[v1.Packet, v1.Packet], 1)}
+			grpcServer := grpc.NewServer()
+			v1.RegisterTunnelServiceServer(grpcServer, hub)
+			go grpcServer.Serve(listener)
+			defer grpcServer.Stop()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			a := New(ctx, &Config{
+				HubAddress:    listener.Addr().String(),
+				ClusterName:   "cluster1",
+				UDSSocketPath: socketPath,
+				DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+			go a.Run(ctx)
+			stream := <-hub.streams
+
+			// The responses are received apart from the PINGs of the agent
+			responses := make(chan int64, 1)
+			go func() {
+				for {
+					packet, err := stream.Recv()
+					if err != nil {
+						return
+					}
+					if packet.Code == v1.ControlCode_DATA {
+						responses <- packet.ConnId
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				connID := int64(i + 1)
+				if !c.firstPacket {
+					if err := stream.Send(&v1.Packet{ConnId: connID, Code: v1.ControlCode_DATA, Data: []byte{}}); err != nil {
+						b.Fatalf("failed to send the empty packet: %v", err)
+					}
+				}
+				if err := stream.Send(&v1.Packet{ConnId: connID, Code: v1.ControlCode_DATA, Data: benchRequest}); err != nil {
+					b.Fatalf("failed to send the request: %v", err)
+				}
+				if got := <-responses; got != connID {
+					b.Fatalf("expected the response of conn_id %d, got conn_id %d", connID, got)
+				}
+				if err := stream.Send(&v1.Packet{ConnId: connID, Code: v1.ControlCode_ERROR, ErrorMessage: "done"}); err != nil {
+					b.Fatalf("failed to close the connection: %v", err)
+				}
+			}
+		})
+	}
+}
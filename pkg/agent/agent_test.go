@@ -0,0 +1,357 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// systemCertificateProvider provides the system roots, the proxy doesn't run in a pod
+type systemCertificateProvider struct{}
+
+func (systemCertificateProvider) GetRootCAs() (*x509.CertPool, error) {
+	return x509.SystemCertPool()
+}
+
+// authorityRecorder is a Hub recording the authority of the tunnel calls
+type authorityRecorder struct {
+	v1.UnimplementedTunnelServiceServer
+	authorities chan string
+}
+
+func (r *authorityRecorder) Tunnel(stream grpc.BidiStreamingServer[v1.Packet, v1.Packet]) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	authority := ""
+	if values := md.Get(":authority"); len(values) > 0 {
+		authority = values[0]
+	}
+	select {
+	case r.authorities <- authority:
+	default:
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestGRPCAuthority(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	hub := &authorityRecorder{authorities: make(chan string, 1)}
+	grpcServer := grpc.NewServer()
+	v1.RegisterTunnelServiceServer(grpcServer, hub)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	hubAddress := listener.Addr().String()
+
+	cases := []struct {
+		name            string
+		grpcAuthority   string
+		tlsServerName   string
+		expectAuthority string
+	}{
+		{name: "default", expectAuthority: hubAddress},
+		{name: "override", grpcAuthority: "tunnel.example.com", expectAuthority: "tunnel.example.com"},
+		{name: "TLS server name", tlsServerName: "hub.example.com", expectAuthority: "hub.example.com"},
+		{name: "override with TLS server name", grpcAuthority: "tunnel.example.com", tlsServerName: "hub.example.com",
+			expectAuthority: "tunnel.example.com"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			a := New(ctx, &Config{
+				HubAddress:    hubAddress,
+				ClusterName:   "cluster1",
+				UDSSocketPath: filepath.Join(t.TempDir(), "proxy.sock"),
+				GRPCAuthority: c.grpcAuthority,
+				TLSServerName: c.tlsServerName,
+				DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				a.Run(ctx)
+			}()
+
+			select {
+			case authority := <-hub.authorities:
+				if authority != c.expectAuthority {
+					t.Errorf("expected authority %q, got %q", c.expectAuthority, authority)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected the agent to open a tunnel")
+			}
+			cancel()
+			<-done
+		})
+	}
+}
+
+// rejectingHub is a Hub rejecting every tunnel with code, it counts the tunnel calls
+type rejectingHub struct {
+	v1.UnimplementedTunnelServiceServer
+	code  codes.Code
+	calls atomic.Int32
+}
+
+func (h *rejectingHub) Tunnel(stream grpc.BidiStreamingServer[v1.Packet, v1.Packet]) error {
+	h.calls.Add(1)
+	return status.Error(h.code, "rejected by the test hub")
+}
+
+func TestPermanentErrors(t *testing.T) {
+	cases := []struct {
+		code          codes.Code
+		expectRetries bool
+	}{
+		{code: codes.PermissionDenied},
+		{code: codes.Unauthenticated},
+		{code: codes.NotFound},
+		{code: codes.Unavailable, expectRetries: true},
+	}
+	for _, c := range cases {
+		t.Run(c.code.String(), func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			hub := &rejectingHub{code: c.code}
+			grpcServer := grpc.NewServer()
+			v1.RegisterTunnelServiceServer(grpcServer, hub)
+			go grpcServer.Serve(listener)
+			defer grpcServer.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			a := New(ctx, &Config{
+				HubAddress:     listener.Addr().String(),
+				ClusterName:    "cluster1",
+				UDSSocketPath:  filepath.Join(t.TempDir(), "proxy.sock"),
+				DialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+				BackoffFactory: func() backoff.BackOff { return backoff.NewConstantBackOff(50 * time.Millisecond) },
+			}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+			err = a.Run(ctx)
+
+			if c.expectRetries {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("expected the agent to retry until stopped, got %v", err)
+				}
+				if n := hub.calls.Load(); n < 2 {
+					t.Errorf("expected the agent to retry, got %d tunnel calls", n)
+				}
+				return
+			}
+			var permanentErr *PermanentError
+			if !errors.As(err, &permanentErr) || permanentErr.Code != c.code {
+				t.Fatalf("expected a PermanentError with %s, got %v", c.code, err)
+			}
+			if status.Code(err) != c.code {
+				t.Errorf("expected the status of the Hub to be kept, got %v", status.Code(err))
+			}
+			if n := hub.calls.Load(); n != 1 {
+				t.Errorf("expected the agent not to retry, got %d tunnel calls", n)
+			}
+		})
+	}
+}
+
+func TestNotTunnelEndpoint(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not a tunnel", http.StatusBadRequest)
+	})
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	plaintext := httptest.NewServer(handler)
+	defer plaintext.Close()
+	https := httptest.NewTLSServer(handler)
+	defer https.Close()
+
+	cases := []struct {
+		name        string
+		server      *httptest.Server
+		credentials credentials.TransportCredentials
+	}{
+		{name: "HTTP/1.1", server: plaintext, credentials: insecure.NewCredentials()},
+		{name: "h2c", server: h2c, credentials: insecure.NewCredentials()},
+		{name: "HTTPS without HTTP/2", server: https, credentials: credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			a := New(ctx, &Config{
+				HubAddress:     c.server.Listener.Addr().String(),
+				ClusterName:    "cluster1",
+				UDSSocketPath:  filepath.Join(t.TempDir(), "proxy.sock"),
+				DialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(c.credentials)},
+				BackoffFactory: func() backoff.BackOff { return backoff.NewConstantBackOff(50 * time.Millisecond) },
+			}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+			a.Run(ctx)
+
+			// The last attempt may be cut by the deadline, the oldest one recorded ran to completion
+			attempts := a.Status().Attempts
+			if len(attempts) == 0 {
+				t.Fatalf("expected the agent to record its attempts")
+			}
+			attemptErr := attempts[0].Error
+			if !strings.Contains(attemptErr, ErrNotTunnelEndpoint.Error()) || !strings.Contains(attemptErr, c.server.Listener.Addr().String()) {
+				t.Fatalf("expected the error to tell the HubAddress is not the gRPC address, got %q", attemptErr)
+			}
+		})
+	}
+	if isNotTunnelEndpoint(status.Error(codes.Unavailable, "connection refused")) {
+		t.Errorf("expected an unreachable Hub not to be reported as another endpoint")
+	}
+}
+
+func TestContextDialer(t *testing.T) {
+	listener := bufconn.Listen(1 << 20)
+	hub := &rejectingHub{code: codes.PermissionDenied}
+	grpcServer := grpc.NewServer()
+	v1.RegisterTunnelServiceServer(grpcServer, hub)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	var dialed atomic.Int32
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	a := New(ctx, &Config{
+		HubAddress:    "passthrough:///hub.test:8443",
+		ClusterName:   "cluster1",
+		UDSSocketPath: filepath.Join(t.TempDir(), "proxy.sock"),
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		ContextDialer: func(ctx context.Context, addr string) (net.Conn, error) {
+			if addr != "hub.test:8443" {
+				t.Errorf("expected the dialer to be given the address of the Hub, got %q", addr)
+			}
+			dialed.Add(1)
+			return listener.DialContext(ctx)
+		},
+	}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+
+	// The tunnel is rejected by the in-memory Hub, it was reached through the dialer
+	if err := a.Run(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the agent to reach the Hub, got %v", err)
+	}
+	if dialed.Load() == 0 {
+		t.Error("expected the agent to dial the Hub with the ContextDialer")
+	}
+}
+
+// sendCheckingStream is a tunnel stream receiving the packets of incoming, it counts the ERRORs and PONGs sent and
+// the sends that overlapped another one
+type sendCheckingStream struct {
+	grpc.ClientStream
+	ctx      context.Context
+	incoming chan *v1.Packet
+
+	sending    atomic.Int32
+	concurrent atomic.Int32
+	errors     atomic.Int32
+	pongs      atomic.Int32
+}
+
+func (s *sendCheckingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *sendCheckingStream) Header() (metadata.MD, error) {
+	return nil, nil
+}
+
+func (s *sendCheckingStream) Recv() (*v1.Packet, error) {
+	select {
+	case packet := <-s.incoming:
+		return packet, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *sendCheckingStream) Send(packet *v1.Packet) error {
+	if s.sending.Add(1) > 1 {
+		s.concurrent.Add(1)
+	}
+	defer s.sending.Add(-1)
+	// Widen the window of the sends overlapping
+	time.Sleep(10 * time.Microsecond)
+
+	switch packet.Code {
+	case v1.ControlCode_ERROR:
+		s.errors.Add(1)
+	case v1.ControlCode_PONG:
+		s.pongs.Add(1)
+	}
+	return nil
+}
+
+// TestConcurrentErrorResponses checks the ERRORs of the packets dispatched concurrently are sent along with the
+// PONGs by a single sender, gRPC streams don't support concurrent sends
+func TestConcurrentErrorResponses(t *testing.T) {
+	const packets = 2000
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &sendCheckingStream{ctx: ctx, incoming: make(chan *v1.Packet, packets+packets/10)}
+	for connID := int64(1); connID <= packets; connID++ {
+		// An unknown code fails to dispatch, the packets of unknown connections are dispatched concurrently
+		stream.incoming <- &v1.Packet{ConnId: connID, Code: v1.ControlCode(99)}
+		if connID%10 == 0 {
+			stream.incoming <- &v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_PING}
+		}
+	}
+
+	a := New(ctx, &Config{
+		HubAddress:    "127.0.0.1:0",
+		ClusterName:   "cluster1",
+		UDSSocketPath: filepath.Join(t.TempDir(), "proxy.sock"),
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+	done := make(chan error, 1)
+	go func() {
+		done <- a.serve(ctx, stream, false)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for stream.errors.Load() < packets && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if errors := stream.errors.Load(); errors != packets {
+		t.Errorf("expected %d ERRORs, got %d", packets, errors)
+	}
+	if stream.pongs.Load() == 0 {
+		t.Errorf("expected PONGs along with the ERRORs")
+	}
+	if concurrent := stream.concurrent.Load(); concurrent != 0 {
+		t.Errorf("expected a single sender, %d sends overlapped", concurrent)
+	}
+
+	cancel()
+	<-done
+}
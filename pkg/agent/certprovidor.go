@@ -1,32 +1,158 @@
 package agent
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
 )
 
+// DefaultCAPath is the CA bundle of the service account of the agent, the one of the kube-apiserver of the managed
+// cluster
+const DefaultCAPath = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
 // CertificateProvider provides the root certificate pool for TLS connections
 type CertificateProvider interface {
 	GetRootCAs() (*x509.CertPool, error)
 }
 
-type CertificateProviderImplt struct{}
+type CertificateProviderImplt struct {
+	// CAPath is the PEM bundle of the root CAs, DefaultCAPath if empty
+	CAPath string
+}
 
 func (c CertificateProviderImplt) GetRootCAs() (*x509.CertPool, error) {
-	const (
-		rootCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
-	)
-	rootCAs := x509.NewCertPool()
+	caPath := c.CAPath
+	if caPath == "" {
+		caPath = DefaultCAPath
+	}
 
 	// ca for accessing apiserver
-	apiserverPem, err := os.ReadFile(rootCAFile)
+	apiserverPem, err := os.ReadFile(caPath)
 	if err != nil {
 		return nil, err
 	}
-	rootCAs.AppendCertsFromPEM(apiserverPem)
 
 	// TODO:@xuezhaojun ca for accessing OCP service
 	// openshift-service-ca.crt
 
+	return parseRootCAs(caPath, apiserverPem)
+}
+
+// parseRootCAs returns the pool of the certificates of the PEM bundle read from caPath
+func parseRootCAs(caPath string, data []byte) (*x509.CertPool, error) {
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %s", caPath)
+	}
 	return rootCAs, nil
 }
+
+// rootCAsWatcher is a CertificateProvider whose root CAs change while the agent runs. The proxies verify the targets
+// with the pool returned by the getter at the time of each TLS handshake
+type rootCAsWatcher interface {
+	CertificateProvider
+	// watchRootCAs watches the root CAs until ctx is done, the getter returns the current pool
+	watchRootCAs(ctx context.Context) (func() *x509.CertPool, error)
+}
+
+// fileWatchCertificateProvider provides the root CAs of a PEM file and reloads them when the file changes
+type fileWatchCertificateProvider struct {
+	caPath string
+	// rootCAs is the last pool parsed from the file, and data the content it was parsed from
+	rootCAs atomic.Pointer[x509.CertPool]
+	data    atomic.Pointer[[]byte]
+}
+
+// NewFileWatchCertificateProvider returns a CertificateProvider providing the root CAs of the PEM file at caPath,
+// DefaultCAPath if empty. The proxies of the agent watch the file and verify the new TLS connections to the targets
+// with the reloaded CAs once it changes, e.g. when cert-manager or the kubelet rotate the CA, without restarting the
+// agent. A change to a file without a valid certificate is logged and the current CAs are kept.
+func NewFileWatchCertificateProvider(caPath string) CertificateProvider {
+	if caPath == "" {
+		caPath = DefaultCAPath
+	}
+	return &fileWatchCertificateProvider{caPath: caPath}
+}
+
+func (c *fileWatchCertificateProvider) GetRootCAs() (*x509.CertPool, error) {
+	if rootCAs := c.rootCAs.Load(); rootCAs != nil {
+		return rootCAs, nil
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c.rootCAs.Load(), nil
+}
+
+// reload parses the file again, the pool is replaced if the content changed. It returns whether it was replaced
+func (c *fileWatchCertificateProvider) reload() (bool, error) {
+	data, err := os.ReadFile(c.caPath)
+	if err != nil {
+		return false, err
+	}
+	if current := c.data.Load(); current != nil && bytes.Equal(*current, data) {
+		return false, nil
+	}
+	rootCAs, err := parseRootCAs(c.caPath, data)
+	if err != nil {
+		return false, err
+	}
+	c.rootCAs.Store(rootCAs)
+	c.data.Store(&data)
+	return true, nil
+}
+
+// watchRootCAs watches the directory of the file rather than the file, the kubelet and most tools replace the file
+// with a rename or swap a symlink, after which a watch on the file would see no event
+func (c *fileWatchCertificateProvider) watchRootCAs(ctx context.Context) (func() *x509.CertPool, error) {
+	if _, err := c.GetRootCAs(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch the CA file %s: %w", c.caPath, err)
+	}
+	if err := watcher.Add(filepath.Dir(c.caPath)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch the CA file %s: %w", c.caPath, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				reloaded, err := c.reload()
+				if err != nil {
+					// The file is being written or replaced, the next event reloads it
+					logger.V(2).InfoS("Failed to reload the CA file, keeping the current root CAs", "ca_path", c.caPath, "error", err)
+					continue
+				}
+				if reloaded {
+					logger.InfoS("Reloaded the root CAs", "ca_path", c.caPath)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				klog.ErrorS(err, "Failed to watch the CA file", "ca_path", c.caPath)
+			}
+		}
+	}()
+	return c.rootCAs.Load, nil
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+)
+
+// writeCAFile writes the data to a temporary file and returns its path
+func writeCAFile(t *testing.T, data []byte) string {
+	t.Helper()
+	file, err := os.CreateTemp(t.TempDir(), "ca-*.crt")
+	if err != nil {
+		t.Fatalf("failed to create the CA file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to write the CA file: %v", err)
+	}
+	return file.Name()
+}
+
+func TestCertificateProviderImpltGetRootCAs(t *testing.T) {
+	ca, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	otherCA, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the other CA: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		expectCerts int
+		expectErr   string
+	}{
+		{
+			name:        "valid PEM",
+			data:        ca.CertPEM,
+			expectCerts: 1,
+		},
+		{
+			name:        "bundle",
+			data:        bytes.Join([][]byte{ca.CertPEM, otherCA.CertPEM}, nil),
+			expectCerts: 2,
+		},
+		{
+			name:      "empty file",
+			data:      nil,
+			expectErr: "no PEM encoded certificate found",
+		},
+		{
+			name:      "invalid PEM",
+			data:      []byte("-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n"),
+			expectErr: "no PEM encoded certificate found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := CertificateProviderImplt{CAPath: writeCAFile(t, tt.data)}
+			rootCAs, err := provider.GetRootCAs()
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get the root CAs: %v", err)
+			}
+			if n := len(rootCAs.Subjects()); n != tt.expectCerts {
+				t.Errorf("expected %d certificates in the pool, got %d", tt.expectCerts, n)
+			}
+		})
+	}
+
+	provider := CertificateProviderImplt{CAPath: writeCAFile(t, ca.CertPEM) + ".missing"}
+	if _, err := provider.GetRootCAs(); !os.IsNotExist(err) {
+		t.Errorf("expected a missing CA file to fail, got %v", err)
+	}
+}
+
+func TestFileWatchCertificateProvider(t *testing.T) {
+	oldCA, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the old CA: %v", err)
+	}
+	newCA, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the new CA: %v", err)
+	}
+
+	// The backend certificate is issued by the new CA, the proxy trusts the old one first
+	keyPair, err := newCA.IssueServer("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to issue the backend certificate: %v", err)
+	}
+	cert, err := keyPair.TLSCertificate()
+	if err != nil {
+		t.Fatalf("failed to load the backend certificate: %v", err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from backend"))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caPath, oldCA.CertPEM, 0o600); err != nil {
+		t.Fatalf("failed to write the CA file: %v", err)
+	}
+	provider := NewFileWatchCertificateProvider(caPath).(*fileWatchCertificateProvider)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rootCAs, err := provider.watchRootCAs(ctx)
+	if err != nil {
+		t.Fatalf("failed to watch the CA file: %v", err)
+	}
+
+	p := newProxy(&passThroughRequestProcessor{}, provider, &staticRouter{proto: "https", host: backend.Listener.Addr().String()}, "")
+	p.rootCAs = rootCAs
+	front := httptest.NewServer(p)
+	defer front.Close()
+	get := func() (int, string) {
+		resp, err := http.Get(front.URL + "/healthz")
+		if err != nil {
+			t.Fatalf("failed to send the request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// waitForRootCAs waits for the watcher to replace the pool
+	waitForRootCAs := func(previous *x509.CertPool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for rootCAs() == previous {
+			if time.Now().After(deadline) {
+				t.Fatalf("the root CAs were not reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if status, _ := get(); status != http.StatusBadGateway {
+		t.Fatalf("expected the backend to be untrusted, got %d", status)
+	}
+
+	// The file is written in place
+	previous := rootCAs()
+	if err := os.WriteFile(caPath, newCA.CertPEM, 0o600); err != nil {
+		t.Fatalf("failed to write the CA file: %v", err)
+	}
+	waitForRootCAs(previous)
+	if status, body := get(); status != http.StatusOK || body != "Hello from backend" {
+		t.Fatalf("expected the backend to be trusted with the new CA, got %d %q", status, body)
+	}
+
+	// A file without certificate keeps the current CAs
+	previous = rootCAs()
+	if err := os.WriteFile(caPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write the CA file: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if rootCAs() != previous {
+		t.Fatalf("expected an invalid CA file to keep the root CAs")
+	}
+
+	// The file is replaced with a rename, as the kubelet and cert-manager do
+	tmpPath := filepath.Join(filepath.Dir(caPath), "ca.crt.tmp")
+	if err := os.WriteFile(tmpPath, oldCA.CertPEM, 0o600); err != nil {
+		t.Fatalf("failed to write the CA file: %v", err)
+	}
+	if err := os.Rename(tmpPath, caPath); err != nil {
+		t.Fatalf("failed to replace the CA file: %v", err)
+	}
+	waitForRootCAs(previous)
+	if status, _ := get(); status != http.StatusBadGateway {
+		t.Fatalf("expected the backend to be untrusted with the old CA, got %d", status)
+	}
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ServicePathRouter routes the requests of the short service paths, /<cluster>/service/<namespace>/<service>/<path>,
+// to the services of the managed cluster. The service segment has the grammar of RouterImpl, [<scheme>:]<name>[:<port>],
+// e.g. /cluster1/service/kube-system/metrics-server:443/apis/metrics. The other paths don't match
+type ServicePathRouter struct {
+	// DefaultServiceScheme is the scheme of the services whose segment has none. Defaults to https
+	DefaultServiceScheme string
+	// AllowHTTPServices proxies the requests to the services with the http scheme, see RouterImpl.AllowHTTPServices
+	AllowHTTPServices bool
+}
+
+func (router *ServicePathRouter) ParseTargetService(r *http.Request) (targetproto, targethost, targetpath string, err error) {
+	segments, trailingSlash := pathSegments(r.URL.EscapedPath())
+	if len(segments) < 2 || segments[1] != "service" {
+		return "", "", "", fmt.Errorf("%w: %s is not a service path", ErrNoMatch, r.URL.EscapedPath())
+	}
+	if len(segments) < 4 {
+		return "", "", "", fmt.Errorf("%w: %s must be /<cluster>/service/<namespace>/<service>/<path>",
+			ErrInvalidPath, r.URL.EscapedPath())
+	}
+
+	namespace, err := parseNamespaceSegment(segments[2])
+	if err != nil {
+		return "", "", "", err
+	}
+	services := &RouterImpl{DefaultServiceScheme: router.DefaultServiceScheme, AllowHTTPServices: router.AllowHTTPServices}
+	proto, host, err := services.serviceTarget(segments[3], namespace)
+	if err != nil {
+		return "", "", "", err
+	}
+	return proto, host, joinPath(segments[4:], trailingSlash), nil
+}
+
+// chainRouter is the Router of NewChainRouter
+type chainRouter struct {
+	routers []Router
+	// names are the names of the routers in the logs and the metrics
+	names []string
+}
+
+// NewChainRouter returns a Router trying the routers in order, the first one not returning ErrNoMatch routes the
+// request, or fails it, e.g. with ErrInvalidPath. ErrNoMatch is returned if none of them matches. The router that
+// matched is logged at verbosity 4 and counted by the multiclustertunnel_agent_router_matches_total metric, with the
+// type of the router as its name, followed by its index for the routers of the same type
+func NewChainRouter(routers ...Router) Router {
+	types := make(map[string]int, len(routers))
+	for _, router := range routers {
+		types[fmt.Sprintf("%T", router)]++
+	}
+	names := make([]string, len(routers))
+	for i, router := range routers {
+		names[i] = fmt.Sprintf("%T", router)
+		if types[names[i]] > 1 {
+			names[i] = fmt.Sprintf("%s[%d]", names[i], i)
+		}
+	}
+	return &chainRouter{routers: routers, names: names}
+}
+
+func (c *chainRouter) ParseTargetService(r *http.Request) (targetproto, targethost, targetpath string, err error) {
+	for i, router := range c.routers {
+		targetproto, targethost, targetpath, err = router.ParseTargetService(r)
+		if errors.Is(err, ErrNoMatch) {
+			continue
+		}
+		routerMatches.WithLabelValues(c.names[i]).Inc()
+		logger.V(4).InfoS("Routed request", "router", c.names[i], "path", r.URL.EscapedPath())
+		return targetproto, targethost, targetpath, err
+	}
+	routerMatches.WithLabelValues("none").Inc()
+	return "", "", "", fmt.Errorf("%w: %s", ErrNoMatch, r.URL.EscapedPath())
+}
+
+// RouteClass classifies the request with the router that matches it, if it's a RouteClassifier
+func (c *chainRouter) RouteClass(r *http.Request) RouteClass {
+	if i := c.match(r); i >= 0 {
+		if classifier, ok := c.routers[i].(RouteClassifier); ok {
+			return classifier.RouteClass(r)
+		}
+	}
+	return ClassifyRequest(r)
+}
+
+// match returns the index of the router that matches the request, -1 if none does
+func (c *chainRouter) match(r *http.Request) int {
+	for i, router := range c.routers {
+		if _, _, _, err := router.ParseTargetService(r); !errors.Is(err, ErrNoMatch) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServicePathRouter(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestURI    string
+		expectProto   string
+		expectHost    string
+		expectPath    string
+		expectInvalid bool
+		expectNoMatch bool
+	}{
+		{
+			name:        "service",
+			requestURI:  "/cluster1/service/kube-system/metrics-server:443/apis/metrics?watch=1",
+			expectProto: "https",
+			expectHost:  "metrics-server.kube-system.svc:443",
+			expectPath:  "/apis/metrics",
+		},
+		{
+			name:        "scheme and port name",
+			requestURI:  "/cluster1/service/kube-system/https%3Ametrics-server%3Ahttps/healthz/",
+			expectProto: "https",
+			expectHost:  "metrics-server.kube-system.svc:https",
+			expectPath:  "/healthz/",
+		},
+		{
+			name:        "name only, no sub-path",
+			requestURI:  "/cluster1//service/kube-system/metrics-server",
+			expectProto: "https",
+			expectHost:  "metrics-server.kube-system.svc",
+			expectPath:  "/",
+		},
+		{
+			name:        "http allowed",
+			requestURI:  "/cluster1/service/default/http:my-svc:8080/",
+			expectProto: "http",
+			expectHost:  "my-svc.default.svc:8080",
+			expectPath:  "/",
+		},
+		{
+			name:          "missing service",
+			requestURI:    "/cluster1/service/kube-system",
+			expectInvalid: true,
+		},
+		{
+			name:          "invalid namespace",
+			requestURI:    "/cluster1/service/evil.example.com%3A443/metrics-server:443/healthz",
+			expectInvalid: true,
+		},
+		{
+			name:          "invalid port",
+			requestURI:    "/cluster1/service/kube-system/metrics-server:99999/healthz",
+			expectInvalid: true,
+		},
+		{
+			name:          "kube-apiserver path",
+			requestURI:    "/cluster1/api/v1/pods",
+			expectNoMatch: true,
+		},
+		{
+			name:          "cluster only",
+			requestURI:    "/cluster1",
+			expectNoMatch: true,
+		},
+	}
+
+	router := &ServicePathRouter{AllowHTTPServices: true}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proto, host, path, err := router.ParseTargetService(httptest.NewRequest("GET", c.requestURI, nil))
+			switch {
+			case c.expectInvalid:
+				if !errors.Is(err, ErrInvalidPath) || errors.Is(err, ErrNoMatch) {
+					t.Fatalf("expected ErrInvalidPath, got %v", err)
+				}
+				return
+			case c.expectNoMatch:
+				if !errors.Is(err, ErrNoMatch) {
+					t.Fatalf("expected ErrNoMatch, got %v", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if proto != c.expectProto || host != c.expectHost || path != c.expectPath {
+				t.Errorf("expected %s://%s%s, got %s://%s%s", c.expectProto, c.expectHost, c.expectPath, proto, host, path)
+			}
+		})
+	}
+}
+
+// catchAllRouter routes all the requests to host
+type catchAllRouter struct {
+	host string
+}
+
+func (router *catchAllRouter) ParseTargetService(r *http.Request) (string, string, string, error) {
+	return "https", router.host, r.URL.EscapedPath(), nil
+}
+
+// streamingRouter is a RouteClassifier classifying all the requests as streaming
+type streamingRouter struct {
+	catchAllRouter
+}
+
+func (router *streamingRouter) RouteClass(*http.Request) RouteClass {
+	return RouteStreaming
+}
+
+func TestChainRouterPrecedence(t *testing.T) {
+	cases := []struct {
+		name       string
+		routers    []Router
+		requestURI string
+		expectHost string
+	}{
+		{
+			name:       "kube-apiserver path, first router",
+			routers:    []Router{&RouterImpl{}, &ServicePathRouter{}},
+			requestURI: "/cluster1/api/v1/pods",
+			expectHost: "kubernetes.default.svc",
+		},
+		{
+			name:       "service path, second router",
+			routers:    []Router{&RouterImpl{}, &ServicePathRouter{}},
+			requestURI: "/cluster1/service/default/my-svc:443/",
+			expectHost: "my-svc.default.svc:443",
+		},
+		{
+			// The grammars are disjoint, the order doesn't matter
+			name:       "service path, first router",
+			routers:    []Router{&ServicePathRouter{}, &RouterImpl{}},
+			requestURI: "/cluster1/service/default/my-svc:443/",
+			expectHost: "my-svc.default.svc:443",
+		},
+		{
+			name:       "catch-all first",
+			routers:    []Router{&catchAllRouter{host: "catch-all"}, &RouterImpl{}, &ServicePathRouter{}},
+			requestURI: "/cluster1/service/default/my-svc:443/",
+			expectHost: "catch-all",
+		},
+		{
+			name:       "catch-all last",
+			routers:    []Router{&RouterImpl{}, &ServicePathRouter{}, &catchAllRouter{host: "catch-all"}},
+			requestURI: "/cluster1/unknown/path",
+			expectHost: "catch-all",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, host, _, err := NewChainRouter(c.routers...).ParseTargetService(httptest.NewRequest("GET", c.requestURI, nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if host != c.expectHost {
+				t.Errorf("expected host %q, got %q", c.expectHost, host)
+			}
+		})
+	}
+}
+
+// TestChainRouterInvalidVsUnmatched checks an invalid path fails the request with the router that matched it, while
+// an unmatched path falls through to the next router
+func TestChainRouterInvalidVsUnmatched(t *testing.T) {
+	router := NewChainRouter(&RouterImpl{}, &ServicePathRouter{}, &catchAllRouter{host: "catch-all"})
+
+	// The service path is invalid, the catch-all router isn't tried
+	_, host, _, err := router.ParseTargetService(httptest.NewRequest("GET", "/cluster1/service/default/http:my-svc:80/", nil))
+	if !errors.Is(err, ErrInvalidPath) || errors.Is(err, ErrNoMatch) {
+		t.Errorf("expected ErrInvalidPath, got %v with host %q", err, host)
+	}
+	_, host, _, err = router.ParseTargetService(httptest.NewRequest("GET", "/cluster1/api/v1/namespaces/bad.namespace/services/my-svc/proxy-service/", nil))
+	if !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("expected ErrInvalidPath, got %v with host %q", err, host)
+	}
+
+	// The path isn't in the grammar of the first two routers
+	_, host, _, err = router.ParseTargetService(httptest.NewRequest("GET", "/cluster1/unknown/path", nil))
+	if err != nil || host != "catch-all" {
+		t.Errorf("expected the catch-all router, got host %q error %v", host, err)
+	}
+
+	// None matches
+	_, host, _, err = NewChainRouter(&RouterImpl{}, &ServicePathRouter{}).ParseTargetService(httptest.NewRequest("GET", "/cluster1/unknown/path", nil))
+	if !errors.Is(err, ErrNoMatch) {
+		t.Errorf("expected ErrNoMatch, got %v with host %q", err, host)
+	}
+}
+
+func TestChainRouterMetrics(t *testing.T) {
+	router := NewChainRouter(&RouterImpl{}, &catchAllRouter{host: "a"}, &catchAllRouter{host: "b"})
+	before := testutil.ToFloat64(routerMatches.WithLabelValues("*agent.RouterImpl"))
+	beforeCatchAll := testutil.ToFloat64(routerMatches.WithLabelValues("*agent.catchAllRouter[1]"))
+
+	for _, path := range []string{"/cluster1/api/v1/pods", "/cluster1/healthz", "/cluster1/unknown"} {
+		if _, _, _, err := router.ParseTargetService(httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(routerMatches.WithLabelValues("*agent.RouterImpl")) - before; got != 2 {
+		t.Errorf("expected 2 requests routed by RouterImpl, got %v", got)
+	}
+	if got := testutil.ToFloat64(routerMatches.WithLabelValues("*agent.catchAllRouter[1]")) - beforeCatchAll; got != 1 {
+		t.Errorf("expected 1 request routed by the first catch-all router, got %v", got)
+	}
+}
+
+func TestChainRouterRouteClass(t *testing.T) {
+	router := NewChainRouter(&RouterImpl{}, &streamingRouter{}).(RouteClassifier)
+
+	if class := router.RouteClass(httptest.NewRequest("GET", "/cluster1/api/v1/pods", nil)); class != RouteUnary {
+		t.Errorf("expected the kube-apiserver request to be unary, got %v", class)
+	}
+	if class := router.RouteClass(httptest.NewRequest("GET", "/cluster1/api/v1/pods?watch=true", nil)); class != RouteStreaming {
+		t.Errorf("expected the watch to be streaming, got %v", class)
+	}
+	if class := router.RouteClass(httptest.NewRequest("GET", "/cluster1/custom", nil)); class != RouteStreaming {
+		t.Errorf("expected the request of the streaming router to be streaming, got %v", class)
+	}
+}
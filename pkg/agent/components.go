@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/hubsig"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// ComponentOptions holds the options used by BuildDefaultComponents to wire up
+// the default RequestProcessor, CertificateProvider and Router.
+type ComponentOptions struct {
+	// HubKubeConfig is the path to the hub cluster kubeconfig file.
+	// Required unless DisableAuth is set.
+	HubKubeConfig string
+	// ManagedKubeConfig is the path to the managed cluster kubeconfig file.
+	// If empty, the in-cluster config is used.
+	ManagedKubeConfig string
+	// DisableAuth substitutes a pass-through RequestProcessor when the TokenReview
+	// kube clients can not be built. For local development only.
+	DisableAuth bool
+	// AuthPolicy decides which requests the RequestProcessor authenticates.
+	AuthPolicy AuthPolicy
+	// HubSignatureKeyFile is the path of the key the hub signs the requests with, it sets
+	// AuthPolicy.HubSignatureKey. Disabled if empty.
+	HubSignatureKeyFile string
+	// DefaultServiceScheme and AllowHTTPServices configure the routing to the services,
+	// see RouterImpl.
+	DefaultServiceScheme string
+	AllowHTTPServices    bool
+	// ServicePaths also routes the short service paths with a ServicePathRouter, chained after RouterImpl.
+	ServicePaths bool
+}
+
+// BuildDefaultComponents builds the default implementations of the interfaces required by the agent.
+// When the managed cluster kubeconfig is provided, it's used instead of the in-cluster config, and the
+// CA in it is used to verify the kube-apiserver. Otherwise the CA of the service account is reloaded when
+// it's rotated.
+func BuildDefaultComponents(opts ComponentOptions) (RequestProcessor, CertificateProvider, Router, error) {
+	certificateProvider := NewFileWatchCertificateProvider(DefaultCAPath)
+	var router Router = &RouterImpl{DefaultServiceScheme: opts.DefaultServiceScheme, AllowHTTPServices: opts.AllowHTTPServices}
+	if opts.ServicePaths {
+		router = NewChainRouter(router, &ServicePathRouter{
+			DefaultServiceScheme: opts.DefaultServiceScheme,
+			AllowHTTPServices:    opts.AllowHTTPServices,
+		})
+	}
+
+	managedClusterConfig, managedClusterConfigErr := buildManagedClusterConfig(opts.ManagedKubeConfig)
+	if opts.ManagedKubeConfig != "" {
+		// An explicitly provided kubeconfig must be valid, even when auth is disabled
+		if managedClusterConfigErr != nil {
+			return nil, nil, nil, managedClusterConfigErr
+		}
+		certificateProvider = &restConfigCertificateProvider{config: managedClusterConfig}
+	}
+
+	policy := opts.AuthPolicy
+	if opts.HubSignatureKeyFile != "" {
+		key, err := hubsig.ReadKeyFile(opts.HubSignatureKeyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		policy.HubSignatureKey = key
+	}
+	requestProcessor, err := buildRequestProcessor(opts.HubKubeConfig, managedClusterConfig, managedClusterConfigErr, policy)
+	if err != nil {
+		if !opts.DisableAuth {
+			return nil, nil, nil, err
+		}
+		klog.Warningf("!!! Authentication is DISABLED: %v. All requests will be proxied without TokenReview, "+
+			"never use --disable-auth in production !!!", err)
+		requestProcessor = &passThroughRequestProcessor{}
+	}
+
+	return requestProcessor, certificateProvider, router, nil
+}
+
+// buildManagedClusterConfig returns the rest config of the managed cluster, from the kubeconfig file if provided,
+// otherwise from the in-cluster config.
+func buildManagedClusterConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build managed cluster kubeconfig: %w", err)
+		}
+		return config, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster config for managed cluster: %w", err)
+	}
+	return config, nil
+}
+
+// buildRequestProcessor creates the TokenReview based RequestProcessor,
+// managedClusterConfigErr is the error returned when building the managed cluster config.
+func buildRequestProcessor(hubKubeConfig string, managedClusterConfig *rest.Config, managedClusterConfigErr error, policy AuthPolicy) (RequestProcessor, error) {
+	if hubKubeConfig == "" {
+		return nil, fmt.Errorf("hub kubeconfig is required")
+	}
+	hubConfig, err := clientcmd.BuildConfigFromFlags("", hubKubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build hub kubeconfig: %w", err)
+	}
+	hubKubeClient, err := kubernetes.NewForConfig(hubConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hub Kubernetes client: %w", err)
+	}
+
+	if managedClusterConfigErr != nil {
+		return nil, managedClusterConfigErr
+	}
+	managedClusterKubeClient, err := kubernetes.NewForConfig(managedClusterConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create managed cluster Kubernetes client: %w", err)
+	}
+
+	return NewRequestProcessorWithPolicy(hubKubeClient, managedClusterKubeClient, policy), nil
+}
+
+// passThroughRequestProcessor lets every request through without authentication
+type passThroughRequestProcessor struct{}
+
+func (p *passThroughRequestProcessor) Process(targetHost string, r *http.Request) (error, int) {
+	return nil, http.StatusOK
+}
+
+// restConfigCertificateProvider provides the CA of a rest config as root CAs
+type restConfigCertificateProvider struct {
+	config *rest.Config
+}
+
+// GetRootCAs returns the pool of the CA data or CA file of the rest config, nil to verify with the system roots if
+// it has none. The CA configured without any PEM encoded certificate fails
+func (c *restConfigCertificateProvider) GetRootCAs() (*x509.CertPool, error) {
+	tlsConfig := c.config.TLSClientConfig
+	if len(tlsConfig.CAData) > 0 {
+		return parseRootCAs("the CA data of the rest config", tlsConfig.CAData)
+	}
+	if tlsConfig.CAFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(tlsConfig.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseRootCAs(tlsConfig.CAFile, data)
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+	"k8s.io/client-go/rest"
+)
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://127.0.0.1:6443
+  name: test
+contexts:
+- context:
+    cluster: test
+    user: test
+  name: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test-token
+`
+
+func TestBuildDefaultComponents(t *testing.T) {
+	// Make sure the in-cluster config is never available
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(kubeconfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	cases := []struct {
+		name                 string
+		opts                 ComponentOptions
+		expectErr            bool
+		expectPassThrough    bool
+		expectRestConfigCert bool
+		expectChainRouter    bool
+	}{
+		{
+			name:      "no kubeconfigs",
+			opts:      ComponentOptions{},
+			expectErr: true,
+		},
+		{
+			name:      "hub kubeconfig only, not in cluster",
+			opts:      ComponentOptions{HubKubeConfig: kubeconfig},
+			expectErr: true,
+		},
+		{
+			name:      "managed kubeconfig only",
+			opts:      ComponentOptions{ManagedKubeConfig: kubeconfig},
+			expectErr: true,
+		},
+		{
+			name:                 "both kubeconfigs",
+			opts:                 ComponentOptions{HubKubeConfig: kubeconfig, ManagedKubeConfig: kubeconfig},
+			expectRestConfigCert: true,
+		},
+		{
+			name:      "invalid hub kubeconfig",
+			opts:      ComponentOptions{HubKubeConfig: missing, ManagedKubeConfig: kubeconfig},
+			expectErr: true,
+		},
+		{
+			name:              "no kubeconfigs, auth disabled",
+			opts:              ComponentOptions{DisableAuth: true},
+			expectPassThrough: true,
+		},
+		{
+			name:                 "managed kubeconfig only, auth disabled",
+			opts:                 ComponentOptions{ManagedKubeConfig: kubeconfig, DisableAuth: true},
+			expectPassThrough:    true,
+			expectRestConfigCert: true,
+		},
+		{
+			name:                 "both kubeconfigs, auth disabled",
+			opts:                 ComponentOptions{HubKubeConfig: kubeconfig, ManagedKubeConfig: kubeconfig, DisableAuth: true},
+			expectRestConfigCert: true,
+		},
+		{
+			name:              "service paths",
+			opts:              ComponentOptions{DisableAuth: true, ServicePaths: true},
+			expectPassThrough: true,
+			expectChainRouter: true,
+		},
+		{
+			name:      "invalid managed kubeconfig, auth disabled",
+			opts:      ComponentOptions{ManagedKubeConfig: missing, DisableAuth: true},
+			expectErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rp, cp, router, err := BuildDefaultComponents(c.opts)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, ok := router.(*chainRouter); c.expectChainRouter && !ok {
+				t.Errorf("expected *chainRouter, got %T", router)
+			}
+			if _, ok := router.(*RouterImpl); !c.expectChainRouter && !ok {
+				t.Errorf("expected *RouterImpl, got %T", router)
+			}
+
+			_, passThrough := rp.(*passThroughRequestProcessor)
+			if passThrough != c.expectPassThrough {
+				t.Errorf("expected pass-through request processor %v, got %T", c.expectPassThrough, rp)
+			}
+
+			_, restConfigCert := cp.(*restConfigCertificateProvider)
+			if restConfigCert != c.expectRestConfigCert {
+				t.Errorf("expected rest config certificate provider %v, got %T", c.expectRestConfigCert, cp)
+			}
+		})
+	}
+}
+
+func TestRestConfigCertificateProviderGetRootCAs(t *testing.T) {
+	ca, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	invalidPEM := []byte("-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n")
+
+	tests := []struct {
+		name         string
+		tlsConfig    rest.TLSClientConfig
+		expectSystem bool
+		expectErr    bool
+	}{
+		{
+			name:         "no CA",
+			expectSystem: true,
+		},
+		{
+			name:      "CA data",
+			tlsConfig: rest.TLSClientConfig{CAData: ca.CertPEM},
+		},
+		{
+			name:      "CA file",
+			tlsConfig: rest.TLSClientConfig{CAFile: writeCAFile(t, ca.CertPEM)},
+		},
+		{
+			name:      "invalid CA data",
+			tlsConfig: rest.TLSClientConfig{CAData: invalidPEM},
+			expectErr: true,
+		},
+		{
+			name:      "invalid CA file",
+			tlsConfig: rest.TLSClientConfig{CAFile: writeCAFile(t, invalidPEM)},
+			expectErr: true,
+		},
+		{
+			name:      "missing CA file",
+			tlsConfig: rest.TLSClientConfig{CAFile: filepath.Join(t.TempDir(), "missing.crt")},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &restConfigCertificateProvider{config: &rest.Config{TLSClientConfig: tt.tlsConfig}}
+			rootCAs, err := provider.GetRootCAs()
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expectSystem {
+				if rootCAs != nil {
+					t.Errorf("expected nil root CAs to verify with the system roots, got %d certificates", len(rootCAs.Subjects()))
+				}
+				return
+			}
+			if rootCAs == nil || len(rootCAs.Subjects()) != 1 {
+				t.Errorf("expected the CA in the pool, got %v", rootCAs)
+			}
+		})
+	}
+}
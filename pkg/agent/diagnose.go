@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/rtt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultDiagnoseTimeout is the default timeout of each check of Diagnose
+const DefaultDiagnoseTimeout = 5 * time.Second
+
+// DefaultAPIServerAddress is the address of the apiserver of the managed cluster from inside the cluster
+const DefaultAPIServerAddress = "kubernetes.default.svc:443"
+
+// DiagnoseConfig configures the checks of Diagnose
+type DiagnoseConfig struct {
+	// Agent is the config of the agent to diagnose: its HubAddress, ClusterName, DialOptions, socket paths and
+	// DialContextFn are checked
+	Agent *Config
+	// HubTLSConfig is the TLS config the agent connects to the Hub with, e.g. the credentials passed in
+	// DialOptions. The TLS handshake is skipped if nil, e.g. for an insecure connection, unless the Agent pins the
+	// SPKI hashes of the Hub, the handshake verifies them then
+	HubTLSConfig *tls.Config
+	// CertificateProvider provides the roots the apiserver of the managed cluster is verified with,
+	// its check is skipped if nil
+	CertificateProvider CertificateProvider
+	// APIServerAddress is the address of the apiserver of the managed cluster, defaults to DefaultAPIServerAddress
+	APIServerAddress string
+	// Timeout bounds each check, defaults to DefaultDiagnoseTimeout
+	Timeout time.Duration
+}
+
+// CheckStatus is the outcome of a check of Diagnose
+type CheckStatus string
+
+const (
+	CheckPassed  CheckStatus = "PASS"
+	CheckFailed  CheckStatus = "FAIL"
+	CheckSkipped CheckStatus = "SKIP"
+)
+
+// The names of the checks of Diagnose, in the order they run
+const (
+	CheckHubDNS     = "hub-dns"
+	CheckHubTCP     = "hub-tcp"
+	CheckHubTLS     = "hub-tls"
+	CheckTunnelPing = "tunnel-ping"
+	CheckUDSSocket  = "uds-socket"
+	CheckAPIServer  = "apiserver"
+)
+
+// CheckResult is the result of a check of Diagnose
+type CheckResult struct {
+	Name   string
+	Status CheckStatus
+	// Message describes what was checked, or why the check failed or was skipped
+	Message  string
+	Duration time.Duration
+}
+
+// DiagnosticReport is the result of Diagnose
+type DiagnosticReport struct {
+	Checks []CheckResult
+}
+
+// Passed returns whether no check failed
+func (r *DiagnosticReport) Passed() bool {
+	for _, c := range r.Checks {
+		if c.Status == CheckFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns the result of the check with the name, nil if it didn't run
+func (r *DiagnosticReport) Check(name string) *CheckResult {
+	for i := range r.Checks {
+		if r.Checks[i].Name == name {
+			return &r.Checks[i]
+		}
+	}
+	return nil
+}
+
+// Print writes a PASS, FAIL or SKIP line for each check
+func (r *DiagnosticReport) Print(w io.Writer) {
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%-4s  %-12s  %s (%v)\n", c.Status, c.Name, c.Message, c.Duration.Round(time.Millisecond))
+	}
+}
+
+// skippedError is returned by a check that doesn't apply, e.g. when it's not configured
+type skippedError struct {
+	reason string
+}
+
+func (e *skippedError) Error() string { return e.reason }
+
+// Diagnose checks the connectivity of the agent for troubleshooting: the DNS resolution, TCP reachability and TLS
+// handshake of the Hub, a Tunnel call exchanging a PING with the Hub, the Unix Domain Sockets of the proxies and
+// the apiserver of the managed cluster. The Tunnel call doesn't replace the tunnel of the running agent of the
+// cluster, except with Hubs not supporting v1.DiagnosticMetadataKey. The error is only set for an invalid config,
+// the failed checks are reported
+func Diagnose(ctx context.Context, config *DiagnoseConfig) (*DiagnosticReport, error) {
+	if config == nil || config.Agent == nil || config.Agent.HubAddress == "" || config.Agent.ClusterName == "" {
+		return nil, errors.New("the HubAddress and ClusterName of the agent must be set")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDiagnoseTimeout
+	}
+
+	checks := []struct {
+		name  string
+		check func(ctx context.Context, config *DiagnoseConfig) (string, error)
+	}{
+		{CheckHubDNS, diagnoseHubDNS},
+		{CheckHubTCP, diagnoseHubTCP},
+		{CheckHubTLS, diagnoseHubTLS},
+		{CheckTunnelPing, diagnoseTunnelPing},
+		{CheckUDSSocket, diagnoseUDSSockets},
+		{CheckAPIServer, diagnoseAPIServer},
+	}
+
+	report := &DiagnosticReport{}
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		message, err := c.check(checkCtx, config)
+		cancel()
+
+		result := CheckResult{Name: c.name, Status: CheckPassed, Message: message, Duration: time.Since(start)}
+		var skipped *skippedError
+		switch {
+		case errors.As(err, &skipped):
+			result.Status, result.Message = CheckSkipped, skipped.reason
+		case err != nil:
+			result.Status, result.Message = CheckFailed, err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report, nil
+}
+
+// diagnoseHubDNS resolves the host of the Hub
+func diagnoseHubDNS(ctx context.Context, config *DiagnoseConfig) (string, error) {
+	host, _, err := net.SplitHostPort(config.Agent.HubAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid hub address %q: %w", config.Agent.HubAddress, err)
+	}
+	if net.ParseIP(host) != nil {
+		return fmt.Sprintf("%s is an IP address", host), nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), nil
+}
+
+// diagnoseHubTCP connects to the Hub
+func diagnoseHubTCP(ctx context.Context, config *DiagnoseConfig) (string, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", config.Agent.HubAddress)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return fmt.Sprintf("connected to %s", conn.RemoteAddr()), nil
+}
+
+// diagnoseHubTLS completes a TLS handshake with the Hub and reports its certificate chain
+func diagnoseHubTLS(ctx context.Context, config *DiagnoseConfig) (string, error) {
+	tlsConfig := config.Agent.pinnedTLSConfig()
+	if tlsConfig == nil {
+		if config.HubTLSConfig == nil {
+			return "", &skippedError{reason: "TLS is not configured"}
+		}
+		tlsConfig = config.HubTLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = config.Agent.TLSServerName
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(config.Agent.HubAddress)
+	}
+	conn, err := (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", config.Agent.HubAddress)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return describeChain(conn.(*tls.Conn).ConnectionState()), nil
+}
+
+// diagnoseTunnelPing sends a PING on a diagnostic Tunnel call to the Hub and waits for the PONG
+func diagnoseTunnelPing(ctx context.Context, config *DiagnoseConfig) (string, error) {
+	dialOptions := slices.Clone(config.Agent.DialOptions)
+	if authority := config.Agent.authority(); authority != "" {
+		dialOptions = append(dialOptions, grpc.WithAuthority(authority))
+	}
+	if creds := config.Agent.pinnedCredentials(); creds != nil {
+		dialOptions = append(dialOptions, creds)
+	}
+	conn, err := grpc.NewClient(config.Agent.HubAddress, dialOptions...)
+	if err != nil {
+		return "", fmt.Errorf("failed to dial hub: %w", err)
+	}
+	defer conn.Close()
+
+	streamCtx := metadata.AppendToOutgoingContext(ctx, "cluster-name", config.Agent.ClusterName, v1.DiagnosticMetadataKey, "true")
+	stream, err := v1.NewTunnelServiceClient(conn).Tunnel(streamCtx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create tunnel stream: %w", err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return "", fmt.Errorf("failed to receive tunnel header: %w", err)
+	}
+	if len(header.Get(v1.DiagnosticMetadataKey)) == 0 {
+		return "", errors.New("the hub doesn't support diagnostic streams, the running agent of the cluster reconnects")
+	}
+
+	if err := stream.Send(&v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_PING, Data: rtt.NewPingPayload()}); err != nil {
+		return "", fmt.Errorf("failed to send PING: %w", err)
+	}
+	packet, err := stream.Recv()
+	if err != nil {
+		return "", fmt.Errorf("failed to receive PONG: %w", err)
+	}
+	if packet.Code != v1.ControlCode_PONG {
+		return "", fmt.Errorf("expected a PONG, got %v", packet.Code)
+	}
+	sample, err := rtt.SampleFromPong(packet.Data)
+	if err != nil {
+		return "", err
+	}
+	stream.CloseSend()
+	return fmt.Sprintf("PONG received from the hub in %v", sample.Round(time.Microsecond)), nil
+}
+
+// diagnoseUDSSockets checks that the sockets of the proxies accept connections, or can be created
+func diagnoseUDSSockets(ctx context.Context, config *DiagnoseConfig) (string, error) {
+	var messages []string
+	for _, spec := range proxySpecs(config.Agent) {
+		message, err := diagnoseUDSSocket(ctx, spec.SocketPath, config.Agent.UseAbstractNamespace && abstractNamespaceSupported)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", spec.SocketPath, err)
+		}
+		messages = append(messages, fmt.Sprintf("%s %s", spec.SocketPath, message))
+	}
+	return strings.Join(messages, ", "), nil
+}
+
+// diagnoseUDSSocket dials the socket of a running proxy at the path, or creates a socket next to it. A socket in the
+// abstract namespace is created at the path itself, it's gone once it's closed
+func diagnoseUDSSocket(ctx context.Context, path string, abstract bool) (string, error) {
+	if abstract {
+		address := socketAddress(path, true)
+		if conn, err := (&net.Dialer{}).DialContext(ctx, "unix", address); err == nil {
+			conn.Close()
+			return "accepts connections in the abstract namespace", nil
+		}
+		listener, err := net.Listen("unix", address)
+		if err != nil {
+			return "", fmt.Errorf("can't create a socket in the abstract namespace: %w", err)
+		}
+		listener.Close()
+		return "can be created in the abstract namespace", nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "unix", path)
+		if err != nil {
+			return "", fmt.Errorf("a file exists but doesn't accept connections: %w", err)
+		}
+		conn.Close()
+		return "accepts connections", nil
+	}
+
+	probe := filepath.Join(filepath.Dir(path), fmt.Sprintf(".mctunnel-diagnose-%d.sock", os.Getpid()))
+	listener, err := net.Listen("unix", probe)
+	if err != nil {
+		return "", fmt.Errorf("can't create a socket in %s: %w", filepath.Dir(path), err)
+	}
+	listener.Close()
+	os.Remove(probe)
+	return "can be created", nil
+}
+
+// diagnoseAPIServer completes a TLS handshake with the apiserver of the managed cluster, verified with the roots
+// of the CertificateProvider
+func diagnoseAPIServer(ctx context.Context, config *DiagnoseConfig) (string, error) {
+	if config.CertificateProvider == nil {
+		return "", &skippedError{reason: "no CertificateProvider"}
+	}
+	rootCAs, err := config.CertificateProvider.GetRootCAs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get root CAs: %w", err)
+	}
+	address := config.APIServerAddress
+	if address == "" {
+		address = DefaultAPIServerAddress
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid apiserver address %q: %w", address, err)
+	}
+
+	dialContext := config.Agent.DialContextFn
+	if dialContext == nil {
+		dialContext = (&net.Dialer{}).DialContext
+	}
+	rawConn, err := dialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	conn := tls.Client(rawConn, &tls.Config{RootCAs: rootCAs, ServerName: host, MinVersion: tls.VersionTLS12})
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s: %s", address, describeChain(conn.ConnectionState())), nil
+}
+
+// describeChain describes the certificate chain of the peer with the expiry of each certificate
+func describeChain(state tls.ConnectionState) string {
+	certs := make([]string, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		certs = append(certs, fmt.Sprintf("%q expires %s (in %dd)", cert.Subject.String(),
+			cert.NotAfter.UTC().Format(time.RFC3339), int(time.Until(cert.NotAfter).Hours()/24)))
+	}
+	return fmt.Sprintf("%s, certificates: %s", tls.VersionName(state.Version), strings.Join(certs, ", "))
+}
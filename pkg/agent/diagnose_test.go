@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestDiagnoseUDSSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	listening := filepath.Join(dir, "listening.sock")
+	listener, err := net.Listen("unix", listening)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	notSocket := filepath.Join(dir, "file")
+	if err := os.WriteFile(notSocket, nil, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	cases := []struct {
+		name            string
+		path            string
+		expectedMessage string
+		expectErr       bool
+	}{
+		{name: "running proxy", path: listening, expectedMessage: "accepts connections"},
+		{name: "missing socket", path: filepath.Join(dir, "missing.sock"), expectedMessage: "can be created"},
+		{name: "not a socket", path: notSocket, expectErr: true},
+		{name: "missing directory", path: filepath.Join(dir, "missing", "proxy.sock"), expectErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			message, err := diagnoseUDSSocket(context.Background(), c.path, false)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if message != c.expectedMessage {
+				t.Errorf("expected %q, got %q", c.expectedMessage, message)
+			}
+		})
+	}
+
+	// The probe socket is removed
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only the listening socket and the file to be left, got %v", entries)
+	}
+}
+
+func TestDiagnoseUnreachableHub(t *testing.T) {
+	// Nothing listens on the port of the hub
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	hubAddress := listener.Addr().String()
+	listener.Close()
+
+	report, err := Diagnose(context.Background(), &DiagnoseConfig{
+		Agent: &Config{
+			HubAddress:    hubAddress,
+			ClusterName:   "cluster1",
+			UDSSocketPath: filepath.Join(t.TempDir(), "proxy.sock"),
+			DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		},
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]CheckStatus{
+		CheckHubDNS:     CheckPassed,
+		CheckHubTCP:     CheckFailed,
+		CheckHubTLS:     CheckSkipped,
+		CheckTunnelPing: CheckFailed,
+		CheckUDSSocket:  CheckPassed,
+		CheckAPIServer:  CheckSkipped,
+	}
+	for name, status := range expected {
+		check := report.Check(name)
+		if check == nil {
+			t.Errorf("expected the %s check to run", name)
+			continue
+		}
+		if check.Status != status {
+			t.Errorf("expected %s to be %s, got %s: %s", name, status, check.Status, check.Message)
+		}
+	}
+	if report.Passed() {
+		t.Errorf("expected the report not to pass")
+	}
+
+	var out bytes.Buffer
+	report.Print(&out)
+	for _, line := range []string{"PASS  hub-dns", "FAIL  hub-tcp", "SKIP  hub-tls"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected the output to contain %q, got\n%s", line, out.String())
+		}
+	}
+
+	if _, err := Diagnose(context.Background(), &DiagnoseConfig{Agent: &Config{HubAddress: hubAddress}}); err == nil {
+		t.Errorf("expected an error without a cluster name")
+	}
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DialContextFunc dials the target services of the proxy, it has the signature of net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewKubeDNSDialer returns a DialContextFunc resolving <service>.<namespace>.svc[.cluster.local] addresses
+// via the Kubernetes API instead of the DNS, e.g. when the agent runs outside of the managed cluster network.
+// Named ports, such as the one in https:metrics-server:https, are resolved to the port of the service.
+// Other addresses are dialed as is.
+func NewKubeDNSDialer(client kubernetes.Interface) DialContextFunc {
+	return newKubeDNSDialer(client, (&net.Dialer{}).DialContext)
+}
+
+func newKubeDNSDialer(client kubernetes.Interface, dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		name, namespace, ok := parseServiceHost(host)
+		if !ok {
+			return dial(ctx, network, addr)
+		}
+
+		resolved, err := resolveService(ctx, client, name, namespace, port)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", addr, err)
+		}
+		logger.V(4).InfoS("Resolved service address", "address", addr, "resolved", resolved)
+		return dial(ctx, network, resolved)
+	}
+}
+
+// parseServiceHost returns the name and namespace of a <service>.<namespace>.svc[.cluster.local] host
+func parseServiceHost(host string) (name, namespace string, ok bool) {
+	host = strings.TrimSuffix(host, ".")
+	host = strings.TrimSuffix(host, ".cluster.local")
+	parts := strings.Split(host, ".")
+	if len(parts) != 3 || parts[2] != "svc" || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// resolveService returns the address to dial for the port of the service, the port is either a number or a name
+func resolveService(ctx context.Context, client kubernetes.Interface, name, namespace, port string) (string, error) {
+	svc, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		return net.JoinHostPort(svc.Spec.ExternalName, port), nil
+	}
+
+	servicePort, err := findServicePort(svc, port)
+	if err != nil {
+		return "", err
+	}
+
+	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		return net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(servicePort.Port))), nil
+	}
+
+	// Headless service, dial a ready endpoint
+	return resolveEndpoint(ctx, client, name, namespace, servicePort)
+}
+
+// findServicePort returns the port of the service with the number or name
+func findServicePort(svc *corev1.Service, port string) (*corev1.ServicePort, error) {
+	number, err := strconv.Atoi(port)
+	for i := range svc.Spec.Ports {
+		p := &svc.Spec.Ports[i]
+		if (err == nil && int(p.Port) == number) || (err != nil && p.Name == port) {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("service %s/%s has no port %s", svc.Namespace, svc.Name, port)
+}
+
+// resolveEndpoint returns the address of a ready endpoint of the headless service for the port
+func resolveEndpoint(ctx context.Context, client kubernetes.Interface, name, namespace string, servicePort *corev1.ServicePort) (string, error) {
+	slices, err := client.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, slice := range slices.Items {
+		var port *int32
+		for _, p := range slice.Ports {
+			if p.Name != nil && *p.Name == servicePort.Name {
+				port = p.Port
+				break
+			}
+		}
+		if port == nil {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if len(endpoint.Addresses) > 0 {
+				return net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(*port))), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("headless service %s/%s has no ready endpoint for port %s", namespace, name, servicePort.Name)
+}
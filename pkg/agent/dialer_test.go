@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+// staticRouter routes every request to the same target
+type staticRouter struct {
+	proto, host string
+}
+
+func (r *staticRouter) ParseTargetService(req *http.Request) (string, string, string, error) {
+	return r.proto, r.host, req.URL.EscapedPath(), nil
+}
+
+func TestProxyDialContextFn(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from backend"))
+	}))
+	defer backend.Close()
+
+	// The mock dialer resolves every address to the backend
+	var dialed []string
+	p := newProxy(&passThroughRequestProcessor{}, &CertificateProviderImplt{},
+		&staticRouter{proto: "http", host: "my-svc.my-ns.svc:8080"}, "")
+	p.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Body.String() != "Hello from backend" {
+		t.Errorf("unexpected body %q", w.Body.String())
+	}
+	if len(dialed) != 1 || dialed[0] != "my-svc.my-ns.svc:8080" {
+		t.Errorf("expected the mock dialer to dial my-svc.my-ns.svc:8080, got %v", dialed)
+	}
+}
+
+func TestKubeDNSDialer(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "metrics-server", Namespace: "kube-system"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []corev1.ServicePort{{Name: "https", Port: 8443}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: corev1.ClusterIPNone,
+				Ports:     []corev1.ServicePort{{Name: "https", Port: 443}},
+			},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "db-abcde",
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "db"},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: ptr.To("https"), Port: ptr.To[int32](9443)}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.1.0.4"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false)}},
+				{Addresses: []string{"10.1.0.5"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: corev1.ClusterIPNone,
+				Ports:     []corev1.ServicePort{{Name: "https", Port: 443}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Type:         corev1.ServiceTypeExternalName,
+				ExternalName: "example.com",
+			},
+		},
+	)
+
+	cases := []struct {
+		name          string
+		addr          string
+		expectAddr    string
+		expectErrPart string
+	}{
+		{name: "named port", addr: "metrics-server.kube-system.svc:https", expectAddr: "10.0.0.1:8443"},
+		{name: "numeric port", addr: "metrics-server.kube-system.svc:8443", expectAddr: "10.0.0.1:8443"},
+		{name: "cluster domain", addr: "metrics-server.kube-system.svc.cluster.local.:https", expectAddr: "10.0.0.1:8443"},
+		{name: "headless", addr: "db.default.svc:https", expectAddr: "10.1.0.5:9443"},
+		{name: "external name", addr: "external.default.svc:443", expectAddr: "example.com:443"},
+		{name: "not a service", addr: "example.com:443", expectAddr: "example.com:443"},
+		{name: "pod address", addr: "10-1-0-5.default.pod:443", expectAddr: "10-1-0-5.default.pod:443"},
+		{name: "unknown service", addr: "missing.default.svc:443", expectErrPart: "not found"},
+		{name: "unknown port", addr: "metrics-server.kube-system.svc:http", expectErrPart: "has no port http"},
+		{name: "no ready endpoint", addr: "empty.default.svc:https", expectErrPart: "has no ready endpoint"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var dialed string
+			dial := newKubeDNSDialer(client, func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = addr
+				conn, _ := net.Pipe()
+				return conn, nil
+			})
+
+			conn, err := dial(context.Background(), "tcp", c.addr)
+			if c.expectErrPart != "" {
+				if err == nil || !strings.Contains(err.Error(), c.expectErrPart) {
+					t.Fatalf("expected error containing %q, got %v", c.expectErrPart, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer conn.Close()
+			if dialed != c.expectAddr {
+				t.Errorf("expected to dial %q, got %q", c.expectAddr, dialed)
+			}
+		})
+	}
+}
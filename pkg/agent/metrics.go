@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tunnelRTT is the smoothed round-trip time of the tunnel to the Hub
+var tunnelRTT = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "agent",
+	Name:      "tunnel_rtt_seconds",
+	Help:      "Smoothed round-trip time between the agent and the hub, measured with PING/PONG packets.",
+})
+
+// packetProcessingLatency is the time from the creation of a packet by the Hub to its delivery to the target,
+// it depends on the clocks of the Hub and agent being in sync
+var packetProcessingLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "agent",
+	Name:      "packet_processing_latency_seconds",
+	Help:      "Time from the creation of a packet by the hub to its delivery to the target, for the packets with a timestamp.",
+	Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16), // 0.5ms to ~16s
+})
+
+// integrityFailures counts the connections closed because the checksum of a DATA packet from the Hub didn't match
+// its data
+var integrityFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "agent",
+	Name:      "integrity_failures_total",
+	Help:      "Connections closed because a DATA packet from the hub didn't match its checksum.",
+})
+
+// routerMatches counts the requests routed by the Router of NewChainRouter, by the router that matched them, none if
+// no router matched
+var routerMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "agent",
+	Name:      "router_matches_total",
+	Help:      "Requests routed by the chain router, by the router that matched them, none if no router matched.",
+}, []string{"router"})
+
+func init() {
+	prometheus.MustRegister(tunnelRTT, packetProcessingLatency, integrityFailures, routerMatches)
+}
@@ -1,25 +1,31 @@
 package agent
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
-	"k8s.io/klog/v2"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/packetqueue"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/resume"
 )
 
 const (
 	// outgoingChanSize is the buffer size for the outgoing packet channel
 	outgoingChanSize = 150
-	// incomingChanSize is the buffer size for each connection's incoming packet channel
-	// This ensures packets with the same conn_id are processed sequentially while
-	// allowing buffering to handle network fluctuations and prevent blocking
-	incomingChanSize = 150
 	// connReadBufferSize is the buffer size for reading from local connections
 	// 32KB is a good balance between memory usage and performance for most use cases:
 	// - Small enough to avoid excessive memory usage
@@ -29,8 +35,18 @@ const (
 	connReadBufferSize = 32 * 1024 // 32KB
 	// dialTimeout is the timeout for dialing local services
 	dialTimeout = 10 * time.Second
+	// idleConnectionTimeout is the default timeout of the connections the proxy sends no data on
+	idleConnectionTimeout = 5 * time.Minute
+	// idleSweepInterval is how often the connections are checked for the idle timeout
+	idleSweepInterval = time.Minute
+	// drainPollInterval is how often GracefulClose checks whether the connections are closed
+	drainPollInterval = 100 * time.Millisecond
 
 	udsSocketPath = "/tmp/multiclustertunnel.sock"
+
+	// controlConnID is the conn_id reserved for tunnel-level control messages (such as DRAIN),
+	// a local connection is never created for it
+	controlConnID int64 = 0
 )
 
 // PacketConnManagerConfig holds configuration for the packetConnManagerImpl
@@ -41,15 +57,41 @@ type PacketConnManagerConfig struct {
 	// OutgoingChanSize is the buffer size for the outgoing packet channel
 	// Default: 150, recommended range: 50-500
 	OutgoingChanSize int
-	// IncomingChanSize is the buffer size for each connection's incoming packet channel
-	// Default: 150, recommended range: 20-200
-	IncomingChanSize int
+	// MaxBufferedBytes is the budget of the data from Hub buffered for each connection until it's written to the
+	// target, the connection is closed with "receiver too slow" when it's exceeded
+	// Default: 256KB, recommended range: 64KB-4MB
+	MaxBufferedBytes int
 	// DialTimeout is the timeout for dialing local services
 	// Default: 10s, recommended range: 5s-30s
 	DialTimeout time.Duration
 	// UDSSocketPath is the path to the Unix Domain Socket for connecting to the proxy
 	// Default: "/tmp/multiclustertunnel.sock"
 	UDSSocketPath string
+	// UseAbstractNamespace dials the sockets of the proxies in the abstract namespace, see Config.UseAbstractNamespace.
+	// It's ignored on the platforms other than Linux
+	// Default: false
+	UseAbstractNamespace bool
+	// ResumeWindow is how long the connections are kept for the Hub to resume them after the tunnel stream ended,
+	// it only applies to the streams the Hub resumes
+	// Default: 0, resuming disabled
+	ResumeWindow time.Duration
+	// MaxReplayBytes is the budget of the data sent on each connection kept until the Hub acknowledges it
+	// Default: resume.DefaultMaxBytes
+	MaxReplayBytes int
+	// LogPayloadSample logs the first bytes of the first packets of each connection in each direction
+	// Default: nil, disabled
+	LogPayloadSample *capture.SampleConfig
+	// IdleConnectionTimeout closes the connections the proxy sent no data on for this long, e.g. when the Hub went
+	// away without closing them. Streams quiet for longer, e.g. watches without events, are closed as well
+	// Default: 5m, 0 disables it
+	IdleConnectionTimeout time.Duration
+	// QoS queues the packets of the bulk connections on BulkOutgoingChan, so the interactive ones aren't delayed
+	// behind them
+	// Default: nil, disabled
+	QoS *qos.Config
+	// Coalesce buffers the small writes of the proxies for up to Coalesce.Delay to send them in fewer packets
+	// Default: nil, disabled
+	Coalesce *coalesce.Config
 }
 
 // DefaultPacketConnManagerConfig returns the default configuration
@@ -57,83 +99,460 @@ func DefaultPacketConnManagerConfig() *PacketConnManagerConfig {
 	return &PacketConnManagerConfig{
 		ReadBufferSize:   connReadBufferSize,
 		OutgoingChanSize: outgoingChanSize,
-		IncomingChanSize: incomingChanSize,
+		MaxBufferedBytes: packetqueue.DefaultMaxBytes,
 		DialTimeout:      dialTimeout,
 		UDSSocketPath:    udsSocketPath,
+
+		IdleConnectionTimeout: idleConnectionTimeout,
 	}
 }
 
+// PacketConnManagerMetrics is a snapshot of the stats of the connections of the agent, the counters are cumulative
+// since the agent was created
+type PacketConnManagerMetrics struct {
+	// ActiveConnections is the number of open connections
+	ActiveConnections int
+	// TotalConnections is the number of connections established to the proxies
+	TotalConnections int64
+	// TotalPacketsSent and BytesSent count the packets sent to the Hub and their data
+	TotalPacketsSent int64
+	// TotalPacketsRecv and BytesRecv count the packets received from the Hub and their data
+	TotalPacketsRecv int64
+	BytesSent        int64
+	BytesRecv        int64
+	// DialErrors is the number of connections that failed to dial their proxy
+	DialErrors int64
+	// SendTimeouts is the number of error packets to the Hub dropped because the outgoing channel was full
+	SendTimeouts int64
+}
+
+// ConnStats are the stats of an open connection to a proxy, returned by Agent.ListConnections
+type ConnStats struct {
+	ConnID   int64     `json:"connId"`
+	DialedAt time.Time `json:"dialedAt"`
+	// BytesRead is the data read from the proxy and sent to the Hub, BytesWritten the data from the Hub written to it
+	BytesRead    int64 `json:"bytesRead"`
+	BytesWritten int64 `json:"bytesWritten"`
+}
+
 // packetConnManager receives tunnel.Packet from Hub and manages local connections
 type packetConnManager interface {
 	Dispatch(packet *v1.Packet) error
+	// HasConnection returns whether the connection is open, its packets are dispatched without blocking
+	HasConnection(connID int64) bool
+	// StartStream is called when a tunnel stream starts, resumable is whether the Hub resumes the connections on it
+	StartStream(resumable bool)
+	// EndStream is called when the tunnel stream ends
+	EndStream()
+	// SetFirstPacket is called before the packets of a tunnel stream are dispatched with whether the Hub opens the
+	// connections on their first DATA packet with data, an empty DATA packet doesn't open a connection then
+	SetFirstPacket(firstPacket bool)
+	// SetIntegrity is called before the packets of a tunnel stream are dispatched with whether the Hub checks the
+	// integrity of the DATA packets, see v1.IntegrityMetadataKey
+	SetIntegrity(integrity bool)
 	OutgoingChan() <-chan *v1.Packet
+	// BulkOutgoingChan returns the channel of the packets of the bulk connections, nil if QoS is disabled
+	BulkOutgoingChan() <-chan *v1.Packet
+	Metrics() PacketConnManagerMetrics
+	// ListConnections returns the stats of the open connections, ordered by conn_id
+	ListConnections() []ConnStats
+	// GracefulClose stops opening new connections, waits until the open ones are closed, or ctx is done, and then
+	// closes the manager
+	GracefulClose(ctx context.Context) error
 	Close() error
 }
 
+// packetConnCounters are the cumulative counters of PacketConnManagerMetrics
+type packetConnCounters struct {
+	totalConnections atomic.Int64
+	packetsSent      atomic.Int64
+	packetsRecv      atomic.Int64
+	bytesSent        atomic.Int64
+	bytesRecv        atomic.Int64
+	dialErrors       atomic.Int64
+	sendTimeouts     atomic.Int64
+}
+
 // packetConn represents a single local connection managed by the packetConnManager
 type packetConn struct {
-	id       int64
-	conn     net.Conn
-	ctx      context.Context
-	cancel   context.CancelFunc
-	outgoing chan<- *v1.Packet
-	// incoming is the channel for packets from Hub that need to be processed sequentially
+	id     int64
+	conn   net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	// classifier turns the connection bulk once it sent enough data, nil if QoS is disabled
+	classifier *qos.Conn
+	// incoming buffers the packets from Hub that need to be processed sequentially
 	// This ensures packets with the same conn_id are processed in order
-	incoming chan *v1.Packet
-	// incomingClosed tracks if the incoming channel has been closed to prevent double-close
-	incomingClosed int32 // atomic flag
-	// closeOnce ensures the channel is only closed once
-	closeOnce sync.Once
+	incoming *packetqueue.Queue
+	// sender and receiver number the DATA packets to resume the connection on the next tunnel stream, nil if it
+	// was created on a stream the Hub doesn't resume. sendMu orders numbering the packets with sending them
+	sender   *resume.Sender
+	receiver *resume.Receiver
+	sendMu   sync.Mutex
+	// seqNum is the SeqNum of the last DATA packet sent to the Hub, only used by the goroutine reading from the target.
+	// seqNums drops the DATA packets from the Hub received twice when the connection isn't resumed
+	seqNum  int64
+	seqNums v1.SeqNumReceiver
+	// generation is the stream generation the connection was created or last resumed on, guarded by connLock
+	generation int64
+	// sampler samples the payload of the first packets for the logs, nil if disabled
+	sampler *capture.Sampler
+
+	dialedAt     time.Time
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	// lastReadAt is when data was last read from the proxy in Unix nanoseconds, or the connection was dialed
+	lastReadAt atomic.Int64
+}
+
+// logSample logs the sample of the data sent in the direction, if it's sampled
+func (lc *packetConn) logSample(direction capture.Direction, data []byte) {
+	if sample, ok := lc.sampler.Sample(direction, data); ok {
+		logger.InfoS("Payload sample", "conn_id", lc.id, "direction", direction, "length", sample.Length,
+			"hex", sample.Hex, "text", sample.Text)
+	}
+}
+
+// proxyTarget is a proxy socket the packetConnManager dials for the new connections its selector matches
+type proxyTarget struct {
+	name       string
+	socketPath string
+	selector   ProxySelector
 }
 
 type packetConnManagerImpl struct {
-	config           *PacketConnManagerConfig
+	config *PacketConnManagerConfig
+	// targets are the proxies to dial for the new connections, the first matching one is dialed.
+	// config.UDSSocketPath is dialed if there are none
+	targets          []proxyTarget
 	localConnections map[int64]*packetConn
 	connLock         sync.RWMutex
 	outgoing         chan *v1.Packet
+	counters         packetConnCounters
 	ctx              context.Context
 	cancel           context.CancelFunc
+
+	// resumable is whether the Hub resumes the connections on the current stream, generation is incremented when
+	// a stream starts or ends. Both are guarded by connLock
+	resumable  bool
+	generation int64
+	// firstPacket is whether the Hub of the current stream opens the connections on their first DATA packet with
+	// data, guarded by connLock
+	firstPacket bool
+	// integrity is whether the DATA packets of the current stream carry the checksum of their data, guarded by
+	// connLock
+	integrity bool
+	// lingering are the connections whose target closed while the Hub didn't acknowledge all their data yet,
+	// they're kept for the resume window to retransmit it
+	lingering map[int64]*packetConn
+	// resumeTimer closes the connections the Hub didn't resume within the resume window after the stream ended
+	resumeTimer *time.Timer
+	// dial dials the proxy sockets, net.DialTimeout is used if nil
+	dial func(network, address string, timeout time.Duration) (net.Conn, error)
+	// sweeper is the goroutine closing the idle connections, Close waits for it before closing the outgoing channel
+	sweeper sync.WaitGroup
+	// bulkOutgoing queues the packets of the bulk connections, nil if QoS is disabled
+	bulkOutgoing chan *v1.Packet
+	// closing is set by GracefulClose, the new connections are refused then
+	closing atomic.Bool
+	// closeOnce closes the manager once, both GracefulClose and the owner of the manager may close it
+	closeOnce sync.Once
 }
 
-func newPacketConnectionManagerWithSocketPath(ctx context.Context, udsSocketPath string) packetConnManager {
-	config := DefaultPacketConnManagerConfig()
-	config.UDSSocketPath = udsSocketPath
-	return newPacketConnectionManagerWithConfig(ctx, config)
+// newPacketConnectionManagerWithTargets creates a packetConnManager dialing the proxy selected for each new connection,
+// the default configuration is used if config is nil
+func newPacketConnectionManagerWithTargets(ctx context.Context, config *PacketConnManagerConfig, targets []proxyTarget) packetConnManager {
+	if config == nil {
+		config = DefaultPacketConnManagerConfig()
+	}
+	if len(targets) > 0 {
+		config.UDSSocketPath = targets[0].socketPath
+	}
+	lcm := newPacketConnectionManagerWithConfig(ctx, config).(*packetConnManagerImpl)
+	lcm.targets = targets
+	return lcm
 }
 
 func newPacketConnectionManagerWithConfig(ctx context.Context, config *PacketConnManagerConfig) packetConnManager {
 	ctx, cancel := context.WithCancel(ctx)
-	return &packetConnManagerImpl{
+	p := &packetConnManagerImpl{
 		config:           config,
 		localConnections: make(map[int64]*packetConn),
+		lingering:        make(map[int64]*packetConn),
 		outgoing:         make(chan *v1.Packet, config.OutgoingChanSize),
 		ctx:              ctx,
 		cancel:           cancel,
 	}
+	if config.QoS != nil {
+		p.bulkOutgoing = make(chan *v1.Packet, config.OutgoingChanSize)
+	}
+	if config.IdleConnectionTimeout > 0 {
+		p.sweeper.Add(1)
+		go p.sweepIdleConnections()
+	}
+	return p
+}
+
+// sweepIdleConnections closes the idle connections until the manager is closed, they're checked every
+// idleSweepInterval, or every IdleConnectionTimeout if it's shorter
+func (p *packetConnManagerImpl) sweepIdleConnections() {
+	defer p.sweeper.Done()
+	ticker := time.NewTicker(min(idleSweepInterval, p.config.IdleConnectionTimeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.closeIdleConnections(now)
+		}
+	}
+}
+
+// closeIdleConnections closes the connections the proxy sent no data on for IdleConnectionTimeout before now, the
+// Hub is sent an ERROR for each so that it closes them as well
+func (p *packetConnManagerImpl) closeIdleConnections(now time.Time) {
+	idleSince := now.Add(-p.config.IdleConnectionTimeout).UnixNano()
+	var idle []int64
+	p.connLock.RLock()
+	for id, lc := range p.localConnections {
+		if lc.lastReadAt.Load() < idleSince {
+			idle = append(idle, id)
+		}
+	}
+	p.connLock.RUnlock()
+
+	for _, id := range idle {
+		logger.V(2).InfoS("Closing idle connection", "conn_id", id, "idle_timeout", p.config.IdleConnectionTimeout)
+		p.removeConnection(id)
+		p.sendConnectionError(id, fmt.Errorf("no data from the proxy for %s", p.config.IdleConnectionTimeout))
+	}
 }
 
 // Dispatch handles incoming packets from the Hub
 func (p *packetConnManagerImpl) Dispatch(packet *v1.Packet) error {
-	klog.V(4).InfoS("Received packet from Hub", "conn_id", packet.ConnId, "code", packet.Code, "data_size", len(packet.Data))
+	logger.V(4).InfoS("Received packet from Hub", "conn_id", packet.ConnId, "code", packet.Code, "data_size", len(packet.Data))
+
+	if packet.ConnId == controlConnID {
+		if packet.Code == v1.ControlCode_RESUME {
+			// The Hub resumed all the connections it knows
+			p.finishResume()
+			return nil
+		}
+		return fmt.Errorf("conn_id %d is reserved for control messages, dropping %v packet", controlConnID, packet.Code)
+	}
+	p.counters.packetsRecv.Add(1)
+	p.counters.bytesRecv.Add(int64(len(packet.Data)))
 
 	switch packet.Code {
 	case v1.ControlCode_DATA:
 		return p.handleDataPacket(packet)
 	case v1.ControlCode_ERROR:
 		return p.handleErrorPacket(packet)
+	case v1.ControlCode_ACK:
+		return p.handleAckPacket(packet)
+	case v1.ControlCode_RESUME:
+		return p.handleResumePacket(packet)
 	default:
 		return fmt.Errorf("unknown control code: %v", packet.Code)
 	}
 }
 
+// StartStream starts a new stream generation, the connections of the previous streams are closed if the Hub
+// doesn't resume them on this one
+func (p *packetConnManagerImpl) StartStream(resumable bool) {
+	p.connLock.Lock()
+	p.generation++
+	p.resumable = resumable
+	p.connLock.Unlock()
+
+	if !resumable {
+		p.closeUnresumed("Hub doesn't resume connections")
+	}
+}
+
+// EndStream starts the resume window of the connections of the stream, they're closed unless the Hub resumes
+// them on the next stream in time
+func (p *packetConnManagerImpl) EndStream() {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+
+	p.generation++
+	if !p.resumable || p.config.ResumeWindow <= 0 {
+		return
+	}
+	p.resumable = false
+	if p.resumeTimer != nil {
+		p.resumeTimer.Stop()
+	}
+	p.resumeTimer = time.AfterFunc(p.config.ResumeWindow, func() {
+		p.closeUnresumed(fmt.Sprintf("not resumed within %v", p.config.ResumeWindow))
+	})
+}
+
+// SetFirstPacket sets whether the Hub opens the connections on their first DATA packet with data
+func (p *packetConnManagerImpl) SetFirstPacket(firstPacket bool) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	p.firstPacket = firstPacket
+}
+
+// SetIntegrity sets whether the DATA packets sent to and received from the Hub carry the checksum of their data
+func (p *packetConnManagerImpl) SetIntegrity(integrity bool) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	p.integrity = integrity
+}
+
+// checksIntegrity returns whether the DATA packets of the current stream carry the checksum of their data
+func (p *packetConnManagerImpl) checksIntegrity() bool {
+	p.connLock.RLock()
+	defer p.connLock.RUnlock()
+	return p.integrity
+}
+
+// finishResume closes the connections the Hub didn't resume after it resumed all the ones it knows
+func (p *packetConnManagerImpl) finishResume() {
+	p.connLock.Lock()
+	if p.resumeTimer != nil {
+		p.resumeTimer.Stop()
+		p.resumeTimer = nil
+	}
+	p.connLock.Unlock()
+
+	p.closeUnresumed("not resumed by Hub")
+}
+
+// closeUnresumed closes the resumable connections not created or resumed on the current stream
+func (p *packetConnManagerImpl) closeUnresumed(reason string) {
+	p.connLock.Lock()
+	var unresumed []int64
+	for id, lc := range p.localConnections {
+		if lc.sender != nil && lc.generation < p.generation {
+			unresumed = append(unresumed, id)
+		}
+	}
+	for id, lc := range p.lingering {
+		if lc.generation < p.generation {
+			delete(p.lingering, id)
+		}
+	}
+	p.connLock.Unlock()
+
+	for _, id := range unresumed {
+		p.removeConnection(id)
+	}
+	if len(unresumed) > 0 {
+		logger.InfoS("Closed connections not resumed", "connections", len(unresumed), "reason", reason)
+	}
+}
+
+// HasConnection returns whether the connection is open
+func (p *packetConnManagerImpl) HasConnection(connID int64) bool {
+	p.connLock.RLock()
+	defer p.connLock.RUnlock()
+	_, exists := p.localConnections[connID]
+	return exists
+}
+
 // OutgoingChan returns the channel for outgoing packets to the Hub
 func (p *packetConnManagerImpl) OutgoingChan() <-chan *v1.Packet {
 	return p.outgoing
 }
 
-// Close gracefully shuts down the connection manager
+// BulkOutgoingChan returns the channel for the outgoing packets of the bulk connections, nil if QoS is disabled
+func (p *packetConnManagerImpl) BulkOutgoingChan() <-chan *v1.Packet {
+	return p.bulkOutgoing
+}
+
+// outgoingChan returns the channel for the outgoing packets of the class
+func (p *packetConnManagerImpl) outgoingChan(class qos.Class) chan *v1.Packet {
+	if class == qos.Bulk && p.bulkOutgoing != nil {
+		return p.bulkOutgoing
+	}
+	return p.outgoing
+}
+
+// interactiveIdle returns whether no packet is queued on the outgoing channel, a connection only turns bulk then
+func (p *packetConnManagerImpl) interactiveIdle() bool {
+	return len(p.outgoing) == 0
+}
+
+// Metrics returns a snapshot of the stats of the connections
+func (p *packetConnManagerImpl) Metrics() PacketConnManagerMetrics {
+	p.connLock.RLock()
+	active := len(p.localConnections)
+	p.connLock.RUnlock()
+
+	return PacketConnManagerMetrics{
+		ActiveConnections: active,
+		TotalConnections:  p.counters.totalConnections.Load(),
+		TotalPacketsSent:  p.counters.packetsSent.Load(),
+		TotalPacketsRecv:  p.counters.packetsRecv.Load(),
+		BytesSent:         p.counters.bytesSent.Load(),
+		BytesRecv:         p.counters.bytesRecv.Load(),
+		DialErrors:        p.counters.dialErrors.Load(),
+		SendTimeouts:      p.counters.sendTimeouts.Load(),
+	}
+}
+
+// ListConnections returns the stats of the open connections, ordered by conn_id
+func (p *packetConnManagerImpl) ListConnections() []ConnStats {
+	p.connLock.RLock()
+	stats := make([]ConnStats, 0, len(p.localConnections))
+	for id, lc := range p.localConnections {
+		stats = append(stats, ConnStats{
+			ConnID:       id,
+			DialedAt:     lc.dialedAt,
+			BytesRead:    lc.bytesRead.Load(),
+			BytesWritten: lc.bytesWritten.Load(),
+		})
+	}
+	p.connLock.RUnlock()
+
+	slices.SortFunc(stats, func(a, b ConnStats) int { return cmp.Compare(a.ConnID, b.ConnID) })
+	return stats
+}
+
+// GracefulClose refuses the new connections and waits until the open ones are closed before closing the manager,
+// they're checked every drainPollInterval. The manager is closed anyway once ctx is done, the connections still
+// open are logged and ctx.Err is returned
+func (p *packetConnManagerImpl) GracefulClose(ctx context.Context) error {
+	p.closing.Store(true)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		p.connLock.RLock()
+		remaining := len(p.localConnections)
+		p.connLock.RUnlock()
+		if remaining == 0 {
+			return p.Close()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			connIDs := make([]int64, 0, remaining)
+			for _, stats := range p.ListConnections() {
+				connIDs = append(connIDs, stats.ConnID)
+			}
+			logger.InfoS("Closing the connections that didn't complete in time", "remaining", len(connIDs), "conn_ids", connIDs)
+			p.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close shuts down the connection manager, the open connections are closed. It can be called more than once
 func (p *packetConnManagerImpl) Close() error {
+	p.closeOnce.Do(p.close)
+	return nil
+}
+
+func (p *packetConnManagerImpl) close() {
 	p.cancel()
+	p.sweeper.Wait()
 
 	// Close all active connections
 	p.connLock.Lock()
@@ -142,12 +561,17 @@ func (p *packetConnManagerImpl) Close() error {
 		conn.conn.Close()
 	}
 	p.localConnections = make(map[int64]*packetConn)
+	p.lingering = make(map[int64]*packetConn)
+	if p.resumeTimer != nil {
+		p.resumeTimer.Stop()
+	}
 	p.connLock.Unlock()
 
-	// Close the outgoing channel
+	// Close the outgoing channels
 	close(p.outgoing)
-
-	return nil
+	if p.bulkOutgoing != nil {
+		close(p.bulkOutgoing)
+	}
 }
 
 // handleDataPacket processes DATA packets from the Hub
@@ -157,130 +581,298 @@ func (p *packetConnManagerImpl) handleDataPacket(packet *v1.Packet) error {
 
 	p.connLock.RLock()
 	lc, exists := p.localConnections[connID]
+	_, lingering := p.lingering[connID]
+	integrity := p.integrity
 	p.connLock.RUnlock()
 
+	if integrity {
+		if err := packet.VerifyChecksum(); err != nil {
+			p.failIntegrity(connID, err)
+			return nil
+		}
+	}
+
+	if lingering {
+		// The target closed the connection, it's only kept to retransmit its data
+		logger.V(4).InfoS("Dropping packet for connection closed by target", "conn_id", connID)
+		return nil
+	}
 	if !exists {
 		// This is a new connection, create it
 		return p.createConnection(packet)
 	}
 
+	// The packets of a stream resuming its connections are ordered by their seq, the others are deduplicated by
+	// their SeqNum
+	if lc.receiver != nil {
+		if !lc.receiver.Accept(packet) {
+			// A duplicate, or a packet after a gap that's retransmitted when the connection is resumed
+			logger.V(5).InfoS("Dropping out of order packet", "conn_id", connID, "seq", packet.Seq)
+			return nil
+		}
+		defer p.sendAck(lc)
+	} else if !lc.seqNums.Accept(packet) {
+		logger.V(5).InfoS("Dropping duplicate packet", "conn_id", connID, "seq_num", packet.SeqNum)
+		return nil
+	}
+
 	// Send packet to connection's incoming channel for sequential processing
 	// Use a safe send function to handle potential channel closure
 	return p.safeSendToConnection(lc, packet, connID)
 }
 
-// safeSendToConnection safely sends a packet to a connection's incoming channel
-// It handles the race condition between sending and channel closure
-func (p *packetConnManagerImpl) safeSendToConnection(lc *packetConn, packet *v1.Packet, connID int64) error {
-	// Use a defer/recover to catch panics from sending on closed channels
-	defer func() {
-		if r := recover(); r != nil {
-			// This can happen if the channel is closed between our check and send
-			klog.V(4).InfoS("Recovered from panic when sending to connection", "conn_id", connID, "panic", r)
-		}
-	}()
-
-	// First, try to send without blocking
+// sendAck acknowledges the DATA packets received on the connection, if it's time to
+func (p *packetConnManagerImpl) sendAck(lc *packetConn) {
+	seq, ok := lc.receiver.Ack()
+	if !ok {
+		return
+	}
 	select {
-	case lc.incoming <- packet:
-		return nil
-	case <-lc.ctx.Done():
-		return fmt.Errorf("local connection %d is closing", connID)
+	case p.outgoing <- &v1.Packet{ConnId: lc.id, Code: v1.ControlCode_ACK, Ack: seq}:
 	case <-p.ctx.Done():
-		return fmt.Errorf("local connection manager is closing")
-	default:
-		// Channel might be full or closed, check the atomic flag
-		if atomic.LoadInt32(&lc.incomingClosed) == 1 {
-			return fmt.Errorf("connection %d is already closed", connID)
+	}
+}
+
+// handleAckPacket drops the DATA packets the Hub acknowledged from the replay buffer of the connection
+func (p *packetConnManagerImpl) handleAckPacket(packet *v1.Packet) error {
+	lc := p.resumableConnection(packet.ConnId)
+	if lc == nil {
+		return nil
+	}
+	if err := lc.sender.Ack(packet.Ack); err != nil {
+		return fmt.Errorf("invalid ACK for conn_id %d: %w", packet.ConnId, err)
+	}
+
+	if lc.sender.Bytes() == 0 {
+		// The Hub has all the data of the connection closed by its target
+		p.connLock.Lock()
+		if p.lingering[lc.id] == lc {
+			delete(p.lingering, lc.id)
 		}
+		p.connLock.Unlock()
+	}
+	return nil
+}
 
-		// Try again with a timeout
+// handleResumePacket resumes the connection on the current stream: the DATA packets the Hub acknowledges are
+// dropped, the other ones retransmitted, and the Hub is answered with the seq of the last packet received in order
+func (p *packetConnManagerImpl) handleResumePacket(packet *v1.Packet) error {
+	lc := p.resumableConnection(packet.ConnId)
+	if lc == nil {
+		return fmt.Errorf("cannot resume unknown conn_id %d", packet.ConnId)
+	}
+	if err := lc.sender.Ack(packet.Ack); err != nil {
+		p.removeConnection(lc.id)
+		return fmt.Errorf("cannot resume conn_id %d: %w", packet.ConnId, err)
+	}
+
+	p.connLock.Lock()
+	lc.generation = p.generation
+	p.connLock.Unlock()
+
+	// Hold sendMu so the packets read from the target afterwards are sent after the retransmitted ones
+	lc.sendMu.Lock()
+	defer lc.sendMu.Unlock()
+
+	packets := append([]*v1.Packet{{ConnId: lc.id, Code: v1.ControlCode_RESUME, Ack: lc.receiver.Received()}}, lc.sender.Unacked()...)
+	outgoing := p.outgoingChan(lc.classifier.Current())
+	integrity := p.checksIntegrity()
+	for _, packet := range packets {
+		// The packets were sent on the previous stream, whose Hub may not have checked their integrity
+		if packet.Code == v1.ControlCode_DATA {
+			packet = packet.Retransmission(integrity)
+		}
 		select {
-		case lc.incoming <- packet:
-			return nil
-		case <-lc.ctx.Done():
-			return fmt.Errorf("local connection %d is closing", connID)
+		case outgoing <- packet:
+			p.counters.packetsSent.Add(1)
 		case <-p.ctx.Done():
-			return fmt.Errorf("local connection manager is closing")
-		case <-time.After(100 * time.Millisecond):
-			return fmt.Errorf("timeout sending packet to connection %d", connID)
+			return p.ctx.Err()
 		}
 	}
+	logger.V(4).InfoS("Resumed connection", "conn_id", lc.id, "retransmitted", len(packets)-1)
+	return nil
+}
+
+// resumableConnection returns the open or lingering connection with the ID, nil if there's none or it's not resumable
+func (p *packetConnManagerImpl) resumableConnection(connID int64) *packetConn {
+	p.connLock.RLock()
+	defer p.connLock.RUnlock()
+
+	lc, exists := p.localConnections[connID]
+	if !exists {
+		lc = p.lingering[connID]
+	}
+	if lc == nil || lc.sender == nil {
+		return nil
+	}
+	return lc
+}
+
+// safeSendToConnection buffers a packet for the connection without blocking, so that a slow target doesn't stall
+// the packets of the other connections. The connection is closed and Hub is sent an error if the target is too
+// slow to keep the buffered data within the budget
+func (p *packetConnManagerImpl) safeSendToConnection(lc *packetConn, packet *v1.Packet, connID int64) error {
+	err := lc.incoming.Push(packet)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, packetqueue.ErrReceiverTooSlow):
+		err = fmt.Errorf("%w: %d bytes buffered", err, lc.incoming.Bytes())
+		p.removeConnection(connID)
+		p.sendConnectionError(connID, err)
+		return fmt.Errorf("closed connection %d: %w", connID, err)
+	default:
+		return fmt.Errorf("connection %d is already closed", connID)
+	}
 }
 
 // handleErrorPacket processes ERROR packets from the Hub
 func (p *packetConnManagerImpl) handleErrorPacket(packet *v1.Packet) error {
 	connID := packet.ConnId
 
-	// Log the error
-	klog.ErrorS(fmt.Errorf("%s", packet.ErrorMessage), "Received error from Hub", "conn_id", connID)
+	p.connLock.RLock()
+	_, exists := p.localConnections[connID]
+	_, lingering := p.lingering[connID]
+	p.connLock.RUnlock()
+	if !exists && !lingering {
+		// The connection was already removed, e.g. its target closed while the Hub closed the client. An ERROR is
+		// never answered, the Hub and the agent would bounce them otherwise
+		logger.V(5).InfoS("Ignoring error from Hub for unknown connection", "conn_id", connID, "error", packet.ErrorMessage)
+		return nil
+	}
+
+	// The Hub sends an error when it's done with the connection, e.g. the client disconnected,
+	// it logs the cause itself
+	logger.V(4).InfoS("Received error from Hub, closing connection", "conn_id", connID, "error", packet.ErrorMessage)
 
 	// Close the connection if it exists
 	// Note: This can race with readFromConnection/processIncomingPackets
 	// if local connection errors occur simultaneously with Hub errors
 	p.removeConnection(connID)
 
+	p.connLock.Lock()
+	delete(p.lingering, connID)
+	p.connLock.Unlock()
+
 	return nil
 }
 
+// failIntegrity closes the connection whose DATA packet from the Hub didn't match its checksum and sends the Hub an
+// INTEGRITY_FAILURE error, so that the client is told why its request failed
+func (p *packetConnManagerImpl) failIntegrity(connID int64, err error) {
+	logger.Warningf("Closing connection %d: %v", connID, err)
+	integrityFailures.Inc()
+	p.removeConnection(connID)
+
+	p.connLock.Lock()
+	delete(p.lingering, connID)
+	p.connLock.Unlock()
+
+	p.sendError(&v1.Packet{
+		ConnId:       connID,
+		Code:         v1.ControlCode_ERROR,
+		ErrorCode:    v1.ErrorCode_INTEGRITY_FAILURE,
+		ErrorMessage: err.Error(),
+	})
+}
+
 // createConnection establishes a new connection to the target service
 func (p *packetConnManagerImpl) createConnection(packet *v1.Packet) error {
 	connID := packet.ConnId
 
-	klog.V(4).InfoS("Target address resolved", "conn_id", connID)
+	if packet.Seq > 1 {
+		// The connection was closed, e.g. it wasn't resumed in time, the Hub must not reopen it midway
+		err := fmt.Errorf("cannot resume unknown conn_id %d", connID)
+		p.sendConnectionError(connID, err)
+		return err
+	}
 
-	// Dial the target service
-	conn, err := net.DialTimeout("unix", p.config.UDSSocketPath, p.config.DialTimeout)
-	if err != nil {
-		// Send error response back to Hub instead of just returning error
-		errorPacket := &v1.Packet{
-			ConnId:       connID,
-			Code:         v1.ControlCode_ERROR,
-			ErrorMessage: fmt.Sprintf("Connection failed: %v", err),
+	p.connLock.RLock()
+	firstPacket := p.firstPacket
+	p.connLock.RUnlock()
+	if len(packet.Data) == 0 {
+		// Hubs opening the connections on their first data don't send an empty packet to open them
+		if firstPacket {
+			logger.V(4).InfoS("Ignoring empty packet for unknown connection", "conn_id", connID)
+			return nil
 		}
-
-		// Send error packet to Hub
-		select {
-		case p.outgoing <- errorPacket:
-		case <-p.ctx.Done():
-			// Context cancelled, don't block
-		default:
-			// Channel full, log warning but don't block
-			klog.Warningf("Failed to send error packet for conn_id %d: outgoing channel full", connID)
+		// The packets are dispatched concurrently, the empty packet the Hub opens the connection with may come
+		// after the initial request. Wait for the request if the proxy is selected from it
+		if p.selectsByRequest() {
+			logger.V(4).InfoS("Waiting for the initial request to select the proxy", "conn_id", connID)
+			return nil
 		}
+	}
+
+	if p.closing.Load() {
+		err := errors.New("agent is shutting down")
+		p.sendConnectionError(connID, err)
+		return fmt.Errorf("refused conn_id %d: %w", connID, err)
+	}
 
+	target, err := p.selectTarget(packet)
+	if err != nil {
+		p.sendConnectionError(connID, err)
+		return fmt.Errorf("failed to select proxy for conn_id %d: %w", connID, err)
+	}
+	logger.V(4).InfoS("Target address resolved", "conn_id", connID, "proxy", target.name)
+
+	// Dial the target service
+	dial := p.dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	conn, err := dial("unix", socketAddress(target.socketPath, p.config.UseAbstractNamespace), p.config.DialTimeout)
+	if err != nil {
+		p.counters.dialErrors.Add(1)
+		// Send error response back to Hub instead of just returning error
+		p.sendConnectionError(connID, err)
 		return fmt.Errorf("failed to dial for conn_id %d: %w", connID, err)
 	}
-	klog.V(4).InfoS("Successfully connected to target", "conn_id", connID)
+	logger.V(4).InfoS("Successfully connected to target", "conn_id", connID)
 
 	// Create connection context
 	ctx, cancel := context.WithCancel(p.ctx)
 
-	// Create lc object with incoming packet channel
+	p.connLock.RLock()
+	resumable, generation := p.resumable, p.generation
+	p.connLock.RUnlock()
+
+	// Create lc object with incoming packet queue
 	lc := &packetConn{
-		id:             connID,
-		conn:           conn,
-		ctx:            ctx,
-		cancel:         cancel,
-		outgoing:       p.outgoing,
-		incoming:       make(chan *v1.Packet, p.config.IncomingChanSize),
-		incomingClosed: 0, // Initialize atomic flag
+		id:       connID,
+		conn:     conn,
+		ctx:      ctx,
+		cancel:   cancel,
+		incoming: packetqueue.New(p.config.MaxBufferedBytes),
+
+		generation: generation,
+		dialedAt:   time.Now(),
+		// The exec, attach and portforward requests stay interactive however much data they send
+		classifier: p.config.QoS.NewConn(qos.RequestPath(packet.Data)),
+	}
+	lc.lastReadAt.Store(lc.dialedAt.UnixNano())
+	if p.config.LogPayloadSample != nil {
+		lc.sampler = capture.NewSampler(*p.config.LogPayloadSample)
+	}
+	if resumable {
+		lc.sender = resume.NewSender(p.config.MaxReplayBytes)
+		lc.receiver = resume.NewReceiver()
+		lc.receiver.Accept(packet)
+	} else {
+		lc.seqNums.Accept(packet)
 	}
 
-	// Send the initial packet to the connection's incoming channel BEFORE starting goroutines
+	// Buffer the initial packet BEFORE starting goroutines
 	// This prevents race condition where readFromConnection might call removeConnection
-	// before we can send the initial packet
-	select {
-	case lc.incoming <- packet:
-	case <-ctx.Done():
-		// Context cancelled during connection setup
-		return fmt.Errorf("failed to send initial packet to connection %d: context cancelled", connID)
-	}
+	// before we can buffer the initial packet. It can't fail, the queue is empty
+	lc.incoming.Push(packet)
 
 	// Store the connection
 	p.connLock.Lock()
 	p.localConnections[connID] = lc
 	p.connLock.Unlock()
+	p.counters.totalConnections.Add(1)
 
 	// Start goroutine to read from the connection and send data back to Hub
 	go p.readFromConnection(lc)
@@ -288,10 +880,69 @@ func (p *packetConnManagerImpl) createConnection(packet *v1.Packet) error {
 	// Start goroutine to process incoming packets sequentially for this connection
 	go p.processIncomingPackets(lc)
 
-	klog.V(4).InfoS("Created new connection", "conn_id", connID)
+	logger.V(4).InfoS("Created new connection", "conn_id", connID)
 	return nil
 }
 
+// selectTarget returns the proxy to dial for the new connection, the first target whose selector matches the
+// initial request is selected. The Hub sends the whole request head in the first packet of the connection.
+func (p *packetConnManagerImpl) selectTarget(packet *v1.Packet) (proxyTarget, error) {
+	if len(p.targets) == 0 {
+		return proxyTarget{name: "default", socketPath: p.config.UDSSocketPath}, nil
+	}
+	// Skip parsing the request if the first target matches all the connections
+	if !p.selectsByRequest() {
+		return p.targets[0], nil
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet.Data)))
+	if err != nil {
+		return proxyTarget{}, fmt.Errorf("failed to parse the initial request: %w", err)
+	}
+	for _, target := range p.targets {
+		if target.selector == nil || target.selector(r) {
+			return target, nil
+		}
+	}
+	return proxyTarget{}, fmt.Errorf("no proxy for %s %s", r.Method, r.URL.Path)
+}
+
+// selectsByRequest returns whether the proxy of a new connection is selected from its initial request
+func (p *packetConnManagerImpl) selectsByRequest() bool {
+	return len(p.targets) > 0 && p.targets[0].selector != nil
+}
+
+// sendConnectionError sends the error establishing or failing the connection to the Hub without blocking
+func (p *packetConnManagerImpl) sendConnectionError(connID int64, err error) {
+	p.sendError(&v1.Packet{
+		ConnId:       connID,
+		Code:         v1.ControlCode_ERROR,
+		ErrorMessage: fmt.Sprintf("Connection failed: %v", err),
+	})
+}
+
+// sendError sends the ERROR packet to the Hub without blocking
+func (p *packetConnManagerImpl) sendError(errorPacket *v1.Packet) {
+	connID := errorPacket.ConnId
+	select {
+	case p.outgoing <- errorPacket:
+		p.counters.packetsSent.Add(1)
+	case <-p.ctx.Done():
+		// Context cancelled, don't block
+	default:
+		// Channel full, log warning but don't block
+		p.counters.sendTimeouts.Add(1)
+		logger.Warningf("Failed to send error packet for conn_id %d: outgoing channel full", connID)
+	}
+}
+
+// observePacketLatency records the time since the packet was created by the Hub, clock skew between the Hub and
+// the agent may make it negative, it's recorded as 0 then
+func observePacketLatency(timestamp int64) {
+	latency := time.Since(time.Unix(0, timestamp))
+	packetProcessingLatency.Observe(max(latency, 0).Seconds())
+}
+
 // removeConnection closes and removes a connection
 // This method can be called concurrently from multiple goroutines:
 // 1. readFromConnection (defer cleanup when read fails)
@@ -304,7 +955,7 @@ func (p *packetConnManagerImpl) createConnection(packet *v1.Packet) error {
 // - Target service suddenly closes connection
 // - readFromConnection gets io.EOF and calls removeConnection via defer
 // - processIncomingPackets gets "broken pipe" and calls removeConnection directly
-// - Both goroutines may try to close conn.incoming channel simultaneously
+// - Both goroutines may try to close conn.incoming simultaneously
 func (p *packetConnManagerImpl) removeConnection(connID int64) {
 	// Lock protects the connections map and ensures only one goroutine
 	// can modify the connection state at a time
@@ -321,20 +972,13 @@ func (p *packetConnManagerImpl) removeConnection(connID int64) {
 	lc.cancel()
 	lc.conn.Close()
 
-	// Close the incoming channel to signal the processing goroutine to exit
-	// Use sync.Once to ensure the channel is only closed once
-	lc.closeOnce.Do(func() {
-		// Set the atomic flag first
-		atomic.StoreInt32(&lc.incomingClosed, 1)
-		// Close the channel - this is safe because sync.Once ensures
-		// this code block only runs once
-		close(lc.incoming)
-	})
+	// Close the incoming queue to drop the buffered packets and signal the processing goroutine to exit
+	lc.incoming.Close()
 
 	// Remove from map to prevent future access
 	delete(p.localConnections, connID)
 
-	klog.V(4).InfoS("Removed connection", "conn_id", connID)
+	logger.V(4).InfoS("Removed connection", "conn_id", connID)
 }
 
 // readFromConnection reads data from a local connection and sends it to the Hub
@@ -342,46 +986,63 @@ func (p *packetConnManagerImpl) readFromConnection(lc *packetConn) {
 	// Always cleanup connection when this goroutine exits (normal or error)
 	// Note: This can race with processIncomingPackets calling removeConnection
 	// when both encounter errors simultaneously (e.g., target service crash)
-	defer p.removeConnection(lc.id)
+	defer func() {
+		if lc.sender != nil && lc.sender.Bytes() > 0 && lc.ctx.Err() == nil {
+			// Keep the data the Hub didn't acknowledge yet, in case the stream ends before it's received
+			p.lingerConnection(lc)
+			return
+		}
+		p.removeConnection(lc.id)
+	}()
 
 	buffer := make([]byte, p.config.ReadBufferSize)
+	coalescer := coalesce.NewBuffer(p.config.Coalesce)
+	// send sends the data back to Hub, the data is owned by the packet
+	send := func(data []byte) bool {
+		if data == nil {
+			return true
+		}
+		packet := &v1.Packet{
+			ConnId: lc.id,
+			Code:   v1.ControlCode_DATA,
+			Data:   data,
+		}
+		lc.logSample(capture.FromAgent, packet.Data)
+		return p.sendData(lc, packet)
+	}
 
 	for {
 		select {
 		case <-lc.ctx.Done():
 			return
 		default:
-			// Set read deadline to avoid blocking forever
-			lc.conn.SetReadDeadline(time.Now().Add(time.Second))
+			// Set read deadline to avoid blocking forever, or to send the coalesced data when it's due
+			lc.conn.SetReadDeadline(coalescer.ReadDeadline(time.Now().Add(time.Second)))
 
 			n, err := lc.conn.Read(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					// Timeout is expected, continue reading
+					if !send(coalescer.Due(time.Now())) {
+						return
+					}
 					continue
 				}
 				if err == io.EOF {
-					klog.V(4).InfoS("Connection closed by remote", "conn_id", lc.id)
+					logger.V(4).InfoS("Connection closed by remote", "conn_id", lc.id)
 				} else {
-					klog.ErrorS(err, "Error reading from connection", "conn_id", lc.id)
+					logger.ErrorS(err, "Error reading from connection", "conn_id", lc.id)
 				}
+				// The data read before is sent before the connection is closed
+				send(coalescer.Flush(time.Now()))
 				return
 			}
 
 			if n > 0 {
-				// Send data back to Hub
-				packet := &v1.Packet{
-					ConnId: lc.id,
-					Code:   v1.ControlCode_DATA,
-					Data:   make([]byte, n),
-				}
-				copy(packet.Data, buffer[:n])
-
-				select {
-				case lc.outgoing <- packet:
-				case <-lc.ctx.Done():
-					return
-				case <-p.ctx.Done():
+				now := time.Now()
+				lc.bytesRead.Add(int64(n))
+				lc.lastReadAt.Store(now.UnixNano())
+				if !send(coalescer.Add(buffer[:n], now)) {
 					return
 				}
 			}
@@ -389,42 +1050,110 @@ func (p *packetConnManagerImpl) readFromConnection(lc *packetConn) {
 	}
 }
 
+// sendData sends the data read from the target to the Hub, it returns false if the connection is closing. The data
+// of a resumable connection is numbered and kept until the Hub acknowledges it, reading from the target waits while
+// the replay buffer is full
+func (p *packetConnManagerImpl) sendData(lc *packetConn, packet *v1.Packet) bool {
+	// Wait for the interactive packets of the connection to be sent when it turns bulk
+	class := lc.classifier.Class(lc.ctx, len(packet.Data), p.interactiveIdle)
+	lc.seqNum++
+	packet.SeqNum = lc.seqNum
+	if p.checksIntegrity() {
+		packet.SetChecksum()
+	}
+	if lc.sender != nil {
+		if err := lc.sender.Wait(lc.ctx); err != nil {
+			return false
+		}
+		lc.sendMu.Lock()
+		defer lc.sendMu.Unlock()
+		lc.sender.Add(packet)
+	}
+
+	select {
+	case p.outgoingChan(class) <- packet:
+		p.counters.packetsSent.Add(1)
+		p.counters.bytesSent.Add(int64(len(packet.Data)))
+		return true
+	case <-lc.ctx.Done():
+		return false
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// lingerConnection closes the connection whose target closed it, and keeps it for the resume window to retransmit
+// the data the Hub didn't acknowledge yet
+func (p *packetConnManagerImpl) lingerConnection(lc *packetConn) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+
+	if p.localConnections[lc.id] != lc {
+		// The connection was removed meanwhile, e.g. the Hub closed it
+		return
+	}
+	lc.cancel()
+	lc.conn.Close()
+	lc.incoming.Close()
+	delete(p.localConnections, lc.id)
+
+	p.lingering[lc.id] = lc
+	time.AfterFunc(p.config.ResumeWindow, func() {
+		p.connLock.Lock()
+		defer p.connLock.Unlock()
+		if p.lingering[lc.id] == lc {
+			delete(p.lingering, lc.id)
+		}
+	})
+	logger.V(4).InfoS("Keeping connection closed by target to retransmit its data", "conn_id", lc.id, "unacked_bytes", lc.sender.Bytes())
+}
+
 // processIncomingPackets processes packets from Hub sequentially for a specific connection
 // This ensures that packets with the same conn_id are processed in order
 func (p *packetConnManagerImpl) processIncomingPackets(lc *packetConn) {
 	defer func() {
-		klog.V(4).InfoS("Stopped processing incoming packets", "conn_id", lc.id)
+		logger.V(4).InfoS("Stopped processing incoming packets", "conn_id", lc.id)
 	}()
 
-	klog.V(4).InfoS("Started processing incoming packets", "conn_id", lc.id)
+	logger.V(4).InfoS("Started processing incoming packets", "conn_id", lc.id)
 
 	for {
-		select {
-		case packet, ok := <-lc.incoming:
-			if !ok {
-				// Channel is closed, connection is being removed
+		// Pop fails once the queue is closed, i.e. the connection is being removed, or the connection is closing
+		packet, err := lc.incoming.Pop(lc.ctx)
+		if err != nil {
+			return
+		}
+
+		// Process the packet by writing data to the target connection
+		if len(packet.Data) > 0 {
+			lc.logSample(capture.ToAgent, packet.Data)
+			// Transparent data forwarding - no HTTP-specific processing needed
+			n, err := lc.conn.Write(packet.Data)
+			lc.bytesWritten.Add(int64(n))
+			if err != nil {
+				logger.ErrorS(err, "Failed to write data to target connection", "conn_id", lc.id)
+				// Connection failed, clean it up
+				// Note: This can race with readFromConnection's defer cleanup
+				// if both goroutines encounter errors at the same time
+				p.removeConnection(lc.id)
 				return
 			}
+			logger.V(5).InfoS("Forwarded data to target", "conn_id", lc.id, "bytes", len(packet.Data))
+		}
+		if packet.Timestamp != 0 {
+			observePacketLatency(packet.Timestamp)
+		}
+	}
+}
 
-			// Process the packet by writing data to the target connection
-			if len(packet.Data) > 0 {
-				// Transparent data forwarding - no HTTP-specific processing needed
-				_, err := lc.conn.Write(packet.Data)
-				if err != nil {
-					klog.ErrorS(err, "Failed to write data to target connection", "conn_id", lc.id)
-					// Connection failed, clean it up
-					// Note: This can race with readFromConnection's defer cleanup
-					// if both goroutines encounter errors at the same time
-					p.removeConnection(lc.id)
-					return
-				}
-				klog.V(5).InfoS("Forwarded data to target", "conn_id", lc.id, "bytes", len(packet.Data))
-			}
+// bufferedBytes returns the bytes of data buffered for each connection
+func (p *packetConnManagerImpl) bufferedBytes() map[int64]int {
+	p.connLock.RLock()
+	defer p.connLock.RUnlock()
 
-		case <-lc.ctx.Done():
-			return
-		case <-p.ctx.Done():
-			return
-		}
+	buffered := make(map[int64]int, len(p.localConnections))
+	for id, lc := range p.localConnections {
+		buffered[id] = lc.incoming.Bytes()
 	}
+	return buffered
 }
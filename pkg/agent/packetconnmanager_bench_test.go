@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+)
+
+// benchConns is the number of connections the Dispatch benchmarks spread the packets over
+const benchConns = 1000
+
+// discardConn is a net.Conn to a proxy that discards the data written to it and never responds
+type discardConn struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newDiscardConn() *discardConn {
+	return &discardConn{closed: make(chan struct{})}
+}
+
+func (c *discardConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *discardConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr                { return &net.UnixAddr{Name: "discard", Net: "unix"} }
+func (c *discardConn) RemoteAddr() net.Addr               { return &net.UnixAddr{Name: "discard", Net: "unix"} }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newBenchPacketConnManager creates a packetConnManager dialing discardConns
+func newBenchPacketConnManager(config *PacketConnManagerConfig) *packetConnManagerImpl {
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	lcm.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return newDiscardConn(), nil
+	}
+	return lcm
+}
+
+// openPipeConn opens conn_id 1 on the manager to a proxy on the other end of a net.Pipe, the request of the Hub is
+// discarded by the proxy. It returns the connection of the proxy
+func openPipeConn(tb testing.TB, lcm *packetConnManagerImpl) net.Conn {
+	tb.Helper()
+	proxy, conn := net.Pipe()
+	lcm.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return conn, nil
+	}
+	go io.Copy(io.Discard, proxy)
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+		tb.Fatalf("failed to open conn_id 1: %v", err)
+	}
+	return proxy
+}
+
+// openBenchConns opens the connections with conn_id 1 to n
+func openBenchConns(b *testing.B, lcm *packetConnManagerImpl, n int) {
+	b.Helper()
+	for id := int64(1); id <= int64(n); id++ {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+			b.Fatalf("failed to open conn_id %d: %v", id, err)
+		}
+	}
+}
+
+// BenchmarkDispatch_NewConn measures opening benchConns connections, each op opens all of them on a new manager
+func BenchmarkDispatch_NewConn(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+		openBenchConns(b, lcm, benchConns)
+
+		b.StopTimer()
+		lcm.Close()
+		b.StartTimer()
+	}
+}
+
+// BenchmarkDispatch_ExistingConn measures dispatching a DATA packet to one of benchConns open connections
+func BenchmarkDispatch_ExistingConn(b *testing.B) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	defer lcm.Close()
+	openBenchConns(b, lcm, benchConns)
+	data := make([]byte, 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: int64(i%benchConns) + 1, Code: v1.ControlCode_DATA, Data: data}); err != nil {
+			b.Fatalf("failed to dispatch: %v", err)
+		}
+	}
+}
+
+// BenchmarkDispatch_Concurrent_100 measures 100 goroutines dispatching DATA packets to benchConns open connections,
+// each goroutine sends to its own connections to keep their packets in order
+func BenchmarkDispatch_Concurrent_100(b *testing.B) {
+	const goroutines = 100
+	const connsPerGoroutine = benchConns / goroutines
+
+	// The writes to the connections fall behind the 100 goroutines, buffer more than the default budget for the
+	// connections not to be closed as too slow
+	config := DefaultPacketConnManagerConfig()
+	config.MaxBufferedBytes = 4 * 1024 * 1024
+	lcm := newBenchPacketConnManager(config)
+	defer lcm.Close()
+	openBenchConns(b, lcm, benchConns)
+	data := make([]byte, 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		// Spread b.N packets over the goroutines
+		n := b.N / goroutines
+		if g < b.N%goroutines {
+			n++
+		}
+		wg.Add(1)
+		go func(g, n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				connID := int64(g*connsPerGoroutine + i%connsPerGoroutine + 1)
+				if err := lcm.Dispatch(&v1.Packet{ConnId: connID, Code: v1.ControlCode_DATA, Data: data}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g, n)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	close(errs)
+	if err := <-errs; err != nil {
+		b.Fatalf("failed to dispatch: %v", err)
+	}
+}
+
+// BenchmarkKeystrokes measures the packets sent to the Hub for an exec session echoing a keystroke every 200µs, and
+// the latency added to the keystrokes, with and without coalescing
+func BenchmarkKeystrokes(b *testing.B) {
+	const keystrokeInterval = 200 * time.Microsecond
+	for _, delay := range []time.Duration{0, 2 * time.Millisecond} {
+		b.Run(fmt.Sprintf("delay=%s", delay), func(b *testing.B) {
+			config := DefaultPacketConnManagerConfig()
+			if delay > 0 {
+				config.Coalesce = &coalesce.Config{Delay: delay}
+			}
+			lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+			defer lcm.Close()
+			proxy := openPipeConn(b, lcm)
+			defer proxy.Close()
+
+			// writtenAt is when each keystroke was written by the proxy, the packets carry the keystrokes in order
+			writtenAt := make([]time.Time, b.N)
+			done := make(chan struct{})
+			var packets int
+			latencies := make([]time.Duration, 0, b.N)
+			go func() {
+				defer close(done)
+				received := 0
+				for received < b.N {
+					packet := <-lcm.OutgoingChan()
+					now := time.Now()
+					packets++
+					for i := range packet.Data {
+						latencies = append(latencies, now.Sub(writtenAt[received+i]))
+					}
+					received += len(packet.Data)
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writtenAt[i] = time.Now()
+				if _, err := proxy.Write([]byte{'x'}); err != nil {
+					b.Fatalf("failed to write the keystroke: %v", err)
+				}
+				time.Sleep(keystrokeInterval)
+			}
+			<-done
+			b.StopTimer()
+
+			slices.Sort(latencies)
+			b.ReportMetric(float64(packets)/float64(b.N), "packets/op")
+			b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-latency-µs")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-latency-µs")
+		})
+	}
+}
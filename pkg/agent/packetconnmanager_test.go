@@ -0,0 +1,942 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+)
+
+func TestDispatchControlConnID(t *testing.T) {
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = filepath.Join(t.TempDir(), "missing.sock")
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	packets := []*v1.Packet{
+		{ConnId: controlConnID, Code: v1.ControlCode_DRAIN},
+		{ConnId: controlConnID, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{ConnId: controlConnID, Code: v1.ControlCode_ERROR, ErrorMessage: "error"},
+	}
+	for _, packet := range packets {
+		if err := lcm.Dispatch(packet); err == nil {
+			t.Errorf("expected error dispatching %v packet on control conn_id", packet.Code)
+		}
+	}
+
+	lcm.connLock.RLock()
+	defer lcm.connLock.RUnlock()
+	if len(lcm.localConnections) != 0 {
+		t.Errorf("expected no local connections, got %d", len(lcm.localConnections))
+	}
+
+	// No dial should have been attempted, so no error packet is sent back to the Hub
+	select {
+	case packet := <-lcm.OutgoingChan():
+		t.Errorf("unexpected outgoing packet: %v", packet)
+	default:
+	}
+}
+
+func TestErrorForRemovedConnection(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "target.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = socketPath
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte{}}); err != nil {
+		t.Fatalf("failed to open connection: %v", err)
+	}
+	if !lcm.HasConnection(1) {
+		t.Fatalf("expected connection 1 to be open")
+	}
+
+	// The first ERROR closes the connection, the ones for the stale conn_id are ignored without an answer
+	for i := 0; i < 3; i++ {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_ERROR, ErrorMessage: "client disconnected"}); err != nil {
+			t.Errorf("unexpected error handling ERROR %d: %v", i, err)
+		}
+	}
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 2, Code: v1.ControlCode_ERROR, ErrorMessage: "unknown packet connection 2"}); err != nil {
+		t.Errorf("unexpected error handling ERROR for a conn_id never opened: %v", err)
+	}
+	if lcm.HasConnection(1) {
+		t.Errorf("expected connection 1 to be removed")
+	}
+
+	select {
+	case packet := <-lcm.OutgoingChan():
+		t.Errorf("unexpected outgoing packet: %v", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSelectTarget(t *testing.T) {
+	apiserver := func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/apis/")
+	}
+	services := func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/services/") }
+
+	cases := []struct {
+		name          string
+		targets       []proxyTarget
+		data          string
+		expectTarget  string
+		expectErrPart string
+	}{
+		{name: "no targets", data: "GET / HTTP/1.1\r\n\r\n", expectTarget: "default"},
+		{
+			name:         "match all",
+			targets:      []proxyTarget{{name: "all"}},
+			data:         "not an http request",
+			expectTarget: "all",
+		},
+		{
+			name:         "apiserver",
+			targets:      []proxyTarget{{name: "apiserver", selector: apiserver}, {name: "services", selector: services}},
+			data:         "GET /apis/apps/v1/deployments HTTP/1.1\r\nHost: hub\r\n\r\n",
+			expectTarget: "apiserver",
+		},
+		{
+			name:         "services",
+			targets:      []proxyTarget{{name: "apiserver", selector: apiserver}, {name: "services", selector: services}},
+			data:         "POST /services/my-svc/data HTTP/1.1\r\nHost: hub\r\nContent-Length: 4\r\n\r\nbody",
+			expectTarget: "services",
+		},
+		{
+			name:         "fallback",
+			targets:      []proxyTarget{{name: "apiserver", selector: apiserver}, {name: "fallback"}},
+			data:         "GET /healthz HTTP/1.1\r\nHost: hub\r\n\r\n",
+			expectTarget: "fallback",
+		},
+		{
+			name:          "no match",
+			targets:       []proxyTarget{{name: "apiserver", selector: apiserver}},
+			data:          "GET /healthz HTTP/1.1\r\nHost: hub\r\n\r\n",
+			expectErrPart: "no proxy for GET /healthz",
+		},
+		{
+			name:          "invalid request",
+			targets:       []proxyTarget{{name: "apiserver", selector: apiserver}},
+			data:          "not an http request",
+			expectErrPart: "failed to parse the initial request",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lcm := newPacketConnectionManagerWithTargets(context.Background(), nil, c.targets).(*packetConnManagerImpl)
+			defer lcm.Close()
+
+			target, err := lcm.selectTarget(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(c.data)})
+			if c.expectErrPart != "" {
+				if err == nil || !strings.Contains(err.Error(), c.expectErrPart) {
+					t.Fatalf("expected error containing %q, got %v", c.expectErrPart, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if target.name != c.expectTarget {
+				t.Errorf("expected target %s, got %s", c.expectTarget, target.name)
+			}
+		})
+	}
+}
+
+func TestCreateConnectionNoProxy(t *testing.T) {
+	lcm := newPacketConnectionManagerWithTargets(context.Background(), nil, []proxyTarget{{
+		name:       "apiserver",
+		socketPath: filepath.Join(t.TempDir(), "apiserver.sock"),
+		selector:   func(r *http.Request) bool { return false },
+	}}).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err == nil {
+		t.Fatalf("expected an error without a matching proxy")
+	}
+
+	// The Hub is told the connection failed
+	select {
+	case packet := <-lcm.OutgoingChan():
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != 1 || !strings.Contains(packet.ErrorMessage, "no proxy") {
+			t.Errorf("unexpected packet %v", packet)
+		}
+	default:
+		t.Errorf("expected an error packet to the Hub")
+	}
+}
+
+func TestCreateConnectionWaitsForRequest(t *testing.T) {
+	lcm := newPacketConnectionManagerWithTargets(context.Background(), nil, []proxyTarget{{
+		name:       "apiserver",
+		socketPath: filepath.Join(t.TempDir(), "apiserver.sock"),
+		selector:   func(r *http.Request) bool { return true },
+	}}).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	// The empty packet opening the connection is dispatched after the initial request
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA}); err != nil {
+		t.Fatalf("unexpected error for the empty packet: %v", err)
+	}
+
+	select {
+	case packet := <-lcm.OutgoingChan():
+		t.Errorf("unexpected packet %v", packet)
+	default:
+	}
+}
+
+func TestCreateConnectionFirstPacket(t *testing.T) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	defer lcm.Close()
+	dials := 0
+	lcm.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return newDiscardConn(), nil
+	}
+
+	// Hubs without the first packet open the connections with an empty packet
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA}); err != nil {
+		t.Fatalf("unexpected error for the empty packet: %v", err)
+	}
+	if dials != 1 || !lcm.HasConnection(1) {
+		t.Fatalf("expected the empty packet to open the connection, got %d dials", dials)
+	}
+
+	// An empty packet doesn't open a connection once the Hub opens them on their first packet
+	lcm.SetFirstPacket(true)
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 2, Code: v1.ControlCode_DATA}); err != nil {
+		t.Fatalf("unexpected error for the empty packet: %v", err)
+	}
+	if dials != 1 || lcm.HasConnection(2) {
+		t.Fatalf("expected the empty packet to be ignored, got %d dials", dials)
+	}
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 2, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+		t.Fatalf("unexpected error for the request: %v", err)
+	}
+	if dials != 2 || !lcm.HasConnection(2) {
+		t.Errorf("expected the request to open the connection, got %d dials", dials)
+	}
+}
+
+func TestListConnections(t *testing.T) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	defer lcm.Close()
+	start := time.Now()
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	for _, id := range []int64{5, 3, 1, 4, 2} {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: request}); err != nil {
+			t.Fatalf("failed to open conn_id %d: %v", id, err)
+		}
+	}
+
+	// The requests are written to the proxies in the background
+	deadline := time.Now().Add(5 * time.Second)
+	var stats []ConnStats
+	for {
+		stats = lcm.ListConnections()
+		written := 0
+		for _, s := range stats {
+			if s.BytesWritten == int64(len(request)) {
+				written++
+			}
+		}
+		if written == 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(stats) != 5 {
+		t.Fatalf("expected 5 connections, got %+v", stats)
+	}
+	for i, s := range stats {
+		if s.ConnID != int64(i+1) || s.DialedAt.Before(start) || s.BytesWritten != int64(len(request)) || s.BytesRead != 0 {
+			t.Errorf("expected conn_id %d dialed with the request written, got %+v", i+1, s)
+		}
+	}
+}
+
+func TestGracefulClose(t *testing.T) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	var conns []*discardConn
+	lcm.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn := newDiscardConn()
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	for _, id := range []int64{1, 2} {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+			t.Fatalf("failed to open conn_id %d: %v", id, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- lcm.GracefulClose(context.Background()) }()
+
+	// The new connections are refused while the open ones drain
+	deadline := time.Now().Add(5 * time.Second)
+	for !lcm.closing.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the manager to be closing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 3, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err == nil {
+		t.Errorf("expected the new connection to be refused")
+	}
+	packet := <-lcm.OutgoingChan()
+	if packet.Code != v1.ControlCode_ERROR || packet.ConnId != 3 || !strings.Contains(packet.ErrorMessage, "shutting down") {
+		t.Errorf("expected an ERROR for conn_id 3, got %v", packet)
+	}
+	if len(conns) != 2 {
+		t.Errorf("expected the refused connection not to be dialed, got %d dials", len(conns))
+	}
+
+	// The proxies close the connections once their requests complete
+	conns[0].Close()
+	select {
+	case err := <-done:
+		t.Fatalf("expected GracefulClose to wait for conn_id 2, returned %v", err)
+	case <-time.After(3 * drainPollInterval):
+	}
+	conns[1].Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected GracefulClose to return once the connections are closed")
+	}
+	if _, ok := <-lcm.OutgoingChan(); ok {
+		t.Errorf("expected the outgoing channel to be closed")
+	}
+}
+
+func TestGracefulCloseTimeout(t *testing.T) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+		t.Fatalf("failed to open conn_id 1: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := lcm.GracefulClose(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	// The manager is closed anyway
+	if lcm.HasConnection(1) {
+		t.Errorf("expected the connection to be closed")
+	}
+	if _, ok := <-lcm.OutgoingChan(); ok {
+		t.Errorf("expected the outgoing channel to be closed")
+	}
+	if err := lcm.Close(); err != nil {
+		t.Errorf("expected closing the manager again to succeed, got %v", err)
+	}
+}
+
+func TestCoalesceData(t *testing.T) {
+	config := DefaultPacketConnManagerConfig()
+	config.Coalesce = &coalesce.Config{Delay: 2 * time.Millisecond, MaxBytes: 1024}
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+	proxy := openPipeConn(t, lcm)
+
+	// The proxy writes small chunks in bursts, then closes the connection
+	const writes = 2000
+	var written []byte
+	go func() {
+		defer proxy.Close()
+		for i := range writes {
+			data := make([]byte, 1+i%7)
+			for j := range data {
+				data[j] = byte(len(written) + j)
+			}
+			written = append(written, data...)
+			if _, err := proxy.Write(data); err != nil {
+				return
+			}
+			if i%100 == 99 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+
+	var received []byte
+	packets := 0
+	timeout := time.After(10 * time.Second)
+	for lcm.HasConnection(1) || len(lcm.OutgoingChan()) > 0 {
+		select {
+		case packet := <-lcm.OutgoingChan():
+			if packet.Code != v1.ControlCode_DATA || packet.ConnId != 1 {
+				t.Fatalf("unexpected packet %v", packet)
+			}
+			received = append(received, packet.Data...)
+			packets++
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("expected the connection to be closed, received %d bytes", len(received))
+		}
+	}
+
+	if !bytes.Equal(received, written) {
+		t.Fatalf("expected the %d bytes written in order, received %d bytes", len(written), len(received))
+	}
+	if packets >= writes/2 {
+		t.Errorf("expected the writes to be coalesced, got %d packets for %d writes", packets, writes)
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	// The sweeper is not started, the connections are checked explicitly
+	config := DefaultPacketConnManagerConfig()
+	config.IdleConnectionTimeout = 0
+	lcm := newBenchPacketConnManager(config)
+	defer lcm.Close()
+	lcm.config.IdleConnectionTimeout = time.Minute
+	for _, id := range []int64{1, 2} {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+			t.Fatalf("failed to open conn_id %d: %v", id, err)
+		}
+	}
+
+	// The proxy last sent data on conn_id 1 over the timeout ago
+	now := time.Now()
+	lcm.connLock.RLock()
+	lcm.localConnections[1].lastReadAt.Store(now.Add(-2 * time.Minute).UnixNano())
+	lcm.connLock.RUnlock()
+	lcm.closeIdleConnections(now)
+
+	if lcm.HasConnection(1) {
+		t.Errorf("expected the idle connection to be closed")
+	}
+	if !lcm.HasConnection(2) {
+		t.Errorf("expected the connection dialed within the timeout to be kept")
+	}
+	select {
+	case packet := <-lcm.OutgoingChan():
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != 1 {
+			t.Errorf("expected an ERROR for conn_id 1, got %v", packet)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error packet to the Hub")
+	}
+}
+
+func TestSweepIdleConnections(t *testing.T) {
+	config := DefaultPacketConnManagerConfig()
+	config.IdleConnectionTimeout = 100 * time.Millisecond
+	lcm := newBenchPacketConnManager(config)
+	defer lcm.Close()
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+		t.Fatalf("failed to open conn_id 1: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lcm.HasConnection(1) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connection the proxy sends nothing on to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowTargetClosed(t *testing.T) {
+	// The target accepts the connection but never reads from it
+	socketPath := filepath.Join(t.TempDir(), "stalled.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = socketPath
+	config.MaxBufferedBytes = 64 * 1024
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	// Keep sending until the socket buffers are full and the budget is exceeded
+	var dispatchErr error
+	for i := 0; i < 1000 && dispatchErr == nil; i++ {
+		dispatchErr = lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: make([]byte, 16*1024)})
+		for id, buffered := range lcm.bufferedBytes() {
+			if buffered > config.MaxBufferedBytes {
+				t.Fatalf("connection %d buffered %d bytes, over the budget of %d", id, buffered, config.MaxBufferedBytes)
+			}
+		}
+	}
+	if dispatchErr == nil || !strings.Contains(dispatchErr.Error(), "receiver too slow") {
+		t.Fatalf("expected the connection to be closed as too slow, got %v", dispatchErr)
+	}
+	if len(lcm.bufferedBytes()) != 0 {
+		t.Errorf("expected the connection to be removed")
+	}
+
+	// The Hub is told the connection failed
+	select {
+	case packet := <-lcm.OutgoingChan():
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != 1 || !strings.Contains(packet.ErrorMessage, "receiver too slow") {
+			t.Errorf("unexpected packet %v", packet)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error packet to the Hub")
+	}
+}
+
+func TestPacketConnManagerMetrics(t *testing.T) {
+	// The target echoes what it reads
+	socketPath := filepath.Join(t.TempDir(), "echo.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = socketPath
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	// Open a connection and write to the target
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: request}); err != nil {
+		t.Fatalf("failed to dispatch: %v", err)
+	}
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("body")}); err != nil {
+		t.Fatalf("failed to dispatch: %v", err)
+	}
+
+	// Read the echo from the target
+	echoed := 0
+	for echoed < len(request)+len("body") {
+		select {
+		case packet := <-lcm.OutgoingChan():
+			echoed += len(packet.Data)
+		case <-time.After(time.Second):
+			t.Fatalf("expected the echo, got %d bytes", echoed)
+		}
+	}
+
+	metrics := lcm.Metrics()
+	if metrics.ActiveConnections != 1 || metrics.TotalConnections != 1 {
+		t.Errorf("expected 1 active and 1 total connection, got %+v", metrics)
+	}
+	if metrics.TotalPacketsRecv != 2 || metrics.BytesRecv != int64(len(request)+len("body")) {
+		t.Errorf("expected 2 packets and %d bytes received, got %+v", len(request)+len("body"), metrics)
+	}
+	if metrics.TotalPacketsSent == 0 || metrics.BytesSent != int64(echoed) {
+		t.Errorf("expected %d bytes sent, got %+v", echoed, metrics)
+	}
+
+	// The Hub closes the connection
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_ERROR, ErrorMessage: "client disconnected"}); err != nil {
+		t.Fatalf("failed to dispatch: %v", err)
+	}
+	if metrics := lcm.Metrics(); metrics.ActiveConnections != 0 || metrics.TotalConnections != 1 || metrics.TotalPacketsRecv != 3 {
+		t.Errorf("expected the connection to be closed, got %+v", metrics)
+	}
+
+	// A connection to a missing proxy fails to dial, the error is sent to the Hub
+	lcm.config.UDSSocketPath = filepath.Join(t.TempDir(), "missing.sock")
+	sent := lcm.Metrics().TotalPacketsSent
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 2, Code: v1.ControlCode_DATA, Data: request}); err == nil {
+		t.Fatalf("expected a dial error")
+	}
+	if metrics := lcm.Metrics(); metrics.DialErrors != 1 || metrics.TotalConnections != 1 || metrics.TotalPacketsSent != sent+1 || metrics.SendTimeouts != 0 {
+		t.Errorf("expected a dial error and an error packet sent, got %+v", metrics)
+	}
+
+	// The error packet is dropped when nothing takes the outgoing packets
+	config = DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = filepath.Join(t.TempDir(), "missing.sock")
+	config.OutgoingChanSize = 0
+	unbuffered := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer unbuffered.Close()
+	unbuffered.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: request})
+	if metrics := unbuffered.Metrics(); metrics.SendTimeouts != 1 || metrics.TotalPacketsSent != 0 {
+		t.Errorf("expected the error packet to be dropped, got %+v", metrics)
+	}
+}
+
+func TestDropOutOfOrderPackets(t *testing.T) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	defer lcm.Close()
+	lcm.StartStream(true)
+
+	// The duplicate and the packet after the gap are dropped, the gap is filled when the connection is resumed
+	for _, p := range []struct {
+		seq  int64
+		data string
+	}{{1, "GET / HTTP/1.1\r\n\r\n"}, {1, "GET / HTTP/1.1\r\n\r\n"}, {3, "c"}, {2, "b"}, {2, "b"}} {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(p.data), Seq: p.seq}); err != nil {
+			t.Fatalf("failed to dispatch seq %d: %v", p.seq, err)
+		}
+	}
+
+	expected := int64(len("GET / HTTP/1.1\r\n\r\n") + len("b"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := lcm.ListConnections()
+		if len(stats) != 1 {
+			t.Fatalf("expected 1 connection, got %+v", stats)
+		}
+		if stats[0].BytesWritten == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d bytes written to the proxy, got %d", expected, stats[0].BytesWritten)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Nothing more is written once the packets are processed
+	time.Sleep(50 * time.Millisecond)
+	if written := lcm.ListConnections()[0].BytesWritten; written != expected {
+		t.Errorf("expected %d bytes written to the proxy, got %d", expected, written)
+	}
+}
+
+// TestDropDuplicatePackets checks the packets of a stream not resuming its connections are numbered by their SeqNum
+// in both directions, and the ones from the Hub received twice or after a later one are dropped
+func TestDropDuplicatePackets(t *testing.T) {
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	defer lcm.Close()
+	lcm.StartStream(false)
+	target, conn := net.Pipe()
+	defer target.Close()
+	lcm.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return conn, nil
+	}
+
+	// The packets without a SeqNum, e.g. from a Hub not numbering them, are written to the target
+	request := "GET / HTTP/1.1\r\n\r\n"
+	for _, p := range []struct {
+		seqNum int64
+		data   string
+	}{{1, request}, {1, request}, {3, "c"}, {2, "b"}, {0, "z"}} {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(p.data), SeqNum: p.seqNum}); err != nil {
+			t.Fatalf("failed to dispatch SeqNum %d: %v", p.seqNum, err)
+		}
+	}
+
+	expected := request + "cz"
+	received := make([]byte, 0, len(expected))
+	buffer := make([]byte, 1024)
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(received) < len(expected) {
+		n, err := target.Read(buffer)
+		if err != nil {
+			t.Fatalf("expected %q written to the target, got %q: %v", expected, received, err)
+		}
+		received = append(received, buffer[:n]...)
+	}
+	if string(received) != expected {
+		t.Fatalf("expected %q written to the target, got %q", expected, received)
+	}
+	// Nothing more is written once the packets are processed
+	target.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := target.Read(buffer); err == nil {
+		t.Errorf("expected nothing more written to the target, got %q", buffer[:n])
+	}
+
+	for _, expected := range []int64{1, 2} {
+		if _, err := target.Write([]byte("data")); err != nil {
+			t.Fatalf("failed to write to the connection: %v", err)
+		}
+		select {
+		case packet := <-lcm.OutgoingChan():
+			if packet.Code != v1.ControlCode_DATA || packet.SeqNum != expected {
+				t.Errorf("expected a DATA packet with SeqNum %d, got %v", expected, packet)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a DATA packet with SeqNum %d", expected)
+		}
+	}
+}
+
+func TestObservePacketLatency(t *testing.T) {
+	histogram := func() *dto.Histogram {
+		m := &dto.Metric{}
+		if err := packetProcessingLatency.Write(m); err != nil {
+			t.Fatalf("failed to read the histogram: %v", err)
+		}
+		return m.GetHistogram()
+	}
+	before := histogram()
+
+	observePacketLatency(time.Now().Add(-100 * time.Millisecond).UnixNano())
+	// A timestamp from the future, e.g. with clock skew, is recorded as 0
+	observePacketLatency(time.Now().Add(time.Hour).UnixNano())
+
+	after := histogram()
+	if count := after.GetSampleCount() - before.GetSampleCount(); count != 2 {
+		t.Fatalf("expected 2 samples, got %d", count)
+	}
+	if sum := after.GetSampleSum() - before.GetSampleSum(); sum < 0.1 || sum > 1 {
+		t.Errorf("expected a sum of about 100ms, got %fs", sum)
+	}
+}
+
+func TestResumeConnections(t *testing.T) {
+	// The target echoes what it reads
+	socketPath := filepath.Join(t.TempDir(), "echo.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = socketPath
+	config.ResumeWindow = time.Minute
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	next := func() *v1.Packet {
+		t.Helper()
+		select {
+		case packet := <-lcm.OutgoingChan():
+			return packet
+		case <-time.After(time.Second):
+			t.Fatalf("expected an outgoing packet")
+			return nil
+		}
+	}
+
+	// Open two connections on a resumable stream, the echoes are numbered
+	lcm.StartStream(true)
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	for _, id := range []int64{1, 2} {
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: request, Seq: 1}); err != nil {
+			t.Fatalf("failed to dispatch: %v", err)
+		}
+		if echo := next(); echo.ConnId != id || echo.Seq != 1 || string(echo.Data) != string(request) {
+			t.Fatalf("expected the echo with seq 1 on conn %d, got %v", id, echo)
+		}
+	}
+	lcm.EndStream()
+
+	// The Hub resumes the first connection on the next stream, it lost the echo
+	lcm.StartStream(true)
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_RESUME}); err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if reply := next(); reply.Code != v1.ControlCode_RESUME || reply.Ack != 1 {
+		t.Errorf("expected a RESUME acknowledging seq 1, got %v", reply)
+	}
+	if retransmitted := next(); retransmitted.Seq != 1 || string(retransmitted.Data) != string(request) {
+		t.Errorf("expected the echo to be retransmitted, got %v", retransmitted)
+	}
+
+	// A duplicate of the request is dropped
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: request, Seq: 1}); err != nil {
+		t.Fatalf("failed to dispatch: %v", err)
+	}
+	select {
+	case packet := <-lcm.OutgoingChan():
+		t.Errorf("unexpected echo of a duplicate: %v", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The connections not resumed are closed once the Hub resumed all the ones it knows
+	if err := lcm.Dispatch(&v1.Packet{ConnId: controlConnID, Code: v1.ControlCode_RESUME}); err != nil {
+		t.Fatalf("failed to dispatch the end of the resume: %v", err)
+	}
+	lcm.connLock.RLock()
+	_, resumed := lcm.localConnections[1]
+	_, unresumed := lcm.localConnections[2]
+	lcm.connLock.RUnlock()
+	if !resumed || unresumed {
+		t.Errorf("expected only the resumed connection to be open, got resumed %v and unresumed %v", resumed, unresumed)
+	}
+
+	// The Hub can't reopen a closed connection midway
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 2, Code: v1.ControlCode_DATA, Data: request, Seq: 2}); err == nil {
+		t.Errorf("expected an error reopening a closed connection")
+	}
+	if packet := next(); packet.Code != v1.ControlCode_ERROR || packet.ConnId != 2 {
+		t.Errorf("expected an error for conn 2, got %v", packet)
+	}
+}
+
+func TestBulkConnectionQueued(t *testing.T) {
+	// The target echoes what it reads
+	socketPath := filepath.Join(t.TempDir(), "echo.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = socketPath
+	config.QoS = &qos.Config{BulkThreshold: 64}
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	next := func(ch <-chan *v1.Packet) *v1.Packet {
+		t.Helper()
+		select {
+		case packet := <-ch:
+			return packet
+		case <-time.After(time.Second):
+			t.Fatalf("expected an outgoing packet")
+			return nil
+		}
+	}
+
+	// The echo of a log request turns bulk once it's over the threshold, the one of an exec request never does
+	for i, path := range []string{"/api/v1/namespaces/default/pods/nginx/log", "/api/v1/namespaces/default/pods/nginx/exec"} {
+		id := int64(i + 1)
+		request := []byte("GET " + path + " HTTP/1.1\r\n\r\n")
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: request}); err != nil {
+			t.Fatalf("failed to dispatch: %v", err)
+		}
+		if echo := next(lcm.OutgoingChan()); echo.ConnId != id {
+			t.Fatalf("expected the echo of the request on the interactive channel, got %v", echo)
+		}
+
+		if err := lcm.Dispatch(&v1.Packet{ConnId: id, Code: v1.ControlCode_DATA, Data: make([]byte, 32)}); err != nil {
+			t.Fatalf("failed to dispatch: %v", err)
+		}
+		ch := lcm.BulkOutgoingChan()
+		if id == 2 {
+			ch = lcm.OutgoingChan()
+		}
+		if echo := next(ch); echo.ConnId != id {
+			t.Fatalf("expected the echo of the data over the threshold on conn %d, got %v", id, echo)
+		}
+	}
+}
+
+func TestIntegrityFailure(t *testing.T) {
+	failures := func() float64 {
+		m := &dto.Metric{}
+		if err := integrityFailures.Write(m); err != nil {
+			t.Fatalf("failed to read the counter: %v", err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := failures()
+
+	lcm := newBenchPacketConnManager(DefaultPacketConnManagerConfig())
+	defer lcm.Close()
+	lcm.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return newDiscardConn(), nil
+	}
+	lcm.SetIntegrity(true)
+
+	request := &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}
+	request.SetChecksum()
+	if err := lcm.Dispatch(request); err != nil {
+		t.Fatalf("unexpected error for the valid packet: %v", err)
+	}
+	if !lcm.HasConnection(1) {
+		t.Fatalf("expected the valid packet to open the connection")
+	}
+
+	// A bit flipped after the Hub set the checksum
+	corrupted := &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}
+	corrupted.SetChecksum()
+	corrupted.Data[4] ^= 0x01
+	if err := lcm.Dispatch(corrupted); err != nil {
+		t.Fatalf("unexpected error for the corrupted packet: %v", err)
+	}
+	if lcm.HasConnection(1) {
+		t.Errorf("expected the connection to be closed")
+	}
+	select {
+	case packet := <-lcm.OutgoingChan():
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != 1 || packet.ErrorCode != v1.ErrorCode_INTEGRITY_FAILURE {
+			t.Errorf("unexpected packet to the Hub: %v", packet)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected an error packet to the Hub")
+	}
+	if got := failures() - before; got != 1 {
+		t.Errorf("expected 1 integrity failure, got %v", got)
+	}
+
+	// A packet without checksum doesn't open a connection either
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 2, Code: v1.ControlCode_DATA, Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err != nil {
+		t.Fatalf("unexpected error for the packet without checksum: %v", err)
+	}
+	if lcm.HasConnection(2) {
+		t.Errorf("expected the packet without checksum to be rejected")
+	}
+}
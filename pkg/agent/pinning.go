@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// SPKIHash returns the pin of a certificate for Config.PinnedHubSPKIHashes: the base64 SHA-256 of its
+// SubjectPublicKeyInfo. It's the output of
+//
+//	openssl x509 -in hub.crt -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validateSPKIHash checks that a pin is the base64 of a SHA-256
+func validateSPKIHash(pin string) error {
+	sum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return err
+	}
+	if len(sum) != sha256.Size {
+		return fmt.Errorf("it's %d bytes instead of %d", len(sum), sha256.Size)
+	}
+	return nil
+}
+
+// hubServerName returns the name the certificate of the Hub is verified for: the ServerName of HubTLSConfig, then
+// TLSServerName, then the host of GRPCAuthority and of HubAddress, like the TLS credentials do
+func (c *Config) hubServerName() string {
+	if c.HubTLSConfig != nil && c.HubTLSConfig.ServerName != "" {
+		return c.HubTLSConfig.ServerName
+	}
+	if c.TLSServerName != "" {
+		return c.TLSServerName
+	}
+	name := c.GRPCAuthority
+	if name == "" {
+		name = c.HubAddress
+	}
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		return host
+	}
+	return name
+}
+
+// pinnedTLSConfig returns a clone of HubTLSConfig verifying the certificate of the Hub against PinnedHubSPKIHashes,
+// nil if no hash is pinned
+func (c *Config) pinnedTLSConfig() *tls.Config {
+	if len(c.PinnedHubSPKIHashes) == 0 {
+		return nil
+	}
+	tlsConfig := &tls.Config{}
+	if c.HubTLSConfig != nil {
+		tlsConfig = c.HubTLSConfig.Clone()
+	}
+	tlsConfig.ServerName = c.hubServerName()
+
+	pins := make(map[string]bool, len(c.PinnedHubSPKIHashes))
+	for _, pin := range c.PinnedHubSPKIHashes {
+		pins[pin] = true
+	}
+	// The chain is verified by VerifyPeerCertificate, against the pins and the RootCAs
+	tlsConfig.InsecureSkipVerify = true
+	verifyCA := tlsConfig.RootCAs != nil || c.RequireHubCAAndPin
+	roots, serverName, now := tlsConfig.RootCAs, tlsConfig.ServerName, tlsConfig.Time
+	requireBoth := c.RequireHubCAAndPin
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the Hub presented no certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("failed to parse the certificate of the Hub: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+		leaf := certs[0]
+
+		var pinErr error
+		if hash := SPKIHash(leaf); !pins[hash] {
+			pinErr = fmt.Errorf("the SPKI hash %s of the certificate of the Hub is not pinned", hash)
+		}
+		var caErr error
+		if verifyCA {
+			caErr = verifyChain(certs, roots, serverName, now)
+		}
+
+		switch {
+		case requireBoth:
+			return errors.Join(pinErr, caErr)
+		case pinErr == nil:
+			return nil
+		case verifyCA && caErr == nil:
+			return nil
+		default:
+			return errors.Join(pinErr, caErr)
+		}
+	}
+	return tlsConfig
+}
+
+// verifyChain verifies the certificates presented by the Hub like crypto/tls does, roots nil meaning the system roots
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool, serverName string, now func() time.Time) error {
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	if now != nil {
+		opts.CurrentTime = now()
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("failed to verify the certificate of the Hub: %w", err)
+	}
+	return nil
+}
+
+// pinnedCredentials returns the dial option of the TLS credentials verifying the Hub against PinnedHubSPKIHashes, nil
+// if no hash is pinned. Appended to DialOptions, they replace the transport credentials passed in them
+func (c *Config) pinnedCredentials() grpc.DialOption {
+	tlsConfig := c.pinnedTLSConfig()
+	if tlsConfig == nil {
+		return nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+}
+
+// ErrTLSRequired is returned by Run when Config.RequireTLS is set and the connection to the Hub isn't secured
+var ErrTLSRequired = errors.New("RequireTLS is set but the connection to the Hub isn't secured with TLS, DialOptions must not use insecure.NewCredentials")
+
+// requireTLSCredentials are per-RPC credentials adding no metadata that require transport security: gRPC refuses to
+// create a client with insecure transport credentials alongside them, and they fail the calls on the connections
+// without privacy and integrity, e.g. of custom plaintext credentials
+type requireTLSCredentials struct{}
+
+func (requireTLSCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	info, _ := credentials.RequestInfoFromContext(ctx)
+	if err := credentials.CheckSecurityLevel(info.AuthInfo, credentials.PrivacyAndIntegrity); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTLSRequired, err)
+	}
+	return nil, nil
+}
+
+func (requireTLSCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// checkTLSRequired returns ErrTLSRequired if gRPC refuses the transport credentials of DialOptions along with
+// requireTLSCredentials, grpc.NewClient doesn't connect
+func (c *Config) checkTLSRequired() error {
+	conn, err := grpc.NewClient(c.HubAddress, c.DialOptions...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTLSRequired, err)
+	}
+	return conn.Close()
+}
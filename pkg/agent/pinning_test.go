@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+)
+
+// handshakeWithPins completes a TLS handshake with a hub serving kp, verified by the pinned TLS config of config
+func handshakeWithPins(t *testing.T, config *Config, kp *certutil.KeyPair) error {
+	t.Helper()
+	cert, err := kp.TLSCertificate()
+	if err != nil {
+		t.Fatalf("failed to load the hub certificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	config.HubAddress = listener.Addr().String()
+	conn, err := tls.Dial("tcp", config.HubAddress, config.pinnedTLSConfig())
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func TestPinnedHubSPKIHashes(t *testing.T) {
+	ca, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	otherCA, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create the other CA: %v", err)
+	}
+	current, err := ca.IssueServer("hub.example.com")
+	if err != nil {
+		t.Fatalf("failed to issue the current certificate: %v", err)
+	}
+	next, err := ca.IssueServer("hub.example.com")
+	if err != nil {
+		t.Fatalf("failed to issue the next certificate: %v", err)
+	}
+	unpinned, err := otherCA.IssueServer("hub.example.com")
+	if err != nil {
+		t.Fatalf("failed to issue the unpinned certificate: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		pins      []string
+		roots     bool
+		strict    bool
+		hub       *certutil.KeyPair
+		expectErr string
+	}{
+		{
+			name: "pinned",
+			pins: []string{SPKIHash(current.Cert)},
+			hub:  current,
+		},
+		{
+			name:      "not pinned",
+			pins:      []string{SPKIHash(current.Cert)},
+			hub:       unpinned,
+			expectErr: "is not pinned",
+		},
+		{
+			name:      "the certificate of the pinned CA is not pinned",
+			pins:      []string{SPKIHash(ca.Cert)},
+			hub:       current,
+			expectErr: "is not pinned",
+		},
+		{
+			name: "rotation overlap, current certificate",
+			pins: []string{SPKIHash(current.Cert), SPKIHash(next.Cert)},
+			hub:  current,
+		},
+		{
+			name: "rotation overlap, next certificate",
+			pins: []string{SPKIHash(current.Cert), SPKIHash(next.Cert)},
+			hub:  next,
+		},
+		{
+			name:      "rotation done, current certificate",
+			pins:      []string{SPKIHash(next.Cert)},
+			hub:       current,
+			expectErr: "is not pinned",
+		},
+		{
+			name:  "not pinned, verified by the CA",
+			pins:  []string{SPKIHash(next.Cert)},
+			roots: true,
+			hub:   current,
+		},
+		{
+			name:      "neither pinned nor verified by the CA",
+			pins:      []string{SPKIHash(current.Cert)},
+			roots:     true,
+			hub:       unpinned,
+			expectErr: "failed to verify the certificate of the Hub",
+		},
+		{
+			name:   "strict, pinned and verified by the CA",
+			pins:   []string{SPKIHash(current.Cert)},
+			roots:  true,
+			strict: true,
+			hub:    current,
+		},
+		{
+			name:      "strict, verified by the CA only",
+			pins:      []string{SPKIHash(next.Cert)},
+			roots:     true,
+			strict:    true,
+			hub:       current,
+			expectErr: "is not pinned",
+		},
+		{
+			name:      "strict, pinned only",
+			pins:      []string{SPKIHash(unpinned.Cert)},
+			roots:     true,
+			strict:    true,
+			hub:       unpinned,
+			expectErr: "failed to verify the certificate of the Hub",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				PinnedHubSPKIHashes: tt.pins,
+				RequireHubCAAndPin:  tt.strict,
+				TLSServerName:       "hub.example.com",
+			}
+			if tt.roots {
+				config.HubTLSConfig = &tls.Config{RootCAs: ca.CertPool()}
+			}
+			err := handshakeWithPins(t, config, tt.hub)
+			if tt.expectErr == "" {
+				if err != nil {
+					t.Fatalf("expected the handshake to succeed, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestPinnedTLSConfigServerName(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *Config
+		expected string
+	}{
+		{
+			name:     "host of HubAddress",
+			config:   &Config{HubAddress: "hub.example.com:8443"},
+			expected: "hub.example.com",
+		},
+		{
+			name:     "TLSServerName",
+			config:   &Config{HubAddress: "10.0.0.1:8443", TLSServerName: "hub.example.com", GRPCAuthority: "tunnel.example.com"},
+			expected: "hub.example.com",
+		},
+		{
+			name:     "host of GRPCAuthority",
+			config:   &Config{HubAddress: "10.0.0.1:8443", GRPCAuthority: "tunnel.example.com:443"},
+			expected: "tunnel.example.com",
+		},
+		{
+			name:     "ServerName of HubTLSConfig",
+			config:   &Config{HubAddress: "10.0.0.1:8443", TLSServerName: "hub.example.com", HubTLSConfig: &tls.Config{ServerName: "pinned.example.com"}},
+			expected: "pinned.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.PinnedHubSPKIHashes = []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+			tlsConfig := tt.config.pinnedTLSConfig()
+			if tlsConfig.ServerName != tt.expected {
+				t.Errorf("expected ServerName %q, got %q", tt.expected, tlsConfig.ServerName)
+			}
+			if !tlsConfig.InsecureSkipVerify || tlsConfig.VerifyPeerCertificate == nil {
+				t.Errorf("expected the chain to be verified by VerifyPeerCertificate")
+			}
+		})
+	}
+
+	if (&Config{HubAddress: "hub.example.com:8443"}).pinnedTLSConfig() != nil {
+		t.Errorf("expected no pinned TLS config without PinnedHubSPKIHashes")
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	// The agent refuses insecure transport credentials before connecting
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a := New(ctx, &Config{
+		HubAddress:    "127.0.0.1:8443",
+		ClusterName:   "cluster1",
+		UDSSocketPath: filepath.Join(t.TempDir(), "proxy.sock"),
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		RequireTLS:    true,
+	}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+	if err := a.Run(ctx); !errors.Is(err, ErrTLSRequired) {
+		t.Fatalf("expected ErrTLSRequired, got %v", err)
+	}
+
+	config := &Config{
+		HubAddress:  "127.0.0.1:8443",
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))},
+		RequireTLS:  true,
+	}
+	config.DialOptions = append(config.DialOptions, grpc.WithPerRPCCredentials(requireTLSCredentials{}))
+	if err := config.checkTLSRequired(); err != nil {
+		t.Fatalf("expected the TLS credentials to be accepted, got %v", err)
+	}
+
+	// The calls on connections without privacy and integrity fail, e.g. of custom plaintext credentials
+	for _, c := range []struct {
+		name      string
+		level     credentials.SecurityLevel
+		expectErr bool
+	}{
+		{name: "no security", level: credentials.NoSecurity, expectErr: true},
+		{name: "integrity only", level: credentials.IntegrityOnly, expectErr: true},
+		{name: "TLS", level: credentials.PrivacyAndIntegrity},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			info := credentials.TLSInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: c.level}}
+			ctx := credentials.NewContextWithRequestInfo(context.Background(), credentials.RequestInfo{AuthInfo: info})
+			_, err := requireTLSCredentials{}.GetRequestMetadata(ctx)
+			if c.expectErr != errors.Is(err, ErrTLSRequired) {
+				t.Errorf("expected ErrTLSRequired %t, got %v", c.expectErr, err)
+			}
+		})
+	}
+}
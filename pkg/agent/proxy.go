@@ -4,25 +4,80 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"k8s.io/klog/v2"
 )
 
+// ProxySelector decides whether a new connection is handled by a proxy, from the initial request on the connection.
+// Only the request line and headers of the request are set, the body must not be read. The following requests on
+// the connection are handled by the same proxy.
+type ProxySelector func(r *http.Request) bool
+
+// ProxySpec configures one of the proxies of the agent, e.g. to handle the requests to the kube-apiserver and
+// the requests to the application services with different RequestProcessors
+type ProxySpec struct {
+	// Name identifies the proxy in the logs
+	Name string
+	// SocketPath is the path of the Unix Domain Socket of the proxy, it must be unique across the proxies
+	SocketPath string
+	// RequestProcessor, Router and CertificateProvider of the proxy, default to the ones passed to New
+	RequestProcessor    RequestProcessor
+	Router              Router
+	CertificateProvider CertificateProvider
+	// Selector decides whether a new connection is handled by the proxy, the first matching proxy is dialed.
+	// A nil Selector matches all the connections.
+	Selector ProxySelector
+}
+
 type proxy struct {
 	maxIdleConns          int
 	idleConnTimeout       time.Duration
 	tLSHandshakeTimeout   time.Duration
 	expectContinueTimeout time.Duration
+	// requestBodyTimeout bounds reading the body of a request from the socket, 0 means no timeout
+	requestBodyTimeout time.Duration
+	// responseHeaderTimeout and requestTimeout bound the wait for the response headers and the whole request of the
+	// RouteUnary requests, 0 means no timeout
+	responseHeaderTimeout time.Duration
+	requestTimeout        time.Duration
 
+	name          string
 	udsSocketPath string
-	rootCAs       *x509.CertPool
+	// rootCAs returns the current root CAs the targets are verified with, the transports are rebuilt once it changes
+	rootCAs func() *x509.CertPool
+	// socketPermissions are set on the socket file once it's created
+	socketPermissions os.FileMode
+	// socketUID and socketGID are the owner and the group set on the socket file once it's created, a negative one
+	// is left unchanged
+	socketUID int
+	socketGID int
+	// abstractNamespace binds the socket in the abstract namespace, it has no file then
+	abstractNamespace bool
+	// dialContext dials the target services, a net.Dialer is used if nil
+	dialContext DialContextFunc
+	// customHeaders and the headers returned by customHeadersFn are set on the processed requests
+	customHeaders   map[string]string
+	customHeadersFn func(r *http.Request) map[string]string
+	// replayStatusCodes are the status codes the POST, PUT and PATCH requests are replayed once on
+	replayStatusCodes []int
+	// server is the HTTP server of the socket once Run started it
+	server atomic.Pointer[http.Server]
+	// transports are the transports to the target services, created on their first request
+	transportsMu sync.Mutex
+	transports   map[transportKey]*http.Transport
 
 	RequestProcessor
 	CertificateProvider
@@ -35,8 +90,14 @@ func newProxy(rp RequestProcessor, cp CertificateProvider, router Router, udsSoc
 		idleConnTimeout:       90 * time.Second,
 		tLSHandshakeTimeout:   10 * time.Second,
 		expectContinueTimeout: 1 * time.Second,
+		requestBodyTimeout:    DefaultProxyRequestBodyTimeout,
+		responseHeaderTimeout: DefaultProxyResponseHeaderTimeout,
+		requestTimeout:        DefaultProxyRequestTimeout,
 
-		udsSocketPath: udsSocketPath,
+		udsSocketPath:     udsSocketPath,
+		socketPermissions: DefaultUDSSocketPermissions,
+		socketUID:         -1,
+		socketGID:         -1,
 
 		RequestProcessor:    rp,
 		CertificateProvider: cp,
@@ -44,35 +105,81 @@ func newProxy(rp RequestProcessor, cp CertificateProvider, router Router, udsSoc
 	}
 }
 
-func (p *proxy) Run(ctx context.Context) error {
-	// Get root CAs
-	rootCAs, err := p.GetRootCAs()
-	if err != nil {
-		return err
+// listen creates the listener of the socket, the socket file is replaced if it exists. A socket in the abstract
+// namespace has no file
+func (p *proxy) listen() (net.Listener, error) {
+	if p.abstractNamespace {
+		listener, err := net.Listen("unix", socketAddress(p.udsSocketPath, true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create UDS listener at %s in the abstract namespace: %w", p.udsSocketPath, err)
+		}
+		return listener, nil
 	}
-	p.rootCAs = rootCAs
 
 	// Remove existing socket file if it exists
 	if err := os.RemoveAll(p.udsSocketPath); err != nil {
-		return fmt.Errorf("failed to remove existing socket file: %w", err)
+		return nil, fmt.Errorf("failed to remove existing socket file: %w", err)
 	}
 
 	// Create Unix domain socket listener
 	listener, err := net.Listen("unix", p.udsSocketPath)
 	if err != nil {
-		return fmt.Errorf("failed to create UDS listener at %s: %w", p.udsSocketPath, err)
+		return nil, fmt.Errorf("failed to create UDS listener at %s: %w", p.udsSocketPath, err)
+	}
+
+	if err := os.Chmod(p.udsSocketPath, p.socketPermissions); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the permissions of socket file %s: %w", p.udsSocketPath, err)
+	}
+	if p.socketUID >= 0 || p.socketGID >= 0 {
+		if err := os.Lchown(p.udsSocketPath, p.socketUID, p.socketGID); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set the owner of socket file %s, it requires root or CAP_CHOWN: %w", p.udsSocketPath, err)
+		}
+	}
+	return listener, nil
+}
+
+func (p *proxy) Run(ctx context.Context) error {
+	// Get root CAs
+	rootCAs, err := p.GetRootCAs()
+	if err != nil {
+		return err
+	}
+	p.rootCAs = func() *x509.CertPool { return rootCAs }
+	if w, ok := p.CertificateProvider.(rootCAsWatcher); ok {
+		getter, err := w.watchRootCAs(ctx)
+		if err != nil {
+			klog.ErrorS(err, "Failed to watch the root CAs, the ones read at startup are used", "name", p.name)
+		} else {
+			p.rootCAs = getter
+		}
+	}
+
+	listener, err := p.listen()
+	if err != nil {
+		return err
 	}
 	defer listener.Close()
+	if !p.abstractNamespace {
+		// Clean up socket file
+		defer os.RemoveAll(p.udsSocketPath)
+	}
 
-	klog.InfoS("ServiceProxy started", "socket_path", p.udsSocketPath)
+	klog.InfoS("ServiceProxy started", "name", p.name, "socket_path", p.udsSocketPath, "abstract", p.abstractNamespace,
+		"permissions", p.socketPermissions, "uid", p.socketUID, "gid", p.socketGID)
 
 	// Create HTTP server with the serviceProxy as handler
+	// The socket serves HTTP/1.1, and HTTP/2 without TLS for the HTTP/2 connections the Hub proxies gRPC requests on.
+	// HTTP/2 is never negotiated for an HTTP/1.1 connection, so the SPDY upgrades used by kubectl exec keep working
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
 	server := &http.Server{
-		Handler: p,
-		// Disable automatic HTTP/2 upgrade to support SPDY protocol used by kubectl exec
-		// HTTP/2 cannot upgrade to SPDY, so we need to prevent automatic HTTP/2 negotiation
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Handler:   p,
+		Protocols: protocols,
 	}
+	p.server.Store(server)
 
 	// Start server in a goroutine
 	errCh := make(chan error, 1)
@@ -91,8 +198,7 @@ func (p *proxy) Run(ctx context.Context) error {
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			klog.ErrorS(err, "Failed to gracefully shutdown serviceProxy")
 		}
-		// Clean up socket file
-		os.RemoveAll(p.udsSocketPath)
+		p.closeIdleConnections()
 		return ctx.Err()
 	case err := <-errCh:
 		if err != nil && err != http.ErrServerClosed {
@@ -103,45 +209,230 @@ func (p *proxy) Run(ctx context.Context) error {
 }
 
 func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	klog.V(4).InfoS("Received request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	logger.V(4).InfoS("Received request", "proxy", p.name, "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 
 	targetProto, targetHost, targetPath, err := p.ParseTargetService(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get target service URL: %v", err), http.StatusInternalServerError)
+		statusCode := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidPath):
+			statusCode = http.StatusBadRequest
+		case errors.Is(err, ErrNoMatch):
+			statusCode = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to get target service URL: %v", err), statusCode)
 		return
 	}
-	klog.V(4).InfoS("Target service URL", "proto", targetProto, "host", targetHost, "path", targetPath)
+	logger.V(4).InfoS("Target service URL", "proto", targetProto, "host", targetHost, "path", targetPath)
 
 	err, statusCode := p.RequestProcessor.Process(targetHost, r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Request processing failed: %v", err), statusCode)
 		return
 	}
+	p.setCustomHeaders(r)
+
+	body := p.limitRequestBody(w, r)
 
+	class := ClassifyRequest(r)
+	if classifier, ok := p.Router.(RouteClassifier); ok {
+		class = classifier.RouteClass(r)
+	}
+	key := transportKey{class: class}
 	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: targetProto, Host: targetHost})
-	rp.Transport = &http.Transport{
-		DialContext: (&net.Dialer{
+	if isGRPCRequest(r) {
+		// gRPC needs HTTP/2 to the target for its streams and trailers, it's never upgraded to SPDY
+		key.http2 = true
+		key.tls = targetProto == "https"
+		rp.FlushInterval = -1
+	}
+	rp.Transport = p.transport(key)
+	if len(p.replayStatusCodes) > 0 {
+		rp.Transport = &replayTransport{RoundTripper: rp.Transport, statusCodes: p.replayStatusCodes}
+	}
+	if class == RouteUnary && p.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), p.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	rp.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, e error) {
+		if body.TimedOut() {
+			// The read error also cancels the context of the request, e.g. e is "context canceled"
+			http.Error(rw, fmt.Sprintf("timed out reading the request body after %v", p.requestBodyTimeout), http.StatusRequestTimeout)
+			logger.ErrorS(e, "Timed out reading the request body", "host", targetHost, "timeout", p.requestBodyTimeout)
+			return
+		}
+		var netErr net.Error
+		if errors.Is(e, context.DeadlineExceeded) || (errors.As(e, &netErr) && netErr.Timeout()) {
+			http.Error(rw, fmt.Sprintf("proxy to target service timed out because %v", e), http.StatusGatewayTimeout)
+			logger.ErrorS(e, "Proxy to target service timed out", "host", targetHost)
+			return
+		}
+		http.Error(rw, fmt.Sprintf("proxy to target service failed because %v", e), http.StatusBadGateway)
+		logger.ErrorS(e, "Proxy to target service failed", "host", targetHost)
+	}
+
+	if err := setTargetPath(r.URL, targetPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target path: %v", err), http.StatusBadRequest)
+		return
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// setCustomHeaders sets the custom headers on the request, the ones returned by customHeadersFn take precedence
+func (p *proxy) setCustomHeaders(r *http.Request) {
+	for k, v := range p.customHeaders {
+		r.Header.Set(k, v)
+	}
+	if p.customHeadersFn != nil {
+		for k, v := range p.customHeadersFn(r) {
+			r.Header.Set(k, v)
+		}
+	}
+}
+
+// shutdown stops the proxy once its in-flight requests complete, or when ctx is done. The idle connections are
+// closed right away
+func (p *proxy) shutdown(ctx context.Context) error {
+	server := p.server.Load()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// transportKey identifies the transports of the proxy, the RouteUnary requests have a response header timeout. The
+// gRPC requests are sent on HTTP/2, with TLS to the https targets
+type transportKey struct {
+	class RouteClass
+	http2 bool
+	tls   bool
+}
+
+// transport returns the transport of the key, it's created on its first request
+func (p *proxy) transport(key transportKey) *http.Transport {
+	var rootCAs *x509.CertPool
+	if p.rootCAs != nil {
+		rootCAs = p.rootCAs()
+	}
+	p.transportsMu.Lock()
+	defer p.transportsMu.Unlock()
+	if t, ok := p.transports[key]; ok {
+		if t.TLSClientConfig.RootCAs == rootCAs {
+			return t
+		}
+		// The root CAs were reloaded, the requests in flight keep the connections of the old transport
+		t.CloseIdleConnections()
+	}
+
+	dialContext := p.dialContext
+	if dialContext == nil {
+		dialContext = (&net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		}).DialContext
+	}
+	t := &http.Transport{
+		DialContext:           dialContext,
 		MaxIdleConns:          p.maxIdleConns,
 		IdleConnTimeout:       p.idleConnTimeout,
 		TLSHandshakeTimeout:   p.tLSHandshakeTimeout,
 		ExpectContinueTimeout: p.expectContinueTimeout,
 		TLSClientConfig: &tls.Config{
-			RootCAs:    p.rootCAs,
+			RootCAs:    rootCAs,
 			MinVersion: tls.VersionTLS12,
 		},
 		// golang http pkg automaticly upgrade http connection to http2 connection, but http2 can not upgrade to SPDY which used in "kubectl exec".
 		// set ForceAttemptHTTP2 = false to prevent auto http2 upgration
 		ForceAttemptHTTP2: false,
 	}
+	if key.class == RouteUnary {
+		t.ResponseHeaderTimeout = p.responseHeaderTimeout
+	}
+	if key.http2 {
+		protocols := new(http.Protocols)
+		if key.tls {
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+		t.Protocols = protocols
+	}
 
-	rp.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, e error) {
-		http.Error(rw, fmt.Sprintf("proxy to target service failed because %v", e), http.StatusBadGateway)
-		klog.Errorf("proxy target service failed because %v", e)
+	if p.transports == nil {
+		p.transports = map[transportKey]*http.Transport{}
 	}
+	p.transports[key] = t
+	return t
+}
 
-	r.URL.Path = targetPath
-	rp.ServeHTTP(w, r)
+// closeIdleConnections closes the idle connections of the transports to the target services
+func (p *proxy) closeIdleConnections() {
+	p.transportsMu.Lock()
+	defer p.transportsMu.Unlock()
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// limitRequestBody sets a read deadline on the connection of the request until its body is read, so a stalled
+// client can't hold the proxy forever. It returns the body reporting whether the deadline was exceeded, nil if the
+// request is not limited, e.g. an upgrade request whose body is the upgraded stream, or a gRPC request whose body is
+// the stream of its messages
+func (p *proxy) limitRequestBody(w http.ResponseWriter, r *http.Request) *timeoutBody {
+	if p.requestBodyTimeout <= 0 || r.Body == nil || r.Body == http.NoBody || isUpgradeRequest(r) || isGRPCRequest(r) {
+		return nil
+	}
+	if err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(p.requestBodyTimeout)); err != nil {
+		logger.V(4).InfoS("Request body timeout not supported", "proxy", p.name, "error", err)
+		return nil
+	}
+	body := &timeoutBody{ReadCloser: r.Body}
+	r.Body = body
+	return body
+}
+
+// isUpgradeRequest returns whether the request upgrades the connection, e.g. to SPDY for kubectl exec
+func isUpgradeRequest(r *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+// isGRPCRequest returns whether the request is a gRPC call, the Hub proxies them on HTTP/2 connections
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// timeoutBody records whether reading the request body exceeded the read deadline. The server clears the deadline
+// once the body is read, before reading the connection in the background
+type timeoutBody struct {
+	io.ReadCloser
+	timedOut atomic.Bool
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.timedOut.Store(true)
+	}
+	return n, err
+}
+
+// TimedOut returns whether the client didn't send the body within the timeout, b may be nil
+func (b *timeoutBody) TimedOut() bool {
+	return b != nil && b.timedOut.Load()
+}
+
+// setTargetPath replaces the path of the URL with the escaped target path returned by the Router,
+// keeping the escaping of its segments. RawQuery is left untouched, so the query of the original request
+// is forwarded as is.
+func setTargetPath(u *url.URL, targetPath string) error {
+	path, err := url.PathUnescape(targetPath)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	// RawPath is only used if it's a valid encoding of Path, see url.URL.EscapedPath
+	u.RawPath = targetPath
+	return nil
 }
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyRequestBodyTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		// Respond after the body timeout, the deadline must not fail the request once the body is read
+		time.Sleep(500 * time.Millisecond)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	p := newProxy(&passThroughRequestProcessor{}, &CertificateProviderImplt{},
+		&staticRouter{proto: "http", host: "my-svc.my-ns.svc:8080"}, "")
+	p.requestBodyTimeout = 300 * time.Millisecond
+	p.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	cases := []struct {
+		name string
+		// body is the part of the 10 bytes of the body sent by the client
+		body           string
+		expectedStatus int
+	}{
+		{name: "body read in time", body: "0123456789", expectedStatus: http.StatusOK},
+		{name: "client stalls", body: "01234", expectedStatus: http.StatusRequestTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", front.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial the proxy: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: proxy\r\nContent-Length: 10\r\n\r\n%s", c.body)
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.expectedStatus {
+				t.Errorf("expected status %d, got %d", c.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestProxyRouteTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" {
+			// A hung backend never responds
+			<-r.Context().Done()
+			return
+		}
+		// The watch streams an event every 50ms for 600ms, past the timeouts of the unary requests
+		w.WriteHeader(http.StatusOK)
+		for i := range 12 {
+			fmt.Fprintf(w, "event %d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	p := newProxy(&passThroughRequestProcessor{}, &CertificateProviderImplt{},
+		&staticRouter{proto: "http", host: "kubernetes.default.svc"}, "")
+	p.responseHeaderTimeout = 200 * time.Millisecond
+	p.requestTimeout = 300 * time.Millisecond
+	p.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	start := time.Now()
+	resp, err := http.Get(front.URL + "/cluster1/api/v1/pods")
+	if err != nil {
+		t.Fatalf("failed to send the unary request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d for the hung unary request, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the unary request to time out after 200ms, took %v", elapsed)
+	}
+
+	resp, err = http.Get(front.URL + "/cluster1/api/v1/pods?watch=true")
+	if err != nil {
+		t.Fatalf("failed to send the watch: %v", err)
+	}
+	defer resp.Body.Close()
+	events, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the watch: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasSuffix(string(events), "event 11\n") {
+		t.Errorf("expected the watch to stream past the unary timeouts, got %d %q", resp.StatusCode, events)
+	}
+}
+
+func TestProxyCustomHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get("X-Cluster-Name"), r.Header.Get("X-Trace-Id"), r.Header.Get("X-Static"))
+	}))
+	defer backend.Close()
+
+	p := newProxy(&passThroughRequestProcessor{}, &CertificateProviderImplt{},
+		&staticRouter{proto: "http", host: "my-svc.my-ns.svc:8080"}, "")
+	p.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	p.customHeaders = map[string]string{"X-Cluster-Name": "cluster1", "X-Trace-Id": "static", "X-Static": "set"}
+	p.customHeadersFn = func(r *http.Request) map[string]string {
+		if id := r.URL.Query().Get("trace"); id != "" {
+			return map[string]string{"X-Trace-Id": id}
+		}
+		return nil
+	}
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "static headers replace the client ones", expected: "cluster1 static set"},
+		{name: "dynamic headers replace the static ones", query: "?trace=abc", expected: "cluster1 abc set"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, front.URL+"/cluster1/api"+c.query, nil)
+			if err != nil {
+				t.Fatalf("failed to create the request: %v", err)
+			}
+			req.Header.Set("X-Cluster-Name", "spoofed")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send the request: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read the response: %v", err)
+			}
+			if string(body) != c.expected {
+				t.Errorf("expected the backend to receive %q, got %q", c.expected, body)
+			}
+		})
+	}
+}
+
+func TestProxySocketPermissions(t *testing.T) {
+	cases := []struct {
+		name        string
+		permissions os.FileMode
+		expected    os.FileMode
+	}{
+		{name: "default", expected: DefaultUDSSocketPermissions},
+		{name: "group", permissions: 0o660, expected: 0o660},
+		// Wider than the usual umask lets a new file be
+		{name: "world", permissions: 0o666, expected: 0o666},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+			p := newProxy(&passThroughRequestProcessor{}, &systemCertificateProvider{},
+				&staticRouter{proto: "http", host: "localhost:8080"}, socketPath)
+			if c.permissions != 0 {
+				p.socketPermissions = c.permissions
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- p.Run(ctx)
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for p.server.Load() == nil {
+				if time.Now().After(deadline) {
+					t.Fatalf("proxy didn't start")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			info, err := os.Stat(socketPath)
+			if err != nil {
+				cancel()
+				t.Fatalf("failed to stat the socket file: %v", err)
+			}
+			if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != c.expected {
+				t.Errorf("expected a socket with permissions %v, got %v", c.expected, info.Mode())
+			}
+
+			// The socket file is removed once the proxy stops
+			cancel()
+			if err := <-done; !errors.Is(err, context.Canceled) {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+			if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+				t.Errorf("expected the socket file to be removed, got %v", err)
+			}
+		})
+	}
+}
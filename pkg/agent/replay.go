@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxReplayBodySize bounds the request body buffered to replay a request, the requests with a larger body are
+	// not replayed
+	maxReplayBodySize = 1024 * 1024 // 1MB
+	// maxReplayRetryAfter bounds the Retry-After the replay of a request waits for, the responses asking to wait
+	// longer are returned to the client as is
+	maxReplayRetryAfter = 5 * time.Second
+)
+
+// replayTransport sends the POST, PUT and PATCH requests once more when the target service answers them with one of
+// the status codes, e.g. a 503 of the kube-apiserver during a rolling restart. The status codes must be ones the
+// target returns before it acted on the request, or the replay may e.g. create a resource twice
+type replayTransport struct {
+	http.RoundTripper
+	statusCodes []int
+}
+
+// isReplayable returns whether the request can be replayed once its body is buffered
+func isReplayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return !isUpgradeRequest(r) && !isGRPCRequest(r)
+	}
+	return false
+}
+
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if len(t.statusCodes) == 0 || !isReplayable(r) {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	body, ok, err := bufferBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil || !slices.Contains(t.statusCodes, resp.StatusCode) {
+		return resp, err
+	}
+	wait, ok := retryAfter(resp.Header)
+	if !ok {
+		return resp, nil
+	}
+
+	// Drain the response so its connection is reused by the replay
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxReplayBodySize))
+	resp.Body.Close()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+
+	logger.V(4).InfoS("Replaying request", "method", r.Method, "host", r.URL.Host, "path", r.URL.Path, "status_code", resp.StatusCode, "retry_after", wait)
+	replay := r.Clone(r.Context())
+	replay.Body = io.NopCloser(bytes.NewReader(body))
+	return t.RoundTripper.RoundTrip(replay)
+}
+
+// bufferBody reads the body of the request in memory and rewinds it, ok is false if the body is larger than
+// maxReplayBodySize, the body then reads the buffered prefix and the rest of the original body
+func bufferBody(r *http.Request) (body []byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(r.Body, maxReplayBodySize+1)); err != nil {
+		r.Body.Close()
+		return nil, false, err
+	}
+	if buf.Len() > maxReplayBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	body = buf.Bytes()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, true, nil
+}
+
+// retryAfter returns the wait the Retry-After header asks for before the replay, 0 if it's not set. ok is false if
+// it's longer than maxReplayRetryAfter or not a number of seconds
+func retryAfter(header http.Header) (wait time.Duration, ok bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, true
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	wait = time.Duration(seconds) * time.Second
+	return wait, wait <= maxReplayRetryAfter
+}
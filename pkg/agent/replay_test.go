@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyReplayNonIdempotent(t *testing.T) {
+	cases := []struct {
+		name        string
+		method      string
+		body        string
+		statusCodes []int
+		retryAfter  string
+		// expectedStatus and expectedBodies are the status of the response and the bodies received by the backend
+		expectedStatus int
+		expectedBodies int
+	}{
+		{name: "POST replayed", method: http.MethodPost, body: `{"kind":"Pod"}`, statusCodes: []int{503}, expectedStatus: http.StatusCreated, expectedBodies: 2},
+		{name: "PATCH replayed after Retry-After", method: http.MethodPatch, body: `{"spec":{}}`, statusCodes: []int{408, 503}, retryAfter: "1", expectedStatus: http.StatusCreated, expectedBodies: 2},
+		{name: "POST without body replayed", method: http.MethodPost, statusCodes: []int{503}, expectedStatus: http.StatusCreated, expectedBodies: 2},
+		{name: "disabled", method: http.MethodPost, body: `{"kind":"Pod"}`, expectedStatus: http.StatusServiceUnavailable, expectedBodies: 1},
+		{name: "other status code", method: http.MethodPost, body: `{"kind":"Pod"}`, statusCodes: []int{408}, expectedStatus: http.StatusServiceUnavailable, expectedBodies: 1},
+		{name: "GET not replayed", method: http.MethodGet, statusCodes: []int{503}, expectedStatus: http.StatusServiceUnavailable, expectedBodies: 1},
+		{name: "Retry-After too long", method: http.MethodPost, body: `{"kind":"Pod"}`, statusCodes: []int{503}, retryAfter: "60", expectedStatus: http.StatusServiceUnavailable, expectedBodies: 1},
+		{name: "body too large", method: http.MethodPut, body: strings.Repeat("x", maxReplayBodySize+1), statusCodes: []int{503}, expectedStatus: http.StatusServiceUnavailable, expectedBodies: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The backend fails the first request with 503, then creates the resource
+			var mu sync.Mutex
+			var bodies []string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				bodies = append(bodies, string(body))
+				first := len(bodies) == 1
+				mu.Unlock()
+				if first {
+					if c.retryAfter != "" {
+						w.Header().Set("Retry-After", c.retryAfter)
+					}
+					http.Error(w, "apiserver is shutting down", http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer backend.Close()
+
+			p := newProxy(&passThroughRequestProcessor{}, &CertificateProviderImplt{},
+				&staticRouter{proto: "http", host: "my-svc.my-ns.svc:8080"}, "")
+			p.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+			}
+			p.replayStatusCodes = c.statusCodes
+			front := httptest.NewServer(p)
+			defer front.Close()
+
+			req, err := http.NewRequest(c.method, front.URL+"/cluster1/api/v1/namespaces/default/pods", strings.NewReader(c.body))
+			if err != nil {
+				t.Fatalf("failed to create the request: %v", err)
+			}
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send the request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.expectedStatus {
+				t.Errorf("expected status %d, got %d", c.expectedStatus, resp.StatusCode)
+			}
+			if c.retryAfter == "1" && time.Since(start) < time.Second {
+				t.Errorf("expected the replay to wait for Retry-After, it was sent after %v", time.Since(start))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(bodies) != c.expectedBodies {
+				t.Fatalf("expected the backend to receive %d requests, got %d", c.expectedBodies, len(bodies))
+			}
+			for i, body := range bodies {
+				if body != c.body {
+					t.Errorf("expected request %d to have the body of %d bytes, got %d bytes", i, len(c.body), len(body))
+				}
+			}
+		})
+	}
+}
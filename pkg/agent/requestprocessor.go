@@ -3,10 +3,13 @@ package agent
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/xuezhaojun/multiclustertunnel/pkg/hubsig"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -18,21 +21,99 @@ type RequestProcessor interface {
 	Process(targetHost string, r *http.Request) (error, int)
 }
 
+// DefaultAuthenticatedHosts are the names of the kube-apiserver in the managed cluster, the requests to them are
+// authenticated by default
+var DefaultAuthenticatedHosts = []string{
+	"kubernetes.default.svc",
+	"kubernetes.default.svc.cluster.local",
+	"kubernetes.default",
+	"kubernetes",
+}
+
+// AuthPolicy decides which requests RequestProcessorImplt authenticates.
+//
+// The security model: the hub routes the requests of the users to the agents, the agent is where they're
+// authenticated before they reach the managed cluster.
+//   - The requests to the AuthenticatedHosts carry a bearer token reviewed with a TokenReview by the managed
+//     cluster, then by the hub. The token of a hub user is replaced with the token of the agent impersonating the
+//     user, so that the kube-apiserver authorizes the request with the RBAC of the user.
+//   - The requests to the other hosts, e.g. the services reached with proxy-service, are proxied as is, the services
+//     authenticate them themselves, unless DenyUnauthenticatedHosts rejects them.
+//   - The target host is returned by the Router from the path of the request, which the user controls. The hosts are
+//     compared without their port, case and trailing dot, so that e.g. a service route to kubernetes.default.svc:443
+//     is authenticated like a request to the kube-apiserver.
+//   - HubSignatureKey requires all the requests to be signed by the hub, so that only the requests the hub accepted,
+//     e.g. with its authentication middlewares, reach the targets, whatever their host.
+type AuthPolicy struct {
+	// AuthenticatedHosts are the target hosts whose requests are authenticated with a TokenReview.
+	// Defaults to DefaultAuthenticatedHosts
+	AuthenticatedHosts []string
+	// DenyUnauthenticatedHosts rejects the requests to the other hosts with 403 Forbidden, they're proxied
+	// without authentication otherwise
+	DenyUnauthenticatedHosts bool
+	// HubSignatureKey rejects the requests to all the hosts with 401 Unauthorized unless they carry a signature of
+	// the hub made with the key, see middleware.NewHubSignatureMiddleware. Disabled if empty
+	HubSignatureKey []byte
+}
+
+// authenticates returns whether the requests to the target host are authenticated
+func (p *AuthPolicy) authenticates(targetHost string) bool {
+	hosts := p.AuthenticatedHosts
+	if len(hosts) == 0 {
+		hosts = DefaultAuthenticatedHosts
+	}
+	targetHost = normalizeHost(targetHost)
+	for _, host := range hosts {
+		if normalizeHost(host) == targetHost {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost returns the host without its port and trailing dot, in lower case
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
 type RequestProcessorImplt struct {
 	hubKubeClient            kubernetes.Interface
 	managedClusterKubeClient kubernetes.Interface
+	policy                   AuthPolicy
 }
 
-// NewRequestProcessorImplt creates a new RequestProcessorImplt instance
+// NewRequestProcessorImplt creates a new RequestProcessorImplt instance, it authenticates the requests to the
+// kube-apiserver and proxies the other ones as is
 func NewRequestProcessorImplt(hubKubeClient, managedClusterKubeClient kubernetes.Interface) *RequestProcessorImplt {
+	return NewRequestProcessorWithPolicy(hubKubeClient, managedClusterKubeClient, AuthPolicy{})
+}
+
+// NewRequestProcessorWithPolicy creates a new RequestProcessorImplt instance authenticating the requests per policy
+func NewRequestProcessorWithPolicy(hubKubeClient, managedClusterKubeClient kubernetes.Interface, policy AuthPolicy) *RequestProcessorImplt {
 	return &RequestProcessorImplt{
 		hubKubeClient:            hubKubeClient,
 		managedClusterKubeClient: managedClusterKubeClient,
+		policy:                   policy,
 	}
 }
 
 func (p *RequestProcessorImplt) Process(targetHost string, r *http.Request) (error, int) {
-	if targetHost != "kubernetes.default.svc" {
+	if len(p.policy.HubSignatureKey) > 0 {
+		if err := hubsig.Verify(p.policy.HubSignatureKey, r, time.Now()); err != nil {
+			klog.ErrorS(err, "Rejected request not signed by the hub", "host", targetHost, "path", r.URL.Path)
+			return fmt.Errorf("request not accepted by the hub: %v", err), http.StatusUnauthorized
+		}
+	}
+	// The signature is only meant for the agent
+	r.Header.Del(hubsig.Header)
+
+	if !p.policy.authenticates(targetHost) {
+		if p.policy.DenyUnauthenticatedHosts {
+			return fmt.Errorf("requests to %s are not allowed", targetHost), http.StatusForbidden
+		}
 		return nil, http.StatusOK
 	}
 
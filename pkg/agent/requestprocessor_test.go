@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/hubsig"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newTokenReviewClient returns a fake client whose TokenReviews authenticate the token only
+func newTokenReviewClient(token string) *fake.Clientset {
+	client := fake.NewClientset()
+	client.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status.Authenticated = review.Spec.Token == token
+		return true, review, nil
+	})
+	return client
+}
+
+func TestRequestProcessorPolicy(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	now := time.Now()
+
+	cases := []struct {
+		name       string
+		policy     AuthPolicy
+		targetHost string
+		token      string
+		// signKey signs the request with the key at signedAt if set
+		signKey        []byte
+		signedAt       time.Time
+		expectedStatus int
+	}{
+		// The default policy authenticates the kube-apiserver and allows the other hosts
+		{name: "apiserver authenticated", targetHost: "kubernetes.default.svc", token: "valid", expectedStatus: http.StatusOK},
+		{name: "apiserver unauthenticated", targetHost: "kubernetes.default.svc", token: "invalid", expectedStatus: http.StatusUnauthorized},
+		{name: "apiserver without token", targetHost: "kubernetes.default.svc", expectedStatus: http.StatusUnauthorized},
+		{name: "apiserver with port", targetHost: "kubernetes.default.svc:443", token: "invalid", expectedStatus: http.StatusUnauthorized},
+		{name: "apiserver fully qualified", targetHost: "Kubernetes.Default.Svc.Cluster.Local.", token: "invalid", expectedStatus: http.StatusUnauthorized},
+		{name: "apiserver short name", targetHost: "kubernetes:443", token: "invalid", expectedStatus: http.StatusUnauthorized},
+		{name: "other host allowed", targetHost: "monitoring.example.svc:9090", expectedStatus: http.StatusOK},
+
+		// Custom authenticated hosts replace the defaults
+		{name: "custom host authenticated", policy: AuthPolicy{AuthenticatedHosts: []string{"metrics.example.svc"}}, targetHost: "metrics.example.svc:8443", token: "valid", expectedStatus: http.StatusOK},
+		{name: "custom host unauthenticated", policy: AuthPolicy{AuthenticatedHosts: []string{"metrics.example.svc"}}, targetHost: "metrics.example.svc:8443", token: "invalid", expectedStatus: http.StatusUnauthorized},
+		{name: "custom hosts replace the apiserver", policy: AuthPolicy{AuthenticatedHosts: []string{"metrics.example.svc"}}, targetHost: "kubernetes.default.svc", expectedStatus: http.StatusOK},
+
+		// Default deny rejects the hosts that aren't authenticated
+		{name: "deny other host", policy: AuthPolicy{DenyUnauthenticatedHosts: true}, targetHost: "monitoring.example.svc:9090", expectedStatus: http.StatusForbidden},
+		{name: "deny keeps the apiserver authenticated", policy: AuthPolicy{DenyUnauthenticatedHosts: true}, targetHost: "kubernetes.default.svc", token: "valid", expectedStatus: http.StatusOK},
+		{name: "deny keeps the apiserver unauthenticated", policy: AuthPolicy{DenyUnauthenticatedHosts: true}, targetHost: "kubernetes.default.svc", token: "invalid", expectedStatus: http.StatusUnauthorized},
+
+		// The hub signature is required for all the hosts
+		{name: "signed other host", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "monitoring.example.svc:9090", signKey: key, signedAt: now, expectedStatus: http.StatusOK},
+		{name: "unsigned other host", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "monitoring.example.svc:9090", expectedStatus: http.StatusUnauthorized},
+		{name: "signed with another key", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "monitoring.example.svc:9090", signKey: otherKey, signedAt: now, expectedStatus: http.StatusUnauthorized},
+		{name: "expired signature", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "monitoring.example.svc:9090", signKey: key, signedAt: now.Add(-2 * hubsig.MaxSkew), expectedStatus: http.StatusUnauthorized},
+		{name: "signed apiserver authenticated", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "kubernetes.default.svc", token: "valid", signKey: key, signedAt: now, expectedStatus: http.StatusOK},
+		{name: "signed apiserver unauthenticated", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "kubernetes.default.svc", token: "invalid", signKey: key, signedAt: now, expectedStatus: http.StatusUnauthorized},
+		{name: "unsigned apiserver authenticated", policy: AuthPolicy{HubSignatureKey: key}, targetHost: "kubernetes.default.svc", token: "valid", expectedStatus: http.StatusUnauthorized},
+		{name: "signed other host denied", policy: AuthPolicy{HubSignatureKey: key, DenyUnauthenticatedHosts: true}, targetHost: "monitoring.example.svc:9090", signKey: key, signedAt: now, expectedStatus: http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The managed cluster authenticates the valid token, the hub none
+			p := NewRequestProcessorWithPolicy(newTokenReviewClient(""), newTokenReviewClient("valid"), c.policy)
+
+			// The agent receives the request URI in origin form, as serialized by the hub
+			r := httptest.NewRequest(http.MethodGet, "/cluster1/api/v1/pods", nil)
+			r.Host = "hub.example.com"
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if c.signKey != nil {
+				r.Header.Set(hubsig.Header, hubsig.Sign(c.signKey, r, c.signedAt))
+			}
+
+			err, status := p.Process(c.targetHost, r)
+			if status != c.expectedStatus {
+				t.Fatalf("expected status %d, got %d (%v)", c.expectedStatus, status, err)
+			}
+			if (err == nil) != (status == http.StatusOK) {
+				t.Errorf("expected an error with status %d, got %v", status, err)
+			}
+			if r.Header.Get(hubsig.Header) != "" && status == http.StatusOK {
+				t.Errorf("expected the hub signature to be removed before the request is proxied")
+			}
+		})
+	}
+}
@@ -1,18 +1,22 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
-	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // Router handles request routing for both hub and agent sides.
 // ---
-// An example of service: https://<route location cluster-proxy>/<managed_cluster_name>/api/v1/namespaces/<namespace_name>/services/<[https:]service_name[:port_name]>/proxy-service/<service_path>
-// Target proto: https
-// Target host: <service_name>.<namespace_name>.svc:<port_name>
+// An example of service: https://<route location cluster-proxy>/<managed_cluster_name>/api/v1/namespaces/<namespace_name>/services/<[scheme:]service_name[:port]>/proxy-service/<service_path>
+// Target proto: the scheme, https by default
+// Target host: <service_name>.<namespace_name>.svc:<port>
 // Target path: /<service_path>
 // ---
 // An example of kube-apiserver: https://<route location cluster-proxy>/<managed_cluster_name>/api/pods?timeout=32s
@@ -23,65 +27,243 @@ import (
 // Note:
 // 1. targetPath must not contain the query part, it should be stripped before returning.
 // For example, /api/v1/pods?timeout=32s should be stripped to /api/v1/pods
+// The query of the original request is forwarded as is.
+// 2. targetPath is escaped, e.g. built from r.URL.EscapedPath(), so that encoded segments are kept.
+// For example, /api/v1/namespaces/default/pods/my%2Fpod must not become /api/v1/namespaces/default/pods/my/pod
 type Router interface {
 	// ParseTargetService retrieves target service information from the request (agent side)
 	// Returns protocol, host, path, and error
 	ParseTargetService(r *http.Request) (targetproto, targethost, targetpath string, err error)
 }
 
-type RouterImpl struct{}
+// RouteClass classifies the requests for the timeouts of the proxy
+type RouteClass int
+
+const (
+	// RouteUnary is an ordinary API call, the proxy bounds the wait for its response headers and the whole request
+	RouteUnary RouteClass = iota
+	// RouteStreaming is a long-lived request, e.g. a watch, kubectl logs -f or exec, the proxy doesn't bound it
+	RouteStreaming
+)
+
+// RouteClassifier is implemented by the Routers classifying the requests they route, the requests of the other
+// Routers are classified by ClassifyRequest
+type RouteClassifier interface {
+	RouteClass(r *http.Request) RouteClass
+}
+
+// ClassifyRequest returns RouteStreaming for the upgrade requests, e.g. kubectl exec, the gRPC calls, the watches,
+// the followed logs and the server-sent events, RouteUnary for the other requests
+func ClassifyRequest(r *http.Request) RouteClass {
+	if isUpgradeRequest(r) || isGRPCRequest(r) || strings.HasPrefix(r.Header.Get("Accept"), "text/event-stream") {
+		return RouteStreaming
+	}
+	query := r.URL.Query()
+	for _, param := range []string{"watch", "follow"} {
+		if value := query.Get(param); value == "true" || value == "1" {
+			return RouteStreaming
+		}
+	}
+	// The deprecated watch paths follow the API version, e.g. /api/v1/watch/namespaces/default/pods
+	segments, _ := pathSegments(r.URL.EscapedPath())
+	for i := 1; i < len(segments); i++ {
+		version := segments[i-1]
+		if segments[i] == "watch" && len(version) > 1 && version[0] == 'v' && version[1] >= '0' && version[1] <= '9' {
+			return RouteStreaming
+		}
+	}
+	return RouteUnary
+}
+
+// ErrInvalidPath is returned by RouterImpl when the request path has fewer segments than the route requires,
+// the proxy responds with 400 Bad Request
+var ErrInvalidPath = errors.New("invalid request path")
+
+// ErrNoMatch is returned by a Router when the request path is not in its grammar, as opposed to ErrInvalidPath for
+// a path in its grammar with invalid segments. The Router of NewChainRouter tries the next Router then, the proxy
+// responds with 404 Not Found
+var ErrNoMatch = errors.New("no route matches the request path")
+
+// kubeAPIServerRoots are the first segments of the paths served by the kube-apiserver
+var kubeAPIServerRoots = map[string]bool{
+	"api":         true,
+	"apis":        true,
+	"version":     true,
+	"openapi":     true,
+	"healthz":     true,
+	"livez":       true,
+	"readyz":      true,
+	"metrics":     true,
+	"logs":        true,
+	".well-known": true,
+}
+
+// RouterImpl routes the requests to the kube-apiserver, or to the services of the managed cluster for the
+// proxy-service paths. The service segment follows the grammar of the apiserver's proxy subresource,
+// [<scheme>:]<name>[:<port>], where the port is a number or a port name. The paths that the kube-apiserver doesn't
+// serve, e.g. /<cluster>/service/..., don't match
+type RouterImpl struct {
+	// DefaultServiceScheme is the scheme of the services whose segment has none, e.g. metrics-server:443.
+	// Defaults to https
+	DefaultServiceScheme string
+	// AllowHTTPServices proxies the requests to the services with the http scheme, e.g. http:my-svc:8080, in
+	// plaintext from the agent to the service. Only https is allowed if not set
+	AllowHTTPServices bool
+}
 
 const (
 	ProxyTypeService = iota
 	ProxyTypeKubeAPIServer
 )
 
-func getProxyType(pathParms []string) int {
-	if len(pathParms) > 9 && pathParms[8] == "proxy-service" {
+// pathSegments splits the path into its non-empty segments, so that duplicate slashes are collapsed, and returns
+// whether it ends with a slash
+func pathSegments(path string) (segments []string, trailingSlash bool) {
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments, len(segments) > 0 && strings.HasSuffix(path, "/")
+}
+
+// joinPath joins the segments into an absolute path, a missing path is "/"
+func joinPath(segments []string, trailingSlash bool) string {
+	path := "/" + strings.Join(segments, "/")
+	if trailingSlash && len(segments) > 0 {
+		path += "/"
+	}
+	return path
+}
+
+// getProxyType returns the proxy type of the path segments of the request, starting with the cluster name:
+// <cluster-name>/api/v1/namespaces/<namespace>/services/<service>/proxy-service/...
+func getProxyType(segments []string) int {
+	if len(segments) > 7 && segments[7] == "proxy-service" {
 		return ProxyTypeService
 	}
 	return ProxyTypeKubeAPIServer
 }
 
+// parseNamespaceSegment unescapes and validates the namespace segment of a service path
+func parseNamespaceSegment(segment string) (string, error) {
+	namespace, err := url.PathUnescape(segment)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid namespace %s: %v", ErrInvalidPath, segment, err)
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return "", fmt.Errorf("%w: invalid namespace %q: %s", ErrInvalidPath, namespace, strings.Join(errs, ", "))
+	}
+	return namespace, nil
+}
+
+// serviceTarget returns the proto and host of the escaped service segment of a service path in namespace
+func (router *RouterImpl) serviceTarget(segment, namespace string) (proto, host string, err error) {
+	serviceParam, err := url.PathUnescape(segment)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: invalid service name %s: %v", ErrInvalidPath, segment, err)
+	}
+	proto, service, port, err := router.parseServiceSegment(serviceParam)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: service %q: %v", ErrInvalidPath, serviceParam, err)
+	}
+	host = fmt.Sprintf("%s.%s.svc", service, namespace)
+	if port != "" {
+		// e.g. https:metrics-server: has no port, use the default port of the scheme
+		host = net.JoinHostPort(host, port)
+	}
+	return proto, host, nil
+}
+
+// parseServiceSegment parses the unescaped service segment of a proxy-service path, [<scheme>:]<name>[:<port>],
+// the scheme is defaulted. A segment with two parts is a name and a port, like the apiserver parses it
+func (router *RouterImpl) parseServiceSegment(segment string) (scheme, name, port string, err error) {
+	parts := strings.Split(segment, ":")
+	switch len(parts) {
+	case 1:
+		name = parts[0]
+	case 2:
+		name, port = parts[0], parts[1]
+	case 3:
+		scheme, name, port = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", errors.New("must be [<scheme>:]<name>[:<port>]")
+	}
+
+	if scheme == "" {
+		scheme = router.DefaultServiceScheme
+		if scheme == "" {
+			scheme = "https"
+		}
+	}
+	switch {
+	case scheme == "https":
+	case scheme == "http" && router.AllowHTTPServices:
+	case scheme == "http":
+		return "", "", "", errors.New("for security reason, only https is supported, the http scheme is not allowed")
+	default:
+		return "", "", "", fmt.Errorf("unsupported scheme %q", scheme)
+	}
+
+	if name == "" {
+		return "", "", "", errors.New("the name is required")
+	}
+	if errs := validation.IsDNS1035Label(name); len(errs) > 0 {
+		return "", "", "", fmt.Errorf("invalid name %q: %s", name, strings.Join(errs, ", "))
+	}
+
+	if port != "" {
+		// A port is either a number or the name of a port of the service
+		var errs []string
+		if number, convErr := strconv.Atoi(port); convErr == nil {
+			errs = validation.IsValidPortNum(number)
+		} else {
+			errs = validation.IsValidPortName(port)
+		}
+		if len(errs) > 0 {
+			return "", "", "", fmt.Errorf("invalid port %q: %s", port, strings.Join(errs, ", "))
+		}
+	}
+	return scheme, name, port, nil
+}
+
 func (router *RouterImpl) ParseTargetService(r *http.Request) (targetproto, targethost, targetpath string, err error) {
-	pathParams := strings.Split(r.URL.Path, "/")
+	// Split the escaped path, so that an encoded "/" in a segment doesn't split it
+	segments, trailingSlash := pathSegments(r.URL.EscapedPath())
+	if len(segments) == 0 {
+		return "", "", "", fmt.Errorf("%w: no cluster name in path %s", ErrInvalidPath, r.URL.EscapedPath())
+	}
 
-	switch getProxyType(pathParams) {
+	switch getProxyType(segments) {
 	case ProxyTypeKubeAPIServer:
+		if len(segments) > 1 && !kubeAPIServerRoots[segments[1]] {
+			return "", "", "", fmt.Errorf("%w: %s is not a kube-apiserver path", ErrNoMatch, r.URL.EscapedPath())
+		}
 		// For kube-apiserver requests: /<cluster-name>/api/...
 		// Target proto: https
 		// Target host: kubernetes.default.svc
-		// Target path: /<api_path> (remove cluster name from path)
-		if len(pathParams) < 3 {
-			return "", "", "", fmt.Errorf("invalid kube-apiserver request path: %s", r.RequestURI)
-		}
+		// Target path: /<api_path> (remove cluster name from path), / if there is none
 		// Remove cluster name from path: /cluster-name/api/v1/pods -> /api/v1/pods
-		targetPath := "/" + strings.Join(pathParams[2:], "/")
-		return "https", "kubernetes.default.svc", targetPath, nil
+		return "https", "kubernetes.default.svc", joinPath(segments[1:], trailingSlash), nil
 
 	case ProxyTypeService:
 		// For service requests: /<cluster-name>/api/v1/namespaces/<namespace>/services/<service>/proxy-service/<service_path>
-		// Target proto: https
-		// Target host: <service_name>.<namespace_name>.svc:<port_name>
-		// Target path: /<service_path>
-		if len(pathParams) < 10 {
-			return "", "", "", fmt.Errorf("invalid service proxy request path: %s", r.RequestURI)
-		}
+		// Target proto: the scheme, RouterImpl.DefaultServiceScheme if there is none
+		// Target host: <service_name>.<namespace_name>.svc:<port>
+		// Target path: /<service_path>, / if there is none
 
-		namespace := pathParams[5]
-		proto, service, port, valid := utilnet.SplitSchemeNamePort(pathParams[7])
-		if !valid {
-			return "", "", "", fmt.Errorf("invalid service name: %s", pathParams[7])
+		// The namespace and service segments may be encoded, e.g. https%3Ametrics-server%3Ahttps
+		namespace, err := parseNamespaceSegment(segments[4])
+		if err != nil {
+			return "", "", "", err
 		}
-		if proto != "https" {
-			return "", "", "", fmt.Errorf("for security reason, only https is supported:unsupported protocol: %s", proto)
+		proto, targetHost, err := router.serviceTarget(segments[6], namespace)
+		if err != nil {
+			return "", "", "", err
 		}
 
 		// Extract service path: everything after proxy-service
-		servicePath := "/" + strings.Join(pathParams[9:], "/")
-		targetHost := fmt.Sprintf("%s.%s.svc:%s", service, namespace, port)
-
-		return "https", targetHost, servicePath, nil
+		return proto, targetHost, joinPath(segments[8:], trailingSlash), nil
 
 	default:
 		return "", "", "", fmt.Errorf("unknown proxy type, please check your request path: %s", r.RequestURI)
@@ -0,0 +1,391 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseTargetService(t *testing.T) {
+	cases := []struct {
+		name        string
+		requestURI  string
+		expectHost  string
+		expectPath  string
+		expectError bool
+		// expectNoMatch expects ErrNoMatch, for the paths the kube-apiserver doesn't serve
+		expectNoMatch bool
+	}{
+		{
+			name:       "kube-apiserver",
+			requestURI: "/cluster1/api/v1/pods?timeout=32s",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/pods",
+		},
+		{
+			name:       "kube-apiserver encoded slash",
+			requestURI: "/cluster1/api/v1/namespaces/default/pods/my%2Fpod/log",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/namespaces/default/pods/my%2Fpod/log",
+		},
+		{
+			name:       "kube-apiserver encoded colon",
+			requestURI: "/cluster1/api/v1/namespaces/default/services/https:my-svc:8443/proxy/metrics",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/namespaces/default/services/https:my-svc:8443/proxy/metrics",
+		},
+		{
+			name:       "service",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:https/proxy-service/apis/metrics?watch=1",
+			expectHost: "metrics-server.kube-system.svc:https",
+			expectPath: "/apis/metrics",
+		},
+		{
+			name:       "service encoded name",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https%3Ametrics-server%3Ahttps/proxy-service/apis/metrics",
+			expectHost: "metrics-server.kube-system.svc:https",
+			expectPath: "/apis/metrics",
+		},
+		{
+			name:       "service encoded path",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:443/proxy-service/a%2Fb/c%20d",
+			expectHost: "metrics-server.kube-system.svc:443",
+			expectPath: "/a%2Fb/c%20d",
+		},
+		{
+			name:       "service without port",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:/proxy-service/healthz",
+			expectHost: "metrics-server.kube-system.svc",
+			expectPath: "/healthz",
+		},
+		{
+			// <name>:<port>, the scheme defaults to https
+			name:       "service without scheme",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/metrics-server:https/proxy-service/healthz",
+			expectHost: "metrics-server.kube-system.svc:https",
+			expectPath: "/healthz",
+		},
+		{
+			name:       "service name only",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/metrics-server/proxy-service/healthz",
+			expectHost: "metrics-server.kube-system.svc",
+			expectPath: "/healthz",
+		},
+		{
+			name:        "service invalid namespace",
+			requestURI:  "/cluster1/api/v1/namespaces/evil.example.com%3A443/services/https:metrics-server:443/proxy-service/healthz",
+			expectError: true,
+		},
+		{
+			// The proxy subresource of the nodes is served by the apiserver
+			name:       "kube-apiserver node proxy",
+			requestURI: "/cluster1/api/v1/nodes/node-1/proxy/stats/summary",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/nodes/node-1/proxy/stats/summary",
+		},
+		{
+			name:       "kube-apiserver node proxy with port",
+			requestURI: "/cluster1/api/v1/nodes/node-1:10250/proxy/metrics/cadvisor",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/nodes/node-1:10250/proxy/metrics/cadvisor",
+		},
+		{
+			name:        "service http scheme",
+			requestURI:  "/cluster1/api/v1/namespaces/kube-system/services/http:metrics-server:80/proxy-service/healthz",
+			expectError: true,
+		},
+		{
+			name:        "service empty name",
+			requestURI:  "/cluster1/api/v1/namespaces/kube-system/services/https::https/proxy-service/healthz",
+			expectError: true,
+		},
+		{
+			name:        "service too many colons",
+			requestURI:  "/cluster1/api/v1/namespaces/kube-system/services/https:a:b:c/proxy-service/healthz",
+			expectError: true,
+		},
+		{
+			name:       "kube-apiserver duplicate slashes",
+			requestURI: "/cluster1//api/v1//pods",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/pods",
+		},
+		{
+			name:       "kube-apiserver trailing slash",
+			requestURI: "/cluster1/apis/",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/apis/",
+		},
+		{
+			name:       "kube-apiserver no sub-path",
+			requestURI: "/cluster1",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/",
+		},
+		{
+			name:       "kube-apiserver root",
+			requestURI: "/cluster1/",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/",
+		},
+		{
+			name:       "service duplicate slashes",
+			requestURI: "/cluster1/api/v1/namespaces//kube-system/services/https:metrics-server:443//proxy-service//healthz",
+			expectHost: "metrics-server.kube-system.svc:443",
+			expectPath: "/healthz",
+		},
+		{
+			name:       "service no sub-path",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:443/proxy-service",
+			expectHost: "metrics-server.kube-system.svc:443",
+			expectPath: "/",
+		},
+		{
+			name:       "kube-apiserver fewer than 3 segments",
+			requestURI: "/cluster1/healthz?verbose",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/healthz",
+		},
+		{
+			// Only proxy-service routes to the service, the proxy subresource of the apiserver is forwarded to it
+			name:       "service path without proxy-service",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:443/healthz/livez",
+			expectHost: "kubernetes.default.svc",
+			expectPath: "/api/v1/namespaces/kube-system/services/https:metrics-server:443/healthz/livez",
+		},
+		{
+			name:       "service query with encoded path",
+			requestURI: "/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:443/proxy-service/a%3Fb?c=d",
+			expectHost: "metrics-server.kube-system.svc:443",
+			expectPath: "/a%3Fb",
+		},
+		{
+			name:        "no cluster name",
+			requestURI:  "//",
+			expectError: true,
+		},
+		{
+			name:          "not a kube-apiserver path",
+			requestURI:    "/cluster1/service/kube-system/metrics-server:443/healthz",
+			expectNoMatch: true,
+		},
+	}
+
+	router := &RouterImpl{}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", c.requestURI, nil)
+			proto, host, path, err := router.ParseTargetService(r)
+			if c.expectNoMatch {
+				if !errors.Is(err, ErrNoMatch) {
+					t.Fatalf("expected ErrNoMatch, got %v with host %q path %q", err, host, path)
+				}
+				return
+			}
+			if c.expectError {
+				if !errors.Is(err, ErrInvalidPath) {
+					t.Fatalf("expected ErrInvalidPath, got %v with host %q path %q", err, host, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if proto != "https" {
+				t.Errorf("expected proto https, got %q", proto)
+			}
+			if host != c.expectHost {
+				t.Errorf("expected host %q, got %q", c.expectHost, host)
+			}
+			if path != c.expectPath {
+				t.Errorf("expected path %q, got %q", c.expectPath, path)
+			}
+		})
+	}
+}
+
+// TestParseServiceSegment checks the service segment follows the grammar of the apiserver's proxy subresource,
+// [<scheme>:]<name>[:<port>]
+func TestParseServiceSegment(t *testing.T) {
+	cases := []struct {
+		name    string
+		router  RouterImpl
+		segment string
+		// expectHost is the target host of the service in namespace ns
+		expectProto string
+		expectHost  string
+		// expectError is a part of the error, which names the service segment
+		expectError string
+	}{
+		{name: "name", segment: "my-svc", expectProto: "https", expectHost: "my-svc.ns.svc"},
+		{name: "name and port number", segment: "my-svc:8443", expectProto: "https", expectHost: "my-svc.ns.svc:8443"},
+		{name: "name and port name", segment: "my-svc:metrics", expectProto: "https", expectHost: "my-svc.ns.svc:metrics"},
+		{name: "scheme name and port number", segment: "https:my-svc:8443", expectProto: "https", expectHost: "my-svc.ns.svc:8443"},
+		{name: "scheme and name", segment: "https:my-svc:", expectProto: "https", expectHost: "my-svc.ns.svc"},
+		{name: "empty scheme", segment: ":my-svc:8443", expectProto: "https", expectHost: "my-svc.ns.svc:8443"},
+		{name: "empty port", segment: "my-svc:", expectProto: "https", expectHost: "my-svc.ns.svc"},
+
+		// The scheme of the segments without one is configurable, http must be allowed
+		{name: "http scheme allowed", router: RouterImpl{AllowHTTPServices: true}, segment: "http:my-svc:8080", expectProto: "http", expectHost: "my-svc.ns.svc:8080"},
+		{name: "http default scheme", router: RouterImpl{DefaultServiceScheme: "http", AllowHTTPServices: true}, segment: "my-svc:8080", expectProto: "http", expectHost: "my-svc.ns.svc:8080"},
+		{name: "https with http default scheme", router: RouterImpl{DefaultServiceScheme: "http", AllowHTTPServices: true}, segment: "https:my-svc:8443", expectProto: "https", expectHost: "my-svc.ns.svc:8443"},
+		{name: "http scheme", segment: "http:my-svc:8080", expectError: `service "http:my-svc:8080": for security reason, only https is supported`},
+		{name: "http default scheme not allowed", router: RouterImpl{DefaultServiceScheme: "http"}, segment: "my-svc:8080", expectError: `service "my-svc:8080": for security reason, only https is supported`},
+		{name: "unsupported scheme", segment: "ftp:my-svc:21", expectError: `service "ftp:my-svc:21": unsupported scheme "ftp"`},
+
+		// A segment with two parts is a name and a port, like for the apiserver
+		{name: "scheme without port", segment: "https:my-svc", expectProto: "https", expectHost: "https.ns.svc:my-svc"},
+		{name: "empty name", segment: "https::8443", expectError: `service "https::8443": the name is required`},
+		{name: "empty segment", segment: ":", expectError: `service ":": the name is required`},
+		{name: "invalid name", segment: "My_Svc:8443", expectError: `service "My_Svc:8443": invalid name "My_Svc"`},
+		{name: "name with a dot", segment: "evil.example.com:443", expectError: `invalid name "evil.example.com"`},
+		{name: "port zero", segment: "my-svc:0", expectError: `service "my-svc:0": invalid port "0"`},
+		{name: "port out of range", segment: "my-svc:65536", expectError: `service "my-svc:65536": invalid port "65536"`},
+		{name: "invalid port name", segment: "my-svc:metrics_port", expectError: `service "my-svc:metrics_port": invalid port "metrics_port"`},
+		{name: "too many colons", segment: "https:my-svc:8443:extra", expectError: `service "https:my-svc:8443:extra": must be [<scheme>:]<name>[:<port>]`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requestURI := "/cluster1/api/v1/namespaces/ns/services/" + url.PathEscape(c.segment) + "/proxy-service/healthz"
+			proto, host, path, err := c.router.ParseTargetService(httptest.NewRequest(http.MethodGet, requestURI, nil))
+			if c.expectError != "" {
+				if !errors.Is(err, ErrInvalidPath) || !strings.Contains(err.Error(), c.expectError) {
+					t.Fatalf("expected ErrInvalidPath with %q, got %v", c.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if proto != c.expectProto || host != c.expectHost || path != "/healthz" {
+				t.Errorf("expected %s://%s/healthz, got %s://%s%s", c.expectProto, c.expectHost, proto, host, path)
+			}
+		})
+	}
+}
+
+func TestSetTargetPath(t *testing.T) {
+	cases := []struct {
+		name             string
+		requestURI       string
+		targetPath       string
+		expectRequestURI string
+		expectError      bool
+	}{
+		{
+			name:             "plain",
+			requestURI:       "/cluster1/api/v1/pods?timeout=32s",
+			targetPath:       "/api/v1/pods",
+			expectRequestURI: "/api/v1/pods?timeout=32s",
+		},
+		{
+			name:             "encoded segments and query",
+			requestURI:       "/cluster1/api/v1/namespaces/default/pods/my%2Fpod?labelSelector=app%3Dweb&watch=1",
+			targetPath:       "/api/v1/namespaces/default/pods/my%2Fpod",
+			expectRequestURI: "/api/v1/namespaces/default/pods/my%2Fpod?labelSelector=app%3Dweb&watch=1",
+		},
+		{
+			name:             "unescaped path from a custom router",
+			requestURI:       "/cluster1/a/b c",
+			targetPath:       "/a/b c",
+			expectRequestURI: "/a/b%20c",
+		},
+		{
+			name:        "invalid escape",
+			requestURI:  "/cluster1/a",
+			targetPath:  "/a%zz",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(c.requestURI)
+			if err != nil {
+				t.Fatalf("failed to parse request URI: %v", err)
+			}
+			err = setTargetPath(u, c.targetPath)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if u.RequestURI() != c.expectRequestURI {
+				t.Errorf("expected request URI %q, got %q", c.expectRequestURI, u.RequestURI())
+			}
+		})
+	}
+}
+
+func FuzzParseTargetService(f *testing.F) {
+	for _, path := range []string{
+		"/", "//", "/cluster1", "/cluster1/", "/cluster1//api/v1/pods", "/cluster1/api/v1/pods/",
+		"/cluster1/api/v1/namespaces/kube-system/services/https:metrics-server:443/proxy-service/healthz",
+		"/cluster1/a/b/c/d/e/f/proxy-service", "/cluster1/a/b/c/%zz/e/f/proxy-service/x",
+	} {
+		f.Add(path)
+	}
+
+	router := &RouterImpl{}
+	f.Fuzz(func(t *testing.T, path string) {
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path}, RequestURI: path}
+		_, host, targetPath, err := router.ParseTargetService(r)
+		if err != nil {
+			return
+		}
+		if host == "" {
+			t.Errorf("expected a host for %q", path)
+		}
+		if !strings.HasPrefix(targetPath, "/") || strings.Contains(targetPath, "//") {
+			t.Errorf("expected an absolute path without empty segments for %q, got %q", path, targetPath)
+		}
+	})
+}
+
+func TestClassifyRequest(t *testing.T) {
+	cases := []struct {
+		name        string
+		requestURI  string
+		header      http.Header
+		expectClass RouteClass
+	}{
+		{name: "list", requestURI: "/cluster1/api/v1/pods?timeout=32s", expectClass: RouteUnary},
+		{name: "watch", requestURI: "/cluster1/apis/apps/v1/deployments?watch=true&resourceVersion=1", expectClass: RouteStreaming},
+		{name: "watch=1", requestURI: "/cluster1/api/v1/pods?watch=1", expectClass: RouteStreaming},
+		{name: "watch=false", requestURI: "/cluster1/api/v1/pods?watch=false", expectClass: RouteUnary},
+		{name: "deprecated watch path", requestURI: "/cluster1/api/v1/watch/namespaces/default/pods", expectClass: RouteStreaming},
+		{name: "pod named watch", requestURI: "/cluster1/api/v1/namespaces/default/pods/watch", expectClass: RouteUnary},
+		{name: "logs", requestURI: "/cluster1/api/v1/namespaces/default/pods/my-pod/log", expectClass: RouteUnary},
+		{name: "followed logs", requestURI: "/cluster1/api/v1/namespaces/default/pods/my-pod/log?follow=true", expectClass: RouteStreaming},
+		{
+			name:        "exec",
+			requestURI:  "/cluster1/api/v1/namespaces/default/pods/my-pod/exec?command=sh",
+			header:      http.Header{"Connection": {"Upgrade"}, "Upgrade": {"SPDY/3.1"}},
+			expectClass: RouteStreaming,
+		},
+		{
+			name:        "server-sent events",
+			requestURI:  "/cluster1/api/v1/namespaces/default/services/https:my-svc:8443/proxy-service/events",
+			header:      http.Header{"Accept": {"text/event-stream"}},
+			expectClass: RouteStreaming,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", c.requestURI, nil)
+			for key, values := range c.header {
+				r.Header[key] = values
+			}
+			if class := ClassifyRequest(r); class != c.expectClass {
+				t.Errorf("expected class %d, got %d", c.expectClass, class)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package agent
+
+// abstractNamespaceSupported is whether the sockets of the proxies can be bound in the abstract namespace
+const abstractNamespaceSupported = true
+
+// socketAddress returns the address the socket at path is bound and dialed at, in the abstract namespace, i.e.
+// prefixed with a NUL byte, if abstract is set. An abstract socket has no file, it's gone once it's closed
+func socketAddress(path string, abstract bool) string {
+	if abstract {
+		return "\x00" + path
+	}
+	return path
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func TestAbstractNamespace(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from backend"))
+	}))
+	defer backend.Close()
+
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	p := newProxy(&passThroughRequestProcessor{}, &systemCertificateProvider{},
+		&staticRouter{proto: "http", host: strings.TrimPrefix(backend.URL, "http://")}, socketPath)
+	p.abstractNamespace = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.server.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected no socket file in the abstract namespace, got %v", err)
+	}
+
+	// The packet connection manager dials the proxy in the abstract namespace
+	config := DefaultPacketConnManagerConfig()
+	config.UDSSocketPath = socketPath
+	config.UseAbstractNamespace = true
+	lcm := newPacketConnectionManagerWithConfig(context.Background(), config).(*packetConnManagerImpl)
+	defer lcm.Close()
+
+	request := "GET /api/v1/pods HTTP/1.1\r\nHost: hub.example.com\r\nConnection: close\r\n\r\n"
+	if err := lcm.Dispatch(&v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(request)}); err != nil {
+		t.Fatalf("failed to dispatch the request: %v", err)
+	}
+	var response strings.Builder
+	timeout := time.After(5 * time.Second)
+	for !strings.Contains(response.String(), "Hello from backend") {
+		select {
+		case packet := <-lcm.OutgoingChan():
+			if packet.Code == v1.ControlCode_ERROR {
+				t.Fatalf("unexpected ERROR: %s", packet.ErrorMessage)
+			}
+			response.Write(packet.Data)
+		case <-timeout:
+			t.Fatalf("expected the response of the backend, got %q", response.String())
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDiagnoseAbstractSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	message, err := diagnoseUDSSocket(context.Background(), path, true)
+	if err != nil || message != "can be created in the abstract namespace" {
+		t.Errorf("expected the socket to be creatable, got %q, %v", message, err)
+	}
+
+	listener, err := net.Listen("unix", socketAddress(path, true))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	message, err = diagnoseUDSSocket(context.Background(), path, true)
+	if err != nil || message != "accepts connections in the abstract namespace" {
+		t.Errorf("expected the socket to accept connections, got %q, %v", message, err)
+	}
+}
+
+func TestValidateAbstractNamespace(t *testing.T) {
+	// The directory of a socket in the abstract namespace doesn't need to exist
+	config := Config{ClusterName: "cluster1", HubAddress: "hub:8443", UseAbstractNamespace: true,
+		UDSSocketPath: filepath.Join(t.TempDir(), "missing", "proxy.sock")}
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
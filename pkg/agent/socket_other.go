@@ -0,0 +1,12 @@
+//go:build !linux
+
+package agent
+
+// abstractNamespaceSupported is whether the sockets of the proxies can be bound in the abstract namespace, it's
+// specific to Linux
+const abstractNamespaceSupported = false
+
+// socketAddress returns the path, the abstract namespace is only supported on Linux
+func socketAddress(path string, _ bool) string {
+	return path
+}
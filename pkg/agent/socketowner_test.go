@@ -0,0 +1,37 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSocketOwnership(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	p := newProxy(&passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost"}, socketPath)
+	p.socketUID, p.socketGID = os.Getuid(), os.Getgid()
+
+	listener, err := p.listen()
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatalf("failed to stat the socket file: %v", err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Skipf("no owner in the file metadata of %T", info.Sys())
+	}
+	if int(stat.Uid) != os.Getuid() || int(stat.Gid) != os.Getgid() {
+		t.Errorf("expected the socket file to be owned by %d:%d, got %d:%d", os.Getuid(), os.Getgid(), stat.Uid, stat.Gid)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != DefaultUDSSocketPermissions {
+		t.Errorf("expected a socket file with the permissions %v, got %v", DefaultUDSSocketPermissions, info.Mode())
+	}
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultStatusHistorySize is the default number of connection attempts kept in the AgentStatus
+const DefaultStatusHistorySize = 10
+
+// ConnectionState is the state of the tunnel of the agent to the Hub
+type ConnectionState string
+
+const (
+	// StateConnecting is an attempt to establish a tunnel stream in progress
+	StateConnecting ConnectionState = "Connecting"
+	// StateConnected is a tunnel stream established
+	StateConnected ConnectionState = "Connected"
+	// StateBackoff is waiting to retry after an attempt ended
+	StateBackoff ConnectionState = "Backoff"
+)
+
+// AttemptOutcome is how a connection attempt ended
+type AttemptOutcome string
+
+const (
+	// AttemptDialError is an attempt whose tunnel stream could not be opened, e.g. the Hub is unreachable
+	AttemptDialError AttemptOutcome = "DialError"
+	// AttemptStreamError is an attempt whose tunnel stream failed, before or after it was established
+	AttemptStreamError AttemptOutcome = "StreamError"
+	// AttemptDisconnected is an attempt closed by the Hub with a DRAIN
+	AttemptDisconnected AttemptOutcome = "Disconnected"
+	// AttemptStopped is an attempt ended by the shutdown of the agent
+	AttemptStopped AttemptOutcome = "Stopped"
+)
+
+// ConnectionAttempt is an ended attempt to establish a tunnel stream to the Hub
+type ConnectionAttempt struct {
+	// Time is when the attempt started
+	Time       time.Time      `json:"time"`
+	HubAddress string         `json:"hubAddress"`
+	Outcome    AttemptOutcome `json:"outcome"`
+	Error      string         `json:"error,omitempty"`
+	// Connected is how long the tunnel stream was established, 0 if it never was
+	Connected time.Duration `json:"connected,omitempty"`
+}
+
+// AgentStatus is the status of the connection of the agent to the Hub, returned by Agent.Status
+type AgentStatus struct {
+	State ConnectionState `json:"state"`
+	// ConnectedSince is when the current tunnel stream was established, zero unless Connected
+	ConnectedSince time.Time `json:"connectedSince,omitzero"`
+	// NextRetry is when the next attempt starts, zero unless Backoff
+	NextRetry time.Time `json:"nextRetry,omitzero"`
+	// ConsecutiveFailures is the number of attempts in a row that didn't establish a tunnel stream
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	LastError           string `json:"lastError,omitempty"`
+	// Attempts are the last ended attempts, oldest first
+	Attempts []ConnectionAttempt `json:"attempts"`
+}
+
+// statusTracker records the connection attempts of the agent, the reconnect loop of Run and establishAndServe
+// report the transitions to it
+type statusTracker struct {
+	mu     sync.Mutex
+	status AgentStatus
+
+	// current is the attempt in progress
+	current        ConnectionAttempt
+	streamOpened   bool
+	connectedSince time.Time
+
+	// attempts is a ring of the last ended attempts, next is the index of the oldest one once it's full
+	attempts []ConnectionAttempt
+	next     int
+	size     int
+}
+
+func newStatusTracker(size int) *statusTracker {
+	if size <= 0 {
+		size = DefaultStatusHistorySize
+	}
+	return &statusTracker{status: AgentStatus{State: StateConnecting}, size: size}
+}
+
+// attemptStarted records the start of an attempt to connect to the Hub address
+func (t *statusTracker) attemptStarted(hubAddress string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current = ConnectionAttempt{Time: time.Now(), HubAddress: hubAddress}
+	t.streamOpened = false
+	t.connectedSince = time.Time{}
+	t.status.State = StateConnecting
+	t.status.NextRetry = time.Time{}
+}
+
+// streamOpen records the tunnel stream of the current attempt was opened, its errors are stream errors
+func (t *statusTracker) streamOpen() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.streamOpened = true
+}
+
+// connected records the tunnel stream of the current attempt was established
+func (t *statusTracker) connected() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connectedSince = time.Now()
+	t.status.State = StateConnected
+	t.status.ConnectedSince = t.connectedSince
+	t.status.ConsecutiveFailures = 0
+}
+
+// attemptEnded records the end of the current attempt with the error establishAndServe returned
+func (t *statusTracker) attemptEnded(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempt := t.current
+	var disconnectErr *hubDisconnectError
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+		attempt.Outcome = AttemptStopped
+	case errors.As(err, &disconnectErr):
+		attempt.Outcome = AttemptDisconnected
+	case t.streamOpened:
+		attempt.Outcome = AttemptStreamError
+	default:
+		attempt.Outcome = AttemptDialError
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		t.status.LastError = attempt.Error
+	}
+	if !t.connectedSince.IsZero() {
+		attempt.Connected = time.Since(t.connectedSince)
+	} else if attempt.Outcome != AttemptStopped {
+		t.status.ConsecutiveFailures++
+	}
+	t.status.ConnectedSince = time.Time{}
+	if t.status.State == StateConnected {
+		t.status.State = StateConnecting
+	}
+
+	if len(t.attempts) < t.size {
+		t.attempts = append(t.attempts, attempt)
+		return
+	}
+	t.attempts[t.next] = attempt
+	t.next = (t.next + 1) % t.size
+}
+
+// backoff records the agent waits until the next attempt
+func (t *statusTracker) backoff(nextRetry time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.State = StateBackoff
+	t.status.NextRetry = nextRetry
+}
+
+// snapshot returns a copy of the status
+func (t *statusTracker) snapshot() AgentStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.status
+	status.Attempts = make([]ConnectionAttempt, 0, len(t.attempts))
+	status.Attempts = append(status.Attempts, t.attempts[t.next:]...)
+	status.Attempts = append(status.Attempts, t.attempts[:t.next]...)
+	return status
+}
+
+// Status returns the state of the connection to the Hub and the last connection attempts, e.g. to tell why the
+// agent can't connect without reading its logs
+func (c *Agent) Status() AgentStatus {
+	return c.status.snapshot()
+}
+
+// StatusHandler serves the Status of the agent as JSON, e.g. on its health endpoint
+func (c *Agent) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.Status()); err != nil {
+			logger.ErrorS(err, "Failed to write the agent status")
+		}
+	})
+}
+
+// ConnectionsHandler serves the ListConnections of the agent as JSON, e.g. on its debug endpoint
+func (c *Agent) ConnectionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.ListConnections()); err != nil {
+			logger.ErrorS(err, "Failed to write the agent connections")
+		}
+	})
+}
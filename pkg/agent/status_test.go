@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// runStatusAgent runs an agent connecting to the Hub address every retryInterval until the test ends
+func runStatusAgent(t *testing.T, hubAddress string, retryInterval time.Duration) *Agent {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := New(ctx, &Config{
+		HubAddress:     hubAddress,
+		ClusterName:    "cluster1",
+		UDSSocketPath:  filepath.Join(t.TempDir(), "proxy.sock"),
+		DialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		BackoffFactory: func() backoff.BackOff { return backoff.NewConstantBackOff(retryInterval) },
+	}, &passThroughRequestProcessor{}, &systemCertificateProvider{}, &staticRouter{proto: "http", host: "localhost:8080"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return a
+}
+
+// waitForStatus waits until the status of the agent satisfies the condition
+func waitForStatus(t *testing.T, a *Agent, condition func(AgentStatus) bool) AgentStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := a.Status()
+		if condition(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the agent status, got %+v", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStatusConnectFailures(t *testing.T) {
+	// Nothing listens on the address once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	hubAddress := listener.Addr().String()
+	listener.Close()
+
+	a := runStatusAgent(t, hubAddress, 500*time.Millisecond)
+	status := waitForStatus(t, a, func(s AgentStatus) bool {
+		return s.State == StateBackoff && s.ConsecutiveFailures >= 2
+	})
+
+	if len(status.Attempts) != status.ConsecutiveFailures {
+		t.Errorf("expected %d attempts, got %d", status.ConsecutiveFailures, len(status.Attempts))
+	}
+	for _, attempt := range status.Attempts {
+		if attempt.Outcome != AttemptDialError || attempt.HubAddress != hubAddress || attempt.Error == "" ||
+			attempt.Connected != 0 {
+			t.Errorf("expected a dial error to %s, got %+v", hubAddress, attempt)
+		}
+	}
+	if status.LastError != status.Attempts[len(status.Attempts)-1].Error {
+		t.Errorf("expected the last error %q, got %q", status.Attempts[len(status.Attempts)-1].Error, status.LastError)
+	}
+	// The next retry is reported with the backoff of the last attempt
+	last := status.Attempts[len(status.Attempts)-1]
+	if status.NextRetry.Before(last.Time) || status.NextRetry.After(time.Now().Add(500*time.Millisecond)) {
+		t.Errorf("expected the next retry within 500ms of the last attempt at %v, got %v", last.Time, status.NextRetry)
+	}
+
+	// The status is served as JSON
+	w := httptest.NewRecorder()
+	a.StatusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var served AgentStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("failed to decode the status %s: %v", w.Body.String(), err)
+	}
+	if served.ConsecutiveFailures < 2 || len(served.Attempts) < 2 || served.Attempts[0].Outcome != AttemptDialError {
+		t.Errorf("expected the failed attempts to be served, got %s", w.Body.String())
+	}
+}
+
+func TestStatusConnected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	v1.RegisterTunnelServiceServer(grpcServer, &authorityRecorder{authorities: make(chan string, 1)})
+	go grpcServer.Serve(listener)
+
+	a := runStatusAgent(t, listener.Addr().String(), time.Minute)
+	status := waitForStatus(t, a, func(s AgentStatus) bool { return s.State == StateConnected })
+	if status.ConnectedSince.IsZero() || status.ConsecutiveFailures != 0 || len(status.Attempts) != 0 {
+		t.Errorf("expected a connected status without attempts ended, got %+v", status)
+	}
+
+	// The tunnel stream fails once the Hub stops
+	time.Sleep(100 * time.Millisecond)
+	grpcServer.Stop()
+	status = waitForStatus(t, a, func(s AgentStatus) bool { return s.State == StateBackoff })
+	if len(status.Attempts) != 1 {
+		t.Fatalf("expected 1 attempt, got %+v", status.Attempts)
+	}
+	if attempt := status.Attempts[0]; attempt.Outcome != AttemptStreamError || attempt.Connected < 100*time.Millisecond {
+		t.Errorf("expected a stream error after 100ms connected, got %+v", attempt)
+	}
+	if !status.ConnectedSince.IsZero() || status.ConsecutiveFailures != 0 {
+		t.Errorf("expected no failure after the connected attempt, got %+v", status)
+	}
+}
+
+func TestStatusHistory(t *testing.T) {
+	tracker := newStatusTracker(3)
+	for i := range 5 {
+		tracker.attemptStarted(fmt.Sprintf("hub-%d:443", i))
+		tracker.attemptEnded(errors.New("connection refused"))
+	}
+	tracker.attemptStarted("hub-5:443")
+	tracker.streamOpen()
+	tracker.connected()
+	tracker.attemptEnded(&hubDisconnectError{reason: "disconnected by admin"})
+
+	status := tracker.snapshot()
+	var addresses []string
+	for _, attempt := range status.Attempts {
+		addresses = append(addresses, attempt.HubAddress)
+	}
+	if fmt.Sprint(addresses) != "[hub-3:443 hub-4:443 hub-5:443]" {
+		t.Errorf("expected the last 3 attempts, oldest first, got %v", addresses)
+	}
+	if outcome := status.Attempts[2].Outcome; outcome != AttemptDisconnected {
+		t.Errorf("expected the last attempt to be disconnected, got %s", outcome)
+	}
+	if status.ConsecutiveFailures != 0 || status.State != StateConnecting {
+		t.Errorf("expected connecting without failures, got %+v", status)
+	}
+}
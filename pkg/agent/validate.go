@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Validate returns all the errors of the config joined, Run returns them before it connects to the Hub so that a
+// misconfigured agent fails with every problem listed. It doesn't modify the config, the zero values that are
+// defaulted by New are valid
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.ClusterName == "" {
+		errs = append(errs, errors.New("ClusterName must be set, it's the name the Hub routes the requests to the cluster by"))
+	}
+	if c.HubAddress == "" {
+		errs = append(errs, errors.New("HubAddress must be set, e.g. \"hub.example.com:8443\""))
+	} else if !strings.Contains(c.HubAddress, "/") {
+		// A gRPC target with a scheme, e.g. dns:///hub.example.com:8443, isn't a host:port
+		if _, _, err := net.SplitHostPort(c.HubAddress); err != nil {
+			errs = append(errs, fmt.Errorf("HubAddress %q must be a host:port, an IPv6 address in brackets, e.g. \"[::1]:8443\": %w", c.HubAddress, err))
+		}
+	}
+	for i, pin := range c.PinnedHubSPKIHashes {
+		if err := validateSPKIHash(pin); err != nil {
+			errs = append(errs, fmt.Errorf("PinnedHubSPKIHashes[%d] %q must be the base64 SHA-256 of a SubjectPublicKeyInfo: %w", i, pin, err))
+		}
+	}
+	if c.RequireHubCAAndPin && len(c.PinnedHubSPKIHashes) == 0 {
+		errs = append(errs, errors.New("RequireHubCAAndPin requires PinnedHubSPKIHashes"))
+	}
+	if c.UseAbstractNamespace && !abstractNamespaceSupported {
+		errs = append(errs, errors.New("UseAbstractNamespace is only supported on Linux"))
+	}
+	for _, spec := range proxySpecs(c) {
+		if c.UseAbstractNamespace {
+			// The sockets in the abstract namespace have no file
+			break
+		}
+		dir := filepath.Dir(spec.SocketPath)
+		if info, err := os.Stat(dir); err != nil {
+			errs = append(errs, fmt.Errorf("the directory of the socket path %s of proxy %s doesn't exist: %w", spec.SocketPath, spec.Name, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("the directory of the socket path %s of proxy %s is not a directory", spec.SocketPath, spec.Name))
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"MaxGRPCMsgSize", int64(c.MaxGRPCMsgSize)},
+		{"InitialConnectTimeout", int64(c.InitialConnectTimeout)},
+		{"MaxConnBufferedBytes", int64(c.MaxConnBufferedBytes)},
+		{"ResumeWindow", int64(c.ResumeWindow)},
+		{"ResumeMaxBufferedBytes", int64(c.ResumeMaxBufferedBytes)},
+		{"StatusHistorySize", int64(c.StatusHistorySize)},
+	} {
+		if field.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", field.name))
+		}
+	}
+	if c.QoS != nil && (c.QoS.InteractiveWeight < 0 || c.QoS.BulkWeight < 0 || c.QoS.BulkThreshold < 0) {
+		errs = append(errs, errors.New("QoS weights and BulkThreshold must not be negative"))
+	}
+	if c.Coalesce != nil && (c.Coalesce.Delay < 0 || c.Coalesce.MaxBytes < 0) {
+		errs = append(errs, errors.New("Coalesce Delay and MaxBytes must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
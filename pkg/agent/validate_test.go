@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+)
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	cases := []struct {
+		name         string
+		config       Config
+		expectErrors []string
+	}{
+		{
+			name:   "valid",
+			config: Config{ClusterName: "cluster1", HubAddress: "hub:8443", UDSSocketPath: filepath.Join(dir, "agent.sock")},
+		},
+		{
+			name:   "default socket path",
+			config: Config{ClusterName: "cluster1", HubAddress: "hub:8443"},
+		},
+		{
+			name:   "IPv6 hub address",
+			config: Config{ClusterName: "cluster1", HubAddress: "[::1]:8443"},
+		},
+		{
+			name:   "gRPC target hub address",
+			config: Config{ClusterName: "cluster1", HubAddress: "dns:///hub:8443"},
+		},
+		{
+			name:         "IPv6 hub address without brackets",
+			config:       Config{ClusterName: "cluster1", HubAddress: "::1:8443"},
+			expectErrors: []string{`HubAddress "::1:8443" must be a host:port, an IPv6 address in brackets`},
+		},
+		{
+			name:         "empty cluster name and hub address",
+			config:       Config{UDSSocketPath: filepath.Join(dir, "agent.sock")},
+			expectErrors: []string{"ClusterName must be set", "HubAddress must be set"},
+		},
+		{
+			name:         "socket path in a nonexistent directory",
+			config:       Config{ClusterName: "cluster1", HubAddress: "hub:8443", UDSSocketPath: filepath.Join(dir, "missing", "agent.sock")},
+			expectErrors: []string{"the directory of the socket path " + filepath.Join(dir, "missing", "agent.sock") + " of proxy default doesn't exist"},
+		},
+		{
+			name:         "socket path in a file",
+			config:       Config{ClusterName: "cluster1", HubAddress: "hub:8443", UDSSocketPath: filepath.Join(file, "agent.sock")},
+			expectErrors: []string{"is not a directory"},
+		},
+		{
+			name: "proxy socket path in a nonexistent directory",
+			config: Config{ClusterName: "cluster1", HubAddress: "hub:8443", Proxies: []ProxySpec{
+				{Name: "kube", SocketPath: filepath.Join(dir, "kube.sock")},
+				{Name: "grpc", SocketPath: filepath.Join(dir, "missing", "grpc.sock")},
+			}},
+			expectErrors: []string{"of proxy grpc doesn't exist"},
+		},
+		{
+			name:         "negative budgets",
+			config:       Config{ClusterName: "cluster1", HubAddress: "hub:8443", MaxGRPCMsgSize: -1, MaxConnBufferedBytes: -1},
+			expectErrors: []string{"MaxGRPCMsgSize must not be negative", "MaxConnBufferedBytes must not be negative"},
+		},
+		{
+			name:         "negative coalesce delay",
+			config:       Config{ClusterName: "cluster1", HubAddress: "hub:8443", Coalesce: &coalesce.Config{Delay: -time.Millisecond}},
+			expectErrors: []string{"Coalesce Delay and MaxBytes must not be negative"},
+		},
+		{
+			name:   "pinned SPKI hash",
+			config: Config{ClusterName: "cluster1", HubAddress: "hub:8443", PinnedHubSPKIHashes: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}, RequireHubCAAndPin: true},
+		},
+		{
+			name:   "invalid pinned SPKI hashes",
+			config: Config{ClusterName: "cluster1", HubAddress: "hub:8443", PinnedHubSPKIHashes: []string{"not base64", "aGVsbG8="}},
+			expectErrors: []string{
+				`PinnedHubSPKIHashes[0] "not base64" must be the base64 SHA-256 of a SubjectPublicKeyInfo`,
+				`PinnedHubSPKIHashes[1] "aGVsbG8=" must be the base64 SHA-256 of a SubjectPublicKeyInfo: it's 5 bytes instead of 32`,
+			},
+		},
+		{
+			name:         "strict pinning without pins",
+			config:       Config{ClusterName: "cluster1", HubAddress: "hub:8443", RequireHubCAAndPin: true},
+			expectErrors: []string{"RequireHubCAAndPin requires PinnedHubSPKIHashes"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.config.Validate()
+			if len(c.expectErrors) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %q, got none", c.expectErrors)
+			}
+			for _, expectError := range c.expectErrors {
+				if !strings.Contains(err.Error(), expectError) {
+					t.Errorf("expected error %q, got %v", expectError, err)
+				}
+			}
+		})
+	}
+}
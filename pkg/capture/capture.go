@@ -0,0 +1,199 @@
+// Package capture records the packets of tunnel connections for debugging, e.g. corrupted responses.
+//
+// Each packet connection is recorded to its own JSONL file, one Record per packet. Authorization and Cookie headers
+// are redacted from the recorded data. cmd/tunnelcap pretty-prints the files and reassembles the HTTP streams.
+//
+// A Sampler formats the first bytes of the first packets of a connection for logging instead, with the same
+// redaction.
+package capture
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// DefaultMaxFileSize is the default maximum size of the capture file of a connection
+const DefaultMaxFileSize = 10 * 1024 * 1024 // 10MB
+
+// Direction is the direction of a recorded packet
+type Direction string
+
+const (
+	// ToAgent packets carry the requests from the clients
+	ToAgent Direction = "to_agent"
+	// FromAgent packets carry the responses from the target services
+	FromAgent Direction = "from_agent"
+)
+
+// Record is a recorded packet
+type Record struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"direction"`
+	ConnID    int64     `json:"conn_id"`
+	Code      string    `json:"code"`
+	// Length is the length of the packet data, Data is its redacted prefix of up to Config.MaxDataSize bytes
+	Length       int    `json:"length"`
+	Data         []byte `json:"data,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// Config configures the capture of packet connections
+type Config struct {
+	// Dir is the directory of the capture files, it must exist
+	Dir string
+	// MaxFileSize caps the size of the capture file of a connection, the following packets are not recorded.
+	// Defaults to DefaultMaxFileSize
+	MaxFileSize int64
+	// MaxDataSize is the size of the data prefix recorded for each packet, 0 only records the packet metadata
+	MaxDataSize int
+}
+
+// Writer records the packets of a packet connection to its capture file, it's safe for concurrent use.
+// The methods of a nil Writer do nothing, so the capture has no overhead when it's disabled
+type Writer struct {
+	mu          sync.Mutex
+	file        *os.File
+	size        int64
+	maxFileSize int64
+	maxDataSize int
+	// redactors keep the state of the redaction of each direction across packets
+	redactors map[Direction]*redactor
+	// done is set once the file is full or closed
+	done bool
+}
+
+// NewWriter creates the capture file name.jsonl in the directory of the config
+func NewWriter(config Config, name string) (*Writer, error) {
+	maxFileSize := config.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+
+	file, err := os.OpenFile(filepath.Join(config.Dir, name+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+	return &Writer{
+		file:        file,
+		maxFileSize: maxFileSize,
+		maxDataSize: config.MaxDataSize,
+		redactors: map[Direction]*redactor{
+			ToAgent:   {},
+			FromAgent: {},
+		},
+	}, nil
+}
+
+// Record records the packet, the packets are not recorded once the file is full or closed
+func (w *Writer) Record(direction Direction, packet *v1.Packet) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return
+	}
+
+	record := Record{
+		Time:         time.Now(),
+		Direction:    direction,
+		ConnID:       packet.ConnId,
+		Code:         packet.Code.String(),
+		Length:       len(packet.Data),
+		ErrorMessage: packet.ErrorMessage,
+	}
+	if r, ok := w.redactors[direction]; ok && len(packet.Data) > 0 {
+		// The whole data is scanned so that a header split across packets is redacted
+		data := r.redact(packet.Data)
+		if w.maxDataSize > 0 {
+			record.Data = data[:min(len(data), w.maxDataSize)]
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if w.size+int64(len(line)) > w.maxFileSize {
+		w.done = true
+		return
+	}
+	// Records are written right away, so that the capture of a long-running connection can be followed
+	if _, err := w.file.Write(line); err != nil {
+		w.done = true
+		return
+	}
+	w.size += int64(len(line))
+}
+
+// Close closes the capture file
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	w.done = true
+
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// ReadFile reads the records of a capture file
+func ReadFile(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// Read reads the records of a capture file
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	decoder := json.NewDecoder(r)
+	for {
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, nil
+			}
+			return records, fmt.Errorf("failed to read record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// Reassemble concatenates the data of the DATA packets of each direction, i.e. the HTTP request and response
+// streams of the connection with the Authorization and Cookie headers redacted. It fails if the data of a packet
+// wasn't recorded in full, e.g. with a MaxDataSize smaller than the packets
+func Reassemble(records []Record) (map[Direction][]byte, error) {
+	streams := make(map[Direction][]byte)
+	for i, record := range records {
+		if record.Code != v1.ControlCode_DATA.String() {
+			continue
+		}
+		if len(record.Data) != record.Length {
+			return nil, fmt.Errorf("record %d has %d of the %d bytes of data", i+1, len(record.Data), record.Length)
+		}
+		streams[record.Direction] = append(streams[record.Direction], record.Data...)
+	}
+	return streams, nil
+}
@@ -0,0 +1,216 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		name    string
+		packets []string
+		expect  string
+	}{
+		{
+			name:    "authorization",
+			packets: []string{"GET / HTTP/1.1\r\nHost: hub\r\nAuthorization: Bearer secret\r\nAccept: */*\r\n\r\n"},
+			expect:  "GET / HTTP/1.1\r\nHost: hub\r\nAuthorization:**************\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name:    "case insensitive",
+			packets: []string{"GET / HTTP/1.1\r\nproxy-AUTHORIZATION: Basic dXNlcg==\r\n\r\n"},
+			expect:  "GET / HTTP/1.1\r\nproxy-AUTHORIZATION:***************\r\n\r\n",
+		},
+		{
+			name:    "split value",
+			packets: []string{"GET / HTTP/1.1\r\nAuthorization: Bea", "rer secret\r\nAccept: */*\r\n\r\n"},
+			expect:  "GET / HTTP/1.1\r\nAuthorization:**************\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name:    "split name",
+			packets: []string{"GET / HTTP/1.1\r\nAuthor", "ization: Bearer secret\r\n\r\n"},
+			expect:  "GET / HTTP/1.1\r\nAuthorization:**************\r\n\r\n",
+		},
+		{
+			name: "cookies",
+			packets: []string{"GET / HTTP/1.1\r\nCookie: session=secret\r\n\r\n",
+				"HTTP/1.1 200 OK\r\nset-cookie: session=new\r\n\r\n"},
+			expect: "GET / HTTP/1.1\r\nCookie:***************\r\n\r\nHTTP/1.1 200 OK\r\nset-cookie:************\r\n\r\n",
+		},
+		{
+			name:    "other headers",
+			packets: []string{"GET / HTTP/1.1\r\nX-Authorization: kept\r\nAuthorization-Hint: kept\r\n\r\n"},
+			expect:  "GET / HTTP/1.1\r\nX-Authorization: kept\r\nAuthorization-Hint: kept\r\n\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &redactor{}
+			var got []byte
+			for _, packet := range c.packets {
+				data := []byte(packet)
+				got = append(got, r.redact(data)...)
+				if string(data) != packet {
+					t.Errorf("expected the packet data to be unchanged, got %q", data)
+				}
+			}
+			if string(got) != c.expect {
+				t.Errorf("expected %q, got %q", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, MaxDataSize: 1024}, "test-cluster-1")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	request := "GET /api HTTP/1.1\r\nHost: hub\r\nAuthorization: Bearer secret\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+	w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA})
+	w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(request[:20])})
+	w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(request[20:])})
+	w.Record(FromAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(response[:30])})
+	w.Record(FromAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte(response[30:])})
+	w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_ERROR, ErrorMessage: "client disconnected"})
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	// Packets are not recorded once the writer is closed
+	w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("late")})
+
+	records, err := ReadFile(filepath.Join(dir, "test-cluster-1.jsonl"))
+	if err != nil {
+		t.Fatalf("failed to read capture file: %v", err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	if records[5].Code != "ERROR" || records[5].ErrorMessage != "client disconnected" {
+		t.Errorf("unexpected error record %+v", records[5])
+	}
+
+	streams, err := Reassemble(records)
+	if err != nil {
+		t.Fatalf("failed to reassemble: %v", err)
+	}
+	expectRequest := strings.Replace(request, " Bearer secret", "**************", 1)
+	if string(streams[ToAgent]) != expectRequest {
+		t.Errorf("expected request %q, got %q", expectRequest, streams[ToAgent])
+	}
+	if string(streams[FromAgent]) != response {
+		t.Errorf("expected response %q, got %q", response, streams[FromAgent])
+	}
+}
+
+func TestReassembleTruncatedData(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"direction":"to_agent","conn_id":1,"code":"DATA","length":10,"data":"YWJj"}` + "\n")
+	records, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if _, err := Reassemble(records); err == nil {
+		t.Errorf("expected an error reassembling truncated data")
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, MaxFileSize: 1024, MaxDataSize: 100}, "conn")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for range 100 {
+		w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: bytes.Repeat([]byte("a"), 100)})
+	}
+	w.Close()
+
+	info, err := os.Stat(filepath.Join(dir, "conn.jsonl"))
+	if err != nil {
+		t.Fatalf("failed to stat capture file: %v", err)
+	}
+	if info.Size() == 0 || info.Size() > 1024 {
+		t.Errorf("expected a capture file of at most 1024 bytes, got %d", info.Size())
+	}
+}
+
+func TestNilWriter(t *testing.T) {
+	var w *Writer
+	w.Record(ToAgent, &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: []byte("data")})
+	if err := w.Close(); err != nil {
+		t.Errorf("unexpected error closing a nil writer: %v", err)
+	}
+}
+
+func TestSamplerRedaction(t *testing.T) {
+	s := NewSampler(SampleConfig{Bytes: 1024, MaxBytes: 4096})
+	var text string
+	for _, packet := range []string{"GET / HTTP/1.1\r\nAuthorization: Bea", "rer secret\r\nCookie: a=b\r\n\r\n"} {
+		sample, ok := s.Sample(ToAgent, []byte(packet))
+		if !ok {
+			t.Fatalf("expected a sample of %q", packet)
+		}
+		text += sample.Text
+	}
+	if expect := "GET / HTTP/1.1..Authorization:**************..Cookie:****...."; text != expect {
+		t.Errorf("expected %q, got %q", expect, text)
+	}
+	if strings.Contains(text, "secret") {
+		t.Errorf("expected the credentials to be redacted, got %q", text)
+	}
+
+	sample, _ := NewSampler(SampleConfig{}).Sample(FromAgent, []byte("Set-Cookie: a=b\r\n"))
+	if sample.Hex != "5365742d436f6f6b69653a2a2a2a2a0d0a" {
+		t.Errorf("expected the hex of the redacted data, got %s", sample.Hex)
+	}
+}
+
+func TestSamplerCaps(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	cases := []struct {
+		name   string
+		config SampleConfig
+		// expect is the length of the samples of 3 packets sent in each direction, alternately
+		expect []int
+	}{
+		{name: "bytes", config: SampleConfig{Packets: 3, Bytes: 10, MaxBytes: 1000}, expect: []int{10, 10, 10, 10, 10, 10}},
+		{name: "packets", config: SampleConfig{Packets: 2, Bytes: 10, MaxBytes: 1000}, expect: []int{10, 10, 10, 10}},
+		{name: "max bytes", config: SampleConfig{Packets: 3, Bytes: 40, MaxBytes: 100}, expect: []int{40, 40, 20}},
+		{name: "defaults", config: SampleConfig{}, expect: []int{64, 64, 64, 64, 64, 64}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewSampler(c.config)
+			var got []int
+			for range 3 {
+				for _, direction := range []Direction{ToAgent, FromAgent} {
+					if sample, ok := s.Sample(direction, data); ok {
+						if sample.Length != len(data) || len(sample.Text)*2 != len(sample.Hex) {
+							t.Errorf("unexpected sample %+v", sample)
+						}
+						got = append(got, len(sample.Text))
+					}
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(c.expect) {
+				t.Errorf("expected samples of %v bytes, got %v", c.expect, got)
+			}
+		})
+	}
+
+	var s *Sampler
+	if _, ok := s.Sample(ToAgent, data); ok {
+		t.Errorf("expected a nil Sampler to sample nothing")
+	}
+}
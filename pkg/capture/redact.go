@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"bytes"
+	"slices"
+)
+
+// redactedHeaders are the headers whose values are replaced by redactionByte, lowercase with the colon
+var redactedHeaders = [][]byte{
+	[]byte("authorization:"),
+	[]byte("proxy-authorization:"),
+	[]byte("cookie:"),
+	[]byte("set-cookie:"),
+}
+
+// maxRedactedHeaderSize is the length of the longest redacted header name with the colon
+const maxRedactedHeaderSize = len("proxy-authorization:")
+
+// redactionByte replaces the bytes of the redacted header values, so that the length of the data is unchanged
+const redactionByte = '*'
+
+// redactor redacts the header values of a stream split in packets, it keeps the state of the current line
+// so that a header split across packets is redacted
+type redactor struct {
+	// line is the lowercase start of the current line, up to maxRedactedHeaderSize+1 bytes
+	line []byte
+	// redacting is set until the end of the line once a redacted header name is found
+	redacting bool
+}
+
+// redact returns the data with the values of the redacted headers replaced, the data itself is not modified
+func (r *redactor) redact(data []byte) []byte {
+	out := data
+	copied := false
+	for i, b := range data {
+		if b == '\n' {
+			r.line = r.line[:0]
+			r.redacting = false
+			continue
+		}
+		if r.redacting {
+			if b != '\r' {
+				if !copied {
+					out = slices.Clone(data)
+					copied = true
+				}
+				out[i] = redactionByte
+			}
+			continue
+		}
+		// A longer line is not a redacted header, keep one more byte than the longest name to tell
+		if len(r.line) > maxRedactedHeaderSize {
+			continue
+		}
+		r.line = append(r.line, toLower(b))
+		if b == ':' && r.isRedactedHeader() {
+			r.redacting = true
+		}
+	}
+	return out
+}
+
+func (r *redactor) isRedactedHeader() bool {
+	for _, header := range redactedHeaders {
+		if bytes.Equal(r.line, header) {
+			return true
+		}
+	}
+	return false
+}
+
+func toLower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
@@ -0,0 +1,100 @@
+package capture
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+const (
+	// DefaultSamplePackets is the default number of the first packets of each direction of a connection sampled
+	DefaultSamplePackets = 4
+	// DefaultSampleBytes is the default number of the first bytes of a packet sampled
+	DefaultSampleBytes = 64
+	// DefaultSampleMaxBytes is the default number of bytes sampled from a connection
+	DefaultSampleMaxBytes = 512
+)
+
+// SampleConfig configures the payload samples of the connections
+type SampleConfig struct {
+	// Packets is the number of the first DATA packets of each direction of a connection sampled, defaults to
+	// DefaultSamplePackets
+	Packets int
+	// Bytes is the number of the first bytes of each packet sampled, defaults to DefaultSampleBytes
+	Bytes int
+	// MaxBytes caps the bytes sampled from a connection in both directions, no packet is sampled past it. Defaults
+	// to DefaultSampleMaxBytes
+	MaxBytes int
+}
+
+// Sample is the redacted prefix of the data of a packet
+type Sample struct {
+	// Length is the length of the packet data, the sample has up to SampleConfig.Bytes of it
+	Length int
+	// Hex is the hex encoding of the sample
+	Hex string
+	// Text is the sample with the bytes that aren't printable ASCII replaced by '.'
+	Text string
+}
+
+// Sampler samples the data of the first packets of a connection for debugging, e.g. data corruption, it's safe for
+// concurrent use. The Authorization and Cookie header values are redacted from the samples. The methods of a nil
+// Sampler do nothing, so that sampling has no overhead when it's disabled
+type Sampler struct {
+	mu        sync.Mutex
+	config    SampleConfig
+	packets   map[Direction]int
+	redactors map[Direction]*redactor
+	sampled   int
+}
+
+// NewSampler creates the sampler of a connection
+func NewSampler(config SampleConfig) *Sampler {
+	if config.Packets <= 0 {
+		config.Packets = DefaultSamplePackets
+	}
+	if config.Bytes <= 0 {
+		config.Bytes = DefaultSampleBytes
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultSampleMaxBytes
+	}
+	return &Sampler{
+		config:    config,
+		packets:   map[Direction]int{},
+		redactors: map[Direction]*redactor{ToAgent: {}, FromAgent: {}},
+	}
+}
+
+// Sample returns the sample of the data of a DATA packet sent in the direction, false once the first packets of
+// the direction or the bytes of the connection were sampled
+func (s *Sampler) Sample(direction Direction, data []byte) (Sample, bool) {
+	if s == nil || len(data) == 0 {
+		return Sample{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.redactors[direction]
+	if !ok || s.packets[direction] >= s.config.Packets || s.sampled >= s.config.MaxBytes {
+		return Sample{}, false
+	}
+	s.packets[direction]++
+
+	// The whole data is scanned so that a header split across packets is redacted
+	redacted := r.redact(data)
+	size := min(len(redacted), s.config.Bytes, s.config.MaxBytes-s.sampled)
+	s.sampled += size
+	return Sample{Length: len(data), Hex: hex.EncodeToString(redacted[:size]), Text: printable(redacted[:size])}, true
+}
+
+// printable returns the data with the bytes that aren't printable ASCII replaced by '.'
+func printable(data []byte) string {
+	text := make([]byte, len(data))
+	for i, b := range data {
+		if b < ' ' || b > '~' {
+			b = '.'
+		}
+		text[i] = b
+	}
+	return string(text)
+}
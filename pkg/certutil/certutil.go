@@ -0,0 +1,254 @@
+// Package certutil generates CA, server and client certificates, e.g. for testing the tunnel with TLS.
+// The certificates are intended for testing only, DO NOT use them in production.
+package certutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// KeyAlgorithm is the algorithm of the private keys of the certificates
+type KeyAlgorithm string
+
+const (
+	RSA2048  KeyAlgorithm = "rsa2048"
+	ECDSA256 KeyAlgorithm = "ecdsa256"
+	ECDSA384 KeyAlgorithm = "ecdsa384"
+)
+
+// DefaultValidity is the validity of the certificates if Options.Validity is not set
+const DefaultValidity = 24 * time.Hour
+
+// Options configures the CA and the certificates it issues
+type Options struct {
+	// KeyAlgorithm of the CA and issued keys, defaults to ECDSA256
+	KeyAlgorithm KeyAlgorithm
+	// Validity of the CA and issued certificates, defaults to DefaultValidity
+	Validity time.Duration
+	// Organization of the subjects of the certificates
+	Organization string
+	// CommonName of the CA
+	CommonName string
+}
+
+// KeyPair is a certificate with its private key
+type KeyPair struct {
+	Cert *x509.Certificate
+	Key  crypto.PrivateKey
+	// CertPEM and KeyPEM are the PEM encoded certificate and key, the key is in PKCS #1 form for RSA and SEC 1 form for ECDSA
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// TLSCertificate returns the key pair as a tls.Certificate
+func (kp *KeyPair) TLSCertificate() (tls.Certificate, error) {
+	return tls.X509KeyPair(kp.CertPEM, kp.KeyPEM)
+}
+
+// CA is a self-signed certificate authority issuing server and client certificates
+type CA struct {
+	KeyPair
+
+	opts        Options
+	generateKey keyGenerator
+}
+
+// NewCA generates a self-signed CA
+func NewCA(opts Options) (*CA, error) {
+	generateKey, err := newKeyGenerator(opts.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Validity < 0 {
+		return nil, fmt.Errorf("validity must not be negative, got %v", opts.Validity)
+	}
+	if opts.Validity == 0 {
+		opts.Validity = DefaultValidity
+	}
+	if opts.CommonName == "" {
+		opts.CommonName = "MultiClusterTunnel Test CA"
+	}
+	if opts.Organization == "" {
+		opts.Organization = "MultiClusterTunnel Test"
+	}
+
+	ca := &CA{opts: opts, generateKey: generateKey}
+	template := ca.newTemplate(opts.CommonName)
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	template.BasicConstraintsValid = true
+
+	kp, err := ca.issue(template, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA certificate: %w", err)
+	}
+	ca.KeyPair = *kp
+	return ca, nil
+}
+
+// CertPool returns a pool with the CA certificate, e.g. for tls.Config.RootCAs and ClientCAs
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// IssueServer issues a server certificate for the SANs, IP addresses are added as IP SANs and other names as DNS SANs.
+// The first SAN is the common name of the certificate.
+func (ca *CA) IssueServer(sans ...string) (*KeyPair, error) {
+	if len(sans) == 0 {
+		return nil, fmt.Errorf("server certificate requires at least one SAN")
+	}
+
+	template := ca.newTemplate(sans[0])
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	kp, err := ca.issue(template, &ca.KeyPair)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue server certificate: %w", err)
+	}
+	return kp, nil
+}
+
+// IssueClient issues a client certificate with the common name
+func (ca *CA) IssueClient(cn string) (*KeyPair, error) {
+	if cn == "" {
+		return nil, fmt.Errorf("client certificate requires a common name")
+	}
+
+	template := ca.newTemplate(cn)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	kp, err := ca.issue(template, &ca.KeyPair)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue client certificate: %w", err)
+	}
+	return kp, nil
+}
+
+// newTemplate returns a certificate template with a random serial number valid for the validity of the CA
+func (ca *CA) newTemplate(cn string) *x509.Certificate {
+	// The serial number is unique as long as the random 128 bits are
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(fmt.Sprintf("failed to generate serial number: %v", err))
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{ca.opts.Organization},
+			CommonName:   cn,
+		},
+		// Tolerate clock skew between the hosts
+		NotBefore: now.Add(-time.Minute),
+		NotAfter:  now.Add(ca.opts.Validity),
+	}
+}
+
+// issue generates a key and signs the certificate with the parent, the certificate is self-signed if parent is nil
+func (ca *CA) issue(template *x509.Certificate, parent *KeyPair) (*KeyPair, error) {
+	key, publicKey, err := ca.generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	parentCert, signer := template, key
+	if parent != nil {
+		parentCert, signer = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, publicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := EncodeKeyToPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  keyPEM,
+	}, nil
+}
+
+// keyGenerator generates a private key and returns it with its public key
+type keyGenerator func() (crypto.PrivateKey, crypto.PublicKey, error)
+
+// newKeyGenerator returns the key generator for the algorithm
+func newKeyGenerator(algorithm KeyAlgorithm) (keyGenerator, error) {
+	switch algorithm {
+	case RSA2048:
+		return func() (crypto.PrivateKey, crypto.PublicKey, error) {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				return nil, nil, err
+			}
+			return key, &key.PublicKey, nil
+		}, nil
+	case ECDSA256, "":
+		return ecdsaKeyGenerator(elliptic.P256()), nil
+	case ECDSA384:
+		return ecdsaKeyGenerator(elliptic.P384()), nil
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q, must be one of: %s, %s, %s", algorithm, RSA2048, ECDSA256, ECDSA384)
+	}
+}
+
+// ecdsaKeyGenerator returns a key generator for ECDSA keys on the curve
+func ecdsaKeyGenerator(curve elliptic.Curve) keyGenerator {
+	return func() (crypto.PrivateKey, crypto.PublicKey, error) {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	}
+}
+
+// EncodeKeyToPEM encodes a private key to PEM format, RSA keys in PKCS #1 and ECDSA keys in SEC 1 form
+func EncodeKeyToPEM(key crypto.PrivateKey) ([]byte, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ECDSA private key: %w", err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return pem.EncodeToMemory(block), nil
+}
@@ -0,0 +1,157 @@
+package certutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIssueServerAndClient(t *testing.T) {
+	cases := []struct {
+		name         string
+		opts         Options
+		expectKey    func(key any) bool
+		expectErr    bool
+		expectExpiry time.Duration
+	}{
+		{
+			name:         "default",
+			expectKey:    func(key any) bool { _, ok := key.(*ecdsa.PrivateKey); return ok },
+			expectExpiry: DefaultValidity,
+		},
+		{
+			name:         "rsa with validity",
+			opts:         Options{KeyAlgorithm: RSA2048, Validity: time.Hour},
+			expectKey:    func(key any) bool { _, ok := key.(*rsa.PrivateKey); return ok },
+			expectExpiry: time.Hour,
+		},
+		{
+			name:         "ecdsa384",
+			opts:         Options{KeyAlgorithm: ECDSA384},
+			expectKey:    func(key any) bool { k, ok := key.(*ecdsa.PrivateKey); return ok && k.Curve.Params().BitSize == 384 },
+			expectExpiry: DefaultValidity,
+		},
+		{name: "unknown algorithm", opts: Options{KeyAlgorithm: "dsa"}, expectErr: true},
+		{name: "negative validity", opts: Options{Validity: -time.Hour}, expectErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ca, err := NewCA(c.opts)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create CA: %v", err)
+			}
+			if !ca.Cert.IsCA || !c.expectKey(ca.Key) {
+				t.Errorf("unexpected CA certificate: IsCA=%v key=%T", ca.Cert.IsCA, ca.Key)
+			}
+
+			server, err := ca.IssueServer("my-svc.my-ns.svc", "localhost", "127.0.0.1", "::1")
+			if err != nil {
+				t.Fatalf("failed to issue server certificate: %v", err)
+			}
+			if !c.expectKey(server.Key) {
+				t.Errorf("unexpected server key %T", server.Key)
+			}
+			if len(server.Cert.DNSNames) != 2 || len(server.Cert.IPAddresses) != 2 {
+				t.Errorf("unexpected SANs: DNS=%v IP=%v", server.Cert.DNSNames, server.Cert.IPAddresses)
+			}
+			if expiry := server.Cert.NotAfter.Sub(time.Now()); expiry > c.expectExpiry || expiry < c.expectExpiry-time.Minute {
+				t.Errorf("expected the certificate to expire in %v, got %v", c.expectExpiry, expiry)
+			}
+			for _, name := range []string{"my-svc.my-ns.svc", "localhost", "127.0.0.1"} {
+				_, err := server.Cert.Verify(x509.VerifyOptions{DNSName: name, Roots: ca.CertPool()})
+				if err != nil {
+					t.Errorf("failed to verify server certificate for %s: %v", name, err)
+				}
+			}
+
+			client, err := ca.IssueClient("my-client")
+			if err != nil {
+				t.Fatalf("failed to issue client certificate: %v", err)
+			}
+			_, err = client.Cert.Verify(x509.VerifyOptions{
+				Roots:     ca.CertPool(),
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err != nil {
+				t.Errorf("failed to verify client certificate: %v", err)
+			}
+			if client.Cert.Subject.CommonName != "my-client" {
+				t.Errorf("expected common name my-client, got %s", client.Cert.Subject.CommonName)
+			}
+			if server.Cert.SerialNumber.Cmp(client.Cert.SerialNumber) == 0 {
+				t.Errorf("expected unique serial numbers")
+			}
+		})
+	}
+}
+
+func TestMutualTLSHandshake(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	server, err := ca.IssueServer("localhost")
+	if err != nil {
+		t.Fatalf("failed to issue server certificate: %v", err)
+	}
+	client, err := ca.IssueClient("my-client")
+	if err != nil {
+		t.Fatalf("failed to issue client certificate: %v", err)
+	}
+	serverCert, err := server.TLSCertificate()
+	if err != nil {
+		t.Fatalf("failed to load server key pair: %v", err)
+	}
+	clientCert, err := client.TLSCertificate()
+	if err != nil {
+		t.Fatalf("failed to load client key pair: %v", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    ca.CertPool(),
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}).Handshake()
+	}()
+	err = tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      ca.CertPool(),
+		ServerName:   "localhost",
+	}).Handshake()
+	if err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+}
+
+func TestIssueInvalid(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	if _, err := ca.IssueServer(); err == nil {
+		t.Errorf("expected an error without SANs")
+	}
+	if _, err := ca.IssueClient(""); err == nil {
+		t.Errorf("expected an error without common name")
+	}
+}
@@ -0,0 +1,106 @@
+// Package coalesce batches the small writes read from a connection into fewer packets, like Nagle's algorithm.
+//
+// Interactive sessions, e.g. kubectl exec, write a keystroke at a time, and each read from the connection is sent
+// as a packet of its own, with its protobuf and gRPC framing. A Buffer sends the data read once the connection was
+// quiet for Config.Delay at once, so that a single keystroke isn't delayed, and buffers the data read within Delay
+// of the last packet for up to Delay, or until Config.MaxBytes are buffered, to send it in a single packet.
+package coalesce
+
+import (
+	"bytes"
+	"time"
+)
+
+// DefaultMaxBytes is the default data buffered before it's sent without waiting for the delay
+const DefaultMaxBytes = 16 * 1024 // 16KB
+
+// Config enables coalescing the small writes of the connections
+type Config struct {
+	// Delay is how long the data is buffered at most, 0 disables coalescing
+	Delay time.Duration
+	// MaxBytes is the data buffered before it's sent without waiting for Delay. Default: DefaultMaxBytes
+	MaxBytes int
+}
+
+// Buffer coalesces the data read from a connection, it's used by the goroutine reading the connection. A nil
+// Buffer sends the data at once
+type Buffer struct {
+	delay    time.Duration
+	maxBytes int
+
+	pending []byte
+	// deadline is when the pending data is sent
+	deadline time.Time
+	// lastSent is when data was last returned to be sent
+	lastSent time.Time
+}
+
+// NewBuffer returns the Buffer of a connection, nil if config is nil or its Delay is 0
+func NewBuffer(config *Config) *Buffer {
+	if config == nil || config.Delay <= 0 {
+		return nil
+	}
+	maxBytes := config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &Buffer{delay: config.Delay, maxBytes: maxBytes}
+}
+
+// Add returns the data to send now: a copy of data if nothing was sent within the delay, or the buffered data once
+// it holds MaxBytes. It returns nil if the data is buffered, it's returned by Due or Flush then
+func (b *Buffer) Add(data []byte, now time.Time) []byte {
+	if b == nil {
+		return bytes.Clone(data)
+	}
+	if len(b.pending) == 0 && now.Sub(b.lastSent) >= b.delay {
+		b.lastSent = now
+		return bytes.Clone(data)
+	}
+
+	if len(b.pending) == 0 {
+		b.deadline = now.Add(b.delay)
+	}
+	b.pending = append(b.pending, data...)
+	if len(b.pending) >= b.maxBytes {
+		return b.Flush(now)
+	}
+	return nil
+}
+
+// Deadline returns when the buffered data is due, false if no data is buffered
+func (b *Buffer) Deadline() (time.Time, bool) {
+	if b == nil || len(b.pending) == 0 {
+		return time.Time{}, false
+	}
+	return b.deadline, true
+}
+
+// Due returns the buffered data once its deadline passed, nil otherwise
+func (b *Buffer) Due(now time.Time) []byte {
+	if deadline, ok := b.Deadline(); !ok || now.Before(deadline) {
+		return nil
+	}
+	return b.Flush(now)
+}
+
+// Flush returns the buffered data, nil if there is none. The data is flushed before the connection ends, so that
+// it's sent before the packets closing it
+func (b *Buffer) Flush(now time.Time) []byte {
+	if b == nil || len(b.pending) == 0 {
+		return nil
+	}
+	data := b.pending
+	b.pending = nil
+	b.lastSent = now
+	return data
+}
+
+// ReadDeadline returns the read deadline of the connection, deadline or the deadline of the buffered data if it's
+// earlier
+func (b *Buffer) ReadDeadline(deadline time.Time) time.Time {
+	if due, ok := b.Deadline(); ok && due.Before(deadline) {
+		return due
+	}
+	return deadline
+}
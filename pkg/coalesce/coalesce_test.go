@@ -0,0 +1,117 @@
+package coalesce
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestNewBuffer(t *testing.T) {
+	if NewBuffer(nil) != nil || NewBuffer(&Config{}) != nil {
+		t.Errorf("expected no buffer without a delay")
+	}
+	if b := NewBuffer(&Config{Delay: time.Millisecond}); b == nil || b.maxBytes != DefaultMaxBytes {
+		t.Errorf("expected a buffer of DefaultMaxBytes, got %+v", b)
+	}
+
+	// A nil buffer sends the data at once
+	var b *Buffer
+	data := []byte("a")
+	sent := b.Add(data, time.Now())
+	if string(sent) != "a" || &sent[0] == &data[0] {
+		t.Errorf("expected a copy of the data, got %q", sent)
+	}
+	if _, ok := b.Deadline(); ok || b.Flush(time.Now()) != nil {
+		t.Errorf("expected no buffered data")
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	const delay = 2 * time.Millisecond
+	b := NewBuffer(&Config{Delay: delay, MaxBytes: 4})
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// The first keystroke is sent at once, the next ones within the delay are buffered
+	if sent := b.Add([]byte("a"), at(0)); string(sent) != "a" {
+		t.Fatalf("expected the first write to be sent at once, got %q", sent)
+	}
+	if sent := b.Add([]byte("b"), at(500*time.Microsecond)); sent != nil {
+		t.Fatalf("expected the write within the delay to be buffered, got %q", sent)
+	}
+	if sent := b.Add([]byte("c"), at(time.Millisecond)); sent != nil {
+		t.Fatalf("expected the write within the delay to be buffered, got %q", sent)
+	}
+	if deadline, ok := b.Deadline(); !ok || !deadline.Equal(at(500*time.Microsecond+delay)) {
+		t.Fatalf("expected the buffered data to be due a delay after it was buffered, got %v", deadline)
+	}
+	if got := b.ReadDeadline(at(time.Second)); !got.Equal(at(500*time.Microsecond + delay)) {
+		t.Errorf("expected the read deadline of the buffered data, got %v", got)
+	}
+	if got := b.ReadDeadline(at(time.Millisecond)); !got.Equal(at(time.Millisecond)) {
+		t.Errorf("expected the earlier read deadline, got %v", got)
+	}
+	if sent := b.Due(at(2 * time.Millisecond)); sent != nil {
+		t.Fatalf("expected the data not to be due yet, got %q", sent)
+	}
+	if sent := b.Due(at(3 * time.Millisecond)); string(sent) != "bc" {
+		t.Fatalf("expected the buffered data once due, got %q", sent)
+	}
+	if _, ok := b.Deadline(); ok {
+		t.Errorf("expected no buffered data")
+	}
+
+	// The data is sent without waiting for the delay once MaxBytes are buffered
+	if sent := b.Add([]byte("de"), at(4*time.Millisecond)); sent != nil {
+		t.Fatalf("expected the write within the delay of the last packet to be buffered, got %q", sent)
+	}
+	if sent := b.Add([]byte("fg"), at(4*time.Millisecond)); string(sent) != "defg" {
+		t.Fatalf("expected MaxBytes to be sent, got %q", sent)
+	}
+
+	// The buffered data is flushed before the connection ends
+	b.Add([]byte("h"), at(5*time.Millisecond))
+	if sent := b.Flush(at(5 * time.Millisecond)); string(sent) != "h" {
+		t.Fatalf("expected the buffered data to be flushed, got %q", sent)
+	}
+
+	// A keystroke after the connection was quiet for the delay is sent at once
+	if sent := b.Add([]byte("i"), at(10*time.Millisecond)); string(sent) != "i" {
+		t.Fatalf("expected the write after a quiet delay to be sent at once, got %q", sent)
+	}
+}
+
+func TestBufferKeepsOrder(t *testing.T) {
+	b := NewBuffer(&Config{Delay: time.Millisecond, MaxBytes: 64})
+	now := time.Now()
+	var written, sent []byte
+	writes, packets := 0, 0
+	for i := range 10000 {
+		data := make([]byte, 1+rand.IntN(16))
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		written = append(written, data...)
+		writes++
+
+		now = now.Add(time.Duration(rand.IntN(300)) * time.Microsecond)
+		for _, packet := range [][]byte{b.Due(now), b.Add(data, now)} {
+			if packet != nil {
+				sent = append(sent, packet...)
+				packets++
+			}
+		}
+	}
+	if packet := b.Flush(now); packet != nil {
+		sent = append(sent, packet...)
+		packets++
+	}
+
+	if !bytes.Equal(sent, written) {
+		t.Fatalf("expected the data to be sent in order")
+	}
+	if packets >= writes/2 {
+		t.Errorf("expected the writes to be coalesced, got %d packets for %d writes", packets, writes)
+	}
+}
@@ -0,0 +1,417 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+)
+
+// AgentConfig is the config file of the agent binary, e.g.
+//
+//	apiVersion: multiclustertunnel.io/v1alpha1
+//	kind: AgentConfig
+//	hubAddress: hub.example.com:8443
+//	clusterName: cluster1
+//	tls:
+//	  caFile: /etc/mctunnel/hub-ca.crt
+//	auth:
+//	  hubKubeConfig: /etc/mctunnel/hub-kubeconfig
+type AgentConfig struct {
+	TypeMeta `json:",inline"`
+
+	HubAddress    string   `json:"hubAddress"`
+	ClusterName   string   `json:"clusterName"`
+	UDSSocketPath string   `json:"udsSocketPath"`
+	TLS           AgentTLS `json:"tls"`
+	// UDSSocketPermissions are the permissions of the socket files of the proxies, in octal, e.g. 0660. Defaults to
+	// agent.DefaultUDSSocketPermissions
+	UDSSocketPermissions os.FileMode `json:"udsSocketPermissions,omitempty"`
+	// UDSSocketOwnership changes the owner and the group of the socket files of the proxies, it requires root or
+	// CAP_CHOWN, see agent.Config.UDSSocketOwnership
+	UDSSocketOwnership *UDSSocketOwnership `json:"udsSocketOwnership,omitempty"`
+	// UseAbstractNamespace binds the sockets of the proxies in the Linux abstract namespace, they have no file then
+	// and udsSocketPermissions and udsSocketOwnership don't apply, see agent.Config.UseAbstractNamespace
+	UseAbstractNamespace bool `json:"useAbstractNamespace,omitempty"`
+	// GRPCAuthority overrides the authority of the gRPC calls to the hub, the certificate of the hub is still verified
+	// for tls.serverName or the host of hubAddress
+	GRPCAuthority string `json:"grpcAuthority,omitempty"`
+	// RequireTLS refuses to connect to the hub without TLS, it can't be set with tls.insecure, see
+	// agent.Config.RequireTLS
+	RequireTLS bool `json:"requireTLS,omitempty"`
+	// KeepAlive configures the gRPC keepalive pings to the hub, they're sent without active streams too
+	KeepAlive      KeepAlive `json:"keepAlive"`
+	MaxGRPCMsgSize int       `json:"maxGRPCMsgSize"`
+	PingInterval   Duration  `json:"pingInterval"`
+	// InitialConnectTimeout makes the agent exit if the tunnel is not established in time, 0 means retry forever
+	InitialConnectTimeout Duration `json:"initialConnectTimeout"`
+	MaxConnBufferedBytes  int      `json:"maxConnBufferedBytes,omitempty"`
+	// ProxyRequestBodyTimeout bounds reading the body of a request from the proxy socket, a negative value disables it
+	ProxyRequestBodyTimeout Duration `json:"proxyRequestBodyTimeout"`
+	// ProxyResponseHeaderTimeout and ProxyRequestTimeout bound the unary requests to the target services, the
+	// streaming ones, e.g. watches, are not bounded. A negative value disables them
+	ProxyResponseHeaderTimeout Duration `json:"proxyResponseHeaderTimeout"`
+	ProxyRequestTimeout        Duration `json:"proxyRequestTimeout"`
+	// IdleConnectionTimeout closes the connections the proxies sent no data on for this long, a negative value
+	// disables it
+	IdleConnectionTimeout Duration `json:"idleConnectionTimeout"`
+	// CustomHeaders are set on every request proxied to the target services, replacing the headers of the same name
+	CustomHeaders map[string]string `json:"customHeaders,omitempty"`
+	// ReplayableNonIdempotentStatusCodes are the status codes the POST, PUT and PATCH requests are replayed once on,
+	// e.g. [408, 503] for a kube-apiserver in a rolling restart
+	ReplayableNonIdempotentStatusCodes []int `json:"replayableNonIdempotentStatusCodes,omitempty"`
+	// QoS prioritizes the interactive connections over the bulk transfers on the tunnel, disabled if not set
+	QoS *QoS `json:"qos,omitempty"`
+	// Coalesce sends the small writes of the target services to the hub in fewer packets, disabled if not set
+	Coalesce *Coalesce `json:"coalesce,omitempty"`
+	// ResumeWindow resumes the connections when the agent reconnects in time to a hub resuming them too,
+	// 0 disables it
+	ResumeWindow           Duration  `json:"resumeWindow"`
+	ResumeMaxBufferedBytes int       `json:"resumeMaxBufferedBytes,omitempty"`
+	EnableIntegrityCheck   bool      `json:"enableIntegrityCheck,omitempty"`
+	Auth                   AgentAuth `json:"auth"`
+	Logging                Logging   `json:"logging"`
+	// MetricsAddress serves the Prometheus metrics, the status of the agent on /status and its open connections on
+	// /debug/connections, e.g. ":9090", disabled if empty
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	// ReadyFile is created once the tunnel to the hub is established, for startup/readiness probes
+	ReadyFile string `json:"readyFile,omitempty"`
+	// Services configures the routing of the proxy-service paths to the services of the managed cluster
+	Services AgentServices `json:"services"`
+}
+
+// AgentTLS configures the TLS connection to the hub
+type AgentTLS struct {
+	// Insecure disables TLS, for testing only
+	Insecure bool `json:"insecure,omitempty"`
+	// CAFile verifies the certificate of the hub, the system roots are used if empty
+	CAFile string `json:"caFile,omitempty"`
+	// ServerName overrides the name the certificate of the hub is verified for
+	ServerName string `json:"serverName,omitempty"`
+	// PinnedSPKIHashes are the base64 SHA-256 of the public keys of the hub, see agent.Config.PinnedHubSPKIHashes.
+	// A certificate of the hub with a pinned key is accepted, as well as one verified by caFile if it's set
+	PinnedSPKIHashes []string `json:"pinnedSPKIHashes,omitempty"`
+	// RequireCAAndPin requires the certificate of the hub to be both pinned and verified by caFile, the system roots
+	// if it's empty
+	RequireCAAndPin bool `json:"requireCAAndPin,omitempty"`
+	// TLSFiles is the client certificate for mutual TLS (optional)
+	TLSFiles `json:",inline"`
+}
+
+// AgentAuth configures the authentication of the proxied requests, see agent.ComponentOptions
+type AgentAuth struct {
+	HubKubeConfig     string `json:"hubKubeConfig,omitempty"`
+	ManagedKubeConfig string `json:"managedKubeConfig,omitempty"`
+	DisableAuth       bool   `json:"disableAuth,omitempty"`
+	// AuthenticatedHosts are the target hosts whose requests are authenticated, agent.DefaultAuthenticatedHosts
+	// if empty
+	AuthenticatedHosts []string `json:"authenticatedHosts,omitempty"`
+	// DenyUnauthenticatedHosts rejects the requests to the other hosts instead of proxying them as is
+	DenyUnauthenticatedHosts bool `json:"denyUnauthenticatedHosts,omitempty"`
+	// HubSignatureKeyFile is the path of the key shared with the hub's http.hubSignatureKeyFile, the requests not
+	// signed by the hub are rejected. Disabled if empty
+	HubSignatureKeyFile string `json:"hubSignatureKeyFile,omitempty"`
+}
+
+// AgentServices configures the routing to the services, see agent.RouterImpl
+type AgentServices struct {
+	// DefaultScheme is the scheme of the services whose segment has none, e.g. metrics-server:443, https if empty
+	DefaultScheme string `json:"defaultScheme,omitempty"`
+	// AllowHTTP proxies the requests to the services with the http scheme, in plaintext from the agent
+	AllowHTTP bool `json:"allowHTTP,omitempty"`
+	// ServicePaths also routes the short service paths, /<cluster>/service/<namespace>/<service>/<path>, see
+	// agent.ServicePathRouter
+	ServicePaths bool `json:"servicePaths,omitempty"`
+}
+
+// reloadableAgentFields are the fields Reload applies at runtime
+var reloadableAgentFields = map[string]bool{
+	"logging.verbosity": true,
+}
+
+// NewAgentConfig returns a defaulted agent config of the current version
+func NewAgentConfig() *AgentConfig {
+	c := &AgentConfig{TypeMeta: TypeMeta{APIVersion: APIVersion, Kind: AgentConfigKind}}
+	c.Default()
+	return c
+}
+
+// LoadAgentConfig reads the agent config file at path, applies the overrides, e.g. the flags set on the command
+// line, then defaults and validates it
+func LoadAgentConfig(path string, overrides ...func(*AgentConfig)) (*AgentConfig, error) {
+	c := &AgentConfig{}
+	if err := decodeFile(path, c); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		override(c)
+	}
+	c.Default()
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Default sets the unset fields to their defaults, the apiVersion and kind of a file are never defaulted
+func (c *AgentConfig) Default() {
+	if c.HubAddress == "" {
+		c.HubAddress = "localhost:8443"
+	}
+	if c.UDSSocketPath == "" {
+		c.UDSSocketPath = "/tmp/multiclustertunnel.sock"
+	}
+	if c.KeepAlive.Time.Duration == 0 {
+		c.KeepAlive.Time.Duration = 10 * time.Second
+	}
+	if c.KeepAlive.Timeout.Duration == 0 {
+		c.KeepAlive.Timeout.Duration = 5 * time.Second
+	}
+	if c.MaxGRPCMsgSize == 0 {
+		c.MaxGRPCMsgSize = agent.DefaultMaxGRPCMsgSize
+	}
+	if c.PingInterval.Duration == 0 {
+		c.PingInterval.Duration = agent.DefaultPingInterval
+	}
+	if c.ProxyRequestBodyTimeout.Duration == 0 {
+		c.ProxyRequestBodyTimeout.Duration = agent.DefaultProxyRequestBodyTimeout
+	}
+	if c.ProxyResponseHeaderTimeout.Duration == 0 {
+		c.ProxyResponseHeaderTimeout.Duration = agent.DefaultProxyResponseHeaderTimeout
+	}
+	if c.ProxyRequestTimeout.Duration == 0 {
+		c.ProxyRequestTimeout.Duration = agent.DefaultProxyRequestTimeout
+	}
+	if c.IdleConnectionTimeout.Duration == 0 {
+		c.IdleConnectionTimeout.Duration = agent.DefaultIdleConnectionTimeout
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "text"
+	}
+}
+
+// Validate returns the errors of all the invalid fields
+func (c *AgentConfig) Validate() error {
+	errs := []error{validateTypeMeta(c.TypeMeta, AgentConfigKind)}
+	if c.HubAddress == "" {
+		errs = append(errs, errors.New("hubAddress: must be set"))
+	} else if !strings.Contains(c.HubAddress, "/") {
+		// A gRPC target with a scheme, e.g. dns:///hub.example.com:8443, isn't a host:port
+		if _, _, err := net.SplitHostPort(c.HubAddress); err != nil {
+			errs = append(errs, fmt.Errorf("hubAddress: must be a host:port, an IPv6 address in brackets, e.g. [::1]:8443: %w", err))
+		}
+	}
+	if c.ClusterName == "" {
+		errs = append(errs, errors.New("clusterName: must be set"))
+	}
+	if c.UDSSocketPath == "" {
+		errs = append(errs, errors.New("udsSocketPath: must be set"))
+	}
+	switch c.Services.DefaultScheme {
+	case "", "https":
+	case "http":
+		if !c.Services.AllowHTTP {
+			errs = append(errs, errors.New("services.defaultScheme: http requires services.allowHTTP"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("services.defaultScheme: must be one of http, https, got %q", c.Services.DefaultScheme))
+	}
+	if c.UDSSocketPermissions&^os.ModePerm != 0 {
+		errs = append(errs, errors.New("udsSocketPermissions: must only set the permission bits, e.g. 0660"))
+	}
+	if o := c.UDSSocketOwnership; o != nil && ((o.UID != nil && *o.UID < 0) || (o.GID != nil && *o.GID < 0)) {
+		errs = append(errs, errors.New("udsSocketOwnership: uid and gid must not be negative, leave them unset to keep the owner or the group"))
+	}
+	errs = append(errs, c.TLS.validate("tls"))
+	if c.TLS.Insecure && (c.TLS.CAFile != "" || c.TLS.Enabled() || len(c.TLS.PinnedSPKIHashes) > 0) {
+		errs = append(errs, errors.New("tls.insecure: can't be set with caFile, certFile, keyFile or pinnedSPKIHashes"))
+	}
+	if c.TLS.Insecure && c.RequireTLS {
+		errs = append(errs, errors.New("tls.insecure: can't be set with requireTLS"))
+	}
+	for i, pin := range c.TLS.PinnedSPKIHashes {
+		if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+			errs = append(errs, fmt.Errorf("tls.pinnedSPKIHashes[%d]: must be the base64 SHA-256 of a SubjectPublicKeyInfo, got %q", i, pin))
+		}
+	}
+	if c.TLS.RequireCAAndPin && len(c.TLS.PinnedSPKIHashes) == 0 {
+		errs = append(errs, errors.New("tls.requireCAAndPin: requires tls.pinnedSPKIHashes"))
+	}
+	errs = append(errs, c.KeepAlive.validate("keepAlive"), c.QoS.validate("qos"), c.Coalesce.validate("coalesce"))
+	if c.MaxGRPCMsgSize < 0 || c.MaxConnBufferedBytes < 0 {
+		errs = append(errs, errors.New("maxGRPCMsgSize and maxConnBufferedBytes must not be negative"))
+	}
+	if c.ResumeWindow.Duration < 0 || c.ResumeMaxBufferedBytes < 0 {
+		errs = append(errs, errors.New("resumeWindow and resumeMaxBufferedBytes must not be negative"))
+	}
+	for _, code := range c.ReplayableNonIdempotentStatusCodes {
+		if code < 400 || code > 599 {
+			errs = append(errs, fmt.Errorf("replayableNonIdempotentStatusCodes: %d is not an error status code", code))
+		}
+	}
+	if c.InitialConnectTimeout.Duration < 0 {
+		errs = append(errs, errors.New("initialConnectTimeout: must not be negative"))
+	}
+	if c.Auth.HubKubeConfig == "" && !c.Auth.DisableAuth {
+		errs = append(errs, errors.New("auth.hubKubeConfig: must be set unless auth.disableAuth is set"))
+	}
+	errs = append(errs, c.Logging.validate())
+	return errors.Join(errs...)
+}
+
+// Reload applies the fields of next that can change at runtime: the logging verbosity.
+// It returns the paths of the other fields that changed, e.g. "hubAddress", they need a restart
+func (c *AgentConfig) Reload(next *AgentConfig) (ignored []string) {
+	ignored = changedFields(c, next, reloadableAgentFields)
+	c.Logging.Verbosity = next.Logging.Verbosity
+	return ignored
+}
+
+// ToAgentConfig translates the config into an agent.Config, it reads the TLS certificates
+func (c *AgentConfig) ToAgentConfig() (*agent.Config, error) {
+	config := &agent.Config{
+		HubAddress:                         c.HubAddress,
+		ClusterName:                        c.ClusterName,
+		UDSSocketPath:                      c.UDSSocketPath,
+		UDSSocketPermissions:               c.UDSSocketPermissions,
+		UDSSocketOwnership:                 c.UDSSocketOwnership.toUDSSocketOwnership(),
+		UseAbstractNamespace:               c.UseAbstractNamespace,
+		MaxGRPCMsgSize:                     c.MaxGRPCMsgSize,
+		PingInterval:                       c.PingInterval.Duration,
+		InitialConnectTimeout:              c.InitialConnectTimeout.Duration,
+		MaxConnBufferedBytes:               c.MaxConnBufferedBytes,
+		ResumeWindow:                       c.ResumeWindow.Duration,
+		ResumeMaxBufferedBytes:             c.ResumeMaxBufferedBytes,
+		EnableIntegrityCheck:               c.EnableIntegrityCheck,
+		ProxyRequestBodyTimeout:            c.ProxyRequestBodyTimeout.Duration,
+		ProxyResponseHeaderTimeout:         c.ProxyResponseHeaderTimeout.Duration,
+		ProxyRequestTimeout:                c.ProxyRequestTimeout.Duration,
+		IdleConnectionTimeout:              c.IdleConnectionTimeout.Duration,
+		CustomHeaders:                      c.CustomHeaders,
+		ReplayableNonIdempotentStatusCodes: c.ReplayableNonIdempotentStatusCodes,
+		QoS:                                c.QoS.toQoSConfig(),
+		Coalesce:                           c.Coalesce.toCoalesceConfig(),
+		TLSServerName:                      c.TLS.ServerName,
+		GRPCAuthority:                      c.GRPCAuthority,
+		RequireTLS:                         c.RequireTLS,
+		DialOptions: []grpc.DialOption{
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                c.KeepAlive.Time.Duration,
+				Timeout:             c.KeepAlive.Timeout.Duration,
+				PermitWithoutStream: true,
+			}),
+		},
+	}
+	if c.Logging.Format == "json" {
+		config.Logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+
+	if c.TLS.Insecure {
+		config.DialOptions = append(config.DialOptions, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		return config, nil
+	}
+	tlsConfig, err := c.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" && c.GRPCAuthority != "" {
+		// The credentials verify the certificate for the authority otherwise
+		tlsConfig.ServerName = c.HubAddress
+		if host, _, err := net.SplitHostPort(c.HubAddress); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+	if len(c.TLS.PinnedSPKIHashes) > 0 {
+		// The agent builds the credentials verifying the pins
+		config.PinnedHubSPKIHashes = c.TLS.PinnedSPKIHashes
+		config.RequireHubCAAndPin = c.TLS.RequireCAAndPin
+		config.HubTLSConfig = tlsConfig
+		return config, nil
+	}
+	config.DialOptions = append(config.DialOptions, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	return config, nil
+}
+
+// HubTLSConfig returns the TLS config of the connection to the hub, nil if TLS is disabled, e.g. for
+// agent.DiagnoseConfig
+func (c *AgentConfig) HubTLSConfig() (*tls.Config, error) {
+	if c.TLS.Insecure {
+		return nil, nil
+	}
+	return c.TLS.tlsConfig()
+}
+
+// ComponentOptions returns the options of agent.BuildDefaultComponents
+func (c *AgentConfig) ComponentOptions() agent.ComponentOptions {
+	return agent.ComponentOptions{
+		HubKubeConfig:     c.Auth.HubKubeConfig,
+		ManagedKubeConfig: c.Auth.ManagedKubeConfig,
+		DisableAuth:       c.Auth.DisableAuth,
+		AuthPolicy: agent.AuthPolicy{
+			AuthenticatedHosts:       c.Auth.AuthenticatedHosts,
+			DenyUnauthenticatedHosts: c.Auth.DenyUnauthenticatedHosts,
+		},
+		HubSignatureKeyFile:  c.Auth.HubSignatureKeyFile,
+		DefaultServiceScheme: c.Services.DefaultScheme,
+		AllowHTTPServices:    c.Services.AllowHTTP,
+		ServicePaths:         c.Services.ServicePaths,
+	}
+}
+
+// tlsConfig loads the CA and the client certificate
+func (t AgentTLS) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: t.ServerName}
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.Enabled() {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client TLS certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// UDSSocketOwnership is the owner and the group of the socket files, an unset one is left unchanged
+type UDSSocketOwnership struct {
+	UID *int `json:"uid,omitempty"`
+	GID *int `json:"gid,omitempty"`
+}
+
+func (o *UDSSocketOwnership) toUDSSocketOwnership() *agent.UDSSocketOwnership {
+	if o == nil {
+		return nil
+	}
+	ownership := &agent.UDSSocketOwnership{UID: -1, GID: -1}
+	if o.UID != nil {
+		ownership.UID = *o.UID
+	}
+	if o.GID != nil {
+		ownership.GID = *o.GID
+	}
+	return ownership
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+)
+
+func TestLoadAgentConfig(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "agent.yaml", []byte(`
+apiVersion: multiclustertunnel.io/v1alpha1
+kind: AgentConfig
+hubAddress: hub.example.com:443
+clusterName: cluster1
+udsSocketPermissions: 0660
+udsSocketOwnership:
+  gid: 1000
+useAbstractNamespace: true
+tls:
+  caFile: /etc/mctunnel/hub-ca.crt
+  serverName: hub.example.com
+  pinnedSPKIHashes: [47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=]
+  requireCAAndPin: true
+grpcAuthority: tunnel.example.com
+requireTLS: true
+keepAlive:
+  timeout: 20s
+initialConnectTimeout: 2m
+proxyRequestBodyTimeout: 30s
+proxyRequestTimeout: 10m
+idleConnectionTimeout: -1s
+customHeaders:
+  X-Cluster-Name: cluster1
+replayableNonIdempotentStatusCodes: [408, 503]
+enableIntegrityCheck: true
+qos:
+  bulkThresholdBytes: 1048576
+coalesce:
+  delay: 2ms
+  maxBytes: 4096
+auth:
+  hubKubeConfig: /etc/mctunnel/hub-kubeconfig
+  authenticatedHosts: [kubernetes.default.svc, metrics.example.svc]
+  denyUnauthenticatedHosts: true
+  hubSignatureKeyFile: /etc/mctunnel/hub-signature-key
+readyFile: /tmp/ready
+services:
+  defaultScheme: http
+  allowHTTP: true
+  servicePaths: true
+`))
+
+	c, err := LoadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	expected := NewAgentConfig()
+	expected.HubAddress = "hub.example.com:443"
+	expected.ClusterName = "cluster1"
+	expected.UDSSocketPermissions = 0o660
+	gid := 1000
+	expected.UDSSocketOwnership = &UDSSocketOwnership{GID: &gid}
+	expected.UseAbstractNamespace = true
+	expected.TLS = AgentTLS{
+		CAFile:           "/etc/mctunnel/hub-ca.crt",
+		ServerName:       "hub.example.com",
+		PinnedSPKIHashes: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+		RequireCAAndPin:  true,
+	}
+	expected.GRPCAuthority = "tunnel.example.com"
+	expected.RequireTLS = true
+	expected.KeepAlive.Timeout.Duration = 20 * time.Second
+	expected.InitialConnectTimeout.Duration = 2 * time.Minute
+	expected.ProxyRequestBodyTimeout.Duration = 30 * time.Second
+	expected.ProxyRequestTimeout.Duration = 10 * time.Minute
+	expected.IdleConnectionTimeout.Duration = -time.Second
+	expected.CustomHeaders = map[string]string{"X-Cluster-Name": "cluster1"}
+	expected.ReplayableNonIdempotentStatusCodes = []int{408, 503}
+	expected.EnableIntegrityCheck = true
+	expected.QoS = &QoS{BulkThresholdBytes: 1024 * 1024}
+	expected.Coalesce = &Coalesce{Delay: Duration{2 * time.Millisecond}, MaxBytes: 4096}
+	expected.Auth.HubKubeConfig = "/etc/mctunnel/hub-kubeconfig"
+	expected.Auth.AuthenticatedHosts = []string{"kubernetes.default.svc", "metrics.example.svc"}
+	expected.Auth.DenyUnauthenticatedHosts = true
+	expected.Auth.HubSignatureKeyFile = "/etc/mctunnel/hub-signature-key"
+	expected.ReadyFile = "/tmp/ready"
+	expected.Services = AgentServices{DefaultScheme: "http", AllowHTTP: true, ServicePaths: true}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, c)
+	}
+	if options := c.ComponentOptions(); options.DefaultServiceScheme != "http" || !options.AllowHTTPServices || !options.ServicePaths {
+		t.Errorf("expected the services options, got %+v", options)
+	}
+
+	// The config written back loads to the same config
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	roundTrip, err := LoadAgentConfig(writeFile(t, t.TempDir(), "agent.yaml", data))
+	if err != nil {
+		t.Fatalf("failed to load the marshaled config: %v\n%s", err, data)
+	}
+	if !reflect.DeepEqual(roundTrip, c) {
+		t.Errorf("expected the round trip to keep %+v, got %+v", c, roundTrip)
+	}
+}
+
+func TestAgentConfigValidate(t *testing.T) {
+	cases := []struct {
+		name          string
+		modify        func(c *AgentConfig)
+		expectErrPart []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *AgentConfig) {},
+		},
+		{
+			name:          "missing cluster name",
+			modify:        func(c *AgentConfig) { c.ClusterName = "" },
+			expectErrPart: []string{"clusterName: must be set"},
+		},
+		{
+			name:          "http default scheme not allowed",
+			modify:        func(c *AgentConfig) { c.Services.DefaultScheme = "http" },
+			expectErrPart: []string{"services.defaultScheme: http requires services.allowHTTP"},
+		},
+		{
+			name:          "unsupported default scheme",
+			modify:        func(c *AgentConfig) { c.Services.DefaultScheme = "ftp" },
+			expectErrPart: []string{`services.defaultScheme: must be one of http, https, got "ftp"`},
+		},
+		{
+			name:   "IPv6 hub address",
+			modify: func(c *AgentConfig) { c.HubAddress = "[::1]:8443" },
+		},
+		{
+			name:   "gRPC target hub address",
+			modify: func(c *AgentConfig) { c.HubAddress = "dns:///hub.example.com:8443" },
+		},
+		{
+			name:          "IPv6 hub address without brackets",
+			modify:        func(c *AgentConfig) { c.HubAddress = "::1:8443" },
+			expectErrPart: []string{"hubAddress: must be a host:port, an IPv6 address in brackets"},
+		},
+		{
+			name:          "hub address without port",
+			modify:        func(c *AgentConfig) { c.HubAddress = "hub.example.com" },
+			expectErrPart: []string{"hubAddress: must be a host:port"},
+		},
+		{
+			name: "missing hub kubeconfig",
+			modify: func(c *AgentConfig) {
+				c.Auth.HubKubeConfig = ""
+			},
+			expectErrPart: []string{"auth.hubKubeConfig: must be set unless auth.disableAuth is set"},
+		},
+		{
+			name: "auth disabled",
+			modify: func(c *AgentConfig) {
+				c.Auth = AgentAuth{DisableAuth: true}
+			},
+		},
+		{
+			name: "insecure with CA",
+			modify: func(c *AgentConfig) {
+				c.TLS = AgentTLS{Insecure: true, CAFile: "ca.crt"}
+			},
+			expectErrPart: []string{"tls.insecure: can't be set with caFile"},
+		},
+		{
+			name: "invalid pinned SPKI hash",
+			modify: func(c *AgentConfig) {
+				c.TLS.PinnedSPKIHashes = []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "aGVsbG8="}
+			},
+			expectErrPart: []string{`tls.pinnedSPKIHashes[1]: must be the base64 SHA-256 of a SubjectPublicKeyInfo, got "aGVsbG8="`},
+		},
+		{
+			name: "strict pinning without pins",
+			modify: func(c *AgentConfig) {
+				c.TLS.RequireCAAndPin = true
+			},
+			expectErrPart: []string{"tls.requireCAAndPin: requires tls.pinnedSPKIHashes"},
+		},
+		{
+			name: "client key without certificate",
+			modify: func(c *AgentConfig) {
+				c.TLS.KeyFile = "tls.key"
+			},
+			expectErrPart: []string{"tls: certFile and keyFile must be set together"},
+		},
+		{
+			name: "negative durations",
+			modify: func(c *AgentConfig) {
+				c.KeepAlive.Time.Duration = -time.Second
+				c.InitialConnectTimeout.Duration = -time.Second
+			},
+			expectErrPart: []string{"keepAlive: time and timeout must not be negative", "initialConnectTimeout: must not be negative"},
+		},
+		{
+			name: "negative QoS weight",
+			modify: func(c *AgentConfig) {
+				c.QoS = &QoS{BulkWeight: -1}
+			},
+			expectErrPart: []string{"qos: weights and bulkThresholdBytes must not be negative"},
+		},
+		{
+			name: "negative coalesce delay",
+			modify: func(c *AgentConfig) {
+				c.Coalesce = &Coalesce{Delay: Duration{-time.Millisecond}}
+			},
+			expectErrPart: []string{"coalesce: delay and maxBytes must not be negative"},
+		},
+		{
+			name: "replay of a success status code",
+			modify: func(c *AgentConfig) {
+				c.ReplayableNonIdempotentStatusCodes = []int{503, 201}
+			},
+			expectErrPart: []string{"replayableNonIdempotentStatusCodes: 201 is not an error status code"},
+		},
+		{
+			name: "socket permissions with other bits",
+			modify: func(c *AgentConfig) {
+				c.UDSSocketPermissions = os.ModeSetuid | 0o660
+			},
+			expectErrPart: []string{"udsSocketPermissions: must only set the permission bits"},
+		},
+		{
+			name: "insecure with require TLS",
+			modify: func(c *AgentConfig) {
+				c.TLS.Insecure = true
+				c.RequireTLS = true
+			},
+			expectErrPart: []string{"tls.insecure: can't be set with requireTLS"},
+		},
+		{
+			name: "negative socket owner",
+			modify: func(c *AgentConfig) {
+				uid := -1
+				c.UDSSocketOwnership = &UDSSocketOwnership{UID: &uid}
+			},
+			expectErrPart: []string{"udsSocketOwnership: uid and gid must not be negative"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := NewAgentConfig()
+			config.ClusterName = "cluster1"
+			config.Auth.HubKubeConfig = "hub-kubeconfig"
+			c.modify(config)
+
+			err := config.Validate()
+			if len(c.expectErrPart) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			for _, part := range c.expectErrPart {
+				if !strings.Contains(err.Error(), part) {
+					t.Errorf("expected error containing %q, got %v", part, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAgentConfigToAgentConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile, certFile, keyFile := writeKeyPair(t, dir)
+
+	c := NewAgentConfig()
+	c.ClusterName = "cluster1"
+	c.TLS = AgentTLS{CAFile: caFile, ServerName: "hub.example.com", TLSFiles: TLSFiles{CertFile: certFile, KeyFile: keyFile}}
+	c.GRPCAuthority = "tunnel.example.com"
+	c.Auth = AgentAuth{DisableAuth: true}
+	c.Coalesce = &Coalesce{Delay: Duration{2 * time.Millisecond}, MaxBytes: 4096}
+	gid := 1000
+	c.UDSSocketOwnership = &UDSSocketOwnership{GID: &gid}
+
+	config, err := c.ToAgentConfig()
+	if err != nil {
+		t.Fatalf("failed to translate config: %v", err)
+	}
+	if config.HubAddress != "localhost:8443" || config.ClusterName != "cluster1" || config.PingInterval != agent.DefaultPingInterval {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.TLSServerName != "hub.example.com" || config.GRPCAuthority != "tunnel.example.com" {
+		t.Errorf("expected the TLS server name hub.example.com and authority tunnel.example.com, got %q and %q",
+			config.TLSServerName, config.GRPCAuthority)
+	}
+	if config.Coalesce == nil || config.Coalesce.Delay != 2*time.Millisecond || config.Coalesce.MaxBytes != 4096 {
+		t.Errorf("expected a coalesce delay of 2ms up to 4096 bytes, got %+v", config.Coalesce)
+	}
+	if o := config.UDSSocketOwnership; o == nil || o.UID != -1 || o.GID != 1000 {
+		t.Errorf("expected the socket files to keep their owner and get the group 1000, got %+v", o)
+	}
+	// The keepalive and the transport credentials
+	if len(config.DialOptions) != 2 {
+		t.Errorf("expected 2 dial options, got %d", len(config.DialOptions))
+	}
+	if options := c.ComponentOptions(); !options.DisableAuth {
+		t.Errorf("unexpected component options %+v", options)
+	}
+
+	// The agent builds the credentials verifying the pinned keys from the TLS config
+	c.TLS.PinnedSPKIHashes = []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	c.TLS.RequireCAAndPin = true
+	config, err = c.ToAgentConfig()
+	if err != nil {
+		t.Fatalf("failed to translate config: %v", err)
+	}
+	if len(config.DialOptions) != 1 || !reflect.DeepEqual(config.PinnedHubSPKIHashes, c.TLS.PinnedSPKIHashes) || !config.RequireHubCAAndPin {
+		t.Errorf("expected the pinned keys instead of the transport credentials, got %+v", config)
+	}
+	if config.HubTLSConfig == nil || config.HubTLSConfig.RootCAs == nil || config.HubTLSConfig.ServerName != "hub.example.com" ||
+		len(config.HubTLSConfig.Certificates) != 1 {
+		t.Errorf("expected the hub TLS config with the CA, the server name and the client certificate, got %+v", config.HubTLSConfig)
+	}
+
+	c.TLS.CAFile = keyFile
+	if _, err := c.ToAgentConfig(); err == nil || !strings.Contains(err.Error(), "no certificates found") {
+		t.Errorf("expected an error loading the invalid CA, got %v", err)
+	}
+}
+
+func TestAgentConfigReload(t *testing.T) {
+	c := NewAgentConfig()
+	next := NewAgentConfig()
+	next.Logging.Verbosity = 3
+	next.ClusterName = "cluster2"
+
+	ignored := c.Reload(next)
+	if !reflect.DeepEqual(ignored, []string{"clusterName"}) {
+		t.Errorf("expected clusterName to be ignored, got %v", ignored)
+	}
+	if c.Logging.Verbosity != 3 || c.ClusterName != "" {
+		t.Errorf("expected only the verbosity to be applied, got %+v", c)
+	}
+}
@@ -0,0 +1,239 @@
+// Package config loads the YAML config files of the server and agent binaries, e.g. mounted from a ConfigMap
+// by a Helm chart.
+//
+// The files are versioned by their apiVersion and kind, decoded strictly so that a typo in a field name is an
+// error rather than silently ignored, defaulted and validated. ServerConfig and AgentConfig translate into
+// server.Config and agent.Config. The fields that can change at runtime are applied by Reload, e.g. on SIGHUP.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+)
+
+// APIVersion is the version of the config file schema
+const APIVersion = "multiclustertunnel.io/v1alpha1"
+
+const (
+	// ServerConfigKind is the kind of the config file of the server
+	ServerConfigKind = "ServerConfig"
+	// AgentConfigKind is the kind of the config file of the agent
+	AgentConfigKind = "AgentConfig"
+)
+
+// TypeMeta identifies the schema of a config file
+type TypeMeta struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+// Duration is a time.Duration written as a string in the config files, e.g. "30s"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON parses a duration string, e.g. "1m30s"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string, e.g. \"30s\": %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// TLSFiles are the paths of a PEM certificate and its private key
+type TLSFiles struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// Enabled returns whether the certificate is configured
+func (t TLSFiles) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+func (t TLSFiles) validate(field string) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("%s: certFile and keyFile must be set together", field)
+	}
+	return nil
+}
+
+// KeepAlive configures the gRPC keepalive pings
+type KeepAlive struct {
+	// Time is the interval of the pings
+	Time Duration `json:"time"`
+	// Timeout is the time to wait for the ack of a ping before the connection is closed
+	Timeout Duration `json:"timeout"`
+}
+
+func (k KeepAlive) validate(field string) error {
+	if k.Time.Duration < 0 || k.Timeout.Duration < 0 {
+		return fmt.Errorf("%s: time and timeout must not be negative", field)
+	}
+	return nil
+}
+
+// QoS prioritizes the interactive connections of the tunnels over the bulk transfers, see qos.Config for the
+// semantics and the defaults of the fields
+type QoS struct {
+	InteractiveWeight  int   `json:"interactiveWeight,omitempty"`
+	BulkWeight         int   `json:"bulkWeight,omitempty"`
+	BulkThresholdBytes int64 `json:"bulkThresholdBytes,omitempty"`
+}
+
+func (q *QoS) validate(field string) error {
+	if q != nil && (q.InteractiveWeight < 0 || q.BulkWeight < 0 || q.BulkThresholdBytes < 0) {
+		return fmt.Errorf("%s: weights and bulkThresholdBytes must not be negative", field)
+	}
+	return nil
+}
+
+// toQoSConfig returns the qos.Config, nil disables QoS
+func (q *QoS) toQoSConfig() *qos.Config {
+	if q == nil {
+		return nil
+	}
+	return &qos.Config{
+		InteractiveWeight: q.InteractiveWeight,
+		BulkWeight:        q.BulkWeight,
+		BulkThreshold:     q.BulkThresholdBytes,
+	}
+}
+
+// Coalesce sends the small writes of the connections in fewer packets, see coalesce.Config for the semantics and
+// the defaults of the fields
+type Coalesce struct {
+	Delay    Duration `json:"delay"`
+	MaxBytes int      `json:"maxBytes,omitempty"`
+}
+
+func (c *Coalesce) validate(field string) error {
+	if c != nil && (c.Delay.Duration < 0 || c.MaxBytes < 0) {
+		return fmt.Errorf("%s: delay and maxBytes must not be negative", field)
+	}
+	return nil
+}
+
+// toCoalesceConfig returns the coalesce.Config, nil disables coalescing
+func (c *Coalesce) toCoalesceConfig() *coalesce.Config {
+	if c == nil {
+		return nil
+	}
+	return &coalesce.Config{Delay: c.Delay.Duration, MaxBytes: c.MaxBytes}
+}
+
+// Logging configures the logs, Verbosity can change at runtime
+type Logging struct {
+	// Format is the log format of the tunnel hot path, one of: text, json
+	Format string `json:"format"`
+	// Verbosity is the klog verbosity, i.e. -v
+	Verbosity int `json:"verbosity"`
+}
+
+func (l Logging) validate() error {
+	var errs []error
+	if l.Format != "text" && l.Format != "json" {
+		errs = append(errs, fmt.Errorf("logging.format: must be one of text, json, got %q", l.Format))
+	}
+	if l.Verbosity < 0 {
+		errs = append(errs, fmt.Errorf("logging.verbosity: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// decodeFile reads the config file at path into out, unknown fields are rejected
+func decodeFile(path string, out any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := decode(data, out); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// decode decodes the YAML data into out, unknown and duplicate fields are rejected
+func decode(data []byte, out any) error {
+	return yaml.UnmarshalStrict(data, out)
+}
+
+// validateTypeMeta checks that the file is of the supported version of kind
+func validateTypeMeta(meta TypeMeta, kind string) error {
+	var errs []error
+	if meta.APIVersion != APIVersion {
+		errs = append(errs, fmt.Errorf("apiVersion: must be %s, got %q", APIVersion, meta.APIVersion))
+	}
+	if meta.Kind != kind {
+		errs = append(errs, fmt.Errorf("kind: must be %s, got %q", kind, meta.Kind))
+	}
+	return errors.Join(errs...)
+}
+
+// changedFields returns the paths of the fields that differ between old and next, e.g. "grpc.address",
+// except the reloadable ones
+func changedFields(old, next any, reloadable map[string]bool) []string {
+	var changed []string
+	var walk func(path string, a, b any)
+	walk = func(path string, a, b any) {
+		am, aok := a.(map[string]any)
+		bm, bok := b.(map[string]any)
+		if !aok || !bok {
+			if !reloadable[path] && !reflect.DeepEqual(a, b) {
+				changed = append(changed, path)
+			}
+			return
+		}
+		keys := make(map[string]bool)
+		for k := range am {
+			keys[k] = true
+		}
+		for k := range bm {
+			keys[k] = true
+		}
+		for k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			walk(child, am[k], bm[k])
+		}
+	}
+	walk("", toMap(old), toMap(next))
+	sort.Strings(changed)
+	return changed
+}
+
+// toMap converts a config to its generic JSON representation
+func toMap(v any) map[string]any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,465 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/hubsig"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server/middleware"
+)
+
+// ServerConfig is the config file of the server binary, e.g.
+//
+//	apiVersion: multiclustertunnel.io/v1alpha1
+//	kind: ServerConfig
+//	grpc:
+//	  address: ":8443"
+//	  tls:
+//	    certFile: /etc/mctunnel/tls/tls.crt
+//	    keyFile: /etc/mctunnel/tls/tls.key
+//	tunnel:
+//	  slowStartWindow: 1m
+//	rateLimit:
+//	  clusterNameQPS: 100
+type ServerConfig struct {
+	TypeMeta `json:",inline"`
+
+	GRPC      ServerGRPC      `json:"grpc"`
+	HTTP      ServerHTTP      `json:"http"`
+	Tunnel    ServerTunnel    `json:"tunnel"`
+	RateLimit ServerRateLimit `json:"rateLimit"`
+	Capture   ServerCapture   `json:"capture"`
+	// Mirror mirrors a share of the requests to a cluster to another cluster, disabled if not set
+	Mirror  *ServerMirror `json:"mirror,omitempty"`
+	Logging Logging       `json:"logging"`
+	// MetricsAddress serves the Prometheus metrics, e.g. ":9090", disabled if empty
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	// ListenNetwork is the network of the listeners, tcp4 or tcp6 to only listen on IPv4 or IPv6, defaults to tcp
+	ListenNetwork string `json:"listenNetwork,omitempty"`
+	// RequireTLS refuses to start unless grpc.tls and http.tls are set, see server.Config.RequireTLS
+	RequireTLS bool `json:"requireTLS,omitempty"`
+	// MinTLSVersion is the lowest TLS version the listeners accept with requireTLS, one of 1.0, 1.1, 1.2, 1.3,
+	// defaults to 1.2
+	MinTLSVersion string `json:"minTLSVersion,omitempty"`
+}
+
+// ServerGRPC configures the gRPC server the agents connect to
+type ServerGRPC struct {
+	Address        string    `json:"address"`
+	TLS            TLSFiles  `json:"tls"`
+	KeepAlive      KeepAlive `json:"keepAlive"`
+	MaxRecvMsgSize int       `json:"maxRecvMsgSize"`
+	MaxSendMsgSize int       `json:"maxSendMsgSize"`
+	// SinglePortMode serves the HTTP server of the clients on address too, http.address is then unused
+	SinglePortMode bool `json:"singlePortMode,omitempty"`
+}
+
+// ServerHTTP configures the HTTP server of the clients
+type ServerHTTP struct {
+	Address               string   `json:"address"`
+	TLS                   TLSFiles `json:"tls"`
+	ClientIdleTimeout     Duration `json:"clientIdleTimeout"`
+	ClientWriteTimeout    Duration `json:"clientWriteTimeout"`
+	ClientKeepAlivePeriod Duration `json:"clientKeepAlivePeriod"`
+	ReadHeaderTimeout     Duration `json:"readHeaderTimeout"`
+	ReadTimeout           Duration `json:"readTimeout,omitempty"`
+	WriteTimeout          Duration `json:"writeTimeout,omitempty"`
+	// DefaultSecurityHeaders adds server.DefaultSecurityHeaders, SecurityHeaders take precedence over them
+	DefaultSecurityHeaders bool              `json:"defaultSecurityHeaders,omitempty"`
+	SecurityHeaders        map[string]string `json:"securityHeaders,omitempty"`
+	EnableDebugEndpoints   bool              `json:"enableDebugEndpoints,omitempty"`
+	// EnableHTTP2 serves HTTP/2 to the clients, e.g. gRPC clients of services in the clusters
+	EnableHTTP2 bool `json:"enableHTTP2,omitempty"`
+	// CORS answers the CORS preflights at the hub for browser-based consoles, disabled if not set
+	CORS *ServerCORS `json:"cors,omitempty"`
+	// AdminTokenFile is the path of the bearer token of the admin API, disabled if empty
+	AdminTokenFile string `json:"adminTokenFile,omitempty"`
+	// AdminAddress moves the admin API and the debug endpoints to a separate server, served with /metrics,
+	// e.g. "127.0.0.1:9443", disabled if empty
+	AdminAddress string `json:"adminAddress,omitempty"`
+	// EnablePprof serves the pprof profiles on the admin server, it requires adminAddress
+	EnablePprof bool `json:"enablePprof,omitempty"`
+	// HubSignatureKeyFile is the path of the key the requests to the clusters are signed with, for the agents'
+	// auth.hubSignatureKeyFile. Disabled if empty
+	HubSignatureKeyFile string `json:"hubSignatureKeyFile,omitempty"`
+	// IdentityHeader is the header identifying the users allowed into the clusters under maintenance, e.g.
+	// "X-Remote-User" set by an authenticating proxy. No request is identified if empty
+	IdentityHeader string `json:"identityHeader,omitempty"`
+}
+
+// ServerTunnel configures the tunnels of the agents, see server.Config for the semantics of the fields
+type ServerTunnel struct {
+	PingInterval               Duration `json:"pingInterval"`
+	HandshakeTimeout           Duration `json:"handshakeTimeout"`
+	EnableConnectionMigration  bool     `json:"enableConnectionMigration,omitempty"`
+	SlowStartWindow            Duration `json:"slowStartWindow"`
+	SlowStartQPS               float64  `json:"slowStartQPS"`
+	SlowStartBurst             int      `json:"slowStartBurst,omitempty"`
+	MaxPacketConnsPerCluster   int      `json:"maxPacketConnsPerCluster,omitempty"`
+	MaxPacketConnBufferedBytes int      `json:"maxPacketConnBufferedBytes,omitempty"`
+	ResumeWindow               Duration `json:"resumeWindow"`
+	ResumeMaxBufferedBytes     int      `json:"resumeMaxBufferedBytes,omitempty"`
+	EnableIntegrityCheck       bool     `json:"enableIntegrityCheck,omitempty"`
+	LastSeenRetention          Duration `json:"lastSeenRetention"`
+	// QoS prioritizes the interactive connections over the bulk transfers on the tunnels, disabled if not set
+	QoS *QoS `json:"qos,omitempty"`
+	// Coalesce sends the small writes of the clients to the agents in fewer packets, disabled if not set
+	Coalesce *Coalesce `json:"coalesce,omitempty"`
+}
+
+// ServerRateLimit rate limits the resolution of cluster names, it can change at runtime
+type ServerRateLimit struct {
+	// ClusterNameQPS is the rate of cluster name resolutions per second, 0 disables rate limiting
+	ClusterNameQPS   float64 `json:"clusterNameQPS"`
+	ClusterNameBurst int     `json:"clusterNameBurst"`
+}
+
+// Limit returns the limit of the rate limiter of the cluster name resolutions, rate.Inf when it's disabled
+func (r ServerRateLimit) Limit() rate.Limit {
+	if r.ClusterNameQPS <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(r.ClusterNameQPS)
+}
+
+// ServerCapture configures the capture of the packets of the connections, disabled if Dir is empty
+type ServerCapture struct {
+	Dir         string `json:"dir,omitempty"`
+	MaxFileSize int64  `json:"maxFileSize,omitempty"`
+	MaxDataSize int    `json:"maxDataSize,omitempty"`
+}
+
+// ServerCORS allows cross-origin requests to the hub, see server.CORSConfig
+type ServerCORS struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	MaxAge         Duration `json:"maxAge"`
+}
+
+// ServerMirror mirrors a share of the requests to a cluster to another cluster, see server.MirrorConfig
+type ServerMirror struct {
+	SourceCluster string   `json:"sourceCluster"`
+	TargetCluster string   `json:"targetCluster"`
+	Percent       float64  `json:"percent"`
+	Methods       []string `json:"methods,omitempty"`
+	MaxConcurrent int      `json:"maxConcurrent,omitempty"`
+}
+
+// reloadableServerFields are the fields Reload applies at runtime
+var reloadableServerFields = map[string]bool{
+	"logging.verbosity":          true,
+	"rateLimit.clusterNameQPS":   true,
+	"rateLimit.clusterNameBurst": true,
+}
+
+// NewServerConfig returns a defaulted server config of the current version
+func NewServerConfig() *ServerConfig {
+	c := &ServerConfig{TypeMeta: TypeMeta{APIVersion: APIVersion, Kind: ServerConfigKind}}
+	c.Default()
+	return c
+}
+
+// LoadServerConfig reads the server config file at path, applies the overrides, e.g. the flags set on the command
+// line, then defaults and validates it
+func LoadServerConfig(path string, overrides ...func(*ServerConfig)) (*ServerConfig, error) {
+	c := &ServerConfig{}
+	if err := decodeFile(path, c); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		override(c)
+	}
+	c.Default()
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Default sets the unset fields to their defaults, the apiVersion and kind of a file are never defaulted
+func (c *ServerConfig) Default() {
+	if c.GRPC.Address == "" {
+		c.GRPC.Address = ":8443"
+	}
+	if c.GRPC.KeepAlive.Time.Duration == 0 {
+		c.GRPC.KeepAlive.Time.Duration = 60 * time.Second
+	}
+	if c.GRPC.KeepAlive.Timeout.Duration == 0 {
+		c.GRPC.KeepAlive.Timeout.Duration = 5 * time.Second
+	}
+	if c.GRPC.MaxRecvMsgSize == 0 {
+		c.GRPC.MaxRecvMsgSize = server.DefaultMaxGRPCMsgSize
+	}
+	if c.GRPC.MaxSendMsgSize == 0 {
+		c.GRPC.MaxSendMsgSize = server.DefaultMaxGRPCMsgSize
+	}
+	if c.HTTP.Address == "" {
+		c.HTTP.Address = ":8080"
+	}
+	if c.HTTP.ClientKeepAlivePeriod.Duration == 0 {
+		c.HTTP.ClientKeepAlivePeriod.Duration = server.DefaultClientKeepAlivePeriod
+	}
+	if c.HTTP.ReadHeaderTimeout.Duration == 0 {
+		c.HTTP.ReadHeaderTimeout.Duration = server.DefaultHTTPReadHeaderTimeout
+	}
+	if c.Tunnel.PingInterval.Duration == 0 {
+		c.Tunnel.PingInterval.Duration = server.DefaultPingInterval
+	}
+	if c.Tunnel.LastSeenRetention.Duration == 0 {
+		c.Tunnel.LastSeenRetention.Duration = server.DefaultTunnelLastSeenRetention
+	}
+	if c.Tunnel.HandshakeTimeout.Duration == 0 {
+		c.Tunnel.HandshakeTimeout.Duration = server.DefaultTunnelHandshakeTimeout
+	}
+	if c.Tunnel.SlowStartQPS == 0 {
+		c.Tunnel.SlowStartQPS = 10
+	}
+	if c.RateLimit.ClusterNameBurst == 0 {
+		c.RateLimit.ClusterNameBurst = 100
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "text"
+	}
+}
+
+// Validate returns the errors of all the invalid fields
+func (c *ServerConfig) Validate() error {
+	errs := []error{validateTypeMeta(c.TypeMeta, ServerConfigKind)}
+	switch c.ListenNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		errs = append(errs, fmt.Errorf("listenNetwork: must be one of tcp, tcp4, tcp6, got %q", c.ListenNetwork))
+	}
+	if c.MinTLSVersion != "" {
+		if _, ok := tlsVersions[c.MinTLSVersion]; !ok {
+			errs = append(errs, fmt.Errorf("minTLSVersion: must be one of 1.0, 1.1, 1.2, 1.3, got %q", c.MinTLSVersion))
+		} else if !c.RequireTLS {
+			errs = append(errs, errors.New("minTLSVersion: requires requireTLS"))
+		}
+	}
+	if c.GRPC.Address == "" {
+		errs = append(errs, errors.New("grpc.address: must be set"))
+	}
+	errs = append(errs, c.GRPC.TLS.validate("grpc.tls"), c.GRPC.KeepAlive.validate("grpc.keepAlive"))
+	if c.GRPC.MaxRecvMsgSize < 0 || c.GRPC.MaxSendMsgSize < 0 {
+		errs = append(errs, errors.New("grpc: maxRecvMsgSize and maxSendMsgSize must not be negative"))
+	}
+	if c.HTTP.Address == "" && !c.GRPC.SinglePortMode {
+		errs = append(errs, errors.New("http.address: must be set"))
+	}
+	errs = append(errs, c.HTTP.TLS.validate("http.tls"))
+	if c.HTTP.ClientIdleTimeout.Duration < 0 {
+		errs = append(errs, errors.New("http.clientIdleTimeout: must not be negative"))
+	}
+	if c.HTTP.ClientWriteTimeout.Duration < 0 {
+		errs = append(errs, errors.New("http.clientWriteTimeout: must not be negative"))
+	}
+	if c.HTTP.ReadTimeout.Duration < 0 || c.HTTP.WriteTimeout.Duration < 0 {
+		errs = append(errs, errors.New("http: readTimeout and writeTimeout must not be negative"))
+	}
+	if c.HTTP.EnablePprof && c.HTTP.AdminAddress == "" {
+		errs = append(errs, errors.New("http.enablePprof: requires http.adminAddress"))
+	}
+	if c.Tunnel.SlowStartWindow.Duration < 0 {
+		errs = append(errs, errors.New("tunnel.slowStartWindow: must not be negative"))
+	}
+	if c.Tunnel.SlowStartWindow.Duration > 0 && c.Tunnel.SlowStartQPS <= 0 {
+		errs = append(errs, errors.New("tunnel.slowStartQPS: must be positive with tunnel.slowStartWindow"))
+	}
+	if c.Tunnel.SlowStartBurst < 0 || c.Tunnel.MaxPacketConnsPerCluster < 0 || c.Tunnel.MaxPacketConnBufferedBytes < 0 {
+		errs = append(errs, errors.New("tunnel: slowStartBurst, maxPacketConnsPerCluster and maxPacketConnBufferedBytes must not be negative"))
+	}
+	if c.Tunnel.ResumeWindow.Duration < 0 || c.Tunnel.ResumeMaxBufferedBytes < 0 {
+		errs = append(errs, errors.New("tunnel: resumeWindow and resumeMaxBufferedBytes must not be negative"))
+	}
+	errs = append(errs, c.Tunnel.QoS.validate("tunnel.qos"), c.Tunnel.Coalesce.validate("tunnel.coalesce"))
+	if c.RateLimit.ClusterNameQPS < 0 {
+		errs = append(errs, errors.New("rateLimit.clusterNameQPS: must not be negative"))
+	}
+	if c.RateLimit.ClusterNameBurst <= 0 {
+		errs = append(errs, errors.New("rateLimit.clusterNameBurst: must be positive"))
+	}
+	if c.Capture.MaxFileSize < 0 || c.Capture.MaxDataSize < 0 {
+		errs = append(errs, errors.New("capture: maxFileSize and maxDataSize must not be negative"))
+	}
+	if c.HTTP.CORS != nil {
+		if len(c.HTTP.CORS.AllowedOrigins) == 0 {
+			errs = append(errs, errors.New("http.cors.allowedOrigins: must be set"))
+		}
+		if c.HTTP.CORS.MaxAge.Duration < 0 {
+			errs = append(errs, errors.New("http.cors.maxAge: must not be negative"))
+		}
+	}
+	if c.Mirror != nil {
+		if c.Mirror.SourceCluster == "" || c.Mirror.TargetCluster == "" || c.Mirror.SourceCluster == c.Mirror.TargetCluster {
+			errs = append(errs, errors.New("mirror: sourceCluster and targetCluster must be set and differ"))
+		}
+		if c.Mirror.Percent < 0 || c.Mirror.Percent > 100 {
+			errs = append(errs, errors.New("mirror.percent: must be between 0 and 100"))
+		}
+		if c.Mirror.MaxConcurrent < 0 {
+			errs = append(errs, errors.New("mirror.maxConcurrent: must not be negative"))
+		}
+	}
+	errs = append(errs, c.Logging.validate())
+	return errors.Join(errs...)
+}
+
+// Reload applies the fields of next that can change at runtime: the logging verbosity and the rate limits.
+// It returns the paths of the other fields that changed, e.g. "grpc.address", they need a restart
+func (c *ServerConfig) Reload(next *ServerConfig) (ignored []string) {
+	ignored = changedFields(c, next, reloadableServerFields)
+	c.Logging.Verbosity = next.Logging.Verbosity
+	c.RateLimit = next.RateLimit
+	return ignored
+}
+
+// ToServerConfig translates the config into a server.Config, it reads the TLS certificates, the admin token and the
+// hub signature key
+func (c *ServerConfig) ToServerConfig() (*server.Config, error) {
+	config := &server.Config{
+		GRPCListenAddress: c.GRPC.Address,
+		HTTPListenAddress: c.HTTP.Address,
+		SinglePortMode:    c.GRPC.SinglePortMode,
+		ListenNetwork:     c.ListenNetwork,
+		RequireTLS:        c.RequireTLS,
+		MinTLSVersion:     tlsVersions[c.MinTLSVersion],
+		KeepAliveParams: &keepalive.ServerParameters{
+			Time:    c.GRPC.KeepAlive.Time.Duration,
+			Timeout: c.GRPC.KeepAlive.Timeout.Duration,
+		},
+		MaxGRPCRecvMsgSize: c.GRPC.MaxRecvMsgSize,
+		MaxGRPCSendMsgSize: c.GRPC.MaxSendMsgSize,
+
+		PingInterval:               c.Tunnel.PingInterval.Duration,
+		TunnelHandshakeTimeout:     c.Tunnel.HandshakeTimeout.Duration,
+		EnableConnectionMigration:  c.Tunnel.EnableConnectionMigration,
+		SlowStartWindow:            c.Tunnel.SlowStartWindow.Duration,
+		SlowStartQPS:               c.Tunnel.SlowStartQPS,
+		SlowStartBurst:             c.Tunnel.SlowStartBurst,
+		MaxPacketConnsPerTunnel:    c.Tunnel.MaxPacketConnsPerCluster,
+		MaxPacketConnBufferedBytes: c.Tunnel.MaxPacketConnBufferedBytes,
+		ResumeWindow:               c.Tunnel.ResumeWindow.Duration,
+		TunnelLastSeenRetention:    c.Tunnel.LastSeenRetention.Duration,
+		ResumeMaxBufferedBytes:     c.Tunnel.ResumeMaxBufferedBytes,
+		EnableIntegrityCheck:       c.Tunnel.EnableIntegrityCheck,
+		QoS:                        c.Tunnel.QoS.toQoSConfig(),
+		Coalesce:                   c.Tunnel.Coalesce.toCoalesceConfig(),
+
+		ClientIdleTimeout:     c.HTTP.ClientIdleTimeout.Duration,
+		ClientWriteTimeout:    c.HTTP.ClientWriteTimeout.Duration,
+		ClientKeepAlivePeriod: c.HTTP.ClientKeepAlivePeriod.Duration,
+		HTTPReadHeaderTimeout: c.HTTP.ReadHeaderTimeout.Duration,
+		HTTPReadTimeout:       c.HTTP.ReadTimeout.Duration,
+		HTTPWriteTimeout:      c.HTTP.WriteTimeout.Duration,
+		EnableDebugEndpoints:  c.HTTP.EnableDebugEndpoints,
+		EnableHTTP2:           c.HTTP.EnableHTTP2,
+		AdminListenAddress:    c.HTTP.AdminAddress,
+		EnablePprof:           c.HTTP.EnablePprof,
+
+		CaptureDir:         c.Capture.Dir,
+		CaptureMaxFileSize: c.Capture.MaxFileSize,
+		CaptureMaxDataSize: c.Capture.MaxDataSize,
+	}
+	if c.Logging.Format == "json" {
+		config.Logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+	if c.HTTP.CORS != nil {
+		config.CORS = &server.CORSConfig{
+			AllowedOrigins: c.HTTP.CORS.AllowedOrigins,
+			AllowedMethods: c.HTTP.CORS.AllowedMethods,
+			AllowedHeaders: c.HTTP.CORS.AllowedHeaders,
+			MaxAge:         c.HTTP.CORS.MaxAge.Duration,
+		}
+	}
+	if c.Mirror != nil {
+		config.Mirror = &server.MirrorConfig{
+			SourceCluster: c.Mirror.SourceCluster,
+			TargetCluster: c.Mirror.TargetCluster,
+			Percent:       c.Mirror.Percent,
+			Methods:       c.Mirror.Methods,
+			MaxConcurrent: c.Mirror.MaxConcurrent,
+		}
+	}
+
+	if c.HTTP.DefaultSecurityHeaders || len(c.HTTP.SecurityHeaders) > 0 {
+		config.SecurityHeaders = make(map[string]string)
+		if c.HTTP.DefaultSecurityHeaders {
+			maps.Copy(config.SecurityHeaders, server.DefaultSecurityHeaders())
+		}
+		maps.Copy(config.SecurityHeaders, c.HTTP.SecurityHeaders)
+	}
+
+	if c.HTTP.AdminTokenFile != "" {
+		data, err := os.ReadFile(c.HTTP.AdminTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin token file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return nil, fmt.Errorf("admin token file %s is empty", c.HTTP.AdminTokenFile)
+		}
+		config.AdminAuthenticator = server.NewTokenAuthenticator(token)
+	}
+
+	if c.HTTP.IdentityHeader != "" {
+		config.RequestIdentifier = server.NewHeaderIdentifier(c.HTTP.IdentityHeader)
+	}
+
+	if c.HTTP.HubSignatureKeyFile != "" {
+		key, err := hubsig.ReadKeyFile(c.HTTP.HubSignatureKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.HTTPMiddlewares = append(config.HTTPMiddlewares, middleware.NewHubSignatureMiddleware(key))
+	}
+
+	var err error
+	if config.GRPCTLSConfig, err = serverTLSConfig(c.GRPC.TLS); err != nil {
+		return nil, fmt.Errorf("failed to load gRPC TLS certificate: %w", err)
+	}
+	if config.HTTPTLSConfig, err = serverTLSConfig(c.HTTP.TLS); err != nil {
+		return nil, fmt.Errorf("failed to load HTTP TLS certificate: %w", err)
+	}
+	// The listeners accept the minimum version they're required to
+	for _, tlsConfig := range []*tls.Config{config.GRPCTLSConfig, config.HTTPTLSConfig} {
+		if tlsConfig != nil {
+			tlsConfig.MinVersion = config.MinTLSVersion
+		}
+	}
+	return config, nil
+}
+
+// tlsVersions are the TLS versions of minTLSVersion
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig loads the certificate of a server, nil if it's not configured
+func serverTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if !files.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+	}, nil
+}
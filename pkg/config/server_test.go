@@ -0,0 +1,372 @@
+package config
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/yaml"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+// writeFile writes the content to name in dir and returns its path
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// writeKeyPair writes a certificate issued by a new CA and returns the paths of the CA, the certificate and its key
+func writeKeyPair(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	t.Helper()
+	ca, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	kp, err := ca.IssueServer("localhost")
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	return writeFile(t, dir, "ca.crt", ca.CertPEM), writeFile(t, dir, "tls.crt", kp.CertPEM), writeFile(t, dir, "tls.key", kp.KeyPEM)
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "server.yaml", []byte(`
+apiVersion: multiclustertunnel.io/v1alpha1
+kind: ServerConfig
+grpc:
+  address: ":9443"
+  keepAlive:
+    time: 30s
+http:
+  clientIdleTimeout: 5m
+  clientWriteTimeout: 30s
+  readHeaderTimeout: 5s
+  writeTimeout: 1m
+  defaultSecurityHeaders: true
+  securityHeaders:
+    X-Frame-Options: SAMEORIGIN
+  hubSignatureKeyFile: /etc/mctunnel/hub-signature-key
+  identityHeader: X-Remote-User
+tunnel:
+  slowStartWindow: 1m
+  maxPacketConnsPerCluster: 500
+  enableIntegrityCheck: true
+  lastSeenRetention: 10m
+  qos:
+    interactiveWeight: 8
+  coalesce:
+    delay: 2ms
+rateLimit:
+  clusterNameQPS: 50
+logging:
+  format: json
+  verbosity: 4
+listenNetwork: tcp6
+requireTLS: true
+minTLSVersion: "1.3"
+`))
+
+	c, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	expected := NewServerConfig()
+	expected.GRPC.Address = ":9443"
+	expected.GRPC.KeepAlive.Time.Duration = 30 * time.Second
+	expected.HTTP.ClientIdleTimeout.Duration = 5 * time.Minute
+	expected.HTTP.ClientWriteTimeout.Duration = 30 * time.Second
+	expected.HTTP.ReadHeaderTimeout.Duration = 5 * time.Second
+	expected.HTTP.WriteTimeout.Duration = time.Minute
+	expected.HTTP.DefaultSecurityHeaders = true
+	expected.HTTP.SecurityHeaders = map[string]string{"X-Frame-Options": "SAMEORIGIN"}
+	expected.HTTP.HubSignatureKeyFile = "/etc/mctunnel/hub-signature-key"
+	expected.HTTP.IdentityHeader = "X-Remote-User"
+	expected.Tunnel.SlowStartWindow.Duration = time.Minute
+	expected.Tunnel.MaxPacketConnsPerCluster = 500
+	expected.Tunnel.EnableIntegrityCheck = true
+	expected.Tunnel.LastSeenRetention.Duration = 10 * time.Minute
+	expected.Tunnel.QoS = &QoS{InteractiveWeight: 8}
+	expected.Tunnel.Coalesce = &Coalesce{Delay: Duration{2 * time.Millisecond}}
+	expected.RateLimit.ClusterNameQPS = 50
+	expected.Logging = Logging{Format: "json", Verbosity: 4}
+	expected.ListenNetwork = "tcp6"
+	expected.RequireTLS = true
+	expected.MinTLSVersion = "1.3"
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, c)
+	}
+
+	// The config written back loads to the same config
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	roundTrip, err := LoadServerConfig(writeFile(t, t.TempDir(), "server.yaml", data))
+	if err != nil {
+		t.Fatalf("failed to load the marshaled config: %v\n%s", err, data)
+	}
+	if !reflect.DeepEqual(roundTrip, c) {
+		t.Errorf("expected the round trip to keep %+v, got %+v", c, roundTrip)
+	}
+}
+
+func TestLoadServerConfigInvalid(t *testing.T) {
+	cases := []struct {
+		name          string
+		content       string
+		expectErrPart []string
+	}{
+		{
+			name:          "unknown field",
+			content:       "apiVersion: multiclustertunnel.io/v1alpha1\nkind: ServerConfig\ngrpc:\n  adress: \":8443\"\n",
+			expectErrPart: []string{`unknown field "adress"`},
+		},
+		{
+			name:          "duplicate field",
+			content:       "apiVersion: multiclustertunnel.io/v1alpha1\nkind: ServerConfig\nmetricsAddress: \":9090\"\nmetricsAddress: \":9091\"\n",
+			expectErrPart: []string{"already set"},
+		},
+		{
+			name:          "invalid duration",
+			content:       "apiVersion: multiclustertunnel.io/v1alpha1\nkind: ServerConfig\ntunnel:\n  pingInterval: 10\n",
+			expectErrPart: []string{"duration must be a string"},
+		},
+		{
+			name:          "missing version",
+			content:       "grpc:\n  address: \":8443\"\n",
+			expectErrPart: []string{"apiVersion: must be", "kind: must be"},
+		},
+		{
+			name:          "wrong kind",
+			content:       "apiVersion: multiclustertunnel.io/v1alpha1\nkind: AgentConfig\n",
+			expectErrPart: []string{"kind: must be ServerConfig"},
+		},
+		{
+			name: "invalid fields",
+			content: `apiVersion: multiclustertunnel.io/v1alpha1
+kind: ServerConfig
+grpc:
+  tls:
+    certFile: tls.crt
+http:
+  enablePprof: true
+  readTimeout: -1s
+  cors:
+    maxAge: -1s
+tunnel:
+  slowStartWindow: 1m
+  slowStartQPS: -1
+rateLimit:
+  clusterNameQPS: -5
+logging:
+  format: xml
+mirror:
+  sourceCluster: cluster-a
+  percent: 150
+listenNetwork: udp
+`,
+			expectErrPart: []string{
+				"grpc.tls: certFile and keyFile must be set together",
+				"http.enablePprof: requires http.adminAddress",
+				"http: readTimeout and writeTimeout must not be negative",
+				"http.cors.allowedOrigins: must be set",
+				"http.cors.maxAge: must not be negative",
+				"tunnel.slowStartQPS: must be positive",
+				"rateLimit.clusterNameQPS: must not be negative",
+				`logging.format: must be one of text, json, got "xml"`,
+				"mirror: sourceCluster and targetCluster must be set and differ",
+				"mirror.percent: must be between 0 and 100",
+				`listenNetwork: must be one of tcp, tcp4, tcp6, got "udp"`,
+			},
+		},
+		{
+			name: "invalid minimum TLS version",
+			content: `apiVersion: multiclustertunnel.io/v1alpha1
+kind: ServerConfig
+requireTLS: true
+minTLSVersion: "1.4"
+`,
+			expectErrPart: []string{`minTLSVersion: must be one of 1.0, 1.1, 1.2, 1.3, got "1.4"`},
+		},
+		{
+			name: "minimum TLS version without requireTLS",
+			content: `apiVersion: multiclustertunnel.io/v1alpha1
+kind: ServerConfig
+minTLSVersion: "1.3"
+`,
+			expectErrPart: []string{"minTLSVersion: requires requireTLS"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := LoadServerConfig(writeFile(t, t.TempDir(), "server.yaml", []byte(c.content)))
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			for _, part := range c.expectErrPart {
+				if !strings.Contains(err.Error(), part) {
+					t.Errorf("expected error containing %q, got %v", part, err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerConfigToServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := writeKeyPair(t, dir)
+
+	c := NewServerConfig()
+	c.GRPC.TLS = TLSFiles{CertFile: certFile, KeyFile: keyFile}
+	c.HTTP.DefaultSecurityHeaders = true
+	c.HTTP.SecurityHeaders = map[string]string{"X-Frame-Options": "SAMEORIGIN"}
+	c.HTTP.AdminTokenFile = writeFile(t, dir, "token", []byte("secret\n"))
+	c.HTTP.HubSignatureKeyFile = writeFile(t, dir, "hub-signature-key", []byte(strings.Repeat("k", 32)+"\n"))
+	c.HTTP.IdentityHeader = "X-Remote-User"
+	c.Tunnel.SlowStartWindow.Duration = time.Minute
+	c.Tunnel.Coalesce = &Coalesce{Delay: Duration{2 * time.Millisecond}}
+	c.HTTP.CORS = &ServerCORS{AllowedOrigins: []string{"https://ui.example.com"}}
+	c.Mirror = &ServerMirror{SourceCluster: "cluster-a", TargetCluster: "cluster-b", Percent: 10}
+	c.ListenNetwork = "tcp6"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected invalid config: %v", err)
+	}
+
+	config, err := c.ToServerConfig()
+	if err != nil {
+		t.Fatalf("failed to translate config: %v", err)
+	}
+	if config.GRPCListenAddress != ":8443" || config.HTTPListenAddress != ":8080" || config.ListenNetwork != "tcp6" {
+		t.Errorf("unexpected addresses %s %s, %s", config.ListenNetwork, config.GRPCListenAddress, config.HTTPListenAddress)
+	}
+	if config.GRPCTLSConfig == nil || len(config.GRPCTLSConfig.Certificates) != 1 {
+		t.Errorf("expected the gRPC certificate to be loaded")
+	}
+	if config.HTTPTLSConfig != nil {
+		t.Errorf("expected no HTTP TLS")
+	}
+	if config.KeepAliveParams.Time != 60*time.Second || config.KeepAliveParams.Timeout != 5*time.Second {
+		t.Errorf("unexpected keepalive %+v", config.KeepAliveParams)
+	}
+	if config.SlowStartWindow != time.Minute || config.SlowStartQPS != 10 || config.TunnelHandshakeTimeout != server.DefaultTunnelHandshakeTimeout {
+		t.Errorf("unexpected tunnel config %+v", config)
+	}
+	if config.Coalesce == nil || config.Coalesce.Delay != 2*time.Millisecond {
+		t.Errorf("expected a coalesce delay of 2ms, got %+v", config.Coalesce)
+	}
+	if config.TunnelLastSeenRetention != server.DefaultTunnelLastSeenRetention {
+		t.Errorf("expected the default last seen retention, got %v", config.TunnelLastSeenRetention)
+	}
+	if config.HTTPReadHeaderTimeout != server.DefaultHTTPReadHeaderTimeout || config.HTTPReadTimeout != 0 || config.HTTPWriteTimeout != 0 {
+		t.Errorf("unexpected HTTP timeouts %v, %v, %v", config.HTTPReadHeaderTimeout, config.HTTPReadTimeout, config.HTTPWriteTimeout)
+	}
+	if config.SecurityHeaders["X-Frame-Options"] != "SAMEORIGIN" || config.SecurityHeaders["X-Content-Type-Options"] != "nosniff" {
+		t.Errorf("unexpected security headers %v", config.SecurityHeaders)
+	}
+	if config.AdminAuthenticator == nil {
+		t.Errorf("expected the admin API to be enabled")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/cluster1/api", nil)
+	r.Header.Set("X-Remote-User", "controller")
+	if config.RequestIdentifier == nil || config.RequestIdentifier.Identify(r) != "controller" {
+		t.Errorf("expected the requests to be identified by X-Remote-User")
+	}
+	if len(config.HTTPMiddlewares) != 1 {
+		t.Errorf("expected the hub signature middleware, got %d middlewares", len(config.HTTPMiddlewares))
+	}
+	if config.CORS == nil || len(config.CORS.AllowedOrigins) != 1 || config.CORS.AllowedOrigins[0] != "https://ui.example.com" {
+		t.Errorf("unexpected CORS config %+v", config.CORS)
+	}
+	if config.Mirror == nil || config.Mirror.SourceCluster != "cluster-a" || config.Mirror.TargetCluster != "cluster-b" || config.Mirror.Percent != 10 {
+		t.Errorf("unexpected mirror config %+v", config.Mirror)
+	}
+
+	c.HTTP.HubSignatureKeyFile = writeFile(t, dir, "short-key", []byte("short"))
+	if _, err := c.ToServerConfig(); err == nil || !strings.Contains(err.Error(), "at least 32 bytes") {
+		t.Errorf("expected an error loading the short hub signature key, got %v", err)
+	}
+	c.HTTP.HubSignatureKeyFile = ""
+
+	c.HTTP.TLS = TLSFiles{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile}
+	if _, err := c.ToServerConfig(); err == nil || !strings.Contains(err.Error(), "HTTP TLS") {
+		t.Errorf("expected an error loading the missing certificate, got %v", err)
+	}
+}
+
+func TestServerConfigReload(t *testing.T) {
+	c := NewServerConfig()
+	if c.RateLimit.Limit() != rate.Inf {
+		t.Errorf("expected no rate limit by default, got %v", c.RateLimit.Limit())
+	}
+
+	next := NewServerConfig()
+	next.Logging.Verbosity = 5
+	next.RateLimit.ClusterNameQPS = 20
+	next.RateLimit.ClusterNameBurst = 40
+	next.GRPC.Address = ":9443"
+	next.HTTP.SecurityHeaders = map[string]string{"X-Frame-Options": "DENY"}
+
+	ignored := c.Reload(next)
+	expectedIgnored := []string{"grpc.address", "http.securityHeaders"}
+	if !reflect.DeepEqual(ignored, expectedIgnored) {
+		t.Errorf("expected ignored fields %v, got %v", expectedIgnored, ignored)
+	}
+	if c.Logging.Verbosity != 5 || c.RateLimit.Limit() != 20 || c.RateLimit.ClusterNameBurst != 40 {
+		t.Errorf("expected the reloadable fields to be applied, got %+v", c)
+	}
+	if c.GRPC.Address != ":8443" || c.HTTP.SecurityHeaders != nil {
+		t.Errorf("expected the other fields to be kept, got %+v", c)
+	}
+
+	if ignored := c.Reload(next); len(ignored) != 2 {
+		t.Errorf("expected the same fields to be ignored again, got %v", ignored)
+	}
+}
+
+func TestServerConfigRequireTLS(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := writeKeyPair(t, dir)
+
+	c := NewServerConfig()
+	c.GRPC.TLS = TLSFiles{CertFile: certFile, KeyFile: keyFile}
+	c.RequireTLS = true
+	c.MinTLSVersion = "1.3"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected invalid config: %v", err)
+	}
+
+	// The HTTP server has no certificate
+	config, err := c.ToServerConfig()
+	if err != nil {
+		t.Fatalf("failed to translate config: %v", err)
+	}
+	if !config.RequireTLS || config.MinTLSVersion != tls.VersionTLS13 || config.GRPCTLSConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 to be required, got %v and %v", config.MinTLSVersion, config.GRPCTLSConfig.MinVersion)
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "the HTTP listener has no TLS") {
+		t.Errorf("expected the HTTP listener to be missing TLS, got %v", err)
+	}
+
+	c.HTTP.TLS = TLSFiles{CertFile: certFile, KeyFile: keyFile}
+	if config, err = c.ToServerConfig(); err != nil {
+		t.Fatalf("failed to translate config: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected the listeners to require TLS 1.3, got %v", err)
+	}
+}
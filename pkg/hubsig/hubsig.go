@@ -0,0 +1,105 @@
+// Package hubsig signs the requests the hub tunnels to the agents, so that an agent can require its requests to have
+// been accepted by the hub, e.g. by the authentication middlewares of the hub, rather than sent to its socket by
+// another process or on a client connection the hub didn't check.
+//
+// The signature is an HMAC-SHA256 with a key shared by the hub and the agents of the method, host, request URI and
+// time of the request, it's valid for MaxSkew. It's sent in Header as "t=<unix seconds>,v1=<hex HMAC>".
+package hubsig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Header carries the signature of the hub
+	Header = "X-Multiclustertunnel-Hub-Signature"
+	// MaxSkew is how long a signature is valid before and after it was made, it bounds the clock skew between the
+	// hub and the agents too
+	MaxSkew = 5 * time.Minute
+	// MinKeySize is the minimum size of the shared key in bytes
+	MinKeySize = 32
+)
+
+var (
+	// ErrMissing is returned by Verify when the request carries no signature
+	ErrMissing = errors.New("missing hub signature")
+	// ErrInvalid is returned by Verify when the signature is malformed or not made with the key for the request
+	ErrInvalid = errors.New("invalid hub signature")
+	// ErrExpired is returned by Verify when the signature was made more than MaxSkew before or after now
+	ErrExpired = errors.New("expired hub signature")
+)
+
+// Sign returns the signature of the request made at now, for Header. It signs the request URI of its URL, which
+// the hub sends to the agent, e.g. /cluster1/api/v1/pods?watch=true
+func Sign(key []byte, r *http.Request, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(key, r.Method, r.Host, r.URL.RequestURI(), timestamp))
+}
+
+// Verify returns nil if the request carries a signature made with the key within MaxSkew of now
+func Verify(key []byte, r *http.Request, now time.Time) error {
+	value := r.Header.Get(Header)
+	if value == "" {
+		return ErrMissing
+	}
+	timestampField, macField, ok := strings.Cut(value, ",")
+	timestamp, ok1 := strings.CutPrefix(timestampField, "t=")
+	encoded, ok2 := strings.CutPrefix(macField, "v1=")
+	if !ok || !ok1 || !ok2 {
+		return ErrInvalid
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	signature, err := hex.DecodeString(encoded)
+	if err != nil || !hmac.Equal(signature, mac(key, r.Method, r.Host, requestURI(r), timestamp)) {
+		return ErrInvalid
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)).Abs(); skew > MaxSkew {
+		return fmt.Errorf("%w: signed %v away from now", ErrExpired, skew.Round(time.Second))
+	}
+	return nil
+}
+
+// ReadKeyFile reads the shared key from the file, the surrounding whitespace is trimmed. The key must be at least
+// MinKeySize bytes
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hub signature key file: %w", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("hub signature key file %s must hold at least %d bytes", path, MinKeySize)
+	}
+	return key, nil
+}
+
+// mac returns the HMAC of the request at the timestamp
+func mac(key []byte, method, host, uri, timestamp string) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, field := range []string{timestamp, method, host, uri} {
+		h.Write([]byte(field))
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum(nil)
+}
+
+// requestURI returns the request URI received by the server, the one of the URL for the requests built by clients
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
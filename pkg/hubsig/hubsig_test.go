@@ -0,0 +1,76 @@
+package hubsig
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+
+	cases := []struct {
+		name string
+		// mutate modifies the signed request before it's verified
+		mutate    func(r *http.Request)
+		verifyKey []byte
+		verifyAt  time.Time
+		expected  error
+	}{
+		{name: "valid", verifyKey: key, verifyAt: now},
+		{name: "valid within skew", verifyKey: key, verifyAt: now.Add(MaxSkew)},
+		{name: "expired", verifyKey: key, verifyAt: now.Add(MaxSkew + time.Second), expected: ErrExpired},
+		{name: "signed in the future", verifyKey: key, verifyAt: now.Add(-MaxSkew - time.Second), expected: ErrExpired},
+		{name: "wrong key", verifyKey: []byte("fedcba9876543210fedcba9876543210"), verifyAt: now, expected: ErrInvalid},
+		{name: "other method", mutate: func(r *http.Request) { r.Method = http.MethodDelete }, verifyKey: key, verifyAt: now, expected: ErrInvalid},
+		{name: "other host", mutate: func(r *http.Request) { r.Host = "evil.example.com" }, verifyKey: key, verifyAt: now, expected: ErrInvalid},
+		{name: "other path", mutate: func(r *http.Request) { r.RequestURI = "/cluster2/api/v1/secrets" }, verifyKey: key, verifyAt: now, expected: ErrInvalid},
+		{name: "missing", mutate: func(r *http.Request) { r.Header.Del(Header) }, verifyKey: key, verifyAt: now, expected: ErrMissing},
+		{name: "malformed", mutate: func(r *http.Request) { r.Header.Set(Header, "v1=00") }, verifyKey: key, verifyAt: now, expected: ErrInvalid},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/cluster1/api/v1/pods?watch=true", nil)
+			r.Host = "hub.example.com"
+			r.Header.Set(Header, Sign(key, r, now))
+			if c.mutate != nil {
+				c.mutate(r)
+			}
+			err := Verify(c.verifyKey, r, c.verifyAt)
+			if c.expected == nil && err != nil {
+				t.Fatalf("expected a valid signature, got %v", err)
+			}
+			if c.expected != nil && !errors.Is(err, c.expected) {
+				t.Fatalf("expected %v, got %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key")
+	if err := os.WriteFile(path, []byte(strings.Repeat("k", MinKeySize)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadKeyFile(path)
+	if err != nil || string(key) != strings.Repeat("k", MinKeySize) {
+		t.Fatalf("expected the trimmed key, got %q, %v", key, err)
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadKeyFile(path); err == nil {
+		t.Errorf("expected an error for a short key")
+	}
+	if _, err := ReadKeyFile(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,15 @@
+package logging
+
+import (
+	"log/slog"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+// NewSlogKlogBridge returns a slog.Logger that writes through klog, it can be used as both
+// server.Config.Logger and agent.Config.Logger to keep klog's text format, flags and verbosity.
+// slog.LevelDebug maps to klog verbosity 4, the level used by the hot path.
+func NewSlogKlogBridge() *slog.Logger {
+	return slog.New(logr.ToSlogHandler(klog.Background()))
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+func TestSlogKlogBridge(t *testing.T) {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	var out bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&out)
+	defer func() {
+		klog.LogToStderr(true)
+		klog.SetOutput(nil)
+	}()
+
+	logger := NewSlogKlogBridge()
+	for _, verbosity := range []string{"3", "4"} {
+		out.Reset()
+		if err := fs.Set("v", verbosity); err != nil {
+			t.Fatalf("failed to set the verbosity: %v", err)
+		}
+		logger.Info("info message", "cluster", "cluster1")
+		logger.Debug("debug message")
+		klog.Flush()
+
+		if !strings.Contains(out.String(), `"info message" cluster="cluster1"`) {
+			t.Errorf("expected the info message in klog's format at verbosity %s, got %q", verbosity, out.String())
+		}
+		// slog.LevelDebug is klog verbosity 4
+		if logged := strings.Contains(out.String(), "debug message"); logged != (verbosity == "4") {
+			t.Errorf("expected the debug message logged %v at verbosity %s, got %q", verbosity == "4", verbosity, out.String())
+		}
+	}
+	if err := fs.Set("v", "0"); err != nil {
+		t.Fatalf("failed to reset the verbosity: %v", err)
+	}
+}
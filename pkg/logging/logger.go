@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrLoggerAlreadySet is returned by Logger.Set for a logger other than the one already set
+var ErrLoggerAlreadySet = errors.New("a different logger is already set in the process")
+
+// Logger is the structured logger of the hot path of a package, klog is used until it's set. The hub and the agent
+// packages each have one, set from the Logger of their config. It's process-wide since the packages also log outside
+// of a Server or an Agent, so a second logger is rejected rather than replacing the one of the running instances
+type Logger struct {
+	logger atomic.Pointer[slog.Logger]
+}
+
+// Set sets the logger, nil is ignored. It fails with ErrLoggerAlreadySet if a different logger was set before
+func (l *Logger) Set(logger *slog.Logger) error {
+	if logger == nil || l.logger.CompareAndSwap(nil, logger) || l.logger.Load() == logger {
+		return nil
+	}
+	return ErrLoggerAlreadySet
+}
+
+// Verbose mirrors klog.Verbose for the Logger
+type Verbose struct {
+	logger *Logger
+	level  klog.Level
+}
+
+// V returns a Verbose for the given klog verbosity level.
+// With slog, V(n) is logged at slog.Level(-n), so V(4) is slog.LevelDebug.
+func (l *Logger) V(level klog.Level) Verbose {
+	return Verbose{logger: l, level: level}
+}
+
+// InfoS logs a structured message at the verbosity level
+func (v Verbose) InfoS(msg string, keysAndValues ...any) {
+	if l := v.logger.logger.Load(); l != nil {
+		l.Log(context.Background(), slog.Level(-int(v.level)), msg, keysAndValues...)
+		return
+	}
+	klog.V(v.level).InfoSDepth(1, msg, keysAndValues...)
+}
+
+// InfoS logs a structured info message
+func (l *Logger) InfoS(msg string, keysAndValues ...any) {
+	if logger := l.logger.Load(); logger != nil {
+		logger.Info(msg, keysAndValues...)
+		return
+	}
+	klog.InfoSDepth(1, msg, keysAndValues...)
+}
+
+// ErrorS logs a structured error message, err may be nil
+func (l *Logger) ErrorS(err error, msg string, keysAndValues ...any) {
+	if logger := l.logger.Load(); logger != nil {
+		if err != nil {
+			keysAndValues = append([]any{"err", err}, keysAndValues...)
+		}
+		logger.Error(msg, keysAndValues...)
+		return
+	}
+	klog.ErrorSDepth(1, err, msg, keysAndValues...)
+}
+
+// Warningf logs a formatted warning message
+func (l *Logger) Warningf(format string, args ...any) {
+	if logger := l.logger.Load(); logger != nil {
+		logger.Warn(fmt.Sprintf(format, args...))
+		return
+	}
+	klog.WarningfDepth(1, format, args...)
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// recordingHandler records the records logged
+type recordingHandler struct {
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+func TestLoggerLevels(t *testing.T) {
+	handler := &recordingHandler{}
+	var logger Logger
+	if err := logger.Set(slog.New(handler)); err != nil {
+		t.Fatalf("failed to set the logger: %v", err)
+	}
+
+	logger.V(2).InfoS("V(2)")
+	logger.V(4).InfoS("V(4)")
+	logger.InfoS("info")
+	logger.Warningf("%s", "warning")
+	logger.ErrorS(errors.New("failed"), "error", "cluster", "cluster1")
+
+	expected := []struct {
+		message string
+		level   slog.Level
+	}{
+		{"V(2)", slog.Level(-2)},
+		{"V(4)", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"warning", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+	if len(handler.records) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(handler.records))
+	}
+	for i, e := range expected {
+		if r := handler.records[i]; r.Message != e.message || r.Level != e.level {
+			t.Errorf("expected %q at level %v, got %q at level %v", e.message, e.level, r.Message, r.Level)
+		}
+	}
+
+	// The error is the first attribute of the error record
+	var attrs []string
+	handler.records[4].Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a.String())
+		return true
+	})
+	if strings.Join(attrs, " ") != "err=failed cluster=cluster1" {
+		t.Errorf("expected the error and the key-value pairs, got %v", attrs)
+	}
+}
+
+func TestLoggerSet(t *testing.T) {
+	var logger Logger
+	first := slog.New(&recordingHandler{})
+
+	if err := logger.Set(nil); err != nil {
+		t.Errorf("expected nil to be ignored, got %v", err)
+	}
+	if err := logger.Set(first); err != nil {
+		t.Fatalf("failed to set the logger: %v", err)
+	}
+	// The same logger, e.g. of a second Server created with the same config, and nil are accepted
+	if err := logger.Set(first); err != nil {
+		t.Errorf("expected the same logger to be accepted, got %v", err)
+	}
+	if err := logger.Set(nil); err != nil {
+		t.Errorf("expected nil to be ignored, got %v", err)
+	}
+	if err := logger.Set(slog.New(&recordingHandler{})); !errors.Is(err, ErrLoggerAlreadySet) {
+		t.Errorf("expected ErrLoggerAlreadySet for a different logger, got %v", err)
+	}
+	if logger.logger.Load() != first {
+		t.Errorf("expected the first logger to be kept")
+	}
+}
@@ -0,0 +1,177 @@
+// Package packetqueue provides a FIFO of packets bounded by the bytes of their data.
+//
+// The packets for a connection are buffered until its receiver, e.g. a slow client or target service, consumes
+// them. Bounding the buffered bytes rather than the number of packets bounds the memory pinned by a connection
+// regardless of the packet sizes. There is no flow control in the tunnel, so a packet exceeding the budget fails
+// with ErrReceiverTooSlow and the connection is expected to be closed, rather than silently dropping the packet.
+package packetqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// DefaultMaxBytes is the default budget of the data buffered by a queue
+const DefaultMaxBytes = 256 * 1024 // 256KB
+
+// initialCapacity is the initial number of packets of the ring buffer
+const initialCapacity = 8
+
+var (
+	// ErrReceiverTooSlow is returned by Push when the packet doesn't fit in the budget of the queue
+	ErrReceiverTooSlow = errors.New("receiver too slow")
+	// ErrClosed is returned by Push and Pop once the queue is closed
+	ErrClosed = errors.New("packet queue closed")
+)
+
+// Queue is a FIFO of packets bounded by the bytes of their data, it's safe for concurrent use
+type Queue struct {
+	mu sync.Mutex
+	// ring holds count packets from head, it grows when it's full
+	ring     []*v1.Packet
+	head     int
+	count    int
+	bytes    int
+	maxBytes int
+	closed   bool
+
+	// ready is signaled when a packet is pushed, done is closed when the queue is closed
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// New creates a queue buffering up to maxBytes of data, DefaultMaxBytes if it's not positive
+func New(maxBytes int) *Queue {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &Queue{
+		ring:     make([]*v1.Packet, initialCapacity),
+		maxBytes: maxBytes,
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Push appends the packet, it never blocks. A packet larger than the budget is accepted when the queue is empty,
+// so that it can still be delivered
+func (q *Queue) Push(packet *v1.Packet) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	size := len(packet.Data)
+	if q.count > 0 && q.bytes+size > q.maxBytes {
+		return ErrReceiverTooSlow
+	}
+
+	if q.count == len(q.ring) {
+		q.grow()
+	}
+	q.ring[(q.head+q.count)%len(q.ring)] = packet
+	q.count++
+	q.bytes += size
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// grow doubles the capacity of the ring, the packets are moved to its start
+func (q *Queue) grow() {
+	ring := make([]*v1.Packet, 2*len(q.ring))
+	n := copy(ring, q.ring[q.head:])
+	copy(ring[n:], q.ring[:q.head])
+	q.ring = ring
+	q.head = 0
+}
+
+// Pop removes and returns the first packet, it blocks until there is one, the queue is closed or ctx is done
+func (q *Queue) Pop(ctx context.Context) (*v1.Packet, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if q.count > 0 {
+			packet := q.ring[q.head]
+			q.ring[q.head] = nil
+			q.head = (q.head + 1) % len(q.ring)
+			q.count--
+			q.bytes -= len(packet.Data)
+			q.mu.Unlock()
+			return packet, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-q.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close drops the buffered packets, the following Push and Pop fail with ErrClosed. It can be called more than once
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	clear(q.ring)
+	q.head, q.count, q.bytes = 0, 0, 0
+	close(q.done)
+}
+
+// Reset empties the queue and reopens it once closed with a budget of maxBytes, DefaultMaxBytes if it's not positive,
+// so that it can be reused for another connection. It must not be called while the queue is in use
+func (q *Queue) Reset(maxBytes int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	// A ring grown by a burst isn't kept for the next connection
+	if len(q.ring) == initialCapacity {
+		clear(q.ring)
+	} else {
+		q.ring = make([]*v1.Packet, initialCapacity)
+	}
+	q.head, q.count, q.bytes = 0, 0, 0
+	q.maxBytes = maxBytes
+	// Drain the signal of a packet pushed but not popped, so that Pop doesn't wake up for nothing
+	for len(q.ready) > 0 {
+		<-q.ready
+	}
+	if q.closed {
+		q.closed = false
+		q.done = make(chan struct{})
+	}
+}
+
+// Len returns the number of buffered packets
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Bytes returns the bytes of data buffered
+func (q *Queue) Bytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
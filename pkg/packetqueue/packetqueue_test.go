@@ -0,0 +1,166 @@
+package packetqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func dataPacket(size int) *v1.Packet {
+	return &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: make([]byte, size)}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := New(1024)
+	// Push past the initial capacity of the ring while popping, so that it wraps around and grows
+	next := 0
+	for i := range 100 {
+		if err := q.Push(&v1.Packet{ConnId: int64(i), Data: []byte("x")}); err != nil {
+			t.Fatalf("failed to push packet %d: %v", i, err)
+		}
+		if i%3 == 0 {
+			packet, err := q.Pop(context.Background())
+			if err != nil {
+				t.Fatalf("failed to pop: %v", err)
+			}
+			if packet.ConnId != int64(next) {
+				t.Fatalf("expected packet %d, got %d", next, packet.ConnId)
+			}
+			next++
+		}
+	}
+	for q.Len() > 0 {
+		packet, _ := q.Pop(context.Background())
+		if packet.ConnId != int64(next) {
+			t.Fatalf("expected packet %d, got %d", next, packet.ConnId)
+		}
+		next++
+	}
+	if next != 100 || q.Bytes() != 0 {
+		t.Errorf("expected 100 packets and no bytes left, got %d packets and %d bytes", next, q.Bytes())
+	}
+}
+
+func TestQueueBudget(t *testing.T) {
+	cases := []struct {
+		name         string
+		maxBytes     int
+		sizes        []int
+		expectErrAt  int
+		expectBuffer int
+	}{
+		{name: "within budget", maxBytes: 100, sizes: []int{40, 40, 20}, expectErrAt: -1, expectBuffer: 100},
+		{name: "over budget", maxBytes: 100, sizes: []int{40, 40, 40}, expectErrAt: 2, expectBuffer: 80},
+		{name: "oversize packet on empty queue", maxBytes: 100, sizes: []int{150, 1}, expectErrAt: 1, expectBuffer: 150},
+		{name: "default budget", sizes: []int{DefaultMaxBytes, 1}, expectErrAt: 1, expectBuffer: DefaultMaxBytes},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := New(c.maxBytes)
+			for i, size := range c.sizes {
+				err := q.Push(dataPacket(size))
+				if i == c.expectErrAt {
+					if !errors.Is(err, ErrReceiverTooSlow) {
+						t.Fatalf("expected ErrReceiverTooSlow at packet %d, got %v", i, err)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error at packet %d: %v", i, err)
+				}
+			}
+			if q.Bytes() != c.expectBuffer {
+				t.Errorf("expected %d bytes buffered, got %d", c.expectBuffer, q.Bytes())
+			}
+		})
+	}
+}
+
+func TestQueuePopBlocks(t *testing.T) {
+	q := New(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.Pop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Pop to wait until the context is done, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(dataPacket(10))
+	}()
+	packet, err := q.Pop(context.Background())
+	if err != nil || len(packet.Data) != 10 {
+		t.Fatalf("expected the pushed packet, got %v, %v", packet, err)
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q := New(0)
+	q.Push(dataPacket(10))
+
+	popErr := make(chan error, 1)
+	go func() {
+		// The buffered packet is popped first
+		if _, err := q.Pop(context.Background()); err != nil {
+			popErr <- fmt.Errorf("unexpected error popping the buffered packet: %w", err)
+			return
+		}
+		_, err := q.Pop(context.Background())
+		popErr <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	q.Close()
+
+	select {
+	case err := <-popErr:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Pop didn't return after Close")
+	}
+	if err := q.Push(dataPacket(1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed pushing to a closed queue, got %v", err)
+	}
+	if q.Len() != 0 || q.Bytes() != 0 {
+		t.Errorf("expected an empty queue, got %d packets and %d bytes", q.Len(), q.Bytes())
+	}
+}
+
+func TestQueueReset(t *testing.T) {
+	q := New(100)
+	q.Push(dataPacket(10))
+	q.Close()
+
+	q.Reset(20)
+	if q.Len() != 0 || q.Bytes() != 0 {
+		t.Fatalf("expected an empty queue, got %d packets and %d bytes", q.Len(), q.Bytes())
+	}
+	if err := q.Push(dataPacket(15)); err != nil {
+		t.Fatalf("failed to push to a reset queue: %v", err)
+	}
+	// The budget is the one of the reset
+	if err := q.Push(dataPacket(10)); !errors.Is(err, ErrReceiverTooSlow) {
+		t.Errorf("expected ErrReceiverTooSlow over the new budget, got %v", err)
+	}
+	if packet, err := q.Pop(context.Background()); err != nil || len(packet.Data) != 15 {
+		t.Fatalf("expected the packet pushed after the reset, got %v, %v", packet, err)
+	}
+
+	// Pop blocks again until a packet is pushed, the signal of the packet dropped by the reset is drained
+	q.Push(dataPacket(1))
+	q.Reset(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Pop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Pop to block on a reset queue, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Package qos prioritizes the interactive connections of a tunnel over its bulk transfers.
+//
+// All the connections of a tunnel share a single stream, so a large transfer, e.g. downloading a log or a backup,
+// fills the outgoing queue of the sender and delays every packet of the other connections behind it. Each sender
+// queues the packets of the interactive and of the bulk connections separately, and a Scheduler sends them in a
+// weighted round robin, so that an interactive packet waits for at most a few bulk packets.
+//
+// A connection is interactive until it sent Config.BulkThreshold bytes, the connections to exec, attach and
+// portforward are always interactive. A connection turns bulk only once the interactive queue is empty, so that
+// its packets are still sent in order.
+package qos
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+const (
+	// DefaultInteractiveWeight is the default number of interactive packets sent in turn
+	DefaultInteractiveWeight = 4
+	// DefaultBulkWeight is the default number of bulk packets sent in turn
+	DefaultBulkWeight = 1
+	// DefaultBulkThreshold is the default data a connection sends before it's bulk
+	DefaultBulkThreshold = 8 * 1024 * 1024 // 8MB
+
+	// idlePollInterval is how often a connection turning bulk checks whether the interactive queue is empty
+	idlePollInterval = time.Millisecond
+	// maxDemoteWait bounds how long a connection turning bulk waits for the interactive queue to be empty
+	maxDemoteWait = time.Second
+)
+
+// ErrQueueClosed is returned by Scheduler.Poll when one of the queues is closed
+var ErrQueueClosed = errors.New("queue closed")
+
+// Class is the priority of the packets of a connection
+type Class int
+
+const (
+	// Interactive connections, e.g. API requests and exec sessions, are latency sensitive
+	Interactive Class = iota
+	// Bulk connections, e.g. large downloads, are throughput bound
+	Bulk
+)
+
+// String returns the name of the class
+func (c Class) String() string {
+	if c == Bulk {
+		return "bulk"
+	}
+	return "interactive"
+}
+
+// Config enables prioritizing the interactive connections of the tunnels over the bulk ones
+type Config struct {
+	// InteractiveWeight and BulkWeight are the number of packets sent from each queue in turn while both have
+	// packets. Default: DefaultInteractiveWeight and DefaultBulkWeight
+	InteractiveWeight int
+	BulkWeight        int
+	// BulkThreshold is the data in bytes a connection sends before it's bulk. Default: DefaultBulkThreshold
+	BulkThreshold int64
+	// IsInteractive pins the connections whose request path it returns true for to Interactive, they never turn
+	// bulk. Default: IsInteractivePath
+	IsInteractive func(path string) bool
+}
+
+// withDefaults returns a copy of the config with the defaults set
+func (c *Config) withDefaults() Config {
+	config := *c
+	if config.InteractiveWeight <= 0 {
+		config.InteractiveWeight = DefaultInteractiveWeight
+	}
+	if config.BulkWeight <= 0 {
+		config.BulkWeight = DefaultBulkWeight
+	}
+	if config.BulkThreshold <= 0 {
+		config.BulkThreshold = DefaultBulkThreshold
+	}
+	if config.IsInteractive == nil {
+		config.IsInteractive = IsInteractivePath
+	}
+	return config
+}
+
+// NewConn returns the classifier of a connection with the request path, nil if the config is nil. A nil Conn
+// classifies all the packets as Interactive
+func (c *Config) NewConn(path string) *Conn {
+	if c == nil {
+		return nil
+	}
+	config := c.withDefaults()
+	return &Conn{threshold: config.BulkThreshold, pinned: config.IsInteractive(path)}
+}
+
+// IsInteractivePath returns whether the path is an exec, attach or portforward request of a pod, e.g.
+// /api/v1/namespaces/default/pods/nginx/exec, those are long-lived but latency sensitive
+func IsInteractivePath(path string) bool {
+	path, _, _ = strings.Cut(path, "?")
+	for _, segment := range strings.Split(path, "/") {
+		switch segment {
+		case "exec", "attach", "portforward":
+			return true
+		}
+	}
+	return false
+}
+
+// RequestPath returns the path of the HTTP request whose head starts the data, empty if it's not a request line
+func RequestPath(data []byte) string {
+	line, _, _ := strings.Cut(string(data[:min(len(data), 4096)]), "\n")
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return ""
+	}
+	return fields[1]
+}
+
+// Conn classifies the packets sent on a connection, it starts Interactive and turns Bulk once it sent its
+// threshold. Its packets must be classified by a single sender at a time, in the order they're queued
+type Conn struct {
+	threshold int64
+	// pinned connections are never bulk
+	pinned bool
+	sent   atomic.Int64
+	bulk   atomic.Bool
+}
+
+// TryClass counts the n bytes of the next packet of the connection and returns its class. Once the connection
+// sent its threshold, it turns bulk when interactiveIdle returns that the interactive queue is empty, so that the
+// packets it queued there are sent before the ones it queues on the bulk queue. ok is false until then, the packet
+// must not be queued and TryClass is called again with 0 bytes
+func (c *Conn) TryClass(n int, interactiveIdle func() bool) (class Class, ok bool) {
+	if c == nil || c.pinned {
+		return Interactive, true
+	}
+	if c.bulk.Load() {
+		return Bulk, true
+	}
+	if c.sent.Add(int64(n)) < c.threshold {
+		return Interactive, true
+	}
+	if !interactiveIdle() {
+		return Interactive, false
+	}
+	c.bulk.Store(true)
+	return Bulk, true
+}
+
+// Class returns the class of the next packet of n bytes like TryClass, it waits up to maxDemoteWait for the
+// interactive queue to be empty when the connection turns bulk. The connection stays interactive for another
+// threshold if it's not empty by then, e.g. when other connections keep it busy
+func (c *Conn) Class(ctx context.Context, n int, interactiveIdle func() bool) Class {
+	class, ok := c.TryClass(n, interactiveIdle)
+	if ok {
+		return class
+	}
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(maxDemoteWait)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if class, ok := c.TryClass(0, interactiveIdle); ok {
+				return class
+			}
+		case <-timeout.C:
+			c.sent.Store(0)
+			return Interactive
+		case <-ctx.Done():
+			return Interactive
+		}
+	}
+}
+
+// Current returns the class of the connection without counting a packet, e.g. for the packets retransmitted
+// when it's resumed
+func (c *Conn) Current() Class {
+	if c != nil && c.bulk.Load() {
+		return Bulk
+	}
+	return Interactive
+}
+
+// Scheduler sends the packets of the interactive and bulk queues of a sender in a weighted round robin, it's
+// owned by the single sender of a stream
+type Scheduler struct {
+	weights [2]int
+	credits [2]int
+}
+
+// NewScheduler returns the scheduler with the weights of the config, both queues have the same weight if the
+// config is nil
+func NewScheduler(config *Config) *Scheduler {
+	s := &Scheduler{weights: [2]int{1, 1}}
+	if config != nil {
+		c := config.withDefaults()
+		s.weights = [2]int{c.InteractiveWeight, c.BulkWeight}
+	}
+	s.credits = s.weights
+	return s
+}
+
+// Poll returns the next packet to send without blocking, nil if both queues are empty. Each queue sends its weight
+// of packets in turn while the other one has packets, an empty queue doesn't hold the other one back. A nil queue
+// is always empty
+func (s *Scheduler) Poll(interactive, bulk <-chan *v1.Packet) (*v1.Packet, error) {
+	queues := [2]<-chan *v1.Packet{interactive, bulk}
+	// The second pass refills the credits of both queues, in case the one with packets has none left
+	for range 2 {
+		for class, queue := range queues {
+			if s.credits[class] == 0 {
+				continue
+			}
+			select {
+			case packet, ok := <-queue:
+				if !ok {
+					return nil, ErrQueueClosed
+				}
+				s.credits[class]--
+				return packet, nil
+			default:
+			}
+		}
+		s.credits = s.weights
+	}
+	return nil, nil
+}
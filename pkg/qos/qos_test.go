@@ -0,0 +1,284 @@
+package qos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func TestIsInteractivePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/v1/namespaces/default/pods/nginx/exec", true},
+		{"/api/v1/namespaces/default/pods/nginx/exec?command=sh&stdin=true", true},
+		{"/api/v1/namespaces/default/pods/nginx/attach", true},
+		{"/api/v1/namespaces/default/pods/nginx/portforward", true},
+		{"/api/v1/namespaces/default/pods/nginx/log", false},
+		{"/api/v1/namespaces/default/pods/executor", false},
+		{"/api/v1/pods?labelSelector=app%3Dexec", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsInteractivePath(tt.path); got != tt.want {
+			t.Errorf("IsInteractivePath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRequestPath(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"GET /api/v1/pods HTTP/1.1\r\nHost: hub\r\n\r\n", "/api/v1/pods"},
+		{"POST /api/v1/namespaces/default/pods/nginx/exec?command=sh HTTP/1.1\r\n", "/api/v1/namespaces/default/pods/nginx/exec?command=sh"},
+		{"GET /api/v1/pods HTT", ""},
+		{"\x16\x03\x01\x02\x00", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := RequestPath([]byte(tt.data)); got != tt.want {
+			t.Errorf("RequestPath(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestConnClass(t *testing.T) {
+	config := &Config{BulkThreshold: 100}
+	idle := func() bool { return true }
+	busy := func() bool { return false }
+
+	conn := config.NewConn("/api/v1/namespaces/default/pods/nginx/log")
+	if got, ok := conn.TryClass(60, idle); got != Interactive || !ok {
+		t.Fatalf("TryClass below the threshold = %v, %v, want interactive", got, ok)
+	}
+	// The connection doesn't turn bulk while its packets may be queued on the interactive queue
+	if _, ok := conn.TryClass(60, busy); ok {
+		t.Fatalf("TryClass over the threshold with a busy interactive queue is ok, want to wait")
+	}
+	if got, ok := conn.TryClass(0, idle); got != Bulk || !ok {
+		t.Fatalf("TryClass over the threshold = %v, %v, want bulk", got, ok)
+	}
+	// Once bulk, the connection stays bulk so that its packets stay in order
+	if got, ok := conn.TryClass(10, busy); got != Bulk || !ok {
+		t.Fatalf("TryClass after turning bulk = %v, %v, want bulk", got, ok)
+	}
+	if got := conn.Current(); got != Bulk {
+		t.Fatalf("Current() = %v, want bulk", got)
+	}
+
+	pinned := config.NewConn("/api/v1/namespaces/default/pods/nginx/exec")
+	if got, ok := pinned.TryClass(1000, idle); got != Interactive || !ok {
+		t.Fatalf("TryClass of an exec connection = %v, %v, want interactive", got, ok)
+	}
+
+	var disabled *Config
+	if got, ok := disabled.NewConn("/").TryClass(1000, idle); got != Interactive || !ok {
+		t.Fatalf("TryClass without QoS = %v, %v, want interactive", got, ok)
+	}
+}
+
+func TestConnClassWaits(t *testing.T) {
+	config := &Config{BulkThreshold: 100}
+	var queued atomic.Int32
+	queued.Store(3)
+	// The sender empties the interactive queue a packet at a time
+	idle := func() bool { return queued.Add(-1) < 0 }
+
+	conn := config.NewConn("/api/v1/namespaces/default/pods/nginx/log")
+	if got := conn.Class(context.Background(), 200, idle); got != Bulk {
+		t.Fatalf("Class once the interactive queue is empty = %v, want bulk", got)
+	}
+
+	busy := config.NewConn("/api/v1/namespaces/default/pods/nginx/log")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := busy.Class(ctx, 200, func() bool { return false }); got != Interactive {
+		t.Fatalf("Class of a canceled connection = %v, want interactive", got)
+	}
+}
+
+func TestConnClassHook(t *testing.T) {
+	config := &Config{BulkThreshold: 1, IsInteractive: func(path string) bool { return strings.HasPrefix(path, "/metrics") }}
+	idle := func() bool { return true }
+
+	if got, _ := config.NewConn("/metrics").TryClass(10, idle); got != Interactive {
+		t.Fatalf("TryClass of a connection pinned by the hook = %v, want interactive", got)
+	}
+	if got, _ := config.NewConn("/api/v1/namespaces/default/pods/nginx/exec").TryClass(10, idle); got != Bulk {
+		t.Fatalf("TryClass of an exec connection with a hook = %v, want bulk", got)
+	}
+}
+
+// queue returns a channel buffering the packets, whose Data is their name
+func queue(names ...string) chan *v1.Packet {
+	ch := make(chan *v1.Packet, 100)
+	for _, name := range names {
+		ch <- &v1.Packet{Data: []byte(name)}
+	}
+	return ch
+}
+
+// poll returns the names of the next n packets polled
+func poll(t *testing.T, s *Scheduler, interactive, bulk <-chan *v1.Packet, n int) []string {
+	t.Helper()
+	var names []string
+	for range n {
+		packet, err := s.Poll(interactive, bulk)
+		if err != nil {
+			t.Fatalf("Poll() error = %v", err)
+		}
+		if packet == nil {
+			names = append(names, "-")
+			continue
+		}
+		names = append(names, string(packet.Data))
+	}
+	return names
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	s := NewScheduler(&Config{InteractiveWeight: 2, BulkWeight: 1})
+	interactive := queue("i1", "i2", "i3", "i4", "i5")
+	bulk := queue("b1", "b2", "b3", "b4")
+
+	got := poll(t, s, interactive, bulk, 10)
+	want := []string{"i1", "i2", "b1", "i3", "i4", "b2", "i5", "b3", "b4", "-"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Poll() order = %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerWithoutBulkQueue(t *testing.T) {
+	s := NewScheduler(nil)
+	interactive := queue("i1", "i2", "i3")
+
+	got := poll(t, s, interactive, nil, 4)
+	want := []string{"i1", "i2", "i3", "-"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Poll() order = %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerClosedQueue(t *testing.T) {
+	s := NewScheduler(&Config{})
+	interactive := queue()
+	close(interactive)
+
+	if _, err := s.Poll(interactive, queue("b1")); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("Poll() error = %v, want ErrQueueClosed", err)
+	}
+}
+
+// BenchmarkInteractiveLatency simulates a 1 Gbit/s tunnel sending a 1GB transfer in 32KB packets while a small
+// request is sent every 10ms, and reports the p99 latency of the small requests in the simulated time. The sender
+// queues are bounded like the ones of the agent, the producers wait for room in them
+func BenchmarkInteractiveLatency(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		config *Config
+	}{
+		{name: "FIFO"},
+		{name: "Weighted", config: &Config{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var p99 time.Duration
+			for range b.N {
+				p99 = simulateTransfer(bc.config)
+			}
+			b.ReportMetric(float64(p99)/float64(time.Millisecond), "p99-ms")
+		})
+	}
+}
+
+// simulateTransfer returns the p99 latency of the small requests sent during the 1GB transfer, a nil config sends
+// all the packets from a single queue
+func simulateTransfer(config *Config) time.Duration {
+	const (
+		bandwidth    = 125 * 1000 * 1000 // bytes per second
+		transferSize = 1024 * 1024 * 1024
+		packetSize   = 32 * 1024
+		requestSize  = 512
+		requestEvery = 10 * time.Millisecond
+		queueSize    = 1000
+	)
+	interactive := make(chan *v1.Packet, queueSize)
+	bulk := interactive
+	if config != nil {
+		bulk = make(chan *v1.Packet, queueSize)
+	}
+	scheduler := NewScheduler(config)
+	transfer := config.NewConn("/api/v1/namespaces/default/pods/backup/log")
+	interactiveIdle := func() bool { return len(interactive) == 0 }
+
+	var (
+		now        time.Duration
+		remaining  = transferSize
+		nextArrive time.Duration
+		// pending are the arrival times of the requests waiting for room in the queue
+		pending   []time.Duration
+		latencies []time.Duration
+		// next is the queue of the next packet of the transfer, nil until it's classified
+		next chan *v1.Packet
+		// counted is whether the next packet of the transfer was counted by its classifier
+		counted bool
+	)
+	for remaining > 0 || len(interactive) > 0 || len(bulk) > 0 {
+		// The requests arrived by now are queued first, then the transfer fills the room left
+		for ; nextArrive <= now && remaining > 0; nextArrive += requestEvery {
+			pending = append(pending, nextArrive)
+		}
+		for len(pending) > 0 && len(interactive) < cap(interactive) {
+			interactive <- &v1.Packet{Data: make([]byte, requestSize), Seq: int64(pending[0])}
+			pending = pending[1:]
+		}
+		for remaining > 0 {
+			if next == nil {
+				// The transfer waits for the sender when it turns bulk, its packets are counted once
+				n := packetSize
+				if counted {
+					n = 0
+				}
+				class, ok := transfer.TryClass(n, interactiveIdle)
+				counted = true
+				if !ok {
+					break
+				}
+				next = interactive
+				if class == Bulk {
+					next = bulk
+				}
+			}
+			if len(next) == cap(next) {
+				break
+			}
+			// The transfer's packets are told apart from the requests by their negative Seq
+			next <- &v1.Packet{Data: make([]byte, packetSize), Seq: -1}
+			next, counted = nil, false
+			remaining -= packetSize
+		}
+
+		packet, err := scheduler.Poll(interactive, bulk)
+		if err != nil || packet == nil {
+			break
+		}
+		now += time.Duration(len(packet.Data)) * time.Second / bandwidth
+		if packet.Seq >= 0 {
+			latencies = append(latencies, now-time.Duration(packet.Seq))
+		}
+	}
+	if len(latencies) == 0 {
+		panic(fmt.Sprintf("no request was sent in %v", now))
+	}
+	slices.Sort(latencies)
+	return latencies[len(latencies)*99/100]
+}
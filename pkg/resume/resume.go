@@ -0,0 +1,179 @@
+// Package resume numbers the DATA packets of a packet connection and keeps them until the peer acknowledges them,
+// so the connection can be resumed on the next tunnel of the agent instead of failing when it reconnects.
+//
+// The sender of each direction numbers the DATA packets with data with a seq starting at 1 and keeps them in a
+// replay buffer bounded by the bytes of their data, the receiver acknowledges them with ACK packets every AckBytes.
+// On a new tunnel both sides send a RESUME with the seq of the last packet they received in order, and the peer
+// retransmits the packets after it. The receiver drops the duplicates and the packets after a gap, the ones lost with
+// the previous tunnel are retransmitted before them.
+//
+// The replay buffer is flow control rather than a cap that fails the connection: the sender waits for
+// acknowledgements while it's full, e.g. while the agent is away, which stops reading from the client or target.
+package resume
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+const (
+	// DefaultMaxBytes is the default budget of the data of a replay buffer
+	DefaultMaxBytes = 1024 * 1024 // 1MB
+	// AckBytes is the data a receiver accepts before it acknowledges it
+	AckBytes = 16 * 1024 // 16KB
+	// MinMaxBytes is the smallest budget of a replay buffer, the receiver acknowledges a full buffer several times
+	MinMaxBytes = 4 * AckBytes
+)
+
+// Sender numbers the DATA packets sent on a packet connection and keeps them until they're acknowledged,
+// it's safe for concurrent use
+type Sender struct {
+	mu       sync.Mutex
+	maxBytes int
+	// seq is the seq of the last packet added
+	seq int64
+	// packets are the packets not acknowledged yet in order, bytes is the size of their data
+	packets []*v1.Packet
+	bytes   int
+	// room is closed when an acknowledgement frees data from the buffer
+	room chan struct{}
+}
+
+// NewSender creates a sender buffering up to maxBytes of data, DefaultMaxBytes if it's not positive
+// and at least MinMaxBytes
+func NewSender(maxBytes int) *Sender {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &Sender{
+		maxBytes: max(maxBytes, MinMaxBytes),
+		room:     make(chan struct{}),
+	}
+}
+
+// Wait blocks until the replay buffer has room for more data or ctx is done
+func (s *Sender) Wait(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.bytes < s.maxBytes {
+			s.mu.Unlock()
+			return nil
+		}
+		room := s.room
+		s.mu.Unlock()
+
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Add numbers the packet with the next seq and keeps it until it's acknowledged, it never blocks. The caller
+// orders Add with sending the packet, and calls Wait before it to bound the buffer
+func (s *Sender) Add(packet *v1.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	packet.Seq = s.seq
+	s.packets = append(s.packets, packet)
+	s.bytes += len(packet.Data)
+}
+
+// Ack drops the packets up to seq from the replay buffer, acknowledgements older than the last one are ignored.
+// It fails if seq was never sent
+func (s *Sender) Ack(seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq > s.seq {
+		return fmt.Errorf("acknowledged seq %d was never sent, the last one is %d", seq, s.seq)
+	}
+	n := 0
+	for n < len(s.packets) && s.packets[n].Seq <= seq {
+		s.bytes -= len(s.packets[n].Data)
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	// Don't pin the dropped packets in the backing array
+	clear(s.packets[:n])
+	s.packets = s.packets[n:]
+
+	close(s.room)
+	s.room = make(chan struct{})
+	return nil
+}
+
+// Unacked returns the packets not acknowledged yet in order, they're retransmitted when the connection is resumed
+func (s *Sender) Unacked() []*v1.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*v1.Packet(nil), s.packets...)
+}
+
+// Bytes returns the bytes of data not acknowledged yet
+func (s *Sender) Bytes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Receiver tracks the DATA packets received in order on a packet connection and when to acknowledge them,
+// it's safe for concurrent use
+type Receiver struct {
+	mu sync.Mutex
+	// received is the seq of the last packet received in order
+	received int64
+	// unacked is the data received since the last acknowledgement
+	unacked int
+}
+
+// NewReceiver creates a receiver expecting the packet with seq 1
+func NewReceiver() *Receiver {
+	return &Receiver{}
+}
+
+// Accept returns whether the packet is the next one in order and should be delivered. Duplicates and packets after
+// a gap are dropped, the sender retransmits them when the connection is resumed. Packets without a seq, e.g.
+// without data, are always accepted
+func (r *Receiver) Accept(packet *v1.Packet) bool {
+	if packet.Seq == 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if packet.Seq != r.received+1 {
+		return false
+	}
+	r.received = packet.Seq
+	r.unacked += len(packet.Data)
+	return true
+}
+
+// Ack returns the seq to acknowledge once AckBytes of data were accepted since the last acknowledgement
+func (r *Receiver) Ack() (int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.unacked < AckBytes {
+		return 0, false
+	}
+	r.unacked = 0
+	return r.received, true
+}
+
+// Received returns the seq of the last packet received in order, the one a RESUME is sent with
+func (r *Receiver) Received() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received
+}
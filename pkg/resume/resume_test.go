@@ -0,0 +1,137 @@
+package resume
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func dataPacket(size int) *v1.Packet {
+	return &v1.Packet{ConnId: 1, Code: v1.ControlCode_DATA, Data: make([]byte, size)}
+}
+
+func seqs(packets []*v1.Packet) []int64 {
+	var s []int64
+	for _, p := range packets {
+		s = append(s, p.Seq)
+	}
+	return s
+}
+
+func TestSenderAck(t *testing.T) {
+	s := NewSender(0)
+	for range 5 {
+		s.Add(dataPacket(10))
+	}
+	if got := seqs(s.Unacked()); len(got) != 5 || got[0] != 1 || got[4] != 5 {
+		t.Fatalf("expected seqs 1 to 5, got %v", got)
+	}
+
+	if err := s.Ack(3); err != nil {
+		t.Fatalf("failed to ack: %v", err)
+	}
+	if got := seqs(s.Unacked()); len(got) != 2 || got[0] != 4 || s.Bytes() != 20 {
+		t.Fatalf("expected seqs 4 and 5 with 20 bytes, got %v with %d bytes", got, s.Bytes())
+	}
+
+	// A stale acknowledgement, e.g. reordered with a RESUME, is ignored
+	if err := s.Ack(2); err != nil {
+		t.Fatalf("unexpected error for a stale ack: %v", err)
+	}
+	if len(s.Unacked()) != 2 {
+		t.Errorf("expected the stale ack to keep the packets")
+	}
+
+	if err := s.Ack(6); err == nil {
+		t.Errorf("expected an error acknowledging a packet never sent")
+	}
+
+	// Numbering continues after the acknowledged packets
+	p := dataPacket(1)
+	s.Add(p)
+	if p.Seq != 6 {
+		t.Errorf("expected seq 6, got %d", p.Seq)
+	}
+}
+
+func TestSenderWait(t *testing.T) {
+	s := NewSender(1)
+	if s.maxBytes != MinMaxBytes {
+		t.Fatalf("expected the budget to be raised to %d, got %d", MinMaxBytes, s.maxBytes)
+	}
+
+	if err := s.Wait(context.Background()); err != nil {
+		t.Fatalf("unexpected error waiting on an empty buffer: %v", err)
+	}
+	s.Add(dataPacket(MinMaxBytes / 2))
+	s.Add(dataPacket(MinMaxBytes / 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Wait to block on a full buffer, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Wait(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := s.Ack(1); err != nil {
+		t.Fatalf("failed to ack: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the acknowledgement to unblock Wait")
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	r := NewReceiver()
+
+	packet := func(seq int64, size int) *v1.Packet {
+		p := dataPacket(size)
+		p.Seq = seq
+		return p
+	}
+
+	cases := []struct {
+		name   string
+		packet *v1.Packet
+		accept bool
+	}{
+		{name: "without seq", packet: dataPacket(0), accept: true},
+		{name: "first", packet: packet(1, 10), accept: true},
+		{name: "after a gap", packet: packet(3, 10), accept: false},
+		{name: "next", packet: packet(2, 10), accept: true},
+		{name: "duplicate", packet: packet(2, 10), accept: false},
+		{name: "retransmitted after the gap", packet: packet(3, 10), accept: true},
+	}
+	for _, c := range cases {
+		if got := r.Accept(c.packet); got != c.accept {
+			t.Errorf("%s: expected accept %v, got %v", c.name, c.accept, got)
+		}
+	}
+	if r.Received() != 3 {
+		t.Errorf("expected seq 3 received, got %d", r.Received())
+	}
+
+	if _, ok := r.Ack(); ok {
+		t.Errorf("expected no acknowledgement before AckBytes are received")
+	}
+	r.Accept(packet(4, AckBytes))
+	seq, ok := r.Ack()
+	if !ok || seq != 4 {
+		t.Errorf("expected an acknowledgement of seq 4, got %d, %v", seq, ok)
+	}
+	if _, ok := r.Ack(); ok {
+		t.Errorf("expected a single acknowledgement")
+	}
+}
@@ -0,0 +1,75 @@
+// Package rtt measures the round-trip time of a tunnel with PING/PONG packets.
+//
+// The PING data carries the sender's monotonic clock reading, which the peer echoes back in the PONG,
+// so the round-trip time is computed by the sender alone and doesn't depend on synchronized clocks.
+package rtt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// smoothingFactor is the weight of a new sample in the EWMA
+	smoothingFactor = 0.2
+	// maxSampleFactor caps a sample to a multiple of the current estimate, so a single outlier can't skew it
+	maxSampleFactor = 4
+	// maxSample caps any sample, e.g. a PONG for a PING sent before a long pause
+	maxSample = time.Minute
+	// pingPayloadSize is the size of the PING data
+	pingPayloadSize = 8
+)
+
+// epoch is the reference of the monotonic clock readings in the PING data
+var epoch = time.Now()
+
+// NewPingPayload returns the data of a PING packet
+func NewPingPayload() []byte {
+	payload := make([]byte, pingPayloadSize)
+	binary.BigEndian.PutUint64(payload, uint64(time.Since(epoch)))
+	return payload
+}
+
+// SampleFromPong returns the round-trip time of the PING the PONG data was echoed from
+func SampleFromPong(data []byte) (time.Duration, error) {
+	if len(data) != pingPayloadSize {
+		return 0, fmt.Errorf("invalid PONG data size %d", len(data))
+	}
+	sample := time.Since(epoch) - time.Duration(binary.BigEndian.Uint64(data))
+	if sample < 0 {
+		return 0, fmt.Errorf("PONG data is from the future, it's not a reply to a local PING")
+	}
+	return sample, nil
+}
+
+// Estimator maintains an exponentially weighted moving average of round-trip time samples
+type Estimator struct {
+	mu      sync.RWMutex
+	rtt     time.Duration
+	samples int
+}
+
+// Observe adds a sample and returns the updated estimate
+func (e *Estimator) Observe(sample time.Duration) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sample = min(sample, maxSample)
+	if e.samples == 0 {
+		e.rtt = sample
+	} else {
+		sample = min(sample, maxSampleFactor*e.rtt)
+		e.rtt += time.Duration(smoothingFactor * float64(sample-e.rtt))
+	}
+	e.samples++
+	return e.rtt
+}
+
+// RTT returns the current estimate, 0 if there is no sample yet
+func (e *Estimator) RTT() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rtt
+}
@@ -0,0 +1,67 @@
+package rtt
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestEstimatorConverges(t *testing.T) {
+	cases := []struct {
+		name     string
+		latency  time.Duration
+		jitter   time.Duration
+		outliers bool
+	}{
+		{name: "constant latency", latency: 20 * time.Millisecond},
+		{name: "jitter", latency: 50 * time.Millisecond, jitter: 10 * time.Millisecond},
+		{name: "outliers", latency: 10 * time.Millisecond, outliers: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := &Estimator{}
+			for i := 0; i < 100; i++ {
+				// Inject the artificial delay
+				sample := c.latency
+				if c.jitter > 0 {
+					sample += time.Duration(rand.Int64N(int64(2*c.jitter))) - c.jitter
+				}
+				if c.outliers && i%10 == 4 {
+					sample = 10 * time.Second
+				}
+				e.Observe(sample)
+			}
+
+			// With outliers capped to 4x, the estimate stays within 1.5x of the injected latency
+			if got := e.RTT(); got < c.latency/2 || got > c.latency*3/2 {
+				t.Errorf("expected RTT near %s, got %s", c.latency, got)
+			}
+		})
+	}
+}
+
+func TestEstimatorCapsOutliers(t *testing.T) {
+	e := &Estimator{}
+	e.Observe(10 * time.Millisecond)
+	if got := e.Observe(time.Hour); got > 20*time.Millisecond {
+		t.Errorf("expected the outlier to be capped, got %s", got)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	payload := NewPingPayload()
+	time.Sleep(10 * time.Millisecond)
+
+	sample, err := SampleFromPong(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sample < 10*time.Millisecond || sample > time.Second {
+		t.Errorf("unexpected sample %s", sample)
+	}
+
+	if _, err := SampleFromPong([]byte("short")); err == nil {
+		t.Errorf("expected error for invalid PONG data")
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
+)
+
+const (
+	// adminTunnelsPath lists the tunnels with GET /admin/tunnels
+	adminTunnelsPath = "/admin/tunnels"
+	// adminTunnelsPrefix is the path prefix of the admin API on the tunnels, POST /admin/tunnels/<cluster>/disconnect
+	// and POST /admin/tunnels/<cluster>/drain
+	adminTunnelsPrefix = adminTunnelsPath + "/"
+	// adminMaintenancePath lists the clusters under maintenance with GET /admin/maintenance
+	adminMaintenancePath = "/admin/maintenance"
+	// adminMaintenancePrefix is the path prefix of the maintenance of a cluster, PUT
+	// /admin/maintenance/<cluster>[?allow=<identity>...] puts it under maintenance, DELETE takes it out of it
+	adminMaintenancePrefix = adminMaintenancePath + "/"
+)
+
+// defaultDisconnectReason is sent to the agent when the disconnect request has no reason
+const defaultDisconnectReason = "disconnected by admin"
+
+// drainReason is sent to the agent when its tunnel is disconnected once drained
+const drainReason = "tunnel drained by hub"
+
+// HTTPAuthenticator authenticates the requests to the admin API of the hub
+type HTTPAuthenticator interface {
+	// Authenticate returns an error if the request is not allowed
+	Authenticate(r *http.Request) error
+}
+
+// tokenAuthenticator authenticates requests with a static bearer token
+type tokenAuthenticator struct {
+	token []byte
+}
+
+// NewTokenAuthenticator creates an HTTPAuthenticator accepting requests with the header "Authorization: Bearer <token>"
+func NewTokenAuthenticator(token string) HTTPAuthenticator {
+	return &tokenAuthenticator{token: []byte(token)}
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return errors.New("missing bearer token")
+	}
+	if len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		return errors.New("invalid bearer token")
+	}
+	return nil
+}
+
+// newAdminHandler returns the handler of the admin server: the admin API if authenticator is set, /debug/tunnels,
+// /metrics, /health, /version and the pprof profiles if enabled. Other paths are not found
+func newAdminHandler(tunnelManager *TunnelManager, authenticator HTTPAuthenticator, enablePprof bool) http.Handler {
+	h := &healthCheckHandler{tunnelManager: tunnelManager, debug: true, admin: authenticator}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.Handle("/version", version.Handler())
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		h.serveTunnels(w)
+	})
+	if authenticator != nil {
+		mux.HandleFunc(adminTunnelsPath, h.serveAdmin)
+		mux.HandleFunc(adminTunnelsPrefix, h.serveAdmin)
+		mux.HandleFunc(adminMaintenancePath, h.serveAdmin)
+		mux.HandleFunc(adminMaintenancePrefix, h.serveAdmin)
+	}
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// isAdminAPIPath returns whether the path is one of the admin API
+func isAdminAPIPath(path string) bool {
+	return path == adminTunnelsPath || strings.HasPrefix(path, adminTunnelsPrefix) ||
+		path == adminMaintenancePath || strings.HasPrefix(path, adminMaintenancePrefix)
+}
+
+// isAdminPath returns whether the path is served by the admin server
+func isAdminPath(path string) bool {
+	return path == "/metrics" || strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/")
+}
+
+// serveAdmin serves the admin API, the request is authenticated first
+func (h *healthCheckHandler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if err := h.admin.Authenticate(r); err != nil {
+		logger.V(2).InfoS("Unauthorized admin request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == adminTunnelsPath {
+		h.serveTunnelList(w, r)
+		return
+	}
+	if r.URL.Path == adminMaintenancePath || strings.HasPrefix(r.URL.Path, adminMaintenancePrefix) {
+		h.serveMaintenance(w, r)
+		return
+	}
+
+	clusterName, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, adminTunnelsPrefix), "/")
+	if !ok || clusterName == "" || (action != "disconnect" && action != "drain") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action == "drain" {
+		h.serveDrain(w, r, clusterName)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = defaultDisconnectReason
+	}
+
+	err := h.tunnelManager.DisconnectTunnel(clusterName, reason)
+	if errors.Is(err, ErrTunnelNotFound) {
+		http.Error(w, fmt.Sprintf("Cluster %s not connected", clusterName), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.ErrorS(err, "Failed to disconnect tunnel", "cluster", clusterName)
+		http.Error(w, "Failed to disconnect tunnel", http.StatusInternalServerError)
+		return
+	}
+
+	logger.InfoS("Disconnected tunnel by admin request", "cluster", clusterName, "reason", reason, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDrain waits for the tunnel of the cluster to be idle and disconnects it, the wait is bounded by the timeout
+// query parameter, e.g. ?timeout=5m, and by the request. It answers 504 Gateway Timeout if the tunnel isn't idle in
+// time, the tunnel is kept then
+func (h *healthCheckHandler) serveDrain(w http.ResponseWriter, r *http.Request, clusterName string) {
+	ctx := r.Context()
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid timeout %q", value), http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	logger.InfoS("Draining tunnel by admin request", "cluster", clusterName, "remote_addr", r.RemoteAddr)
+	start := time.Now()
+	err := h.tunnelManager.DrainTunnel(ctx, clusterName, drainReason)
+	switch {
+	case errors.Is(err, ErrTunnelNotFound):
+		http.Error(w, fmt.Sprintf("Cluster %s not connected", clusterName), http.StatusNotFound)
+		return
+	case err != nil:
+		logger.InfoS("Tunnel not drained", "cluster", clusterName, "error", err)
+		http.Error(w, fmt.Sprintf("Tunnel of cluster %s not drained: %v", clusterName, err), http.StatusGatewayTimeout)
+		return
+	}
+
+	logger.InfoS("Drained tunnel by admin request", "cluster", clusterName, "duration", time.Since(start), "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveMaintenance lists the clusters under maintenance, or puts a cluster under maintenance or takes it out of it
+func (h *healthCheckHandler) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == adminMaintenancePath {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.tunnelManager.MaintenanceClusters()); err != nil {
+			logger.ErrorS(err, "Failed to write the clusters under maintenance")
+		}
+		return
+	}
+
+	clusterName := strings.TrimPrefix(r.URL.Path, adminMaintenancePrefix)
+	if clusterName == "" || strings.Contains(clusterName, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		allowIdentities := r.URL.Query()["allow"]
+		h.tunnelManager.SetMaintenance(clusterName, true, allowIdentities)
+		logger.InfoS("Cluster under maintenance by admin request", "cluster", clusterName, "allowed_identities", allowIdentities, "remote_addr", r.RemoteAddr)
+	case http.MethodDelete:
+		h.tunnelManager.SetMaintenance(clusterName, false, nil)
+		logger.InfoS("Cluster out of maintenance by admin request", "cluster", clusterName, "remote_addr", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveTunnelList writes the tunnels as JSON, sorted by cluster name
+func (h *healthCheckHandler) serveTunnelList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.tunnelManager.ListTunnels()); err != nil {
+		logger.ErrorS(err, "Failed to write tunnels")
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func TestAdminDisconnect(t *testing.T) {
+	cases := []struct {
+		name          string
+		method        string
+		path          string
+		token         string
+		expectStatus  int
+		expectDrained string
+	}{
+		{name: "no token", method: "POST", path: "/admin/tunnels/test-cluster/disconnect", expectStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: "POST", path: "/admin/tunnels/test-cluster/disconnect", token: "wrong", expectStatus: http.StatusUnauthorized},
+		{name: "wrong method", method: "GET", path: "/admin/tunnels/test-cluster/disconnect", token: "secret", expectStatus: http.StatusMethodNotAllowed},
+		{name: "unknown path", method: "POST", path: "/admin/tunnels/test-cluster/restart", token: "secret", expectStatus: http.StatusNotFound},
+		{name: "unknown cluster", method: "POST", path: "/admin/tunnels/other-cluster/disconnect", token: "secret", expectStatus: http.StatusNotFound},
+		{
+			name: "disconnect", method: "POST", path: "/admin/tunnels/test-cluster/disconnect?reason=stuck",
+			token: "secret", expectStatus: http.StatusNoContent, expectDrained: "stuck",
+		},
+		{
+			name: "default reason", method: "POST", path: "/admin/tunnels/test-cluster/disconnect",
+			token: "secret", expectStatus: http.StatusNoContent, expectDrained: defaultDisconnectReason,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tun := newTestTunnel(0)
+			tm := NewTunnelManager()
+			tm.tunnels[tun.clusterName] = tun
+			h := &healthCheckHandler{tunnelManager: tm, admin: NewTokenAuthenticator("secret")}
+
+			r := httptest.NewRequest(c.method, c.path, nil)
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", c.expectStatus, w.Code, w.Body.String())
+			}
+			if c.expectDrained == "" {
+				if tm.GetTunnel(tun.clusterName) == nil {
+					t.Errorf("expected the tunnel to be kept")
+				}
+				return
+			}
+
+			if tm.GetTunnel(tun.clusterName) != nil {
+				t.Errorf("expected the tunnel to be removed")
+			}
+			// The DRAIN is queued before the outgoing channel is closed
+			packet, ok := <-tun.outgoingChan
+			if !ok || packet.Code != v1.ControlCode_DRAIN || packet.ErrorMessage != c.expectDrained {
+				t.Fatalf("expected a DRAIN with reason %q, got %v", c.expectDrained, packet)
+			}
+			if _, ok := <-tun.outgoingChan; ok {
+				t.Errorf("expected the outgoing channel to be closed")
+			}
+		})
+	}
+}
+
+func TestAdminListTunnels(t *testing.T) {
+	tun := newTestTunnel(0)
+	tm := NewTunnelManager()
+	tm.tunnels[tun.clusterName] = tun
+	h := &healthCheckHandler{tunnelManager: tm, admin: NewTokenAuthenticator("secret")}
+
+	r := httptest.NewRequest("GET", "/admin/tunnels", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without a token, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var infos []TunnelInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatalf("failed to decode the tunnels: %v", err)
+	}
+	if len(infos) != 1 || infos[0].ClusterName != tun.clusterName || infos[0].TunnelID != tun.id {
+		t.Errorf("expected the tunnel of %s, got %+v", tun.clusterName, infos)
+	}
+
+	r = httptest.NewRequest("POST", "/admin/tunnels", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for POST, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	tm := NewTunnelManager()
+	h := &healthCheckHandler{tunnelManager: tm, admin: NewTokenAuthenticator("secret")}
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("PUT", "/admin/maintenance/test-cluster", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without a token, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := serve("POST", "/admin/maintenance/test-cluster", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for POST, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if w := serve("PUT", "/admin/maintenance/test-cluster/upgrade", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for an unknown path, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w := serve("PUT", "/admin/maintenance/test-cluster?allow=controller&allow=operator", "secret")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	w = serve("GET", "/admin/maintenance", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var clusters []ClusterMaintenance
+	if err := json.NewDecoder(w.Body).Decode(&clusters); err != nil {
+		t.Fatalf("failed to decode the clusters under maintenance: %v", err)
+	}
+	if len(clusters) != 1 || clusters[0].ClusterName != "test-cluster" || len(clusters[0].AllowedIdentities) != 2 {
+		t.Fatalf("expected test-cluster under maintenance for 2 identities, got %+v", clusters)
+	}
+
+	if w := serve("DELETE", "/admin/maintenance/test-cluster", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if clusters := tm.MaintenanceClusters(); len(clusters) != 0 {
+		t.Errorf("expected no cluster under maintenance, got %+v", clusters)
+	}
+}
+
+func TestDisconnectFailsPacketConns(t *testing.T) {
+	tun := newTestTunnel(0)
+	pc, err := tun.NewPacketConn(t.Context())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+
+	tun.Disconnect("stuck")
+
+	<-pc.Context().Done()
+	if pc.Err() == nil || pc.Err().Error() != "tunnel disconnected by hub: stuck" {
+		t.Errorf("expected the packet connection to fail with the reason, got %v", pc.Err())
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	tun := newTestTunnel(0)
+	tm := NewTunnelManager()
+	tm.tunnels[tun.clusterName] = tun
+	admin := newAdminHandler(tm, NewTokenAuthenticator("secret"), true)
+	// The handler of the users when the admin server is enabled
+	public := &healthCheckHandler{handler: &httpHandler{tunnelManager: tm}, tunnelManager: tm, adminServed: true}
+
+	cases := []struct {
+		name                      string
+		method                    string
+		path                      string
+		expectAdmin, expectPublic int
+		expectAdminBodyContains   string
+	}{
+		{name: "health", method: "GET", path: "/health", expectAdmin: http.StatusOK, expectPublic: http.StatusOK},
+		{name: "metrics", method: "GET", path: "/metrics", expectAdmin: http.StatusOK, expectPublic: http.StatusNotFound},
+		{
+			name: "debug tunnels", method: "GET", path: "/debug/tunnels",
+			expectAdmin: http.StatusOK, expectPublic: http.StatusNotFound, expectAdminBodyContains: tun.clusterName,
+		},
+		{name: "pprof", method: "GET", path: "/debug/pprof/", expectAdmin: http.StatusOK, expectPublic: http.StatusNotFound},
+		{name: "admin API", method: "POST", path: "/admin/tunnels/other-cluster/disconnect", expectAdmin: http.StatusNotFound, expectPublic: http.StatusNotFound},
+		{name: "unknown path", method: "GET", path: "/other", expectAdmin: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.path, nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			if w.Code != c.expectAdmin {
+				t.Errorf("expected status %d on the admin server, got %d: %s", c.expectAdmin, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), c.expectAdminBodyContains) {
+				t.Errorf("expected the response of the admin server to contain %q, got %s", c.expectAdminBodyContains, w.Body.String())
+			}
+
+			if c.expectPublic == 0 {
+				return
+			}
+			w = httptest.NewRecorder()
+			public.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+			if w.Code != c.expectPublic {
+				t.Errorf("expected status %d on the HTTP server, got %d: %s", c.expectPublic, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// The admin API authenticates the requests on the admin server too
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/admin/tunnels/test-cluster/disconnect", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	tun := newTestTunnel(0)
+	tm := NewTunnelManager()
+	tm.tunnels[tun.clusterName] = tun
+	h := &healthCheckHandler{tunnelManager: tm, admin: NewTokenAuthenticator("secret")}
+	drain := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/tunnels/test-cluster/drain"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := drain("?timeout=soon"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid timeout, got %d", w.Code)
+	}
+
+	// The tunnel is kept while a packet connection is open
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if w := drain("?timeout=100ms"); w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "1 packet connections still open") {
+		t.Fatalf("expected 504 while the packet connection is open, got %d: %s", w.Code, w.Body.String())
+	}
+	if tm.GetTunnel(tun.clusterName) == nil {
+		t.Fatalf("expected the tunnel to be kept")
+	}
+
+	// It's disconnected once the packet connection is closed
+	time.AfterFunc(100*time.Millisecond, func() { pc.Close(nil) })
+	if w := drain("?timeout=5s"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 once drained, got %d: %s", w.Code, w.Body.String())
+	}
+	if tm.GetTunnel(tun.clusterName) != nil {
+		t.Errorf("expected the tunnel to be removed")
+	}
+	for packet := range tun.outgoingChan {
+		if packet.Code == v1.ControlCode_DRAIN {
+			if packet.ErrorMessage != drainReason {
+				t.Errorf("expected a DRAIN with reason %q, got %q", drainReason, packet.ErrorMessage)
+			}
+			return
+		}
+	}
+	t.Errorf("expected a DRAIN to be sent to the agent")
+}
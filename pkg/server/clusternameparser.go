@@ -1,11 +1,23 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
+// ErrRateLimited is returned by a ClusterNameParser when the request is rejected by a rate limiter,
+// the hub responds with 429 Too Many Requests
+var ErrRateLimited = errors.New("too many requests")
+
+// maxRateLimitWait bounds how long a request waits for the rate limiter before it's rejected
+const maxRateLimitWait = 1 * time.Second
+
 // ClusterNameParser defines the interface for parsing cluster names from HTTP requests
 type ClusterNameParser interface {
 	ParseClusterName(r *http.Request) (clusterName string, err error)
@@ -19,12 +31,41 @@ func NewClusterNameParserImplt() ClusterNameParser {
 	return &clusterNameParserImplt{}
 }
 
-// ParseClusterName parses the cluster name from the HTTP request URI
+// ParseClusterName parses the cluster name from the first segment of the request path, duplicate slashes are
+// collapsed like the agent's RouterImpl does, e.g. //cluster1//api/v1/pods is routed to cluster1
 func (p *clusterNameParserImplt) ParseClusterName(r *http.Request) (clusterName string, err error) {
-	urlparams := strings.Split(r.RequestURI, "/")
-	if len(urlparams) < 2 {
-		err = fmt.Errorf("requestURI format not correct, path less than 2: %s", r.RequestURI)
-		return
+	for _, segment := range strings.Split(r.URL.EscapedPath(), "/") {
+		if segment != "" {
+			return segment, nil
+		}
+	}
+	return "", fmt.Errorf("requestURI format not correct, no cluster name in path: %s", r.RequestURI)
+}
+
+// rateLimitingClusterNameParser rate-limits the cluster name resolution of the inner ClusterNameParser
+type rateLimitingClusterNameParser struct {
+	inner   ClusterNameParser
+	limiter *rate.Limiter
+}
+
+// NewRateLimitingClusterNameParser wraps a ClusterNameParser so that requests are rate-limited before
+// the cluster name is resolved, this protects the hub from floods of requests with random path prefixes.
+// Requests that can't get a token from the limiter in time are rejected with 429 Too Many Requests.
+// Note that the cluster name is resolved once per client connection, keep-alive requests on a tunneled
+// connection are not rate-limited.
+func NewRateLimitingClusterNameParser(inner ClusterNameParser, limiter *rate.Limiter) ClusterNameParser {
+	return &rateLimitingClusterNameParser{
+		inner:   inner,
+		limiter: limiter,
+	}
+}
+
+// ParseClusterName waits for the rate limiter and then delegates to the inner parser
+func (p *rateLimitingClusterNameParser) ParseClusterName(r *http.Request) (clusterName string, err error) {
+	ctx, cancel := context.WithTimeout(r.Context(), maxRateLimitWait)
+	defer cancel()
+	if err := p.limiter.Wait(ctx); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrRateLimited, err)
 	}
-	return urlparams[1], nil
+	return p.inner.ParseClusterName(r)
 }
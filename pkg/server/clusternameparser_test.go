@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseClusterName(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestURI    string
+		expectCluster string
+		expectError   bool
+	}{
+		{name: "api path", requestURI: "/cluster1/api/v1/pods", expectCluster: "cluster1"},
+		{name: "query", requestURI: "/cluster1?timeout=32s", expectCluster: "cluster1"},
+		{name: "trailing slash", requestURI: "/cluster1/", expectCluster: "cluster1"},
+		{name: "duplicate slashes", requestURI: "//cluster1//api/v1/pods", expectCluster: "cluster1"},
+		{name: "root", requestURI: "/", expectError: true},
+		{name: "only slashes", requestURI: "///", expectError: true},
+	}
+
+	parser := NewClusterNameParserImplt()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clusterName, err := parser.ParseClusterName(httptest.NewRequest("GET", c.requestURI, nil))
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("expected an error, got cluster %q", clusterName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if clusterName != c.expectCluster {
+				t.Errorf("expected cluster %q, got %q", c.expectCluster, clusterName)
+			}
+		})
+	}
+}
+
+func FuzzParseClusterName(f *testing.F) {
+	for _, path := range []string{"/", "//", "/cluster1", "/cluster1/", "//cluster1//api/v1/pods", "/%2F/api"} {
+		f.Add(path)
+	}
+
+	parser := NewClusterNameParserImplt()
+	f.Fuzz(func(t *testing.T, path string) {
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path}, RequestURI: path}
+		clusterName, err := parser.ParseClusterName(r)
+		if err != nil {
+			return
+		}
+		if clusterName == "" || strings.Contains(clusterName, "/") {
+			t.Errorf("expected a non-empty cluster name without slashes for %q, got %q", path, clusterName)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"sync"
+	"time"
+)
+
+// ConnReuseConfig reuses the packet connections of the requests proxied by RoundTrip: once a response was read to
+// its end with keep-alive semantics, the packet connection and the agent's connection to its proxy are kept idle
+// for the next request to the same cluster, which saves the setup of a connection on the hub and the agent. The
+// requests to the HTTP listener keep the connection of their client instead
+type ConnReuseConfig struct {
+	// MaxIdleConnsPerCluster caps the idle connections kept for each cluster, defaults to
+	// DefaultMaxIdleConnsPerCluster. The idle connections count towards MaxPacketConnsPerTunnel
+	MaxIdleConnsPerCluster int
+	// IdleTimeout closes the connections idle for this long, defaults to DefaultConnReuseIdleTimeout. It must be
+	// shorter than the idle timeout of the connections of the agents, 5 minutes by default
+	IdleTimeout time.Duration
+	// MaxRequestsPerConn closes the connections once they served this many requests, 0 doesn't limit them
+	MaxRequestsPerConn int
+}
+
+// DefaultMaxIdleConnsPerCluster is the default cap on the idle connections kept for each cluster
+const DefaultMaxIdleConnsPerCluster = 4
+
+// DefaultConnReuseIdleTimeout is the default time the idle connections are kept for
+const DefaultConnReuseIdleTimeout = 90 * time.Second
+
+const (
+	connRetiredMaxRequests = "max_requests"
+	connRetiredIdleTimeout = "idle_timeout"
+	connRetiredPoolFull    = "pool_full"
+	connRetiredClosed      = "closed"
+)
+
+// roundTripConn is a packet connection carrying the requests of RoundTrip one after the other
+type roundTripConn struct {
+	cluster string
+	tunnel  *Tunnel
+	pc      *packetConnection
+	conn    *packetNetConn
+	// reader buffers the responses read from conn, it's kept with the connection
+	reader *bufio.Reader
+	// requests is the number of requests sent on the connection
+	requests int
+	// idleTimer retires the connection once it's idle for the idle timeout, set while it's in the pool
+	idleTimer *time.Timer
+}
+
+// connPool holds the idle connections of RoundTrip of each cluster, the most recently used ones are reused first
+type connPool struct {
+	config ConnReuseConfig
+	// retire closes a connection that isn't reused
+	retire func(rc *roundTripConn)
+
+	mu     sync.Mutex
+	idle   map[string][]*roundTripConn
+	closed bool
+}
+
+func newConnPool(config ConnReuseConfig, retire func(rc *roundTripConn)) *connPool {
+	if config.MaxIdleConnsPerCluster <= 0 {
+		config.MaxIdleConnsPerCluster = DefaultMaxIdleConnsPerCluster
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultConnReuseIdleTimeout
+	}
+	return &connPool{config: config, retire: retire, idle: make(map[string][]*roundTripConn)}
+}
+
+// get returns an idle connection of the tunnel, nil if there's none. The connections of the previous tunnels of the
+// cluster and the ones the agent closed are retired
+func (p *connPool) get(cluster string, tun *Tunnel) *roundTripConn {
+	p.mu.Lock()
+	var found *roundTripConn
+	var stale []*roundTripConn
+	conns := p.idle[cluster]
+	for len(conns) > 0 && found == nil {
+		rc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		rc.idleTimer.Stop()
+		if rc.tunnel == tun && rc.pc.quiet() {
+			found = rc
+		} else {
+			stale = append(stale, rc)
+		}
+	}
+	p.setIdle(cluster, conns)
+	p.mu.Unlock()
+
+	for _, rc := range stale {
+		p.retireConn(rc, connRetiredClosed)
+	}
+	return found
+}
+
+// put keeps the connection idle once its response was read to its end, it's retired if it served
+// MaxRequestsPerConn requests, the agent closed it or the cluster has MaxIdleConnsPerCluster idle connections
+func (p *connPool) put(rc *roundTripConn) {
+	reason := ""
+	switch {
+	case p.config.MaxRequestsPerConn > 0 && rc.requests >= p.config.MaxRequestsPerConn:
+		reason = connRetiredMaxRequests
+	case rc.reader.Buffered() > 0 || !rc.pc.quiet():
+		// The agent sent data after the response or closed the connection
+		reason = connRetiredClosed
+	}
+	if reason == "" {
+		p.mu.Lock()
+		switch {
+		case p.closed:
+			reason = connRetiredClosed
+		case len(p.idle[rc.cluster]) >= p.config.MaxIdleConnsPerCluster:
+			reason = connRetiredPoolFull
+		default:
+			rc.idleTimer = time.AfterFunc(p.config.IdleTimeout, func() { p.expire(rc) })
+			p.setIdle(rc.cluster, append(p.idle[rc.cluster], rc))
+		}
+		p.mu.Unlock()
+	}
+	if reason != "" {
+		p.retireConn(rc, reason)
+		return
+	}
+	logger.V(5).InfoS("Keeping idle connection for reuse", "cluster", rc.cluster, "packet_connection_id", rc.pc.ID(), "requests", rc.requests)
+}
+
+// expire retires the connection once it was idle for the idle timeout, unless it was reused meanwhile
+func (p *connPool) expire(rc *roundTripConn) {
+	p.mu.Lock()
+	conns := p.idle[rc.cluster]
+	i := -1
+	for j, c := range conns {
+		if c == rc {
+			i = j
+			break
+		}
+	}
+	if i >= 0 {
+		p.setIdle(rc.cluster, append(conns[:i:i], conns[i+1:]...))
+	}
+	p.mu.Unlock()
+	if i >= 0 {
+		p.retireConn(rc, connRetiredIdleTimeout)
+	}
+}
+
+// close retires the idle connections, the connections returned afterwards are retired too
+func (p *connPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = make(map[string][]*roundTripConn)
+	for cluster := range idle {
+		roundTripIdleConns.DeleteLabelValues(cluster)
+	}
+	p.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, rc := range conns {
+			rc.idleTimer.Stop()
+			p.retireConn(rc, connRetiredClosed)
+		}
+	}
+}
+
+// setIdle sets the idle connections of the cluster, p.mu must be held
+func (p *connPool) setIdle(cluster string, conns []*roundTripConn) {
+	if len(conns) == 0 {
+		delete(p.idle, cluster)
+		roundTripIdleConns.DeleteLabelValues(cluster)
+		return
+	}
+	p.idle[cluster] = conns
+	roundTripIdleConns.WithLabelValues(cluster).Set(float64(len(conns)))
+}
+
+func (p *connPool) retireConn(rc *roundTripConn, reason string) {
+	logger.V(5).InfoS("Closing connection not reused", "cluster", rc.cluster, "packet_connection_id", rc.pc.ID(),
+		"requests", rc.requests, "reason", reason)
+	roundTripConnsRetired.WithLabelValues(rc.cluster, reason).Inc()
+	p.retire(rc)
+}
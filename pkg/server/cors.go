@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server/middleware"
+)
+
+// CORSConfig allows browser-based consoles on other origins to call the clusters through the hub. The preflight
+// requests are answered by the hub and never reach the clusters
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to call the hub, "*" allows any origin without credentials, see
+	// middleware.NewCORSMiddleware
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed in preflight responses, defaults to middleware.DefaultCORSAllowedMethods
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed in preflight responses, the headers requested by the
+	// preflight are allowed if empty
+	AllowedHeaders []string
+	// MaxAge is how long browsers cache the preflight responses, defaults to middleware.DefaultCORSMaxAge
+	MaxAge time.Duration
+}
+
+// corsMiddleware adds the CORS headers to the responses to allowed origins and answers the preflight requests.
+// The preflights of other origins are rejected with 403, they're never tunneled to the clusters either
+func corsMiddleware(config CORSConfig) func(http.Handler) http.Handler {
+	return middleware.NewCORSMiddlewareWithOptions(middleware.CORSOptions{
+		AllowedOrigins:   config.AllowedOrigins,
+		AllowedMethods:   config.AllowedMethods,
+		AllowedHeaders:   config.AllowedHeaders,
+		MaxAge:           config.MaxAge,
+		RejectPreflights: true,
+	})
+}
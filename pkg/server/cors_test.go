@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	cases := []struct {
+		name          string
+		config        CORSConfig
+		method        string
+		headers       map[string]string
+		expectStatus  int
+		expectHeaders map[string]string
+		expectNext    bool
+	}{
+		{
+			name:   "preflight",
+			config: CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://ui.example.com",
+				"Access-Control-Request-Method":  "PUT",
+				"Access-Control-Request-Headers": "Authorization",
+			},
+			expectStatus: http.StatusNoContent,
+			expectHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://ui.example.com",
+				"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+				"Access-Control-Allow-Headers": "Authorization",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name: "preflight with configured methods and headers",
+			config: CORSConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"},
+				AllowedHeaders: []string{"Authorization", "Content-Type"}, MaxAge: time.Hour},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://other.example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "X-Custom",
+			},
+			expectStatus: http.StatusNoContent,
+			expectHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Allow-Methods":     "GET",
+				"Access-Control-Allow-Headers":     "Authorization, Content-Type",
+				"Access-Control-Max-Age":           "3600",
+			},
+		},
+		{
+			name:         "preflight from origin not allowed",
+			config:       CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}},
+			method:       http.MethodOptions,
+			headers:      map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"},
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:          "request",
+			config:        CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}},
+			method:        http.MethodGet,
+			headers:       map[string]string{"Origin": "https://ui.example.com"},
+			expectStatus:  http.StatusOK,
+			expectHeaders: map[string]string{"Access-Control-Allow-Origin": "https://ui.example.com", "Vary": "Origin"},
+			expectNext:    true,
+		},
+		{
+			name:         "request from origin not allowed",
+			config:       CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}},
+			method:       http.MethodGet,
+			headers:      map[string]string{"Origin": "https://evil.example.com"},
+			expectStatus: http.StatusOK,
+			expectNext:   true,
+		},
+		{
+			name:         "OPTIONS without origin",
+			config:       CORSConfig{AllowedOrigins: []string{"*"}},
+			method:       http.MethodOptions,
+			expectStatus: http.StatusOK,
+			expectNext:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			next := false
+			handler := corsMiddleware(c.config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next = true
+			}))
+			r := httptest.NewRequest(c.method, "/cluster1/api", nil)
+			for key, value := range c.headers {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != c.expectStatus {
+				t.Errorf("expected status %d, got %d", c.expectStatus, w.Code)
+			}
+			if next != c.expectNext {
+				t.Errorf("expected the request to be passed on %v, got %v", c.expectNext, next)
+			}
+			for key, value := range c.expectHeaders {
+				if got := w.Header().Get(key); got != value {
+					t.Errorf("expected %s %q, got %q", key, value, got)
+				}
+			}
+			if c.expectHeaders == nil && w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Errorf("expected no CORS headers, got %v", w.Header())
+			}
+		})
+	}
+}
+
+func TestMethodPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.CORS = &CORSConfig{AllowedOrigins: []string{"*"}}
+	config.MethodPolicy = func(cluster, method string) error {
+		if cluster == "read-only" && method != http.MethodGet && method != http.MethodOptions {
+			return errors.New("cluster is read-only")
+		}
+		return nil
+	}
+	s, err := New(config, NewClusterNameParserImplt())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	cases := []struct {
+		name         string
+		method       string
+		path         string
+		preflight    bool
+		expectStatus int
+	}{
+		{name: "denied", method: http.MethodDelete, path: "/read-only/api/v1/pods/a", expectStatus: http.StatusMethodNotAllowed},
+		// The requests allowed are tunneled, there is no tunnel to the cluster
+		{name: "allowed method", method: http.MethodGet, path: "/read-only/api/v1/pods", expectStatus: http.StatusServiceUnavailable},
+		{name: "other cluster", method: http.MethodDelete, path: "/cluster1/api/v1/pods/a", expectStatus: http.StatusServiceUnavailable},
+		// The preflight of a denied method is answered by the hub, the request itself is denied
+		{name: "preflight", method: http.MethodOptions, path: "/read-only/api/v1/pods/a", preflight: true, expectStatus: http.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.path, nil)
+			if c.preflight {
+				r.Header.Set("Origin", "https://ui.example.com")
+				r.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+			}
+			w := httptest.NewRecorder()
+			s.httpServer.Handler.ServeHTTP(w, r)
+			if w.Code != c.expectStatus {
+				t.Errorf("expected status %d, got %d: %s", c.expectStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+)
+
+// maxPacketDataSize bounds the data of the packets the HTTP/2 connections to the agents write, like the data read
+// from a hijacked client connection
+const maxPacketDataSize = 32 * 1024
+
+// serveHTTP2 proxies an HTTP/2 request, e.g. a gRPC call, over an HTTP/2 connection to the proxy of the agent carried
+// by the packet connection. HTTP/2 connections can't be hijacked like HTTP/1.x ones, and gRPC needs HTTP/2 end to end
+// for its streams and trailers: the agent forwards gRPC requests to the target with an HTTP/2 transport
+func (h *httpHandler) serveHTTP2(w http.ResponseWriter, r *http.Request, pc *packetConnection, clusterName string) {
+	conn := &packetNetConn{
+		pc:     pc,
+		opened: make(chan struct{}),
+		onRead: func() { h.extendWriteDeadline(pc) },
+		// Close the agent's connection to the proxy once the request is done, the HTTP/2 connection isn't reused
+		onClose: func() { closeClientDisconnected(pc) },
+	}
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		logger.ErrorS(err, "Failed to establish HTTP/2 connection to agent", "cluster", clusterName)
+		http.Error(w, "Failed to establish tunnel", http.StatusBadGateway)
+		return
+	}
+	defer cc.Close()
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The agent routes the request by its path, like the requests on hijacked connections
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = r.Host
+			pr.Out.Host = r.Host
+		},
+		Transport: cc,
+		// Flush the responses as they come, e.g. the messages of gRPC server streams
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.ErrorS(err, "Failed to proxy HTTP/2 request to agent", "cluster", clusterName, "packet_connection_id", pc.ID())
+			if status.Code(pc.Err()) == codes.DeadlineExceeded || pc.readDeadlineExceeded() {
+				http.Error(w, pc.Err().Error(), http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	if h.rewriter != nil {
+		rp.ModifyResponse = func(resp *http.Response) error {
+			return h.rewriter.Rewrite(clusterName, resp)
+		}
+	}
+
+	logger.V(4).InfoS("Established HTTP/2 tunnel", "cluster", clusterName, "packet_connection_id", pc.ID())
+	rp.ServeHTTP(w, r)
+}
+
+// packetNetConn is a net.Conn carrying the data of the packet connection, for the HTTP/2 connections to the agents
+type packetNetConn struct {
+	pc *packetConnection
+	// onRead is called when data from the agent is read, onClose closes the packet connection
+	onRead  func()
+	onClose func()
+	// pending is the data of the last packet not read yet, only accessed by Read
+	pending []byte
+
+	// The agent dispatches the packets of a connection it doesn't have yet concurrently, a later packet could open
+	// the connection before the HTTP/2 preface. Only the first write is sent until the agent answers on opened
+	sent       atomic.Bool
+	opened     chan struct{}
+	openedOnce sync.Once
+	closeOnce  sync.Once
+}
+
+func (c *packetNetConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		packet, err := c.pc.Recv()
+		c.openedOnce.Do(func() { close(c.opened) })
+		if err != nil {
+			if err := c.pc.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		c.pc.record(capture.FromAgent, packet)
+		if packet.Code == v1.ControlCode_ERROR {
+			return 0, fmt.Errorf("agent error: %s", errorPacketMessage(packet))
+		}
+		c.pending = packet.Data
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if c.onRead != nil {
+		c.onRead()
+	}
+	return n, nil
+}
+
+func (c *packetNetConn) Write(b []byte) (int, error) {
+	if c.sent.Swap(true) {
+		select {
+		case <-c.opened:
+		case <-c.pc.Context().Done():
+			return 0, net.ErrClosed
+		}
+	}
+
+	written := 0
+	for written < len(b) {
+		// The packet keeps the data, b may be reused by the caller
+		data := make([]byte, min(len(b)-written, maxPacketDataSize))
+		copy(data, b[written:])
+		if err := c.pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: data}); err != nil {
+			return written, err
+		}
+		written += len(data)
+	}
+	return written, nil
+}
+
+func (c *packetNetConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return nil
+}
+
+func (c *packetNetConn) LocalAddr() net.Addr  { return packetNetAddr{} }
+func (c *packetNetConn) RemoteAddr() net.Addr { return packetNetAddr{} }
+
+// The deadlines are not supported, the packet connection is bounded by its context
+
+func (c *packetNetConn) SetDeadline(t time.Time) error      { return nil }
+func (c *packetNetConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *packetNetConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// packetNetAddr is the address of a packetNetConn
+type packetNetAddr struct{}
+
+func (packetNetAddr) Network() string { return "tunnel" }
+func (packetNetAddr) String() string  { return "tunnel" }
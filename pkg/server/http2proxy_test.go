@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func TestPacketNetConn(t *testing.T) {
+	tun := newTestTunnel(0)
+	pc, err := tun.NewPacketConn(t.Context())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	conn := &packetNetConn{pc: pc, opened: make(chan struct{}), onClose: func() { pc.Close(nil) }}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("preface")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if packet := <-tun.outgoingChan; string(packet.Data) != "preface" || packet.ConnId != pc.ID() {
+		t.Fatalf("expected the preface to be sent, got %v", packet)
+	}
+
+	// The following writes wait for the agent to answer, so they can't open the connection before the preface
+	large := bytes.Repeat([]byte("x"), 2*maxPacketDataSize+1)
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(large)
+		written <- err
+	}()
+	select {
+	case packet := <-tun.outgoingChan:
+		t.Fatalf("expected no packet before the agent answered, got %d bytes", len(packet.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := pc.deliver(&v1.Packet{Code: v1.ControlCode_DATA, Data: []byte("settings")}); err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+	buf := make([]byte, 4)
+	for _, expected := range []string{"sett", "ings"} {
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != expected {
+			t.Fatalf("expected to read %q, got %q, %v", expected, buf[:n], err)
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	// The data is split into packets of at most maxPacketDataSize
+	for _, size := range []int{maxPacketDataSize, maxPacketDataSize, 1} {
+		if packet := <-tun.outgoingChan; len(packet.Data) != size {
+			t.Fatalf("expected a packet of %d bytes, got %d", size, len(packet.Data))
+		}
+	}
+
+	if err := pc.deliver(&v1.Packet{Code: v1.ControlCode_ERROR, ErrorMessage: "connection refused"}); err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+	if _, err := conn.Read(buf); err == nil || err.Error() != "agent error: connection refused" {
+		t.Errorf("expected the error of the agent, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrNoCluster is returned by a HubAdapter when no cluster can take the request, the hub responds with
+// 503 Service Unavailable
+var ErrNoCluster = errors.New("no cluster available")
+
+// HubAdapter selects the cluster of each request the hub receives in place of the ClusterNameParser, e.g. to use the
+// hub as a load balancer across clusters serving the same backends. The request is tunneled unchanged, the agent of
+// the selected cluster routes it by its path
+type HubAdapter interface {
+	// SelectCluster returns the name of the cluster to tunnel the request to
+	SelectCluster(r *http.Request) (string, error)
+}
+
+// roundRobinAdapter is the HubAdapter of NewRoundRobinAdapter
+type roundRobinAdapter struct {
+	tunnelManager *TunnelManager
+	// next is incremented by each request, it rotates the cluster preferred among the least loaded ones
+	next atomic.Uint64
+}
+
+// NewRoundRobinAdapter returns a HubAdapter selecting the cluster whose tunnel has the fewest active connections in
+// tunnelManager, the ties are broken in a round-robin. It fails with ErrNoCluster if no agent is connected
+func NewRoundRobinAdapter(tunnelManager *TunnelManager) HubAdapter {
+	return &roundRobinAdapter{tunnelManager: tunnelManager}
+}
+
+func (a *roundRobinAdapter) SelectCluster(r *http.Request) (string, error) {
+	tunnels := a.tunnelManager.ListTunnels()
+	if len(tunnels) == 0 {
+		return "", ErrNoCluster
+	}
+	start := int((a.next.Add(1) - 1) % uint64(len(tunnels)))
+	selected := tunnels[start]
+	for i := 1; i < len(tunnels); i++ {
+		if t := tunnels[(start+i)%len(tunnels)]; t.ActiveConnections < selected.ActiveConnections {
+			selected = t
+		}
+	}
+	return selected.ClusterName, nil
+}
+
+// hubAdapterParser is the ClusterNameParser of the hub when a HubAdapter is set
+type hubAdapterParser struct {
+	adapter HubAdapter
+}
+
+func (p *hubAdapterParser) ParseClusterName(r *http.Request) (string, error) {
+	return p.adapter.SelectCluster(r)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoundRobinAdapter(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+	adapter := NewRoundRobinAdapter(tm)
+	r := httptest.NewRequest("GET", "/api/v1/pods", nil)
+
+	if _, err := adapter.SelectCluster(r); !errors.Is(err, ErrNoCluster) {
+		t.Fatalf("expected ErrNoCluster without tunnels, got %v", err)
+	}
+
+	for _, clusterName := range []string{"cluster-a", "cluster-b", "cluster-c"} {
+		if _, err := tm.NewTunnel(context.Background(), clusterName, nil); err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+	}
+
+	// The idle clusters take the requests in turn
+	counts := make(map[string]int)
+	for range 9 {
+		clusterName, err := adapter.SelectCluster(r)
+		if err != nil {
+			t.Fatalf("failed to select a cluster: %v", err)
+		}
+		counts[clusterName]++
+	}
+	for _, clusterName := range []string{"cluster-a", "cluster-b", "cluster-c"} {
+		if counts[clusterName] != 3 {
+			t.Errorf("expected 3 requests to %s, got %v", clusterName, counts)
+		}
+	}
+
+	// The least loaded cluster is selected
+	openPacketConns(t, tm.GetTunnel("cluster-a"), 2)
+	openPacketConns(t, tm.GetTunnel("cluster-c"), 1)
+	for range 3 {
+		if clusterName, err := adapter.SelectCluster(r); err != nil || clusterName != "cluster-b" {
+			t.Errorf("expected cluster-b, got %q, %v", clusterName, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // the hashes of the signature algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJWKSCacheTTL is how long the keys fetched from the JWKS URL are used before they're fetched again
+const DefaultJWKSCacheTTL = time.Hour
+
+// jwksFetchTimeout bounds a fetch of the JWKS
+const jwksFetchTimeout = 5 * time.Second
+
+// minJWKSRefreshInterval rate limits the fetches of the JWKS for the tokens signed by an unknown key, e.g. after
+// the keys were rotated, so that forged tokens can't flood the JWKS URL
+const minJWKSRefreshInterval = 10 * time.Second
+
+// maxJWKSResponseSize bounds the JWKS read
+const maxJWKSResponseSize = 1024 * 1024
+
+// jwtClockSkew is the clock skew tolerated when checking the exp and nbf claims
+const jwtClockSkew = time.Minute
+
+// jwk is a key of a JSON Web Key Set, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// N and E are the modulus and exponent of the RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// Crv, X and Y are the curve and coordinates of the EC keys, Crv and X the curve and key of the OKP keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtKey is a public key of the JWKS the tokens are verified with
+type jwtKey struct {
+	kid string
+	// alg restricts the key to a signature algorithm, any algorithm of the type of the key if empty
+	alg string
+	key crypto.PublicKey
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClusterNameParser resolves the cluster names from a claim of the JWT bearer token of the requests
+type jwtClusterNameParser struct {
+	clusterClaim string
+	jwksURL      string
+	client       *http.Client
+	ttl          time.Duration
+	now          func() time.Time
+
+	// fetchMu serializes the fetches of the JWKS
+	fetchMu sync.Mutex
+	// mu protects keys and the times of the last fetch
+	mu        sync.Mutex
+	keys      []jwtKey
+	fetchedAt time.Time
+	// attemptedAt is the time of the last fetch, whether it succeeded or not
+	attemptedAt time.Time
+}
+
+// NewJWTClusterNameParser creates a ClusterNameParser routing the requests to the cluster in the clusterClaim of
+// the JWT bearer token of their Authorization header, e.g. a token issued by an API gateway. The signature of the
+// token is verified with the keys of the JSON Web Key Set at jwksURL, fetched on the first request and again after
+// DefaultJWKSCacheTTL, or when a token is signed by a key it doesn't have, e.g. after a key rotation. The stale keys
+// are kept if a fetch fails. RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512 and EdDSA signatures are
+// supported. The exp and nbf claims are checked, the issuer and the audience are not.
+func NewJWTClusterNameParser(clusterClaim string, jwksURL string) ClusterNameParser {
+	return &jwtClusterNameParser{
+		clusterClaim: clusterClaim,
+		jwksURL:      jwksURL,
+		client:       &http.Client{},
+		ttl:          DefaultJWKSCacheTTL,
+		now:          time.Now,
+	}
+}
+
+// ParseClusterName verifies the bearer token of the request and returns its cluster claim
+func (p *jwtClusterNameParser) ParseClusterName(r *http.Request) (clusterName string, err error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("missing bearer token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT, it must have 3 parts")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("malformed JWT header: %w", err)
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return "", fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed JWT signature: %w", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := p.verify(r.Context(), header, hash, signed, signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	if err := checkJWTTimes(claims, p.now()); err != nil {
+		return "", err
+	}
+	clusterName, ok = claims[p.clusterClaim].(string)
+	if !ok || clusterName == "" || strings.Contains(clusterName, "/") {
+		return "", fmt.Errorf("JWT claim %s is not a valid cluster name: %v", p.clusterClaim, claims[p.clusterClaim])
+	}
+	return clusterName, nil
+}
+
+// verify verifies the signature with the keys of the JWKS, fetching them again if none of them matches the header
+func (p *jwtClusterNameParser) verify(ctx context.Context, header jwtHeader, hash crypto.Hash, signed, signature []byte) error {
+	keys, err := p.keySet(ctx, false)
+	if err != nil {
+		return err
+	}
+	candidates := matchingJWTKeys(keys, header)
+	if len(candidates) == 0 {
+		if keys, err = p.keySet(ctx, true); err != nil {
+			return err
+		}
+		candidates = matchingJWTKeys(keys, header)
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no key of the JWKS matches the JWT key %q and algorithm %s", header.Kid, header.Alg)
+	}
+
+	digest := signed
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	for _, key := range candidates {
+		if verifyJWTSignature(header.Alg, hash, key.key, digest, signature) {
+			return nil
+		}
+	}
+	return errors.New("invalid JWT signature")
+}
+
+// keySet returns the keys of the JWKS, fetched again if they're older than the TTL, or if refresh is set and they
+// weren't fetched within minJWKSRefreshInterval
+func (p *jwtClusterNameParser) keySet(ctx context.Context, refresh bool) ([]jwtKey, error) {
+	stale := func() bool {
+		now := p.now()
+		if p.fetchedAt.IsZero() || now.Sub(p.fetchedAt) >= p.ttl {
+			// Don't retry a failing JWKS URL on every request
+			return p.attemptedAt.IsZero() || now.Sub(p.attemptedAt) >= minJWKSRefreshInterval
+		}
+		return refresh && now.Sub(p.attemptedAt) >= minJWKSRefreshInterval
+	}
+
+	cached := func(keys []jwtKey) ([]jwtKey, error) {
+		if keys == nil {
+			return nil, errors.New("the JWKS couldn't be fetched")
+		}
+		return keys, nil
+	}
+
+	p.mu.Lock()
+	keys, fetch := p.keys, stale()
+	p.mu.Unlock()
+	if !fetch {
+		return cached(keys)
+	}
+
+	p.fetchMu.Lock()
+	defer p.fetchMu.Unlock()
+	// Another request may have fetched them while this one waited
+	p.mu.Lock()
+	keys, fetch = p.keys, stale()
+	if fetch {
+		p.attemptedAt = p.now()
+	}
+	p.mu.Unlock()
+	if !fetch {
+		return cached(keys)
+	}
+
+	fetched, err := p.fetch(ctx)
+	if err != nil {
+		if keys == nil {
+			return nil, err
+		}
+		logger.ErrorS(err, "Failed to refresh the JWKS, using the keys fetched before", "url", p.jwksURL)
+		return keys, nil
+	}
+	p.mu.Lock()
+	p.keys, p.fetchedAt = fetched, p.now()
+	p.mu.Unlock()
+	return fetched, nil
+}
+
+// fetch fetches and parses the JWKS, the keys that aren't signature keys of a supported type are skipped
+func (p *jwtClusterNameParser) fetch(ctx context.Context) ([]jwtKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the JWKS: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS URL returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logger.V(4).InfoS("Skipping a key of the JWKS", "url", p.jwksURL, "kid", k.Kid, "reason", err)
+			continue
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key of the JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 2 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+			"P-521": {elliptic.P521(), ecdh.P521()},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		size := (c.curve.Params().BitSize + 7) / 8
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid coordinates")
+		}
+		// The uncompressed point is rejected if it's not on the curve
+		if _, err := c.ecdh.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key on curve %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// jwtHashes are the hashes of the supported signature algorithms, EdDSA signs the message itself
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// jwtECDSACurves are the curves of the ECDSA signature algorithms
+var jwtECDSACurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// matchingJWTKeys returns the keys that can verify the signature of the token: those of its kid, or all of them
+// if it has none, restricted to the ones of its algorithm
+func matchingJWTKeys(keys []jwtKey, header jwtHeader) []jwtKey {
+	var matching []jwtKey
+	for _, key := range keys {
+		if header.Kid != "" && key.kid != header.Kid {
+			continue
+		}
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		matching = append(matching, key)
+	}
+	return matching
+}
+
+// verifyJWTSignature returns whether the signature of the digest was made by the key with the algorithm
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if jwtECDSACurves[alg] != key.Curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, digest, signature)
+	}
+	return false
+}
+
+// checkJWTTimes returns an error if the token is expired or not valid yet
+func checkJWTTimes(claims map[string]any, now time.Time) error {
+	if exp, ok := claims["exp"]; ok {
+		seconds, ok := exp.(float64)
+		if !ok {
+			return fmt.Errorf("invalid JWT exp claim: %v", exp)
+		}
+		if now.Add(-jwtClockSkew).After(time.Unix(int64(seconds), 0)) {
+			return errors.New("JWT is expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		seconds, ok := nbf.(float64)
+		if !ok {
+			return fmt.Errorf("invalid JWT nbf claim: %v", nbf)
+		}
+		if now.Add(jwtClockSkew).Before(time.Unix(int64(seconds), 0)) {
+			return errors.New("JWT is not valid yet")
+		}
+	}
+	return nil
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeJWKInt decodes a base64url encoded big-endian unsigned integer of a JWK
+func decodeJWKInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
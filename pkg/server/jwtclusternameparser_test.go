@@ -0,0 +1,324 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves the JWKS of its keys, it counts the fetches and fails them while failing is set
+type jwksServer struct {
+	*httptest.Server
+	calls   atomic.Int32
+	failing atomic.Bool
+
+	mu   sync.Mutex
+	keys []jwk
+}
+
+func newJWKSServer(t *testing.T, keys ...jwk) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		if s.failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) addKey(key jwk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+}
+
+// newJWK returns the JWK of the public key
+func newJWK(t *testing.T, kid string, key crypto.PublicKey) jwk {
+	t.Helper()
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Kid: kid, Crv: key.Curve.Params().Name, X: encode(key.X.FillBytes(make([]byte, size))), Y: encode(key.Y.FillBytes(make([]byte, size)))}
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: encode(key)}
+	}
+	t.Fatalf("unsupported key %T", key)
+	return jwk{}
+}
+
+// signJWT returns a token of the claims signed by the key with the algorithm
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	encodeJSON := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encodeJSON(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeJSON(claims)
+
+	hash := jwtHashes[alg]
+	digest := []byte(signed)
+	if hash != 0 {
+		h := hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, digest); err == nil {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	default:
+		signature, err = key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwtTestKeys are the keys of the tests, generated once
+type jwtTestKeys struct {
+	rsa     *rsa.PrivateKey
+	p256    *ecdsa.PrivateKey
+	p384    *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) jwtTestKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate the RSA key: %v", err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the P-256 key: %v", err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the P-384 key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the Ed25519 key: %v", err)
+	}
+	return jwtTestKeys{rsa: rsaKey, p256: p256, p384: p384, ed25519: edKey}
+}
+
+func (k jwtTestKeys) jwks(t *testing.T) []jwk {
+	return []jwk{
+		newJWK(t, "rsa", &k.rsa.PublicKey),
+		newJWK(t, "p256", &k.p256.PublicKey),
+		newJWK(t, "p384", &k.p384.PublicKey),
+		newJWK(t, "ed25519", k.ed25519.Public()),
+		// The keys that aren't signature keys are skipped
+		{Kty: "RSA", Kid: "encryption", Use: "enc"},
+	}
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/v1/pods", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTClusterNameParser(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks := newJWKSServer(t, keys.jwks(t)...)
+	parser := NewJWTClusterNameParser("cluster", jwks.URL).(*jwtClusterNameParser)
+	now := time.Now()
+	parser.now = func() time.Time { return now }
+
+	parse := func(token, expectCluster string) {
+		t.Helper()
+		clusterName, err := parser.ParseClusterName(bearerRequest(token))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if clusterName != expectCluster {
+			t.Errorf("expected cluster %q, got %q", expectCluster, clusterName)
+		}
+	}
+	claims := func(cluster string) map[string]any {
+		return map[string]any{"cluster": cluster, "exp": now.Add(time.Hour).Unix(), "nbf": now.Unix()}
+	}
+
+	parse(signJWT(t, "RS256", "rsa", keys.rsa, claims("cluster-rs256")), "cluster-rs256")
+	parse(signJWT(t, "RS512", "rsa", keys.rsa, claims("cluster-rs512")), "cluster-rs512")
+	parse(signJWT(t, "PS256", "rsa", keys.rsa, claims("cluster-ps256")), "cluster-ps256")
+	parse(signJWT(t, "ES256", "p256", keys.p256, claims("cluster-es256")), "cluster-es256")
+	parse(signJWT(t, "ES384", "p384", keys.p384, claims("cluster-es384")), "cluster-es384")
+	parse(signJWT(t, "EdDSA", "ed25519", keys.ed25519, claims("cluster-eddsa")), "cluster-eddsa")
+	// A token without a kid is verified with the keys of its algorithm
+	parse(signJWT(t, "ES256", "", keys.p256, claims("cluster-no-kid")), "cluster-no-kid")
+	if n := jwks.calls.Load(); n != 1 {
+		t.Errorf("expected the JWKS to be fetched once, got %d fetches", n)
+	}
+
+	// A token signed by a rotated key fetches the JWKS again
+	_, rotated, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the rotated key: %v", err)
+	}
+	jwks.addKey(newJWK(t, "rotated", rotated.Public()))
+	now = now.Add(minJWKSRefreshInterval)
+	parse(signJWT(t, "EdDSA", "rotated", rotated, claims("cluster-rotated")), "cluster-rotated")
+	if n := jwks.calls.Load(); n != 2 {
+		t.Errorf("expected the JWKS to be fetched again for the rotated key, got %d fetches", n)
+	}
+
+	// The fetches for unknown keys are rate limited
+	if _, err := parser.ParseClusterName(bearerRequest(signJWT(t, "EdDSA", "unknown", rotated, claims("cluster-unknown")))); err == nil {
+		t.Errorf("expected a token of an unknown key to be rejected")
+	}
+	if n := jwks.calls.Load(); n != 2 {
+		t.Errorf("expected the JWKS not to be fetched again so soon, got %d fetches", n)
+	}
+
+	// The keys are fetched again once they expire
+	now = now.Add(DefaultJWKSCacheTTL)
+	parse(signJWT(t, "RS256", "rsa", keys.rsa, claims("cluster-refreshed")), "cluster-refreshed")
+	if n := jwks.calls.Load(); n != 3 {
+		t.Errorf("expected the expired JWKS to be fetched again, got %d fetches", n)
+	}
+}
+
+func TestJWTClusterNameParserErrors(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks := newJWKSServer(t, keys.jwks(t)...)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate the other RSA key: %v", err)
+	}
+	now := time.Now()
+	valid := map[string]any{"cluster": "cluster1", "exp": now.Add(time.Hour).Unix()}
+	with := func(claim string, value any) map[string]any {
+		claims := map[string]any{"cluster": "cluster1"}
+		claims[claim] = value
+		return claims
+	}
+
+	cases := []struct {
+		name          string
+		authorization string
+		expectErrPart string
+	}{
+		{name: "no token", expectErrPart: "missing bearer token"},
+		{name: "basic auth", authorization: "Basic dXNlcjpwYXNz", expectErrPart: "missing bearer token"},
+		{name: "malformed", authorization: "Bearer not-a-jwt", expectErrPart: "3 parts"},
+		{
+			name:          "none algorithm",
+			authorization: "Bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"cluster":"cluster1"}`)) + ".",
+			expectErrPart: `unsupported JWT algorithm "none"`,
+		},
+		{name: "HMAC algorithm", authorization: "Bearer " + strings.Replace(signJWT(t, "RS256", "rsa", keys.rsa, valid), "eyJhbGciOiJSUzI1NiI", "eyJhbGciOiJIUzI1NiI", 1), expectErrPart: `unsupported JWT algorithm "HS256"`},
+		{name: "unknown signer", authorization: "Bearer " + signJWT(t, "RS256", "rsa", otherKey, valid), expectErrPart: "invalid JWT signature"},
+		{name: "algorithm of another curve", authorization: "Bearer " + signJWT(t, "ES256", "p384", keys.p384, valid), expectErrPart: "invalid JWT signature"},
+		{name: "algorithm of another key type", authorization: "Bearer " + signJWT(t, "ES256", "rsa", keys.p256, valid), expectErrPart: "invalid JWT signature"},
+		{name: "expired", authorization: "Bearer " + signJWT(t, "EdDSA", "ed25519", keys.ed25519, with("exp", now.Add(-time.Hour).Unix())), expectErrPart: "JWT is expired"},
+		{name: "not valid yet", authorization: "Bearer " + signJWT(t, "EdDSA", "ed25519", keys.ed25519, with("nbf", now.Add(time.Hour).Unix())), expectErrPart: "JWT is not valid yet"},
+		{name: "invalid exp", authorization: "Bearer " + signJWT(t, "EdDSA", "ed25519", keys.ed25519, with("exp", "tomorrow")), expectErrPart: "invalid JWT exp claim"},
+		{name: "missing claim", authorization: "Bearer " + signJWT(t, "EdDSA", "ed25519", keys.ed25519, map[string]any{"sub": "alice"}), expectErrPart: "JWT claim cluster is not a valid cluster name"},
+		{name: "non-string claim", authorization: "Bearer " + signJWT(t, "EdDSA", "ed25519", keys.ed25519, map[string]any{"cluster": 42}), expectErrPart: "JWT claim cluster is not a valid cluster name"},
+		{name: "claim with a slash", authorization: "Bearer " + signJWT(t, "EdDSA", "ed25519", keys.ed25519, map[string]any{"cluster": "a/b"}), expectErrPart: "JWT claim cluster is not a valid cluster name"},
+	}
+
+	tampered := strings.Split(signJWT(t, "RS256", "rsa", keys.rsa, valid), ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"cluster":"cluster2"}`))
+	cases = append(cases, struct {
+		name          string
+		authorization string
+		expectErrPart string
+	}{name: "tampered claims", authorization: "Bearer " + strings.Join(tampered, "."), expectErrPart: "invalid JWT signature"})
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			parser := NewJWTClusterNameParser("cluster", jwks.URL).(*jwtClusterNameParser)
+			parser.now = func() time.Time { return now }
+			r := httptest.NewRequest("GET", "/api/v1/pods", nil)
+			if c.authorization != "" {
+				r.Header.Set("Authorization", c.authorization)
+			}
+			_, err := parser.ParseClusterName(r)
+			if err == nil || !strings.Contains(err.Error(), c.expectErrPart) {
+				t.Fatalf("expected an error containing %q, got %v", c.expectErrPart, err)
+			}
+		})
+	}
+}
+
+func TestJWTClusterNameParserJWKSFailure(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks := newJWKSServer(t, keys.jwks(t)...)
+	parser := NewJWTClusterNameParser("cluster", jwks.URL).(*jwtClusterNameParser)
+	now := time.Now()
+	parser.now = func() time.Time { return now }
+	token := signJWT(t, "ES256", "p256", keys.p256, map[string]any{"cluster": "cluster1"})
+	parse := func() error {
+		_, err := parser.ParseClusterName(bearerRequest(token))
+		return err
+	}
+
+	jwks.failing.Store(true)
+	if err := parse(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected the failed fetch to be returned, got %v", err)
+	}
+
+	// A failing JWKS URL isn't fetched again on every request
+	jwks.failing.Store(false)
+	if err := parse(); err == nil {
+		t.Fatalf("expected the token to be rejected until the JWKS is fetched again")
+	}
+	if n := jwks.calls.Load(); n != 1 {
+		t.Errorf("expected a single fetch, got %d", n)
+	}
+	now = now.Add(minJWKSRefreshInterval)
+	if err := parse(); err != nil {
+		t.Fatalf("unexpected error once the JWKS is fetched: %v", err)
+	}
+
+	// The stale keys are kept while the JWKS can't be fetched again
+	jwks.failing.Store(true)
+	now = now.Add(DefaultJWKSCacheTTL)
+	if err := parse(); err != nil {
+		t.Fatalf("expected the stale keys to be used, got %v", err)
+	}
+	if n := jwks.calls.Load(); n != 3 {
+		t.Errorf("expected the expired JWKS to be fetched again, got %d fetches", n)
+	}
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ForwardedByHeader is set on the requests a replica forwards to the replica holding the tunnel of their cluster,
+// to the URL of the forwarding replica. The requests carrying it are never forwarded again
+const ForwardedByHeader = "X-Multiclustertunnel-Forwarded-By"
+
+// TunnelLocator shares which hub replica holds the tunnel of each cluster, so that a replica receiving a request
+// for a cluster whose agent is connected to another replica forwards it there, e.g. with several replicas behind a
+// TCP load balancer. The replicas are identified by their Config.ReplicaURL.
+// The TunnelManager calls Announce and Withdraw while it holds its lock, they must not block
+type TunnelLocator interface {
+	// Lookup returns the URL of the replica holding the tunnel of the cluster
+	Lookup(cluster string) (hubEndpoint string, ok bool)
+	// Announce records that the replica holds the tunnel of the cluster
+	Announce(cluster, selfEndpoint string)
+	// Withdraw removes the record of Announce, unless another replica announced the cluster since
+	Withdraw(cluster, selfEndpoint string)
+}
+
+// MemoryTunnelLocator is a TunnelLocator shared by the replicas running in the same process, e.g. in tests
+type MemoryTunnelLocator struct {
+	mu        sync.RWMutex
+	endpoints map[string]string // clusterName -> replica URL
+}
+
+// NewMemoryTunnelLocator returns an empty in-memory TunnelLocator
+func NewMemoryTunnelLocator() *MemoryTunnelLocator {
+	return &MemoryTunnelLocator{endpoints: map[string]string{}}
+}
+
+// Lookup returns the URL of the replica holding the tunnel of the cluster
+func (l *MemoryTunnelLocator) Lookup(cluster string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	endpoint, ok := l.endpoints[cluster]
+	return endpoint, ok
+}
+
+// Announce records that the replica holds the tunnel of the cluster
+func (l *MemoryTunnelLocator) Announce(cluster, selfEndpoint string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.endpoints[cluster] = selfEndpoint
+}
+
+// Withdraw removes the record of the replica for the cluster
+func (l *MemoryTunnelLocator) Withdraw(cluster, selfEndpoint string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.endpoints[cluster] == selfEndpoint {
+		delete(l.endpoints, cluster)
+	}
+}
+
+// ConfigMapLocatorRefreshInterval is how long ConfigMapTunnelLocator.Lookup uses its copy of the ConfigMap
+const ConfigMapLocatorRefreshInterval = time.Second
+
+// configMapLocatorTimeout bounds each call to the Kubernetes API
+const configMapLocatorTimeout = 5 * time.Second
+
+// locatorUpdate is an Announce or a Withdraw queued for the ConfigMap
+type locatorUpdate struct {
+	cluster, endpoint string
+	withdraw          bool
+}
+
+// ConfigMapTunnelLocator is a TunnelLocator sharing the replicas of the tunnels in a ConfigMap, whose data maps the
+// clusters to the URLs of the replicas. Announce and Withdraw update the ConfigMap in order in the background,
+// Lookup reads a copy of it refreshed every ConfigMapLocatorRefreshInterval. The records of a replica that crashed
+// are replaced when the agents reconnect to another replica, the requests forwarded to it meanwhile fail with 502
+type ConfigMapTunnelLocator struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// updates are applied until ctx is done, they're dropped then
+	ctx     context.Context
+	updates chan locatorUpdate
+
+	mu          sync.Mutex
+	endpoints   map[string]string
+	refreshedAt time.Time
+}
+
+// NewConfigMapTunnelLocator returns the TunnelLocator backed by the ConfigMap, which is created on the first
+// Announce. It updates the ConfigMap until ctx is done
+func NewConfigMapTunnelLocator(ctx context.Context, client kubernetes.Interface, namespace, name string) *ConfigMapTunnelLocator {
+	l := &ConfigMapTunnelLocator{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		ctx:       ctx,
+		updates:   make(chan locatorUpdate, 1024),
+	}
+	go l.run(ctx)
+	return l
+}
+
+// Lookup returns the URL of the replica holding the tunnel of the cluster, the last copy of the ConfigMap is used
+// if it can't be read
+func (l *ConfigMapTunnelLocator) Lookup(cluster string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.refreshedAt) >= ConfigMapLocatorRefreshInterval {
+		ctx, cancel := context.WithTimeout(context.Background(), configMapLocatorTimeout)
+		defer cancel()
+		cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(ctx, l.name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			l.endpoints, l.refreshedAt = nil, time.Now()
+		case err != nil:
+			logger.ErrorS(err, "Failed to read the tunnel locator ConfigMap", "namespace", l.namespace, "name", l.name)
+		default:
+			l.endpoints, l.refreshedAt = cm.Data, time.Now()
+		}
+	}
+	endpoint, ok := l.endpoints[cluster]
+	return endpoint, ok
+}
+
+// Announce queues recording the replica of the cluster in the ConfigMap
+func (l *ConfigMapTunnelLocator) Announce(cluster, selfEndpoint string) {
+	l.queue(locatorUpdate{cluster: cluster, endpoint: selfEndpoint})
+}
+
+// Withdraw queues removing the replica of the cluster from the ConfigMap
+func (l *ConfigMapTunnelLocator) Withdraw(cluster, selfEndpoint string) {
+	l.queue(locatorUpdate{cluster: cluster, endpoint: selfEndpoint, withdraw: true})
+}
+
+// queue queues the update for run, it waits for room in the queue unless ctx is done
+func (l *ConfigMapTunnelLocator) queue(update locatorUpdate) {
+	select {
+	case l.updates <- update:
+	case <-l.ctx.Done():
+	}
+}
+
+// run applies the queued updates to the ConfigMap until ctx is done
+func (l *ConfigMapTunnelLocator) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-l.updates:
+			if err := l.apply(ctx, update); err != nil {
+				logger.ErrorS(err, "Failed to update the tunnel locator ConfigMap", "namespace", l.namespace, "name", l.name,
+					"cluster", update.cluster, "withdraw", update.withdraw)
+			}
+		}
+	}
+}
+
+// apply updates the ConfigMap with the update, it's created if it doesn't exist
+func (l *ConfigMapTunnelLocator) apply(ctx context.Context, update locatorUpdate) error {
+	ctx, cancel := context.WithTimeout(ctx, configMapLocatorTimeout)
+	defer cancel()
+	configMaps := l.client.CoreV1().ConfigMaps(l.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, l.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if update.withdraw {
+				return nil
+			}
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: l.namespace, Name: l.name},
+				Data:       map[string]string{update.cluster: update.endpoint},
+			}
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Another replica created it meanwhile, retry on its ConfigMap
+				return apierrors.NewConflict(corev1.Resource("configmaps"), l.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case update.withdraw && cm.Data[update.cluster] != update.endpoint:
+			// Another replica holds the tunnel of the cluster now
+			return nil
+		case update.withdraw:
+			delete(cm.Data, update.cluster)
+		case cm.Data[update.cluster] == update.endpoint:
+			return nil
+		default:
+			if cm.Data == nil {
+				cm.Data = map[string]string{}
+			}
+			cm.Data[update.cluster] = update.endpoint
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// forwardToReplica proxies the request to the replica holding the tunnel of the cluster, it returns false if there
+// is no other replica holding it, or if the request was forwarded by a replica already, so that a stale record
+// can't make the replicas forward a request in a loop
+func (h *httpHandler) forwardToReplica(w http.ResponseWriter, r *http.Request, clusterName string) bool {
+	if r.Header.Get(ForwardedByHeader) != "" {
+		return false
+	}
+	self, endpoint, ok := h.tunnelManager.replicaOf(clusterName)
+	if !ok {
+		return false
+	}
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		logger.ErrorS(err, "Invalid replica URL in the tunnel locator", "cluster", clusterName, "replica", endpoint)
+		return false
+	}
+
+	logger.V(4).InfoS("Forwarding request to replica", "cluster", clusterName, "replica", endpoint, "path", r.URL.Path)
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// The replica routes the request by the same host and path, e.g. with a host-based ClusterNameParser
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set(ForwardedByHeader, self)
+		},
+		Transport: h.replicaTransport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.ErrorS(err, "Failed to forward request to replica", "cluster", clusterName, "replica", endpoint)
+			http.Error(w, fmt.Sprintf("Cluster %s not available: replica %s failed: %v", clusterName, endpoint, err), http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(w, r)
+	return true
+}
+
+// replicaURL returns Config.ReplicaURL, or the URL of the HTTP listener if it's not set
+func (s *Server) replicaURL(httpListener net.Listener) string {
+	if s.config.ReplicaURL != "" {
+		return s.config.ReplicaURL
+	}
+	scheme := "http"
+	if s.config.HTTPTLSConfig != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + httpListener.Addr().String()
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMemoryTunnelLocator(t *testing.T) {
+	l := NewMemoryTunnelLocator()
+	l.Announce("cluster1", "http://hub-0:8080")
+	if endpoint, ok := l.Lookup("cluster1"); !ok || endpoint != "http://hub-0:8080" {
+		t.Fatalf("expected cluster1 on hub-0, got %q, %v", endpoint, ok)
+	}
+
+	// The agent reconnected to hub-1 before hub-0 removed its tunnel
+	l.Announce("cluster1", "http://hub-1:8080")
+	l.Withdraw("cluster1", "http://hub-0:8080")
+	if endpoint, ok := l.Lookup("cluster1"); !ok || endpoint != "http://hub-1:8080" {
+		t.Fatalf("expected cluster1 on hub-1, got %q, %v", endpoint, ok)
+	}
+
+	l.Withdraw("cluster1", "http://hub-1:8080")
+	if _, ok := l.Lookup("cluster1"); ok {
+		t.Fatalf("expected cluster1 to be withdrawn")
+	}
+}
+
+func TestConfigMapTunnelLocator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewClientset()
+	hub0 := NewConfigMapTunnelLocator(ctx, client, "hub-ns", "tunnels")
+	hub1 := NewConfigMapTunnelLocator(ctx, client, "hub-ns", "tunnels")
+
+	hub0.Announce("cluster1", "http://hub-0:8080")
+	hub0.Announce("cluster2", "http://hub-0:8080")
+	hub1.Announce("cluster3", "http://hub-1:8080")
+	// The replicas update the ConfigMap concurrently, wait for both before cluster2 moves
+	waitForConfigMap(t, client, map[string]string{
+		"cluster1": "http://hub-0:8080",
+		"cluster2": "http://hub-0:8080",
+		"cluster3": "http://hub-1:8080",
+	})
+	// cluster2 moved to hub-1, the withdrawal of hub-0 must not remove it
+	hub1.Announce("cluster2", "http://hub-1:8080")
+	waitForConfigMap(t, client, map[string]string{
+		"cluster1": "http://hub-0:8080",
+		"cluster2": "http://hub-1:8080",
+		"cluster3": "http://hub-1:8080",
+	})
+	hub0.Withdraw("cluster2", "http://hub-0:8080")
+	hub0.Withdraw("cluster1", "http://hub-0:8080")
+	waitForConfigMap(t, client, map[string]string{
+		"cluster2": "http://hub-1:8080",
+		"cluster3": "http://hub-1:8080",
+	})
+
+	for cluster, expected := range map[string]string{"cluster1": "", "cluster2": "http://hub-1:8080", "cluster3": "http://hub-1:8080"} {
+		endpoint, ok := hub0.Lookup(cluster)
+		if ok != (expected != "") || endpoint != expected {
+			t.Errorf("expected %s on %q, got %q, %v", cluster, expected, endpoint, ok)
+		}
+	}
+}
+
+// waitForConfigMap waits for the data of the tunnels ConfigMap to be the expected one
+func waitForConfigMap(t *testing.T, client *fake.Clientset, expected map[string]string) {
+	t.Helper()
+	var data map[string]string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		cm, err := client.CoreV1().ConfigMaps("hub-ns").Get(context.Background(), "tunnels", metav1.GetOptions{})
+		if err != nil {
+			continue
+		}
+		data = cm.Data
+		if len(data) != len(expected) {
+			continue
+		}
+		equal := true
+		for k, v := range expected {
+			equal = equal && data[k] == v
+		}
+		if equal {
+			return
+		}
+	}
+	t.Fatalf("expected the ConfigMap data %v, got %v", expected, data)
+}
+
+func TestTunnelManagerLocator(t *testing.T) {
+	locator := NewMemoryTunnelLocator()
+	tm := NewTunnelManager()
+	tm.locator = locator
+
+	// The tunnels created before Run set the URL of the replica are announced then
+	if _, err := tm.NewTunnel(context.Background(), "cluster1", nil); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if _, ok := locator.Lookup("cluster1"); ok {
+		t.Fatalf("expected no announcement before the replica URL is set")
+	}
+	tm.setEndpoint("http://hub-0:8080")
+	if endpoint, _ := locator.Lookup("cluster1"); endpoint != "http://hub-0:8080" {
+		t.Fatalf("expected cluster1 on hub-0, got %q", endpoint)
+	}
+
+	tun, err := tm.NewTunnel(context.Background(), "cluster2", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if endpoint, _ := locator.Lookup("cluster2"); endpoint != "http://hub-0:8080" {
+		t.Fatalf("expected cluster2 on hub-0, got %q", endpoint)
+	}
+	// The local tunnels are never forwarded
+	if _, _, ok := tm.replicaOf("cluster2"); ok {
+		t.Fatalf("expected cluster2 not to be forwarded")
+	}
+	locator.Announce("cluster3", "http://hub-1:8080")
+	if self, endpoint, ok := tm.replicaOf("cluster3"); !ok || self != "http://hub-0:8080" || endpoint != "http://hub-1:8080" {
+		t.Fatalf("expected cluster3 to be forwarded from hub-0 to hub-1, got %q, %q, %v", self, endpoint, ok)
+	}
+
+	tm.RemoveTunnel("cluster2", tun.ID())
+	if _, ok := locator.Lookup("cluster2"); ok {
+		t.Fatalf("expected cluster2 to be withdrawn")
+	}
+	tm.Close()
+	if _, ok := locator.Lookup("cluster1"); ok {
+		t.Fatalf("expected cluster1 to be withdrawn on close")
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ErrClusterMaintenance is returned by Server.RoundTrip for the requests to a cluster under maintenance whose user
+// isn't allowed
+var ErrClusterMaintenance = errors.New("cluster is under maintenance")
+
+// maintenanceRetryAfter is the Retry-After of the requests to a cluster under maintenance, e.g. during its upgrade
+const maintenanceRetryAfter = 30 * time.Second
+
+// RequestIdentifier identifies the user of the requests to the clusters, e.g. the controllers allowed into a
+// cluster under maintenance
+type RequestIdentifier interface {
+	// Identify returns the identity of the user of the request, empty if it's not identified
+	Identify(r *http.Request) string
+}
+
+// headerIdentifier identifies the requests by the value of a header
+type headerIdentifier struct {
+	header string
+}
+
+// NewHeaderIdentifier creates a RequestIdentifier returning the value of the header, e.g. "X-Remote-User" set by an
+// authenticating proxy or by one of the HTTPMiddlewares. The clients can set any header, only use it when the
+// header of the requests is overwritten before they reach the hub
+func NewHeaderIdentifier(header string) RequestIdentifier {
+	return &headerIdentifier{header: header}
+}
+
+func (i *headerIdentifier) Identify(r *http.Request) string {
+	return r.Header.Get(i.header)
+}
+
+// clientCertIdentifier identifies the requests by their verified client certificate
+type clientCertIdentifier struct{}
+
+// NewClientCertIdentifier creates a RequestIdentifier returning the common name of the client certificate of the
+// request, verified by the ClientCAs of HTTPTLSConfig. The requests without a verified certificate are not identified
+func NewClientCertIdentifier() RequestIdentifier {
+	return clientCertIdentifier{}
+}
+
+func (clientCertIdentifier) Identify(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// ClusterMaintenance describes a cluster under maintenance, see Server.SetClusterMaintenance
+type ClusterMaintenance struct {
+	ClusterName string `json:"cluster_name"`
+	// AllowedIdentities are the identities whose requests are still forwarded to the cluster
+	AllowedIdentities []string `json:"allowed_identities"`
+	// Since is when the cluster was put under maintenance
+	Since time.Time `json:"since"`
+}
+
+// allows returns whether the requests of the identity are forwarded to the cluster under maintenance
+func (m ClusterMaintenance) allows(identity string) bool {
+	return identity != "" && slices.Contains(m.AllowedIdentities, identity)
+}
+
+// SetMaintenance puts the cluster under maintenance, or takes it out of it. It's kept across the tunnels of the
+// cluster, setting it again replaces the allowed identities and keeps the time it started. The client connections
+// to the cluster kept alive across requests are closed once it goes under maintenance, so that the next requests of
+// their clients are checked
+func (tm *TunnelManager) SetMaintenance(clusterName string, on bool, allowIdentities []string) {
+	tm.mu.Lock()
+	if !on {
+		delete(tm.maintenance, clusterName)
+		tm.mu.Unlock()
+		return
+	}
+	since := time.Now()
+	m, wasOn := tm.maintenance[clusterName]
+	if wasOn {
+		since = m.Since
+	}
+	tm.maintenance[clusterName] = ClusterMaintenance{
+		ClusterName:       clusterName,
+		AllowedIdentities: slices.Clone(allowIdentities),
+		Since:             since,
+	}
+	tm.mu.Unlock()
+
+	if wasOn {
+		return
+	}
+	if tun := tm.GetTunnel(clusterName); tun != nil {
+		if n := tun.closeKeepAliveConns(); n > 0 {
+			logger.InfoS("Closed client connections kept alive", "cluster", clusterName, "connections", n)
+		}
+	}
+}
+
+// Maintenance returns the maintenance of the cluster, false if it's not under maintenance
+func (tm *TunnelManager) Maintenance(clusterName string) (ClusterMaintenance, bool) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	m, ok := tm.maintenance[clusterName]
+	return m, ok
+}
+
+// MaintenanceClusters returns the clusters under maintenance sorted by cluster name
+func (tm *TunnelManager) MaintenanceClusters() []ClusterMaintenance {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	clusters := make([]ClusterMaintenance, 0, len(tm.maintenance))
+	for _, m := range tm.maintenance {
+		m.AllowedIdentities = slices.Clone(m.AllowedIdentities)
+		clusters = append(clusters, m)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].ClusterName < clusters[j].ClusterName
+	})
+	return clusters
+}
+
+// SetClusterMaintenance puts the cluster under maintenance, e.g. during its upgrade, or takes it out of it. The
+// tunnel of the cluster stays connected, the requests of allowIdentities, as identified by
+// Config.RequestIdentifier, are still forwarded to it, the others get 503 Service Unavailable with ReasonMaintenance.
+// It's state of the hub, it's kept while the agent reconnects. The hub only sees the first request of an HTTP/1.1
+// client connection: under maintenance, the client connections are closed after the response to their first
+// request, and the ones kept alive across requests are closed once the cluster goes under maintenance, so that
+// the next requests of their clients are checked
+func (s *Server) SetClusterMaintenance(clusterName string, on bool, allowIdentities []string) {
+	s.tunnelManager.SetMaintenance(clusterName, on, allowIdentities)
+	if on {
+		logger.InfoS("Cluster under maintenance", "cluster", clusterName, "allowed_identities", allowIdentities)
+	} else {
+		logger.InfoS("Cluster out of maintenance", "cluster", clusterName)
+	}
+}
+
+// MaintenanceClusters returns the clusters under maintenance sorted by cluster name
+func (s *Server) MaintenanceClusters() []ClusterMaintenance {
+	return s.tunnelManager.MaintenanceClusters()
+}
+
+// checkMaintenance writes the response to a request to a cluster under maintenance whose user isn't allowed, it
+// returns false if the request can be forwarded
+func (h *httpHandler) checkMaintenance(w http.ResponseWriter, r *http.Request, clusterName string) bool {
+	if !h.deniedByMaintenance(r, clusterName) {
+		return false
+	}
+	writeClusterUnavailable(w, http.StatusServiceUnavailable,
+		h.clusterUnavailable(clusterName, ReasonMaintenance, "Cluster "+clusterName+" is under maintenance"))
+	return true
+}
+
+// deniedByMaintenance returns whether the cluster is under maintenance and the user of the request isn't allowed
+func (h *httpHandler) deniedByMaintenance(r *http.Request, clusterName string) bool {
+	m, ok := h.tunnelManager.Maintenance(clusterName)
+	if !ok {
+		return false
+	}
+	var identity string
+	if h.identifier != nil {
+		identity = h.identifier.Identify(r)
+	}
+	if m.allows(identity) {
+		return false
+	}
+	logger.V(4).InfoS("Request rejected during cluster maintenance", "cluster", clusterName, "path", r.URL.Path, "identity", identity)
+	return true
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTunnelManagerMaintenance(t *testing.T) {
+	tm := NewTunnelManager()
+	if _, ok := tm.Maintenance("cluster-b"); ok {
+		t.Fatalf("expected the cluster not to be under maintenance")
+	}
+
+	allowIdentities := []string{"controller"}
+	tm.SetMaintenance("cluster-b", true, allowIdentities)
+	tm.SetMaintenance("cluster-a", true, nil)
+	allowIdentities[0] = "modified"
+	first, ok := tm.Maintenance("cluster-b")
+	if !ok || len(first.AllowedIdentities) != 1 || first.AllowedIdentities[0] != "controller" {
+		t.Fatalf("expected the cluster to be under maintenance for the controller, got %+v", first)
+	}
+
+	// Setting it again replaces the identities and keeps when it started
+	tm.SetMaintenance("cluster-b", true, []string{"controller", "operator"})
+	second, _ := tm.Maintenance("cluster-b")
+	if !second.Since.Equal(first.Since) || len(second.AllowedIdentities) != 2 {
+		t.Errorf("expected the identities to be replaced since %v, got %+v", first.Since, second)
+	}
+
+	clusters := tm.MaintenanceClusters()
+	if len(clusters) != 2 || clusters[0].ClusterName != "cluster-a" || clusters[1].ClusterName != "cluster-b" {
+		t.Fatalf("expected the clusters under maintenance sorted by name, got %+v", clusters)
+	}
+
+	tm.SetMaintenance("cluster-b", false, nil)
+	if _, ok := tm.Maintenance("cluster-b"); ok {
+		t.Errorf("expected the cluster to be out of maintenance")
+	}
+	if clusters := tm.MaintenanceClusters(); len(clusters) != 1 {
+		t.Errorf("expected a cluster under maintenance, got %+v", clusters)
+	}
+}
+
+// TestMaintenanceClosesKeepAliveConns checks the client connections kept alive are closed once the cluster goes under
+// maintenance, and not when its allowed identities are replaced
+func TestMaintenanceClosesKeepAliveConns(t *testing.T) {
+	tm := NewTunnelManager()
+	tun := newTestTunnel(1)
+	tm.tunnels["test-cluster"] = tun
+
+	newConn := func(keepAlive bool) *packetConnection {
+		pc, err := tun.NewPacketConn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+		if keepAlive {
+			pc.setKeepAlive()
+		}
+		return pc
+	}
+	keepAlive, single := newConn(true), newConn(false)
+
+	tm.SetMaintenance("test-cluster", true, []string{"controller"})
+	if keepAlive.Context().Err() == nil || single.Context().Err() != nil {
+		t.Fatalf("expected only the connection kept alive to be closed")
+	}
+	if packet := <-tun.outgoingChan; packet.ConnId != keepAlive.ID() || packet.ErrorMessage != clientDisconnectedMessage {
+		t.Errorf("expected the agent to be told to close its connection, got %v", packet)
+	}
+
+	again := newConn(true)
+	tm.SetMaintenance("test-cluster", true, nil)
+	if again.Context().Err() != nil {
+		t.Errorf("expected the connection to stay open while the cluster stays under maintenance")
+	}
+	single.Close(nil)
+	again.Close(nil)
+}
+
+func TestCheckMaintenance(t *testing.T) {
+	cases := []struct {
+		name        string
+		identifier  RequestIdentifier
+		maintenance bool
+		user        string
+		expectBlock bool
+	}{
+		{name: "not under maintenance", identifier: NewHeaderIdentifier("X-Remote-User"), user: "alice"},
+		{name: "allowed identity", identifier: NewHeaderIdentifier("X-Remote-User"), maintenance: true, user: "controller"},
+		{name: "other identity", identifier: NewHeaderIdentifier("X-Remote-User"), maintenance: true, user: "alice", expectBlock: true},
+		{name: "not identified", identifier: NewHeaderIdentifier("X-Remote-User"), maintenance: true, expectBlock: true},
+		{name: "no identifier", maintenance: true, user: "controller", expectBlock: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tm := NewTunnelManager()
+			if c.maintenance {
+				tm.SetMaintenance("test-cluster", true, []string{"controller"})
+			}
+			h := &httpHandler{tunnelManager: tm, identifier: c.identifier}
+
+			r := httptest.NewRequest(http.MethodGet, "/test-cluster/api", nil)
+			if c.user != "" {
+				r.Header.Set("X-Remote-User", c.user)
+			}
+			w := httptest.NewRecorder()
+			if blocked := h.checkMaintenance(w, r, "test-cluster"); blocked != c.expectBlock {
+				t.Fatalf("expected the request to be blocked %v, got %v", c.expectBlock, blocked)
+			}
+			if !c.expectBlock {
+				return
+			}
+
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+				t.Errorf("expected 503 with Retry-After 30, got %d with %q", w.Code, w.Header().Get("Retry-After"))
+			}
+			var body ClusterUnavailable
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode the body: %v", err)
+			}
+			if body.Cluster != "test-cluster" || body.Reason != ReasonMaintenance || body.RetryAfterSeconds != 30 {
+				t.Errorf("expected the maintenance of test-cluster, got %+v", body)
+			}
+		})
+	}
+}
+
+func TestClientCertIdentifier(t *testing.T) {
+	identifier := NewClientCertIdentifier()
+
+	r := httptest.NewRequest(http.MethodGet, "/test-cluster/api", nil)
+	if identity := identifier.Identify(r); identity != "" {
+		t.Errorf("expected a request without TLS not to be identified, got %q", identity)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "controller"}}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if identity := identifier.Identify(r); identity != "" {
+		t.Errorf("expected an unverified certificate not to be identified, got %q", identity)
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	if identity := identifier.Identify(r); identity != "controller" {
+		t.Errorf("expected the common name of the verified certificate, got %q", identity)
+	}
+}
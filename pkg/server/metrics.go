@@ -0,0 +1,195 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tunnelRTT is the smoothed round-trip time of the tunnel of each cluster
+var tunnelRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "tunnel_rtt_seconds",
+	Help:      "Smoothed round-trip time between the hub and the agent of a cluster, measured with PING/PONG packets.",
+}, []string{"cluster"})
+
+// tunnelSlowStartRate is the current cap on new packet connections per second of the tunnel of each cluster
+var tunnelSlowStartRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "tunnel_slow_start_rate",
+	Help:      "Cap on new connections per second to a cluster during the slow start window after its agent (re)connected, 0 once lifted.",
+}, []string{"cluster"})
+
+// tunnelMaxPacketConns is the cap on open packet connections of the tunnel of each cluster
+var tunnelMaxPacketConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "tunnel_max_packet_conns",
+	Help:      "Cap on open connections to a cluster, not set if unlimited.",
+}, []string{"cluster"})
+
+const (
+	rejectReasonSlowStart      = "slow_start"
+	rejectReasonMaxPacketConns = "max_packet_conns"
+	rejectReasonDraining       = "draining"
+)
+
+// packetConnRejections counts the connections rejected by the caps of the tunnel of each cluster
+var packetConnRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "packet_conn_rejections_total",
+	Help:      "Connections to a cluster rejected by the slow start rate, the cap on open connections or the drain of the agent.",
+}, []string{"cluster", "reason"})
+
+const (
+	resumeResultResumed = "resumed"
+	resumeResultExpired = "expired"
+	resumeResultFailed  = "failed"
+)
+
+// packetConnResumes counts the packet connections of a closed tunnel by whether the next tunnel of the agent resumed them
+var packetConnResumes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "packet_conn_resumes_total",
+	Help:      "Connections to a cluster kept after its tunnel closed, by whether they were resumed, expired with the resume window, or failed to resume.",
+}, []string{"cluster", "result"})
+
+// mirroredRequests counts the requests mirrored to another cluster by whether their response was read, the mirror
+// failed, or the request was dropped because the cap on mirrored requests in flight was reached
+var mirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "mirrored_requests_total",
+	Help:      "Requests to a source cluster mirrored to a target cluster, by whether they were mirrored, failed, or dropped at the cap on mirrored requests in flight.",
+}, []string{"source_cluster", "target_cluster", "result"})
+
+// unknownConnErrorsSuppressed counts the packets for unknown packet connections not answered with an ERROR because
+// one was sent for the same conn_id shortly before
+var unknownConnErrorsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "unknown_conn_errors_suppressed_total",
+	Help:      "Packets from the agent of a cluster for unknown connections not answered with an error, since one was sent for the same connection shortly before.",
+}, []string{"cluster"})
+
+// connectionLatency is the end-to-end latency of the client connections tunneled to each cluster, its p50, p95 and
+// p99 are computed with histogram_quantile
+var connectionLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "connection_latency_seconds",
+	Help:      "Time from a request to a cluster entering the hub until the last byte of the responses of its connection left the hub.",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16), // 5ms to ~2.7m
+}, []string{"cluster"})
+
+const (
+	integrityDirectionFromAgent = "from_agent"
+	integrityDirectionToAgent   = "to_agent"
+)
+
+// integrityFailures counts the packet connections closed because the checksum of a DATA packet didn't match its
+// data, by whether the hub received the packet from the agent or the agent received it from the hub
+var integrityFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "integrity_failures_total",
+	Help:      "Connections to a cluster closed because a DATA packet didn't match its checksum, by whether it was sent from or to the agent.",
+}, []string{"cluster", "direction"})
+
+// tunnelsReaped counts the closed tunnels of each cluster the reaper of the tunnel manager found still registered
+var tunnelsReaped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "tunnels_reaped_total",
+	Help:      "Closed tunnels of a cluster found still registered and removed by the periodic check.",
+}, []string{"cluster"})
+
+const (
+	roundTripConnNew    = "new"
+	roundTripConnReused = "reused"
+)
+
+// roundTripRequests counts the requests of RoundTrip by whether they reused an idle connection, see ConnReuseConfig
+var roundTripRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "round_trip_requests_total",
+	Help:      "Requests to a cluster proxied without the HTTP listener, by whether they were sent on a new or a reused idle connection.",
+}, []string{"cluster", "conn"})
+
+// roundTripConnsRetired counts the connections of RoundTrip closed instead of being kept idle or reused, by reason
+var roundTripConnsRetired = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "round_trip_conns_retired_total",
+	Help:      "Connections to a cluster of the requests proxied without the HTTP listener closed instead of being reused, by whether they served the max requests, were idle for the idle timeout, found the pool full, or were closed.",
+}, []string{"cluster", "reason"})
+
+// roundTripIdleConns is the number of idle connections of RoundTrip kept for each cluster
+var roundTripIdleConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "multiclustertunnel",
+	Subsystem: "hub",
+	Name:      "round_trip_idle_conns",
+	Help:      "Idle connections to a cluster kept for the next request proxied without the HTTP listener.",
+}, []string{"cluster"})
+
+// tunnelPacketConnsDesc is the number of open packet connections of the tunnel of each cluster
+var tunnelPacketConnsDesc = prometheus.NewDesc(
+	"multiclustertunnel_hub_tunnel_packet_conns",
+	"Open connections to a cluster.",
+	[]string{"cluster"}, nil,
+)
+
+// tunnels collects the packet connections of the tunnels of the servers from TunnelManager.ListTunnels when the
+// metrics are scraped, instead of updating a gauge on every packet connection
+var tunnels = &tunnelCollector{managers: make(map[*TunnelManager]struct{})}
+
+// tunnelCollector collects the tunnels of the registered tunnel managers, the packet connections of a cluster
+// connected to several servers in the process are summed
+type tunnelCollector struct {
+	mu       sync.Mutex
+	managers map[*TunnelManager]struct{}
+}
+
+// register collects the tunnels of the tunnel manager until it's unregistered
+func (c *tunnelCollector) register(tm *TunnelManager) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.managers[tm] = struct{}{}
+}
+
+// unregister stops collecting the tunnels of the tunnel manager
+func (c *tunnelCollector) unregister(tm *TunnelManager) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.managers, tm)
+}
+
+func (c *tunnelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelPacketConnsDesc
+}
+
+func (c *tunnelCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	packetConns := make(map[string]int)
+	for tm := range c.managers {
+		for _, info := range tm.ListTunnels() {
+			packetConns[info.ClusterName] += info.ActiveConnections
+		}
+	}
+	c.mu.Unlock()
+
+	for cluster, n := range packetConns {
+		ch <- prometheus.MustNewConstMetric(tunnelPacketConnsDesc, prometheus.GaugeValue, float64(n), cluster)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(tunnelRTT, tunnelSlowStartRate, tunnelMaxPacketConns, packetConnRejections, packetConnResumes,
+		mirroredRequests, unknownConnErrorsSuppressed, connectionLatency, integrityFailures, tunnelsReaped, roundTripRequests,
+		roundTripConnsRetired, roundTripIdleConns, tunnels)
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSAllowedMethods are the methods allowed in the preflight responses by default
+var DefaultCORSAllowedMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// DefaultCORSMaxAge is how long browsers cache the preflight responses by default
+const DefaultCORSMaxAge = 10 * time.Minute
+
+// CORSOptions configures NewCORSMiddlewareWithOptions
+type CORSOptions struct {
+	// AllowedOrigins are the origins allowed to call the hub, "*" allows any origin
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed in preflight responses, defaults to DefaultCORSAllowedMethods
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed in preflight responses, the headers requested by the
+	// preflight are allowed if empty
+	AllowedHeaders []string
+	// MaxAge is how long browsers cache the preflight responses, defaults to DefaultCORSMaxAge
+	MaxAge time.Duration
+	// RejectPreflights rejects the preflights of the origins not allowed with 403, instead of passing them on
+	RejectPreflights bool
+}
+
+// NewCORSMiddleware returns a middleware that allows cross-origin requests from the given origins, "*" allows any origin.
+// Only the origins listed explicitly are allowed to send credentials, the other origins allowed by "*" get
+// Access-Control-Allow-Origin: * so that browsers don't send them the cookies nor the authorization of the user.
+// Preflight requests from allowed origins are answered by the hub and not forwarded to the cluster.
+func NewCORSMiddleware(origins []string) func(http.Handler) http.Handler {
+	return NewCORSMiddlewareWithOptions(CORSOptions{AllowedOrigins: origins})
+}
+
+// NewCORSMiddlewareWithOptions returns the middleware of NewCORSMiddleware with the methods, headers and max age of
+// the preflight responses of opts
+func NewCORSMiddlewareWithOptions(opts CORSOptions) func(http.Handler) http.Handler {
+	origins := opts.AllowedOrigins
+	allowAny := slices.Contains(origins, "*")
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSAllowedMethods
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(opts.AllowedHeaders, ", ")
+	maxAge := opts.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultCORSMaxAge
+	}
+	maxAgeSeconds := strconv.Itoa(int(maxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+			listed := origin != "" && slices.Contains(origins, origin)
+			if origin == "" || !listed && !allowAny {
+				if preflight && opts.RejectPreflights {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header := w.Header()
+			header.Add("Vary", "Origin")
+			if listed {
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				header.Set("Access-Control-Allow-Origin", "*")
+			}
+			if !preflight {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Answer the preflight request
+			header.Set("Access-Control-Allow-Methods", allowMethods)
+			switch {
+			case allowHeaders != "":
+				header.Set("Access-Control-Allow-Headers", allowHeaders)
+			case len(r.Header.Values("Access-Control-Request-Headers")) > 0:
+				header.Set("Access-Control-Allow-Headers", strings.Join(r.Header.Values("Access-Control-Request-Headers"), ", "))
+			}
+			header.Set("Access-Control-Max-Age", maxAgeSeconds)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
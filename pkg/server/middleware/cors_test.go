@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	cases := []struct {
+		name              string
+		origins           []string
+		origin            string
+		preflight         bool
+		expectOrigin      string
+		expectCredentials string
+		expectNext        bool
+	}{
+		{
+			name:              "listed origin",
+			origins:           []string{"https://ui.example.com"},
+			origin:            "https://ui.example.com",
+			expectOrigin:      "https://ui.example.com",
+			expectCredentials: "true",
+			expectNext:        true,
+		},
+		{
+			name:       "origin not listed",
+			origins:    []string{"https://ui.example.com"},
+			origin:     "https://evil.example.com",
+			expectNext: true,
+		},
+		{
+			// Any website may call the hub, but the browsers don't send it the credentials of the user
+			name:         "wildcard",
+			origins:      []string{"*"},
+			origin:       "https://evil.example.com",
+			expectOrigin: "*",
+			expectNext:   true,
+		},
+		{
+			name:         "wildcard preflight",
+			origins:      []string{"*"},
+			origin:       "https://evil.example.com",
+			preflight:    true,
+			expectOrigin: "*",
+		},
+		{
+			name:              "listed origin with wildcard",
+			origins:           []string{"*", "https://ui.example.com"},
+			origin:            "https://ui.example.com",
+			preflight:         true,
+			expectOrigin:      "https://ui.example.com",
+			expectCredentials: "true",
+		},
+		{
+			name:       "no origin",
+			origins:    []string{"*"},
+			expectNext: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			next := false
+			handler := NewCORSMiddleware(c.origins)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next = true
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/cluster1/api", nil)
+			if c.preflight {
+				r.Method = http.MethodOptions
+				r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+			if c.origin != "" {
+				r.Header.Set("Origin", c.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if next != c.expectNext {
+				t.Errorf("expected the request to be passed on %v, got %v", c.expectNext, next)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != c.expectOrigin {
+				t.Errorf("expected Access-Control-Allow-Origin %q, got %q", c.expectOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != c.expectCredentials {
+				t.Errorf("expected Access-Control-Allow-Credentials %q, got %q", c.expectCredentials, got)
+			}
+			if c.preflight && w.Code != http.StatusNoContent {
+				t.Errorf("expected the preflight to be answered with 204, got %d", w.Code)
+			}
+		})
+	}
+}
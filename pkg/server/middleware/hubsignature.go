@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/hubsig"
+	"golang.org/x/net/http/httpguts"
+)
+
+// NewHubSignatureMiddleware returns a middleware that signs the requests forwarded to the clusters with the key
+// shared with the agents, see pkg/hubsig and agent.AuthPolicy.HubSignatureKey. A signature sent by the client is
+// replaced. It must be the innermost middleware, after the ones that reject requests, e.g. authentication, so that
+// only the accepted requests are signed.
+//
+// The hub only sees the first request of an HTTP/1.1 client connection, the next ones are tunneled as is. The
+// middleware sets Connection: close on the requests that don't upgrade the connection, so that each request of
+// the client reaches the hub on a new connection and is signed.
+func NewHubSignatureMiddleware(key []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set(hubsig.Header, hubsig.Sign(key, r, time.Now()))
+			if r.ProtoMajor == 1 && !httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") {
+				r.Header.Set("Connection", "close")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/logging"
+)
+
+// NewRequestLoggingMiddleware returns a middleware that logs every request handled by the hub,
+// logs go through klog if logger is nil. Tunneled requests are logged once the tunnel is closed.
+func NewRequestLoggingMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	if logger == nil {
+		logger = logging.NewSlogKlogBridge()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w}
+
+			next.ServeHTTP(rw, r)
+
+			attrs := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"remote_addr", r.RemoteAddr,
+				"duration", time.Since(start),
+			}
+			if requestID := r.Header.Get(RequestIDHeader); requestID != "" {
+				attrs = append(attrs, "request_id", requestID)
+			}
+			if rw.hijacked {
+				// The response was written by the cluster on the hijacked connection
+				attrs = append(attrs, "tunneled", true)
+			} else {
+				status := rw.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				attrs = append(attrs, "status", status, "bytes", rw.bytes)
+			}
+			logger.Info("HTTP request", attrs...)
+		})
+	}
+}
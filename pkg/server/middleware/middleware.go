@@ -0,0 +1,61 @@
+// Package middleware provides HTTP middlewares for the hub's HTTP server, they are set in server.Config.HTTPMiddlewares.
+//
+// Requests to clusters are tunneled on the hijacked client connection, so a middleware runs once per client
+// connection rather than per request. Headers a middleware sets on the ResponseWriter before the connection is
+// hijacked are merged into the response from the agent.
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// responseWriter records the status code and the size of the response, it keeps supporting http.Hijacker
+// which is required to tunnel requests to the clusters
+type responseWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int
+	hijacked bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.Hijacker is not supported by the underlying ResponseWriter")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to access the underlying ResponseWriter
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
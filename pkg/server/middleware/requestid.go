@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader is the header carrying the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// NewRequestIDMiddleware returns a middleware that sets the X-Request-ID header on the request forwarded to the
+// cluster and on the response. An X-Request-ID sent by the client is kept, otherwise a random ID is generated.
+func NewRequestIDMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(RequestIDHeader)
+			if requestID == "" {
+				requestID = newRequestID()
+				r.Header.Set(RequestIDHeader, requestID)
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newRequestID returns a random 128-bit hex encoded ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never returns an error
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
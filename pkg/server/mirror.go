@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// MirrorConfig mirrors a share of the requests to a cluster to another cluster, e.g. to validate a migration.
+// The responses of the mirror cluster are discarded, and mirroring never fails or delays the requests
+type MirrorConfig struct {
+	// SourceCluster is the cluster whose requests are mirrored
+	SourceCluster string
+	// TargetCluster is the cluster the requests are mirrored to
+	TargetCluster string
+	// Percent is the share of the matching requests mirrored, from 0 to 100
+	Percent float64
+	// Methods are the methods of the mirrored requests, defaults to DefaultMirrorMethods
+	Methods []string
+	// MaxConcurrent caps the mirrored requests in flight, the requests beyond it aren't mirrored.
+	// Defaults to DefaultMirrorMaxConcurrent
+	MaxConcurrent int
+}
+
+// DefaultMirrorMethods are the read-only methods mirrored by default
+var DefaultMirrorMethods = []string{http.MethodGet, http.MethodHead}
+
+// DefaultMirrorMaxConcurrent is the default cap on the mirrored requests in flight
+const DefaultMirrorMaxConcurrent = 16
+
+// mirrorTimeout bounds a mirrored request until its response is read
+const mirrorTimeout = 30 * time.Second
+
+const (
+	mirrorResultMirrored = "mirrored"
+	mirrorResultFailed   = "failed"
+	mirrorResultDropped  = "dropped"
+)
+
+// requestMirror replays a share of the requests to the source cluster to the target cluster in the background
+type requestMirror struct {
+	config        MirrorConfig
+	tunnelManager *TunnelManager
+	// inflight holds a token for each mirrored request in flight
+	inflight chan struct{}
+	// sample returns a number in [0, 100) compared to Percent, a random one if nil
+	sample func() float64
+	// closeConn closes the packet connection of a mirrored request and the agent's connection to the proxy
+	closeConn func(pc *packetConnection)
+}
+
+func newRequestMirror(config MirrorConfig, tunnelManager *TunnelManager, closeConn func(pc *packetConnection)) (*requestMirror, error) {
+	if config.SourceCluster == "" || config.TargetCluster == "" {
+		return nil, fmt.Errorf("SourceCluster and TargetCluster must be set to mirror requests")
+	}
+	if config.SourceCluster == config.TargetCluster {
+		return nil, fmt.Errorf("requests to cluster %s can't be mirrored to itself", config.SourceCluster)
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return nil, fmt.Errorf("mirror Percent must be between 0 and 100, got %v", config.Percent)
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = DefaultMirrorMethods
+	}
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = DefaultMirrorMaxConcurrent
+	}
+	return &requestMirror{
+		config:        config,
+		tunnelManager: tunnelManager,
+		inflight:      make(chan struct{}, config.MaxConcurrent),
+		closeConn:     closeConn,
+	}, nil
+}
+
+// maybeMirror mirrors the serialized request in the background if it matches and is sampled
+func (m *requestMirror) maybeMirror(clusterName string, r *http.Request, requestData []byte) {
+	// Upgraded connections, e.g. kubectl exec, would stream to the mirror until the timeout
+	if clusterName != m.config.SourceCluster || !slices.Contains(m.config.Methods, r.Method) || r.Header.Get("Upgrade") != "" {
+		return
+	}
+	sample := m.sample
+	if sample == nil {
+		sample = func() float64 { return rand.Float64() * 100 }
+	}
+	if sample() >= m.config.Percent {
+		return
+	}
+
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		logger.V(4).InfoS("Mirrored requests at capacity, not mirroring", "cluster", m.config.TargetCluster, "path", r.URL.Path)
+		mirroredRequests.WithLabelValues(m.config.SourceCluster, m.config.TargetCluster, mirrorResultDropped).Inc()
+		return
+	}
+	method, path := r.Method, r.URL.Path
+	go func() {
+		defer func() { <-m.inflight }()
+
+		result := mirrorResultMirrored
+		if err := m.mirror(method, requestData); err != nil {
+			logger.V(4).InfoS("Failed to mirror request", "cluster", m.config.TargetCluster, "path", path, "error", err)
+			result = mirrorResultFailed
+		}
+		mirroredRequests.WithLabelValues(m.config.SourceCluster, m.config.TargetCluster, result).Inc()
+	}()
+}
+
+// mirror sends the serialized request to the target cluster and discards its response
+func (m *requestMirror) mirror(method string, requestData []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+
+	tun := m.tunnelManager.GetTunnel(m.config.TargetCluster)
+	if tun == nil {
+		return fmt.Errorf("cluster %s not available", m.config.TargetCluster)
+	}
+	pc, err := tun.NewPacketConn(ctx)
+	if err != nil {
+		return err
+	}
+	// Close the agent's connection to the proxy once the response is read, it's kept alive otherwise
+	defer m.closeConn(pc)
+
+	// Like the requests of the clients, an empty packet opens the connection on the agents that don't open it on
+	// the request
+	if !tun.firstPacket {
+		if err := pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: []byte{}}); err != nil {
+			return err
+		}
+	}
+	if err := pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: requestData}); err != nil {
+		return err
+	}
+
+	conn := &packetNetConn{pc: pc, opened: make(chan struct{})}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	return nil
+}
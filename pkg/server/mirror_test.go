@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+func TestNewRequestMirror(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      MirrorConfig
+		expectError bool
+	}{
+		{name: "valid", config: MirrorConfig{SourceCluster: "a", TargetCluster: "b", Percent: 10}},
+		{name: "no target", config: MirrorConfig{SourceCluster: "a", Percent: 10}, expectError: true},
+		{name: "same cluster", config: MirrorConfig{SourceCluster: "a", TargetCluster: "a", Percent: 10}, expectError: true},
+		{name: "negative percent", config: MirrorConfig{SourceCluster: "a", TargetCluster: "b", Percent: -1}, expectError: true},
+		{name: "percent over 100", config: MirrorConfig{SourceCluster: "a", TargetCluster: "b", Percent: 101}, expectError: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := newRequestMirror(c.config, NewTunnelManager(), nil)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(m.config.Methods) != len(DefaultMirrorMethods) || cap(m.inflight) != DefaultMirrorMaxConcurrent {
+				t.Errorf("expected the defaults, got methods %v and %d in flight", m.config.Methods, cap(m.inflight))
+			}
+		})
+	}
+}
+
+func TestRequestMirror(t *testing.T) {
+	tun := newTestTunnel(0)
+	tun.clusterName = "cluster-b"
+	tm := NewTunnelManager()
+	tm.tunnels[tun.clusterName] = tun
+	closed := make(chan *packetConnection, 1)
+	m, err := newRequestMirror(MirrorConfig{SourceCluster: "cluster-a", TargetCluster: "cluster-b", Percent: 50, MaxConcurrent: 1}, tm,
+		func(pc *packetConnection) {
+			pc.Close(nil)
+			closed <- pc
+		})
+	if err != nil {
+		t.Fatalf("failed to create mirror: %v", err)
+	}
+	sampled := 10.0
+	m.sample = func() float64 { return sampled }
+
+	count := func(result string) float64 {
+		metric := &dto.Metric{}
+		if err := mirroredRequests.WithLabelValues("cluster-a", "cluster-b", result).Write(metric); err != nil {
+			t.Fatalf("failed to read the counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	mirrored, dropped := count(mirrorResultMirrored), count(mirrorResultDropped)
+
+	get := httptest.NewRequest("GET", "/cluster-a/api", nil)
+	upgrade := httptest.NewRequest("GET", "/cluster-a/api", nil)
+	upgrade.Header.Set("Upgrade", "websocket")
+	m.maybeMirror("cluster-b", get, []byte("other cluster"))
+	m.maybeMirror("cluster-a", httptest.NewRequest("POST", "/cluster-a/api", nil), []byte("write"))
+	m.maybeMirror("cluster-a", upgrade, []byte("upgrade"))
+	sampled = 50
+	m.maybeMirror("cluster-a", get, []byte("not sampled"))
+	if len(tun.outgoingChan) != 0 {
+		t.Fatalf("expected no request to be mirrored, got %d packets", len(tun.outgoingChan))
+	}
+
+	sampled = 49.9
+	m.maybeMirror("cluster-a", get, []byte("GET /cluster-a/api HTTP/1.1\r\n\r\n"))
+	// The cap on mirrored requests in flight is reached
+	m.maybeMirror("cluster-a", get, []byte("dropped"))
+	if count(mirrorResultDropped) != dropped+1 {
+		t.Errorf("expected the second request to be dropped")
+	}
+
+	// An empty packet opens the connection on the agent, then the request is sent
+	open, request := <-tun.outgoingChan, <-tun.outgoingChan
+	if len(open.Data) != 0 || string(request.Data) != "GET /cluster-a/api HTTP/1.1\r\n\r\n" || request.ConnId != open.ConnId {
+		t.Fatalf("expected the mirrored request, got %v and %v", open, request)
+	}
+	tun.handleDataPacket(&v1.Packet{ConnId: request.ConnId, Code: v1.ControlCode_DATA, Data: []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nOK")})
+
+	select {
+	case pc := <-closed:
+		if pc.ID() != request.ConnId {
+			t.Errorf("expected packet connection %d to be closed, got %d", request.ConnId, pc.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the packet connection to be closed once the response is read")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count(mirrorResultMirrored) != mirrored+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the request to be counted as mirrored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
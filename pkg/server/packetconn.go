@@ -2,22 +2,75 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
-	"k8s.io/klog/v2"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/packetqueue"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/resume"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// errWriteDeadlineExceeded closes a packet connection whose client didn't read the data from the agent by its write
+// deadline, the client is sent 504 Gateway Timeout if no response was written to it yet
+var errWriteDeadlineExceeded = status.Error(codes.DeadlineExceeded, "client did not read the response within the write deadline")
+
+// readDeadlineExceededMessage is the message of the ERROR packet received once the read deadline of a packet
+// connection passes
+const readDeadlineExceededMessage = "read deadline exceeded"
+
+// packetConnection carries one connection of a client through the tunnel, it's recycled by packetConnPool
 type packetConnection struct {
-	id           int64
-	ctx          context.Context
-	cancel       context.CancelFunc
-	tunnel       *Tunnel
-	incomingChan chan *v1.Packet
-	mu           sync.Mutex
-	closed       bool
-	closeError   error
+	id     int64
+	ctx    context.Context
+	cancel context.CancelFunc
+	tunnel *Tunnel
+	// incoming buffers the packets from the agent until they're written to the client, up to a budget of bytes
+	incoming   *packetqueue.Queue
+	mu         sync.Mutex
+	closed     bool
+	closeError error
+	// capture records the packets of the packet connection, nil if the capture is disabled
+	capture *capture.Writer
+	// sampler samples the payload of the first packets for the logs, nil if disabled
+	sampler *capture.Sampler
+	// sender and receiver number the DATA packets to resume the packet connection on the next tunnel of the agent,
+	// nil if the tunnel doesn't resume packet connections
+	sender   *resume.Sender
+	receiver *resume.Receiver
+	// seqNum is the SeqNum of the last DATA packet sent to the agent, guarded by mu. seqNums drops the DATA packets
+	// from the agent received twice when the packet connection isn't resumed
+	seqNum  int64
+	seqNums v1.SeqNumReceiver
+	// writeDeadline is the time the client must read the data from the agent over the budget of incoming by,
+	// zero means the packet connection is closed as soon as the budget is exceeded
+	writeDeadline time.Time
+	// overflow holds the packets over the budget of incoming until the client makes room for them,
+	// overflowTimer closes the packet connection when the write deadline passes first
+	overflow      []*v1.Packet
+	overflowBytes int
+	overflowTimer *time.Timer
+	// readDeadline is the time the agent must send its data by, zero means no deadline. readTimer delivers an
+	// ERROR packet once it passes, readExpired is set then
+	readDeadline time.Time
+	readTimer    *time.Timer
+	readExpired  bool
+	// classifier turns the packet connection bulk once it sent enough data, nil if QoS is disabled. It's set
+	// before the first packet is sent
+	classifier *qos.Conn
+	// keepAlive is set for the client connections kept alive across requests, the hub doesn't check their
+	// requests after the first one
+	keepAlive bool
+	// refs counts the references to the packet connection: its owner, the tunnel while it's registered, the packet
+	// handlers looking it up and the timers scheduled. It's put back in the pool once it drops to 0 if pooled
+	refs   atomic.Int32
+	pooled bool
 }
 
 // Context returns the context associated with this packet connection
@@ -30,13 +83,200 @@ func (pc *packetConnection) ID() int64 {
 	return pc.id
 }
 
-// Recv returns a channel for receiving packets from the agent
-func (pc *packetConnection) Recv() <-chan *v1.Packet {
-	return pc.incomingChan
+// Recv waits for the next packet from the agent, it fails once the packet connection is closed
+func (pc *packetConnection) Recv() (*v1.Packet, error) {
+	packet, err := pc.incoming.Pop(pc.ctx)
+	if err == nil {
+		pc.drainOverflow()
+	}
+	return packet, err
+}
+
+// BufferedBytes returns the bytes of data from the agent buffered until the client reads them
+func (pc *packetConnection) BufferedBytes() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.incoming.Bytes() + pc.overflowBytes
+}
+
+// SetWriteDeadline sets the time the client must read the data from the agent by once it exceeds the budget of
+// the buffer. A zero value closes the packet connection as soon as the budget is exceeded
+func (pc *packetConnection) SetWriteDeadline(t time.Time) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.writeDeadline = t
+	if pc.overflowTimer != nil {
+		pc.resetTimer(pc.overflowTimer, pc.timeUntilDeadline())
+	}
+}
+
+// SetReadDeadline sets the time the data from the agent must be received by, like the deadline of a net.Conn it
+// doesn't move with the data received. Once it passes, Recv returns an ERROR packet with readDeadlineExceededMessage
+// after the packets already received, and the agent is told to close its connection to the target service. A zero
+// value disables it
+func (pc *packetConnection) SetReadDeadline(t time.Time) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.readTimer != nil {
+		pc.stopTimer(pc.readTimer)
+		pc.readTimer = nil
+	}
+	pc.readDeadline = t
+	if t.IsZero() || pc.closed {
+		return
+	}
+	pc.readExpired = false
+	pc.readTimer = pc.afterFunc(max(time.Until(t), 0), pc.expireReadDeadline)
+}
+
+// readDeadlineExceeded returns whether the ERROR packet of the read deadline was delivered
+func (pc *packetConnection) readDeadlineExceeded() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.readExpired
+}
+
+// expireReadDeadline delivers the ERROR packet of the read deadline, unless it was extended concurrently
+func (pc *packetConnection) expireReadDeadline() {
+	pc.mu.Lock()
+	if pc.closed || pc.readExpired || pc.readDeadline.IsZero() || time.Now().Before(pc.readDeadline) {
+		pc.mu.Unlock()
+		return
+	}
+	pc.readExpired = true
+	packet := &v1.Packet{ConnId: pc.id, Code: v1.ControlCode_ERROR, ErrorMessage: readDeadlineExceededMessage}
+	// The ERROR carries no data, it only waits behind the packets held over the budget
+	if len(pc.overflow) > 0 || pc.incoming.Push(packet) != nil {
+		pc.overflow = append(pc.overflow, packet)
+	}
+	tunnel := pc.tunnel
+	pc.mu.Unlock()
+
+	logger.V(4).InfoS("Read deadline exceeded", "cluster", tunnel.clusterName, "packet_connection_id", pc.id)
+	tunnel.sendControlPacket(&v1.Packet{ConnId: pc.id, Code: v1.ControlCode_ERROR, ErrorMessage: readDeadlineExceededMessage})
+}
+
+// timeUntilDeadline returns the time left until the write deadline, 0 if it passed or is not set.
+// The caller must hold pc.mu
+func (pc *packetConnection) timeUntilDeadline() time.Duration {
+	if pc.writeDeadline.IsZero() {
+		return 0
+	}
+	return max(time.Until(pc.writeDeadline), 0)
+}
+
+// deliver buffers the packet from the agent without blocking. If the client doesn't keep up and the packet exceeds
+// the budget, the packet connection is closed with ErrReceiverTooSlow, or it's held until the write deadline for
+// the client to make room, the packet connection is closed with errWriteDeadlineExceeded if it doesn't
+func (pc *packetConnection) deliver(packet *v1.Packet) error {
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return packetqueue.ErrClosed
+	}
+	if len(pc.overflow) == 0 {
+		err := pc.incoming.Push(packet)
+		if !errors.Is(err, packetqueue.ErrReceiverTooSlow) {
+			pc.mu.Unlock()
+			return err
+		}
+	}
+
+	remaining := pc.timeUntilDeadline()
+	if remaining > 0 {
+		// Keep the order of the packets, the following ones are held too until the client catches up
+		pc.overflow = append(pc.overflow, packet)
+		pc.overflowBytes += len(packet.Data)
+		if pc.overflowTimer == nil {
+			pc.overflowTimer = pc.afterFunc(remaining, pc.expireWriteDeadline)
+		}
+		pc.mu.Unlock()
+		return nil
+	}
+	deadlineSet := !pc.writeDeadline.IsZero()
+	buffered := pc.incoming.Bytes() + pc.overflowBytes
+	pc.mu.Unlock()
+
+	err := fmt.Errorf("%w: %d bytes buffered", packetqueue.ErrReceiverTooSlow, buffered)
+	if deadlineSet {
+		err = fmt.Errorf("%w: %d bytes buffered", errWriteDeadlineExceeded, buffered)
+	}
+	pc.closeWithError(err)
+	return err
+}
+
+// drainOverflow moves the packets held over the budget to the buffer as the client makes room for them
+func (pc *packetConnection) drainOverflow() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for len(pc.overflow) > 0 {
+		if err := pc.incoming.Push(pc.overflow[0]); err != nil {
+			return
+		}
+		pc.overflowBytes -= len(pc.overflow[0].Data)
+		pc.overflow[0] = nil
+		pc.overflow = pc.overflow[1:]
+	}
+	if pc.overflowTimer != nil {
+		pc.stopTimer(pc.overflowTimer)
+		pc.overflowTimer = nil
+	}
+}
+
+// expireWriteDeadline closes the packet connection if the client didn't make room for the packets held over
+// the budget by the write deadline, the agent is told to close its connection to the target service
+func (pc *packetConnection) expireWriteDeadline() {
+	pc.mu.Lock()
+	if pc.closed || len(pc.overflow) == 0 || pc.timeUntilDeadline() > 0 {
+		// The client caught up, or the deadline was extended concurrently
+		pc.mu.Unlock()
+		return
+	}
+	buffered := pc.incoming.Bytes() + pc.overflowBytes
+	tunnel := pc.tunnel
+	pc.mu.Unlock()
+
+	err := fmt.Errorf("%w: %d bytes buffered", errWriteDeadlineExceeded, buffered)
+	logger.Warningf("Closing packet connection %d of cluster %s: %v", pc.id, tunnel.clusterName, err)
+	pc.closeWithError(err)
+	tunnel.sendControlPacket(&v1.Packet{ConnId: pc.id, Code: v1.ControlCode_ERROR, ErrorMessage: err.Error()})
+}
+
+// UnackedBytes returns the bytes of data sent to the agent kept until it acknowledges them
+func (pc *packetConnection) UnackedBytes() int {
+	if pc.sender == nil {
+		return 0
+	}
+	return pc.sender.Bytes()
+}
+
+// accept returns whether the packet from the agent is the next one in order and should be delivered. The packets of
+// a tunnel resuming packet connections are ordered by their seq, the others are deduplicated by their SeqNum
+func (pc *packetConnection) accept(packet *v1.Packet) bool {
+	if pc.receiver == nil {
+		return pc.seqNums.Accept(packet)
+	}
+	return pc.receiver.Accept(packet)
+}
+
+// ack returns the seq of the packets from the agent to acknowledge, if it's time to
+func (pc *packetConnection) ack() (int64, bool) {
+	if pc.receiver == nil {
+		return 0, false
+	}
+	return pc.receiver.Ack()
 }
 
 // Send sends a packet to the agent
 func (pc *packetConnection) Send(packet *v1.Packet) error {
+	class := pc.classify(packet)
+	if pc.sender != nil && packet.Code == v1.ControlCode_DATA && len(packet.Data) > 0 {
+		return pc.sendResumable(packet, class)
+	}
+
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
 
@@ -46,9 +286,149 @@ func (pc *packetConnection) Send(packet *v1.Packet) error {
 
 	// Set the packet connection ID
 	packet.ConnId = pc.id
+	pc.stamp(packet)
+	pc.record(capture.ToAgent, packet)
 
 	// Send through the tunnel
-	return pc.tunnel.sendPacket(packet)
+	return pc.tunnel.sendPacketAs(packet, class)
+}
+
+// classify returns the class of the packet, it waits for the interactive packets of the packet connection to be
+// sent when it turns bulk. The ERRORs are sent with the class of the packet connection, after its DATA packets
+func (pc *packetConnection) classify(packet *v1.Packet) qos.Class {
+	if pc.classifier == nil {
+		return qos.Interactive
+	}
+	if packet.Code != v1.ControlCode_DATA {
+		return pc.classifier.Current()
+	}
+	pc.mu.Lock()
+	tunnel := pc.tunnel
+	pc.mu.Unlock()
+	return pc.classifier.Class(pc.ctx, len(packet.Data), tunnel.interactiveIdle)
+}
+
+// sendResumable numbers the DATA packet and keeps it until the agent acknowledges it. It waits while the replay
+// buffer is full, and succeeds while the tunnel is unavailable since the packet is retransmitted on resume
+func (pc *packetConnection) sendResumable(packet *v1.Packet, class qos.Class) error {
+	if err := pc.sender.Wait(pc.ctx); err != nil {
+		return fmt.Errorf("packet connection is closed: %w", err)
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed {
+		return fmt.Errorf("packet connection is closed: %v", pc.closeError)
+	}
+
+	packet.ConnId = pc.id
+	pc.stamp(packet)
+	pc.sender.Add(packet)
+	pc.record(capture.ToAgent, packet)
+
+	err := pc.tunnel.sendPacketAs(packet, class)
+	if errors.Is(err, errTunnelUnavailable) {
+		return nil
+	}
+	return err
+}
+
+// stamp numbers the DATA packet and sets its checksum if the tunnel checks the integrity, before the packet is queued
+// or kept for retransmission so that it's never modified once shared. The caller must hold pc.mu
+func (pc *packetConnection) stamp(packet *v1.Packet) {
+	if packet.Code != v1.ControlCode_DATA {
+		return
+	}
+	pc.seqNum++
+	packet.SeqNum = pc.seqNum
+	if pc.tunnel.integrity {
+		packet.SetChecksum()
+	}
+}
+
+// resume sends a RESUME with the seq of the last packet received from the agent in order, followed by the DATA
+// packets the agent didn't acknowledge. The packets sent afterwards are ordered after them
+func (pc *packetConnection) resume() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed {
+		return nil
+	}
+	class := pc.classifier.Current()
+	if err := pc.tunnel.sendPacketAs(&v1.Packet{ConnId: pc.id, Code: v1.ControlCode_RESUME, Ack: pc.receiver.Received()}, class); err != nil {
+		return err
+	}
+	for _, packet := range pc.sender.Unacked() {
+		// The packets were sent on the previous tunnel, which may not have checked their integrity
+		if err := pc.tunnel.sendPacketAs(packet.Retransmission(pc.tunnel.integrity), class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Err returns the error the packet connection was closed with, nil if it's open or closed without error
+func (pc *packetConnection) Err() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closeError
+}
+
+// quiet returns whether the packet connection is open and holds no packet from the agent, e.g. an idle connection
+// whose agent didn't close it
+func (pc *packetConnection) quiet() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return !pc.closed && pc.incoming.Len() == 0 && len(pc.overflow) == 0
+}
+
+// setTunnel moves the packet connection to another tunnel of the same cluster
+func (pc *packetConnection) setTunnel(t *Tunnel) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.tunnel = t
+}
+
+// setCapture records the packets of the packet connection with the writer, it's closed with the packet connection
+func (pc *packetConnection) setCapture(w *capture.Writer) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.capture = w
+}
+
+// setKeepAlive marks the packet connection as carrying a client connection kept alive across requests
+func (pc *packetConnection) setKeepAlive() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.keepAlive = true
+}
+
+// isKeepAlive returns whether the packet connection carries a client connection kept alive across requests
+func (pc *packetConnection) isKeepAlive() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.keepAlive
+}
+
+// setSampler logs the payload samples of the packet connection with the sampler
+func (pc *packetConnection) setSampler(s *capture.Sampler) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.sampler = s
+}
+
+// record captures the packet and logs the sample of its payload
+func (pc *packetConnection) record(direction capture.Direction, packet *v1.Packet) {
+	pc.capture.Record(direction, packet)
+	if packet.Code != v1.ControlCode_DATA {
+		return
+	}
+	if sample, ok := pc.sampler.Sample(direction, packet.Data); ok {
+		logger.InfoS("Payload sample", "packet_connection_id", pc.id, "direction", direction, "length", sample.Length,
+			"hex", sample.Hex, "text", sample.Text)
+	}
 }
 
 // Close closes the packet connection with an optional error
@@ -72,15 +452,31 @@ func (pc *packetConnection) closeWithError(err error) {
 	if pc.cancel != nil {
 		pc.cancel()
 	}
+	// Release the buffered packets
+	pc.incoming.Close()
+	pc.overflow, pc.overflowBytes = nil, 0
+	if pc.overflowTimer != nil {
+		pc.stopTimer(pc.overflowTimer)
+		pc.overflowTimer = nil
+	}
+	if pc.readTimer != nil {
+		pc.stopTimer(pc.readTimer)
+		pc.readTimer = nil
+	}
 
+	tunnel := pc.tunnel
 	pc.mu.Unlock()
 
+	if err := pc.capture.Close(); err != nil {
+		logger.ErrorS(err, "Failed to close packet capture", "packet_connection_id", pc.id)
+	}
+
 	// Remove from tunnel - do this outside the lock to avoid deadlock
-	pc.tunnel.removePacketConn(pc.id)
+	tunnel.removePacketConn(pc)
 
 	if err != nil {
-		klog.V(4).InfoS("Closed packet connection with error", "packet_connection_id", pc.id, "error", err)
+		logger.V(4).InfoS("Closed packet connection with error", "packet_connection_id", pc.id, "error", err)
 	} else {
-		klog.V(4).InfoS("Closed packet connection", "packet_connection_id", pc.id)
+		logger.V(4).InfoS("Closed packet connection", "packet_connection_id", pc.id)
 	}
 }
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// BenchmarkPacketConnLifecycle measures the allocations of a packet connection over a request: it's opened, receives
+// the response from the agent and is closed. The pooled packet connections are released by their owner like the ones
+// of ServeHTTP, the others are left to the GC like the ones of Tunnel.RoundTrip
+func BenchmarkPacketConnLifecycle(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			tun := newTestTunnel(1)
+			response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pc, err := tun.NewPacketConn(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: response})
+				if _, err := pc.Recv(); err != nil {
+					b.Fatal(err)
+				}
+				pc.Close(nil)
+				if pooled {
+					pc.release()
+				}
+			}
+		})
+	}
+}
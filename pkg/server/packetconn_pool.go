@@ -0,0 +1,73 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// packetConnPool recycles the packet connections, with the buffer of their packets from the agent, so that every HTTP
+// request to the hub doesn't allocate them. A packet connection is put back once its last reference is released:
+// the packet handlers of the Tunnel, the timers and the HTTP handler keep using one after it's closed, a recycled one
+// would receive the packets of the connection it replaced otherwise
+type packetConnPool struct {
+	sync.Pool
+}
+
+// pooledPacketConns is the pool of the packet connections of all the tunnels
+var pooledPacketConns = &packetConnPool{
+	Pool: sync.Pool{
+		New: func() any { return &packetConnection{} },
+	},
+}
+
+// get returns a packet connection with zeroed fields, its buffer is kept to be reset by the caller, nil for a new one
+func (p *packetConnPool) get() *packetConnection {
+	return p.Get().(*packetConnection)
+}
+
+// put resets the fields of the packet connection and puts it back, it must not be referenced anymore. Its buffer was
+// closed with the packet connection, the packets left in it are dropped by the reset in NewPacketConn
+func (p *packetConnPool) put(pc *packetConnection) {
+	*pc = packetConnection{incoming: pc.incoming}
+	p.Put(pc)
+}
+
+// acquire adds a reference to the packet connection, the caller must already hold one, e.g. the one of the tunnel
+// while it looks the packet connection up
+func (pc *packetConnection) acquire() {
+	pc.refs.Add(1)
+}
+
+// release drops a reference to the packet connection, it's put back in the pool once the last one is released. The
+// packet connections whose owner never releases them, e.g. the ones of Tunnel.RoundTrip, are left to the GC
+func (pc *packetConnection) release() {
+	if pc.refs.Add(-1) == 0 && pc.pooled {
+		pooledPacketConns.put(pc)
+	}
+}
+
+// afterFunc calls f after d, the timer holds a reference to the packet connection until it fires or stopTimer
+// stops it. The caller must hold pc.mu
+func (pc *packetConnection) afterFunc(d time.Duration, f func()) *time.Timer {
+	pc.acquire()
+	return time.AfterFunc(d, func() {
+		defer pc.release()
+		f()
+	})
+}
+
+// resetTimer reschedules the timer of afterFunc after d, it takes a reference again if the timer fired or was stopped.
+// The caller must hold pc.mu
+func (pc *packetConnection) resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Reset(d) {
+		pc.acquire()
+	}
+}
+
+// stopTimer stops the timer of afterFunc, the reference of the timer is released if it didn't fire. The caller must
+// hold pc.mu and a reference to the packet connection
+func (pc *packetConnection) stopTimer(timer *time.Timer) {
+	if timer.Stop() {
+		pc.release()
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// sniffTimeout bounds the wait for the first bytes of a connection on the gRPC listener, the connections
+	// sending nothing for this long are served by the gRPC server
+	sniffTimeout = 10 * time.Second
+	// misroutedLingerTimeout is how long the request of a misrouted HTTP client is read after the error response,
+	// so that closing the connection with unread data doesn't reset it before the client reads the response
+	misroutedLingerTimeout = 500 * time.Millisecond
+	// maxTLSRecordSize is the size of the largest TLS record holding a ClientHello, with its header
+	maxTLSRecordSize = 5 + 16*1024
+)
+
+// http2Preface is the start of the preface of the HTTP/2 connections with prior knowledge, e.g. the plaintext gRPC
+// connections
+var http2Preface = []byte("PRI * HTTP/2.0")
+
+// connProtocol is the protocol of a connection accepted on the gRPC listener
+type connProtocol int
+
+const (
+	protocolGRPC connProtocol = iota
+	protocolHTTP
+)
+
+// protocolMux sniffs the first bytes of the connections accepted on the gRPC listener. The HTTP/1.x clients, e.g.
+// kubectl pointed at the gRPC port, are answered 400 Bad Request with the HTTP address to use, or served by the HTTP
+// server in single-port mode, the other connections are served by the gRPC server.
+//
+// With TLS, a ClientHello offering no ALPN protocol or offering http/1.1 is an HTTP client: gRPC clients only offer
+// h2. Plaintext HTTP/2 connections with prior knowledge are always gRPC ones
+type protocolMux struct {
+	root net.Listener
+	// tlsConfig is the TLS config of the gRPC server, nil if it's plaintext. The misrouted HTTPS clients are answered
+	// over TLS with it
+	tlsConfig *tls.Config
+	// httpAddress is the address the misrouted HTTP clients are told to use, empty without an HTTP server
+	httpAddress string
+
+	grpc *muxListener
+	// http receives the HTTP connections in single-port mode, nil otherwise
+	http *muxListener
+
+	mu sync.Mutex
+	// routing holds the connections being sniffed or rejected, they're closed once root is
+	routing map[net.Conn]struct{}
+	// done is closed once root fails to accept, err is its error
+	done chan struct{}
+	err  error
+}
+
+// newProtocolMux starts accepting the connections of root, singlePort serves the HTTP clients on the listener
+// returned by httpListener. Closing the gRPC listener closes root
+func newProtocolMux(root net.Listener, tlsConfig *tls.Config, httpAddress string, singlePort bool) *protocolMux {
+	m := &protocolMux{
+		root:        root,
+		tlsConfig:   tlsConfig,
+		httpAddress: httpAddress,
+		routing:     make(map[net.Conn]struct{}),
+		done:        make(chan struct{}),
+	}
+	m.grpc = newMuxListener(m, func() { root.Close() })
+	if singlePort {
+		m.http = newMuxListener(m, func() {})
+	}
+	go m.serve()
+	return m
+}
+
+// grpcListener returns the listener of the connections of the gRPC server
+func (m *protocolMux) grpcListener() net.Listener {
+	return m.grpc
+}
+
+// httpListener returns the listener of the connections of the HTTP server in single-port mode, nil otherwise
+func (m *protocolMux) httpListener() net.Listener {
+	if m.http == nil {
+		return nil
+	}
+	return m.http
+}
+
+func (m *protocolMux) serve() {
+	var delay time.Duration
+	for {
+		conn, err := m.root.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// Retry like the http.Server does, e.g. when the process is out of file descriptors
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				logger.V(2).InfoS("Failed to accept connection on gRPC listener, retrying", "error", err, "delay", delay)
+				time.Sleep(delay)
+				continue
+			}
+			m.stop(err)
+			return
+		}
+		delay = 0
+		m.track(conn)
+		go m.route(conn)
+	}
+}
+
+// route sniffs the protocol of the connection and hands it to its server
+func (m *protocolMux) route(conn net.Conn) {
+	defer m.untrack(conn)
+	protocol, sniffed, err := m.sniff(conn)
+	if err != nil {
+		// The client closed the connection before sending anything, e.g. a TCP health check
+		conn.Close()
+		return
+	}
+
+	target := m.grpc
+	if protocol == protocolHTTP {
+		if m.http == nil {
+			m.rejectHTTP(sniffed)
+			return
+		}
+		target = m.http
+	}
+	select {
+	case target.conns <- sniffed:
+	case <-target.closed:
+		conn.Close()
+	case <-m.done:
+		conn.Close()
+	}
+}
+
+// sniff returns the protocol of the connection and the connection replaying the sniffed bytes. It fails if the
+// connection is closed before its first byte, the connections whose protocol can't be told are gRPC ones
+func (m *protocolMux) sniff(conn net.Conn) (connProtocol, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReaderSize(conn, maxTLSRecordSize)
+	sniffed := &sniffedConn{Conn: conn, r: r}
+	first, err := r.Peek(1)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, err
+		}
+		return protocolGRPC, sniffed, nil
+	}
+
+	// The first byte of a TLS handshake record
+	if first[0] == 0x16 {
+		if m.tlsConfig == nil {
+			return protocolGRPC, sniffed, nil
+		}
+		protos, ok := peekClientHelloProtos(r)
+		if ok && (len(protos) == 0 || slices.Contains(protos, "http/1.1")) {
+			return protocolHTTP, sniffed, nil
+		}
+		return protocolGRPC, sniffed, nil
+	}
+
+	// The request line of HTTP/1.x is at least as long as the preface, e.g. "GET / HTTP/1.0"
+	prefix, err := r.Peek(len(http2Preface))
+	if err != nil || bytes.Equal(prefix, http2Preface) || !isHTTPMethod(prefix) {
+		return protocolGRPC, sniffed, nil
+	}
+	return protocolHTTP, sniffed, nil
+}
+
+// isHTTPMethod returns whether the data starts with an HTTP method followed by a space, e.g. "GET "
+func isHTTPMethod(data []byte) bool {
+	for i, b := range data {
+		switch {
+		case b == ' ':
+			return i > 0
+		case b < 'A' || b > 'Z':
+			return false
+		}
+	}
+	return false
+}
+
+// errClientHelloRead aborts the handshake reading the ClientHello of a connection
+var errClientHelloRead = errors.New("client hello read")
+
+// peekClientHelloProtos returns the ALPN protocols offered by the ClientHello in the first TLS record buffered by r,
+// false if the record doesn't hold a whole ClientHello
+func peekClientHelloProtos(r *bufio.Reader) ([]string, bool) {
+	header, err := r.Peek(5)
+	if err != nil {
+		return nil, false
+	}
+	record, err := r.Peek(min(5+(int(header[3])<<8|int(header[4])), maxTLSRecordSize))
+	if err != nil {
+		return nil, false
+	}
+
+	// The ClientHello is parsed by a handshake over a copy of the record, aborted once it's read
+	var protos []string
+	read := false
+	tls.Server(&replayConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos, read = hello.SupportedProtos, true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return protos, read
+}
+
+// rejectHTTP answers a misrouted HTTP client with 400 Bad Request and the HTTP address to use, over TLS if the gRPC
+// server uses TLS
+func (m *protocolMux) rejectHTTP(conn net.Conn) {
+	defer conn.Close()
+	logger.V(2).InfoS("Rejecting HTTP request on the gRPC listener", "remote_addr", conn.RemoteAddr())
+
+	var tlsConn *tls.Conn
+	if m.tlsConfig != nil {
+		if _, ok := peekClientHelloProtos(conn.(*sniffedConn).r); ok {
+			config := m.tlsConfig.Clone()
+			config.NextProtos = []string{"http/1.1"}
+			tlsConn = tls.Server(conn, config)
+			conn = tlsConn
+		}
+	}
+	conn.SetDeadline(time.Now().Add(sniffTimeout))
+
+	message := "This is the tunnel gRPC port of the hub, it serves the agents only."
+	if m.httpAddress != "" {
+		message += fmt.Sprintf(" Send the HTTP requests to the HTTP address of the hub, %s.", m.httpAddress)
+	}
+	message += "\n"
+	if err := writeErrorResponse(conn, 400, message); err != nil {
+		logger.V(4).InfoS("Failed to answer HTTP request on the gRPC listener", "remote_addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	// Read the request until the client closes the connection, it would be reset if it's closed with unread data
+	if tlsConn != nil {
+		tlsConn.CloseWrite()
+	} else if cw, ok := conn.(*sniffedConn).Conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(misroutedLingerTimeout))
+	io.Copy(io.Discard, conn)
+}
+
+// track records a connection being routed
+func (m *protocolMux) track(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routing[conn] = struct{}{}
+}
+
+func (m *protocolMux) untrack(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.routing, conn)
+}
+
+// stop closes the connections being routed once root failed with err, the listeners then fail with it
+func (m *protocolMux) stop(err error) {
+	m.mu.Lock()
+	routing := m.routing
+	m.routing = nil
+	m.mu.Unlock()
+	for conn := range routing {
+		conn.Close()
+	}
+	m.err = err
+	close(m.done)
+}
+
+// muxListener is a listener of the connections of one protocol of a protocolMux
+type muxListener struct {
+	mux       *protocolMux
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newMuxListener(mux *protocolMux, onClose func()) *muxListener {
+	return &muxListener{mux: mux, conns: make(chan net.Conn), closed: make(chan struct{}), onClose: onClose}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.mux.done:
+		return nil, l.mux.err
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.onClose()
+	})
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.mux.root.Addr()
+}
+
+// sniffedConn is a connection whose first bytes were buffered by r, they're read before the rest of the connection
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the accepted connection, e.g. to set the TCP keepalive of the HTTP clients in single-port mode
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// replayConn replays the data of r to a TLS handshake, its writes are discarded
+type replayConn struct {
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return packetNetAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr               { return packetNetAddr{} }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
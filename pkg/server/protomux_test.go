@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+)
+
+// newTestMux returns a protocol mux of a listener on a random port
+func newTestMux(t *testing.T, tlsConfig *tls.Config, singlePort bool) *protocolMux {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	m := newProtocolMux(listener, tlsConfig, "hub.example.com:8080", singlePort)
+	t.Cleanup(func() {
+		m.grpcListener().Close()
+		if l := m.httpListener(); l != nil {
+			l.Close()
+		}
+	})
+	return m
+}
+
+// acceptConn returns the next connection of the listener
+func acceptConn(t *testing.T, listener net.Listener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a connection to be accepted")
+		return nil
+	}
+}
+
+// newTestTLSConfigs returns the TLS config of a server for localhost and the pool verifying it
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	ca, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	keyPair, err := ca.IssueServer("localhost")
+	if err != nil {
+		t.Fatalf("failed to issue server certificate: %v", err)
+	}
+	cert, err := keyPair.TLSCertificate()
+	if err != nil {
+		t.Fatalf("failed to load server key pair: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, ca.CertPool()
+}
+
+func TestProtocolMuxRejectsHTTP(t *testing.T) {
+	m := newTestMux(t, nil, false)
+	resp, err := http.Get("http://" + m.root.Addr().String() + "/cluster1/api")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "hub.example.com:8080") {
+		t.Fatalf("expected 400 with the HTTP address, got %d %q", resp.StatusCode, body)
+	}
+
+	// The gRPC connections are replayed their sniffed bytes
+	conn, err := net.Dial("tcp", m.root.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	preface := "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	conn.Write([]byte(preface))
+	accepted := acceptConn(t, m.grpcListener())
+	data := make([]byte, len(preface))
+	if _, err := io.ReadFull(accepted, data); err != nil || string(data) != preface {
+		t.Fatalf("expected the preface, got %q: %v", data, err)
+	}
+}
+
+func TestProtocolMuxRejectsHTTPS(t *testing.T) {
+	tlsConfig, pool := newTestTLSConfigs(t)
+	m := newTestMux(t, tlsConfig, false)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}}
+	resp, err := client.Get("https://" + m.root.Addr().String() + "/cluster1/api")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "tunnel gRPC port") {
+		t.Fatalf("expected 400 with the hint, got %d %q", resp.StatusCode, body)
+	}
+
+	// The TLS clients offering h2 only are gRPC ones
+	done := make(chan error, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", m.root.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"h2"}})
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	server := tls.Server(acceptConn(t, m.grpcListener()), &tls.Config{Certificates: tlsConfig.Certificates, NextProtos: []string{"h2"}})
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("unexpected handshake error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected client error: %v", err)
+	}
+}
+
+func TestProtocolMuxSinglePort(t *testing.T) {
+	m := newTestMux(t, nil, true)
+	go http.Serve(m.httpListener(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served " + r.URL.Path))
+	}))
+
+	resp, err := http.Get("http://" + m.root.Addr().String() + "/cluster1/api")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "served /cluster1/api" {
+		t.Fatalf("expected the HTTP server to serve the request, got %d %q", resp.StatusCode, body)
+	}
+
+	// Closing the HTTP listener leaves the gRPC one accepting
+	m.httpListener().Close()
+	conn, err := net.Dial("tcp", m.root.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	acceptConn(t, m.grpcListener())
+
+	// Closing the gRPC listener closes the root one
+	m.grpcListener().Close()
+	if _, err := m.grpcListener().Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", m.root.Addr().String(), time.Second); err == nil {
+		t.Fatalf("expected the root listener to be closed")
+	}
+}
+
+func TestIsHTTPMethod(t *testing.T) {
+	for data, expected := range map[string]bool{
+		"GET / HTTP/1.1":   true,
+		"OPTIONS * HTTP/":  true,
+		"PRI * HTTP/2.0":   true,
+		" GET / HTTP/1.1":  false,
+		"get / HTTP/1.1":   false,
+		"\x00\x00\x12\x04": false,
+	} {
+		if isHTTPMethod([]byte(data)) != expected {
+			t.Errorf("expected isHTTPMethod(%q) to be %t", data, expected)
+		}
+	}
+	if isHTTPMethod(bytes.Repeat([]byte("A"), 14)) {
+		t.Errorf("expected a token without a space not to be a method")
+	}
+}
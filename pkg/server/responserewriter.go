@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ResponseRewriter rewrites the response from the agent before it's written to the client.
+// Only the response head (status and headers) can be rewritten, the body is forwarded as is.
+type ResponseRewriter interface {
+	// Rewrite is called with the parsed response head, resp.Request is the original client request
+	Rewrite(clusterName string, resp *http.Response) error
+}
+
+// headerResponseRewriter rewrites Location and Set-Cookie headers that point at the in-cluster target host,
+// so that web UIs proxied through the tunnel keep working when accessed via the hub URL.
+type headerResponseRewriter struct {
+	externalURL *url.URL
+}
+
+// NewHeaderResponseRewriter creates a ResponseRewriter that:
+//   - rewrites Location headers pointing at an in-cluster host, or at an absolute path, to the hub's external URL + proxy prefix
+//   - drops in-cluster Domain attributes of Set-Cookie headers and prepends the proxy prefix to their Path attributes
+//
+// The proxy prefix is the part of the request path before the target path, e.g. /<cluster_name> for kube-apiserver
+// requests and /<cluster_name>/api/v1/namespaces/<namespace>/services/<service>/proxy-service for service requests.
+// externalURL is the URL clients use to access the hub, e.g. https://hub.example.com; if it's empty the scheme and
+// host of the client request are used.
+func NewHeaderResponseRewriter(externalURL string) (ResponseRewriter, error) {
+	rewriter := &headerResponseRewriter{}
+	if externalURL != "" {
+		u, err := url.Parse(externalURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid external URL %s: %w", externalURL, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("external URL %s must be absolute", externalURL)
+		}
+		rewriter.externalURL = u
+	}
+	return rewriter, nil
+}
+
+// Rewrite rewrites the Location and Set-Cookie headers of the response
+func (rw *headerResponseRewriter) Rewrite(clusterName string, resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	prefix := proxyPrefix(clusterName, resp.Request.URL.Path)
+
+	if location := resp.Header.Get("Location"); location != "" {
+		rewritten, err := rw.rewriteLocation(location, prefix, resp.Request)
+		if err != nil {
+			return err
+		}
+		resp.Header.Set("Location", rewritten)
+	}
+
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		resp.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			resp.Header.Add("Set-Cookie", rewriteSetCookie(cookie, prefix))
+		}
+	}
+
+	return nil
+}
+
+// rewriteLocation rewrites an absolute in-cluster URL or an absolute path to the hub's external URL + prefix.
+// Relative paths and URLs pointing outside of the cluster are left untouched.
+func (rw *headerResponseRewriter) rewriteLocation(location, prefix string, r *http.Request) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid Location header %s: %w", location, err)
+	}
+
+	switch {
+	case u.Host != "" && isInClusterHost(u.Host):
+	case u.Host == "" && u.Scheme == "" && strings.HasPrefix(u.Path, "/"):
+		if strings.HasPrefix(u.Path, prefix+"/") {
+			// Already points at the hub
+			return location, nil
+		}
+	default:
+		return location, nil
+	}
+
+	external := rw.externalURL
+	if external == nil {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		external = &url.URL{Scheme: scheme, Host: r.Host}
+	}
+
+	u.Scheme = external.Scheme
+	u.Host = external.Host
+	u.Path = strings.TrimSuffix(external.Path, "/") + prefix + u.Path
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// rewriteSetCookie drops an in-cluster Domain attribute and prepends the prefix to the Path attribute
+func rewriteSetCookie(setCookie, prefix string) string {
+	cookie, err := http.ParseSetCookie(setCookie)
+	if err != nil {
+		// Leave cookies we don't understand untouched
+		return setCookie
+	}
+
+	if cookie.Domain != "" && isInClusterHost(cookie.Domain) {
+		// A host-only cookie is scoped to the hub host
+		cookie.Domain = ""
+	}
+	// Without a Path attribute, the browser defaults to the request path which already contains the prefix
+	if strings.HasPrefix(cookie.Path, "/") && cookie.Path != prefix && !strings.HasPrefix(cookie.Path, prefix+"/") {
+		cookie.Path = prefix + cookie.Path
+	}
+	return cookie.String()
+}
+
+// proxyPrefix returns the part of the request path before the target path
+func proxyPrefix(clusterName, requestPath string) string {
+	const proxyService = "/proxy-service"
+	if i := strings.Index(requestPath, proxyService+"/"); i >= 0 {
+		return requestPath[:i+len(proxyService)]
+	}
+	if strings.HasSuffix(requestPath, proxyService) {
+		return requestPath
+	}
+	return "/" + clusterName
+}
+
+// isInClusterHost returns true if the host is a kubernetes service or a short name only resolvable in the cluster
+func isInClusterHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	return !strings.Contains(host, ".") ||
+		strings.HasSuffix(host, ".svc") ||
+		strings.HasSuffix(host, ".svc.cluster.local")
+}
+
+// responseBodySize returns the size of the body of the response, 0 for the responses without body, e.g. to HEAD
+// requests, and -1 if the size is not known before the end of the body, see RFC 7230 section 3.3.3
+func responseBodySize(r *http.Request, resp *http.Response) int64 {
+	if (r != nil && r.Method == http.MethodHead) ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return 0
+	}
+	if len(resp.Header.Values("Transfer-Encoding")) > 0 {
+		return -1
+	}
+	values := resp.Header.Values("Content-Length")
+	if len(values) != 1 {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// maxResponseHeadSize bounds the response head buffered for rewriting, larger heads are forwarded as is
+const maxResponseHeadSize = 1 << 20 // 1MB
+
+// responseHeadRewriter buffers the response head from the agent, merges the headers set by the HTTP middlewares
+// and applies the ResponseRewriter to it
+type responseHeadRewriter struct {
+	rewriter    ResponseRewriter
+	header      http.Header
+	clusterName string
+	request     *http.Request
+	head        []byte
+	done        bool
+	// bodyRemaining is the size of the body left once the response asks the client to close the connection, the
+	// hub closes it after the body. It's -1 while the size of the body is not known, e.g. for chunked bodies
+	bodyRemaining int64
+	// complete is set once the whole response asking the client to close the connection is written
+	complete bool
+}
+
+// newResponseHeadRewriter returns nil if there is neither a ResponseRewriter nor a header to merge, and the client
+// connection isn't closed after the response
+func newResponseHeadRewriter(rewriter ResponseRewriter, header http.Header, clusterName string, r *http.Request, closeAfterResponse bool) *responseHeadRewriter {
+	if rewriter == nil && len(header) == 0 && !closeAfterResponse {
+		return nil
+	}
+	return &responseHeadRewriter{
+		rewriter:      rewriter,
+		header:        header,
+		clusterName:   clusterName,
+		request:       r,
+		bodyRemaining: -1,
+	}
+}
+
+// Write takes the data from the agent and returns the data to write to the client,
+// which is empty until the response head is complete
+func (rw *responseHeadRewriter) Write(data []byte) []byte {
+	if rw == nil {
+		return data
+	}
+	if rw.done {
+		return rw.body(data)
+	}
+
+	rw.head = append(rw.head, data...)
+	var out []byte
+	for !rw.done {
+		end := bytes.Index(rw.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(rw.head) > maxResponseHeadSize {
+				rw.done = true
+				out = append(out, rw.Flush()...)
+			}
+			return out
+		}
+
+		head, informational := rw.rewrite(rw.head[:end+4])
+		out = append(out, head...)
+		rw.head = rw.head[end+4:]
+		// Informational responses (e.g. 100 Continue) are followed by the final response head
+		rw.done = !informational
+	}
+	return append(out, rw.body(rw.Flush())...)
+}
+
+// body returns the body data to write to the client, the data after the end of a response closing the connection
+// is dropped
+func (rw *responseHeadRewriter) body(data []byte) []byte {
+	if rw.bodyRemaining < 0 {
+		return data
+	}
+	if int64(len(data)) >= rw.bodyRemaining {
+		data = data[:rw.bodyRemaining]
+		rw.complete = true
+	}
+	rw.bodyRemaining -= int64(len(data))
+	return data
+}
+
+// Complete returns whether the response asking the client to close the connection is written, the client
+// connection is then closed
+func (rw *responseHeadRewriter) Complete() bool {
+	return rw != nil && rw.complete
+}
+
+// Flush returns the buffered data that has not been written yet
+func (rw *responseHeadRewriter) Flush() []byte {
+	if rw == nil {
+		return nil
+	}
+	head := rw.head
+	rw.head = nil
+	return head
+}
+
+// rewrite parses and rewrites a complete response head, it's returned as is if it can't be parsed or rewritten
+func (rw *responseHeadRewriter) rewrite(head []byte) ([]byte, bool) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(head)))
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return head, false
+	}
+	proto, status, ok := strings.Cut(statusLine, " ")
+	if !ok || len(status) < 3 {
+		return head, false
+	}
+	statusCode, err := strconv.Atoi(status[:3])
+	if err != nil {
+		return head, false
+	}
+	informational := statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+	if informational {
+		return head, true
+	}
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return head, false
+	}
+
+	resp := &http.Response{
+		Status:     status,
+		StatusCode: statusCode,
+		Proto:      proto,
+		Header:     http.Header(mimeHeader),
+		Request:    rw.request,
+	}
+	// Headers from the agent take precedence
+	for key, values := range rw.header {
+		if _, ok := resp.Header[key]; !ok {
+			resp.Header[key] = values
+		}
+	}
+	if rw.rewriter != nil {
+		if err := rw.rewriter.Rewrite(rw.clusterName, resp); err != nil {
+			logger.ErrorS(err, "Failed to rewrite response", "cluster", rw.clusterName)
+			return head, false
+		}
+	}
+	if statusCode != http.StatusSwitchingProtocols {
+		// Only the first response of the connection is rewritten, make the client use a new connection
+		// for the next request so that its response is rewritten as well
+		resp.Header.Set("Connection", "close")
+		rw.bodyRemaining = responseBodySize(rw.request, resp)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(statusLine + "\r\n")
+	if err := resp.Header.Write(&buf); err != nil {
+		return head, false
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes(), false
+}
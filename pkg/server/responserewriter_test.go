@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderResponseRewriter(t *testing.T) {
+	cases := []struct {
+		name           string
+		externalURL    string
+		requestURL     string
+		location       string
+		setCookie      string
+		expectLocation string
+		expectCookie   string
+	}{
+		{
+			name:           "in-cluster location",
+			requestURL:     "http://hub.example.com/cluster1/dashboard",
+			location:       "http://backend.default.svc:8080/login?next=%2F",
+			expectLocation: "http://hub.example.com/cluster1/login?next=%2F",
+		},
+		{
+			name:           "absolute path location with external URL",
+			externalURL:    "https://hub.example.com/tunnel",
+			requestURL:     "http://10.0.0.1/cluster1/api/v1/namespaces/default/services/ui/proxy-service/index.html",
+			location:       "/login",
+			expectLocation: "https://hub.example.com/tunnel/cluster1/api/v1/namespaces/default/services/ui/proxy-service/login",
+		},
+		{
+			name:           "location already under the prefix",
+			requestURL:     "http://hub.example.com/cluster1/dashboard",
+			location:       "/cluster1/login",
+			expectLocation: "/cluster1/login",
+		},
+		{
+			name:           "relative and external locations are untouched",
+			requestURL:     "http://hub.example.com/cluster1/dashboard",
+			location:       "https://example.com/docs",
+			expectLocation: "https://example.com/docs",
+		},
+		{
+			name:         "in-cluster cookie domain and path",
+			requestURL:   "http://hub.example.com/cluster1/dashboard",
+			setCookie:    "session=abc; Domain=backend.default.svc.cluster.local; Path=/app",
+			expectCookie: "session=abc; Path=/cluster1/app",
+		},
+		{
+			name:         "external cookie domain is kept",
+			requestURL:   "http://hub.example.com/cluster1/dashboard",
+			setCookie:    "session=abc; Domain=example.com",
+			expectCookie: "session=abc; Domain=example.com",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rewriter, err := NewHeaderResponseRewriter(c.externalURL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			resp := &http.Response{Header: http.Header{}, Request: httptest.NewRequest(http.MethodGet, c.requestURL, nil)}
+			if c.location != "" {
+				resp.Header.Set("Location", c.location)
+			}
+			if c.setCookie != "" {
+				resp.Header.Set("Set-Cookie", c.setCookie)
+			}
+
+			if err := rewriter.Rewrite("cluster1", resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := resp.Header.Get("Location"); got != c.expectLocation {
+				t.Errorf("expected Location %q, got %q", c.expectLocation, got)
+			}
+			if got := resp.Header.Get("Set-Cookie"); got != c.expectCookie {
+				t.Errorf("expected Set-Cookie %q, got %q", c.expectCookie, got)
+			}
+		})
+	}
+}
+
+func TestResponseHeadRewriter(t *testing.T) {
+	rewriter, _ := NewHeaderResponseRewriter("")
+	rw := newResponseHeadRewriter(rewriter, nil, "cluster1", httptest.NewRequest(http.MethodGet, "http://hub/cluster1/", nil), false)
+
+	// The head is split across packets and preceded by an informational response
+	if out := rw.Write([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 302 Found\r\nLocation: http://ui/login\r\n")); string(out) != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	out := rw.Write([]byte("Content-Length: 8\r\n\r\nbody"))
+	expected := "HTTP/1.1 302 Found\r\nConnection: close\r\nContent-Length: 8\r\nLocation: http://hub/cluster1/login\r\n\r\nbody"
+	if string(out) != expected {
+		t.Fatalf("expected %q, got %q", expected, out)
+	}
+	if rw.Complete() {
+		t.Fatalf("expected the response to be incomplete")
+	}
+	if out := rw.Write([]byte("more")); string(out) != "more" {
+		t.Fatalf("expected the body to be forwarded as is, got %q", out)
+	}
+	if !rw.Complete() {
+		t.Fatalf("expected the response to be complete")
+	}
+}
+
+func TestResponseHeadRewriterBodySize(t *testing.T) {
+	cases := []struct {
+		name           string
+		method         string
+		response       string
+		expected       string
+		expectComplete bool
+	}{
+		{
+			name:           "HEAD keeps Content-Length",
+			method:         http.MethodHead,
+			response:       "HTTP/1.1 200 OK\r\nContent-Length: 18\r\n\r\nHTTP/1.1 200 OK",
+			expected:       "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 18\r\n\r\n",
+			expectComplete: true,
+		},
+		{
+			name:           "204 without Content-Length",
+			method:         http.MethodGet,
+			response:       "HTTP/1.1 204 No Content\r\n\r\n",
+			expected:       "HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n",
+			expectComplete: true,
+		},
+		{
+			name:           "304 keeps the validators",
+			method:         http.MethodGet,
+			response:       "HTTP/1.1 304 Not Modified\r\nEtag: \"v1\"\r\n\r\n",
+			expected:       "HTTP/1.1 304 Not Modified\r\nConnection: close\r\nEtag: \"v1\"\r\n\r\n",
+			expectComplete: true,
+		},
+		{
+			name:           "Content-Length 0 is kept",
+			method:         http.MethodGet,
+			response:       "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+			expected:       "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+			expectComplete: true,
+		},
+		{
+			name:     "chunked body size is unknown",
+			method:   http.MethodGet,
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			expected: "HTTP/1.1 200 OK\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rewriter, _ := NewHeaderResponseRewriter("")
+			rw := newResponseHeadRewriter(rewriter, nil, "cluster1", httptest.NewRequest(c.method, "http://hub/cluster1/", nil), false)
+			if out := rw.Write([]byte(c.response)); string(out) != c.expected {
+				t.Fatalf("expected %q, got %q", c.expected, out)
+			}
+			if rw.Complete() != c.expectComplete {
+				t.Errorf("expected complete %v, got %v", c.expectComplete, rw.Complete())
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+)
+
+// RoundTrip proxies the request to the cluster over a new packet connection of its tunnel, or an idle one with
+// Config.ConnReuse, without going through the HTTP listener, e.g. for the controllers running in the hub's process.
+// The request is subject to the connection limits, the slow start, the method policy and the maintenance of the
+// cluster, and is counted in the metrics like the requests to the listener. It isn't passed to the HTTPMiddlewares,
+// and only reaches the tunnels held by this hub.
+//
+// The agent routes the request by its path like the requests to the listener, e.g. the default router of the agent
+// needs the path to start with /<clusterName>. The request is sent once its body was read, ctx bounds the whole
+// exchange including the read of the response body, which must be closed.
+func (s *Server) RoundTrip(ctx context.Context, clusterName string, req *http.Request) (*http.Response, error) {
+	return s.proxy.roundTrip(ctx, clusterName, req)
+}
+
+// TransportFor returns an http.RoundTripper proxying the requests to the cluster with RoundTrip, bounded by the
+// context of each request, e.g. for the WrapTransport of a client-go rest.Config
+func (s *Server) TransportFor(clusterName string) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return s.RoundTrip(req.Context(), clusterName, req)
+	})
+}
+
+// roundTripperFunc is a function implementing http.RoundTripper
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// roundTrip proxies the request like ServeHTTP, the response is read from the packet connection instead of being
+// copied to a hijacked client connection
+func (h *httpHandler) roundTrip(ctx context.Context, clusterName string, req *http.Request) (*http.Response, error) {
+	startTime := time.Now()
+	if req.URL == nil {
+		closeRequestBody(req)
+		return nil, errors.New("request has no URL")
+	}
+	if h.methodPolicy != nil {
+		if err := h.methodPolicy(clusterName, req.Method); err != nil {
+			closeRequestBody(req)
+			return nil, fmt.Errorf("method %s not allowed for cluster %s: %w", req.Method, clusterName, err)
+		}
+	}
+	if h.deniedByMaintenance(req, clusterName) {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("%w: %s", ErrClusterMaintenance, clusterName)
+	}
+
+	// The request is serialized as the agent reads it from the socket, Write reads and closes its body
+	out := req.Clone(ctx)
+	if out.Host == "" && out.URL.Host == "" {
+		out.Host = clusterName
+	}
+	var requestData bytes.Buffer
+	if err := out.Write(&requestData); err != nil {
+		return nil, fmt.Errorf("failed to serialize request: %w", err)
+	}
+
+	tun := h.tunnelManager.GetTunnel(clusterName)
+	if tun == nil {
+		return nil, fmt.Errorf("%w %s", ErrTunnelNotFound, clusterName)
+	}
+	if h.connPool != nil {
+		if rc := h.connPool.get(clusterName, tun); rc != nil {
+			resp, err := h.exchange(ctx, rc, req, requestData.Bytes(), startTime)
+			// The agent may have closed the idle connection as the request was sent, the idempotent requests are
+			// retried on a new connection like net/http does
+			if err == nil || ctx.Err() != nil || !idempotentMethod(req.Method) {
+				return resp, err
+			}
+			logger.V(4).InfoS("Retrying request on a new connection", "cluster", clusterName, "error", err)
+		}
+	}
+	rc, err := h.newRoundTripConn(ctx, tun, clusterName, req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	return h.exchange(ctx, rc, req, requestData.Bytes(), startTime)
+}
+
+// newRoundTripConn opens a packet connection of the tunnel for the requests of RoundTrip
+func (h *httpHandler) newRoundTripConn(ctx context.Context, tun *Tunnel, clusterName, path string) (*roundTripConn, error) {
+	// The connections kept idle outlive the request opening them, they're closed by the pool or with the tunnel
+	if h.connPool != nil {
+		ctx = context.WithoutCancel(ctx)
+	}
+	pc, err := tun.NewPacketConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create packet connection to cluster %s: %w", clusterName, err)
+	}
+	h.extendWriteDeadline(pc)
+	if h.capture != nil {
+		h.startCapture(pc, clusterName)
+	}
+	if h.payloadSample != nil {
+		pc.setSampler(capture.NewSampler(*h.payloadSample))
+	}
+	pc.classifier = tun.qos.NewConn(path)
+
+	rc := &roundTripConn{cluster: clusterName, tunnel: tun, pc: pc}
+	rc.conn = &packetNetConn{
+		pc:      pc,
+		opened:  make(chan struct{}),
+		onRead:  func() { h.extendWriteDeadline(pc) },
+		onClose: func() { closeClientDisconnected(pc) },
+	}
+	rc.reader = bufio.NewReader(rc.conn)
+	return rc, nil
+}
+
+// exchange sends the request on the connection and reads the head of its response. The connection is closed once
+// the body of the response is closed, or kept idle for the next request if it's reusable
+func (h *httpHandler) exchange(ctx context.Context, rc *roundTripConn, req *http.Request, requestData []byte, startTime time.Time) (*http.Response, error) {
+	pc := rc.pc
+	key := newCorrelationKey(pc)
+	h.correlationMap.Store(key, correlation{cluster: rc.cluster, startTime: startTime})
+
+	// The agent is told to close its connection to the target once the exchange is done or ctx is canceled
+	var closeOnce sync.Once
+	closeConn := func() {
+		closeOnce.Do(func() {
+			closeClientDisconnected(pc)
+			h.correlationMap.Delete(key)
+		})
+	}
+	stop := context.AfterFunc(ctx, closeConn)
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		closeConn()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	conn := roundTripConnNew
+	if rc.requests > 0 {
+		conn = roundTripConnReused
+	} else if !rc.tunnel.firstPacket {
+		// Agents that don't open the connections on their first data need an empty packet to establish them
+		if err := pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: []byte{}}); err != nil {
+			return fail(fmt.Errorf("failed to send initial packet to agent: %w", err))
+		}
+	}
+	rc.requests++
+	roundTripRequests.WithLabelValues(rc.cluster, conn).Inc()
+	if err := h.sendInitialHTTPRequest(pc, requestData); err != nil {
+		return fail(fmt.Errorf("failed to send request to agent: %w", err))
+	}
+
+	resp, err := http.ReadResponse(rc.reader, req)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read response from agent: %w", err))
+	}
+	h.observeLatency(pc)
+	logger.V(4).InfoS("Proxied request without the HTTP listener", "cluster", rc.cluster, "packet_connection_id", pc.ID(),
+		"status", resp.StatusCode, "conn", conn)
+
+	// The connection is reused once the response was read to its end, unless either side asked to close it
+	reusable := h.connPool != nil && !req.Close && !resp.Close && resp.StatusCode != http.StatusSwitchingProtocols
+	body := &roundTripBody{ReadCloser: resp.Body, ctx: ctx}
+	body.complete.Store(resp.Body == http.NoBody)
+	body.close = func() {
+		if stop() && reusable && body.complete.Load() {
+			h.correlationMap.Delete(key)
+			h.connPool.put(rc)
+			return
+		}
+		closeConn()
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// idempotentMethod returns whether the requests with the method can be retried, like net/http retries them
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// roundTripBody is the body of a response returned by RoundTrip, closing it closes the packet connection or
+// returns it to the pool
+type roundTripBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	close func()
+	// complete is set once the body was read to its end
+	complete atomic.Bool
+}
+
+func (b *roundTripBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	// The packet connection ends without an error once ctx is canceled, the read mustn't look complete
+	if err != nil && b.ctx.Err() != nil {
+		err = b.ctx.Err()
+	} else if err == io.EOF {
+		b.complete.Store(true)
+	}
+	return n, err
+}
+
+func (b *roundTripBody) Close() error {
+	b.close()
+	return nil
+}
+
+// closeRequestBody closes the body of a request that isn't sent, like the RoundTrippers must
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
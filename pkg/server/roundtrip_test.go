@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+// newRoundTripHandler returns a handler proxying to the test tunnel of test-cluster
+func newRoundTripHandler() (*httpHandler, *Tunnel) {
+	tun := newTestTunnel(0)
+	tm := NewTunnelManager()
+	tm.tunnels[tun.clusterName] = tun
+	return &httpHandler{tunnelManager: tm}, tun
+}
+
+// recvRequest returns the request sent to the agent after the empty packet opening its connection, and the error
+// packet closing an idle connection that wasn't reused
+func recvRequest(t *testing.T, tun *Tunnel) *v1.Packet {
+	t.Helper()
+	for range 3 {
+		select {
+		case packet := <-tun.outgoingChan:
+			if len(packet.Data) > 0 {
+				return packet
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the request to be sent to the agent")
+		}
+	}
+	t.Fatalf("expected the request after the empty packet")
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	h, tun := newRoundTripHandler()
+	req, _ := http.NewRequest(http.MethodPost, "http://test-cluster/test-cluster/api/v1/namespaces?dryRun=All", strings.NewReader(`{"kind":"Namespace"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := h.roundTrip(context.Background(), "test-cluster", req)
+		done <- result{resp, err}
+	}()
+
+	request := recvRequest(t, tun)
+	for _, want := range []string{
+		"POST /test-cluster/api/v1/namespaces?dryRun=All HTTP/1.1\r\n",
+		"Host: test-cluster\r\n",
+		"Content-Length: 20\r\n",
+		"Content-Type: application/json\r\n",
+		"\r\n\r\n{\"kind\":\"Namespace\"}",
+	} {
+		if !strings.Contains(string(request.Data), want) {
+			t.Errorf("expected the request to contain %q, got %q", want, request.Data)
+		}
+	}
+	if request.Timestamp == 0 {
+		t.Errorf("expected the request to be timestamped")
+	}
+	tun.handleDataPacket(&v1.Packet{ConnId: request.ConnId, Code: v1.ControlCode_DATA, Data: []byte("HTTP/1.1 201 Created\r\nContent-Length: 7\r\n\r\ncre")})
+	tun.handleDataPacket(&v1.Packet{ConnId: request.ConnId, Code: v1.ControlCode_DATA, Data: []byte("ated")})
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+	body, err := io.ReadAll(r.resp.Body)
+	if err != nil || r.resp.StatusCode != http.StatusCreated || string(body) != "created" {
+		t.Fatalf("expected 201 created, got %d %q: %v", r.resp.StatusCode, body, err)
+	}
+	r.resp.Body.Close()
+
+	// Closing the body tells the agent to close its connection to the target
+	packet := <-tun.outgoingChan
+	if packet.Code != v1.ControlCode_ERROR || packet.ConnId != request.ConnId {
+		t.Errorf("expected an error packet closing the connection, got %v", packet)
+	}
+	if len(tun.packetConns) != 0 {
+		t.Errorf("expected the packet connection to be closed")
+	}
+}
+
+func TestRoundTripContextCanceled(t *testing.T) {
+	h, tun := newRoundTripHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://test-cluster/test-cluster/api", nil)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.roundTrip(ctx, "test-cluster", req)
+		done <- err
+	}()
+	request := recvRequest(t, tun)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("roundTrip didn't return once canceled")
+	}
+	packet := <-tun.outgoingChan
+	if packet.Code != v1.ControlCode_ERROR || packet.ConnId != request.ConnId {
+		t.Errorf("expected an error packet closing the connection, got %v", packet)
+	}
+}
+
+func TestRoundTripRejected(t *testing.T) {
+	cases := []struct {
+		name      string
+		cluster   string
+		configure func(h *httpHandler, tun *Tunnel)
+		expected  error
+	}{
+		{
+			name:     "no tunnel",
+			cluster:  "other-cluster",
+			expected: ErrTunnelNotFound,
+		},
+		{
+			name:    "method policy",
+			cluster: "test-cluster",
+			configure: func(h *httpHandler, _ *Tunnel) {
+				h.methodPolicy = func(cluster, method string) error { return errors.New("read-only") }
+			},
+		},
+		{
+			name:    "maintenance",
+			cluster: "test-cluster",
+			configure: func(h *httpHandler, _ *Tunnel) {
+				h.tunnelManager.SetMaintenance("test-cluster", true, nil)
+			},
+			expected: ErrClusterMaintenance,
+		},
+		{
+			name:    "too many connections",
+			cluster: "test-cluster",
+			configure: func(_ *httpHandler, tun *Tunnel) {
+				tun.maxPacketConns = 1
+				if _, err := tun.NewPacketConn(context.Background()); err != nil {
+					t.Fatalf("failed to create packet connection: %v", err)
+				}
+			},
+			expected: ErrTooManyPacketConns,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, tun := newRoundTripHandler()
+			if c.configure != nil {
+				c.configure(h, tun)
+			}
+			req, _ := http.NewRequest(http.MethodDelete, "http://test-cluster/test-cluster/api", nil)
+			_, err := h.roundTrip(context.Background(), c.cluster, req)
+			if err == nil || (c.expected != nil && !errors.Is(err, c.expected)) {
+				t.Fatalf("expected error %v, got %v", c.expected, err)
+			}
+			if len(tun.outgoingChan) != 0 {
+				t.Errorf("expected no packet to be sent to the agent")
+			}
+		})
+	}
+}
+
+// roundTripResponse runs a GET request with roundTrip, answers it with the response and returns the request packet
+// once the body of the response was read and closed
+func roundTripResponse(t *testing.T, h *httpHandler, tun *Tunnel, response string) *v1.Packet {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://test-cluster/test-cluster/api", nil)
+	done := make(chan error, 1)
+	go func() {
+		resp, err := h.roundTrip(context.Background(), "test-cluster", req)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	request := recvRequest(t, tun)
+	tun.handleDataPacket(&v1.Packet{ConnId: request.ConnId, Code: v1.ControlCode_DATA, Data: []byte(response)})
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return request
+}
+
+func TestRoundTripConnReuse(t *testing.T) {
+	h, tun := newRoundTripHandler()
+	h.connPool = newConnPool(ConnReuseConfig{MaxRequestsPerConn: 3}, func(rc *roundTripConn) { closeClientDisconnected(rc.pc) })
+	defer h.connPool.close()
+
+	// The connection is kept idle once the response was read, and the next requests are sent on it
+	first := roundTripResponse(t, h, tun, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	second := roundTripResponse(t, h, tun, "HTTP/1.1 204 No Content\r\n\r\n")
+	if second.ConnId != first.ConnId {
+		t.Fatalf("expected the idle connection %d to be reused, got %d", first.ConnId, second.ConnId)
+	}
+	if len(tun.outgoingChan) != 0 || len(tun.packetConns) != 1 {
+		t.Fatalf("expected the connection to be kept open")
+	}
+
+	// It's closed once it served MaxRequestsPerConn requests
+	third := roundTripResponse(t, h, tun, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	if third.ConnId != first.ConnId {
+		t.Fatalf("expected the idle connection %d to be reused, got %d", first.ConnId, third.ConnId)
+	}
+	packet := <-tun.outgoingChan
+	if packet.Code != v1.ControlCode_ERROR || packet.ConnId != first.ConnId {
+		t.Errorf("expected an error packet closing the connection, got %v", packet)
+	}
+
+	// The responses closing the connection and the connections the agent closed while idle aren't reused
+	closing := roundTripResponse(t, h, tun, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	<-tun.outgoingChan
+	idle := roundTripResponse(t, h, tun, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	if idle.ConnId == closing.ConnId {
+		t.Fatalf("expected a new connection after Connection: close")
+	}
+	tun.handleErrorPacket(&v1.Packet{ConnId: idle.ConnId, Code: v1.ControlCode_ERROR, ErrorMessage: "proxy closed the connection"})
+	if next := roundTripResponse(t, h, tun, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"); next.ConnId == idle.ConnId {
+		t.Fatalf("expected a new connection once the agent closed the idle one")
+	}
+}
+
+func TestRoundTripConnIdleTimeout(t *testing.T) {
+	h, tun := newRoundTripHandler()
+	h.connPool = newConnPool(ConnReuseConfig{IdleTimeout: 50 * time.Millisecond}, func(rc *roundTripConn) { closeClientDisconnected(rc.pc) })
+	defer h.connPool.close()
+
+	request := roundTripResponse(t, h, tun, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	select {
+	case packet := <-tun.outgoingChan:
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != request.ConnId {
+			t.Errorf("expected an error packet closing the connection, got %v", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the idle connection to be closed after the idle timeout")
+	}
+	if conns := h.connPool.idle["test-cluster"]; len(conns) != 0 {
+		t.Errorf("expected no idle connection, got %d", len(conns))
+	}
+}
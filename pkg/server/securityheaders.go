@@ -0,0 +1,31 @@
+package server
+
+import "net/http"
+
+// DefaultSecurityHeaders returns the security headers browsers expect from a hub exposed to end-users,
+// including HSTS with a 1-year max-age. HSTS is ignored by browsers unless the HTTP server uses TLS
+func DefaultSecurityHeaders() map[string]string {
+	return map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+	}
+}
+
+// securityHeadersMiddleware adds the headers to every response. The headers of the responses from the agent
+// take precedence, e.g. a web UI allowing to be framed by its own X-Frame-Options
+func securityHeadersMiddleware(headers map[string]string) func(http.Handler) http.Handler {
+	header := make(http.Header, len(headers))
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
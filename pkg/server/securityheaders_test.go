@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	config := DefaultConfig()
+	config.SecurityHeaders = DefaultSecurityHeaders()
+	s, err := New(config, NewClusterNameParserImplt())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	for _, path := range []string{"/health", "/unknown-cluster/api"} {
+		w := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		for key, value := range DefaultSecurityHeaders() {
+			if got := w.Header().Get(key); got != value {
+				t.Errorf("%s: expected %s %q, got %q", path, key, value, got)
+			}
+		}
+	}
+}
+
+func TestSecurityHeadersMergedIntoAgentResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	securityHeadersMiddleware(DefaultSecurityHeaders())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The headers set before the connection is hijacked are merged into the response from the agent
+		rw := newResponseHeadRewriter(nil, w.Header().Clone(), "test-cluster", r, false)
+		out := rw.Write([]byte("HTTP/1.1 200 OK\r\nX-Frame-Options: SAMEORIGIN\r\nContent-Length: 0\r\n\r\n"))
+		w.Write(out)
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/test-cluster/ui", nil))
+
+	resp := w.Body.String()
+	if !strings.Contains(resp, "Strict-Transport-Security: max-age=31536000; includeSubDomains\r\n") {
+		t.Errorf("expected HSTS in the response, got %q", resp)
+	}
+	if !strings.Contains(resp, "X-Content-Type-Options: nosniff\r\n") {
+		t.Errorf("expected X-Content-Type-Options in the response, got %q", resp)
+	}
+	// The agent's header takes precedence
+	if !strings.Contains(resp, "X-Frame-Options: SAMEORIGIN\r\n") || strings.Contains(resp, "X-Frame-Options: DENY") {
+		t.Errorf("expected the X-Frame-Options of the agent, got %q", resp)
+	}
+}
@@ -3,18 +3,35 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/logging"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
@@ -40,16 +57,254 @@ type Config struct {
 	GRPCListenAddress string
 	// Address to listen on for HTTP connections from users
 	HTTPListenAddress string
+	// GRPCListener serves the gRPC server of the agents instead of a listener on GRPCListenAddress, e.g. an
+	// in-memory listener of a test, the server closes it when it shuts down
+	GRPCListener net.Listener
+	// HTTPListener serves the HTTP server of the users instead of a listener on HTTPListenAddress, the server
+	// closes it when it shuts down
+	HTTPListener net.Listener
+	// SinglePortMode serves the HTTP server of the users on the gRPC listener too, e.g. behind a load balancer
+	// exposing one port: the connections are told apart by their first bytes, the HTTP/1.x requests and the TLS
+	// connections offering http/1.1 or no ALPN protocol are served by the HTTP server. HTTPListenAddress and
+	// HTTPListener are not used, GRPCTLSConfig and HTTPTLSConfig must be both set or both unset. The plaintext
+	// HTTP/2 clients with prior knowledge are served by the gRPC server, EnableHTTP2 only serves HTTP/2 over TLS.
+	// Without it, the HTTP/1.x requests to the gRPC listener are answered 400 Bad Request with the HTTP address
+	SinglePortMode bool
+	// ListenNetwork is the network of the gRPC, HTTP and admin listeners, "tcp4" or "tcp6" to only listen on the
+	// IPv4 or the IPv6 addresses, e.g. ":8443" listens on [::]:8443 with "tcp6". Defaults to "tcp", which listens
+	// on both when the host of an address is empty
+	ListenNetwork string
+	// AdminListenAddress serves the admin API, /debug/tunnels, /metrics and /health on a separate HTTP server
+	// instead of the HTTP server of the users, which then only serves the tunnels and /health. The admin server
+	// doesn't use TLS, listen on an address only reachable by operators, e.g. "127.0.0.1:9443". Disabled if empty
+	AdminListenAddress string
+	// EnablePprof serves the net/http/pprof profiles under /debug/pprof/ on the admin server, it requires
+	// AdminListenAddress
+	EnablePprof bool
 	// ServerOptions for gRPC server configuration
 	ServerOptions []grpc.ServerOption
 	// KeepAlive settings for server
 	KeepAliveParams *keepalive.ServerParameters
+	// UnaryInterceptors are chained into the gRPC server in order, e.g. for services registered via GRPCServer (optional)
+	UnaryInterceptors []grpc.UnaryServerInterceptor
+	// StreamInterceptors are chained into the gRPC server in order, they see the Tunnel stream of every agent (optional)
+	StreamInterceptors []grpc.StreamServerInterceptor
 	// TLS configuration for gRPC server (optional)
 	GRPCTLSConfig *tls.Config
+	// GRPCServerName chooses the certificate of GRPCTLSConfig for the agents requesting no server name with SNI, or
+	// one none of its certificates is valid for, e.g. when they connect to the IP of the hub. The agents requesting
+	// another server name get its certificate, e.g. a hub serving the clusters of several domains. Defaults to the
+	// first certificate (optional)
+	GRPCServerName string
 	// TLS configuration for HTTP server (optional)
 	HTTPTLSConfig *tls.Config
+	// RequireTLS refuses to start the hub unless GRPCTLSConfig and HTTPTLSConfig are both set, with a certificate and
+	// a minimum version of at least MinTLSVersion, so that a missing certificate doesn't serve in plaintext by
+	// accident. The admin server isn't covered, it's always plaintext
+	RequireTLS bool
+	// MinTLSVersion is the lowest TLS version the listeners may accept with RequireTLS, e.g. tls.VersionTLS13,
+	// defaults to tls.VersionTLS12. A TLS config without MinVersion accepts TLS 1.2, the default of crypto/tls
+	MinTLSVersion uint16
+	// MaxGRPCRecvMsgSize is the maximum message size in bytes the gRPC server can receive from agents,
+	// defaults to DefaultMaxGRPCMsgSize
+	MaxGRPCRecvMsgSize int
+	// MaxGRPCSendMsgSize is the maximum message size in bytes the gRPC server can send to agents,
+	// defaults to DefaultMaxGRPCMsgSize
+	MaxGRPCSendMsgSize int
+	// PingInterval is the interval of the PINGs measuring the round-trip time to the agents,
+	// defaults to DefaultPingInterval, a negative value disables them
+	PingInterval time.Duration
+	// TunnelHandshakeTimeout closes the tunnel of an agent that sends no packet for this long after it connected,
+	// so a misconfigured agent doesn't hold the tunnel of its cluster. Agents send a PING right after they connect.
+	// Defaults to DefaultTunnelHandshakeTimeout, a negative value disables it
+	TunnelHandshakeTimeout time.Duration
+	// EnableConnectionMigration moves the open packet connections to the new tunnel when an agent reconnects
+	// while its previous tunnel is still open, e.g. after a network partition, instead of failing the in-flight requests
+	EnableConnectionMigration bool
+	// ResumeWindow resumes the open connections of an agent on its next tunnel if it reconnects within this long,
+	// e.g. after the TCP connection to the hub was reset: the packets lost with the previous tunnel are retransmitted
+	// instead of failing the in-flight requests. Only the agents enabling it too resume their connections, see
+	// v1.ProtocolVersionResume. 0 disables it
+	ResumeWindow time.Duration
+	// TunnelLastSeenRetention is how long the hub remembers when the agent of a cluster disconnected, for the
+	// lastSeen of the ClusterUnavailable responses. Defaults to DefaultTunnelLastSeenRetention, a negative value
+	// disables it
+	TunnelLastSeenRetention time.Duration
+	// ResumeMaxBufferedBytes is the budget of the data sent on each connection kept until the agent acknowledges it,
+	// the client is not read from while it's exceeded. Defaults to resume.DefaultMaxBytes
+	ResumeMaxBufferedBytes int
+	// EnableIntegrityCheck checks the integrity of the data tunneled to the agents enabling it too, see
+	// v1.IntegrityMetadataKey: each DATA packet carries the CRC32C of its data, a connection whose data doesn't match
+	// is closed with an INTEGRITY_FAILURE error, the client is sent 502 Bad Gateway if no response was written to it
+	// yet. The failures are counted in multiclustertunnel_hub_integrity_failures_total by the direction the data was
+	// corrupted in, to tell the hub, the network and the agent apart
+	EnableIntegrityCheck bool
+	// SlowStartWindow caps the rate of new connections to a cluster at SlowStartQPS for this long after its agent
+	// (re)connected, so the backlog of queued requests doesn't overwhelm a cold agent. Connections beyond the rate
+	// are queued for up to a second, then rejected with 503 and Retry-After. 0 disables slow start
+	SlowStartWindow time.Duration
+	// SlowStartQPS is the rate of new connections per second during the slow start window, required with SlowStartWindow
+	SlowStartQPS float64
+	// SlowStartBurst is the burst of new connections during the slow start window, defaults to SlowStartQPS rounded up
+	SlowStartBurst int
+	// MaxPacketConnsPerTunnel caps the open connections to each cluster, connections beyond it are rejected
+	// with 429. 0 means unlimited
+	MaxPacketConnsPerTunnel int
+	// MaxPacketConnBufferedBytes caps the data from the agent buffered for each connection until the client reads
+	// it, so slow clients can't pin unbounded memory. A connection whose client doesn't keep up is closed with
+	// a "receiver too slow" error. Defaults to packetqueue.DefaultMaxBytes
+	MaxPacketConnBufferedBytes int
+	// ClientWriteTimeout gives a client that doesn't keep up this long since it last read to catch up, instead of
+	// closing its connection as soon as MaxPacketConnBufferedBytes is exceeded. The data over the budget is held
+	// meanwhile, then the connection is closed with codes.DeadlineExceeded and the client is sent 504 Gateway Timeout
+	// if no response was written to it yet. 0 disables it
+	ClientWriteTimeout time.Duration
+	// ClientIdleTimeout closes the connections of the clients without traffic in either direction for this long,
+	// e.g. clients gone without closing their TCP connection after a NAT timeout or a laptop sleep.
+	// 0 disables it
+	ClientIdleTimeout time.Duration
+	// ClientKeepAlivePeriod is the period of the TCP keepalive probes of the client connections, so that dead
+	// clients are detected by the kernel. Defaults to DefaultClientKeepAlivePeriod, a negative value disables them
+	ClientKeepAlivePeriod time.Duration
+	// HTTPReadHeaderTimeout bounds reading the headers of a request, so that clients sending them slowly, e.g. a
+	// slow-loris attack, can't hold connections open. Defaults to DefaultHTTPReadHeaderTimeout, a negative value
+	// disables it
+	HTTPReadHeaderTimeout time.Duration
+	// HTTPReadTimeout bounds reading a whole request, its body included. It doesn't apply to the HTTP/1.1 requests
+	// once their connection is tunneled to the agent, but it breaks the HTTP/2 requests whose body streams for
+	// longer, e.g. gRPC client streams, and the requests forwarded to another replica. 0 disables it
+	HTTPReadTimeout time.Duration
+	// HTTPWriteTimeout bounds the time from the end of the headers of a request to the end of its response. It
+	// doesn't apply to the HTTP/1.1 requests once their connection is tunneled to the agent, but it breaks the
+	// streaming responses to the HTTP/2 requests, e.g. gRPC server streams, and to the requests forwarded to another
+	// replica, e.g. watches. 0 disables it
+	HTTPWriteTimeout time.Duration
+	// EnableHTTP2 serves HTTP/2 on the HTTP server, with TLS and in cleartext (h2c), so that gRPC clients can call
+	// gRPC services in the clusters through the tunnel. HTTP/2 requests are proxied over an HTTP/2 connection to the
+	// agent, which forwards gRPC requests to the target with HTTP/2 and the other requests with HTTP/1.1.
+	// ClientIdleTimeout and ClientWriteTimeout don't apply to HTTP/2 requests. HTTP/1.1 clients, e.g. kubectl exec
+	// with SPDY, are served as before
+	EnableHTTP2 bool
+	// QoS prioritizes the interactive connections to each cluster, e.g. API requests and exec sessions, over its
+	// bulk transfers: the packets to the agent of the connections that sent more than QoS.BulkThreshold are queued
+	// separately and sent in a weighted round robin. Agents prioritize the packets to the hub the same way with
+	// agent.Config.QoS. nil disables it
+	QoS *qos.Config
+	// Coalesce sends the small writes of the clients, e.g. the keystrokes of an exec session, to the agents in fewer
+	// packets: the data read within Coalesce.Delay of the last packet of a connection is buffered for up to
+	// Coalesce.Delay, or until Coalesce.MaxBytes are buffered, the data read after the connection was quiet is sent
+	// at once. Agents coalesce the packets to the hub with agent.Config.Coalesce. nil disables it
+	Coalesce *coalesce.Config
+	// TunnelLocator shares the replica holding the tunnel of each cluster with the other hub replicas, e.g.
+	// NewConfigMapTunnelLocator: a request for a cluster whose agent is connected to another replica is forwarded
+	// to that replica's HTTP server, once. Disabled if not set
+	TunnelLocator TunnelLocator
+	// ReplicaURL is the URL the other replicas forward the requests to this replica at, e.g.
+	// "https://hub-0.hub.hub-ns.svc:8080". Defaults to the address of the HTTP listener, it must be set if
+	// HTTPListenAddress listens on all the addresses
+	ReplicaURL string
+	// ReplicaTransport sends the requests forwarded to the other replicas, e.g. with the CA of their certificates.
+	// Defaults to http.DefaultTransport
+	ReplicaTransport http.RoundTripper
+	// AdminAuthenticator enables the admin API on the HTTP server, or on the admin server if AdminListenAddress is
+	// set, and authenticates its requests, e.g.
+	// NewTokenAuthenticator. POST /admin/tunnels/<cluster>/disconnect[?reason=<reason>] calls DisconnectCluster,
+	// PUT /admin/maintenance/<cluster>[?allow=<identity>...] and DELETE /admin/maintenance/<cluster> call
+	// SetClusterMaintenance, GET /admin/maintenance lists the clusters under maintenance.
+	// The admin API is disabled if not set
+	AdminAuthenticator HTTPAuthenticator
+	// EnableDebugEndpoints serves /debug/tunnels on the HTTP server, listing the tunnels with their round-trip time.
+	// It exposes the names of the connected clusters, only enable it when the HTTP server isn't public. The admin
+	// server always serves it
+	EnableDebugEndpoints bool
+	// HTTPMiddlewares wrap the HTTP handler in order, the first one is the outermost, e.g. the ones in
+	// pkg/server/middleware. They also run for health checks. Headers they set on the ResponseWriter are
+	// merged into the response from the agent, which closes the client connection after the response (optional)
+	HTTPMiddlewares []func(http.Handler) http.Handler
+	// SecurityHeaders are added to every response of the HTTP server, e.g. DefaultSecurityHeaders when the hub
+	// is exposed to end-users. Headers of the responses from the agent take precedence (optional)
+	SecurityHeaders map[string]string
+	// CORS answers the CORS preflight requests at the hub and adds the CORS headers to the responses to the allowed
+	// origins, for browser-based consoles calling the hub directly. Disabled if not set
+	CORS *CORSConfig
+	// MethodPolicy is called with the cluster and the method of each request before it's tunneled, the request is
+	// rejected with 405 Method Not Allowed if it returns an error, e.g. to deny writes to read-only clusters.
+	// The hub only sees the first request of an HTTP/1.1 client connection, so with a MethodPolicy the connection
+	// is closed after the response to its first request, the next request of the client is checked on a new one.
+	// All methods are allowed if not set
+	MethodPolicy func(cluster, method string) error
+	// HubAdapter returns the HubAdapter selecting the cluster of each request in place of the ClusterNameParser,
+	// given the TunnelManager of the hub, e.g. NewRoundRobinAdapter to balance the requests across the clusters.
+	// Like with a MethodPolicy, the client connection is closed after the response to its first request so that
+	// each request is balanced. Disabled if not set
+	HubAdapter func(tunnelManager *TunnelManager) HubAdapter
+	// RequestIdentifier identifies the users of the requests to the clusters under maintenance, whose requests are
+	// only forwarded for the identities allowed by SetClusterMaintenance, e.g. NewHeaderIdentifier or
+	// NewClientCertIdentifier. No request is identified if not set
+	RequestIdentifier RequestIdentifier
+	// ResponseRewriter rewrites the response head from the agent before it's written to the client (optional)
+	// e.g. NewHeaderResponseRewriter to rewrite Location and Set-Cookie headers of proxied web UIs
+	ResponseRewriter ResponseRewriter
+	// Mirror replays a share of the requests to a cluster to another cluster in the background and discards the
+	// responses, e.g. to validate a migration. Only the first request of a client connection is mirrored, the
+	// responses of the source cluster are unaffected. Disabled if not set
+	Mirror *MirrorConfig
+	// ConnReuse keeps the connections of the requests proxied by RoundTrip idle once their response was read, and
+	// reuses them for the next requests to the same cluster. nil closes the connection of each request
+	ConnReuse *ConnReuseConfig
+	// CaptureDir enables the capture of the packets of every connection to a JSONL file in the directory, for
+	// debugging e.g. corrupted responses. Authorization and Cookie headers are redacted, see pkg/capture and
+	// cmd/tunnelcap. The capture is disabled if not set
+	CaptureDir string
+	// CaptureMaxFileSize caps the size of the capture file of a connection, defaults to capture.DefaultMaxFileSize
+	CaptureMaxFileSize int64
+	// CaptureMaxDataSize is the size of the data prefix captured for each packet, 0 only captures the packet metadata.
+	// The HTTP streams can be reassembled when it's at least the size of the packets, 32KB
+	CaptureMaxDataSize int
+	// LogPayloadSample logs the first bytes of the first packets of each connection in each direction, as hex and
+	// printable text, for debugging e.g. corrupted bodies without a capture. Authorization and Cookie headers are
+	// redacted, and the bytes logged per connection are capped. Disabled if not set
+	LogPayloadSample *capture.SampleConfig
+	// Logger is used for structured logging in the hot path, e.g. JSON logs via slog.NewJSONHandler (optional)
+	// klog is used if not set. The logger is process-wide, it's also used by the package outside of the Server:
+	// New fails if another Server of the process was created with a different one
+	Logger *slog.Logger
 }
 
+// requestTimeout is the read deadline of the packet connections of the requests, from the time they're received
+const requestTimeout = 30 * time.Second
+
+// clientDisconnectedMessage is the error message sent to the agent when the client connection is closed
+const clientDisconnectedMessage = "client disconnected"
+
+// DefaultPingInterval is the default interval of the PINGs measuring the round-trip time to the agents
+const DefaultPingInterval = 10 * time.Second
+
+// DefaultTunnelHandshakeTimeout is the default time for a new agent to send its first packet
+const DefaultTunnelHandshakeTimeout = 30 * time.Second
+
+// DefaultMaxGRPCMsgSize is the default maximum size of a gRPC message between the hub and agents
+const DefaultMaxGRPCMsgSize = 64 * 1024 * 1024 // 64MB
+
+// DefaultClientKeepAlivePeriod is the default period of the TCP keepalive probes of the client connections
+const DefaultClientKeepAlivePeriod = 30 * time.Second
+
+// DefaultHTTPReadHeaderTimeout is the default time to read the headers of a request
+const DefaultHTTPReadHeaderTimeout = 10 * time.Second
+
+// clientReadInterval bounds each read from a client connection, so that the end of the forwarding and idle
+// clients are noticed while the client sends nothing
+const clientReadInterval = time.Second
+
+// errServerShutDown is returned by Run once the server is shut down
+var errServerShutDown = errors.New("server is shut down")
+
+// errClientIdle is returned by forwardClientToAgent when the connection exceeded the client idle timeout
+var errClientIdle = errors.New("client idle timeout")
+
+// errAgentError is returned by forwardAgentToClient when the agent sent an ERROR for the connection
+var errAgentError = errors.New("agent error")
+
 // Server implements the hub-side tunnel server with both gRPC and HTTP servers
 type Server struct {
 	config        *Config
@@ -58,11 +313,24 @@ type Server struct {
 	tunnelManager *TunnelManager
 	grpcListener  net.Listener
 	httpListener  net.Listener
+	// grpcTLSConfig is the TLS config of the gRPC server, nil if it's plaintext
+	grpcTLSConfig *tls.Config
+	// adminServer serves the admin and debug endpoints on AdminListenAddress, nil if it's not set
+	adminServer   *http.Server
+	adminListener net.Listener
+	// handler serves the requests of httpServer, see ReplaceHTTPHandler
+	handler *swappableHandler
+	// proxy proxies the requests to the clusters, the ones served by handler and the ones of RoundTrip
+	proxy *httpHandler
 
 	// Server state
 	mu      sync.RWMutex
 	running bool
 	ready   bool
+	// closed is set once the server is shut down, it can't run again
+	closed bool
+	// shutdownOnce stops the server once, the concurrent shutdowns wait for it
+	shutdownOnce sync.Once
 
 	// Embed the unimplemented server to satisfy the interface
 	v1.UnimplementedTunnelServiceServer
@@ -70,11 +338,28 @@ type Server struct {
 	ClusterNameParser
 }
 
+// logger is the structured logger of the package, set from Config.Logger
+var logger logging.Logger
+
 // New creates a new Hub server instance
 func New(config *Config, parser ClusterNameParser) (*Server, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
+	var errs []error
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if parser == nil && config.HubAdapter == nil {
+		errs = append(errs, errors.New("a ClusterNameParser must be set, e.g. NewClusterNameParserImplt"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
+
+	if err := logger.Set(config.Logger); err != nil {
+		return nil, fmt.Errorf("invalid server config: Logger: %w", err)
+	}
 
 	// Set default keepalive parameters if not provided
 	if config.KeepAliveParams == nil {
@@ -84,16 +369,40 @@ func New(config *Config, parser ClusterNameParser) (*Server, error) {
 		}
 	}
 
-	// Add keepalive to server options
-	serverOpts := append(config.ServerOptions, grpc.KeepaliveParams(*config.KeepAliveParams))
+	// Bound the message size so a single packet can't overwhelm the server
+	if config.MaxGRPCRecvMsgSize <= 0 {
+		config.MaxGRPCRecvMsgSize = DefaultMaxGRPCMsgSize
+	}
+	if config.MaxGRPCSendMsgSize <= 0 {
+		config.MaxGRPCSendMsgSize = DefaultMaxGRPCMsgSize
+	}
+
+	// Add keepalive and message size limits to server options
+	serverOpts := append(config.ServerOptions,
+		grpc.KeepaliveParams(*config.KeepAliveParams),
+		grpc.MaxRecvMsgSize(config.MaxGRPCRecvMsgSize),
+		grpc.MaxSendMsgSize(config.MaxGRPCSendMsgSize),
+	)
+
+	// Chain the interceptors, so they compose with any interceptor passed in ServerOptions
+	if len(config.UnaryInterceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(config.UnaryInterceptors...))
+	}
+	if len(config.StreamInterceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.ChainStreamInterceptor(config.StreamInterceptors...))
+	}
 
 	// Add TLS credentials if TLS config is provided
+	var serverTLSConfig *tls.Config
 	if config.GRPCTLSConfig != nil {
-		creds := credentials.NewTLS(config.GRPCTLSConfig)
+		tlsConfig, err := grpcTLSConfig(config.GRPCTLSConfig, config.GRPCServerName)
+		if err != nil {
+			return nil, err
+		}
+		serverTLSConfig = tlsConfig
+		creds := credentials.NewTLS(tlsConfig)
 		serverOpts = append(serverOpts, grpc.Creds(creds))
 		klog.InfoS("TLS enabled for gRPC server")
-	} else {
-		klog.InfoS("TLS not configured for gRPC server - using insecure connection")
 	}
 
 	// Create gRPC server
@@ -101,10 +410,49 @@ func New(config *Config, parser ClusterNameParser) (*Server, error) {
 
 	// Create tunnel manager
 	tunnelManager := NewTunnelManager()
+	tunnelManager.connectionMigration = config.EnableConnectionMigration
+	tunnelManager.maxPacketConns = config.MaxPacketConnsPerTunnel
+	tunnelManager.maxBufferedBytes = config.MaxPacketConnBufferedBytes
+	tunnelManager.qos = config.QoS
+	tunnelManager.locator = config.TunnelLocator
+	tunnelManager.integrity = config.EnableIntegrityCheck
+	if config.TunnelLastSeenRetention != 0 {
+		tunnelManager.lastSeenRetention = config.TunnelLastSeenRetention
+	}
+	if config.ResumeWindow > 0 {
+		tunnelManager.resumeWindow = config.ResumeWindow
+		tunnelManager.resumeMaxBytes = config.ResumeMaxBufferedBytes
+	}
+	if config.SlowStartWindow > 0 {
+		tunnelManager.slowStartWindow = config.SlowStartWindow
+		tunnelManager.slowStartRate = rate.Limit(config.SlowStartQPS)
+		tunnelManager.slowStartBurst = config.SlowStartBurst
+		if tunnelManager.slowStartBurst <= 0 {
+			tunnelManager.slowStartBurst = int(math.Ceil(config.SlowStartQPS))
+		}
+	}
+	switch {
+	case config.PingInterval == 0:
+		tunnelManager.pingInterval = DefaultPingInterval
+	case config.PingInterval > 0:
+		tunnelManager.pingInterval = config.PingInterval
+	}
+	switch {
+	case config.TunnelHandshakeTimeout == 0:
+		tunnelManager.handshakeTimeout = DefaultTunnelHandshakeTimeout
+	case config.TunnelHandshakeTimeout > 0:
+		tunnelManager.handshakeTimeout = config.TunnelHandshakeTimeout
+	}
+
+	if config.HubAdapter != nil {
+		parser = &hubAdapterParser{adapter: config.HubAdapter(tunnelManager)}
+		klog.InfoS("Hub adapter enabled, the requests are tunneled to the clusters it selects")
+	}
 
 	server := &Server{
 		config:        config,
 		grpcServer:    grpcServer,
+		grpcTLSConfig: serverTLSConfig,
 		tunnelManager: tunnelManager,
 	}
 
@@ -112,32 +460,120 @@ func New(config *Config, parser ClusterNameParser) (*Server, error) {
 	handler := &httpHandler{
 		tunnelManager: tunnelManager,
 		parser:        parser,
+		rewriter:      config.ResponseRewriter,
+		methodPolicy:  config.MethodPolicy,
+		balancing:     config.HubAdapter != nil,
+		identifier:    config.RequestIdentifier,
+		idleTimeout:   config.ClientIdleTimeout,
+		writeTimeout:  config.ClientWriteTimeout,
+		coalesce:      config.Coalesce,
+	}
+	if config.TunnelLocator != nil {
+		handler.replicaTransport = config.ReplicaTransport
+		if handler.replicaTransport == nil {
+			handler.replicaTransport = http.DefaultTransport
+		}
+	}
+	switch {
+	case config.ClientKeepAlivePeriod == 0:
+		handler.keepAlivePeriod = DefaultClientKeepAlivePeriod
+	case config.ClientKeepAlivePeriod > 0:
+		handler.keepAlivePeriod = config.ClientKeepAlivePeriod
+	}
+	if config.Mirror != nil {
+		mirror, err := newRequestMirror(*config.Mirror, tunnelManager, closeClientDisconnected)
+		if err != nil {
+			return nil, err
+		}
+		handler.mirror = mirror
+		klog.InfoS("Request mirroring enabled", "source_cluster", config.Mirror.SourceCluster, "target_cluster", config.Mirror.TargetCluster, "percent", config.Mirror.Percent)
 	}
+	if config.ConnReuse != nil {
+		handler.connPool = newConnPool(*config.ConnReuse, func(rc *roundTripConn) { closeClientDisconnected(rc.pc) })
+		klog.InfoS("Connection reuse enabled for RoundTrip", "max_idle_conns_per_cluster", handler.connPool.config.MaxIdleConnsPerCluster,
+			"idle_timeout", handler.connPool.config.IdleTimeout, "max_requests_per_conn", handler.connPool.config.MaxRequestsPerConn)
+	}
+	if config.CaptureDir != "" {
+		if err := os.MkdirAll(config.CaptureDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create capture directory: %w", err)
+		}
+		handler.capture = &capture.Config{
+			Dir:         config.CaptureDir,
+			MaxFileSize: config.CaptureMaxFileSize,
+			MaxDataSize: config.CaptureMaxDataSize,
+		}
+		klog.InfoS("Packet capture enabled", "dir", config.CaptureDir)
+	}
+	if config.LogPayloadSample != nil {
+		handler.payloadSample = config.LogPayloadSample
+		klog.InfoS("Payload sample logging enabled")
+	}
+	server.proxy = handler
 	// Wrap the handler to handle health checks
 	wrappedHandler := &healthCheckHandler{
-		handler: handler,
+		handler:       handler,
+		tunnelManager: tunnelManager,
+		debug:         config.EnableDebugEndpoints,
+		admin:         config.AdminAuthenticator,
+	}
+	if config.AdminListenAddress != "" {
+		// The admin and debug endpoints are only served by the admin server
+		wrappedHandler.debug, wrappedHandler.admin, wrappedHandler.adminServed = false, nil, true
+		server.adminServer = &http.Server{
+			Addr:    config.AdminListenAddress,
+			Handler: newAdminHandler(tunnelManager, config.AdminAuthenticator, config.EnablePprof),
+		}
+	}
+	var rootHandler http.Handler = wrappedHandler
+	for i := len(config.HTTPMiddlewares) - 1; i >= 0; i-- {
+		rootHandler = config.HTTPMiddlewares[i](rootHandler)
+	}
+	if config.CORS != nil {
+		// Preflights carry no credentials, answer them before the middlewares, e.g. authentication, reject them
+		rootHandler = corsMiddleware(*config.CORS)(rootHandler)
+	}
+	if len(config.SecurityHeaders) > 0 {
+		rootHandler = securityHeadersMiddleware(config.SecurityHeaders)(rootHandler)
+	}
+	server.handler = newSwappableHandler(rootHandler)
+	if config.HTTPReadHeaderTimeout == 0 {
+		config.HTTPReadHeaderTimeout = DefaultHTTPReadHeaderTimeout
 	}
 	httpServer := &http.Server{
 		Addr:    config.HTTPListenAddress,
-		Handler: wrappedHandler,
+		Handler: server.handler,
+		// A negative ReadHeaderTimeout disables it, it doesn't fall back to ReadTimeout like 0 does
+		ReadHeaderTimeout: config.HTTPReadHeaderTimeout,
+		ReadTimeout:       config.HTTPReadTimeout,
+		WriteTimeout:      config.HTTPWriteTimeout,
 		// Disable automatic HTTP/2 upgrade to support SPDY protocol used by kubectl exec
 		// HTTP/2 cannot upgrade to SPDY, so we need to prevent automatic HTTP/2 negotiation
 		// This allows clients like kubectl to use SPDY for exec/port-forward operations
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
+	if config.EnableHTTP2 {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		httpServer.Protocols = protocols
+		// The server only serves HTTP/2 when TLSNextProto is nil
+		httpServer.TLSNextProto = nil
+	}
+
 	// Add TLS configuration to HTTP server if provided
 	if config.HTTPTLSConfig != nil {
 		httpServer.TLSConfig = config.HTTPTLSConfig.Clone()
 		klog.InfoS("TLS enabled for HTTP server")
-	} else {
-		klog.InfoS("TLS not configured for HTTP server - using insecure connection")
 	}
 
 	server.httpServer = httpServer
 
 	// Register the tunnel service
 	v1.RegisterTunnelServiceServer(grpcServer, server)
+	// Report the packet connections of the tunnels until the server shuts down
+	tunnels.register(tunnelManager)
 
 	return server, nil
 }
@@ -160,6 +596,10 @@ func DefaultConfig() *Config {
 // Run starts the hub server and blocks until the context is canceled
 func (s *Server) Run(ctx context.Context) error {
 	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errServerShutDown
+	}
 	if s.running {
 		s.mu.Unlock()
 		return fmt.Errorf("server is already running")
@@ -167,47 +607,99 @@ func (s *Server) Run(ctx context.Context) error {
 	s.running = true
 	s.mu.Unlock()
 
-	klog.InfoS("Starting hub server", "grpc_address", s.config.GRPCListenAddress, "http_address", s.config.HTTPListenAddress)
+	network := s.config.listenNetwork()
+	klog.InfoS("Starting hub server", "network", network, "grpc_address", s.config.GRPCListenAddress, "http_address", s.config.HTTPListenAddress)
 
-	// Create gRPC listener
-	grpcListener, err := net.Listen("tcp", s.config.GRPCListenAddress)
-	if err != nil {
+	// failStart closes the listeners created so far and marks the server as not running
+	failStart := func(err error, listeners ...net.Listener) error {
+		closeListeners(listeners...)
 		s.mu.Lock()
 		s.running = false
 		s.mu.Unlock()
-		return fmt.Errorf("failed to listen on gRPC address %s: %w", s.config.GRPCListenAddress, err)
+		return err
 	}
-	s.grpcListener = grpcListener
 
-	// Create HTTP listener if HTTP server is configured
-	if s.httpServer != nil {
-		httpListener, err := net.Listen("tcp", s.config.HTTPListenAddress)
+	// Create gRPC listener
+	grpcListener := s.config.GRPCListener
+	if grpcListener == nil {
+		var err error
+		grpcListener, err = net.Listen(network, s.config.GRPCListenAddress)
 		if err != nil {
-			grpcListener.Close()
-			s.mu.Lock()
-			s.running = false
-			s.mu.Unlock()
-			return fmt.Errorf("failed to listen on HTTP address %s: %w", s.config.HTTPListenAddress, err)
+			return failStart(fmt.Errorf("failed to listen on gRPC address %s: %w", s.config.GRPCListenAddress, err))
+		}
+	}
+
+	// Create HTTP listener if HTTP server is configured, it shares the gRPC listener in single-port mode
+	var httpListener net.Listener
+	if s.httpServer != nil && !s.config.SinglePortMode {
+		httpListener = s.config.HTTPListener
+		if httpListener == nil {
+			var err error
+			httpListener, err = net.Listen(network, s.config.HTTPListenAddress)
+			if err != nil {
+				return failStart(fmt.Errorf("failed to listen on HTTP address %s: %w", s.config.HTTPListenAddress, err), grpcListener)
+			}
 		}
-		s.httpListener = httpListener
 	}
 
-	// Mark server as ready
+	// Create admin listener if the admin server is configured
+	var adminListener net.Listener
+	if s.adminServer != nil {
+		var err error
+		adminListener, err = net.Listen(network, s.config.AdminListenAddress)
+		if err != nil {
+			return failStart(fmt.Errorf("failed to listen on admin address %s: %w", s.config.AdminListenAddress, err), grpcListener, httpListener)
+		}
+	}
+
+	// Listen addresses with distinct host names may still resolve to the same port
+	if err := checkListeners(map[string]net.Listener{"gRPC": grpcListener, "HTTP": httpListener, "admin": adminListener}); err != nil {
+		return failStart(err, grpcListener, httpListener, adminListener)
+	}
+
+	// The connections to the gRPC listener are sniffed to answer the misrouted HTTP clients, or to serve them in
+	// single-port mode
+	var httpAddress string
+	if httpListener != nil {
+		httpAddress = httpListener.Addr().String()
+	}
+	mux := newProtocolMux(grpcListener, s.grpcTLSConfig, httpAddress, s.config.SinglePortMode && s.httpServer != nil)
+	grpcListener = mux.grpcListener()
+	if s.config.SinglePortMode && s.httpServer != nil {
+		httpListener = mux.httpListener()
+	}
+	s.logEffectiveConfig()
+	if s.config.TunnelLocator != nil {
+		s.tunnelManager.setEndpoint(s.replicaURL(httpListener))
+	}
+	s.tunnelManager.startReaper()
+
+	// Publish the listeners and mark server as ready, unless it was shut down while they were created
 	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return failStart(errServerShutDown, grpcListener, httpListener, adminListener)
+	}
+	s.grpcListener = grpcListener
+	s.httpListener = httpListener
+	s.adminListener = adminListener
 	s.ready = true
 	s.mu.Unlock()
 
-	klog.InfoS("Hub server is ready", "grpc_address", grpcListener.Addr().String())
-	if s.httpListener != nil {
+	klog.InfoS("Hub server is ready", "grpc_address", grpcListener.Addr().String(), "single_port", s.config.SinglePortMode)
+	if httpListener != nil {
 		if s.config.HTTPTLSConfig != nil {
-			klog.InfoS("HTTPS server is ready", "https_address", s.httpListener.Addr().String())
+			klog.InfoS("HTTPS server is ready", "https_address", httpListener.Addr().String())
 		} else {
-			klog.InfoS("HTTP server is ready", "http_address", s.httpListener.Addr().String())
+			klog.InfoS("HTTP server is ready", "http_address", httpListener.Addr().String())
 		}
 	}
+	if adminListener != nil {
+		klog.InfoS("Admin server is ready", "admin_address", adminListener.Addr().String(), "pprof", s.config.EnablePprof)
+	}
 
-	// Start both servers in goroutines
-	errCh := make(chan error, 2)
+	// Start the servers in goroutines
+	errCh := make(chan error, 3)
 
 	// Start gRPC server
 	go func() {
@@ -216,18 +708,26 @@ func (s *Server) Run(ctx context.Context) error {
 	}()
 
 	// Start HTTP server if configured
-	if s.httpServer != nil && s.httpListener != nil {
+	if httpListener != nil {
 		go func() {
 			if s.config.HTTPTLSConfig != nil {
-				klog.InfoS("Starting HTTPS server", "address", s.httpListener.Addr().String())
-				errCh <- s.httpServer.ServeTLS(s.httpListener, "", "")
+				klog.InfoS("Starting HTTPS server", "address", httpListener.Addr().String())
+				errCh <- s.httpServer.ServeTLS(httpListener, "", "")
 			} else {
-				klog.InfoS("Starting HTTP server", "address", s.httpListener.Addr().String())
-				errCh <- s.httpServer.Serve(s.httpListener)
+				klog.InfoS("Starting HTTP server", "address", httpListener.Addr().String())
+				errCh <- s.httpServer.Serve(httpListener)
 			}
 		}()
 	}
 
+	// Start admin server if configured
+	if adminListener != nil {
+		go func() {
+			klog.InfoS("Starting admin server", "address", adminListener.Addr().String())
+			errCh <- s.adminServer.Serve(adminListener)
+		}()
+	}
+
 	// Wait for context cancellation or server error
 	select {
 	case <-ctx.Done():
@@ -257,11 +757,19 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return s.shutdown()
 }
 
-// shutdown performs the actual shutdown logic
+// shutdown performs the actual shutdown logic, it's run once and the concurrent calls wait for it to complete
 func (s *Server) shutdown() error {
+	s.shutdownOnce.Do(s.stop)
+	return nil
+}
+
+// stop stops the servers and closes the listeners and the tunnels
+func (s *Server) stop() {
 	s.mu.Lock()
 	s.running = false
 	s.ready = false
+	s.closed = true
+	grpcListener, httpListener, adminListener := s.grpcListener, s.httpListener, s.adminListener
 	s.mu.Unlock()
 
 	klog.InfoS("Shutting down hub server")
@@ -274,6 +782,13 @@ func (s *Server) shutdown() error {
 			klog.ErrorS(err, "Failed to shutdown HTTP server gracefully")
 		}
 	}
+	if s.adminServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := s.adminServer.Shutdown(shutdownCtx); err != nil {
+			klog.ErrorS(err, "Failed to shutdown admin server gracefully")
+		}
+	}
 
 	// Stop gRPC server gracefully with timeout
 	done := make(chan struct{})
@@ -293,20 +808,77 @@ func (s *Server) shutdown() error {
 	}
 
 	// Close listeners
-	if s.grpcListener != nil {
-		s.grpcListener.Close()
-	}
-	if s.httpListener != nil {
-		s.httpListener.Close()
-	}
+	closeListeners(grpcListener, httpListener, adminListener)
 
-	// Close tunnel manager
+	// Close the idle connections of RoundTrip, then the tunnel manager
+	if s.proxy != nil && s.proxy.connPool != nil {
+		s.proxy.connPool.close()
+	}
 	if s.tunnelManager != nil {
 		s.tunnelManager.Close()
+		tunnels.unregister(s.tunnelManager)
 	}
 
 	klog.InfoS("Hub server shutdown complete")
-	return nil
+}
+
+// closeListeners closes the listeners that are not nil
+func closeListeners(listeners ...net.Listener) {
+	for _, listener := range listeners {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+// serveDiagnostic answers the first PING of an agent diagnosing its connectivity with a PONG, see agent.Diagnose.
+// The stream is not registered as the tunnel of the cluster, so the running agent of the cluster keeps its tunnel
+func (s *Server) serveDiagnostic(stream v1.TunnelService_TunnelServer, clusterName string) error {
+	klog.InfoS("New diagnostic stream", "cluster", clusterName)
+	if err := stream.SendHeader(metadata.Pairs(v1.DiagnosticMetadataKey, "true")); err != nil {
+		return err
+	}
+
+	type result struct {
+		packet *v1.Packet
+		err    error
+	}
+	// The receive ends with the stream once this returns
+	received := make(chan result, 1)
+	go func() {
+		packet, err := stream.Recv()
+		received <- result{packet, err}
+	}()
+
+	timeout := s.tunnelManager.handshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultTunnelHandshakeTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-received:
+		if r.err != nil {
+			return r.err
+		}
+		if r.packet.Code != v1.ControlCode_PING {
+			return status.Errorf(codes.InvalidArgument, "expected a PING on the diagnostic stream, got %v", r.packet.Code)
+		}
+		return stream.Send(&v1.Packet{ConnId: controlPacketConnID, Code: v1.ControlCode_PONG, Data: r.packet.Data})
+	case <-timer.C:
+		return status.Errorf(codes.DeadlineExceeded, "no PING on the diagnostic stream within %v", timeout)
+	}
+}
+
+// Version returns the build information of the hub
+func (s *Server) Version() version.Info {
+	return version.Get()
+}
+
+// GRPCServer returns the underlying gRPC server, additional services can be registered on it before Run
+func (s *Server) GRPCServer() *grpc.Server {
+	return s.grpcServer
 }
 
 // Ready returns true if the server is ready to accept connections
@@ -336,6 +908,24 @@ func (s *Server) HTTPAddress() string {
 	return s.config.HTTPListenAddress
 }
 
+// AdminAddress returns the actual admin server address, empty if the admin server is disabled
+func (s *Server) AdminAddress() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.adminListener != nil {
+		return s.adminListener.Addr().String()
+	}
+	return s.config.AdminListenAddress
+}
+
+// ReplaceHTTPHandler replaces the handler of the HTTP server, e.g. to swap the routing of a test harness without
+// restarting the server. The requests in flight complete with the previous handler, the next ones are served by
+// handler. It replaces the handler built by New with its health checks, middlewares and security headers, a nil
+// handler restores it
+func (s *Server) ReplaceHTTPHandler(handler http.Handler) {
+	s.handler.replace(handler)
+}
+
 // GetTunnel returns the tunnel for a specific cluster
 func (s *Server) GetTunnel(clusterName string) *Tunnel {
 	if s.tunnelManager == nil {
@@ -344,6 +934,21 @@ func (s *Server) GetTunnel(clusterName string) *Tunnel {
 	return s.tunnelManager.GetTunnel(clusterName)
 }
 
+// DisconnectCluster closes the tunnel of a cluster, e.g. to kick a stuck agent so it reconnects fresh.
+// The agent is sent a DRAIN with the reason first, in-flight requests fail with 502 Bad Gateway.
+// It returns ErrTunnelNotFound if the cluster has no tunnel.
+func (s *Server) DisconnectCluster(clusterName string, reason string) error {
+	return s.tunnelManager.DisconnectTunnel(clusterName, reason)
+}
+
+// DrainCluster waits for the in-flight requests of a cluster to complete, then disconnects its tunnel like
+// DisconnectCluster, e.g. before upgrading the hub. Put the cluster under maintenance first to stop its new requests.
+// It returns ErrTunnelNotFound if the cluster has no tunnel, and the error of ctx if it's done before the tunnel is
+// idle, the tunnel is kept then.
+func (s *Server) DrainCluster(ctx context.Context, clusterName string) error {
+	return s.tunnelManager.DrainTunnel(ctx, clusterName, drainReason)
+}
+
 // Tunnel implements the TunnelService gRPC interface
 // This is called when an agent establishes a tunnel
 func (s *Server) Tunnel(stream v1.TunnelService_TunnelServer) error {
@@ -359,7 +964,11 @@ func (s *Server) Tunnel(stream v1.TunnelService_TunnelServer) error {
 	}
 	clusterName := clusterNames[0]
 
-	klog.InfoS("New tunnel", "cluster", clusterName)
+	if len(md.Get(v1.DiagnosticMetadataKey)) > 0 {
+		return s.serveDiagnostic(stream, clusterName)
+	}
+
+	klog.InfoS("New tunnel", "cluster", clusterName, "agent_version", agentVersion(stream.Context()))
 
 	// Create a new tunnel
 	conn, err := s.tunnelManager.NewTunnel(stream.Context(), clusterName, stream)
@@ -368,6 +977,19 @@ func (s *Server) Tunnel(stream v1.TunnelService_TunnelServer) error {
 		return fmt.Errorf("failed to create tunnel: %w", err)
 	}
 
+	// Tell the agent the negotiated protocol version, it waits for it before resuming its connections
+	header := metadata.Pairs(v1.ProtocolVersionMetadataKey, strconv.Itoa(conn.ProtocolVersion()))
+	if conn.firstPacket {
+		header.Set(v1.FirstPacketMetadataKey, "true")
+	}
+	if conn.integrity {
+		header.Set(v1.IntegrityMetadataKey, "true")
+	}
+	if err := stream.SendHeader(header); err != nil {
+		// The stream is broken, Serve ends with its error
+		klog.ErrorS(err, "Failed to send tunnel header", "cluster", clusterName)
+	}
+
 	// Handle the tunnel (this blocks until the tunnel is closed)
 	err = conn.Serve()
 
@@ -387,11 +1009,119 @@ func (s *Server) Tunnel(stream v1.TunnelService_TunnelServer) error {
 type httpHandler struct {
 	tunnelManager *TunnelManager
 	parser        ClusterNameParser
+	rewriter      ResponseRewriter
+	// methodPolicy rejects the requests whose method isn't allowed for the cluster, nil allows all methods
+	methodPolicy func(cluster, method string) error
+	// balancing is set when a HubAdapter selects the clusters, the client connections are closed after their first
+	// response so that each request is balanced
+	balancing bool
+	// identifier identifies the users of the requests to the clusters under maintenance, nil identifies none
+	identifier RequestIdentifier
+	// capture configures the capture of the packet connections, nil disables it
+	capture *capture.Config
+	// payloadSample configures the payload samples logged for the packet connections, nil disables it
+	payloadSample *capture.SampleConfig
+	// idleTimeout closes the client connections without traffic for this long, 0 disables it
+	idleTimeout time.Duration
+	// writeTimeout is how long since it last read a client has to read the data over the buffer budget,
+	// 0 disables it
+	writeTimeout time.Duration
+	// keepAlivePeriod is the TCP keepalive period of the client connections, 0 disables keepalive
+	keepAlivePeriod time.Duration
+	// coalesce coalesces the small writes of the clients into fewer packets, nil disables it
+	coalesce *coalesce.Config
+	// mirror mirrors a share of the requests to a cluster to another cluster, nil disables it
+	mirror *requestMirror
+	// connPool keeps the idle connections of RoundTrip, nil closes the connection of each request
+	connPool *connPool
+	// replicaTransport forwards the requests to the replicas holding the tunnels of their clusters, it's only set
+	// with a TunnelLocator
+	replicaTransport http.RoundTripper
+	// correlationMap holds the correlation of each packet connection being forwarded, by correlationKey, from
+	// ServeHTTP until the forwarding of its traffic ends
+	correlationMap sync.Map
+}
+
+// correlationKey identifies a packet connection across the tunnels, its ID is only unique within its tunnel
+type correlationKey struct {
+	tunnelID string
+	connID   int64
+}
+
+func newCorrelationKey(pc *packetConnection) correlationKey {
+	return correlationKey{tunnelID: pc.tunnel.ID(), connID: pc.ID()}
+}
+
+// correlation is when the request that opened a packet connection entered ServeHTTP
+type correlation struct {
+	cluster   string
+	startTime time.Time
+}
+
+// observeLatency records the latency of the packet connection since its request entered ServeHTTP, once
+func (h *httpHandler) observeLatency(pc *packetConnection) {
+	value, ok := h.correlationMap.LoadAndDelete(newCorrelationKey(pc))
+	if !ok {
+		return
+	}
+	c := value.(correlation)
+	latency := time.Since(c.startTime)
+	connectionLatency.WithLabelValues(c.cluster).Observe(latency.Seconds())
+	logger.V(5).InfoS("Recorded connection latency", "cluster", c.cluster, "packet_connection_id", pc.ID(), "latency", latency)
+}
+
+// swappableHandler serves each request with the handler stored last, so that it can be replaced while serving
+type swappableHandler struct {
+	// initial is the handler built by New
+	initial http.Handler
+	// current holds a handlerBox, atomic.Value requires all its values to be of the same type
+	current atomic.Value
+}
+
+// handlerBox boxes the handler stored in swappableHandler.current
+type handlerBox struct {
+	http.Handler
+}
+
+func newSwappableHandler(handler http.Handler) *swappableHandler {
+	h := &swappableHandler{initial: handler}
+	h.current.Store(handlerBox{handler})
+	return h
+}
+
+// replace serves the next requests with the handler, or with the initial one if it's nil
+func (h *swappableHandler) replace(handler http.Handler) {
+	if handler == nil {
+		handler = h.initial
+	}
+	h.current.Store(handlerBox{handler})
+}
+
+func (h *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.current.Load().(handlerBox).ServeHTTP(w, r)
 }
 
 // healthCheckHandler wraps the httpHandler to provide health check endpoint
 type healthCheckHandler struct {
-	handler *httpHandler
+	handler       *httpHandler
+	tunnelManager *TunnelManager
+	debug         bool
+	// admin authenticates the admin API requests, the admin API is disabled if nil
+	admin HTTPAuthenticator
+	// adminServed is set when the admin server serves the admin and debug endpoints, they're not found here
+	adminServed bool
+}
+
+// tunnelInfo describes a tunnel in the /debug/tunnels response
+type tunnelInfo struct {
+	ClusterName string    `json:"cluster_name"`
+	TunnelID    string    `json:"tunnel_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	RTTSeconds  float64   `json:"rtt_seconds"`
+	// AgentVersion is the release of the agent, empty for agents not sending it
+	AgentVersion string `json:"agent_version,omitempty"`
+	// PacketConns are the open connections of the tunnel
+	PacketConns []PacketConnStats `json:"packet_conns"`
 }
 
 // ServeHTTP handles HTTP requests, including health checks
@@ -402,130 +1132,414 @@ func (h *healthCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("OK"))
 		return
 	}
+	// Handle the build information endpoint
+	if r.URL.Path == "/version" {
+		version.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	// Don't route the paths of the admin server to the clusters
+	if h.adminServed && isAdminPath(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Handle the admin API
+	if h.admin != nil && isAdminAPIPath(r.URL.Path) {
+		h.serveAdmin(w, r)
+		return
+	}
+
+	// Handle the tunnels debug endpoint
+	if h.debug && r.URL.Path == "/debug/tunnels" {
+		h.serveTunnels(w)
+		return
+	}
 
 	// Delegate all other requests to the main handler
 	h.handler.ServeHTTP(w, r)
 }
 
+// serveTunnels writes the tunnels as JSON
+func (h *healthCheckHandler) serveTunnels(w http.ResponseWriter) {
+	tunnels := h.tunnelManager.sortedTunnels()
+	infos := make([]tunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		infos = append(infos, tunnelInfo{
+			ClusterName:  t.ClusterName(),
+			TunnelID:     t.ID(),
+			CreatedAt:    t.CreatedAt(),
+			RTTSeconds:   t.RTT().Seconds(),
+			AgentVersion: t.AgentVersion(),
+			PacketConns:  t.PacketConnStats(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		logger.ErrorS(err, "Failed to write tunnels")
+	}
+}
+
 // ServeHTTP handles HTTP requests and routes them to appropriate clusters using HTTP CONNECT tunneling
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	klog.V(4).InfoS("Received HTTP request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	startTime := time.Now()
+	logger.V(4).InfoS("Received HTTP request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 
 	// Parse cluster name using the configured parser
 	clusterName, err := h.parser.ParseClusterName(r)
+	if errors.Is(err, ErrRateLimited) {
+		// Rate limited requests are expected under load, don't flood the log
+		logger.V(4).InfoS("Request rate limited", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		writeClusterUnavailable(w, http.StatusTooManyRequests, h.clusterUnavailable("", ReasonRateLimited, "Too many requests"))
+		return
+	}
+	if errors.Is(err, ErrNoCluster) {
+		logger.V(4).InfoS("No cluster available for request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		writeClusterUnavailable(w, http.StatusServiceUnavailable, h.clusterUnavailable("", ReasonNoTunnel, "No cluster available"))
+		return
+	}
 	if err != nil {
-		klog.ErrorS(err, "Failed to parse cluster name and target address from request", "path", r.URL.Path)
+		logger.ErrorS(err, "Failed to parse cluster name and target address from request", "path", r.URL.Path)
 		http.Error(w, fmt.Sprintf("Failed to parse cluster name and target address from request, path:%s", r.URL.Path), http.StatusBadRequest)
 		return
 	}
+	if err := validateRequestTarget(r); err != nil {
+		logger.V(4).InfoS("Invalid request target", "cluster", clusterName, "remote_addr", r.RemoteAddr, "reason", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.checkMaintenance(w, r, clusterName) {
+		return
+	}
+
+	if h.methodPolicy != nil {
+		if err := h.methodPolicy(clusterName, r.Method); err != nil {
+			logger.V(4).InfoS("Request method denied", "cluster", clusterName, "method", r.Method, "path", r.URL.Path, "reason", err)
+			http.Error(w, fmt.Sprintf("Method %s not allowed for cluster %s: %v", r.Method, clusterName, err), http.StatusMethodNotAllowed)
+			return
+		}
+	}
 
-	klog.V(4).InfoS("Routing request to cluster", "cluster", clusterName, "path", r.URL.Path)
+	logger.V(4).InfoS("Routing request to cluster", "cluster", clusterName, "path", r.URL.Path)
 
-	// Create a new packet connection to the target cluster
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	// The request is bounded by the read deadline of its packet connection, so that the client gets 504 Gateway
+	// Timeout from an agent that never responds rather than a closed connection
+	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
 	// Get tunnel for the cluster
 	tun := h.tunnelManager.GetTunnel(clusterName)
+	if tun == nil && h.forwardToReplica(w, r, clusterName) {
+		return
+	}
 	if tun == nil {
-		klog.ErrorS(nil, "No tunnel found for cluster", "cluster", clusterName)
-		http.Error(w, fmt.Sprintf("Cluster %s not available", clusterName), http.StatusServiceUnavailable)
+		logger.ErrorS(nil, "No tunnel found for cluster", "cluster", clusterName)
+		writeClusterUnavailable(w, http.StatusServiceUnavailable,
+			h.clusterUnavailable(clusterName, ReasonNoTunnel, fmt.Sprintf("Cluster %s not available", clusterName)))
 		return
 	}
 
 	// Create new packet connection
 	pc, err := tun.NewPacketConn(ctx)
+	switch {
+	case errors.Is(err, ErrSlowStart):
+		// Rejections are expected while the backlog drains, don't flood the log
+		logger.V(4).InfoS("Request rejected during tunnel slow start", "cluster", clusterName, "path", r.URL.Path)
+		writeClusterUnavailable(w, http.StatusServiceUnavailable,
+			h.clusterUnavailable(clusterName, ReasonConnecting, fmt.Sprintf("Cluster %s is warming up, retry later", clusterName)))
+		return
+	case errors.Is(err, errTunnelNotInitialized):
+		logger.V(4).InfoS("Request rejected by connecting agent", "cluster", clusterName, "path", r.URL.Path)
+		writeClusterUnavailable(w, http.StatusServiceUnavailable,
+			h.clusterUnavailable(clusterName, ReasonConnecting, fmt.Sprintf("Cluster %s is connecting, retry later", clusterName)))
+		return
+	case errors.Is(err, ErrTunnelDraining):
+		logger.V(4).InfoS("Request rejected by draining agent", "cluster", clusterName, "path", r.URL.Path)
+		writeClusterUnavailable(w, http.StatusServiceUnavailable,
+			h.clusterUnavailable(clusterName, ReasonDraining, fmt.Sprintf("Cluster %s is draining, retry later", clusterName)))
+		return
+	case errors.Is(err, ErrTooManyPacketConns):
+		logger.V(4).InfoS("Request rejected by connection limit", "cluster", clusterName, "path", r.URL.Path)
+		writeClusterUnavailable(w, http.StatusTooManyRequests,
+			h.clusterUnavailable(clusterName, ReasonTooManyConnections, fmt.Sprintf("Too many connections to cluster %s", clusterName)))
+		return
+	}
 	if err != nil {
-		klog.ErrorS(err, "Failed to create packet connection to cluster", "cluster", clusterName)
-		http.Error(w, fmt.Sprintf("Cluster %s not available: %v", clusterName, err), http.StatusServiceUnavailable)
+		logger.ErrorS(err, "Failed to create packet connection to cluster", "cluster", clusterName)
+		writeClusterUnavailable(w, http.StatusServiceUnavailable,
+			h.clusterUnavailable(clusterName, ReasonNoTunnel, fmt.Sprintf("Cluster %s not available: %v", clusterName, err)))
+		return
+	}
+	// The packet connection is recycled once the request is done, except for HTTP/2 whose connection to the agent may
+	// still read from it
+	recycle := true
+	defer func() {
+		pc.Close(nil)
+		if recycle {
+			pc.release()
+		}
+	}()
+	pc.SetReadDeadline(startTime.Add(requestTimeout))
+	h.correlationMap.Store(newCorrelationKey(pc), correlation{cluster: clusterName, startTime: startTime})
+	// The latency is only recorded once the traffic was forwarded, not for the requests failing before
+	defer h.correlationMap.Delete(newCorrelationKey(pc))
+	h.extendWriteDeadline(pc)
+	if h.capture != nil {
+		h.startCapture(pc, clusterName)
+	}
+	if h.payloadSample != nil {
+		pc.setSampler(capture.NewSampler(*h.payloadSample))
+	}
+	// The exec, attach and portforward requests stay interactive however much data they send
+	pc.classifier = tun.qos.NewConn(r.URL.Path)
+
+	if r.ProtoMajor == 2 {
+		// HTTP/2 connections can't be hijacked, the request is proxied on an HTTP/2 connection to the agent
+		recycle = false
+		h.serveHTTP2(w, r, pc, clusterName)
+		h.observeLatency(pc)
 		return
 	}
-	defer pc.Close(nil)
+
+	// The method policy and the maintenance only see the first request of an HTTP/1.1 client connection, the agent
+	// and the hub close the connection after its response so that the next request of the client comes on a new
+	// one and is checked. The connections kept alive are closed once the cluster goes under maintenance, see
+	// Server.SetClusterMaintenance
+	closeAfterResponse := h.methodPolicy != nil || h.balancing
+	if !closeAfterResponse {
+		pc.setKeepAlive()
+		_, closeAfterResponse = h.tunnelManager.Maintenance(clusterName)
+	}
+	if closeAfterResponse && !httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") {
+		r.Header.Set("Connection", "close")
+	}
 
 	// Hijack the HTTP connection to create a transparent tunnel
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		klog.ErrorS(nil, "HTTP hijacking not supported")
+		logger.ErrorS(nil, "HTTP hijacking not supported")
 		http.Error(w, "HTTP tunneling not supported", http.StatusInternalServerError)
 		return
 	}
 
-	// Send initial packet to establish connection on agent side
-	// NOTE: TargetAddress is required here because this is the first packet that tells
-	// the agent which target service to connect to. This establishes the connection.
-	initialPacket := &v1.Packet{
-		ConnId: pc.ID(),
-		Code:   v1.ControlCode_DATA,
-		Data:   []byte{}, // Empty data to trigger connection creation
-	}
+	// Agents that don't open the connections on their first data need an empty packet to establish them
+	if !tun.firstPacket {
+		initialPacket := &v1.Packet{
+			ConnId: pc.ID(),
+			Code:   v1.ControlCode_DATA,
+			Data:   []byte{}, // Empty data to trigger connection creation
+		}
 
-	if err := pc.Send(initialPacket); err != nil {
-		klog.ErrorS(err, "Failed to send initial packet to agent", "cluster", clusterName)
-		http.Error(w, "Failed to establish tunnel", http.StatusBadGateway)
-		return
+		if err := pc.Send(initialPacket); err != nil {
+			logger.ErrorS(err, "Failed to send initial packet to agent", "cluster", clusterName)
+			http.Error(w, "Failed to establish tunnel", http.StatusBadGateway)
+			return
+		}
 	}
 
 	// Send the original HTTP request to establish the connection and start communication
-	if err := h.sendInitialHTTPRequest(pc, r); err != nil {
-		klog.ErrorS(err, "Failed to send initial HTTP request to agent")
+	requestData, err := serializeHTTPRequest(r)
+	if err == nil {
+		err = h.sendInitialHTTPRequest(pc, requestData)
+	}
+	if err != nil {
+		logger.ErrorS(err, "Failed to send initial HTTP request to agent")
 		http.Error(w, "Failed to establish tunnel", http.StatusBadGateway)
 		return
 	}
+	if h.mirror != nil {
+		// The mirrored request runs in the background, it never fails or delays the request
+		h.mirror.maybeMirror(clusterName, r, requestData)
+	}
 
 	// Note: We removed the immediate error check here because it was consuming
 	// the first packet from the packet connection, causing data loss. Instead, we'll let
 	// the forwardTraffic method handle any errors that occur during data transfer.
 
+	// Headers set by the middlewares are merged into the response from the agent
+	headRewriter := newResponseHeadRewriter(h.rewriter, w.Header().Clone(), clusterName, r, closeAfterResponse)
+
 	// Hijack the connection
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
-		klog.ErrorS(err, "Failed to hijack HTTP connection")
+		logger.ErrorS(err, "Failed to hijack HTTP connection")
 		return
 	}
 	defer clientConn.Close()
+	// The tunneled connections outlive the request, the deadlines of HTTPReadTimeout and HTTPWriteTimeout don't
+	// apply to them
+	clientConn.SetDeadline(time.Time{})
+	if h.keepAlivePeriod > 0 {
+		setClientKeepAlive(clientConn, h.keepAlivePeriod)
+	}
 
-	klog.V(4).InfoS("Established HTTP tunnel", "cluster", clusterName, "packet_connection_id", pc.ID())
+	logger.V(4).InfoS("Established HTTP tunnel", "cluster", clusterName, "packet_connection_id", pc.ID())
 
 	// Start transparent data forwarding between client and agent
-	h.forwardTraffic(ctx, clientConn, pc)
+	h.forwardTraffic(ctx, clientConn, pc, headRewriter)
 }
 
-// forwardTraffic handles bidirectional data forwarding between client and agent
-func (h *httpHandler) forwardTraffic(ctx context.Context, clientConn net.Conn, packetConnection *packetConnection) {
-	// Create error channel for goroutines
-	errChan := make(chan error, 2)
+// startCapture records the packets of the packet connection until it's closed
+func (h *httpHandler) startCapture(pc *packetConnection, clusterName string) {
+	w, err := capture.NewWriter(*h.capture, fmt.Sprintf("%s-%d", clusterName, pc.ID()))
+	if err != nil {
+		logger.ErrorS(err, "Failed to start packet capture", "cluster", clusterName, "packet_connection_id", pc.ID())
+		return
+	}
+	pc.setCapture(w)
+}
+
+// setClientKeepAlive enables the TCP keepalive probes of the hijacked client connection, so that the kernel
+// detects a client gone without closing its connection
+func setClientKeepAlive(clientConn net.Conn, period time.Duration) {
+	conn := clientConn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	// The connections of the HTTP server in single-port mode were sniffed by the protocol mux
+	if wrapped, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = wrapped.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		logger.V(4).InfoS("Failed to enable TCP keepalive on client connection", "error", err)
+		return
+	}
+	if err := tcpConn.SetKeepAlivePeriod(period); err != nil {
+		logger.V(4).InfoS("Failed to set TCP keepalive period on client connection", "error", err)
+	}
+}
+
+// clientActivity tracks the time of the last traffic of a client connection, in either direction
+type clientActivity struct {
+	last atomic.Int64
+}
+
+func newClientActivity() *clientActivity {
+	a := &clientActivity{}
+	a.touch()
+	return a
+}
+
+func (a *clientActivity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// idle returns the time since the last traffic
+func (a *clientActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// forwardTraffic handles bidirectional data forwarding between client and agent. Once either direction ends, both
+// the packet connection and the client connection are closed, the agent being sent an ERROR unless it ended the
+// connection itself, and forwardTraffic returns after the other direction ended too
+func (h *httpHandler) forwardTraffic(ctx context.Context, clientConn net.Conn, packetConnection *packetConnection, headRewriter *responseHeadRewriter) {
+	// The client may have gone away before the connection was hijacked
+	select {
+	case <-ctx.Done():
+		logger.V(4).InfoS("Client disconnected before forwarding", "packet_connection_id", packetConnection.ID(), "error", ctx.Err())
+		closeClientDisconnected(packetConnection)
+		clientConn.Close()
+		return
+	default:
+	}
+	defer h.observeLatency(packetConnection)
+
+	// Create error channels for goroutines, one per direction
+	clientErrChan := make(chan error, 1)
+	agentErrChan := make(chan error, 1)
+	activity := newClientActivity()
 
 	// Forward data from client to agent
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				klog.ErrorS(fmt.Errorf("panic in client->agent forwarding: %v", r), "Panic in forwardTraffic")
-			}
-		}()
-		errChan <- h.forwardClientToAgent(clientConn, packetConnection)
-	}()
+	go forwardDirection(clientErrChan, "client->agent", func() error {
+		return h.forwardClientToAgent(ctx, clientConn, packetConnection, activity)
+	})
 
 	// Forward data from agent to client
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				klog.ErrorS(fmt.Errorf("panic in agent->client forwarding: %v", r), "Panic in forwardTraffic")
-			}
-		}()
-		errChan <- h.forwardAgentToClient(packetConnection, clientConn)
-	}()
+	go forwardDirection(agentErrChan, "agent->client", func() error {
+		return h.forwardAgentToClient(packetConnection, clientConn, headRewriter, activity)
+	})
 
 	// Wait for either direction to complete or error
+	var clientErr, agentErr error
+	clientDone, agentDone := false, false
 	select {
-	case err := <-errChan:
-		if err != nil && err != io.EOF {
-			klog.V(4).InfoS("Traffic forwarding ended", "error", err)
+	case clientErr = <-clientErrChan:
+		clientDone = true
+		if errors.Is(clientErr, errClientIdle) {
+			logger.V(4).InfoS("Closing idle client connection", "packet_connection_id", packetConnection.ID(), "idle_timeout", h.idleTimeout)
 		}
+	case agentErr = <-agentErrChan:
+		agentDone = true
 	case <-ctx.Done():
-		klog.V(4).InfoS("Traffic forwarding cancelled", "error", ctx.Err())
+		clientErr = ctx.Err()
 	}
 
-	klog.V(4).InfoS("HTTP tunnel closed", "packet_connection_id", packetConnection.ID())
+	// The agent ended the connection if it closed it or sent an ERROR, it's notified of any other ending so that it
+	// doesn't leave its connection to the target service open until its next packet
+	if agentDone && (errors.Is(agentErr, io.EOF) || errors.Is(agentErr, errAgentError)) {
+		packetConnection.Close(nil)
+	} else {
+		closeClientDisconnected(packetConnection)
+	}
+	// Closing both connections unblocks the other direction, reading from the client or from the agent
+	clientConn.Close()
+	if !clientDone {
+		if err := <-clientErrChan; clientErr == nil {
+			clientErr = err
+		}
+	}
+	if !agentDone {
+		agentErr = <-agentErrChan
+	}
+
+	logger.V(4).InfoS("HTTP tunnel closed", "packet_connection_id", packetConnection.ID(),
+		"reason", terminationReason(clientErr, agentErr))
+}
+
+// forwardDirection runs the forwarding of one direction and sends its result to errChan, a panic is sent as an error
+// so that forwardTraffic doesn't wait forever for the direction to end
+func forwardDirection(errChan chan<- error, direction string, forward func() error) {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in %s forwarding: %v", direction, r)
+			logger.ErrorS(err, "Panic in forwardTraffic")
+		}
+		errChan <- err
+	}()
+	err = forward()
+}
+
+// terminationReason joins the errors the directions of a tunneled connection ended with, except the ends of stream
+// and the errors of reading a connection closed by forwardTraffic. It's nil if both ended cleanly
+func terminationReason(errs ...error) error {
+	var reasons []error
+	for _, err := range errs {
+		if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			continue
+		}
+		reasons = append(reasons, err)
+	}
+	return errors.Join(reasons...)
+}
+
+// closeClientDisconnected sends an ERROR to the agent, so it closes the connection to the target service promptly,
+// and closes the packet connection
+func closeClientDisconnected(pc *packetConnection) {
+	errorPacket := &v1.Packet{
+		ConnId:       pc.ID(),
+		Code:         v1.ControlCode_ERROR,
+		ErrorMessage: clientDisconnectedMessage,
+	}
+	if err := pc.Send(errorPacket); err != nil {
+		logger.V(4).InfoS("Failed to notify agent of client disconnect", "packet_connection_id", pc.ID(), "error", err)
+	}
+	pc.Close(nil)
 }
 
 // packetSender interface for sending packets (used for testing)
@@ -534,8 +1548,25 @@ type packetSender interface {
 	Send(packet *v1.Packet) error
 }
 
-// sendInitialHTTPRequest sends the original HTTP request to the agent to establish the connection
-func (h *httpHandler) sendInitialHTTPRequest(pc packetSender, r *http.Request) error {
+// validateRequestTarget returns an error if the request can't be forwarded with an origin-form target and the Host
+// it was routed by. net/http already rejects the requests with several Host headers, and gives the authority of an
+// absolute-form target, e.g. GET http://hub/cluster1/api HTTP/1.1, precedence over the Host header as r.Host
+func validateRequestTarget(r *http.Request) error {
+	if r.URL.Opaque != "" {
+		return fmt.Errorf("request target %q has no path", r.RequestURI)
+	}
+	// A middleware changed the Host of an absolute-form request, a ClusterNameParser routing by host would route it
+	// by one authority and the agent receive the other
+	if r.URL.Host != "" && !strings.EqualFold(r.URL.Host, r.Host) {
+		return fmt.Errorf("authority %s of the request target conflicts with Host %s", r.URL.Host, r.Host)
+	}
+	return nil
+}
+
+// serializeHTTPRequest serializes the original HTTP request with its body, as the agent reads it from the socket.
+// The request target is always in origin form, e.g. /cluster1/api/v1/pods?watch=true for an absolute-form request,
+// and the request has exactly one Host header, r.Host
+func serializeHTTPRequest(r *http.Request) ([]byte, error) {
 	// Build the complete HTTP request
 	var requestData []byte
 
@@ -547,18 +1578,27 @@ func (h *httpHandler) sendInitialHTTPRequest(pc packetSender, r *http.Request) e
 		httpVersion = fmt.Sprintf("HTTP/%d.%d", r.ProtoMajor, r.ProtoMinor)
 	}
 
-	requestLine := fmt.Sprintf("%s %s %s\r\n", r.Method, r.URL.RequestURI(), httpVersion)
+	// The path and query only, RequestURI keeps the opaque part of an opaque URL
+	target := r.URL.EscapedPath()
+	if target == "" {
+		target = "/"
+	}
+	if r.URL.ForceQuery || r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	requestLine := fmt.Sprintf("%s %s %s\r\n", r.Method, target, httpVersion)
 	requestData = append(requestData, []byte(requestLine)...)
 
 	// Add HTTP headers
-	// Ensure Host header is present (required for HTTP/1.1 and later)
-	if r.Header.Get("Host") == "" {
-		// Use the original request's host
-		hostHeader := fmt.Sprintf("Host: %s\r\n", r.Host)
-		requestData = append(requestData, []byte(hostHeader)...)
-	}
+	// The Host header is required for HTTP/1.1 and later, net/http moves it to r.Host. A Host set in the headers,
+	// e.g. by a middleware, would be a second one
+	hostHeader := fmt.Sprintf("Host: %s\r\n", r.Host)
+	requestData = append(requestData, []byte(hostHeader)...)
 
 	for name, values := range r.Header {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
 		for _, value := range values {
 			headerLine := fmt.Sprintf("%s: %s\r\n", name, value)
 			requestData = append(requestData, []byte(headerLine)...)
@@ -572,100 +1612,200 @@ func (h *httpHandler) sendInitialHTTPRequest(pc packetSender, r *http.Request) e
 	if r.Body != nil {
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
-			return fmt.Errorf("failed to read request body: %w", err)
+			return nil, fmt.Errorf("failed to read request body: %w", err)
 		}
 		r.Body.Close()
 		requestData = append(requestData, bodyBytes...)
 	}
+	return requestData, nil
+}
 
+// sendInitialHTTPRequest sends the serialized HTTP request to the agent to establish the connection
+func (h *httpHandler) sendInitialHTTPRequest(pc packetSender, requestData []byte) error {
 	// Send the HTTP request as a data packet
 	// NOTE: TargetAddress is required here because this is part of the connection
 	// establishment phase. The agent needs to know the target service address
 	// when processing the initial HTTP request.
+	// The timestamp lets the agent measure the latency of the request through the tunnel
 	packet := &v1.Packet{
-		ConnId: pc.ID(),
-		Code:   v1.ControlCode_DATA,
-		Data:   requestData,
+		ConnId:    pc.ID(),
+		Code:      v1.ControlCode_DATA,
+		Data:      requestData,
+		Timestamp: time.Now().UnixNano(),
 	}
 
 	return pc.Send(packet)
 }
 
-// forwardClientToAgent forwards data from client connection to packet connection
-func (h *httpHandler) forwardClientToAgent(clientConn net.Conn, pc *packetConnection) error {
+// forwardClientToAgent forwards data from client connection to packet connection until ctx is done or the
+// connection is idle for longer than the idle timeout, activity is touched by the traffic in either direction
+func (h *httpHandler) forwardClientToAgent(ctx context.Context, clientConn net.Conn, pc *packetConnection, activity *clientActivity) error {
 	buffer := make([]byte, 32*1024) // 32KB buffer
+	coalescer := coalesce.NewBuffer(h.coalesce)
+	// send sends the data to the agent, the data is owned by the packet
+	send := func(data []byte) error {
+		if data == nil {
+			return nil
+		}
+		// NOTE: TargetAddress is NOT set here because this is a data forwarding packet.
+		// The connection has already been established, and the agent knows where to
+		// forward this data. Setting TargetAddress would be redundant and inefficient.
+		packet := &v1.Packet{
+			ConnId: pc.ID(),
+			Code:   v1.ControlCode_DATA,
+			Data:   data,
+		}
+		if err := pc.Send(packet); err != nil {
+			logger.ErrorS(err, "Failed to send data to agent", "packet_connection_id", pc.ID())
+			return err
+		}
+		logger.V(5).InfoS("Forwarded data to agent", "packet_connection_id", pc.ID(), "bytes", len(data))
+		return nil
+	}
+
+	readInterval := clientReadInterval
+	if h.idleTimeout > 0 {
+		readInterval = min(readInterval, h.idleTimeout)
+	}
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if h.idleTimeout > 0 && activity.idle() > h.idleTimeout {
+			return errClientIdle
+		}
+
+		// Set read deadline to avoid blocking forever on a client gone silently, or to send the coalesced data
+		// when it's due
+		clientConn.SetReadDeadline(coalescer.ReadDeadline(time.Now().Add(readInterval)))
+
 		n, err := clientConn.Read(buffer)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// Timeout is expected, send the coalesced data if it's due and check the context and the idle timeout
+				if err := send(coalescer.Due(time.Now())); err != nil {
+					return err
+				}
+				continue
+			}
 			if err == io.EOF {
-				klog.V(4).InfoS("Client connection closed", "packet_connection_id", pc.ID())
+				logger.V(4).InfoS("Client connection closed", "packet_connection_id", pc.ID())
 			} else {
-				klog.V(4).InfoS("Error reading from client", "packet_connection_id", pc.ID(), "error", err)
+				logger.V(4).InfoS("Error reading from client", "packet_connection_id", pc.ID(), "error", err)
 			}
+			// The data read before is sent before the packet connection is closed
+			send(coalescer.Flush(time.Now()))
 			return err
 		}
 
 		if n > 0 {
-			// Create a copy of the data to avoid race conditions
-			// The buffer slice is reused in the next iteration, so we need to copy
-			// the data to prevent concurrent access to the same memory
-			data := make([]byte, n)
-			copy(data, buffer[:n])
-
-			// NOTE: TargetAddress is NOT set here because this is a data forwarding packet.
-			// The connection has already been established, and the agent knows where to
-			// forward this data. Setting TargetAddress would be redundant and inefficient.
-			packet := &v1.Packet{
-				ConnId: pc.ID(),
-				Code:   v1.ControlCode_DATA,
-				Data:   data,
-			}
-
-			if err := pc.Send(packet); err != nil {
-				klog.ErrorS(err, "Failed to send data to agent", "packet_connection_id", pc.ID())
+			activity.touch()
+			// The data is copied by the coalescer, the buffer is reused in the next iteration
+			if err := send(coalescer.Add(buffer[:n], time.Now())); err != nil {
 				return err
 			}
-			klog.V(5).InfoS("Forwarded data to agent", "packet_connection_id", pc.ID(), "bytes", n)
 		}
 	}
 }
 
-// forwardAgentToClient forwards data from packet connection to client connection
-func (h *httpHandler) forwardAgentToClient(pc *packetConnection, clientConn net.Conn) error {
+// forwardAgentToClient forwards data from packet connection to client connection,
+// headRewriter rewrites the response head if it's not nil, activity is touched by the data written to the client
+func (h *httpHandler) forwardAgentToClient(pc *packetConnection, clientConn net.Conn, headRewriter *responseHeadRewriter, activity *clientActivity) error {
+	// written is set once data is written to the client, an error response can't be written afterwards
+	written := false
 	for {
-		packet := <-pc.Recv()
-		if packet == nil {
-			klog.V(4).InfoS("packet connection closed", "packet_connection_id", pc.ID())
+		packet, err := pc.Recv()
+		if err != nil {
+			logger.V(4).InfoS("packet connection closed", "packet_connection_id", pc.ID())
+			// Forward an incomplete response head as is
+			if pending := headRewriter.Flush(); len(pending) > 0 {
+				clientConn.Write(pending)
+				written = true
+			}
+			// The tunnel was closed before the agent responded, e.g. by DisconnectCluster
+			if err := pc.Err(); err != nil && !written {
+				if status.Code(err) == codes.DeadlineExceeded {
+					writeErrorResponse(clientConn, http.StatusGatewayTimeout, err.Error())
+				} else {
+					writeBadGateway(clientConn, err.Error())
+				}
+			}
 			return io.EOF
 		}
 
+		pc.record(capture.FromAgent, packet)
+
 		if packet.Code == v1.ControlCode_ERROR {
-			klog.ErrorS(fmt.Errorf("%s", packet.ErrorMessage), "Received error from agent", "packet_connection_id", pc.ID())
-
-			// Send HTTP 502 Bad Gateway response for connection errors
-			errorResponse := "HTTP/1.1 502 Bad Gateway\r\n" +
-				"Content-Type: text/plain\r\n" +
-				"Content-Length: " + fmt.Sprintf("%d", len(packet.ErrorMessage)) + "\r\n" +
-				"Connection: close\r\n" +
-				"\r\n" +
-				packet.ErrorMessage
-
-			_, writeErr := clientConn.Write([]byte(errorResponse))
-			if writeErr != nil {
-				klog.ErrorS(writeErr, "Failed to write error response to client", "packet_connection_id", pc.ID())
+			message := errorPacketMessage(packet)
+			logger.ErrorS(fmt.Errorf("%s", message), "Received error from agent", "packet_connection_id", pc.ID())
+
+			// Send HTTP 502 Bad Gateway response for connection errors, 504 Gateway Timeout once the read deadline
+			// passed. It would corrupt a response already being written
+			code := http.StatusBadGateway
+			if pc.readDeadlineExceeded() {
+				code = http.StatusGatewayTimeout
+			}
+			if !written {
+				if writeErr := writeErrorResponse(clientConn, code, message); writeErr != nil {
+					logger.ErrorS(writeErr, "Failed to write error response to client", "packet_connection_id", pc.ID())
+				}
 			}
 
-			return fmt.Errorf("agent error: %s", packet.ErrorMessage)
+			return fmt.Errorf("%w: %s", errAgentError, message)
 		}
 
-		if len(packet.Data) > 0 {
-			_, err := clientConn.Write(packet.Data)
+		if data := headRewriter.Write(packet.Data); len(data) > 0 {
+			_, err := clientConn.Write(data)
 			if err != nil {
-				klog.ErrorS(err, "Failed to write data to client", "packet_connection_id", pc.ID())
+				logger.ErrorS(err, "Failed to write data to client", "packet_connection_id", pc.ID())
 				return err
 			}
-			klog.V(5).InfoS("Forwarded data to client", "packet_connection_id", pc.ID(), "bytes", len(packet.Data))
+			written = true
+			activity.touch()
+			h.extendWriteDeadline(pc)
+			logger.V(5).InfoS("Forwarded data to client", "packet_connection_id", pc.ID(), "bytes", len(data))
 		}
+		if headRewriter.Complete() {
+			// The response asked the client to close the connection, the agent keeps its connection to the
+			// target open otherwise
+			logger.V(4).InfoS("Response complete, closing client connection", "packet_connection_id", pc.ID())
+			closeClientDisconnected(pc)
+			return io.EOF
+		}
+	}
+}
+
+// extendWriteDeadline gives the client writeTimeout from now to read the data over the buffer budget
+func (h *httpHandler) extendWriteDeadline(pc *packetConnection) {
+	if h.writeTimeout > 0 {
+		pc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
 	}
 }
+
+// errorPacketMessage returns the message of the ERROR packet, prefixed with its error code if it has one, e.g.
+// "INTEGRITY_FAILURE: checksum mismatch: ..."
+func errorPacketMessage(packet *v1.Packet) string {
+	if packet.ErrorCode == v1.ErrorCode_UNSPECIFIED_ERROR {
+		return packet.ErrorMessage
+	}
+	return fmt.Sprintf("%s: %s", packet.ErrorCode, packet.ErrorMessage)
+}
+
+// writeBadGateway writes a 502 Bad Gateway response with the message to the hijacked client connection
+func writeBadGateway(clientConn net.Conn, message string) error {
+	return writeErrorResponse(clientConn, http.StatusBadGateway, message)
+}
+
+// writeErrorResponse writes an error response with the status code and the message to the hijacked client connection
+func writeErrorResponse(clientConn net.Conn, code int, message string) error {
+	errorResponse := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code)) +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: " + fmt.Sprintf("%d", len(message)) + "\r\n" +
+		"Connection: close\r\n" +
+		"\r\n" +
+		message
+
+	_, err := clientConn.Write([]byte(errorResponse))
+	return err
+}
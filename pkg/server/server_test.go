@@ -0,0 +1,589 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"go.uber.org/goleak"
+)
+
+func TestForwardTrafficClientDisconnect(t *testing.T) {
+	cases := []struct {
+		name string
+		// end ends the traffic forwarding
+		end func(cancel context.CancelFunc, client net.Conn, pc *packetConnection)
+		// beforeForwarding ends it before forwardTraffic is called
+		beforeForwarding bool
+		expectError      bool
+	}{
+		{
+			name:        "client disconnects",
+			end:         func(_ context.CancelFunc, client net.Conn, _ *packetConnection) { client.Close() },
+			expectError: true,
+		},
+		{
+			name:             "client gone before forwarding",
+			end:              func(cancel context.CancelFunc, _ net.Conn, _ *packetConnection) { cancel() },
+			beforeForwarding: true,
+			expectError:      true,
+		},
+		{
+			name:        "agent closes",
+			end:         func(_ context.CancelFunc, _ net.Conn, pc *packetConnection) { pc.Close(nil) },
+			expectError: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tun := newTestTunnel(0)
+			pc, err := tun.NewPacketConn(context.Background())
+			if err != nil {
+				t.Fatalf("failed to create packet connection: %v", err)
+			}
+			client, clientConn := net.Pipe()
+			defer client.Close()
+			defer clientConn.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.beforeForwarding {
+				c.end(cancel, client, pc)
+			}
+
+			h := &httpHandler{tunnelManager: NewTunnelManager()}
+			done := make(chan struct{})
+			go func() {
+				h.forwardTraffic(ctx, clientConn, pc, nil)
+				close(done)
+			}()
+			if !c.beforeForwarding {
+				c.end(cancel, client, pc)
+			}
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("forwardTraffic didn't return")
+			}
+			select {
+			case <-pc.Context().Done():
+			default:
+				t.Errorf("expected the packet connection to be closed")
+			}
+
+			select {
+			case packet := <-tun.outgoingChan:
+				if !c.expectError {
+					t.Fatalf("unexpected packet to agent: %v", packet)
+				}
+				if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() || packet.ErrorMessage != clientDisconnectedMessage {
+					t.Errorf("expected a client disconnected error, got %v", packet)
+				}
+			default:
+				if c.expectError {
+					t.Fatalf("expected an error packet to agent")
+				}
+			}
+		})
+	}
+}
+
+// failingWriteConn is a client connection whose writes fail, e.g. a client whose connection was reset while the
+// hub wrote the response
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (c *failingWriteConn) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestForwardTrafficClosingOrder(t *testing.T) {
+	cases := []struct {
+		name string
+		// wrap wraps the client connection of the hub
+		wrap func(net.Conn) net.Conn
+		// end ends one direction of the traffic forwarding
+		end func(tun *Tunnel, client net.Conn, pc *packetConnection)
+		// clientCloses is whether end closes the client, which then can't read from its connection
+		clientCloses bool
+		// expectResponse is the status of the response the client reads before the connection is closed, 0 if none
+		expectResponse int
+		// expectError is whether the agent is sent an ERROR, it isn't if it ended the connection itself
+		expectError bool
+	}{
+		{
+			name:         "client dies first",
+			end:          func(_ *Tunnel, client net.Conn, _ *packetConnection) { client.Close() },
+			clientCloses: true,
+			expectError:  true,
+		},
+		{
+			name: "client write fails",
+			wrap: func(conn net.Conn) net.Conn { return &failingWriteConn{Conn: conn} },
+			end: func(tun *Tunnel, _ net.Conn, pc *packetConnection) {
+				tun.deliver(pc, &v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("HTTP/1.1 200 OK\r\n\r\n")})
+			},
+			expectError: true,
+		},
+		{
+			name: "agent dies first",
+			end: func(tun *Tunnel, _ net.Conn, pc *packetConnection) {
+				tun.deliver(pc, &v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_ERROR, ErrorMessage: "connection refused"})
+			},
+			expectResponse: http.StatusBadGateway,
+		},
+		{
+			name: "agent closes",
+			end:  func(_ *Tunnel, _ net.Conn, pc *packetConnection) { pc.Close(nil) },
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			tun := newTestTunnel(0)
+			pc, err := tun.NewPacketConn(context.Background())
+			if err != nil {
+				t.Fatalf("failed to create packet connection: %v", err)
+			}
+			client, clientConn := net.Pipe()
+			defer client.Close()
+			if c.wrap != nil {
+				clientConn = c.wrap(clientConn)
+			}
+
+			h := &httpHandler{tunnelManager: NewTunnelManager()}
+			done := make(chan struct{})
+			go func() {
+				h.forwardTraffic(context.Background(), clientConn, pc, nil)
+				close(done)
+			}()
+			c.end(tun, client, pc)
+
+			// The client reads the response if any, then the connection closed by the hub
+			if !c.clientCloses {
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				reader := bufio.NewReader(client)
+				if c.expectResponse != 0 {
+					resp, err := http.ReadResponse(reader, nil)
+					if err != nil {
+						t.Fatalf("failed to read response: %v", err)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != c.expectResponse {
+						t.Errorf("expected status %d, got %d", c.expectResponse, resp.StatusCode)
+					}
+				}
+				if _, err := reader.ReadByte(); err != io.EOF {
+					t.Fatalf("expected the client connection to be closed, got %v", err)
+				}
+			}
+
+			// The hub doesn't wait for the read deadline of the client connection to return
+			select {
+			case <-done:
+			case <-time.After(clientReadInterval / 2):
+				t.Fatalf("forwardTraffic didn't return")
+			}
+			select {
+			case <-pc.Context().Done():
+			default:
+				t.Errorf("expected the packet connection to be closed")
+			}
+
+			select {
+			case packet := <-tun.outgoingChan:
+				if !c.expectError {
+					t.Fatalf("unexpected packet to agent: %v", packet)
+				}
+				if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() || packet.ErrorMessage != clientDisconnectedMessage {
+					t.Errorf("expected a client disconnected error, got %v", packet)
+				}
+			default:
+				if c.expectError {
+					t.Fatalf("expected an error packet to agent")
+				}
+			}
+		})
+	}
+}
+
+func TestTerminationReason(t *testing.T) {
+	if err := terminationReason(io.EOF, nil, net.ErrClosed, fmt.Errorf("read: %w", io.ErrClosedPipe)); err != nil {
+		t.Errorf("expected no reason for connections closed cleanly, got %v", err)
+	}
+	clientErr := errors.New("connection reset by peer")
+	agentErr := fmt.Errorf("%w: connection refused", errAgentError)
+	err := terminationReason(clientErr, agentErr)
+	if !errors.Is(err, clientErr) || !errors.Is(err, agentErr) {
+		t.Errorf("expected both errors in the reason, got %v", err)
+	}
+}
+
+func TestForwardTrafficClientIdle(t *testing.T) {
+	tun := newTestTunnel(0)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	client, clientConn := net.Pipe()
+	defer client.Close()
+	defer clientConn.Close()
+
+	h := &httpHandler{tunnelManager: NewTunnelManager(), idleTimeout: 300 * time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		h.forwardTraffic(context.Background(), clientConn, pc, nil)
+		close(done)
+	}()
+
+	// The data from the agent keeps the connection open while the client sends nothing
+	go io.Copy(io.Discard, client)
+	for range 5 {
+		tun.deliver(pc, &v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("data")})
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatalf("expected the connection with traffic to stay open")
+	default:
+	}
+
+	// The client never sends anything and the agent stopped, the connection is closed after the idle timeout
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("forwardTraffic didn't return")
+	}
+	select {
+	case packet := <-tun.outgoingChan:
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() || packet.ErrorMessage != clientDisconnectedMessage {
+			t.Errorf("expected a client disconnected error, got %v", packet)
+		}
+	default:
+		t.Fatalf("expected an error packet to agent")
+	}
+}
+
+func TestForwardTrafficWriteDeadlineExceeded(t *testing.T) {
+	tun := newTestTunnel(0)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	client, clientConn := net.Pipe()
+	defer client.Close()
+	defer clientConn.Close()
+
+	h := &httpHandler{tunnelManager: NewTunnelManager(), writeTimeout: time.Second}
+	go h.forwardTraffic(context.Background(), clientConn, pc, nil)
+
+	// The client didn't read the response by the write deadline before any of it was written
+	pc.Close(fmt.Errorf("%w: %d bytes buffered", errWriteDeadlineExceeded, 64*1024))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
+
+func TestForwardClientToAgentCoalesce(t *testing.T) {
+	tun := newTestTunnel(0)
+	tun.outgoingChan = make(chan *v1.Packet, 4096)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	client, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	h := &httpHandler{tunnelManager: NewTunnelManager(), coalesce: &coalesce.Config{Delay: 2 * time.Millisecond, MaxBytes: 1024}}
+	done := make(chan error, 1)
+	go func() { done <- h.forwardClientToAgent(context.Background(), clientConn, pc, newClientActivity()) }()
+
+	// The client types in bursts, then closes the connection
+	const writes = 2000
+	var written []byte
+	for i := range writes {
+		data := make([]byte, 1+i%7)
+		for j := range data {
+			data[j] = byte(len(written) + j)
+		}
+		written = append(written, data...)
+		if _, err := client.Write(data); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	client.Close()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Fatalf("expected the client to close the connection, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("forwardClientToAgent didn't return")
+	}
+
+	// The data buffered when the client closed the connection is sent too
+	var received []byte
+	packets := len(tun.outgoingChan)
+	for range packets {
+		packet := <-tun.outgoingChan
+		if packet.Code != v1.ControlCode_DATA || packet.ConnId != pc.ID() {
+			t.Fatalf("unexpected packet %v", packet)
+		}
+		received = append(received, packet.Data...)
+	}
+	if string(received) != string(written) {
+		t.Fatalf("expected the %d bytes written in order, received %d bytes", len(written), len(received))
+	}
+	if packets >= writes/2 {
+		t.Errorf("expected the writes to be coalesced, got %d packets for %d writes", packets, writes)
+	}
+}
+
+// recordingSender records the packets sent on a packet connection
+type recordingSender struct {
+	packets []*v1.Packet
+}
+
+func (s *recordingSender) ID() int64 { return 1 }
+
+func (s *recordingSender) Send(packet *v1.Packet) error {
+	s.packets = append(s.packets, packet)
+	return nil
+}
+
+func TestSendInitialHTTPRequestTimestamp(t *testing.T) {
+	for _, body := range []string{"", "payload"} {
+		sender := &recordingSender{}
+		r := httptest.NewRequest("POST", "/test-cluster/api", strings.NewReader(body))
+		requestData, err := serializeHTTPRequest(r)
+		if err != nil {
+			t.Fatalf("failed to serialize the request: %v", err)
+		}
+		if err := (&httpHandler{}).sendInitialHTTPRequest(sender, requestData); err != nil {
+			t.Fatalf("failed to send the initial request: %v", err)
+		}
+
+		if len(sender.packets) != 1 {
+			t.Fatalf("expected 1 packet, got %d", len(sender.packets))
+		}
+		packet := sender.packets[0]
+		if packet.Timestamp == 0 {
+			t.Fatalf("expected the timestamp to be set")
+		}
+		if elapsed := time.Since(time.Unix(0, packet.Timestamp)); elapsed < 0 || elapsed > time.Second {
+			t.Errorf("expected the timestamp to be within 1s of now, got %s ago", elapsed)
+		}
+	}
+}
+
+func TestSerializeHTTPRequestTarget(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		// modify modifies the parsed request, like a middleware
+		modify         func(r *http.Request)
+		expectedTarget string
+		expectedHost   string
+		// expectedErr is the error of validateRequestTarget, the request is serialized otherwise
+		expectedErr string
+	}{
+		{name: "origin form", raw: "GET /cluster1/api/v1/pods?watch=true HTTP/1.1\r\nHost: hub.example.com\r\n\r\n",
+			expectedTarget: "/cluster1/api/v1/pods?watch=true", expectedHost: "hub.example.com"},
+		{name: "absolute form", raw: "GET http://hub.example.com:8080/cluster1/api/v1/pods?watch=true HTTP/1.1\r\nHost: hub.example.com:8080\r\n\r\n",
+			expectedTarget: "/cluster1/api/v1/pods?watch=true", expectedHost: "hub.example.com:8080"},
+		// The authority of the target takes precedence over the Host header
+		{name: "absolute form with another Host", raw: "GET http://hub.example.com/cluster1/api HTTP/1.1\r\nHost: other.example.com\r\n\r\n",
+			expectedTarget: "/cluster1/api", expectedHost: "hub.example.com"},
+		{name: "absolute form without path", raw: "GET http://hub.example.com HTTP/1.1\r\nHost: hub.example.com\r\n\r\n",
+			expectedTarget: "/", expectedHost: "hub.example.com"},
+		{name: "escaped path", raw: "GET /cluster1/api/v1/namespaces/a%2Fb HTTP/1.1\r\nHost: hub.example.com\r\n\r\n",
+			expectedTarget: "/cluster1/api/v1/namespaces/a%2Fb", expectedHost: "hub.example.com"},
+		{name: "Host header set by a middleware", raw: "GET /cluster1/api HTTP/1.1\r\nHost: hub.example.com\r\n\r\n",
+			modify:         func(r *http.Request) { r.Header["Host"] = []string{"hub.example.com", "evil.example.com"} },
+			expectedTarget: "/cluster1/api", expectedHost: "hub.example.com"},
+		{name: "Host changed by a middleware", raw: "GET http://hub.example.com/cluster1/api HTTP/1.1\r\nHost: hub.example.com\r\n\r\n",
+			modify:      func(r *http.Request) { r.Host = "cluster2.hub.example.com" },
+			expectedErr: "conflicts with Host cluster2.hub.example.com"},
+		{name: "opaque target", raw: "GET http:cluster1 HTTP/1.1\r\nHost: hub.example.com\r\n\r\n",
+			expectedErr: "has no path"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(c.raw)))
+			if err != nil {
+				t.Fatalf("failed to parse the request: %v", err)
+			}
+			if c.modify != nil {
+				c.modify(r)
+			}
+			err = validateRequestTarget(r)
+			if c.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+					t.Fatalf("expected error %q, got %v", c.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			requestData, err := serializeHTTPRequest(r)
+			if err != nil {
+				t.Fatalf("failed to serialize the request: %v", err)
+			}
+			// The agent's HTTP server parses the request as it's sent
+			forwarded, err := http.ReadRequest(bufio.NewReader(strings.NewReader(string(requestData))))
+			if err != nil {
+				t.Fatalf("the agent failed to parse the forwarded request: %v\n%s", err, requestData)
+			}
+			if forwarded.RequestURI != c.expectedTarget {
+				t.Errorf("expected the request target %q, got %q", c.expectedTarget, forwarded.RequestURI)
+			}
+			if forwarded.Host != c.expectedHost {
+				t.Errorf("expected Host %q, got %q", c.expectedHost, forwarded.Host)
+			}
+			if hosts := strings.Count(string(requestData), "Host: "); hosts != 1 {
+				t.Errorf("expected exactly one Host header, got %d\n%s", hosts, requestData)
+			}
+		})
+	}
+}
+
+func TestShutdownConcurrent(t *testing.T) {
+	s, err := New(&Config{
+		GRPCListenAddress:  "127.0.0.1:0",
+		HTTPListenAddress:  "127.0.0.1:0",
+		AdminListenAddress: "127.0.0.1:0",
+	}, NewClusterNameParserImplt())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Concurrent runs, only one of them can start the server
+	const runs = 3
+	runErr := make(chan error, runs)
+	for i := 0; i < runs; i++ {
+		go func() {
+			runErr <- s.Run(ctx)
+		}()
+	}
+
+	// Shut down while Run is still starting, and read the addresses meanwhile
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.shutdown(); err != nil {
+				t.Errorf("unexpected error shutting down: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			s.GRPCAddress()
+			s.HTTPAddress()
+			s.AdminAddress()
+			s.Ready()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("shutdown deadlocked")
+	}
+
+	cancel()
+	for i := 0; i < runs; i++ {
+		select {
+		case <-runErr:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Run didn't return after the shutdown")
+		}
+	}
+	if s.Ready() {
+		t.Errorf("expected the server not to be ready after the shutdown")
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Errorf("expected Run to fail after the shutdown")
+	}
+}
+
+func TestReplaceHTTPHandler(t *testing.T) {
+	s, err := New(DefaultConfig(), NewClusterNameParserImplt())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	// serve sends a request to the HTTP server and returns the response body
+	serve := func(path string) string {
+		w := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	s.ReplaceHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		fmt.Fprint(w, "old")
+	}))
+	inFlight := make(chan string, 1)
+	go func() {
+		inFlight <- serve("/slow")
+	}()
+	<-started
+
+	// The handler is swapped while the request of the old one is in flight
+	s.ReplaceHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "new")
+	}))
+	if body := serve("/fast"); body != "new" {
+		t.Errorf("expected the new handler to serve the next request, got %q", body)
+	}
+	close(release)
+	if body := <-inFlight; body != "old" {
+		t.Errorf("expected the old handler to complete the request in flight, got %q", body)
+	}
+
+	// A nil handler restores the one built by New
+	s.ReplaceHTTPHandler(nil)
+	if body := serve("/health"); body != "OK" {
+		t.Errorf("expected the health check of the initial handler, got %q", body)
+	}
+}
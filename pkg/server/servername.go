@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// grpcTLSConfig returns the TLS config of the gRPC server choosing the certificate of config for the server name the
+// agent requests with SNI, or for serverName if the agent requests none or one no certificate is valid for, e.g. when
+// it connects to the IP of the hub. The certificates are chosen by SNI only, the first one otherwise, if serverName
+// is empty
+func grpcTLSConfig(config *tls.Config, serverName string) (*tls.Config, error) {
+	if serverName == "" {
+		return config, nil
+	}
+	if config.GetConfigForClient != nil || config.GetCertificate != nil {
+		return nil, fmt.Errorf("GRPCServerName can't be used with the GetConfigForClient or GetCertificate of GRPCTLSConfig")
+	}
+
+	// A config for each certificate
+	leafs := make([]*x509.Certificate, len(config.Certificates))
+	configs := make([]*tls.Config, len(config.Certificates))
+	for i, cert := range config.Certificates {
+		leafs[i] = cert.Leaf
+		if leafs[i] == nil && len(cert.Certificate) > 0 {
+			// A certificate that doesn't parse is never chosen
+			leafs[i], _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		configs[i] = config.Clone()
+		configs[i].Certificates = []tls.Certificate{cert}
+	}
+	configFor := func(name string) *tls.Config {
+		if name == "" {
+			return nil
+		}
+		for i, leaf := range leafs {
+			if leaf != nil && leaf.VerifyHostname(name) == nil {
+				return configs[i]
+			}
+		}
+		return nil
+	}
+	if configFor(serverName) == nil {
+		return nil, fmt.Errorf("no certificate of GRPCTLSConfig is valid for GRPCServerName %s", serverName)
+	}
+
+	serverConfig := config.Clone()
+	serverConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if c := configFor(hello.ServerName); c != nil {
+			return c, nil
+		}
+		return configFor(serverName), nil
+	}
+	return serverConfig, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+)
+
+func TestGRPCServerName(t *testing.T) {
+	ca, err := certutil.NewCA(certutil.Options{})
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	var certificates []tls.Certificate
+	for _, name := range []string{"tenant-a.example.com", "tenant-b.example.com", "hub.example.com"} {
+		keyPair, err := ca.IssueServer(name)
+		if err != nil {
+			t.Fatalf("failed to issue server certificate: %v", err)
+		}
+		cert, err := keyPair.TLSCertificate()
+		if err != nil {
+			t.Fatalf("failed to load server key pair: %v", err)
+		}
+		certificates = append(certificates, cert)
+	}
+
+	cases := []struct {
+		name       string
+		serverName string
+		sni        string
+		expectName string
+	}{
+		{name: "SNI", serverName: "hub.example.com", sni: "tenant-b.example.com", expectName: "tenant-b.example.com"},
+		{name: "no SNI", serverName: "hub.example.com", expectName: "hub.example.com"},
+		{name: "unknown SNI", serverName: "hub.example.com", sni: "10.0.0.1.nip.io", expectName: "hub.example.com"},
+		{name: "SNI without server name", sni: "tenant-b.example.com", expectName: "tenant-b.example.com"},
+		{name: "no SNI without server name", expectName: "tenant-a.example.com"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := grpcTLSConfig(&tls.Config{Certificates: certificates}, c.serverName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			go tls.Server(serverConn, config).Handshake()
+
+			// An empty ServerName sends no SNI, the certificate is checked below
+			client := tls.Client(clientConn, &tls.Config{ServerName: c.sni, InsecureSkipVerify: true})
+			if err := client.Handshake(); err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			leaf := client.ConnectionState().PeerCertificates[0]
+			if err := leaf.VerifyHostname(c.expectName); err != nil {
+				t.Errorf("expected the certificate of %s, got %v", c.expectName, leaf.DNSNames)
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name        string
+		config      *Config
+		expectError string
+	}{
+		{
+			name:        "no certificate for the server name",
+			config:      &Config{GRPCTLSConfig: &tls.Config{Certificates: certificates}, GRPCServerName: "other.example.com"},
+			expectError: "no certificate of GRPCTLSConfig is valid for GRPCServerName other.example.com",
+		},
+		{
+			name: "GetCertificate",
+			config: &Config{GRPCTLSConfig: &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &certificates[0], nil
+			}}, GRPCServerName: "hub.example.com"},
+			expectError: "GRPCServerName can't be used with the GetConfigForClient or GetCertificate of GRPCTLSConfig",
+		},
+		{
+			name:        "no TLS",
+			config:      &Config{GRPCServerName: "hub.example.com"},
+			expectError: "GRPCTLSConfig must be set when GRPCServerName is set",
+		},
+	}
+	for _, c := range errorCases {
+		t.Run(c.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.GRPCTLSConfig = c.config.GRPCTLSConfig
+			config.GRPCServerName = c.config.GRPCServerName
+			if _, err := New(config, NewClusterNameParserImplt()); err == nil || !strings.Contains(err.Error(), c.expectError) {
+				t.Errorf("expected error %q, got %v", c.expectError, err)
+			}
+		})
+	}
+}
@@ -2,15 +2,71 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
-	"k8s.io/klog/v2"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/packetqueue"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/resume"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/rtt"
+	"golang.org/x/time/rate"
 )
 
+const (
+	// controlPacketConnID is the conn_id reserved for tunnel-level control messages (such as DRAIN),
+	// it's never allocated to a packet connection
+	controlPacketConnID int64 = 0
+	// maxPacketConnIDOffset bounds the random offset packet connection IDs start from,
+	// leaving plenty of room before the IDs wrap around
+	maxPacketConnIDOffset int64 = math.MaxInt64 / 2
+	// maxSlowStartWait bounds how long a new packet connection is queued during slow start before it's rejected
+	maxSlowStartWait = 1 * time.Second
+	// unknownConnErrorInterval is the minimum interval between the ERRORs sent for the same unknown conn_id
+	unknownConnErrorInterval = 5 * time.Second
+	// maxUnknownConnErrors bounds the unknown conn_ids remembered before the expired ones are pruned
+	maxUnknownConnErrors = 1024
+)
+
+// ErrSlowStart is returned by NewPacketConn when the tunnel is in its slow start window and the rate
+// of new packet connections is exceeded, the hub responds with 503 Service Unavailable and Retry-After
+var ErrSlowStart = errors.New("tunnel is warming up after reconnect")
+
+// ErrHandshakeTimeout is returned by Serve when the agent sends no packet within the handshake timeout
+var ErrHandshakeTimeout = errors.New("agent sent no packet within the handshake timeout")
+
+// ErrTooManyPacketConns is returned by NewPacketConn when the tunnel has the maximum number of open packet
+// connections, the hub responds with 429 Too Many Requests
+var ErrTooManyPacketConns = errors.New("too many connections to cluster")
+
+// ErrTunnelDraining is returned by NewPacketConn when the agent sent a DRAIN, it finishes its in-flight requests
+// before it closes the tunnel. The hub responds with 503 Service Unavailable and Retry-After
+var ErrTunnelDraining = errors.New("agent is draining")
+
+// errTunnelUnavailable is returned by sendPacket when the tunnel is not serving yet or closed, the DATA packets of
+// a resumable packet connection are retransmitted when it's resumed on the next tunnel
+var errTunnelUnavailable = errors.New("tunnel unavailable")
+
+// errTunnelNotInitialized is returned by NewPacketConn when the tunnel is not served yet, the agent is connecting
+var errTunnelNotInitialized = errors.New("connection not initialized")
+
+// errTunnelServed is returned by Serve when the tunnel is already served, gRPC streams don't support concurrent sends
+var errTunnelServed = errors.New("tunnel already served")
+
+// errTunnelClosed is returned by Serve when the tunnel was closed before it's served, e.g. replaced by the next
+// tunnel of the agent. The agent reconnects
+var errTunnelClosed = errors.New("tunnel closed before it's served")
+
+// errAgentDrained is returned by Serve when the tunnel of an agent that sent a DRAIN ends, it won't resume its
+// packet connections
+var errAgentDrained = errors.New("agent initiated drain")
+
 type Tunnel struct {
 	id          string
 	clusterName string
@@ -21,10 +77,72 @@ type Tunnel struct {
 	// packet connection management
 	mu               sync.RWMutex
 	packetConns      map[int64]*packetConnection
-	nextPacketConnID int64
+	nextPacketConnID int64 // last allocated packet connection ID
 	outgoingChan     chan *v1.Packet
 	closed           bool
 	initialized      int32 // atomic flag to check if connection is initialized
+	// served is set by Serve, handleOutgoing must be the only sender of the stream
+	served atomic.Bool
+	// serveDone is closed when Serve returns, nil if the tunnel was not created by a TunnelManager
+	serveDone chan struct{}
+	// closedAt is when the tunnel was closed, the reaper of the TunnelManager removes the tunnels registered long
+	// after it
+	closedAt time.Time
+	// drained is set when the agent sends a DRAIN, no new packet connection is opened on the tunnel
+	drained atomic.Bool
+	// bulkChan queues the packets of the bulk packet connections, nil if QoS is disabled
+	bulkChan chan *v1.Packet
+
+	// firstPacketConnID and packetConnIDWrapped are used to tell whether a conn_id was ever allocated by this tunnel
+	firstPacketConnID   int64
+	packetConnIDWrapped bool
+
+	// pingInterval is the interval of the PINGs measuring the round-trip time to the agent, 0 disables them
+	pingInterval time.Duration
+	// handshakeTimeout closes the tunnel if the agent sends no packet for this long after it connected,
+	// 0 disables it
+	handshakeTimeout time.Duration
+	rtt              rtt.Estimator
+
+	// maxPacketConns caps the open packet connections, 0 means unlimited
+	maxPacketConns int
+	// maxBufferedBytes caps the data from the agent buffered for each packet connection,
+	// packetqueue.DefaultMaxBytes if not positive
+	maxBufferedBytes int
+	// slowStart caps the rate of new packet connections until slowStartUntil, nil disables it
+	slowStart      *rate.Limiter
+	slowStartUntil time.Time
+	slowStartTimer *time.Timer
+
+	// resumable numbers the DATA packets of the packet connections and keeps them on the tunnel manager when the
+	// tunnel closes, for the next tunnel of the agent to resume them
+	resumable bool
+	// resumeMaxBytes caps the data sent on each packet connection kept until the agent acknowledges it
+	resumeMaxBytes int
+	// resumeTimer closes the packet connections kept after the tunnel closed when the resume window expires
+	resumeTimer *time.Timer
+
+	// firstPacket is whether the agent opens the packet connections on their first DATA packet with data, so that
+	// they're opened without an empty DATA packet
+	firstPacket bool
+	// agentVersion is the release of the agent from v1.AgentVersionMetadataKey, empty for older agents
+	agentVersion string
+	// qos prioritizes the interactive packet connections over the bulk ones, nil disables it
+	qos *qos.Config
+	// integrity sets the checksum of the DATA packets sent to the agent and verifies the one of the DATA packets
+	// received from it
+	integrity bool
+
+	// unknownConnErrors holds when an ERROR was last sent for each unknown conn_id, so that a stale conn_id the
+	// agent keeps sending packets for gets one ERROR per unknownConnErrorInterval
+	unknownConnErrorsMu sync.Mutex
+	unknownConnErrors   map[int64]time.Time
+}
+
+// randomPacketConnIDOffset returns a random offset to start allocating packet connection IDs from,
+// so that IDs are not reused across tunnel replacements for the same cluster
+func randomPacketConnIDOffset() int64 {
+	return rand.Int64N(maxPacketConnIDOffset)
 }
 
 // ID returns the unique identifier for this connection
@@ -37,23 +155,65 @@ func (t *Tunnel) ClusterName() string {
 	return t.clusterName
 }
 
+// CreatedAt returns the time the tunnel was created
+func (t *Tunnel) CreatedAt() time.Time {
+	return t.createdAt
+}
+
+// AgentVersion returns the release of the agent, empty if the agent didn't send it
+func (t *Tunnel) AgentVersion() string {
+	return t.agentVersion
+}
+
+// RTT returns the smoothed round-trip time to the agent, 0 until the first PONG is received
+func (t *Tunnel) RTT() time.Duration {
+	return t.rtt.RTT()
+}
+
+// ProtocolVersion returns the protocol version negotiated with the agent
+func (t *Tunnel) ProtocolVersion() int {
+	if t.resumable {
+		return v1.ProtocolVersionResume
+	}
+	return v1.ProtocolVersionBase
+}
+
 // Serve handles the connection (blocks until connection is closed)
 func (t *Tunnel) Serve() error {
-	klog.InfoS("Starting to serve tunnel", "cluster", t.clusterName, "tunnel_id", t.id)
+	if !t.served.CompareAndSwap(false, true) {
+		return errTunnelServed
+	}
+	if t.serveDone != nil {
+		defer close(t.serveDone)
+	}
+	logger.InfoS("Starting to serve tunnel", "cluster", t.clusterName, "tunnel_id", t.id)
 
 	// Initialize connection with proper synchronization
 	t.mu.Lock()
+	if t.closed {
+		// Serving it would leave the stream of the agent open on a tunnel no request is sent on
+		t.mu.Unlock()
+		return errTunnelClosed
+	}
 	t.outgoingChan = make(chan *v1.Packet, 1000) // Buffer for outgoing packets
-	t.packetConns = make(map[int64]*packetConnection)
+	if t.qos != nil {
+		t.bulkChan = make(chan *v1.Packet, 1000)
+	}
+	if t.packetConns == nil {
+		// Packet connections may have been adopted from the previous tunnel already
+		t.packetConns = make(map[int64]*packetConnection)
+	}
 	atomic.StoreInt32(&t.initialized, 1) // Mark as initialized
 	t.mu.Unlock()
 
 	// Start goroutines for handling incoming and outgoing packets
-	errCh := make(chan error, 2)
+	errCh := make(chan error, 3)
+	// handshakeDone is closed once the first packet is received from the agent
+	handshakeDone := make(chan struct{})
 
 	// Goroutine 1: Handle incoming packets from agent
 	go func() {
-		errCh <- t.handleIncoming()
+		errCh <- t.handleIncoming(handshakeDone)
 	}()
 
 	// Goroutine 2: Handle outgoing packets to agent
@@ -61,23 +221,103 @@ func (t *Tunnel) Serve() error {
 		errCh <- t.handleOutgoing()
 	}()
 
+	// Goroutine 3: Measure the round-trip time to agent
+	if t.pingInterval > 0 {
+		go t.ping()
+	}
+
+	// Goroutine 4: Close the tunnel of an agent that connected but sends nothing
+	if t.handshakeTimeout > 0 {
+		go func() {
+			if err := t.waitHandshake(handshakeDone); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+
+	if t.resumable {
+		t.sendResumes()
+	}
+
 	// Wait for either goroutine to exit
 	err := <-errCh
 
 	// Clean up
-	t.Close()
+	if t.resumable && !errors.Is(err, errAgentDrained) {
+		// Keep the packet connections for the next tunnel of the agent to resume them
+		t.close(fmt.Errorf("connection closed"), false)
+	} else {
+		t.Close()
+	}
 
 	return err
 }
 
-// handleIncoming processes packets received from the agent
-func (t *Tunnel) handleIncoming() error {
+// sendResumes sends a RESUME for each packet connection followed by its DATA packets the agent didn't acknowledge,
+// then a RESUME on the control conn_id to tell the agent all its connections the hub knows were resumed
+func (t *Tunnel) sendResumes() {
+	t.mu.RLock()
+	packetConns := make([]*packetConnection, 0, len(t.packetConns))
+	for _, pc := range t.packetConns {
+		// The packet connections adopted from a tunnel that doesn't resume them are not numbered
+		if pc.sender != nil {
+			pc.acquire()
+			packetConns = append(packetConns, pc)
+		}
+	}
+	t.mu.RUnlock()
+
+	for _, pc := range packetConns {
+		if err := pc.resume(); err != nil {
+			pc.closeWithError(fmt.Errorf("failed to resume connection: %w", err))
+			packetConnResumes.WithLabelValues(t.clusterName, resumeResultFailed).Inc()
+		}
+		pc.release()
+	}
+	t.sendControlPacket(&v1.Packet{ConnId: controlPacketConnID, Code: v1.ControlCode_RESUME})
+	if len(packetConns) > 0 {
+		logger.InfoS("Resuming packet connections", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connections", len(packetConns))
+	}
+}
+
+// waitHandshake waits for the first packet from the agent, it returns ErrHandshakeTimeout if it's not received
+// within the handshake timeout
+func (t *Tunnel) waitHandshake(handshakeDone <-chan struct{}) error {
+	timer := time.NewTimer(t.handshakeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-handshakeDone:
+		return nil
+	case <-t.ctx.Done():
+		return nil
+	case <-timer.C:
+		logger.ErrorS(nil, "Agent sent no packet within the handshake timeout, closing tunnel", "cluster", t.clusterName, "tunnel_id", t.id, "timeout", t.handshakeTimeout)
+		return fmt.Errorf("%w after %v", ErrHandshakeTimeout, t.handshakeTimeout)
+	}
+}
+
+// handleIncoming processes packets received from the agent, handshakeDone is closed when the first one is received
+func (t *Tunnel) handleIncoming(handshakeDone chan<- struct{}) error {
 	for {
 		packet, err := t.grpcStream.Recv()
 		if err != nil {
-			klog.InfoS("Connection receive ended", "cluster", t.clusterName, "tunnel_id", t.id, "error", err)
+			logger.InfoS("Connection receive ended", "cluster", t.clusterName, "tunnel_id", t.id, "error", err)
+			if t.drained.Load() {
+				return errAgentDrained
+			}
 			return err
 		}
+		if handshakeDone != nil {
+			close(handshakeDone)
+			handshakeDone = nil
+		}
+
+		// conn_id 0 is reserved for control messages, only DRAIN, PING and PONG are expected on it
+		if packet.ConnId == controlPacketConnID && !isControlCode(packet.Code) {
+			logger.Warningf("Rejecting %v packet on reserved control conn_id %d", packet.Code, packet.ConnId)
+			continue
+		}
 
 		// Handle different packet types
 		switch packet.Code {
@@ -86,119 +326,250 @@ func (t *Tunnel) handleIncoming() error {
 		case v1.ControlCode_ERROR:
 			t.handleErrorPacket(packet)
 		case v1.ControlCode_DRAIN:
-			klog.InfoS("Received DRAIN signal from agent", "cluster", t.clusterName, "tunnel_id", t.id)
-			return fmt.Errorf("agent initiated drain")
+			// The agent closes the tunnel once its in-flight requests complete, or right away when it's stopped
+			logger.InfoS("Received DRAIN signal from agent", "cluster", t.clusterName, "tunnel_id", t.id)
+			t.drained.Store(true)
+		case v1.ControlCode_PING:
+			t.sendControlPacket(&v1.Packet{ConnId: controlPacketConnID, Code: v1.ControlCode_PONG, Data: packet.Data})
+		case v1.ControlCode_PONG:
+			t.handlePongPacket(packet)
+		case v1.ControlCode_ACK:
+			t.handleAckPacket(packet)
+		case v1.ControlCode_RESUME:
+			t.handleResumePacket(packet)
 		default:
-			klog.Warningf("Unknown packet code received: %v", packet.Code)
+			logger.Warningf("Unknown packet code received: %v", packet.Code)
 		}
 	}
 }
 
-// handleOutgoing sends packets to the agent
-func (t *Tunnel) handleOutgoing() error {
+// isControlCode returns true for the codes of tunnel-level control messages
+func isControlCode(code v1.ControlCode) bool {
+	return code == v1.ControlCode_DRAIN || code == v1.ControlCode_PING || code == v1.ControlCode_PONG
+}
+
+// ping periodically sends a PING to the agent until the tunnel is closed
+func (t *Tunnel) ping() {
+	ticker := time.NewTicker(t.pingInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case packet := <-t.outgoingChan:
-			if err := t.grpcStream.Send(packet); err != nil {
-				klog.ErrorS(err, "Failed to send packet to agent", "cluster", t.clusterName, "tunnel_id", t.id)
-				return err
-			}
+		case <-ticker.C:
+			t.sendControlPacket(&v1.Packet{ConnId: controlPacketConnID, Code: v1.ControlCode_PING, Data: rtt.NewPingPayload()})
 		case <-t.ctx.Done():
-			return t.ctx.Err()
+			return
+		}
+	}
+}
+
+// handlePongPacket updates the round-trip time with the PONG of a PING sent by ping
+func (t *Tunnel) handlePongPacket(packet *v1.Packet) {
+	sample, err := rtt.SampleFromPong(packet.Data)
+	if err != nil {
+		logger.Warningf("Dropping invalid PONG from cluster %s: %v", t.clusterName, err)
+		return
+	}
+	estimate := t.rtt.Observe(sample)
+	tunnelRTT.WithLabelValues(t.clusterName).Set(estimate.Seconds())
+	logger.V(5).InfoS("Measured tunnel round-trip time", "cluster", t.clusterName, "tunnel_id", t.id, "sample", sample, "rtt", estimate)
+}
+
+// sendControlPacket sends a control packet to the agent without blocking,
+// it's dropped if the tunnel is closed or the outgoing channel is full
+func (t *Tunnel) sendControlPacket(packet *v1.Packet) {
+	if err := t.sendPacket(packet); err != nil {
+		logger.V(4).InfoS("Dropping control packet", "cluster", t.clusterName, "code", packet.Code, "error", err)
+	}
+}
+
+// handleOutgoing sends packets to the agent, it's the only sender of the stream: the packets of the packet
+// connections and the control packets are queued on outgoingChan, the ones of the bulk packet connections on
+// bulkChan if QoS is enabled. The scheduler interleaves them
+func (t *Tunnel) handleOutgoing() error {
+	scheduler := qos.NewScheduler(t.qos)
+	for {
+		packet, err := scheduler.Poll(t.outgoingChan, t.bulkChan)
+		if err != nil {
+			// The tunnel is closed
+			return fmt.Errorf("tunnel closed")
+		}
+		if packet == nil {
+			var ok bool
+			select {
+			case packet, ok = <-t.outgoingChan:
+			case packet, ok = <-t.bulkChan:
+			case <-t.ctx.Done():
+				return t.ctx.Err()
+			}
+			if !ok {
+				// The tunnel is closed
+				return fmt.Errorf("tunnel closed")
+			}
+		}
+		if err := t.grpcStream.Send(packet); err != nil {
+			logger.ErrorS(err, "Failed to send packet to agent", "cluster", t.clusterName, "tunnel_id", t.id)
+			return err
 		}
 	}
 }
 
 // handleDataPacket processes a DATA packet
 func (t *Tunnel) handleDataPacket(packet *v1.Packet) {
-	t.mu.RLock()
-	pc, exists := t.packetConns[packet.ConnId]
-	t.mu.RUnlock()
-
+	pc, exists := t.acquirePacketConn(packet.ConnId)
 	if exists {
-		// Use a safe send that handles closed channels
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					// Channel was closed, ignore the packet
-					klog.V(4).InfoS("Dropping packet for closed packet connection", "packet_connection_id", packet.ConnId)
-				}
-			}()
-
-			// Check if packet connection context is cancelled (connection closed)
-			select {
-			case <-pc.ctx.Done():
-				// Stream is closed, drop the packet
-				klog.V(4).InfoS("Dropping packet for closed packet connection", "packet_connection_id", packet.ConnId)
-			default:
-				// Send to existing packet connection
-				select {
-				case pc.incomingChan <- packet:
-				case <-pc.ctx.Done():
-					// Stream was closed while we were trying to send
-					klog.V(4).InfoS("Dropping packet for closed packet connection", "packet_connection_id", packet.ConnId)
-				default:
-					klog.Warningf("Stream %d incoming channel is full, dropping packet", packet.ConnId)
-				}
+		defer pc.release()
+		if t.integrity {
+			if err := packet.VerifyChecksum(); err != nil {
+				t.failIntegrity(pc, err)
+				return
 			}
-		}()
+		}
+		if !pc.accept(packet) {
+			// A duplicate, or a packet after a gap that's retransmitted when the packet connection is resumed
+			logger.V(5).InfoS("Dropping out of order packet", "packet_connection_id", packet.ConnId, "seq", packet.Seq, "seq_num", packet.SeqNum)
+			return
+		}
+		t.deliver(pc, packet)
+		if seq, ok := pc.ack(); ok {
+			t.sendControlPacket(&v1.Packet{ConnId: packet.ConnId, Code: v1.ControlCode_ACK, Ack: seq})
+		}
 	} else {
-		klog.Warningf("Received packet for unknown packet connection %d", packet.ConnId)
-		// Send error response
-		errorPacket := &v1.Packet{
-			ConnId:       packet.ConnId,
+		errorMessage := fmt.Sprintf("unknown packet connection %d", packet.ConnId)
+		if !t.isAllocatedPacketConnID(packet.ConnId) {
+			logger.Warningf("Rejecting packet for packet connection %d never allocated by tunnel %s", packet.ConnId, t.id)
+			errorMessage = fmt.Sprintf("packet connection %d was never allocated", packet.ConnId)
+		} else {
+			logger.V(4).InfoS("Received packet for unknown packet connection", "cluster", t.clusterName, "packet_connection_id", packet.ConnId)
+		}
+		t.sendUnknownConnError(packet.ConnId, errorMessage)
+	}
+}
+
+// failIntegrity closes the packet connection whose DATA packet from the agent didn't match its checksum: the client
+// is sent the INTEGRITY_FAILURE error and the agent is told to close its connection to the target service
+func (t *Tunnel) failIntegrity(pc *packetConnection, err error) {
+	logger.Warningf("Closing packet connection %d of cluster %s: %v", pc.ID(), t.clusterName, err)
+	integrityFailures.WithLabelValues(t.clusterName, integrityDirectionFromAgent).Inc()
+	newErrorPacket := func() *v1.Packet {
+		return &v1.Packet{
+			ConnId:       pc.ID(),
 			Code:         v1.ControlCode_ERROR,
-			ErrorMessage: fmt.Sprintf("unknown packet connection %d", packet.ConnId),
+			ErrorCode:    v1.ErrorCode_INTEGRITY_FAILURE,
+			ErrorMessage: err.Error(),
 		}
-		select {
-		case t.outgoingChan <- errorPacket:
-		default:
-			klog.Warningf("Outgoing channel is full, dropping error packet")
+	}
+	t.deliver(pc, newErrorPacket())
+	t.sendControlPacket(newErrorPacket())
+}
+
+// sendUnknownConnError tells the agent the conn_id is unknown, at most once per unknownConnErrorInterval for each
+// conn_id, so that the packets in flight for a closed packet connection don't each get an ERROR
+func (t *Tunnel) sendUnknownConnError(connID int64, errorMessage string) {
+	now := time.Now()
+	t.unknownConnErrorsMu.Lock()
+	if t.unknownConnErrors == nil {
+		t.unknownConnErrors = make(map[int64]time.Time)
+	}
+	if sent, ok := t.unknownConnErrors[connID]; ok && now.Sub(sent) < unknownConnErrorInterval {
+		t.unknownConnErrorsMu.Unlock()
+		logger.V(5).InfoS("Suppressing error for unknown packet connection", "cluster", t.clusterName, "packet_connection_id", connID)
+		unknownConnErrorsSuppressed.WithLabelValues(t.clusterName).Inc()
+		return
+	}
+	if len(t.unknownConnErrors) >= maxUnknownConnErrors {
+		for id, sent := range t.unknownConnErrors {
+			if now.Sub(sent) >= unknownConnErrorInterval {
+				delete(t.unknownConnErrors, id)
+			}
 		}
 	}
+	t.unknownConnErrors[connID] = now
+	t.unknownConnErrorsMu.Unlock()
+
+	t.sendControlPacket(&v1.Packet{
+		ConnId:       connID,
+		Code:         v1.ControlCode_ERROR,
+		ErrorMessage: errorMessage,
+	})
 }
 
-// handleErrorPacket processes an ERROR packet
-func (t *Tunnel) handleErrorPacket(packet *v1.Packet) {
-	t.mu.RLock()
-	pc, exists := t.packetConns[packet.ConnId]
-	t.mu.RUnlock()
+// handleAckPacket drops the DATA packets the agent acknowledged from the replay buffer of the packet connection
+func (t *Tunnel) handleAckPacket(packet *v1.Packet) {
+	pc, exists := t.acquirePacketConn(packet.ConnId)
+	if !exists {
+		return
+	}
+	defer pc.release()
+	if pc.sender == nil {
+		return
+	}
+	if err := pc.sender.Ack(packet.Ack); err != nil {
+		logger.Warningf("Invalid ACK for packet connection %d of cluster %s: %v", packet.ConnId, t.clusterName, err)
+	}
+}
 
+// handleResumePacket processes the RESUME the agent answers the one of sendResumes with, it acknowledges the
+// DATA packets the agent received before the previous tunnel closed
+func (t *Tunnel) handleResumePacket(packet *v1.Packet) {
+	pc, exists := t.acquirePacketConn(packet.ConnId)
 	if exists {
-		// Use a safe send that handles closed channels gracefully
-		t.safeSendToStream(pc, packet)
+		defer pc.release()
+	}
+	if !exists || pc.sender == nil {
+		logger.Warningf("Received RESUME for unknown packet connection %d of cluster %s", packet.ConnId, t.clusterName)
+		t.sendUnknownConnError(packet.ConnId, fmt.Sprintf("cannot resume unknown packet connection %d", packet.ConnId))
+		return
+	}
+	if err := pc.sender.Ack(packet.Ack); err != nil {
+		err = fmt.Errorf("failed to resume connection: %w", err)
+		pc.closeWithError(err)
+		t.sendControlPacket(&v1.Packet{ConnId: packet.ConnId, Code: v1.ControlCode_ERROR, ErrorMessage: err.Error()})
+		packetConnResumes.WithLabelValues(t.clusterName, resumeResultFailed).Inc()
+		return
 	}
+	packetConnResumes.WithLabelValues(t.clusterName, resumeResultResumed).Inc()
+	logger.V(4).InfoS("Resumed packet connection", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connection_id", packet.ConnId,
+		"acknowledged_seq", packet.Ack)
 }
 
-// safeSendToStream safely sends a packet to a packet connection's incoming channel
-func (t *Tunnel) safeSendToStream(pc *packetConnection, packet *v1.Packet) {
-	// Use a defer/recover to handle potential panic from sending to closed channel
-	defer func() {
-		if r := recover(); r != nil {
-			// Channel was closed while we were trying to send
-			klog.V(4).InfoS("Packet dropped due to closed channel", "packet_connection_id", packet.ConnId)
-		}
-	}()
-
-	// Check if the packet connection context is cancelled (connection closed)
-	select {
-	case <-pc.ctx.Done():
-		klog.V(4).InfoS("Dropping packet for closed packet connection", "packet_connection_id", packet.ConnId)
+// handleErrorPacket processes an ERROR packet, an ERROR for an unknown packet connection is ignored and never
+// answered, so that the hub and the agent don't bounce ERRORs for a conn_id both closed
+func (t *Tunnel) handleErrorPacket(packet *v1.Packet) {
+	pc, exists := t.acquirePacketConn(packet.ConnId)
+	if !exists {
+		logger.V(5).InfoS("Ignoring error for unknown packet connection", "cluster", t.clusterName, "packet_connection_id", packet.ConnId,
+			"error", packet.ErrorMessage)
 		return
-	default:
-		// Context is not cancelled, proceed with sending
 	}
+	defer pc.release()
+	if packet.ErrorCode == v1.ErrorCode_INTEGRITY_FAILURE {
+		// The agent received a DATA packet of the packet connection that didn't match its checksum
+		integrityFailures.WithLabelValues(t.clusterName, integrityDirectionToAgent).Inc()
+	}
+	t.deliver(pc, packet)
+}
 
-	// Try to send the packet with a non-blocking send
-	select {
-	case pc.incomingChan <- packet:
-		// Successfully sent
-	case <-pc.ctx.Done():
-		// Stream was closed while we were trying to send
-		klog.V(4).InfoS("Dropping packet for closed packet connection", "packet_connection_id", packet.ConnId)
+// deliver buffers the packet for the packet connection. If the client is too slow to keep up, the packet
+// connection is closed and the agent is told to close its connection to the target service
+func (t *Tunnel) deliver(pc *packetConnection, packet *v1.Packet) {
+	err := pc.deliver(packet)
+	switch {
+	case err == nil:
+	case errors.Is(err, packetqueue.ErrReceiverTooSlow), errors.Is(err, errWriteDeadlineExceeded):
+		logger.Warningf("Closing packet connection %d of cluster %s: %v", packet.ConnId, t.clusterName, err)
+		if packet.Code == v1.ControlCode_ERROR {
+			// The agent already closed its connection, an ERROR is never answered with another
+			return
+		}
+		t.sendControlPacket(&v1.Packet{
+			ConnId:       packet.ConnId,
+			Code:         v1.ControlCode_ERROR,
+			ErrorMessage: err.Error(),
+		})
 	default:
-		// Channel is full, drop the packet
-		klog.V(4).InfoS("Dropping packet for full packet connection", "packet_connection_id", packet.ConnId)
+		// The packet connection was closed concurrently
+		logger.V(4).InfoS("Dropping packet for closed packet connection", "packet_connection_id", packet.ConnId)
 	}
 }
 
@@ -206,7 +577,16 @@ func (t *Tunnel) safeSendToStream(pc *packetConnection, packet *v1.Packet) {
 func (t *Tunnel) NewPacketConn(ctx context.Context) (*packetConnection, error) {
 	// Check if connection is initialized
 	if atomic.LoadInt32(&t.initialized) == 0 {
-		return nil, fmt.Errorf("connection not initialized")
+		return nil, errTunnelNotInitialized
+	}
+
+	if t.drained.Load() {
+		packetConnRejections.WithLabelValues(t.clusterName, rejectReasonDraining).Inc()
+		return nil, ErrTunnelDraining
+	}
+
+	if err := t.waitSlowStart(ctx); err != nil {
+		return nil, err
 	}
 
 	t.mu.Lock()
@@ -216,61 +596,288 @@ func (t *Tunnel) NewPacketConn(ctx context.Context) (*packetConnection, error) {
 		return nil, fmt.Errorf("connection is closed")
 	}
 
+	if t.maxPacketConns > 0 && len(t.packetConns) >= t.maxPacketConns {
+		packetConnRejections.WithLabelValues(t.clusterName, rejectReasonMaxPacketConns).Inc()
+		return nil, fmt.Errorf("%w: %d open connections", ErrTooManyPacketConns, len(t.packetConns))
+	}
+
 	// Generate new packet connection ID
-	packetConnID := atomic.AddInt64(&t.nextPacketConnID, 1)
+	packetConnID, err := t.allocatePacketConnID()
+	if err != nil {
+		return nil, err
+	}
 
 	// Create context with cancel for this packet connection
 	packetCtx, cancel := context.WithCancel(ctx)
 
-	// Create new packet connection
-	packetConn := &packetConnection{
-		id:           packetConnID,
-		ctx:          packetCtx,
-		cancel:       cancel,
-		tunnel:       t,
-		incomingChan: make(chan *v1.Packet, 100),
-		closed:       false,
+	// Create new packet connection, recycled from the ones released by their owner
+	packetConn := pooledPacketConns.get()
+	packetConn.id = packetConnID
+	packetConn.ctx = packetCtx
+	packetConn.cancel = cancel
+	packetConn.tunnel = t
+	if packetConn.incoming == nil {
+		packetConn.incoming = packetqueue.New(t.maxBufferedBytes)
+	} else {
+		packetConn.incoming.Reset(t.maxBufferedBytes)
+	}
+	// The references of the caller and of the tunnel
+	packetConn.refs.Store(2)
+	packetConn.pooled = true
+	if t.resumable {
+		packetConn.sender = resume.NewSender(t.resumeMaxBytes)
+		packetConn.receiver = resume.NewReceiver()
 	}
-
-	// Note: We don't close the incomingChan here to avoid data races.
-	// The channel will be garbage collected when the packetConnection is no longer referenced.
-	// The context cancellation is sufficient to signal that the connection is closed.
 
 	// Register packet connection
 	t.packetConns[packetConnID] = packetConn
 
-	klog.V(4).InfoS("Created new packet connection", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connection_id", packetConnID)
+	logger.V(4).InfoS("Created new packet connection", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connection_id", packetConnID)
 
 	return packetConn, nil
 }
 
+// startSlowStart caps the rate of new packet connections at limit for the window, the cap is lifted afterwards
+func (t *Tunnel) startSlowStart(window time.Duration, limit rate.Limit, burst int) {
+	t.slowStart = rate.NewLimiter(limit, burst)
+	t.slowStartUntil = t.createdAt.Add(window)
+	tunnelSlowStartRate.WithLabelValues(t.clusterName).Set(float64(limit))
+
+	t.slowStartTimer = time.AfterFunc(time.Until(t.slowStartUntil), func() {
+		// Hold the lock so a closed tunnel doesn't set the gauge of the cluster again
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		if !t.closed {
+			tunnelSlowStartRate.WithLabelValues(t.clusterName).Set(0)
+			logger.V(2).InfoS("Tunnel slow start finished", "cluster", t.clusterName, "tunnel_id", t.id)
+		}
+	})
+}
+
+// waitSlowStart queues a new packet connection during the slow start window until the rate allows it,
+// it fails with ErrSlowStart if that takes longer than maxSlowStartWait
+func (t *Tunnel) waitSlowStart(ctx context.Context) error {
+	if t.slowStart == nil {
+		return nil
+	}
+	remaining := time.Until(t.slowStartUntil)
+	if remaining <= 0 {
+		return nil
+	}
+
+	r := t.slowStart.Reserve()
+	delay := r.Delay()
+	if delay > remaining {
+		// The cap is lifted before the reservation is due
+		r.Cancel()
+		delay = remaining
+	}
+	if delay > maxSlowStartWait {
+		r.Cancel()
+		packetConnRejections.WithLabelValues(t.clusterName, rejectReasonSlowStart).Inc()
+		return fmt.Errorf("%w: %v remaining", ErrSlowStart, remaining.Round(time.Millisecond))
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// allocatePacketConnID returns the next free packet connection ID, the caller must hold t.mu.
+// IDs wrap around to 1 on overflow, controlPacketConnID is never allocated.
+func (t *Tunnel) allocatePacketConnID() (int64, error) {
+	if t.firstPacketConnID == 0 {
+		t.firstPacketConnID = t.nextPacketConnID + 1
+	}
+
+	// At most len(t.packetConns) IDs are in use, so probing one more than that always finds a free ID
+	for i := 0; i <= len(t.packetConns); i++ {
+		if t.nextPacketConnID == math.MaxInt64 {
+			logger.InfoS("Packet connection IDs wrapped around", "cluster", t.clusterName, "tunnel_id", t.id)
+			t.nextPacketConnID = controlPacketConnID
+			t.packetConnIDWrapped = true
+		}
+		t.nextPacketConnID++
+
+		if _, inUse := t.packetConns[t.nextPacketConnID]; !inUse {
+			return t.nextPacketConnID, nil
+		}
+	}
+	return 0, fmt.Errorf("no free packet connection ID")
+}
+
+// isAllocatedPacketConnID returns true if the packet connection ID was allocated by this tunnel
+func (t *Tunnel) isAllocatedPacketConnID(packetConnID int64) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if packetConnID <= controlPacketConnID || t.firstPacketConnID == 0 {
+		return false
+	}
+	if t.packetConnIDWrapped {
+		return true
+	}
+	return packetConnID >= t.firstPacketConnID && packetConnID <= t.nextPacketConnID
+}
+
+// AdoptConnections moves the open packet connections of the old tunnel of the same cluster to this tunnel,
+// so that their traffic continues on the new stream once the agent has reconnected. Packets queued on the
+// old tunnel but not sent yet are lost. The old tunnel is left without packet connections and can be closed.
+func (t *Tunnel) AdoptConnections(old *Tunnel) {
+	old.mu.Lock()
+	packetConns := old.packetConns
+	old.packetConns = make(map[int64]*packetConnection)
+	firstPacketConnID, nextPacketConnID, wrapped := old.firstPacketConnID, old.nextPacketConnID, old.packetConnIDWrapped
+	old.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.packetConns == nil {
+		t.packetConns = make(map[int64]*packetConnection)
+	}
+	// Continue the packet connection IDs of the old tunnel, so the adopted IDs are known as allocated
+	// and new IDs don't collide with them
+	if firstPacketConnID != 0 {
+		t.firstPacketConnID = firstPacketConnID
+		t.nextPacketConnID = nextPacketConnID
+		t.packetConnIDWrapped = wrapped
+	}
+	for id, pc := range packetConns {
+		pc.setTunnel(t)
+		t.packetConns[id] = pc
+	}
+
+	logger.InfoS("Adopted packet connections from previous tunnel", "cluster", t.clusterName, "tunnel_id", t.id,
+		"previous_tunnel_id", old.id, "packet_connections", len(packetConns))
+}
+
+// PacketConnStats describes an open packet connection of a tunnel
+type PacketConnStats struct {
+	ID int64 `json:"id"`
+	// BufferedBytes is the data from the agent buffered until the client reads it
+	BufferedBytes int `json:"buffered_bytes"`
+	// UnackedBytes is the data sent to the agent kept until it acknowledges it, only when the tunnel resumes
+	// packet connections
+	UnackedBytes int `json:"unacked_bytes,omitempty"`
+}
+
+// PacketConnStats returns the stats of the open packet connections sorted by ID
+func (t *Tunnel) PacketConnStats() []PacketConnStats {
+	t.mu.RLock()
+	packetConns := make([]*packetConnection, 0, len(t.packetConns))
+	for _, pc := range t.packetConns {
+		pc.acquire()
+		packetConns = append(packetConns, pc)
+	}
+	t.mu.RUnlock()
+
+	stats := make([]PacketConnStats, 0, len(packetConns))
+	for _, pc := range packetConns {
+		stats = append(stats, PacketConnStats{ID: pc.ID(), BufferedBytes: pc.BufferedBytes(), UnackedBytes: pc.UnackedBytes()})
+		pc.release()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+// packetConnCount returns the number of open packet connections
+func (t *Tunnel) packetConnCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.packetConns)
+}
+
+// waitForIdleInterval is how often WaitForIdle checks the packet connections of the tunnel
+const waitForIdleInterval = 500 * time.Millisecond
+
+// WaitForIdle waits until the tunnel has no packet connection, e.g. to drain it before upgrading the hub. It doesn't
+// stop new requests, put the cluster under maintenance for that. It fails with the error of ctx, wrapped with the
+// number of packet connections still open
+func (t *Tunnel) WaitForIdle(ctx context.Context) error {
+	ticker := time.NewTicker(waitForIdleInterval)
+	defer ticker.Stop()
+	for {
+		n := t.packetConnCount()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d packet connections still open: %w", n, ctx.Err())
+		}
+	}
+}
+
 // removePacketConn removes a packet connection from this tunnel
-func (t *Tunnel) removePacketConn(packetConnID int64) {
+func (t *Tunnel) removePacketConn(pc *packetConnection) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	delete(t.packetConns, packetConnID)
-	klog.V(4).InfoS("Removed packet connection", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connection_id", packetConnID)
+	// The packet connection was removed already if the tunnel closed its packet connections, its ID may be reused
+	if t.packetConns[pc.id] != pc {
+		return
+	}
+	delete(t.packetConns, pc.id)
+	logger.V(4).InfoS("Removed packet connection", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connection_id", pc.id)
+	pc.release()
+}
+
+// acquirePacketConn looks the packet connection up with a reference, the caller must release it
+func (t *Tunnel) acquirePacketConn(packetConnID int64) (*packetConnection, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	pc, exists := t.packetConns[packetConnID]
+	if exists {
+		pc.acquire()
+	}
+	return pc, exists
 }
 
-// sendPacket sends a packet through this connection
+// sendPacket sends a packet through this connection without blocking, it fails with errTunnelUnavailable
+// if the tunnel is not serving yet or closed
 func (t *Tunnel) sendPacket(packet *v1.Packet) error {
+	return t.sendPacketAs(packet, qos.Interactive)
+}
+
+// sendPacketAs queues the packet of the class for handleOutgoing without blocking, the packets of the bulk class
+// are queued on bulkChan if QoS is enabled
+func (t *Tunnel) sendPacketAs(packet *v1.Packet, class qos.Class) error {
 	// Check if connection is initialized
 	if atomic.LoadInt32(&t.initialized) == 0 {
-		return fmt.Errorf("connection not initialized")
+		return fmt.Errorf("%w: connection not initialized", errTunnelUnavailable)
 	}
 
-	// Use read lock to safely access outgoingChan
+	// Hold the read lock so that Close can't close the outgoing channel concurrently
 	t.mu.RLock()
-	outgoingChan := t.outgoingChan
-	t.mu.RUnlock()
+	defer t.mu.RUnlock()
 
-	if outgoingChan == nil {
-		return fmt.Errorf("connection not ready")
+	if t.closed {
+		return fmt.Errorf("%w: connection is closed", errTunnelUnavailable)
+	}
+	if t.outgoingChan == nil {
+		return fmt.Errorf("%w: connection not ready", errTunnelUnavailable)
+	}
+	outgoing := t.outgoingChan
+	if class == qos.Bulk && t.bulkChan != nil {
+		outgoing = t.bulkChan
 	}
 
 	select {
-	case outgoingChan <- packet:
+	case outgoing <- packet:
 		return nil
 	case <-t.ctx.Done():
 		return t.ctx.Err()
@@ -279,27 +886,131 @@ func (t *Tunnel) sendPacket(packet *v1.Packet) error {
 	}
 }
 
+// interactiveIdle returns whether no packet is queued on outgoingChan, a packet connection only turns bulk then
+func (t *Tunnel) interactiveIdle() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.outgoingChan) == 0
+}
+
+// Disconnect sends a DRAIN with the reason to the agent and closes the tunnel, the packet connections
+// fail with the reason. The agent reconnects with a new tunnel.
+func (t *Tunnel) Disconnect(reason string) {
+	logger.InfoS("Disconnecting tunnel", "cluster", t.clusterName, "tunnel_id", t.id, "reason", reason)
+	// The DRAIN is queued before the outgoing channel is closed, so it's still sent to the agent
+	t.sendControlPacket(&v1.Packet{ConnId: controlPacketConnID, Code: v1.ControlCode_DRAIN, ErrorMessage: reason})
+	t.close(fmt.Errorf("tunnel disconnected by hub: %s", reason), true)
+}
+
+// Closed returns whether the tunnel is closed, no packet can be sent on it anymore
+func (t *Tunnel) Closed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.closed
+}
+
+// waitServed waits up to timeout for Serve to return, it returns false on timeout. It returns at once if the
+// tunnel is not served
+func (t *Tunnel) waitServed(timeout time.Duration) bool {
+	if t.serveDone == nil || !t.served.Load() {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.serveDone:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 // Close closes the connection
 func (t *Tunnel) Close() {
+	t.close(fmt.Errorf("connection closed"), true)
+}
+
+// close closes the connection, the packet connections are closed with the error unless they're kept for
+// the next tunnel of the agent to resume them
+func (t *Tunnel) close(err error, closePacketConns bool) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
 
 	if t.closed {
+		t.mu.Unlock()
+		if closePacketConns {
+			// The packet connections may have been kept when the tunnel closed
+			t.closePacketConns(err)
+		}
 		return
 	}
 
 	t.closed = true
+	t.closedAt = time.Now()
 
-	// Close all packet connections
-	for _, packetConn := range t.packetConns {
-		packetConn.closeWithError(fmt.Errorf("connection closed"))
+	var packetConns map[int64]*packetConnection
+	if closePacketConns {
+		packetConns = t.packetConns
+		t.packetConns = make(map[int64]*packetConnection)
 	}
-	t.packetConns = make(map[int64]*packetConnection)
 
 	// Close outgoing channel
 	if t.outgoingChan != nil {
 		close(t.outgoingChan)
 	}
+	if t.bulkChan != nil {
+		close(t.bulkChan)
+	}
+
+	t.mu.Unlock()
+
+	// The next tunnel of the cluster sets the gauges again with its first PONG and when it's registered
+	tunnelRTT.DeleteLabelValues(t.clusterName)
+	if t.slowStartTimer != nil {
+		t.slowStartTimer.Stop()
+	}
+	tunnelSlowStartRate.DeleteLabelValues(t.clusterName)
+	tunnelMaxPacketConns.DeleteLabelValues(t.clusterName)
+
+	// Close all packet connections outside the lock, closing a packet connection
+	// removes it from the tunnel which acquires the lock again
+	for _, packetConn := range packetConns {
+		packetConn.closeWithError(err)
+		packetConn.release()
+	}
+
+	logger.InfoS("Closed tunnel", "cluster", t.clusterName, "tunnel_id", t.id)
+}
+
+// closeKeepAliveConns closes the packet connections of the client connections kept alive across requests, and the
+// agent's connections to the target services, it returns how many were closed
+func (t *Tunnel) closeKeepAliveConns() int {
+	t.mu.RLock()
+	var packetConns []*packetConnection
+	for _, pc := range t.packetConns {
+		if pc.isKeepAlive() {
+			pc.acquire()
+			packetConns = append(packetConns, pc)
+		}
+	}
+	t.mu.RUnlock()
 
-	klog.InfoS("Closed tunnel", "cluster", t.clusterName, "tunnel_id", t.id)
+	for _, pc := range packetConns {
+		closeClientDisconnected(pc)
+		pc.release()
+	}
+	return len(packetConns)
+}
+
+// closePacketConns closes the packet connections of the tunnel with the error and returns how many were closed
+func (t *Tunnel) closePacketConns(err error) int {
+	t.mu.Lock()
+	packetConns := t.packetConns
+	t.packetConns = make(map[int64]*packetConnection)
+	t.mu.Unlock()
+
+	for _, packetConn := range packetConns {
+		packetConn.closeWithError(err)
+		packetConn.release()
+	}
+	return len(packetConns)
 }
@@ -0,0 +1,739 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/packetqueue"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestTunnel(nextPacketConnID int64) *Tunnel {
+	return &Tunnel{
+		id:               "test-tunnel",
+		clusterName:      "test-cluster",
+		ctx:              context.Background(),
+		packetConns:      make(map[int64]*packetConnection),
+		outgoingChan:     make(chan *v1.Packet, 10),
+		initialized:      1,
+		nextPacketConnID: nextPacketConnID,
+	}
+}
+
+func TestRejectNeverAllocatedPacketConnID(t *testing.T) {
+	tun := newTestTunnel(100)
+
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if pc.ID() != 101 {
+		t.Fatalf("expected packet connection ID 101, got %d", pc.ID())
+	}
+	pc.Close(nil)
+
+	cases := []struct {
+		name          string
+		connID        int64
+		expectMessage string
+	}{
+		{name: "stale", connID: 101, expectMessage: "unknown packet connection 101"},
+		{name: "below offset", connID: 50, expectMessage: "packet connection 50 was never allocated"},
+		{name: "not allocated yet", connID: 102, expectMessage: "packet connection 102 was never allocated"},
+		{name: "negative", connID: -1, expectMessage: "packet connection -1 was never allocated"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tun.handleDataPacket(&v1.Packet{ConnId: c.connID, Code: v1.ControlCode_DATA})
+
+			select {
+			case packet := <-tun.outgoingChan:
+				if packet.Code != v1.ControlCode_ERROR || packet.ConnId != c.connID {
+					t.Fatalf("unexpected packet: %v", packet)
+				}
+				if !strings.Contains(packet.ErrorMessage, c.expectMessage) {
+					t.Errorf("expected error message %q, got %q", c.expectMessage, packet.ErrorMessage)
+				}
+			default:
+				t.Fatalf("expected an error packet")
+			}
+		})
+	}
+}
+
+func TestUnknownPacketConnErrorsLimited(t *testing.T) {
+	tun := newTestTunnel(100)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	pc.Close(nil)
+
+	suppressed := func() float64 {
+		metric := &dto.Metric{}
+		if err := unknownConnErrorsSuppressed.WithLabelValues(tun.clusterName).Write(metric); err != nil {
+			t.Fatalf("failed to read the counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := suppressed()
+
+	// The agent keeps sending the data in flight for the closed packet connection, then its own ERROR
+	for i := 0; i < 5; i++ {
+		tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("stale")})
+	}
+	tun.handleErrorPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_ERROR, ErrorMessage: "Connection failed: EOF"})
+
+	if len(tun.outgoingChan) != 1 {
+		t.Fatalf("expected exactly one error packet, got %d packets", len(tun.outgoingChan))
+	}
+	if packet := <-tun.outgoingChan; packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() {
+		t.Errorf("unexpected packet: %v", packet)
+	}
+	if got := suppressed() - before; got != 4 {
+		t.Errorf("expected 4 suppressed errors, got %v", got)
+	}
+
+	// Another unknown conn_id still gets its error
+	tun.handleDataPacket(&v1.Packet{ConnId: 50, Code: v1.ControlCode_DATA})
+	if len(tun.outgoingChan) != 1 {
+		t.Errorf("expected an error packet for another conn_id, got %d packets", len(tun.outgoingChan))
+	}
+}
+
+func TestPacketConnIDWrapAround(t *testing.T) {
+	tun := newTestTunnel(math.MaxInt64 - 1)
+
+	pc1, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if pc1.ID() != math.MaxInt64 {
+		t.Fatalf("expected packet connection ID %d, got %d", int64(math.MaxInt64), pc1.ID())
+	}
+
+	pc2, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if pc2.ID() == controlPacketConnID {
+		t.Fatalf("control conn_id must never be allocated")
+	}
+	if pc2.ID() != 1 {
+		t.Fatalf("expected packet connection ID to wrap around to 1, got %d", pc2.ID())
+	}
+	if !tun.isAllocatedPacketConnID(42) {
+		t.Errorf("expected any positive ID to be considered allocated after wrap around")
+	}
+}
+
+func TestAdoptConnections(t *testing.T) {
+	old := newTestTunnel(100)
+	pc, err := old.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+
+	tun := newTestTunnel(5000)
+	tun.id = "new-tunnel"
+	tun.AdoptConnections(old)
+	old.Close()
+
+	if pc.Context().Err() != nil {
+		t.Fatalf("expected the adopted packet connection to stay open")
+	}
+
+	// Packets from the agent on the new tunnel reach the adopted packet connection
+	tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("data")})
+	if pc.incoming.Len() != 1 {
+		t.Fatalf("expected the packet to be delivered to the adopted packet connection")
+	}
+	if packet, err := pc.Recv(); err != nil || string(packet.Data) != "data" {
+		t.Errorf("unexpected packet: %v, %v", packet, err)
+	}
+
+	// Packets to the agent go through the new tunnel
+	if err := pc.Send(&v1.Packet{Code: v1.ControlCode_DATA}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	select {
+	case packet := <-tun.outgoingChan:
+		if packet.ConnId != pc.ID() {
+			t.Errorf("unexpected packet: %v", packet)
+		}
+	default:
+		t.Fatalf("expected the packet to be sent on the new tunnel")
+	}
+
+	// New packet connection IDs continue after the adopted ones
+	next, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if next.ID() != pc.ID()+1 {
+		t.Errorf("expected packet connection ID %d, got %d", pc.ID()+1, next.ID())
+	}
+
+	pc.Close(nil)
+	if _, exists := tun.packetConns[pc.ID()]; exists {
+		t.Errorf("expected the closed packet connection to be removed from the new tunnel")
+	}
+}
+
+func TestRecyclePacketConn(t *testing.T) {
+	tun := newTestTunnel(100)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	// The read timer and a packet handler hold references too
+	pc.SetReadDeadline(time.Now().Add(time.Hour))
+	looked, exists := tun.acquirePacketConn(pc.ID())
+	if !exists || looked != pc {
+		t.Fatalf("expected to look the packet connection up")
+	}
+	if refs := pc.refs.Load(); refs != 4 {
+		t.Fatalf("expected 4 references, got %d", refs)
+	}
+
+	// Closing stops the timer and removes the packet connection from the tunnel, the handler still uses it
+	pc.Close(nil)
+	pc.release()
+	if refs := pc.refs.Load(); refs != 1 || pc.ID() != 101 {
+		t.Fatalf("expected the packet connection to be kept for the handler, got %d references and ID %d", refs, pc.ID())
+	}
+	looked.release()
+	if pc.ID() != 0 || pc.tunnel != nil || pc.closed {
+		t.Fatalf("expected the packet connection to be reset once released, got ID %d", pc.ID())
+	}
+
+	// A packet connection whose ID is reused isn't removed by the one closed before
+	stale, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	tun.closePacketConns(errors.New("closed"))
+	tun.nextPacketConnID = stale.ID() - 1
+	next, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	defer next.Close(nil)
+	if next.ID() != stale.ID() {
+		t.Fatalf("expected the ID %d to be reused, got %d", stale.ID(), next.ID())
+	}
+	stale.Close(nil)
+	if tun.packetConns[next.ID()] != next {
+		t.Fatalf("expected the packet connection reusing the ID to stay registered")
+	}
+
+	// The buffer of a recycled packet connection is empty and open
+	tun.handleDataPacket(&v1.Packet{ConnId: next.ID(), Code: v1.ControlCode_DATA, Data: []byte("data")})
+	packet, err := next.Recv()
+	if err != nil || string(packet.Data) != "data" {
+		t.Fatalf("expected the packet from the agent, got %v, %v", packet, err)
+	}
+}
+
+func TestDropOutOfOrderPackets(t *testing.T) {
+	tun := newTestTunnel(100)
+	tun.resumable = true
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	defer pc.Close(nil)
+
+	// The duplicate and the packet after the gap are dropped, the gap is filled when the connection is resumed
+	for _, p := range []struct {
+		seq  int64
+		data string
+	}{{1, "a"}, {1, "a"}, {3, "c"}, {2, "b"}, {2, "b"}} {
+		tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte(p.data), Seq: p.seq})
+	}
+	if pc.incoming.Len() != 2 {
+		t.Fatalf("expected 2 packets delivered, got %d", pc.incoming.Len())
+	}
+	for _, expected := range []string{"a", "b"} {
+		if packet, err := pc.Recv(); err != nil || string(packet.Data) != expected {
+			t.Errorf("expected %q, got %v, %v", expected, packet, err)
+		}
+	}
+}
+
+// TestDropDuplicatePackets checks the packets of a tunnel not resuming its packet connections are numbered by their
+// SeqNum in both directions, and the ones from the agent received twice or after a later one are dropped
+func TestDropDuplicatePackets(t *testing.T) {
+	tun := newTestTunnel(100)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	defer pc.Close(nil)
+
+	// The packets without a SeqNum, e.g. from an agent not numbering them, are delivered
+	for _, p := range []struct {
+		seqNum int64
+		data   string
+	}{{1, "a"}, {1, "a"}, {3, "c"}, {2, "b"}, {0, "z"}} {
+		tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte(p.data), SeqNum: p.seqNum})
+	}
+	if pc.incoming.Len() != 3 {
+		t.Fatalf("expected 3 packets delivered, got %d", pc.incoming.Len())
+	}
+	for _, expected := range []string{"a", "c", "z"} {
+		if packet, err := pc.Recv(); err != nil || string(packet.Data) != expected {
+			t.Errorf("expected %q, got %v, %v", expected, packet, err)
+		}
+	}
+
+	for _, expected := range []int64{1, 2} {
+		if err := pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: []byte("data")}); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if packet := <-tun.outgoingChan; packet.SeqNum != expected {
+			t.Errorf("expected SeqNum %d, got %v", expected, packet)
+		}
+	}
+}
+
+func TestMaxPacketConns(t *testing.T) {
+	tun := newTestTunnel(0)
+	tun.maxPacketConns = 2
+
+	pc1, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if _, err := tun.NewPacketConn(context.Background()); err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	if _, err := tun.NewPacketConn(context.Background()); !errors.Is(err, ErrTooManyPacketConns) {
+		t.Fatalf("expected ErrTooManyPacketConns, got %v", err)
+	}
+
+	// Closing a packet connection makes room for a new one
+	pc1.Close(nil)
+	if _, err := tun.NewPacketConn(context.Background()); err != nil {
+		t.Fatalf("failed to create packet connection after close: %v", err)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	cases := []struct {
+		name          string
+		window        time.Duration
+		limit         rate.Limit
+		burst         int
+		requests      int
+		expectCreated int
+	}{
+		// 1 immediately, then 1 every 500ms within the 1s wait
+		{name: "queued then rejected", window: time.Minute, limit: 2, burst: 1, requests: 5, expectCreated: 3},
+		{name: "burst", window: time.Minute, limit: 0.1, burst: 3, requests: 5, expectCreated: 3},
+		// The cap is lifted before the reservations are due
+		{name: "window ends", window: 300 * time.Millisecond, limit: 0.1, burst: 1, requests: 5, expectCreated: 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tun := newTestTunnel(0)
+			tun.createdAt = time.Now()
+			tun.startSlowStart(c.window, c.limit, c.burst)
+			defer tun.Close()
+
+			// Send the requests as a burst, like the backlog after a reconnect
+			errs := make(chan error, c.requests)
+			for i := 0; i < c.requests; i++ {
+				go func() {
+					_, err := tun.NewPacketConn(context.Background())
+					errs <- err
+				}()
+			}
+			created := 0
+			for i := 0; i < c.requests; i++ {
+				err := <-errs
+				switch {
+				case err == nil:
+					created++
+				case !errors.Is(err, ErrSlowStart):
+					t.Fatalf("expected ErrSlowStart, got %v", err)
+				}
+			}
+			if created != c.expectCreated {
+				t.Errorf("expected %d packet connections, got %d", c.expectCreated, created)
+			}
+		})
+	}
+}
+
+func TestSlowReceiverClosed(t *testing.T) {
+	const maxBufferedBytes = 64 * 1024
+	tun := newTestTunnel(0)
+	tun.maxBufferedBytes = maxBufferedBytes
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+
+	// The client never reads, the agent keeps sending 32KB packets
+	for range 10 {
+		tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: make([]byte, 32*1024)})
+		if buffered := pc.BufferedBytes(); buffered > maxBufferedBytes {
+			t.Fatalf("expected at most %d bytes buffered, got %d", maxBufferedBytes, buffered)
+		}
+	}
+
+	if !errors.Is(pc.Err(), packetqueue.ErrReceiverTooSlow) {
+		t.Fatalf("expected the packet connection to be closed with ErrReceiverTooSlow, got %v", pc.Err())
+	}
+	if pc.BufferedBytes() != 0 {
+		t.Errorf("expected the buffered packets to be released, got %d bytes", pc.BufferedBytes())
+	}
+	if len(tun.PacketConnStats()) != 0 {
+		t.Errorf("expected the packet connection to be removed from the tunnel")
+	}
+
+	// The agent is told to close its connection to the target service
+	select {
+	case packet := <-tun.outgoingChan:
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() || !strings.Contains(packet.ErrorMessage, "receiver too slow") {
+			t.Errorf("unexpected packet to agent: %v", packet)
+		}
+	default:
+		t.Fatalf("expected an error packet to agent")
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	const maxBufferedBytes = 64 * 1024
+	sendPackets := func(tun *Tunnel, pc *packetConnection) {
+		for i := range 10 {
+			data := make([]byte, 32*1024)
+			data[0] = byte(i)
+			tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: data})
+		}
+	}
+
+	t.Run("client catches up", func(t *testing.T) {
+		tun := newTestTunnel(0)
+		tun.maxBufferedBytes = maxBufferedBytes
+		pc, err := tun.NewPacketConn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+		pc.SetWriteDeadline(time.Now().Add(time.Second))
+
+		// The packets over the budget are held for the client until the deadline
+		sendPackets(tun, pc)
+		if pc.Err() != nil {
+			t.Fatalf("expected the packet connection to stay open, got %v", pc.Err())
+		}
+		if buffered := pc.BufferedBytes(); buffered != 10*32*1024 {
+			t.Errorf("expected %d bytes buffered, got %d", 10*32*1024, buffered)
+		}
+
+		for i := range 10 {
+			packet, err := pc.Recv()
+			if err != nil {
+				t.Fatalf("failed to receive packet %d: %v", i, err)
+			}
+			if packet.Data[0] != byte(i) {
+				t.Fatalf("expected packet %d, got packet %d", i, packet.Data[0])
+			}
+		}
+		time.Sleep(1500 * time.Millisecond)
+		if pc.Err() != nil {
+			t.Errorf("expected the packet connection to stay open, got %v", pc.Err())
+		}
+		select {
+		case packet := <-tun.outgoingChan:
+			t.Errorf("unexpected packet to agent: %v", packet)
+		default:
+		}
+	})
+
+	t.Run("deadline passes", func(t *testing.T) {
+		tun := newTestTunnel(0)
+		tun.maxBufferedBytes = maxBufferedBytes
+		pc, err := tun.NewPacketConn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+		pc.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+
+		// The client never reads
+		sendPackets(tun, pc)
+		select {
+		case <-pc.Context().Done():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected the packet connection to be closed at the deadline")
+		}
+		if status.Code(pc.Err()) != codes.DeadlineExceeded {
+			t.Fatalf("expected the packet connection to be closed with DeadlineExceeded, got %v", pc.Err())
+		}
+		if pc.BufferedBytes() != 0 {
+			t.Errorf("expected the buffered packets to be released, got %d bytes", pc.BufferedBytes())
+		}
+
+		// The agent is told to close its connection to the target service
+		select {
+		case packet := <-tun.outgoingChan:
+			if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() {
+				t.Errorf("unexpected packet to agent: %v", packet)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected an error packet to agent")
+		}
+	})
+}
+
+func TestReadDeadline(t *testing.T) {
+	t.Run("deadline passes", func(t *testing.T) {
+		tun := newTestTunnel(0)
+		pc, err := tun.NewPacketConn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+		pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("partial")})
+
+		// The data received before the deadline is read first, then the ERROR of the deadline
+		packet, err := pc.Recv()
+		if err != nil || string(packet.Data) != "partial" {
+			t.Fatalf("expected the data received before the deadline, got %v: %v", packet, err)
+		}
+		packet, err = pc.Recv()
+		if err != nil || packet.Code != v1.ControlCode_ERROR || packet.ErrorMessage != readDeadlineExceededMessage {
+			t.Fatalf("expected the error of the read deadline, got %v: %v", packet, err)
+		}
+		if !pc.readDeadlineExceeded() {
+			t.Errorf("expected the read deadline to be exceeded")
+		}
+
+		// The agent is told to close its connection to the target service
+		select {
+		case packet := <-tun.outgoingChan:
+			if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() {
+				t.Errorf("unexpected packet to agent: %v", packet)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected an error packet to agent")
+		}
+	})
+
+	t.Run("deadline extended or cleared", func(t *testing.T) {
+		tun := newTestTunnel(0)
+		pc, err := tun.NewPacketConn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+		pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		pc.SetReadDeadline(time.Now().Add(time.Hour))
+		other, err := tun.NewPacketConn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+		other.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		other.SetReadDeadline(time.Time{})
+
+		time.Sleep(200 * time.Millisecond)
+		if pc.readDeadlineExceeded() || other.readDeadlineExceeded() || pc.incoming.Len() != 0 || other.incoming.Len() != 0 {
+			t.Errorf("expected the read deadlines not to pass")
+		}
+		select {
+		case packet := <-tun.outgoingChan:
+			t.Errorf("unexpected packet to agent: %v", packet)
+		default:
+		}
+	})
+}
+
+func TestPacketConnStats(t *testing.T) {
+	tun := newTestTunnel(0)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("data")})
+
+	stats := tun.PacketConnStats()
+	if len(stats) != 1 || stats[0].ID != pc.ID() || stats[0].BufferedBytes != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if _, err := pc.Recv(); err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if stats := tun.PacketConnStats(); stats[0].BufferedBytes != 0 {
+		t.Errorf("expected no bytes buffered once received, got %d", stats[0].BufferedBytes)
+	}
+}
+
+func TestServeOnce(t *testing.T) {
+	tun := newTestTunnel(0)
+	outgoingChan := tun.outgoingChan
+	tun.served.Store(true)
+
+	// A second Serve would start another sender on the stream
+	if err := tun.Serve(); !errors.Is(err, errTunnelServed) {
+		t.Fatalf("expected errTunnelServed, got %v", err)
+	}
+	if tun.outgoingChan != outgoingChan {
+		t.Errorf("expected the outgoing channel to be kept")
+	}
+}
+
+func TestServeClosedTunnel(t *testing.T) {
+	tun := newTestTunnel(0)
+	tun.serveDone = make(chan struct{})
+	tun.Close()
+
+	// The tunnel was replaced before it's served, the agent reconnects
+	if err := tun.Serve(); !errors.Is(err, errTunnelClosed) {
+		t.Fatalf("expected errTunnelClosed, got %v", err)
+	}
+	if !tun.waitServed(time.Second) {
+		t.Errorf("expected Serve to be done")
+	}
+}
+
+func TestDrainedTunnelRejectsPacketConns(t *testing.T) {
+	tun := newTestTunnel(0)
+	if _, err := tun.NewPacketConn(context.Background()); err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+
+	// The in-flight packet connections are kept until the agent closes the tunnel
+	tun.drained.Store(true)
+	if _, err := tun.NewPacketConn(context.Background()); !errors.Is(err, ErrTunnelDraining) {
+		t.Fatalf("expected ErrTunnelDraining, got %v", err)
+	}
+	if stats := tun.PacketConnStats(); len(stats) != 1 {
+		t.Errorf("expected the in-flight packet connection to be kept, got %d", len(stats))
+	}
+}
+
+func TestBulkPacketConnQueued(t *testing.T) {
+	tun := newTestTunnel(0)
+	tun.qos = &qos.Config{BulkThreshold: 10}
+	tun.bulkChan = make(chan *v1.Packet, 10)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	pc.classifier = tun.qos.NewConn("/api/v1/namespaces/default/pods/nginx/log")
+
+	if err := pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: make([]byte, 8)}); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+	if len(tun.outgoingChan) != 1 {
+		t.Fatalf("expected the packet under the threshold to be interactive, got %d interactive packets", len(tun.outgoingChan))
+	}
+
+	// The packet connection turns bulk once its interactive packet is sent
+	sent := make(chan error, 1)
+	go func() {
+		sent <- pc.Send(&v1.Packet{Code: v1.ControlCode_DATA, Data: make([]byte, 8)})
+	}()
+	<-tun.outgoingChan
+	if err := <-sent; err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+	if len(tun.bulkChan) != 1 || len(tun.outgoingChan) != 0 {
+		t.Fatalf("expected the packet over the threshold to be bulk, got %d interactive and %d bulk packets",
+			len(tun.outgoingChan), len(tun.bulkChan))
+	}
+
+	// The control packets stay interactive
+	tun.sendControlPacket(&v1.Packet{ConnId: controlPacketConnID, Code: v1.ControlCode_PING})
+	if len(tun.outgoingChan) != 1 {
+		t.Errorf("expected the control packet to be interactive, got %d interactive packets", len(tun.outgoingChan))
+	}
+}
+
+func TestIntegrityFailure(t *testing.T) {
+	failures := func(direction string) float64 {
+		metric := &dto.Metric{}
+		if err := integrityFailures.WithLabelValues("test-cluster", direction).Write(metric); err != nil {
+			t.Fatalf("failed to read the counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	fromAgent, toAgent := failures(integrityDirectionFromAgent), failures(integrityDirectionToAgent)
+
+	tun := newTestTunnel(0)
+	tun.integrity = true
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+
+	valid := &v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("HTTP/1.1 200 OK\r\n")}
+	valid.SetChecksum()
+	tun.handleDataPacket(valid)
+	if packet, err := pc.Recv(); err != nil || packet.Code != v1.ControlCode_DATA {
+		t.Fatalf("expected the valid packet to be delivered, got %v, %v", packet, err)
+	}
+
+	// A bit flipped after the agent set the checksum
+	corrupted := &v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("Content-Length: 5\r\n")}
+	corrupted.SetChecksum()
+	corrupted.Data[0] ^= 0x01
+	tun.handleDataPacket(corrupted)
+
+	packet, err := pc.Recv()
+	if err != nil || packet.Code != v1.ControlCode_ERROR || packet.ErrorCode != v1.ErrorCode_INTEGRITY_FAILURE {
+		t.Fatalf("expected an INTEGRITY_FAILURE error for the client, got %v, %v", packet, err)
+	}
+	if message := errorPacketMessage(packet); !strings.HasPrefix(message, "INTEGRITY_FAILURE: ") {
+		t.Errorf("expected the message for the client to start with the error code, got %q", message)
+	}
+	select {
+	case packet := <-tun.outgoingChan:
+		if packet.Code != v1.ControlCode_ERROR || packet.ConnId != pc.ID() || packet.ErrorCode != v1.ErrorCode_INTEGRITY_FAILURE {
+			t.Errorf("unexpected packet to agent: %v", packet)
+		}
+	default:
+		t.Fatalf("expected an error packet to agent")
+	}
+	if got := failures(integrityDirectionFromAgent) - fromAgent; got != 1 {
+		t.Errorf("expected 1 failure from the agent, got %v", got)
+	}
+
+	// The agent detected a corrupted packet from the hub
+	pc2, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+	tun.handleErrorPacket(&v1.Packet{ConnId: pc2.ID(), Code: v1.ControlCode_ERROR, ErrorCode: v1.ErrorCode_INTEGRITY_FAILURE,
+		ErrorMessage: "checksum mismatch"})
+	if got := failures(integrityDirectionToAgent) - toAgent; got != 1 {
+		t.Errorf("expected 1 failure to the agent, got %v", got)
+	}
+}
+
+func TestIntegrityDisabled(t *testing.T) {
+	tun := newTestTunnel(0)
+	pc, err := tun.NewPacketConn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create packet connection: %v", err)
+	}
+
+	// Without the negotiated capability the packets carry no checksum and aren't checked
+	tun.handleDataPacket(&v1.Packet{ConnId: pc.ID(), Code: v1.ControlCode_DATA, Data: []byte("data")})
+	if packet, err := pc.Recv(); err != nil || packet.Code != v1.ControlCode_DATA {
+		t.Fatalf("expected the packet to be delivered, got %v, %v", packet, err)
+	}
+	if len(tun.outgoingChan) != 0 {
+		t.Errorf("expected no packet to agent, got %d", len(tun.outgoingChan))
+	}
+}
@@ -2,24 +2,88 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/qos"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/metadata"
 	"k8s.io/klog/v2"
 )
 
+// ErrTunnelNotFound is returned when the cluster has no tunnel
+var ErrTunnelNotFound = errors.New("no tunnel for cluster")
+
+// replacedTunnelServeTimeout bounds the wait of NewTunnel for the Serve of the tunnel it replaces to return
+const replacedTunnelServeTimeout = time.Second
+
+// defaultTunnelReapInterval is the interval of the reaper removing the closed tunnels still registered, see
+// TunnelManager.startReaper
+const defaultTunnelReapInterval = 30 * time.Second
+
 // TunnelManager manages all tunnels from agents
 type TunnelManager struct {
 	mu      sync.RWMutex
 	tunnels map[string]*Tunnel // clusterName -> tunnels
+	// detached are the closed tunnels whose packet connections are kept for the next tunnel of the agent to resume
+	detached map[string]*Tunnel // clusterName -> tunnel
+	// disconnectedAt are the times the last tunnels of the clusters without a tunnel were removed, kept for
+	// lastSeenRetention. A non-positive retention disables them
+	disconnectedAt    map[string]time.Time // clusterName -> time
+	lastSeenRetention time.Duration
+	// maintenance are the clusters under maintenance, they're kept across the tunnels of the clusters
+	maintenance map[string]ClusterMaintenance // clusterName -> maintenance
+	// reapInterval is the interval of the reaper started by startReaper, reapTimer its next run. The reaper stops
+	// once the manager is closed
+	reapInterval time.Duration
+	reapTimer    *time.Timer
+	closed       bool
+
+	// pingInterval is passed to new tunnels to measure the round-trip time to the agents
+	pingInterval time.Duration
+	// handshakeTimeout is passed to new tunnels to close the ones whose agent sends nothing
+	handshakeTimeout time.Duration
+	// connectionMigration moves the packet connections of a replaced tunnel to the new tunnel instead of closing them
+	connectionMigration bool
+	// maxPacketConns caps the open packet connections of each tunnel, 0 means unlimited
+	maxPacketConns int
+	// maxBufferedBytes caps the data from the agent buffered for each packet connection
+	maxBufferedBytes int
+	// slowStartWindow, slowStartRate and slowStartBurst cap the rate of new packet connections of a tunnel
+	// right after it's registered, a zero window disables it
+	slowStartWindow time.Duration
+	slowStartRate   rate.Limit
+	slowStartBurst  int
+	// resumeWindow is how long the packet connections of a closed tunnel are kept for the agent to resume them,
+	// 0 disables resumption
+	resumeWindow time.Duration
+	// resumeMaxBytes caps the data sent on each packet connection kept until the agent acknowledges it
+	resumeMaxBytes int
+	// qos is passed to new tunnels to prioritize their interactive packet connections, nil disables it
+	qos *qos.Config
+	// integrity checks the DATA packets of the new tunnels whose agent checks them too
+	integrity bool
+	// locator is told about the tunnels of the manager once endpoint, the URL of the replica, is set by Run.
+	// nil disables forwarding the requests to other replicas
+	locator  TunnelLocator
+	endpoint string
 }
 
 // NewTunnelManager creates a new tunnel manager
 func NewTunnelManager() *TunnelManager {
 	return &TunnelManager{
-		tunnels: make(map[string]*Tunnel),
+		tunnels:           make(map[string]*Tunnel),
+		detached:          make(map[string]*Tunnel),
+		disconnectedAt:    make(map[string]time.Time),
+		maintenance:       make(map[string]ClusterMaintenance),
+		lastSeenRetention: DefaultTunnelLastSeenRetention,
+		reapInterval:      defaultTunnelReapInterval,
 	}
 }
 
@@ -28,41 +92,208 @@ func (tm *TunnelManager) NewTunnel(ctx context.Context, clusterName string, stre
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	// Check if there's already a tunnel for this cluster
-	if existingTunnel, exists := tm.tunnels[clusterName]; exists {
+	// Create new tunnel
+	t := &Tunnel{
+		id:               generateTunnelID(),
+		clusterName:      clusterName,
+		grpcStream:       stream,
+		ctx:              ctx,
+		createdAt:        time.Now(),
+		nextPacketConnID: randomPacketConnIDOffset(),
+		pingInterval:     tm.pingInterval,
+		handshakeTimeout: tm.handshakeTimeout,
+		maxPacketConns:   tm.maxPacketConns,
+		maxBufferedBytes: tm.maxBufferedBytes,
+		resumable:        tm.resumeWindow > 0 && agentProtocolVersion(ctx) >= v1.ProtocolVersionResume,
+		resumeMaxBytes:   tm.resumeMaxBytes,
+		firstPacket:      agentOpensOnFirstPacket(ctx),
+		agentVersion:     agentVersion(ctx),
+		qos:              tm.qos,
+		integrity:        tm.integrity && agentChecksIntegrity(ctx),
+		serveDone:        make(chan struct{}),
+	}
+
+	// Check if there's already a tunnel for this cluster, another one may be registered while the Serve of the
+	// replaced one returns
+	for {
+		existingTunnel, exists := tm.tunnels[clusterName]
+		if !exists {
+			break
+		}
 		klog.InfoS("Replacing existing tunnel for cluster", "cluster", clusterName, "old_tunnel_id", existingTunnel.ID())
-		// Close the existing tunnel
+		if tm.connectionMigration || (t.resumable && existingTunnel.resumable) {
+			// Keep the in-flight requests of the reconnected agent going on the new tunnel
+			t.AdoptConnections(existingTunnel)
+		}
+		// Close the existing tunnel, and don't register the new one before the existing one stopped serving,
+		// so the tunnel of the cluster is never one that is closed
 		existingTunnel.Close()
+		delete(tm.tunnels, clusterName)
+		tm.mu.Unlock()
+		if !existingTunnel.waitServed(replacedTunnelServeTimeout) {
+			klog.InfoS("Replaced tunnel still serving, registering the new tunnel anyway", "cluster", clusterName,
+				"old_tunnel_id", existingTunnel.ID(), "timeout", replacedTunnelServeTimeout)
+		}
+		tm.mu.Lock()
 	}
 
-	// Create new tunnel
-	t := &Tunnel{
-		id:          generateTunnelID(),
-		clusterName: clusterName,
-		grpcStream:  stream,
-		ctx:         ctx,
-		createdAt:   time.Now(),
+	// Resume the packet connections of the previous tunnel, which was closed before the agent reconnected
+	if detached, exists := tm.detached[clusterName]; exists {
+		delete(tm.detached, clusterName)
+		detached.resumeTimer.Stop()
+		if t.resumable {
+			t.AdoptConnections(detached)
+		} else {
+			n := detached.closePacketConns(errors.New("agent reconnected without resuming its connections"))
+			packetConnResumes.WithLabelValues(clusterName, resumeResultFailed).Add(float64(n))
+		}
+	}
+
+	// Set the caps after the existing tunnel of the cluster is closed, which deletes its gauges
+	if tm.maxPacketConns > 0 {
+		tunnelMaxPacketConns.WithLabelValues(clusterName).Set(float64(tm.maxPacketConns))
+	}
+	if tm.slowStartWindow > 0 {
+		// Don't overwhelm a cold agent with the backlog of requests queued while it was away
+		t.startSlowStart(tm.slowStartWindow, tm.slowStartRate, tm.slowStartBurst)
 	}
 
 	// Store the tunnel
 	tm.tunnels[clusterName] = t
+	delete(tm.disconnectedAt, clusterName)
+	if tm.locator != nil && tm.endpoint != "" {
+		tm.locator.Announce(clusterName, tm.endpoint)
+	}
 
 	klog.InfoS("Created new tunnel for cluster", "cluster", clusterName, "tunnel_id", t.id)
 
 	return t, nil
 }
 
-// GetTunnel returns the tunnel for a specific cluster
+// GetTunnel returns the tunnel for a specific cluster, nil if it has none. A closed tunnel still registered is
+// removed instead of returned, no packet can be sent on it
 func (tm *TunnelManager) GetTunnel(clusterName string) *Tunnel {
 	tm.mu.RLock()
-	defer tm.mu.RUnlock()
-
 	tunnel, exists := tm.tunnels[clusterName]
+	tm.mu.RUnlock()
 	if !exists {
 		return nil
 	}
+	if !tunnel.Closed() {
+		return tunnel
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.tunnels[clusterName] == tunnel {
+		logger.V(4).InfoS("Removing closed tunnel", "cluster", clusterName, "tunnel_id", tunnel.ID())
+		tm.unregister(tunnel)
+	}
+	return nil
+}
+
+// LastSeen returns the time the manager last had a tunnel of the cluster: now if it has one, the time its last
+// tunnel was removed if it's within the retention window. ok is false otherwise
+func (tm *TunnelManager) LastSeen(clusterName string) (lastSeen time.Time, ok bool) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	if t, exists := tm.tunnels[clusterName]; exists {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		if t.closed {
+			return t.closedAt, true
+		}
+		return time.Now(), true
+	}
+	lastSeen, ok = tm.disconnectedAt[clusterName]
+	if !ok || time.Since(lastSeen) > tm.lastSeenRetention {
+		return time.Time{}, false
+	}
+	return lastSeen, true
+}
+
+// recordDisconnect remembers the time the last tunnel of the cluster was removed and forgets the ones older than
+// the retention window. The caller must hold tm.mu
+func (tm *TunnelManager) recordDisconnect(clusterName string, now time.Time) {
+	if tm.lastSeenRetention <= 0 {
+		return
+	}
+	for name, disconnectedAt := range tm.disconnectedAt {
+		if now.Sub(disconnectedAt) > tm.lastSeenRetention {
+			delete(tm.disconnectedAt, name)
+		}
+	}
+	tm.disconnectedAt[clusterName] = now
+}
+
+// setEndpoint sets the URL of the replica and announces the tunnels of the manager to its locator
+func (tm *TunnelManager) setEndpoint(endpoint string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.endpoint = endpoint
+	if tm.locator == nil {
+		return
+	}
+	for clusterName := range tm.tunnels {
+		tm.locator.Announce(clusterName, endpoint)
+	}
+}
+
+// replicaOf returns the URL of the replica and the one of the other replica holding the tunnel of the cluster,
+// ok is false if the manager has no locator or no other replica holds it
+func (tm *TunnelManager) replicaOf(clusterName string) (self, endpoint string, ok bool) {
+	tm.mu.RLock()
+	locator, self := tm.locator, tm.endpoint
+	tm.mu.RUnlock()
+	if locator == nil || self == "" {
+		return "", "", false
+	}
+	endpoint, ok = locator.Lookup(clusterName)
+	if !ok || endpoint == self {
+		return "", "", false
+	}
+	return self, endpoint, true
+}
+
+// TunnelInfo is a snapshot of a tunnel returned by ListTunnels
+type TunnelInfo struct {
+	ClusterName string    `json:"cluster_name"`
+	TunnelID    string    `json:"tunnel_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	// ActiveConnections is the number of open packet connections of the tunnel
+	ActiveConnections int `json:"active_connections"`
+}
 
-	return tunnel
+// ListTunnels returns a snapshot of the tunnels sorted by cluster name
+func (tm *TunnelManager) ListTunnels() []TunnelInfo {
+	tunnels := tm.sortedTunnels()
+	infos := make([]TunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		infos = append(infos, TunnelInfo{
+			ClusterName:       t.ClusterName(),
+			TunnelID:          t.ID(),
+			CreatedAt:         t.CreatedAt(),
+			ActiveConnections: t.packetConnCount(),
+		})
+	}
+	return infos
+}
+
+// sortedTunnels returns all tunnels sorted by cluster name
+func (tm *TunnelManager) sortedTunnels() []*Tunnel {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	tunnels := make([]*Tunnel, 0, len(tm.tunnels))
+	for _, t := range tm.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ClusterName() < tunnels[j].ClusterName()
+	})
+	return tunnels
 }
 
 // RemoveTunnel removes a tunnel for a cluster
@@ -77,26 +308,188 @@ func (tm *TunnelManager) RemoveTunnel(clusterName string, tunnelID string) {
 
 	// Only remove if the tunnel ID matches (to handle race conditions)
 	if t.ID() == tunnelID {
-		delete(tm.tunnels, clusterName)
+		tm.unregister(t)
 		klog.InfoS("Removed tunnel for cluster", "cluster", clusterName, "tunnel_id", tunnelID)
 	}
 }
 
+// unregister removes the registered tunnel of its cluster. The caller must hold tm.mu
+func (tm *TunnelManager) unregister(t *Tunnel) {
+	delete(tm.tunnels, t.clusterName)
+	tm.recordDisconnect(t.clusterName, time.Now())
+	if tm.locator != nil && tm.endpoint != "" {
+		tm.locator.Withdraw(t.clusterName, tm.endpoint)
+	}
+	if t.resumable {
+		tm.detach(t)
+	}
+}
+
+// startReaper periodically removes the tunnels closed for longer than the reap interval but still registered, in
+// case their Serve returned without removing them. They're counted by tunnelsReaped
+func (tm *TunnelManager) startReaper() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.closed || tm.reapTimer != nil || tm.reapInterval <= 0 {
+		return
+	}
+	tm.reapTimer = time.AfterFunc(tm.reapInterval, tm.reap)
+}
+
+// reap removes the tunnels closed for longer than the reap interval and schedules its next run
+func (tm *TunnelManager) reap() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.closed {
+		return
+	}
+	for clusterName, t := range tm.tunnels {
+		t.mu.RLock()
+		closed, closedAt := t.closed, t.closedAt
+		t.mu.RUnlock()
+		if !closed || time.Since(closedAt) < tm.reapInterval {
+			continue
+		}
+		klog.InfoS("Reaped closed tunnel still registered", "cluster", clusterName, "tunnel_id", t.ID(), "closed_at", closedAt)
+		tm.unregister(t)
+		tunnelsReaped.WithLabelValues(clusterName).Inc()
+	}
+	tm.reapTimer.Reset(tm.reapInterval)
+}
+
+// detach keeps the packet connections of the closed tunnel for the resume window, so the next tunnel of the
+// agent resumes them. The caller must hold tm.mu
+func (tm *TunnelManager) detach(t *Tunnel) {
+	n := t.packetConnCount()
+	if n == 0 {
+		return
+	}
+	if previous, exists := tm.detached[t.clusterName]; exists {
+		// The tunnel in between didn't resume the connections of the previous one
+		previous.resumeTimer.Stop()
+		previous.closePacketConns(errors.New("agent reconnected without resuming its connections"))
+	}
+
+	tm.detached[t.clusterName] = t
+	t.resumeTimer = time.AfterFunc(tm.resumeWindow, func() {
+		tm.expireDetached(t)
+	})
+	klog.InfoS("Keeping packet connections for the agent to resume", "cluster", t.clusterName, "tunnel_id", t.id,
+		"packet_connections", n, "resume_window", tm.resumeWindow)
+}
+
+// expireDetached closes the packet connections of the detached tunnel the agent didn't resume within the window
+func (tm *TunnelManager) expireDetached(t *Tunnel) {
+	tm.mu.Lock()
+	if tm.detached[t.clusterName] != t {
+		// The connections were resumed meanwhile
+		tm.mu.Unlock()
+		return
+	}
+	delete(tm.detached, t.clusterName)
+	tm.mu.Unlock()
+
+	n := t.closePacketConns(fmt.Errorf("agent did not reconnect within the resume window of %v", tm.resumeWindow))
+	packetConnResumes.WithLabelValues(t.clusterName, resumeResultExpired).Add(float64(n))
+	klog.InfoS("Closed packet connections not resumed by the agent", "cluster", t.clusterName, "tunnel_id", t.id, "packet_connections", n)
+}
+
+// DisconnectTunnel disconnects and removes the tunnel of a cluster, see Tunnel.Disconnect
+func (tm *TunnelManager) DisconnectTunnel(clusterName string, reason string) error {
+	t := tm.GetTunnel(clusterName)
+	if t == nil {
+		return fmt.Errorf("%w %s", ErrTunnelNotFound, clusterName)
+	}
+	t.Disconnect(reason)
+	tm.RemoveTunnel(clusterName, t.ID())
+	return nil
+}
+
+// DrainTunnel waits for the tunnel of a cluster to be idle, see Tunnel.WaitForIdle, then disconnects and removes it
+// with the reason. The tunnel is kept if ctx is done first
+func (tm *TunnelManager) DrainTunnel(ctx context.Context, clusterName string, reason string) error {
+	t := tm.GetTunnel(clusterName)
+	if t == nil {
+		return fmt.Errorf("%w %s", ErrTunnelNotFound, clusterName)
+	}
+	if err := t.WaitForIdle(ctx); err != nil {
+		return err
+	}
+	t.Disconnect(reason)
+	tm.RemoveTunnel(clusterName, t.ID())
+	return nil
+}
+
 // Close closes all tunnels
 func (tm *TunnelManager) Close() {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
+	tm.closed = true
+	if tm.reapTimer != nil {
+		tm.reapTimer.Stop()
+	}
 	for clusterName, t := range tm.tunnels {
 		t.Close()
 		klog.InfoS("Closed tunnel", "cluster", clusterName, "tunnel_id", t.ID())
+		if tm.locator != nil && tm.endpoint != "" {
+			tm.locator.Withdraw(clusterName, tm.endpoint)
+		}
+	}
+	for _, t := range tm.detached {
+		t.resumeTimer.Stop()
+		t.closePacketConns(errors.New("hub is shutting down"))
 	}
 
 	tm.tunnels = make(map[string]*Tunnel)
+	tm.detached = make(map[string]*Tunnel)
+}
+
+// agentProtocolVersion returns the protocol version the agent sent in the metadata of its Tunnel call
+func agentProtocolVersion(ctx context.Context) int {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(v1.ProtocolVersionMetadataKey)
+	if len(values) == 0 {
+		return v1.ProtocolVersionBase
+	}
+	version, err := strconv.Atoi(values[0])
+	if err != nil || version < v1.ProtocolVersionBase {
+		return v1.ProtocolVersionBase
+	}
+	return version
+}
+
+// agentOpensOnFirstPacket returns whether the agent sent v1.FirstPacketMetadataKey in the metadata of its Tunnel call
+func agentOpensOnFirstPacket(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(v1.FirstPacketMetadataKey)) > 0
+}
+
+// agentChecksIntegrity returns whether the agent sent v1.IntegrityMetadataKey in the metadata of its Tunnel call
+func agentChecksIntegrity(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(v1.IntegrityMetadataKey)) > 0
+}
+
+// agentVersion returns the release the agent sent in v1.AgentVersionMetadataKey, empty if it didn't
+func agentVersion(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(v1.AgentVersionMetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// lastTunnelID is the last allocated tunnel ID, it starts from the startup time so that IDs are not reused
+// across hub restarts
+var lastTunnelID atomic.Int64
+
+func init() {
+	lastTunnelID.Store(time.Now().UnixNano())
 }
 
-// generateTunnelID generates a unique tunnel ID
+// generateTunnelID generates a unique tunnel ID. Tunnels created concurrently must not share an ID, or
+// RemoveTunnel would remove the tunnel that replaced the one being removed
 func generateTunnelID() string {
-	// Simple implementation - in production, use UUID or similar
-	return fmt.Sprintf("tunnel-%d", time.Now().UnixNano())
+	return fmt.Sprintf("tunnel-%d", lastTunnelID.Add(1))
 }
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeTunnelStream is the stream of a connected agent, Recv blocks until it breaks
+type fakeTunnelStream struct {
+	grpc.ServerStream
+	broken    chan struct{}
+	breakOnce sync.Once
+}
+
+func newFakeTunnelStream() *fakeTunnelStream {
+	return &fakeTunnelStream{broken: make(chan struct{})}
+}
+
+func (s *fakeTunnelStream) Send(*v1.Packet) error {
+	return nil
+}
+
+func (s *fakeTunnelStream) Recv() (*v1.Packet, error) {
+	<-s.broken
+	return nil, errors.New("stream broken")
+}
+
+// breakStream makes Recv fail, like the agent going away
+func (s *fakeTunnelStream) breakStream() {
+	s.breakOnce.Do(func() { close(s.broken) })
+}
+
+// newTunnels creates n tunnels for the cluster concurrently, starting them at the same time
+func newTunnels(t *testing.T, tm *TunnelManager, clusterName string, n int) []*Tunnel {
+	t.Helper()
+
+	tunnels := make([]*Tunnel, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			tun, err := tm.NewTunnel(context.Background(), clusterName, nil)
+			if err != nil {
+				t.Errorf("failed to create tunnel: %v", err)
+				return
+			}
+			tunnels[i] = tun
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return tunnels
+}
+
+func TestConcurrentNewTunnel(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	tunnels := newTunnels(t, tm, "test-cluster", 100)
+
+	ids := make(map[string]bool, len(tunnels))
+	open := 0
+	for _, tun := range tunnels {
+		if ids[tun.ID()] {
+			t.Errorf("tunnel ID %s is not unique", tun.ID())
+		}
+		ids[tun.ID()] = true
+
+		tun.mu.RLock()
+		if !tun.closed {
+			open++
+		}
+		tun.mu.RUnlock()
+	}
+
+	// The last registered tunnel survives, the ones it replaced are closed
+	if open != 1 {
+		t.Errorf("expected 1 open tunnel, got %d", open)
+	}
+	survivor := tm.GetTunnel("test-cluster")
+	if survivor == nil {
+		t.Fatalf("expected a tunnel for the cluster")
+	}
+	survivor.mu.RLock()
+	defer survivor.mu.RUnlock()
+	if survivor.closed {
+		t.Errorf("expected the registered tunnel to be open")
+	}
+	if len(tm.ListTunnels()) != 1 {
+		t.Errorf("expected 1 tunnel, got %d", len(tm.ListTunnels()))
+	}
+}
+
+func TestConcurrentNewTunnelAndGetTunnel(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if tun := tm.GetTunnel("test-cluster"); tun != nil {
+					_ = tun.ID()
+					_ = tun.ClusterName()
+				}
+				for _, tun := range tm.ListTunnels() {
+					_ = tun.TunnelID
+				}
+			}
+		}()
+	}
+
+	newTunnels(t, tm, "test-cluster", 100)
+	close(done)
+	wg.Wait()
+
+	if tm.GetTunnel("test-cluster") == nil {
+		t.Errorf("expected a tunnel for the cluster")
+	}
+}
+
+func TestConcurrentRemoveTunnelAndGetTunnel(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	var tunnels []*Tunnel
+	for i := range 50 {
+		tun, err := tm.NewTunnel(context.Background(), fmt.Sprintf("cluster-%d", i), nil)
+		if err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+		tunnels = append(tunnels, tun)
+	}
+
+	var wg sync.WaitGroup
+	for _, tun := range tunnels {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			tm.RemoveTunnel(tun.ClusterName(), tun.ID())
+		}()
+		go func() {
+			defer wg.Done()
+			if got := tm.GetTunnel(tun.ClusterName()); got != nil && got != tun {
+				t.Errorf("expected tunnel %s, got %s", tun.ID(), got.ID())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(tm.ListTunnels()); n != 0 {
+		t.Errorf("expected all the tunnels to be removed, got %d", n)
+	}
+}
+
+func TestRemoveReplacedTunnel(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	// The agent reconnects concurrently with the end of its previous tunnel
+	old, err := tm.NewTunnel(context.Background(), "test-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var current *Tunnel
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		current, _ = tm.NewTunnel(context.Background(), "test-cluster", nil)
+	}()
+	go func() {
+		defer wg.Done()
+		tm.RemoveTunnel("test-cluster", old.ID())
+	}()
+	wg.Wait()
+
+	// Removing the old tunnel never removes the new one
+	if got := tm.GetTunnel("test-cluster"); got != current {
+		t.Errorf("expected the new tunnel to be registered, got %v", got)
+	}
+}
+
+func TestTunnelLastSeen(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	if _, ok := tm.LastSeen("test-cluster"); ok {
+		t.Errorf("expected no last seen time for a cluster never connected")
+	}
+	tun, err := tm.NewTunnel(context.Background(), "test-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if lastSeen, ok := tm.LastSeen("test-cluster"); !ok || time.Since(lastSeen) > time.Second {
+		t.Errorf("expected the connected cluster to be seen now, got %v, %v", lastSeen, ok)
+	}
+
+	before := time.Now()
+	tm.RemoveTunnel("test-cluster", tun.ID())
+	lastSeen, ok := tm.LastSeen("test-cluster")
+	if !ok || lastSeen.Before(before) || lastSeen.After(time.Now()) {
+		t.Errorf("expected the disconnection time, got %v, %v", lastSeen, ok)
+	}
+
+	// The disconnections older than the retention window are forgotten
+	tm.mu.Lock()
+	tm.disconnectedAt["test-cluster"] = time.Now().Add(-2 * tm.lastSeenRetention)
+	tm.recordDisconnect("other-cluster", time.Now())
+	tm.mu.Unlock()
+	if _, ok := tm.LastSeen("test-cluster"); ok {
+		t.Errorf("expected the disconnection older than the retention window to be forgotten")
+	}
+	if len(tm.disconnectedAt) != 1 {
+		t.Errorf("expected the expired disconnections to be pruned, got %v", tm.disconnectedAt)
+	}
+
+	// A negative retention disables it
+	tm.lastSeenRetention = -1
+	tun, err = tm.NewTunnel(context.Background(), "test-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	tm.RemoveTunnel("test-cluster", tun.ID())
+	if _, ok := tm.LastSeen("test-cluster"); ok {
+		t.Errorf("expected no last seen time with a negative retention")
+	}
+}
+
+// openPacketConns opens n packet connections on the tunnel, which is not served
+func openPacketConns(t *testing.T, tun *Tunnel, n int) {
+	t.Helper()
+	tun.mu.Lock()
+	tun.packetConns = make(map[int64]*packetConnection)
+	tun.outgoingChan = make(chan *v1.Packet, n)
+	tun.initialized = 1
+	tun.mu.Unlock()
+	for range n {
+		if _, err := tun.NewPacketConn(context.Background()); err != nil {
+			t.Fatalf("failed to create packet connection: %v", err)
+		}
+	}
+}
+
+func TestListTunnels(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	clusters := []string{"cluster-c", "cluster-a", "cluster-e", "cluster-b", "cluster-d"}
+	ids := make(map[string]string)
+	for _, clusterName := range clusters {
+		tun, err := tm.NewTunnel(context.Background(), clusterName, nil)
+		if err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+		ids[clusterName] = tun.ID()
+	}
+	openPacketConns(t, tm.GetTunnel("cluster-b"), 2)
+
+	infos := tm.ListTunnels()
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.ClusterName)
+		if info.TunnelID != ids[info.ClusterName] {
+			t.Errorf("expected tunnel %s for %s, got %s", ids[info.ClusterName], info.ClusterName, info.TunnelID)
+		}
+		if info.CreatedAt.IsZero() {
+			t.Errorf("expected the creation time of the tunnel of %s", info.ClusterName)
+		}
+		expectedConns := 0
+		if info.ClusterName == "cluster-b" {
+			expectedConns = 2
+		}
+		if info.ActiveConnections != expectedConns {
+			t.Errorf("expected %d active connections for %s, got %d", expectedConns, info.ClusterName, info.ActiveConnections)
+		}
+	}
+	expected := slices.Sorted(slices.Values(clusters))
+	if !slices.Equal(names, expected) {
+		t.Fatalf("expected tunnels %v, got %v", expected, names)
+	}
+
+	tm.RemoveTunnel("cluster-c", ids["cluster-c"])
+	names = nil
+	for _, info := range tm.ListTunnels() {
+		names = append(names, info.ClusterName)
+	}
+	if expected := []string{"cluster-a", "cluster-b", "cluster-d", "cluster-e"}; !slices.Equal(names, expected) {
+		t.Errorf("expected tunnels %v after removing cluster-c, got %v", expected, names)
+	}
+}
+
+func TestTunnelCollector(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+	tun, err := tm.NewTunnel(context.Background(), "test-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	openPacketConns(t, tun, 1)
+
+	collector := &tunnelCollector{managers: make(map[*TunnelManager]struct{})}
+	collector.register(tm)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	gather := func() map[string]float64 {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("failed to gather: %v", err)
+		}
+		values := make(map[string]float64)
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				values[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+			}
+		}
+		return values
+	}
+
+	if values := gather(); len(values) != 1 || values["test-cluster"] != 1 {
+		t.Errorf("expected 1 packet connection for test-cluster, got %v", values)
+	}
+	collector.unregister(tm)
+	if values := gather(); len(values) != 0 {
+		t.Errorf("expected no tunnels once unregistered, got %v", values)
+	}
+}
+
+func TestReplaceTunnelWhileServeEnds(t *testing.T) {
+	for i := range 50 {
+		tm := NewTunnelManager()
+		// serve runs the tunnel like Server.Tunnel
+		serve := func(tun *Tunnel) {
+			go func() {
+				tun.Serve()
+				tm.RemoveTunnel(tun.ClusterName(), tun.ID())
+			}()
+		}
+
+		oldStream := newFakeTunnelStream()
+		old, err := tm.NewTunnel(context.Background(), "test-cluster", oldStream)
+		if err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+		serve(old)
+
+		// The stream of the old tunnel breaks while the agent reconnects
+		newStream := newFakeTunnelStream()
+		var current *Tunnel
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			oldStream.breakStream()
+		}()
+		go func() {
+			defer wg.Done()
+			current, _ = tm.NewTunnel(context.Background(), "test-cluster", newStream)
+		}()
+		wg.Wait()
+		serve(current)
+
+		if got := tm.GetTunnel("test-cluster"); got != current || current.Closed() {
+			t.Fatalf("iteration %d: expected the new tunnel to be registered and open, got %v", i, got)
+		}
+		// The requests go through the new tunnel as soon as it's served, without another reconnect of the agent
+		deadline := time.Now().Add(time.Second)
+		for {
+			_, err := current.NewPacketConn(context.Background())
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errTunnelNotInitialized) || time.Now().After(deadline) {
+				t.Fatalf("iteration %d: failed to create packet connection on the new tunnel: %v", i, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if !old.Closed() {
+			t.Errorf("iteration %d: expected the old tunnel to be closed", i)
+		}
+
+		newStream.breakStream()
+		tm.Close()
+	}
+}
+
+func TestGetTunnelRemovesClosedTunnel(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+
+	// The tunnel is closed but still registered, e.g. its Serve ended without removing it
+	tun, err := tm.NewTunnel(context.Background(), "test-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	tun.Close()
+	if lastSeen, ok := tm.LastSeen("test-cluster"); !ok || !lastSeen.Equal(tun.closedAt) {
+		t.Errorf("expected the closed tunnel to be last seen when it closed, got %v, %v", lastSeen, ok)
+	}
+
+	if got := tm.GetTunnel("test-cluster"); got != nil {
+		t.Fatalf("expected no tunnel, got the closed tunnel %s", got.ID())
+	}
+	if n := len(tm.ListTunnels()); n != 0 {
+		t.Errorf("expected the closed tunnel to be removed, got %d tunnels", n)
+	}
+	if _, ok := tm.LastSeen("test-cluster"); !ok {
+		t.Errorf("expected the removal of the closed tunnel to be recorded")
+	}
+	// Removing it once its Serve returns is a no-op
+	tm.RemoveTunnel("test-cluster", tun.ID())
+}
+
+func TestReapClosedTunnels(t *testing.T) {
+	tm := NewTunnelManager()
+	defer tm.Close()
+	tm.reapInterval = 10 * time.Millisecond
+
+	reaped := func() float64 {
+		metric := &dto.Metric{}
+		if err := tunnelsReaped.WithLabelValues("reaped-cluster").Write(metric); err != nil {
+			t.Fatalf("failed to read the counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := reaped()
+
+	closed, err := tm.NewTunnel(context.Background(), "reaped-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	closed.Close()
+	open, err := tm.NewTunnel(context.Background(), "open-cluster", nil)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	tm.startReaper()
+	deadline := time.Now().Add(time.Second)
+	for len(tm.ListTunnels()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if infos := tm.ListTunnels(); len(infos) != 1 || infos[0].TunnelID != open.ID() {
+		t.Fatalf("expected only the open tunnel to be kept, got %v", infos)
+	}
+	if n := reaped() - before; n != 1 {
+		t.Errorf("expected 1 reaped tunnel, got %v", n)
+	}
+	if _, ok := tm.LastSeen("reaped-cluster"); !ok {
+		t.Errorf("expected the removal of the reaped tunnel to be recorded")
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The reasons of ClusterUnavailable
+const (
+	// ReasonNoTunnel is the reason of the requests to a cluster whose agent is not connected to the hub
+	ReasonNoTunnel = "no_tunnel"
+	// ReasonDraining is the reason of the requests to a cluster whose agent is draining, see ErrTunnelDraining
+	ReasonDraining = "draining"
+	// ReasonConnecting is the reason of the requests to a cluster whose agent just connected, e.g. during its slow
+	// start, see ErrSlowStart
+	ReasonConnecting = "connecting"
+	// ReasonRateLimited is the reason of the requests rejected by the rate limiter of the cluster names, see
+	// ErrRateLimited, their cluster is not resolved
+	ReasonRateLimited = "rate_limited"
+	// ReasonTooManyConnections is the reason of the requests to a cluster with Config.MaxPacketConnsPerTunnel open
+	// connections, see ErrTooManyPacketConns
+	ReasonTooManyConnections = "too_many_connections"
+	// ReasonMaintenance is the reason of the requests to a cluster under maintenance from the users it doesn't
+	// allow, see Server.SetClusterMaintenance
+	ReasonMaintenance = "maintenance"
+)
+
+// DefaultTunnelLastSeenRetention is how long the hub remembers when the agent of a cluster disconnected by default
+const DefaultTunnelLastSeenRetention = time.Hour
+
+// noTunnelRetryAfter is the Retry-After of the requests to a cluster without a tunnel, the agents retry connecting
+// with a backoff
+const noTunnelRetryAfter = 5 * time.Second
+
+// ClusterUnavailable is the application/json body of the responses of the hub to the requests it can't forward to
+// their cluster: 503 Service Unavailable, or 429 Too Many Requests for the ReasonRateLimited and
+// ReasonTooManyConnections. The responses carry a Retry-After header of RetryAfterSeconds
+type ClusterUnavailable struct {
+	// Cluster is the name of the cluster, empty for ReasonRateLimited
+	Cluster string `json:"cluster"`
+	// Reason is one of ReasonNoTunnel, ReasonDraining, ReasonConnecting, ReasonRateLimited,
+	// ReasonTooManyConnections and ReasonMaintenance
+	Reason string `json:"reason"`
+	// LastSeen is the time the hub last had a tunnel of the cluster: now while it's connected, when it disconnected
+	// within Config.TunnelLastSeenRetention otherwise. null if unknown
+	LastSeen *time.Time `json:"lastSeen"`
+	// RetryAfterSeconds is the time to wait before retrying the request
+	RetryAfterSeconds int `json:"retryAfterSeconds"`
+	// Message describes the error for humans
+	Message string `json:"message"`
+}
+
+// writeClusterUnavailable writes the response of a request the hub can't forward to its cluster
+func writeClusterUnavailable(w http.ResponseWriter, status int, body ClusterUnavailable) {
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Retry-After", strconv.Itoa(body.RetryAfterSeconds))
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.V(4).InfoS("Failed to write the unavailable cluster response", "cluster", body.Cluster, "error", err)
+	}
+}
+
+// clusterUnavailable returns the body of the response to a request to the cluster for the reason
+func (h *httpHandler) clusterUnavailable(clusterName, reason, message string) ClusterUnavailable {
+	body := ClusterUnavailable{
+		Cluster:           clusterName,
+		Reason:            reason,
+		RetryAfterSeconds: 1,
+		Message:           message,
+	}
+	switch reason {
+	case ReasonNoTunnel:
+		body.RetryAfterSeconds = int(noTunnelRetryAfter.Seconds())
+	case ReasonMaintenance:
+		body.RetryAfterSeconds = int(maintenanceRetryAfter.Seconds())
+	}
+	if clusterName != "" {
+		if lastSeen, ok := h.tunnelManager.LastSeen(clusterName); ok {
+			lastSeen = lastSeen.UTC().Truncate(time.Second)
+			body.LastSeen = &lastSeen
+		}
+	}
+	return body
+}
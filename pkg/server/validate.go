@@ -0,0 +1,313 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// listenAddress is a listen address of the config, named by its field
+type listenAddress struct {
+	field   string
+	address string
+}
+
+// Validate returns all the errors of the config joined, so that a misconfigured hub fails in New with every
+// problem listed instead of with an obscure error once it serves. It doesn't modify the config, the zero values
+// that are defaulted by New are valid
+func (c *Config) Validate() error {
+	var errs []error
+
+	grpcListenAddress, httpListenAddress := c.GRPCListenAddress, c.HTTPListenAddress
+	if c.GRPCListener != nil {
+		grpcListenAddress = ""
+	} else if grpcListenAddress == "" {
+		errs = append(errs, errors.New("GRPCListenAddress must be set, e.g. \":8443\""))
+	}
+	if c.SinglePortMode {
+		httpListenAddress = ""
+		if c.HTTPListener != nil {
+			errs = append(errs, errors.New("HTTPListener can't be set with SinglePortMode, the HTTP server is served on the gRPC listener"))
+		}
+		if (c.GRPCTLSConfig == nil) != (c.HTTPTLSConfig == nil) {
+			errs = append(errs, errors.New("GRPCTLSConfig and HTTPTLSConfig must be both set or both unset with SinglePortMode"))
+		}
+	} else if c.HTTPListener != nil {
+		httpListenAddress = ""
+	} else if httpListenAddress == "" {
+		errs = append(errs, errors.New("HTTPListenAddress must be set, e.g. \":8080\""))
+	}
+	switch c.ListenNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		errs = append(errs, fmt.Errorf("ListenNetwork must be \"tcp\", \"tcp4\" or \"tcp6\", got %q", c.ListenNetwork))
+	}
+	errs = append(errs, validateListenAddresses(c.listenNetwork(), []listenAddress{
+		{"GRPCListenAddress", grpcListenAddress},
+		{"HTTPListenAddress", httpListenAddress},
+		{"AdminListenAddress", c.AdminListenAddress},
+	})...)
+	if c.EnablePprof && c.AdminListenAddress == "" {
+		errs = append(errs, errors.New("AdminListenAddress must be set when EnablePprof is set"))
+	}
+
+	if err := validateTLSConfig("GRPCTLSConfig", c.GRPCTLSConfig); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateTLSConfig("HTTPTLSConfig", c.HTTPTLSConfig); err != nil {
+		errs = append(errs, err)
+	}
+	if c.GRPCTLSConfig == nil && c.GRPCServerName != "" {
+		errs = append(errs, errors.New("GRPCTLSConfig must be set when GRPCServerName is set"))
+	}
+	if c.RequireTLS {
+		errs = append(errs, c.validateRequiredTLS()...)
+	} else if c.MinTLSVersion != 0 {
+		errs = append(errs, errors.New("MinTLSVersion requires RequireTLS"))
+	}
+
+	if c.TunnelLocator != nil && c.ReplicaURL == "" {
+		field, address := "HTTPListenAddress", httpListenAddress
+		if c.SinglePortMode {
+			field, address = "GRPCListenAddress", grpcListenAddress
+		}
+		if host, _, err := net.SplitHostPort(address); err == nil && isWildcardHost(host) {
+			errs = append(errs, fmt.Errorf("ReplicaURL must be set when TunnelLocator is set and %s %q listens on all the addresses", field, address))
+		}
+	}
+	if c.ReplicaURL != "" {
+		if u, err := url.Parse(c.ReplicaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ReplicaURL %q must be an http or https URL", c.ReplicaURL))
+		}
+	}
+
+	if c.KeepAliveParams != nil {
+		if c.KeepAliveParams.Time <= 0 {
+			errs = append(errs, fmt.Errorf("KeepAliveParams.Time must be positive, got %s", c.KeepAliveParams.Time))
+		}
+		if c.KeepAliveParams.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("KeepAliveParams.Timeout must not be negative, got %s", c.KeepAliveParams.Timeout))
+		}
+	}
+
+	if c.SlowStartWindow < 0 {
+		errs = append(errs, fmt.Errorf("SlowStartWindow must not be negative, got %s", c.SlowStartWindow))
+	}
+	if c.SlowStartWindow > 0 && c.SlowStartQPS <= 0 {
+		errs = append(errs, errors.New("SlowStartQPS must be positive when SlowStartWindow is set"))
+	}
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"MaxPacketConnsPerTunnel", int64(c.MaxPacketConnsPerTunnel)},
+		{"MaxPacketConnBufferedBytes", int64(c.MaxPacketConnBufferedBytes)},
+		{"ResumeMaxBufferedBytes", int64(c.ResumeMaxBufferedBytes)},
+		{"ResumeWindow", int64(c.ResumeWindow)},
+		{"ClientWriteTimeout", int64(c.ClientWriteTimeout)},
+		{"ClientIdleTimeout", int64(c.ClientIdleTimeout)},
+		{"HTTPReadTimeout", int64(c.HTTPReadTimeout)},
+		{"HTTPWriteTimeout", int64(c.HTTPWriteTimeout)},
+		{"CaptureMaxFileSize", c.CaptureMaxFileSize},
+		{"CaptureMaxDataSize", int64(c.CaptureMaxDataSize)},
+	} {
+		if field.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", field.name))
+		}
+	}
+	if c.QoS != nil && (c.QoS.InteractiveWeight < 0 || c.QoS.BulkWeight < 0 || c.QoS.BulkThreshold < 0) {
+		errs = append(errs, errors.New("QoS weights and BulkThreshold must not be negative"))
+	}
+	if c.Coalesce != nil && (c.Coalesce.Delay < 0 || c.Coalesce.MaxBytes < 0) {
+		errs = append(errs, errors.New("Coalesce Delay and MaxBytes must not be negative"))
+	}
+	if c.ConnReuse != nil && (c.ConnReuse.MaxIdleConnsPerCluster < 0 || c.ConnReuse.IdleTimeout < 0 || c.ConnReuse.MaxRequestsPerConn < 0) {
+		errs = append(errs, errors.New("ConnReuse MaxIdleConnsPerCluster, IdleTimeout and MaxRequestsPerConn must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// listenNetwork returns the network of the listeners, ListenNetwork defaulted to "tcp"
+func (c *Config) listenNetwork() string {
+	if c.ListenNetwork == "" {
+		return "tcp"
+	}
+	return c.ListenNetwork
+}
+
+// validateListenAddresses returns an error for each address that doesn't parse or whose IP isn't of the network,
+// and for each pair of addresses the listeners of would conflict. Port 0 picks a free port, it never conflicts
+func validateListenAddresses(network string, addresses []listenAddress) []error {
+	var errs []error
+	type hostPort struct {
+		field, host, port string
+	}
+	var parsed []hostPort
+	for _, a := range addresses {
+		if a.address == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(a.address)
+		if err != nil {
+			if strings.Count(a.address, ":") > 1 {
+				err = fmt.Errorf("%w, an IPv6 address must be in brackets, e.g. \"[::1]:8443\"", err)
+			}
+			errs = append(errs, fmt.Errorf("%s %q is not a valid host:port: %w", a.field, a.address, err))
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if is4 := ip.To4() != nil; (network == "tcp4" && !is4) || (network == "tcp6" && is4) {
+				errs = append(errs, fmt.Errorf("%s %q can't be listened on with ListenNetwork %s", a.field, a.address, network))
+			}
+		}
+		if port == "0" {
+			continue
+		}
+		for _, p := range parsed {
+			if p.port == port && (p.host == host || isWildcardHost(p.host) || isWildcardHost(host)) {
+				errs = append(errs, fmt.Errorf("%s and %s must listen on distinct ports, both use %s", p.field, a.field, port))
+			}
+		}
+		parsed = append(parsed, hostPort{a.field, host, port})
+	}
+	return errs
+}
+
+// isWildcardHost returns whether a listener on the host listens on all the addresses of the host
+func isWildcardHost(host string) bool {
+	return host == "" || net.ParseIP(host).IsUnspecified()
+}
+
+// validateTLSConfig returns an error if the TLS config can't serve any certificate
+func validateTLSConfig(field string, config *tls.Config) error {
+	if config == nil || len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil {
+		return nil
+	}
+	return fmt.Errorf("%s has no certificate, set its Certificates, GetCertificate or GetConfigForClient", field)
+}
+
+// defaultMinTLSVersion is the default MinTLSVersion, and the version accepted by a TLS config without MinVersion
+const defaultMinTLSVersion = tls.VersionTLS12
+
+// validateRequiredTLS returns an error for each listener without TLS or accepting a TLS version below MinTLSVersion
+func (c *Config) validateRequiredTLS() []error {
+	minVersion := c.MinTLSVersion
+	switch minVersion {
+	case 0:
+		minVersion = defaultMinTLSVersion
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		return []error{fmt.Errorf("MinTLSVersion must be one of tls.VersionTLS10 to tls.VersionTLS13, got %#04x", minVersion)}
+	}
+
+	var errs []error
+	for _, listener := range []struct {
+		name   string
+		field  string
+		config *tls.Config
+	}{
+		{"gRPC", "GRPCTLSConfig", c.GRPCTLSConfig},
+		{"HTTP", "HTTPTLSConfig", c.HTTPTLSConfig},
+	} {
+		if listener.config == nil {
+			errs = append(errs, fmt.Errorf("RequireTLS is set but the %s listener has no TLS, set %s", listener.name, listener.field))
+			continue
+		}
+		version := listener.config.MinVersion
+		if version == 0 {
+			version = defaultMinTLSVersion
+		}
+		if version < minVersion {
+			errs = append(errs, fmt.Errorf("RequireTLS is set but the %s listener accepts %s, %s.MinVersion must be at least %s",
+				listener.name, tls.VersionName(version), listener.field, tls.VersionName(minVersion)))
+		}
+	}
+	return errs
+}
+
+// checkListeners returns an error if two of the listeners are bound to the same port, e.g. when a listen address
+// resolved to the port of another one
+func checkListeners(listeners map[string]net.Listener) error {
+	ports := map[int]string{}
+	var errs []error
+	for _, name := range []string{"gRPC", "HTTP", "admin"} {
+		listener := listeners[name]
+		if listener == nil {
+			continue
+		}
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		if other, ok := ports[addr.Port]; ok {
+			errs = append(errs, fmt.Errorf("the %s and %s listeners are bound to the same port %d", other, name, addr.Port))
+			continue
+		}
+		ports[addr.Port] = name
+	}
+	return errors.Join(errs...)
+}
+
+// logEffectiveConfig logs the configuration the server runs with, the TLS configs and the secrets of the
+// authenticators are only logged as whether they're set, and warns about the listeners without TLS
+func (s *Server) logEffectiveConfig() {
+	c := s.config
+	var enabled []string
+	for name, on := range map[string]bool{
+		"connection_migration": c.EnableConnectionMigration,
+		"http2":                c.EnableHTTP2,
+		"pprof":                c.EnablePprof,
+		"debug_endpoints":      c.EnableDebugEndpoints,
+		"admin_api":            c.AdminAuthenticator != nil,
+		"cors":                 c.CORS != nil,
+		"mirror":               c.Mirror != nil,
+		"conn_reuse":           c.ConnReuse != nil,
+		"capture":              c.CaptureDir != "",
+		"qos":                  c.QoS != nil,
+		"coalesce":             c.Coalesce != nil && c.Coalesce.Delay > 0,
+		"tunnel_locator":       c.TunnelLocator != nil,
+		"integrity_check":      c.EnableIntegrityCheck,
+		"single_port":          c.SinglePortMode,
+		"require_tls":          c.RequireTLS,
+	} {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	slices.Sort(enabled)
+	klog.InfoS("Effective hub configuration",
+		"listen_network", c.listenNetwork(),
+		"grpc_address", c.GRPCListenAddress,
+		"http_address", c.HTTPListenAddress,
+		"admin_address", c.AdminListenAddress,
+		"grpc_tls", c.GRPCTLSConfig != nil,
+		"grpc_server_name", c.GRPCServerName,
+		"http_tls", c.HTTPTLSConfig != nil,
+		"keepalive_time", c.KeepAliveParams.Time,
+		"keepalive_timeout", c.KeepAliveParams.Timeout,
+		"max_recv_msg_size", c.MaxGRPCRecvMsgSize,
+		"max_send_msg_size", c.MaxGRPCSendMsgSize,
+		"max_packet_conns_per_tunnel", c.MaxPacketConnsPerTunnel,
+		"resume_window", c.ResumeWindow,
+		"slow_start_window", c.SlowStartWindow,
+		"client_idle_timeout", c.ClientIdleTimeout,
+		"client_write_timeout", c.ClientWriteTimeout,
+		"http_read_header_timeout", c.HTTPReadHeaderTimeout,
+		"http_read_timeout", c.HTTPReadTimeout,
+		"http_write_timeout", c.HTTPWriteTimeout,
+		"enabled", strings.Join(enabled, ","))
+
+	if c.GRPCTLSConfig == nil {
+		klog.Warning("TLS is disabled on the gRPC listener, the agents connect in plaintext")
+	}
+	if c.HTTPTLSConfig == nil {
+		klog.Warning("TLS is disabled on the HTTP listener, the requests to the clusters are served in plaintext")
+	}
+}
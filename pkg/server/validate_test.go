@@ -0,0 +1,343 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/coalesce"
+	"google.golang.org/grpc/keepalive"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		name         string
+		modify       func(*Config)
+		expectErrors []string
+	}{
+		{
+			name:   "default",
+			modify: func(*Config) {},
+		},
+		{
+			name: "random ports",
+			modify: func(c *Config) {
+				c.GRPCListenAddress, c.HTTPListenAddress, c.AdminListenAddress = "127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0"
+			},
+		},
+		{
+			name: "distinct hosts",
+			modify: func(c *Config) {
+				c.HTTPListenAddress, c.AdminListenAddress = "10.0.0.1:9443", "127.0.0.1:9443"
+			},
+		},
+		{
+			name: "empty listen addresses",
+			modify: func(c *Config) {
+				c.GRPCListenAddress, c.HTTPListenAddress = "", ""
+			},
+			expectErrors: []string{"GRPCListenAddress must be set", "HTTPListenAddress must be set"},
+		},
+		{
+			name: "listeners ignore the listen addresses",
+			modify: func(c *Config) {
+				c.GRPCListener, c.HTTPListener = &net.TCPListener{}, &net.TCPListener{}
+				c.GRPCListenAddress, c.HTTPListenAddress = "", "8080"
+			},
+		},
+		{
+			name: "invalid listen address",
+			modify: func(c *Config) {
+				c.HTTPListenAddress = "8080"
+			},
+			expectErrors: []string{`HTTPListenAddress "8080" is not a valid host:port`},
+		},
+		{
+			name: "IPv6 listen addresses",
+			modify: func(c *Config) {
+				c.ListenNetwork = "tcp6"
+				c.GRPCListenAddress, c.HTTPListenAddress, c.AdminListenAddress = "[::1]:8443", "[::]:8080", ":9443"
+			},
+		},
+		{
+			name: "IPv6 listen address without brackets",
+			modify: func(c *Config) {
+				c.GRPCListenAddress = "::1:8443"
+			},
+			expectErrors: []string{`GRPCListenAddress "::1:8443" is not a valid host:port`, "an IPv6 address must be in brackets"},
+		},
+		{
+			name: "listen addresses of another network",
+			modify: func(c *Config) {
+				c.ListenNetwork = "tcp4"
+				c.GRPCListenAddress, c.HTTPListenAddress = "[::1]:8443", "127.0.0.1:8080"
+			},
+			expectErrors: []string{`GRPCListenAddress "[::1]:8443" can't be listened on with ListenNetwork tcp4`},
+		},
+		{
+			name: "invalid listen network",
+			modify: func(c *Config) {
+				c.ListenNetwork = "udp"
+			},
+			expectErrors: []string{`ListenNetwork must be "tcp", "tcp4" or "tcp6", got "udp"`},
+		},
+		{
+			name: "IPv6 wildcard overlaps another address",
+			modify: func(c *Config) {
+				c.HTTPListenAddress, c.AdminListenAddress = "[::]:8080", "[::1]:8080"
+			},
+			expectErrors: []string{"HTTPListenAddress and AdminListenAddress must listen on distinct ports"},
+		},
+		{
+			name: "identical listen addresses",
+			modify: func(c *Config) {
+				c.HTTPListenAddress = c.GRPCListenAddress
+			},
+			expectErrors: []string{"GRPCListenAddress and HTTPListenAddress must listen on distinct ports, both use 8443"},
+		},
+		{
+			name: "admin port overlaps the wildcard HTTP address",
+			modify: func(c *Config) {
+				c.AdminListenAddress = "127.0.0.1:8080"
+			},
+			expectErrors: []string{"HTTPListenAddress and AdminListenAddress must listen on distinct ports"},
+		},
+		{
+			name: "TLS config without certificates",
+			modify: func(c *Config) {
+				c.GRPCTLSConfig, c.HTTPTLSConfig = &tls.Config{}, &tls.Config{}
+			},
+			expectErrors: []string{"GRPCTLSConfig has no certificate", "HTTPTLSConfig has no certificate"},
+		},
+		{
+			name: "server name without TLS",
+			modify: func(c *Config) {
+				c.GRPCServerName = "hub.example.com"
+			},
+			expectErrors: []string{"GRPCTLSConfig must be set when GRPCServerName is set"},
+		},
+		{
+			name: "keepalive time of 0",
+			modify: func(c *Config) {
+				c.KeepAliveParams = &keepalive.ServerParameters{Timeout: -time.Second}
+			},
+			expectErrors: []string{"KeepAliveParams.Time must be positive", "KeepAliveParams.Timeout must not be negative"},
+		},
+		{
+			name: "pprof without admin server",
+			modify: func(c *Config) {
+				c.EnablePprof = true
+			},
+			expectErrors: []string{"AdminListenAddress must be set when EnablePprof is set"},
+		},
+		{
+			name: "slow start without QPS",
+			modify: func(c *Config) {
+				c.SlowStartWindow = time.Minute
+			},
+			expectErrors: []string{"SlowStartQPS must be positive when SlowStartWindow is set"},
+		},
+		{
+			name: "tunnel locator on all the addresses",
+			modify: func(c *Config) {
+				c.TunnelLocator = NewMemoryTunnelLocator()
+			},
+			expectErrors: []string{"ReplicaURL must be set when TunnelLocator is set"},
+		},
+		{
+			name: "tunnel locator with replica URL",
+			modify: func(c *Config) {
+				c.TunnelLocator, c.ReplicaURL = NewMemoryTunnelLocator(), "https://hub-0.hub:8080"
+			},
+		},
+		{
+			name: "invalid replica URL",
+			modify: func(c *Config) {
+				c.ReplicaURL = "hub-0.hub:8080"
+			},
+			expectErrors: []string{`ReplicaURL "hub-0.hub:8080" must be an http or https URL`},
+		},
+		{
+			name: "negative caps",
+			modify: func(c *Config) {
+				c.MaxPacketConnsPerTunnel, c.ClientIdleTimeout = -1, -time.Second
+			},
+			expectErrors: []string{"MaxPacketConnsPerTunnel must not be negative", "ClientIdleTimeout must not be negative"},
+		},
+		{
+			name: "negative HTTP timeouts",
+			modify: func(c *Config) {
+				c.HTTPReadTimeout, c.HTTPWriteTimeout = -time.Second, -time.Second
+			},
+			expectErrors: []string{"HTTPReadTimeout must not be negative", "HTTPWriteTimeout must not be negative"},
+		},
+		{
+			name: "negative coalesce delay",
+			modify: func(c *Config) {
+				c.Coalesce = &coalesce.Config{Delay: -time.Millisecond}
+			},
+			expectErrors: []string{"Coalesce Delay and MaxBytes must not be negative"},
+		},
+		{
+			name: "single-port mode ignores the HTTP listen address",
+			modify: func(c *Config) {
+				c.SinglePortMode = true
+				c.HTTPListenAddress = ""
+			},
+		},
+		{
+			name: "single-port mode with HTTP listener or TLS on one protocol",
+			modify: func(c *Config) {
+				c.SinglePortMode = true
+				c.HTTPListener = &net.TCPListener{}
+				c.GRPCTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+			},
+			expectErrors: []string{"HTTPListener can't be set with SinglePortMode", "GRPCTLSConfig and HTTPTLSConfig must be both set or both unset"},
+		},
+		{
+			name: "require TLS",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.GRPCTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+				c.HTTPTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}, MinVersion: tls.VersionTLS13}
+			},
+		},
+		{
+			name: "require TLS without TLS",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+			},
+			expectErrors: []string{
+				"RequireTLS is set but the gRPC listener has no TLS, set GRPCTLSConfig",
+				"RequireTLS is set but the HTTP listener has no TLS, set HTTPTLSConfig",
+			},
+		},
+		{
+			name: "require TLS without gRPC TLS",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.HTTPTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+			},
+			expectErrors: []string{"RequireTLS is set but the gRPC listener has no TLS, set GRPCTLSConfig"},
+		},
+		{
+			name: "require TLS without HTTP TLS",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.GRPCTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+			},
+			expectErrors: []string{"RequireTLS is set but the HTTP listener has no TLS, set HTTPTLSConfig"},
+		},
+		{
+			name: "require TLS without certificate",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.GRPCTLSConfig = &tls.Config{}
+				c.HTTPTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+			},
+			expectErrors: []string{"GRPCTLSConfig has no certificate"},
+		},
+		{
+			name: "require TLS with an old minimum version",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.GRPCTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}, MinVersion: tls.VersionTLS10}
+				c.HTTPTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}, MinVersion: tls.VersionTLS11}
+			},
+			expectErrors: []string{
+				"the gRPC listener accepts TLS 1.0, GRPCTLSConfig.MinVersion must be at least TLS 1.2",
+				"the HTTP listener accepts TLS 1.1, HTTPTLSConfig.MinVersion must be at least TLS 1.2",
+			},
+		},
+		{
+			name: "require TLS 1.3",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.MinTLSVersion = tls.VersionTLS13
+				c.GRPCTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}, MinVersion: tls.VersionTLS13}
+				c.HTTPTLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+			},
+			expectErrors: []string{"the HTTP listener accepts TLS 1.2, HTTPTLSConfig.MinVersion must be at least TLS 1.3"},
+		},
+		{
+			name: "invalid minimum TLS version",
+			modify: func(c *Config) {
+				c.RequireTLS = true
+				c.MinTLSVersion = 0x0200
+			},
+			expectErrors: []string{"MinTLSVersion must be one of tls.VersionTLS10 to tls.VersionTLS13, got 0x0200"},
+		},
+		{
+			name: "minimum TLS version without require TLS",
+			modify: func(c *Config) {
+				c.MinTLSVersion = tls.VersionTLS13
+			},
+			expectErrors: []string{"MinTLSVersion requires RequireTLS"},
+		},
+		{
+			name: "disabled read header timeout",
+			modify: func(c *Config) {
+				c.HTTPReadHeaderTimeout = -1
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := DefaultConfig()
+			c.modify(config)
+			err := config.Validate()
+			if len(c.expectErrors) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %q, got none", c.expectErrors)
+			}
+			for _, expectError := range c.expectErrors {
+				if !strings.Contains(err.Error(), expectError) {
+					t.Errorf("expected error %q, got %v", expectError, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.HTTPListenAddress = config.GRPCListenAddress
+	_, err := New(config, nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, expectError := range []string{"invalid server config", "must listen on distinct ports", "a ClusterNameParser must be set"} {
+		if !strings.Contains(err.Error(), expectError) {
+			t.Errorf("expected error %q, got %v", expectError, err)
+		}
+	}
+}
+
+func TestCheckListeners(t *testing.T) {
+	grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer grpcListener.Close()
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer httpListener.Close()
+
+	if err := checkListeners(map[string]net.Listener{"gRPC": grpcListener, "HTTP": httpListener}); err != nil {
+		t.Errorf("expected no error for distinct ports, got %v", err)
+	}
+	// The same listener stands for two listeners bound to the same port, e.g. with SO_REUSEPORT
+	err = checkListeners(map[string]net.Listener{"gRPC": grpcListener, "HTTP": httpListener, "admin": grpcListener})
+	if err == nil || !strings.Contains(err.Error(), "the gRPC and admin listeners are bound to the same port") {
+		t.Errorf("expected an error for the same port, got %v", err)
+	}
+}
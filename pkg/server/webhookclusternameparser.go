@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWebhookTimeout bounds a call to the cluster name webhook when no timeout is given
+const DefaultWebhookTimeout = 5 * time.Second
+
+// DefaultWebhookCacheTTL is how long a cluster name resolved by the webhook is reused for the same request metadata
+const DefaultWebhookCacheTTL = 30 * time.Second
+
+// maxWebhookCacheEntries bounds the cached cluster names, the cache is pruned once it's exceeded
+const maxWebhookCacheEntries = 4096
+
+// maxWebhookResponseSize bounds the response of the webhook read
+const maxWebhookResponseSize = 64 * 1024
+
+// WebhookRequest is the request metadata the cluster name webhook receives as JSON
+type WebhookRequest struct {
+	Path       string              `json:"path"`
+	Headers    map[string][]string `json:"headers"`
+	RemoteAddr string              `json:"remoteAddr"`
+}
+
+// WebhookResponse is the JSON response expected from the cluster name webhook
+type WebhookResponse struct {
+	ClusterName string `json:"clusterName"`
+}
+
+type webhookCacheEntry struct {
+	clusterName string
+	expires     time.Time
+}
+
+// webhookClusterNameParser resolves the cluster names with a webhook
+type webhookClusterNameParser struct {
+	webhookURL string
+	timeout    time.Duration
+	client     *http.Client
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]webhookCacheEntry
+}
+
+// NewWebhookClusterNameParser creates a ClusterNameParser that POSTs the metadata of each request, see WebhookRequest,
+// to webhookURL and routes it to the cluster of the WebhookResponse. This lets platforms resolve the cluster with
+// their own logic, e.g. a tenant to cluster mapping. The call fails after timeout, DefaultWebhookTimeout if not
+// positive, and the request is then rejected. The cluster names are cached for DefaultWebhookCacheTTL by path,
+// headers and remote host; the remote port isn't part of the key since it changes with each client connection.
+// Note that the headers, including Authorization, are sent to the webhook.
+func NewWebhookClusterNameParser(webhookURL string, timeout time.Duration) ClusterNameParser {
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	return &webhookClusterNameParser{
+		webhookURL: webhookURL,
+		timeout:    timeout,
+		client:     &http.Client{},
+		ttl:        DefaultWebhookCacheTTL,
+		now:        time.Now,
+		cache:      make(map[string]webhookCacheEntry),
+	}
+}
+
+// ParseClusterName returns the cached cluster name of the request metadata or calls the webhook
+func (p *webhookClusterNameParser) ParseClusterName(r *http.Request) (clusterName string, err error) {
+	request := WebhookRequest{Path: r.URL.EscapedPath(), Headers: r.Header, RemoteAddr: r.RemoteAddr}
+	key, err := webhookCacheKey(request)
+	if err != nil {
+		return "", err
+	}
+	if clusterName, ok := p.cached(key); ok {
+		return clusterName, nil
+	}
+
+	clusterName, err = p.call(r.Context(), request)
+	if err != nil {
+		return "", err
+	}
+	p.store(key, clusterName)
+	return clusterName, nil
+}
+
+// call POSTs the request metadata to the webhook and returns the cluster name of its response
+func (p *webhookClusterNameParser) call(ctx context.Context, request WebhookRequest) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal webhook request: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cluster name webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read cluster name webhook response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cluster name webhook returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var response WebhookResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return "", fmt.Errorf("invalid cluster name webhook response: %w", err)
+	}
+	if response.ClusterName == "" || strings.Contains(response.ClusterName, "/") {
+		return "", fmt.Errorf("cluster name webhook returned invalid cluster name %q", response.ClusterName)
+	}
+	return response.ClusterName, nil
+}
+
+// webhookCacheKey keys the cache by the request metadata without the remote port
+func webhookCacheKey(request WebhookRequest) (string, error) {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		request.RemoteAddr = host
+	}
+	// The keys of the headers are sorted by encoding/json, so the same metadata always has the same key
+	key, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal webhook request: %w", err)
+	}
+	return string(key), nil
+}
+
+func (p *webhookClusterNameParser) cached(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.cache[key]
+	if !ok || !p.now().Before(entry.expires) {
+		return "", false
+	}
+	return entry.clusterName, true
+}
+
+func (p *webhookClusterNameParser) store(key, clusterName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if len(p.cache) >= maxWebhookCacheEntries {
+		for k, entry := range p.cache {
+			if !now.Before(entry.expires) {
+				delete(p.cache, k)
+			}
+		}
+		// All entries are fresh, start over rather than growing without bound
+		if len(p.cache) >= maxWebhookCacheEntries {
+			clear(p.cache)
+		}
+	}
+	p.cache[key] = webhookCacheEntry{clusterName: clusterName, expires: now.Add(p.ttl)}
+}
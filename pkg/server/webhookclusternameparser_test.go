@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookClusterNameParser(t *testing.T) {
+	var calls atomic.Int32
+	var received WebhookRequest
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(WebhookResponse{ClusterName: "cluster-" + received.Headers["X-Tenant"][0]})
+	}))
+	defer webhook.Close()
+
+	parser := NewWebhookClusterNameParser(webhook.URL, 0).(*webhookClusterNameParser)
+	now := time.Now()
+	parser.now = func() time.Time { return now }
+
+	request := func(tenant, remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "/api/v1/pods", nil)
+		r.Header.Set("X-Tenant", tenant)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+	parse := func(r *http.Request, expectCluster string) {
+		t.Helper()
+		clusterName, err := parser.ParseClusterName(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if clusterName != expectCluster {
+			t.Errorf("expected cluster %q, got %q", expectCluster, clusterName)
+		}
+	}
+
+	parse(request("a", "10.0.0.1:40000"), "cluster-a")
+	if received.Path != "/api/v1/pods" || received.RemoteAddr != "10.0.0.1:40000" {
+		t.Errorf("unexpected webhook request %+v", received)
+	}
+
+	// Another connection of the same client is resolved from the cache, another tenant isn't
+	parse(request("a", "10.0.0.1:40001"), "cluster-a")
+	parse(request("b", "10.0.0.1:40001"), "cluster-b")
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 webhook calls, got %d", calls.Load())
+	}
+
+	// The cached cluster names expire
+	now = now.Add(DefaultWebhookCacheTTL)
+	parse(request("a", "10.0.0.1:40000"), "cluster-a")
+	if calls.Load() != 3 {
+		t.Errorf("expected the expired cluster name to be resolved again, got %d webhook calls", calls.Load())
+	}
+}
+
+func TestWebhookClusterNameParserErrors(t *testing.T) {
+	cases := []struct {
+		name          string
+		handler       http.HandlerFunc
+		expectErrPart string
+	}{
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "lookup failed", http.StatusInternalServerError)
+			},
+			expectErrPart: "lookup failed",
+		},
+		{
+			name:          "invalid json",
+			handler:       func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("cluster1")) },
+			expectErrPart: "invalid cluster name webhook response",
+		},
+		{
+			name:          "empty cluster name",
+			handler:       func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"clusterName":""}`)) },
+			expectErrPart: "invalid cluster name",
+		},
+		{
+			name: "timeout",
+			// The handler doesn't notice the client gone, outlast the timeout only a little
+			handler:       func(w http.ResponseWriter, r *http.Request) { time.Sleep(300 * time.Millisecond) },
+			expectErrPart: "deadline exceeded",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var calls atomic.Int32
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				c.handler(w, r)
+			}))
+			defer webhook.Close()
+
+			parser := NewWebhookClusterNameParser(webhook.URL, 100*time.Millisecond)
+			for i := 0; i < 2; i++ {
+				_, err := parser.ParseClusterName(httptest.NewRequest("GET", "/api/v1/pods", nil))
+				if err == nil || !strings.Contains(err.Error(), c.expectErrPart) {
+					t.Fatalf("expected error containing %q, got %v", c.expectErrPart, err)
+				}
+			}
+			// Failures aren't cached
+			if calls.Load() != 2 {
+				t.Errorf("expected 2 webhook calls, got %d", calls.Load())
+			}
+		})
+	}
+
+	_, err := NewWebhookClusterNameParser("http://127.0.0.1:1", time.Second).ParseClusterName(httptest.NewRequest("GET", "/", nil))
+	if err == nil {
+		t.Errorf("expected an error when the webhook is unreachable")
+	}
+}
@@ -0,0 +1,52 @@
+// Package version holds the build information of the hub and agent binaries. The variables are set at build time,
+// e.g.
+//
+//	go build -ldflags "-X github.com/xuezhaojun/multiclustertunnel/pkg/version.Version=$(git describe --tags --always)"
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+var (
+	// Version is the release of the binary, e.g. v0.3.0
+	Version = "dev"
+	// GitCommit is the commit the binary is built from
+	GitCommit = "unknown"
+	// BuildDate is when the binary was built, in RFC 3339
+	BuildDate = "unknown"
+)
+
+// Info is the build information of a binary
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String formats the build information for --version
+func (i Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, i.GitCommit, i.BuildDate, i.GoVersion)
+}
+
+// Handler serves the build information of the running binary as JSON, on /version of the hub and the agent
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get())
+	})
+}
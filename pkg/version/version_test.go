@@ -0,0 +1,34 @@
+package version
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	saved := Version
+	defer func() { Version = saved }()
+	Version = "v1.2.3"
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+
+	var info Info
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("failed to decode the version: %v", err)
+	}
+	if info != Get() {
+		t.Errorf("expected %+v, got %+v", Get(), info)
+	}
+	if info.Version != "v1.2.3" {
+		t.Errorf("expected version v1.2.3, got %q", info.Version)
+	}
+}
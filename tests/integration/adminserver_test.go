@@ -0,0 +1,155 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Admin Server", func() {
+	const adminToken = "test-admin-token"
+	var framework *TestFramework
+	var release chan struct{}
+
+	BeforeEach(func() {
+		release = make(chan struct{})
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.AdminListenAddress = "127.0.0.1:0"
+				config.AdminAuthenticator = server.NewTokenAuthenticator(adminToken)
+				config.EnableDebugEndpoints = true
+				config.EnablePprof = true
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/test-cluster/slow" {
+				// The response comes once the spec releases it
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			select {
+			case <-release:
+			default:
+				close(release)
+			}
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// do sends the request with the admin token to the address and returns the status and the body of the response
+	do := func(method, addr, path string) (int, string) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", addr, path), nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	It("should serve the admin and debug endpoints only on the admin server", func() {
+		hubAddr := framework.GetHubHTTPAddr()
+		adminAddr := framework.GetHubServer().AdminAddress()
+		Expect(adminAddr).NotTo(Equal(hubAddr))
+
+		for _, path := range []string{"/debug/tunnels", "/metrics", "/debug/pprof/"} {
+			status, _ := do("GET", hubAddr, path)
+			Expect(status).To(Equal(http.StatusNotFound), "path %s on the HTTP server", path)
+			status, _ = do("GET", adminAddr, path)
+			Expect(status).To(Equal(http.StatusOK), "path %s on the admin server", path)
+		}
+
+		_, body := do("GET", adminAddr, "/debug/tunnels")
+		Expect(body).To(ContainSubstring("test-cluster"))
+		_, body = do("GET", adminAddr, "/metrics")
+		Expect(body).To(ContainSubstring("go_goroutines"))
+
+		// The tunnels and the health check are still served on the HTTP server
+		status, body := do("GET", hubAddr, "/test-cluster/api/v1/test")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+		status, _ = do("GET", hubAddr, "/health")
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	It("should disconnect a cluster through the admin server", func() {
+		status, _ := do("POST", framework.GetHubHTTPAddr(), "/admin/tunnels/test-cluster/disconnect")
+		Expect(status).To(Equal(http.StatusNotFound))
+		firstTunnel := framework.GetHubServer().GetTunnel("test-cluster")
+		Expect(firstTunnel).NotTo(BeNil())
+
+		status, _ = do("POST", framework.GetHubServer().AdminAddress(), "/admin/tunnels/test-cluster/disconnect?reason=stuck")
+		Expect(status).To(Equal(http.StatusNoContent))
+
+		// The agent reconnects with a new tunnel
+		Eventually(func() bool {
+			t := framework.GetHubServer().GetTunnel("test-cluster")
+			return t != nil && t.ID() != firstTunnel.ID()
+		}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+	})
+
+	It("should drain a cluster through the admin server", func() {
+		adminAddr := framework.GetHubServer().AdminAddress()
+		firstTunnel := framework.GetHubServer().GetTunnel("test-cluster")
+		Expect(firstTunnel).NotTo(BeNil())
+
+		// A request is in flight until it's released, its client connection is closed with the response
+		slowStatus := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/slow", framework.GetHubHTTPAddr()))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			slowStatus <- resp.StatusCode
+		}()
+		Eventually(func() int {
+			return len(firstTunnel.PacketConnStats())
+		}, 5*time.Second).Should(Equal(1))
+
+		status, body := do("POST", adminAddr, "/admin/tunnels/test-cluster/drain?timeout=500ms")
+		Expect(status).To(Equal(http.StatusGatewayTimeout))
+		Expect(body).To(ContainSubstring("1 packet connections still open"))
+		Expect(framework.GetHubServer().GetTunnel("test-cluster").ID()).To(Equal(firstTunnel.ID()))
+
+		// The tunnel is disconnected once the request completed
+		time.AfterFunc(500*time.Millisecond, func() { close(release) })
+		status, _ = do("POST", adminAddr, "/admin/tunnels/test-cluster/drain?timeout=5s")
+		Expect(status).To(Equal(http.StatusNoContent))
+		Expect(<-slowStatus).To(Equal(http.StatusOK))
+
+		// The agent reconnects with a new tunnel
+		Eventually(func() bool {
+			t := framework.GetHubServer().GetTunnel("test-cluster")
+			return t != nil && t.ID() != firstTunnel.ID()
+		}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+
+		// Server.DrainCluster disconnects the idle tunnel at once
+		Expect(framework.GetHubServer().DrainCluster(context.Background(), "test-cluster")).To(Succeed())
+		Expect(errors.Is(framework.GetHubServer().DrainCluster(context.Background(), "unknown-cluster"), server.ErrTunnelNotFound)).To(BeTrue())
+	})
+})
@@ -0,0 +1,96 @@
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// recordingT records the errors of the assertions of the framework
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingT) Logf(format string, args ...interface{}) {}
+
+var _ = Describe("Authentication Headers", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	sendRequest := func(headers map[string]string) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/test-cluster/api/v1/pods", framework.GetHubHTTPAddr()), nil)
+		Expect(err).NotTo(HaveOccurred())
+		for header, value := range headers {
+			req.Header.Set(header, value)
+		}
+		client := &http.Client{Timeout: 5 * time.Second}
+		// A connection dialed while the previous one was reused stays idle, the hub would wait for it on shutdown
+		defer client.CloseIdleConnections()
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	}
+
+	It("should forward the Authorization header", func() {
+		sendRequest(map[string]string{"Authorization": "Bearer hub-user-token"})
+
+		mockServer.AssertLastRequestHeader(&GinkgoTestingAdapter{GinkgoT()}, "Authorization", "Bearer hub-user-token")
+	})
+
+	It("should forward the impersonation headers", func() {
+		sendRequest(map[string]string{"Authorization": "Bearer first-token"})
+		sendRequest(map[string]string{
+			"Authorization":     "Bearer second-token",
+			"Impersonate-User":  "cluster:hub:alice",
+			"Impersonate-Group": "system:authenticated",
+		})
+
+		t := &GinkgoTestingAdapter{GinkgoT()}
+		mockServer.AssertRequestHeaders(t, 0, map[string]string{"Authorization": "Bearer first-token"})
+		mockServer.AssertRequestHeaders(t, 1, map[string]string{
+			"Authorization":     "Bearer second-token",
+			"Impersonate-User":  "cluster:hub:alice",
+			"Impersonate-Group": "system:authenticated",
+		})
+		mockServer.AssertLastRequestHeader(t, "impersonate-user", "cluster:hub:alice")
+	})
+
+	It("should report missing and mismatched headers", func() {
+		sendRequest(map[string]string{"Authorization": "Bearer hub-user-token"})
+
+		recorder := &recordingT{}
+		mockServer.AssertRequestHeaders(recorder, 0, map[string]string{"Impersonate-User": "alice"})
+		mockServer.AssertLastRequestHeader(recorder, "Authorization", "Bearer other-token")
+		mockServer.AssertRequestHeaders(recorder, 1, map[string]string{"Authorization": "Bearer hub-user-token"})
+		Expect(recorder.errors).To(HaveLen(3))
+		Expect(recorder.errors[0]).To(ContainSubstring("it's missing"))
+		Expect(recorder.errors[1]).To(ContainSubstring(`got "Bearer hub-user-token"`))
+		Expect(recorder.errors[2]).To(ContainSubstring("got 1 requests"))
+	})
+})
@@ -17,13 +17,14 @@ var _ = Describe("Basic Connectivity", func() {
 	var framework *TestFramework
 
 	BeforeEach(func() {
-		framework = NewTestFrameworkWithGinkgo(false) // Start with insecure for simplicity
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork() // Start with insecure for simplicity
 		Expect(framework.Setup()).To(Succeed())
 	})
 
 	AfterEach(func() {
 		if framework != nil {
 			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
 		}
 	})
 
@@ -301,6 +302,40 @@ var _ = Describe("Basic Connectivity", func() {
 		requests := mockServer.GetRequests()
 		Expect(requests).To(HaveLen(len(testCases)))
 	})
+	It("should preserve escaped paths and query strings", func() {
+		// Create a mock backend server that echoes the request URI
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(r.RequestURI))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Create an agent
+		err = framework.CreateAgent("test-cluster", mockServer.GetAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		// Wait for agent to connect
+		time.Sleep(500 * time.Millisecond)
+
+		requestURIs := []string{
+			"/api/v1/namespaces/default/pods/my%2Fpod/log?container=app&follow=true",
+			"/api/v1/namespaces/default/services/https:metrics-server:https/proxy/metrics",
+			"/api/v1/namespaces/default/services/https%3Ametrics-server%3Ahttps/proxy/metrics",
+			"/api/v1/pods?labelSelector=app%3Dweb%2Ctier%20in%20%28a%2Cb%29",
+		}
+
+		for _, requestURI := range requestURIs {
+			By(fmt.Sprintf("Requesting %s", requestURI))
+			resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster%s", framework.GetHubHTTPAddr(), requestURI))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("/test-cluster" + requestURI))
+		}
+	})
 })
 
 var _ = Describe("TLS Connectivity", func() {
@@ -314,6 +349,7 @@ var _ = Describe("TLS Connectivity", func() {
 	AfterEach(func() {
 		if framework != nil {
 			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
 		}
 	})
 
@@ -357,3 +393,54 @@ var _ = Describe("TLS Connectivity", func() {
 		Expect(requests).To(HaveLen(1))
 	})
 })
+
+var _ = Describe("IPv6 Connectivity", func() {
+	var framework *TestFramework
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	DescribeTable("should establish tunnel connectivity on [::1]", func(useTLS bool) {
+		if !IPv6Available() {
+			Skip("IPv6 is not available")
+		}
+		framework = NewTestFrameworkWithGinkgo(useTLS).WithIPv6()
+		Expect(framework.Setup()).To(Succeed())
+		Expect(framework.GetHubGRPCAddr()).To(HavePrefix("[::1]:"))
+		Expect(framework.GetHubHTTPAddr()).To(HavePrefix("[::1]:"))
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from IPv6 backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mockServer.GetAddr()).To(HavePrefix("[::1]:"))
+
+		// The agent dials the IPv6 address of the Hub
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		scheme, transport := "http", &http.Transport{}
+		if useTLS {
+			scheme, transport.TLSClientConfig = "https", getTestClientTLSConfig()
+		}
+		defer transport.CloseIdleConnections()
+		client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+		resp, err := client.Get(fmt.Sprintf("%s://%s/test-cluster/api/v1/test", scheme, framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("Hello from IPv6 backend"))
+		Expect(mockServer.GetRequests()).To(HaveLen(1))
+	},
+		Entry("without TLS", false),
+		Entry("with TLS", true),
+	)
+})
@@ -0,0 +1,160 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Bodyless Responses", func() {
+	var framework *TestFramework
+
+	// bodylessHandler answers /204, /304 and /empty without body, and the other paths with a body
+	bodylessHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "204":
+			w.WriteHeader(http.StatusNoContent)
+		case "304":
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+		case "empty":
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Write([]byte("Hello from backend"))
+		}
+	}
+
+	// do sends the request on the client connection and reads its response
+	do := func(conn net.Conn, reader *bufio.Reader, method, path string) *http.Response {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", framework.GetHubHTTPAddr(), path), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Write(conn)).To(Succeed())
+		resp, err := http.ReadResponse(reader, req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+		// contentLength is the Content-Length header of the response, nil if it has none
+		contentLength []string
+	}{
+		{method: http.MethodHead, path: "/test-cluster/api/hello", status: http.StatusOK, contentLength: []string{"18"}},
+		{method: http.MethodGet, path: "/test-cluster/api/204", status: http.StatusNoContent},
+		{method: http.MethodGet, path: "/test-cluster/api/304", status: http.StatusNotModified},
+		{method: http.MethodGet, path: "/test-cluster/api/empty", status: http.StatusOK, contentLength: []string{"0"}},
+	}
+
+	Context("without response rewriting", func() {
+		BeforeEach(func() {
+			framework = NewTestFrameworkWithGinkgo(false)
+			Expect(framework.Setup()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			if framework != nil {
+				framework.Cleanup()
+				framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+			}
+		})
+
+		It("should keep the client connection alive after responses without body", func() {
+			mockServer, err := framework.CreateMockServer("backend", bodylessHandler)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+			time.Sleep(500 * time.Millisecond)
+
+			for _, c := range cases {
+				conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+				Expect(err).NotTo(HaveOccurred())
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				reader := bufio.NewReader(conn)
+
+				resp := do(conn, reader, c.method, c.path)
+				Expect(resp.StatusCode).To(Equal(c.status), "%s %s", c.method, c.path)
+				Expect(resp.Header.Values("Content-Length")).To(Equal(c.contentLength), "%s %s", c.method, c.path)
+				body, err := io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(body).To(BeEmpty(), "%s %s", c.method, c.path)
+				Expect(resp.Close).To(BeFalse(), "%s %s", c.method, c.path)
+
+				// The follow-up request is served on the same connection
+				resp = do(conn, reader, http.MethodGet, "/test-cluster/api/hello")
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				body, err = io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(body)).To(Equal("Hello from backend"), "follow-up of %s %s", c.method, c.path)
+				conn.Close()
+			}
+		})
+	})
+
+	Context("with response rewriting", func() {
+		BeforeEach(func() {
+			rewriter, err := server.NewHeaderResponseRewriter("")
+			Expect(err).NotTo(HaveOccurred())
+			framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+				config.ResponseRewriter = rewriter
+			})
+			Expect(framework.Setup()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			if framework != nil {
+				framework.Cleanup()
+				framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+			}
+		})
+
+		It("should close the client connection after responses without body", func() {
+			mockServer, err := framework.CreateMockServer("backend", bodylessHandler)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+			time.Sleep(500 * time.Millisecond)
+
+			for _, c := range cases {
+				conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+				Expect(err).NotTo(HaveOccurred())
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				reader := bufio.NewReader(conn)
+
+				// Only the first response of a connection is rewritten, it asks the client to close the connection
+				resp := do(conn, reader, c.method, c.path)
+				Expect(resp.StatusCode).To(Equal(c.status), "%s %s", c.method, c.path)
+				Expect(resp.Header.Values("Content-Length")).To(Equal(c.contentLength), "%s %s", c.method, c.path)
+				Expect(resp.Close).To(BeTrue(), "%s %s", c.method, c.path)
+				body, err := io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(body).To(BeEmpty(), "%s %s", c.method, c.path)
+
+				// The hub closes the connection instead of leaving the client waiting
+				_, err = reader.ReadByte()
+				Expect(err).To(MatchError(io.EOF), "%s %s", c.method, c.path)
+				conn.Close()
+
+				// The follow-up request is served on a new connection
+				conn, err = net.Dial("tcp", framework.GetHubHTTPAddr())
+				Expect(err).NotTo(HaveOccurred())
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				reader = bufio.NewReader(conn)
+				resp = do(conn, reader, http.MethodGet, "/test-cluster/api/hello")
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				body, err = io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(body)).To(Equal("Hello from backend"), "follow-up of %s %s", c.method, c.path)
+				conn.Close()
+			}
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/capture"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Packet Capture", func() {
+	var (
+		framework  *TestFramework
+		captureDir string
+	)
+
+	BeforeEach(func() {
+		captureDir = GinkgoT().TempDir()
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.CaptureDir = captureDir
+			config.CaptureMaxDataSize = 64 * 1024
+		})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should capture the connection with the Authorization header redacted", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()), nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer secret-token")
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("Hello from backend"))
+		client.CloseIdleConnections()
+
+		// The capture file is complete once the packet connection is closed
+		var streams map[capture.Direction][]byte
+		Eventually(func(g Gomega) {
+			files, err := filepath.Glob(filepath.Join(captureDir, "test-cluster-*.jsonl"))
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(files).To(HaveLen(1))
+
+			records, err := capture.ReadFile(files[0])
+			g.Expect(err).NotTo(HaveOccurred())
+			streams, err = capture.Reassemble(records)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(string(streams[capture.FromAgent])).To(HaveSuffix("Hello from backend"))
+		}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+
+		request := string(streams[capture.ToAgent])
+		Expect(request).To(HavePrefix("GET /test-cluster/api/v1/test HTTP/1.1\r\n"))
+		Expect(request).To(ContainSubstring("Authorization:" + strings.Repeat("*", len(" Bearer secret-token")) + "\r\n"))
+		Expect(request).NotTo(ContainSubstring("secret-token"))
+		Expect(string(streams[capture.FromAgent])).To(HavePrefix("HTTP/1.1 200 OK\r\n"))
+	})
+})
@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/certutil"
+)
+
+// httpsRouter routes the requests to a target over TLS
+type httpsRouter struct {
+	targetAddr string
+}
+
+func (r *httpsRouter) ParseTargetService(req *http.Request) (string, string, string, error) {
+	return "https", r.targetAddr, req.URL.EscapedPath(), nil
+}
+
+var _ = Describe("Agent CA Reload", func() {
+	var (
+		framework *TestFramework
+		backend   *httptest.Server
+		caPath    string
+		oldCA     *certutil.CA
+		newCA     *certutil.CA
+	)
+
+	BeforeEach(func() {
+		var err error
+		oldCA, err = certutil.NewCA(certutil.Options{CommonName: "Old CA"})
+		Expect(err).NotTo(HaveOccurred())
+		newCA, err = certutil.NewCA(certutil.Options{CommonName: "New CA"})
+		Expect(err).NotTo(HaveOccurred())
+
+		// The backend serves a certificate of the new CA, the agent trusts the old one first
+		keyPair, err := newCA.IssueServer("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := keyPair.TLSCertificate()
+		Expect(err).NotTo(HaveOccurred())
+		backend = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		}))
+		backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		backend.StartTLS()
+
+		dir := GinkgoT().TempDir()
+		caPath = filepath.Join(dir, "ca.crt")
+		Expect(os.WriteFile(caPath, oldCA.CertPEM, 0o600)).To(Succeed())
+
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithAgentConfig(func(config *agent.Config) {
+				config.Proxies = []agent.ProxySpec{{
+					Name:                "apiserver",
+					SocketPath:          filepath.Join(dir, "apiserver.sock"),
+					CertificateProvider: agent.NewFileWatchCertificateProvider(caPath),
+				}}
+			}).
+			WithAgentRouter(func(targetAddr string) agent.Router {
+				return &httpsRouter{targetAddr: targetAddr}
+			})
+		Expect(framework.Setup()).To(Succeed())
+		Expect(framework.CreateAgent("test-cluster", backend.Listener.Addr().String())).To(Succeed())
+		Eventually(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") != nil
+		}, 5*time.Second, 50*time.Millisecond).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		if backend != nil {
+			backend.Close()
+		}
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// get sends a request to the backend through the hub and returns the status and the body of the response
+	get := func() (int, string) {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/healthz", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	It("should trust the target once the CA file is rotated, without restarting the agent", func() {
+		status, _ := get()
+		Expect(status).To(Equal(http.StatusBadGateway))
+
+		Expect(os.WriteFile(caPath, newCA.CertPEM, 0o600)).To(Succeed())
+		Eventually(func() string {
+			status, body := get()
+			return fmt.Sprintf("%d %s", status, body)
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal("200 Hello from backend"))
+	})
+
+	It("should keep the current CA when the file is replaced with an invalid one", func() {
+		Expect(os.WriteFile(caPath, newCA.CertPEM, 0o600)).To(Succeed())
+		Eventually(func() int {
+			status, _ := get()
+			return status
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(http.StatusOK))
+
+		// The file is replaced with a rename, as the kubelet and cert-manager do
+		tmpPath := caPath + ".tmp"
+		Expect(os.WriteFile(tmpPath, []byte("not a certificate"), 0o600)).To(Succeed())
+		Expect(os.Rename(tmpPath, caPath)).To(Succeed())
+		Consistently(func() int {
+			status, _ := get()
+			return status
+		}, time.Second, 100*time.Millisecond).Should(Equal(http.StatusOK))
+
+		Expect(os.WriteFile(tmpPath, oldCA.CertPEM, 0o600)).To(Succeed())
+		Expect(os.Rename(tmpPath, caPath)).To(Succeed())
+		Eventually(func() int {
+			status, _ := get()
+			return status
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(http.StatusBadGateway))
+	})
+})
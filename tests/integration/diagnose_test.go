@@ -0,0 +1,90 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+)
+
+// poolCertificateProvider returns a fixed pool of root CAs
+type poolCertificateProvider struct {
+	pool *x509.CertPool
+}
+
+func (p *poolCertificateProvider) GetRootCAs() (*x509.CertPool, error) {
+	return p.pool, nil
+}
+
+var _ = Describe("Agent Diagnostics", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(true)
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") != nil
+		}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should pass every check without replacing the tunnel of the running agent", func() {
+		apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer apiServer.Close()
+		apiServerRoots := x509.NewCertPool()
+		apiServerRoots.AddCert(apiServer.Certificate())
+
+		tunnel := framework.GetHubServer().GetTunnel("test-cluster")
+
+		hubTLSConfig := getTestClientTLSConfig()
+		report, err := agent.Diagnose(context.Background(), &agent.DiagnoseConfig{
+			Agent: &agent.Config{
+				HubAddress:    framework.GetHubGRPCAddr(),
+				ClusterName:   "test-cluster",
+				UDSSocketPath: filepath.Join(GinkgoT().TempDir(), "proxy.sock"),
+				DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(hubTLSConfig))},
+			},
+			HubTLSConfig:        hubTLSConfig,
+			CertificateProvider: &poolCertificateProvider{pool: apiServerRoots},
+			APIServerAddress:    apiServer.Listener.Addr().String(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var out bytes.Buffer
+		report.Print(&out)
+		GinkgoWriter.Println(out.String())
+		for _, check := range report.Checks {
+			Expect(check.Status).To(Equal(agent.CheckPassed), "%s: %s", check.Name, check.Message)
+		}
+		Expect(report.Passed()).To(BeTrue())
+		Expect(report.Checks).To(HaveLen(6))
+		Expect(out.String()).NotTo(ContainSubstring("FAIL"))
+
+		// The diagnostic stream is not registered as the tunnel of the cluster
+		Consistently(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") == tunnel
+		}, time.Second, 100*time.Millisecond).Should(BeTrue())
+	})
+})
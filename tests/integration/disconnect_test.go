@@ -0,0 +1,126 @@
+package integration
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Cluster Disconnect", func() {
+	const adminToken = "test-admin-token"
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.AdminAuthenticator = server.NewTokenAuthenticator(adminToken)
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		// The backend answers /slow 2s after receiving the request, so it's in flight during the disconnect
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/test-cluster/slow" {
+				select {
+				case <-time.After(2 * time.Second):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// disconnect sends the admin request to disconnect the cluster
+	disconnect := func(clusterName, token string) *http.Response {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/admin/tunnels/%s/disconnect?reason=stuck",
+			framework.GetHubHTTPAddr(), clusterName), nil)
+		Expect(err).NotTo(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		// A connection dialed while the previous one was reused stays idle, the hub would wait for it on shutdown
+		defer http.DefaultClient.CloseIdleConnections()
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		return resp
+	}
+
+	get := func(path string) (int, string) {
+		client := &http.Client{Timeout: 10 * time.Second}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster%s", framework.GetHubHTTPAddr(), path))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	It("should fail in-flight requests and serve traffic after the agent reconnects", func() {
+		firstTunnel := framework.GetHubServer().GetTunnel("test-cluster")
+		Expect(firstTunnel).NotTo(BeNil())
+
+		type result struct {
+			status int
+			body   string
+		}
+		inFlight := make(chan result, 1)
+		go func() {
+			defer GinkgoRecover()
+			status, body := get("/slow")
+			inFlight <- result{status, body}
+		}()
+
+		time.Sleep(300 * time.Millisecond)
+		Expect(disconnect("test-cluster", adminToken).StatusCode).To(Equal(http.StatusNoContent))
+
+		var r result
+		Eventually(inFlight, 5*time.Second).Should(Receive(&r))
+		Expect(r.status).To(Equal(http.StatusBadGateway))
+		Expect(r.body).To(ContainSubstring("tunnel disconnected by hub: stuck"))
+
+		// The agent reconnects with a new tunnel
+		Eventually(func() bool {
+			tun := framework.GetHubServer().GetTunnel("test-cluster")
+			return tun != nil && tun.ID() != firstTunnel.ID()
+		}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+
+		status, body := get("/api/v1/test")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+	})
+
+	It("should reject unauthenticated admin requests", func() {
+		Expect(disconnect("test-cluster", "").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(disconnect("test-cluster", "wrong-token").StatusCode).To(Equal(http.StatusUnauthorized))
+
+		// The tunnel is untouched
+		status, _ := get("/api/v1/test")
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	It("should report clusters without a tunnel", func() {
+		Expect(disconnect("other-cluster", adminToken).StatusCode).To(Equal(http.StatusNotFound))
+
+		err := framework.GetHubServer().DisconnectCluster("other-cluster", "stuck")
+		Expect(errors.Is(err, server.ErrTunnelNotFound)).To(BeTrue())
+	})
+})
@@ -0,0 +1,77 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Graceful Agent Drain", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should complete the in-flight requests before the agent stops", func() {
+		var received atomic.Int32
+		mockServer, err := framework.CreateMockServer("slow-backend", func(w http.ResponseWriter, r *http.Request) {
+			received.Add(1)
+			time.Sleep(time.Second)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Slow response " + r.URL.Query().Get("id")))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") != nil
+		}, 3*time.Second, 50*time.Millisecond).Should(BeTrue())
+
+		const requests = 5
+		client := &http.Client{Timeout: 10 * time.Second}
+		var wg sync.WaitGroup
+		statusCodes := make([]int, requests)
+		bodies := make([]string, requests)
+		errs := make([]error, requests)
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/slow?id=%d", framework.GetHubHTTPAddr(), i))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				statusCodes[i], bodies[i], errs[i] = resp.StatusCode, string(body), err
+			}(i)
+		}
+
+		// The agent is drained while the backend serves all the requests
+		Eventually(received.Load, 3*time.Second, 10*time.Millisecond).Should(BeEquivalentTo(requests))
+		Expect(framework.DrainAndWait("test-cluster", 5*time.Second)).To(Succeed())
+		wg.Wait()
+
+		for i := 0; i < requests; i++ {
+			Expect(errs[i]).NotTo(HaveOccurred(), "request %d", i)
+			Expect(statusCodes[i]).To(Equal(http.StatusOK), "request %d", i)
+			Expect(bodies[i]).To(Equal(fmt.Sprintf("Slow response %d", i)), "request %d", i)
+		}
+	})
+})
@@ -2,6 +2,7 @@ package integration
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,41 +11,50 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
 )
 
 var _ = Describe("Error Handling", func() {
 	var framework *TestFramework
 
 	BeforeEach(func() {
-		framework = NewTestFrameworkWithGinkgo(false)
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithInMemoryNetwork().
+			WithClusterNameParser(server.NewClusterNameParserImplt())
 		Expect(framework.Setup()).To(Succeed())
 	})
 
 	AfterEach(func() {
 		if framework != nil {
 			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
 		}
 	})
 
-	It("should return bad request for non-existent clusters", func() {
+	It("should return service unavailable for clusters without a tunnel", func() {
 		// Don't create any agents, so no clusters are available
-
-		// Send a request to a non-existent cluster
-		resp, err := http.Get(fmt.Sprintf("http://%s/non-existent-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+		resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
 		Expect(err).NotTo(HaveOccurred())
 		defer resp.Body.Close()
 
-		// Should get a bad request error since no route is configured
-		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
-
-		body, err := io.ReadAll(resp.Body)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(string(body)).To(ContainSubstring("Failed to parse cluster name and target address from request"))
+		// The hub never had a tunnel of the cluster, the agents reconnect with a backoff
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(resp.Header.Get("Retry-After")).To(Equal("5"))
+
+		var body server.ClusterUnavailable
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body).To(Equal(server.ClusterUnavailable{
+			Cluster:           "test-cluster",
+			Reason:            server.ReasonNoTunnel,
+			RetryAfterSeconds: 5,
+			Message:           "Cluster test-cluster not available",
+		}))
 	})
 
 	It("should return bad gateway when backend service is unavailable", func() {
 		// Create an agent that routes to a non-existent backend
-		err := framework.CreateAgent("test-cluster", "localhost:99999") // Non-existent port
+		err := framework.CreateAgent("test-cluster", "backend.memnet:80") // No in-memory listener on this address
 		Expect(err).NotTo(HaveOccurred())
 
 		// Wait for agent to connect
@@ -62,8 +72,12 @@ var _ = Describe("Error Handling", func() {
 	It("should handle request timeout scenarios", func() {
 		// Create a mock backend server that hangs
 		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
-			// Hang for longer than the client timeout
-			time.Sleep(35 * time.Second)
+			// Hang for longer than the client timeout, but stop once the request is gone
+			select {
+			case <-time.After(35 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Too late"))
 		})
@@ -142,14 +156,44 @@ var _ = Describe("Error Handling", func() {
 		}
 	})
 
+	It("should cancel the backend request when the client disconnects", func() {
+		// Create a mock backend server that hangs until its request is canceled
+		canceled := make(chan struct{})
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				close(canceled)
+			case <-time.After(10 * time.Second):
+				w.WriteHeader(http.StatusOK)
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Create an agent
+		err = framework.CreateAgent("test-cluster", mockServer.GetAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		// Wait for agent to connect
+		time.Sleep(500 * time.Millisecond)
+
+		// The client gives up while the backend is still handling the request
+		client := &http.Client{Timeout: 500 * time.Millisecond}
+		_, err = client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+		Expect(err).To(HaveOccurred())
+
+		// The agent closes its connection to the backend without waiting for the backend to respond
+		Eventually(canceled, 2*time.Second).Should(BeClosed())
+	})
+
 	It("should handle requests with invalid cluster names", func() {
+		// The cluster name is the first segment of the path, duplicate slashes are collapsed
 		testCases := []struct {
 			name string
 			path string
 		}{
 			{"empty path", "/"},
-			{"no cluster name", "/api/v1/test"},
-			{"empty cluster name", "//api/v1/test"},
+			{"empty cluster name", "//"},
+			{"query only", "/?cluster=test-cluster"},
 		}
 
 		for _, tc := range testCases {
@@ -9,14 +9,18 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/backoff/v5"
+	"github.com/gorilla/websocket"
 	"github.com/onsi/ginkgo/v2"
 	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
 	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"go.uber.org/goleak"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
@@ -31,13 +35,21 @@ type TestingInterface interface {
 
 // TestFramework provides a complete testing environment for integration tests
 type TestFramework struct {
-	t           TestingInterface
-	ctx         context.Context
-	cancel      context.CancelFunc
-	hubServer   *server.Server
-	agents      map[string]*agent.Agent
-	mockServers map[string]*MockServer
-	mu          sync.RWMutex
+	t         TestingInterface
+	ctx       context.Context
+	cancel    context.CancelFunc
+	hubServer *server.Server
+	agents    map[string]*agent.Agent
+	// agentCancels stop the agents, agentDone are closed once they stopped
+	agentCancels map[string]context.CancelFunc
+	agentDone    map[string]chan struct{}
+	mockServers  map[string]*MockServer
+	// mockGRPCServers are the Hubs replaced by mock gRPC servers, see CreateMockGRPCServer
+	mockGRPCServers map[string]*MockGRPCServer
+	mu              sync.RWMutex
+
+	// ignoreCurrentGoroutines snapshots the goroutines running before the framework started anything
+	ignoreCurrentGoroutines goleak.Option
 
 	// Configuration
 	hubGRPCAddr   string
@@ -45,6 +57,21 @@ type TestFramework struct {
 	useTLS        bool
 	grpcTLSConfig *tls.Config
 	httpTLSConfig *tls.Config
+
+	// serverConfigFn customizes the Hub server configuration before the server is created
+	serverConfigFn func(*server.Config)
+	// grpcServerFn is called with the Hub gRPC server before it starts, e.g. to register additional services
+	grpcServerFn func(*grpc.Server)
+	// agentConfigFn customizes the configuration of the agents created by CreateAgent
+	agentConfigFn func(*agent.Config)
+	// agentRouterFn creates the router of the agents created by CreateAgent, defaults to TestRouter
+	agentRouterFn func(targetAddr string) agent.Router
+	// clusterNameParser is used by the Hub server, defaults to TestClusterNameParser
+	clusterNameParser server.ClusterNameParser
+	// ipv6 runs the Hub and the mock servers on [::1] instead of 127.0.0.1, see WithIPv6
+	ipv6 bool
+	// inMemory runs the Hub and the mock servers on in-memory listeners instead of TCP, see WithInMemoryNetwork
+	inMemory bool
 }
 
 // Note: The server now handles routing internally by parsing cluster names from URLs
@@ -58,6 +85,12 @@ type MockServer struct {
 	handler  http.HandlerFunc
 	mu       sync.RWMutex
 	requests []MockRequest
+	// wsHandlers are the WebSocket handlers registered with ServeWebSocket by path, and wsMessages the messages
+	// they exchanged
+	wsHandlers map[string]func(*websocket.Conn)
+	wsMessages []MockWebSocketMessage
+	// wsConns are the open WebSocket connections, the shutdown of the server doesn't close hijacked connections
+	wsConns map[*websocket.Conn]struct{}
 }
 
 // MockRequest captures details of received requests
@@ -101,7 +134,7 @@ func (r *TestRouter) ParseTargetService(req *http.Request) (targetproto, targeth
 	}
 
 	// For testing, we assume the target address is in the format "host:port"
-	return "http", r.targetAddr, req.URL.Path, nil
+	return "http", r.targetAddr, req.URL.EscapedPath(), nil
 }
 
 func (r *TestRouter) SetTargetAddr(addr string) {
@@ -197,14 +230,20 @@ func NewTestFramework(t TestingInterface, useTLS bool) *TestFramework {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	framework := &TestFramework{
-		t:           t,
-		ctx:         ctx,
-		cancel:      cancel,
-		agents:      make(map[string]*agent.Agent),
-		mockServers: make(map[string]*MockServer),
-		useTLS:      useTLS,
-		hubGRPCAddr: "localhost:0", // Use random port
-		hubHTTPAddr: "localhost:0", // Use random port
+		t:            t,
+		ctx:          ctx,
+		cancel:       cancel,
+		agents:       make(map[string]*agent.Agent),
+		agentCancels: make(map[string]context.CancelFunc),
+		agentDone:    make(map[string]chan struct{}),
+		mockServers:  make(map[string]*MockServer),
+		useTLS:       useTLS,
+		hubGRPCAddr:  "localhost:0", // Use random port
+		hubHTTPAddr:  "localhost:0", // Use random port
+
+		mockGRPCServers: make(map[string]*MockGRPCServer),
+
+		ignoreCurrentGoroutines: goleak.IgnoreCurrent(),
 	}
 
 	if useTLS {
@@ -238,6 +277,70 @@ func NewTestFrameworkWithGinkgo(useTLS bool) *TestFramework {
 	return NewTestFramework(&GinkgoTestingAdapter{ginkgo.GinkgoT()}, useTLS)
 }
 
+// WithServerConfig registers a function to customize the Hub server configuration, must be called before Setup
+func (f *TestFramework) WithServerConfig(fn func(*server.Config)) *TestFramework {
+	f.serverConfigFn = fn
+	return f
+}
+
+// WithGRPCServer registers a function called with the Hub gRPC server before it starts, must be called before Setup
+func (f *TestFramework) WithGRPCServer(fn func(*grpc.Server)) *TestFramework {
+	f.grpcServerFn = fn
+	return f
+}
+
+// WithAgentConfig registers a function to customize the configuration of the agents created by CreateAgent
+func (f *TestFramework) WithAgentConfig(fn func(*agent.Config)) *TestFramework {
+	f.agentConfigFn = fn
+	return f
+}
+
+// WithAgentRouter registers a function creating the router of the agents created by CreateAgent for their target
+func (f *TestFramework) WithAgentRouter(fn func(targetAddr string) agent.Router) *TestFramework {
+	f.agentRouterFn = fn
+	return f
+}
+
+// WithClusterNameParser sets the ClusterNameParser used by the Hub server, must be called before Setup
+func (f *TestFramework) WithClusterNameParser(parser server.ClusterNameParser) *TestFramework {
+	f.clusterNameParser = parser
+	return f
+}
+
+// WithIPv6 runs the Hub, with the tcp6 ListenNetwork, and the mock servers on [::1], the agents dial the Hub at its
+// IPv6 address. Must be called before Setup, the specs should skip when IPv6Available returns false
+func (f *TestFramework) WithIPv6() *TestFramework {
+	f.ipv6 = true
+	return f
+}
+
+// WithInMemoryNetwork runs the Hub and the mock servers on in-memory listeners, the agents dial them and the specs
+// reach them with http.DefaultTransport without opening a TCP port. The agents only resolve the in-memory addresses.
+// Must be called before Setup, it can't be combined with WithIPv6, and the specs must not dial the addresses with
+// dialers of their own, e.g. net.Dial
+func (f *TestFramework) WithInMemoryNetwork() *TestFramework {
+	f.inMemory = true
+	return f
+}
+
+// IPv6Available returns whether the IPv6 loopback address can be listened on, it isn't in some CI environments
+func IPv6Available() bool {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// localAddr returns the address of a random port on the loopback address the framework runs on
+func (f *TestFramework) localAddr() string {
+	if f.ipv6 {
+		return "[::1]:0"
+	}
+	return "127.0.0.1:0"
+}
+
 // Setup initializes the test environment
 func (f *TestFramework) Setup() error {
 	// Create and start the real Hub server
@@ -277,6 +380,11 @@ func (f *TestFramework) Cleanup() {
 		server.Stop()
 	}
 
+	for name, server := range f.mockGRPCServers {
+		klog.InfoS("Stopping mock gRPC server", "name", name)
+		server.Stop()
+	}
+
 	// Stop Hub server (this will stop both gRPC and HTTP servers)
 	if f.hubServer != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -285,6 +393,22 @@ func (f *TestFramework) Cleanup() {
 	}
 }
 
+// AssertNoGoroutineLeak fails the test if goroutines started since the framework was created are still running.
+// It should be called after Cleanup.
+func (f *TestFramework) AssertNoGoroutineLeak(t TestingInterface) {
+	err := goleak.Find(
+		f.ignoreCurrentGoroutines,
+		// klog flushes logs in a long-lived daemon goroutine started on first use
+		goleak.IgnoreTopFunction("k8s.io/klog/v2.(*flushDaemon).run.func1"),
+		// Idle keep-alive connections of http.DefaultTransport used by the tests to send requests
+		goleak.IgnoreAnyFunction("net/http.(*persistConn).readLoop"),
+		goleak.IgnoreAnyFunction("net/http.(*persistConn).writeLoop"),
+	)
+	if err != nil {
+		t.Errorf("Goroutine leak detected: %v", err)
+	}
+}
+
 // GetHubGRPCAddr returns the actual gRPC server address
 func (f *TestFramework) GetHubGRPCAddr() string {
 	// For now, we'll use the configured address
@@ -299,14 +423,25 @@ func (f *TestFramework) GetHubHTTPAddr() string {
 	return f.hubHTTPAddr
 }
 
+// GetHubServer returns the Hub server, nil before Setup
+func (f *TestFramework) GetHubServer() *server.Server {
+	return f.hubServer
+}
+
 // CreateMockServer creates a new mock backend server
 func (f *TestFramework) CreateMockServer(name string, handler http.HandlerFunc) (*MockServer, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	listener, err := net.Listen("tcp", "localhost:0")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create listener: %w", err)
+	var listener net.Listener
+	if f.inMemory {
+		listener = memNet.Listen(name)
+	} else {
+		var err error
+		listener, err = net.Listen("tcp", f.localAddr())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create listener: %w", err)
+		}
 	}
 
 	mockServer := &MockServer{
@@ -329,8 +464,13 @@ func (f *TestFramework) CreateMockServer(name string, handler http.HandlerFunc)
 			Body:      body,
 			Timestamp: time.Now(),
 		})
+		wsHandler := mockServer.wsHandlers[r.URL.Path]
 		mockServer.mu.Unlock()
 
+		if wsHandler != nil {
+			mockServer.serveWebSocket(w, r, wsHandler)
+			return
+		}
 		if handler != nil {
 			handler(w, r)
 		} else {
@@ -355,14 +495,21 @@ func (f *TestFramework) CreateMockServer(name string, handler http.HandlerFunc)
 
 // CreateAgent creates and starts a new agent client
 func (f *TestFramework) CreateAgent(clusterName string, targetAddr string) error {
+	return f.CreateAgentWithHubAddress(clusterName, targetAddr, f.hubGRPCAddr)
+}
+
+// CreateAgentWithHubAddress creates and starts a new agent client connecting to another Hub, e.g. a MockGRPCServer
+func (f *TestFramework) CreateAgentWithHubAddress(clusterName, targetAddr, hubAddress string) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	// Note: The server now handles routing internally, no need to set cluster routes
 
 	config := &agent.Config{
-		HubAddress:  f.hubGRPCAddr,
+		HubAddress:  hubAddress,
 		ClusterName: clusterName,
+		// Each agent listens on its own socket, the agents of several clusters would take over each other's otherwise
+		UDSSocketPath: filepath.Join(os.TempDir(), fmt.Sprintf("multiclustertunnel-%d-%s.sock", os.Getpid(), clusterName)),
 		BackoffFactory: func() backoff.BackOff {
 			// Use a shorter backoff for tests to avoid hanging
 			b := backoff.NewExponentialBackOff()
@@ -381,36 +528,129 @@ func (f *TestFramework) CreateAgent(clusterName string, targetAddr string) error
 			grpc.WithTransportCredentials(insecure.NewCredentials()))
 	}
 
+	if f.inMemory {
+		// The passthrough resolver hands the address to the dialer as is, instead of resolving its fake host name
+		config.HubAddress = "passthrough:///" + hubAddress
+		config.ContextDialer = memNet.dialHub
+		config.DialContextFn = memNet.dialMemory
+	}
+
+	if f.agentConfigFn != nil {
+		f.agentConfigFn(config)
+	}
+
 	// Create test components for the agent
 	requestProcessor := &TestRequestProcessor{}
 	certProvider := &TestCertificateProvider{}
-	router := &TestRouter{}
-	router.SetTargetAddr(targetAddr)
+	var router agent.Router
+	if f.agentRouterFn != nil {
+		router = f.agentRouterFn(targetAddr)
+	} else {
+		testRouter := &TestRouter{}
+		testRouter.SetTargetAddr(targetAddr)
+		router = testRouter
+	}
+
+	// Each agent runs until the framework is cleaned up or the agent is stopped by DrainAndWait
+	ctx, cancel := context.WithCancel(f.ctx)
+	done := make(chan struct{})
 
 	// Create the agent with the new architecture
-	agentClient := agent.New(f.ctx, config, requestProcessor, certProvider, router)
+	agentClient := agent.New(ctx, config, requestProcessor, certProvider, router)
 
 	// Start the agent
 	go func() {
-		if err := agentClient.Run(f.ctx); err != nil {
+		defer close(done)
+		if err := agentClient.Run(ctx); err != nil {
 			// Only log error if context is not cancelled (test not finished)
-			if f.ctx.Err() == nil {
+			if ctx.Err() == nil {
 				f.t.Errorf("Agent %s failed: %v", clusterName, err)
 			}
 		}
 	}()
 
 	f.agents[clusterName] = agentClient
+	f.agentCancels[clusterName] = cancel
+	f.agentDone[clusterName] = done
 	return nil
 }
 
+// GetAgent returns the agent created for the cluster, or nil if there is none
+func (f *TestFramework) GetAgent(clusterName string) *agent.Agent {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.agents[clusterName]
+}
+
+// DrainAndWait stops the agent of the cluster gracefully: the agent drains its tunnel, waits for the in-flight
+// requests to complete and is then stopped. It returns once the agent stopped, or an error if it didn't drain within
+// timeout
+func (f *TestFramework) DrainAndWait(clusterName string, timeout time.Duration) error {
+	f.mu.Lock()
+	agentClient := f.agents[clusterName]
+	cancel := f.agentCancels[clusterName]
+	done := f.agentDone[clusterName]
+	delete(f.agents, clusterName)
+	delete(f.agentCancels, clusterName)
+	delete(f.agentDone, clusterName)
+	f.mu.Unlock()
+	if agentClient == nil {
+		return fmt.Errorf("no agent for cluster %s", clusterName)
+	}
+
+	ctx, cancelDrain := context.WithTimeout(f.ctx, timeout)
+	defer cancelDrain()
+	drainErr := agentClient.Drain(ctx)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return fmt.Errorf("agent %s didn't stop within %s", clusterName, timeout)
+	}
+	if drainErr != nil {
+		return fmt.Errorf("failed to drain agent %s: %w", clusterName, drainErr)
+	}
+	return nil
+}
+
+// StopAgent stops the agent of the cluster without draining it, the agent closes its connections to the proxies
+// before it stops. It returns once the agent stopped, or an error if it didn't stop within timeout
+func (f *TestFramework) StopAgent(clusterName string, timeout time.Duration) error {
+	f.mu.Lock()
+	cancel := f.agentCancels[clusterName]
+	done := f.agentDone[clusterName]
+	delete(f.agents, clusterName)
+	delete(f.agentCancels, clusterName)
+	delete(f.agentDone, clusterName)
+	f.mu.Unlock()
+	if cancel == nil {
+		return fmt.Errorf("no agent for cluster %s", clusterName)
+	}
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("agent %s didn't stop within %s", clusterName, timeout)
+	}
+}
+
 // startHubServer starts the real Hub server
 func (f *TestFramework) startHubServer() error {
 
 	// Create hub server configuration with random ports
 	config := &server.Config{
-		GRPCListenAddress: "127.0.0.1:0", // Let the server pick a random port
-		HTTPListenAddress: "127.0.0.1:0", // Let the server pick a random port
+		GRPCListenAddress: f.localAddr(), // Let the server pick a random port
+		HTTPListenAddress: f.localAddr(), // Let the server pick a random port
+	}
+	if f.ipv6 {
+		config.ListenNetwork = "tcp6"
+	}
+	if f.inMemory {
+		config.GRPCListener = memNet.Listen("hub-grpc")
+		config.HTTPListener = memNet.Listen("hub-http")
 	}
 
 	// Add TLS configuration if needed
@@ -420,13 +660,31 @@ func (f *TestFramework) startHubServer() error {
 		klog.InfoS("Configuring Hub server with TLS")
 	}
 
+	if f.serverConfigFn != nil {
+		f.serverConfigFn(config)
+	}
+
 	// Create the hub server
 	var err error
-	f.hubServer, err = server.New(config, &TestClusterNameParser{})
+	parser := f.clusterNameParser
+	if parser == nil {
+		parser = &TestClusterNameParser{}
+	}
+	f.hubServer, err = server.New(config, parser)
 	if err != nil {
+		// The server only owns its listeners once it runs
+		for _, listener := range []net.Listener{config.GRPCListener, config.HTTPListener} {
+			if listener != nil {
+				listener.Close()
+			}
+		}
 		return fmt.Errorf("failed to create hub server: %w", err)
 	}
 
+	if f.grpcServerFn != nil {
+		f.grpcServerFn(f.hubServer.GRPCServer())
+	}
+
 	// Start the hub server in a goroutine
 	go func() {
 		if err := f.hubServer.Run(f.ctx); err != nil {
@@ -465,6 +723,7 @@ func (m *MockServer) Stop() {
 	if m.listener != nil {
 		m.listener.Close()
 	}
+	m.closeWebSockets()
 }
 
 // GetAddr returns the server address
@@ -489,7 +748,29 @@ func (m *MockServer) ClearRequests() {
 	m.requests = m.requests[:0]
 }
 
+// AssertRequestHeaders asserts that the index-th captured request has the expected header values, the other headers
+// are ignored
+func (m *MockServer) AssertRequestHeaders(t TestingInterface, index int, expected map[string]string) {
+	requests := m.GetRequests()
+	if index < 0 || index >= len(requests) {
+		t.Errorf("Expected request %d to be captured, got %d requests", index, len(requests))
+		return
+	}
+	for header, value := range expected {
+		if len(requests[index].Headers.Values(header)) == 0 {
+			t.Errorf("Expected header %s of request %d to be %q, it's missing", header, index, value)
+		} else if got := requests[index].Headers.Get(header); got != value {
+			t.Errorf("Expected header %s of request %d to be %q, got %q", header, index, value, got)
+		}
+	}
+}
+
+// AssertLastRequestHeader asserts that the last captured request has the header value
+func (m *MockServer) AssertLastRequestHeader(t TestingInterface, header, value string) {
+	m.AssertRequestHeaders(t, len(m.GetRequests())-1, map[string]string{header: value})
+}
+
 // GetGRPCListener creates a new gRPC listener for custom testing
 func (f *TestFramework) GetGRPCListener() (net.Listener, error) {
-	return net.Listen("tcp", "127.0.0.1:0")
+	return net.Listen("tcp", f.localAddr())
 }
@@ -0,0 +1,202 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// echoServiceDesc is a gRPC echo service with a unary and a bidirectional streaming method
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			in := new(wrapperspb.StringValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if in.Value == "fail" {
+				return nil, status.Error(codes.InvalidArgument, "echo failed")
+			}
+			md, _ := metadata.FromIncomingContext(ctx)
+			return wrapperspb.String(in.Value + strings.Join(md.Get("suffix"), "")), nil
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "EchoStream",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(_ any, stream grpc.ServerStream) error {
+			for {
+				in := new(wrapperspb.StringValue)
+				if err := stream.RecvMsg(in); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := stream.SendMsg(in); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+// clusterPrefixInterceptors prefix the method paths of the gRPC calls with the cluster, so that the Hub routes
+// them to its agent
+func clusterPrefixInterceptors(cluster string) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(ctx, "/"+cluster+method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(ctx, desc, cc, "/"+cluster+method, opts...)
+		}),
+	}
+}
+
+// stripClusterRouter routes the requests to the target without the cluster prefix of their path
+type stripClusterRouter struct {
+	targetAddr string
+}
+
+func (r *stripClusterRouter) ParseTargetService(req *http.Request) (string, string, string, error) {
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/test-cluster")
+	return "http", r.targetAddr, path, nil
+}
+
+// callEcho calls the unary and the streaming method of the echo service through the Hub
+func callEcho(conn *grpc.ClientConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reply := new(wrapperspb.StringValue)
+	ctx = metadata.AppendToOutgoingContext(ctx, "suffix", "!")
+	Expect(conn.Invoke(ctx, "/test.Echo/Echo", wrapperspb.String("hello"), reply)).To(Succeed())
+	Expect(reply.Value).To(Equal("hello!"))
+
+	// The status of failed calls is carried by the trailers
+	err := conn.Invoke(ctx, "/test.Echo/Echo", wrapperspb.String("fail"), reply)
+	Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	Expect(status.Convert(err).Message()).To(Equal("echo failed"))
+
+	stream, err := conn.NewStream(ctx, &echoServiceDesc.Streams[0], "/test.Echo/EchoStream")
+	Expect(err).NotTo(HaveOccurred())
+	for _, msg := range []string{"one", "two", "three"} {
+		Expect(stream.SendMsg(wrapperspb.String(msg))).To(Succeed())
+		in := new(wrapperspb.StringValue)
+		Expect(stream.RecvMsg(in)).To(Succeed())
+		Expect(in.Value).To(Equal(msg))
+	}
+	Expect(stream.CloseSend()).To(Succeed())
+	Expect(stream.RecvMsg(new(wrapperspb.StringValue))).To(Equal(io.EOF))
+}
+
+var _ = Describe("gRPC Through The Tunnel", func() {
+	var framework *TestFramework
+	var echoServer *grpc.Server
+	var echoAddr string
+
+	BeforeEach(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		echoServer = grpc.NewServer()
+		echoServer.RegisterService(&echoServiceDesc, nil)
+		go echoServer.Serve(listener)
+		echoAddr = listener.Addr().String()
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			echoServer.Stop()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	setupFramework := func(useTLS bool) {
+		framework = NewTestFrameworkWithGinkgo(useTLS).
+			WithServerConfig(func(config *server.Config) {
+				config.EnableHTTP2 = true
+			}).
+			WithAgentRouter(func(targetAddr string) agent.Router {
+				return &stripClusterRouter{targetAddr: targetAddr}
+			})
+		Expect(framework.Setup()).To(Succeed())
+		Expect(framework.CreateAgent("test-cluster", echoAddr)).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	It("should serve gRPC calls from clients over h2c", func() {
+		setupFramework(false)
+
+		conn, err := grpc.NewClient(framework.GetHubHTTPAddr(), append(clusterPrefixInterceptors("test-cluster"),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		callEcho(conn)
+	})
+
+	It("should serve gRPC calls from clients over TLS", func() {
+		setupFramework(true)
+
+		clientTLSConfig := getTestClientTLSConfig()
+		conn, err := grpc.NewClient(framework.GetHubHTTPAddr(), append(clusterPrefixInterceptors("test-cluster"),
+			grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))...)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		callEcho(conn)
+	})
+
+	It("should keep serving HTTP/1.1 and HTTP/2 requests to HTTP/1.1 targets", func() {
+		framework = NewTestFrameworkWithGinkgo(true).
+			WithServerConfig(func(config *server.Config) {
+				config.EnableHTTP2 = true
+			})
+		Expect(framework.Setup()).To(Succeed())
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello over " + r.Proto))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		for _, forceHTTP2 := range []bool{false, true} {
+			transport := &http.Transport{TLSClientConfig: getTestClientTLSConfig(), ForceAttemptHTTP2: forceHTTP2}
+			if !forceHTTP2 {
+				transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			}
+			client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+			resp, err := client.Get("https://" + framework.GetHubHTTPAddr() + "/test-cluster/hello")
+			Expect(err).NotTo(HaveOccurred())
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			transport.CloseIdleConnections()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.ProtoMajor).To(Equal(map[bool]int{false: 1, true: 2}[forceHTTP2]))
+			// The agent forwards the requests to the target with HTTP/1.1
+			Expect(string(body)).To(Equal("Hello over HTTP/1.1"))
+		}
+	})
+})
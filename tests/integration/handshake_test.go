@@ -0,0 +1,89 @@
+package integration
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+var _ = Describe("Tunnel Handshake Timeout", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.TunnelHandshakeTimeout = time.Second
+		})
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should close the tunnel of an agent that sends no packets", func() {
+		Expect(framework.Setup()).To(Succeed())
+
+		conn, err := grpc.NewClient(framework.GetHubGRPCAddr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "cluster-name", "silent-cluster")
+		stream, err := v1.NewTunnelServiceClient(conn).Tunnel(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() *server.Tunnel {
+			return framework.GetHubServer().GetTunnel("silent-cluster")
+		}, 2*time.Second, 50*time.Millisecond).ShouldNot(BeNil())
+
+		// The hub ends the stream once the handshake timeout fires
+		start := time.Now()
+		recvErr := make(chan error, 1)
+		go func() {
+			for {
+				if _, err := stream.Recv(); err != nil {
+					recvErr <- err
+					return
+				}
+			}
+		}()
+		var streamErr error
+		Eventually(recvErr, 5*time.Second).Should(Receive(&streamErr))
+		Expect(streamErr.Error()).To(ContainSubstring("handshake timeout"))
+		Expect(time.Since(start)).To(BeNumerically("<", 3*time.Second))
+		Expect(framework.GetHubServer().GetTunnel("silent-cluster")).To(BeNil())
+	})
+
+	It("should keep the tunnel of an agent without pings", func() {
+		framework.WithAgentConfig(func(config *agent.Config) {
+			config.PingInterval = -1
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		Expect(framework.CreateAgent("test-cluster", "localhost:0")).To(Succeed())
+		var tun *server.Tunnel
+		Eventually(func() *server.Tunnel {
+			tun = framework.GetHubServer().GetTunnel("test-cluster")
+			return tun
+		}, 2*time.Second, 50*time.Millisecond).ShouldNot(BeNil())
+
+		// The agent sends a PING right after it connects
+		Consistently(func() string {
+			if t := framework.GetHubServer().GetTunnel("test-cluster"); t != nil {
+				return t.ID()
+			}
+			return ""
+		}, 2*time.Second, 100*time.Millisecond).Should(Equal(tun.ID()))
+	})
+})
@@ -0,0 +1,142 @@
+package integration
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("HTTP Server Timeouts", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	// setup starts the hub with the timeouts, and an agent routing the requests to a backend streaming an event
+	// every 200ms for a second
+	setup := func(configure func(config *server.Config)) {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(configure)
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			for i := range 5 {
+				fmt.Fprintf(w, "event %d\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// watch requests the streaming response and returns its body, read until the hub closes the connection
+	watch := func() (string, error) {
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = conn.Write([]byte("GET /test-cluster/api/v1/pods?watch=true HTTP/1.1\r\nHost: hub.example.com\r\nConnection: close\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should drop a client sending the headers slowly", func() {
+		setup(func(config *server.Config) {
+			config.HTTPReadHeaderTimeout = 500 * time.Millisecond
+		})
+
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub.example.com\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// A header line every 200ms, never ending the headers
+		start := time.Now()
+		var writeErr error
+		for i := 0; writeErr == nil && time.Since(start) < 5*time.Second; i++ {
+			time.Sleep(200 * time.Millisecond)
+			_, writeErr = fmt.Fprintf(conn, "X-Slow-%d: loris\r\n", i)
+		}
+		Expect(writeErr).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+
+		// The hub closed the connection without a response
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(errors.Is(err, io.EOF) || isConnReset(err)).To(BeTrue(), "expected the connection to be closed, got %v", err)
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+	})
+
+	It("should serve a streaming response longer than the read header timeout", func() {
+		setup(func(config *server.Config) {
+			config.HTTPReadHeaderTimeout = 300 * time.Millisecond
+		})
+
+		body, err := watch()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("event 0\nevent 1\nevent 2\nevent 3\nevent 4\n"))
+	})
+
+	It("should not bound the tunneled HTTP/1.1 connections by the read and write timeouts", func() {
+		setup(func(config *server.Config) {
+			config.HTTPReadTimeout = 300 * time.Millisecond
+			config.HTTPWriteTimeout = 300 * time.Millisecond
+		})
+
+		body, err := watch()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("event 0\nevent 1\nevent 2\nevent 3\nevent 4\n"))
+	})
+
+	It("should cut an HTTP/2 streaming response longer than the write timeout", func() {
+		setup(func(config *server.Config) {
+			config.EnableHTTP2 = true
+			config.HTTPWriteTimeout = 500 * time.Millisecond
+		})
+
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		transport := &http.Transport{Protocols: protocols}
+		defer transport.CloseIdleConnections()
+		client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+		resp, err := client.Get("http://" + framework.GetHubHTTPAddr() + "/test-cluster/api/v1/pods?watch=true")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.ProtoMajor).To(Equal(2))
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(HaveOccurred())
+		Expect(string(body)).To(HavePrefix("event 0\n"))
+		Expect(string(body)).NotTo(ContainSubstring("event 4"))
+	})
+})
+
+// isConnReset reports whether err is a connection reset by the peer
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
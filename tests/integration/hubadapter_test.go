@@ -0,0 +1,70 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Hub Adapter", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.HubAdapter = server.NewRoundRobinAdapter
+			})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	get := func() (int, string) {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s/api/v1/pods", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	It("should answer service unavailable when no agent is connected", func() {
+		status, body := get()
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(ContainSubstring("No cluster available"))
+	})
+
+	It("should distribute the requests across the clusters", func() {
+		clusters := []string{"cluster1", "cluster2", "cluster3"}
+		for _, cluster := range clusters {
+			mockServer, err := framework.CreateMockServer(cluster, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(cluster))
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(framework.CreateAgent(cluster, mockServer.GetAddr())).To(Succeed())
+		}
+		time.Sleep(500 * time.Millisecond)
+
+		counts := make(map[string]int)
+		for range 9 {
+			status, body := get()
+			Expect(status).To(Equal(http.StatusOK))
+			counts[body]++
+		}
+		// The requests are sequential, the clusters are idle in turn unless a connection is still being closed
+		for _, cluster := range clusters {
+			Expect(counts[cluster]).To(BeNumerically("~", 3, 1), "requests per cluster: %v", counts)
+		}
+	})
+})
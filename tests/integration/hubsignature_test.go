@@ -0,0 +1,107 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/hubsig"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server/middleware"
+)
+
+var _ = Describe("Hub Signature", func() {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	// setup starts the hub, signing the requests if sign is set, and an agent requiring the signature of the hub
+	setup := func(sign bool) {
+		socketDir := GinkgoT().TempDir()
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			if sign {
+				config.HTTPMiddlewares = append(config.HTTPMiddlewares, middleware.NewHubSignatureMiddleware(key))
+			}
+		}).WithAgentConfig(func(config *agent.Config) {
+			// The mock backend isn't an authenticated host, no TokenReview is made
+			config.Proxies = []agent.ProxySpec{{
+				Name:             "signed",
+				SocketPath:       filepath.Join(socketDir, "signed.sock"),
+				RequestProcessor: agent.NewRequestProcessorWithPolicy(nil, nil, agent.AuthPolicy{HubSignatureKey: key}),
+			}}
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// get sends a GET request with the client, with the headers
+	get := func(client *http.Client, headers map[string]string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/test-cluster/api/v1/pods", framework.GetHubHTTPAddr()), nil)
+		Expect(err).NotTo(HaveOccurred())
+		for header, value := range headers {
+			req.Header.Set(header, value)
+		}
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should sign each request of a keep-alive client connection", func() {
+		setup(true)
+
+		// The client reuses its connection when it can, each request must reach the hub to be signed
+		client := &http.Client{Timeout: 5 * time.Second}
+		for i := 0; i < 3; i++ {
+			status, body := get(client, nil)
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal("Hello from backend"))
+		}
+
+		requests := mockServer.GetRequests()
+		Expect(requests).To(HaveLen(3))
+		for _, request := range requests {
+			Expect(request.Headers.Get(hubsig.Header)).To(BeEmpty(), "the signature must not reach the target")
+		}
+	})
+
+	It("should replace a signature sent by the client", func() {
+		setup(true)
+
+		forged := "t=1700000000,v1=" + fmt.Sprintf("%064x", 0)
+		status, _ := get(&http.Client{Timeout: 5 * time.Second}, map[string]string{hubsig.Header: forged})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(mockServer.GetRequests()).To(HaveLen(1))
+	})
+
+	It("should reject the requests the hub didn't sign", func() {
+		setup(false)
+
+		status, _ := get(&http.Client{Timeout: 5 * time.Second}, nil)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Client Idle Timeout", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.ClientIdleTimeout = time.Second
+		})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should close the connection of a client gone silently", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		// The client sends a keep-alive request, reads the response and then neither sends nor closes anything
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "GET /test-cluster/api/v1/test HTTP/1.1\r\nHost: %s\r\n\r\n", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("Hello from backend"))
+
+		tun := framework.GetHubServer().GetTunnel("test-cluster")
+		Expect(tun).NotTo(BeNil())
+		Expect(tun.PacketConnStats()).To(HaveLen(1))
+
+		// The hub closes the idle connection within the idle timeout and the read interval
+		start := time.Now()
+		Eventually(tun.PacketConnStats, 3*time.Second, 100*time.Millisecond).Should(BeEmpty())
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = reader.ReadByte()
+		Expect(err).To(MatchError(io.EOF))
+	})
+})
@@ -0,0 +1,216 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"google.golang.org/grpc"
+)
+
+// gatherCounter returns the value of a counter from the default Prometheus registry
+func gatherCounter(name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// corruptor flips a bit in the next DATA packet with data received once armed, and counts the DATA packets received
+// with and without checksum
+type corruptor struct {
+	armed      atomic.Bool
+	checksums  atomic.Int64
+	unchecked  atomic.Int64
+	corruption atomic.Int64
+}
+
+func (c *corruptor) received(m any) {
+	packet, ok := m.(*v1.Packet)
+	if !ok || packet.Code != v1.ControlCode_DATA || len(packet.Data) == 0 {
+		return
+	}
+	if packet.Checksum != nil {
+		c.checksums.Add(1)
+	} else {
+		c.unchecked.Add(1)
+	}
+	if c.armed.CompareAndSwap(true, false) {
+		packet.Data[0] ^= 0x01
+		c.corruption.Add(1)
+	}
+}
+
+// corruptingServerStream passes the packets received by the Hub to the corruptor
+type corruptingServerStream struct {
+	grpc.ServerStream
+	corruptor *corruptor
+}
+
+func (s *corruptingServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.corruptor.received(m)
+	return nil
+}
+
+// corruptingClientStream passes the packets received by the agent to the corruptor
+type corruptingClientStream struct {
+	grpc.ClientStream
+	corruptor *corruptor
+}
+
+func (s *corruptingClientStream) RecvMsg(m any) error {
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.corruptor.received(m)
+	return nil
+}
+
+var _ = Describe("Integrity Check", func() {
+	const (
+		hubMetric   = "multiclustertunnel_hub_integrity_failures_total"
+		agentMetric = "multiclustertunnel_agent_integrity_failures_total"
+		// clusterName is only used by these specs, the counters are shared by the servers of the process
+		clusterName = "integrity-cluster"
+	)
+
+	var framework *TestFramework
+	// hubSide corrupts the packets from the agent, agentSide the packets from the hub
+	var hubSide, agentSide *corruptor
+
+	// setup starts the hub and the agent, each checking the integrity of the DATA packets if enabled
+	setup := func(hubEnabled, agentEnabled bool) {
+		hubSide, agentSide = &corruptor{}, &corruptor{}
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithClusterNameParser(server.NewClusterNameParserImplt()).
+			WithServerConfig(func(config *server.Config) {
+				config.EnableIntegrityCheck = hubEnabled
+				config.StreamInterceptors = []grpc.StreamServerInterceptor{
+					func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+						return handler(srv, &corruptingServerStream{ServerStream: ss, corruptor: hubSide})
+					},
+				}
+			}).
+			WithAgentConfig(func(config *agent.Config) {
+				config.EnableIntegrityCheck = agentEnabled
+				config.DialOptions = append(config.DialOptions, grpc.WithStreamInterceptor(
+					func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+						cs, err := streamer(ctx, desc, cc, method, opts...)
+						if err != nil {
+							return nil, err
+						}
+						return &corruptingClientStream{ClientStream: cs, corruptor: agentSide}, nil
+					}))
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent(clusterName, mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// get sends a request to the cluster on a new client connection
+	get := func() (int, string) {
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s/%s/api/v1/pods", framework.GetHubHTTPAddr(), clusterName))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should set the checksum of the DATA packets in both directions", func() {
+		setup(true, true)
+
+		status, body := get()
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+		Expect(hubSide.checksums.Load()).To(BeNumerically(">", 0))
+		Expect(hubSide.unchecked.Load()).To(BeZero())
+		Expect(agentSide.checksums.Load()).To(BeNumerically(">", 0))
+		Expect(agentSide.unchecked.Load()).To(BeZero())
+	})
+
+	It("should fail the request whose response was corrupted from the agent to the hub", func() {
+		setup(true, true)
+		labels := map[string]string{"cluster": clusterName, "direction": "from_agent"}
+		before := gatherCounter(hubMetric, labels)
+
+		hubSide.armed.Store(true)
+		status, body := get()
+		Expect(hubSide.corruption.Load()).To(Equal(int64(1)))
+		Expect(status).To(Equal(http.StatusBadGateway))
+		Expect(body).To(ContainSubstring("INTEGRITY_FAILURE"))
+		Expect(gatherCounter(hubMetric, labels) - before).To(Equal(1.0))
+
+		// The next requests are served
+		status, _ = get()
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	It("should fail the request corrupted from the hub to the agent", func() {
+		setup(true, true)
+		labels := map[string]string{"cluster": clusterName, "direction": "to_agent"}
+		hubBefore, agentBefore := gatherCounter(hubMetric, labels), gatherCounter(agentMetric, nil)
+
+		agentSide.armed.Store(true)
+		status, body := get()
+		Expect(agentSide.corruption.Load()).To(Equal(int64(1)))
+		Expect(status).To(Equal(http.StatusBadGateway))
+		Expect(body).To(ContainSubstring("INTEGRITY_FAILURE"))
+		Expect(gatherCounter(agentMetric, nil) - agentBefore).To(Equal(1.0))
+		Expect(gatherCounter(hubMetric, labels) - hubBefore).To(Equal(1.0))
+	})
+
+	It("should not set the checksums unless both sides enable it", func() {
+		setup(true, false)
+
+		// The hub doesn't answer the capability the agent didn't ask for, neither side computes the checksums
+		status, _ := get()
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(hubSide.checksums.Load()).To(BeZero())
+		Expect(agentSide.checksums.Load()).To(BeZero())
+		Expect(hubSide.unchecked.Load()).To(BeNumerically(">", 0))
+		Expect(agentSide.unchecked.Load()).To(BeNumerically(">", 0))
+	})
+})
@@ -0,0 +1,115 @@
+package integration
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// countingInterceptors counts the gRPC calls seen by the Hub and the cluster names of the Tunnel streams
+type countingInterceptors struct {
+	mu           sync.Mutex
+	unaryCalls   map[string]int
+	streamCalls  map[string]int
+	clusterNames []string
+}
+
+func newCountingInterceptors() *countingInterceptors {
+	return &countingInterceptors{
+		unaryCalls:  make(map[string]int),
+		streamCalls: make(map[string]int),
+	}
+}
+
+func (c *countingInterceptors) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	c.mu.Lock()
+	c.unaryCalls[info.FullMethod]++
+	c.mu.Unlock()
+	return handler(ctx, req)
+}
+
+func (c *countingInterceptors) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	c.mu.Lock()
+	c.streamCalls[info.FullMethod]++
+	if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+		c.clusterNames = append(c.clusterNames, md.Get("cluster-name")...)
+	}
+	c.mu.Unlock()
+	return handler(srv, ss)
+}
+
+func (c *countingInterceptors) unaryCount(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unaryCalls[method]
+}
+
+func (c *countingInterceptors) streamCount(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streamCalls[method]
+}
+
+func (c *countingInterceptors) seenClusterNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.clusterNames...)
+}
+
+var _ = Describe("gRPC Interceptors", func() {
+	var framework *TestFramework
+	var interceptors *countingInterceptors
+
+	BeforeEach(func() {
+		interceptors = newCountingInterceptors()
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.UnaryInterceptors = []grpc.UnaryServerInterceptor{interceptors.unary}
+				config.StreamInterceptors = []grpc.StreamServerInterceptor{interceptors.stream}
+			}).
+			WithGRPCServer(func(grpcServer *grpc.Server) {
+				healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+			})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should run the stream interceptors for the Tunnel stream with cluster-name metadata", func() {
+		Expect(framework.CreateAgent("test-cluster", "localhost:0")).To(Succeed())
+
+		Eventually(func() int {
+			return interceptors.streamCount(v1.TunnelService_Tunnel_FullMethodName)
+		}, 5*time.Second).Should(BeNumerically(">=", 1))
+		Expect(interceptors.seenClusterNames()).To(ContainElement("test-cluster"))
+	})
+
+	It("should serve additional services registered on the gRPC server", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, err := grpc.NewClient(framework.GetHubGRPCAddr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Status).To(Equal(healthpb.HealthCheckResponse_SERVING))
+		Expect(interceptors.unaryCount(healthpb.Health_Check_FullMethodName)).To(Equal(1))
+	})
+})
@@ -0,0 +1,104 @@
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+// gatherHistogram returns the sample count and sum of a histogram from the default Prometheus registry
+func gatherHistogram(name string, labels map[string]string) (count uint64, sum float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+		}
+	}
+	return 0, 0
+}
+
+var _ = Describe("Connection Latency", func() {
+	const (
+		metricName = "multiclustertunnel_hub_connection_latency_seconds"
+		// clusterName is only used by these specs, the histogram is shared by the servers of the process
+		clusterName  = "latency-cluster"
+		backendDelay = 50 * time.Millisecond
+	)
+
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithClusterNameParser(server.NewClusterNameParserImplt())
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(backendDelay)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent(clusterName, mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should record the latency of each request", func() {
+		const requests = 5
+		labels := map[string]string{"cluster": clusterName}
+		countBefore, sumBefore := gatherHistogram(metricName, labels)
+
+		// Each request opens its own connection, the latency is recorded per connection
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		for i := 0; i < requests; i++ {
+			resp, err := client.Get(fmt.Sprintf("http://%s/%s/api/v1/pods", framework.GetHubHTTPAddr(), clusterName))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		// The latency is recorded once the hub stops forwarding the traffic, right after the response
+		Eventually(func() uint64 {
+			count, _ := gatherHistogram(metricName, labels)
+			return count - countBefore
+		}, 5*time.Second, 50*time.Millisecond).Should(Equal(uint64(requests)))
+
+		_, sum := gatherHistogram(metricName, labels)
+		Expect(sum - sumBefore).To(BeNumerically(">=", requests*backendDelay.Seconds()))
+	})
+
+	It("should not record the requests that failed before they were forwarded", func() {
+		labels := map[string]string{"cluster": "latency-missing-cluster"}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/latency-missing-cluster/api/v1/pods", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		count, _ := gatherHistogram(metricName, labels)
+		Expect(count).To(BeZero())
+	})
+})
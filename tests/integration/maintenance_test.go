@@ -0,0 +1,196 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Cluster Maintenance", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork().WithServerConfig(func(config *server.Config) {
+			config.RequestIdentifier = server.NewHeaderIdentifier("X-Remote-User")
+			config.AdminAuthenticator = server.NewTokenAuthenticator("secret")
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// setMaintenance puts the cluster under maintenance for the controller with the admin API, or takes it out of it
+	setMaintenance := func(on bool) {
+		method, url := http.MethodDelete, fmt.Sprintf("http://%s/admin/maintenance/test-cluster", framework.GetHubHTTPAddr())
+		if on {
+			method, url = http.MethodPut, url+"?allow=controller"
+		}
+		req, err := http.NewRequest(method, url, nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+	}
+
+	It("should only let the allowed identities in while the cluster is under maintenance", func() {
+		tunnelID := framework.GetHubServer().GetTunnel("test-cluster").ID()
+
+		// Each user sends requests in a loop while the maintenance is flipped on and off
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		responses := map[string][]unavailableResponse{}
+		for _, user := range []string{"controller", "alice"} {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					response := getUnavailableAs(framework, "test-cluster", user)
+					mu.Lock()
+					responses[user] = append(responses[user], response)
+					mu.Unlock()
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+		}
+		countReasons := func(user string) map[string]int {
+			mu.Lock()
+			defer mu.Unlock()
+			reasons := map[string]int{}
+			for _, response := range responses[user] {
+				reasons[response.body.Reason]++
+			}
+			return reasons
+		}
+
+		Eventually(func() int { return countReasons("alice")[""] }, 3*time.Second).Should(BeNumerically(">", 0))
+		setMaintenance(true)
+		Eventually(func() int { return countReasons("alice")[server.ReasonMaintenance] }, 3*time.Second).Should(BeNumerically(">", 2))
+		served := countReasons("alice")[""]
+		setMaintenance(false)
+		Eventually(func() int { return countReasons("alice")[""] }, 3*time.Second).Should(BeNumerically(">", served))
+		close(stop)
+		wg.Wait()
+
+		Expect(countReasons("controller")).To(HaveKey(""))
+		Expect(countReasons("controller")).To(HaveLen(1), "the controller is never rejected")
+		Expect(countReasons("alice")).To(HaveLen(2))
+		for _, response := range responses["alice"] {
+			if response.body.Reason == server.ReasonMaintenance {
+				Expect(response.status).To(Equal(http.StatusServiceUnavailable))
+				Expect(response.retryAfter).To(Equal("30"))
+				Expect(response.body.Cluster).To(Equal("test-cluster"))
+				Expect(response.body.LastSeen).NotTo(BeNil())
+			}
+		}
+
+		// The tunnel stayed connected
+		Expect(framework.GetHubServer().GetTunnel("test-cluster").ID()).To(Equal(tunnelID))
+	})
+
+	It("should keep the cluster under maintenance while its agent reconnects", func() {
+		setMaintenance(true)
+		Expect(framework.GetHubServer().MaintenanceClusters()).To(HaveLen(1))
+		tunnelID := framework.GetHubServer().GetTunnel("test-cluster").ID()
+		Expect(framework.GetHubServer().DisconnectCluster("test-cluster", "upgrade")).To(Succeed())
+
+		Eventually(func() string {
+			tun := framework.GetHubServer().GetTunnel("test-cluster")
+			if tun == nil {
+				return ""
+			}
+			return tun.ID()
+		}, 5*time.Second, 50*time.Millisecond).ShouldNot(Or(BeEmpty(), Equal(tunnelID)))
+
+		Expect(getUnavailableAs(framework, "test-cluster", "controller").status).To(Equal(http.StatusOK))
+		Expect(getUnavailableAs(framework, "test-cluster", "alice").body.Reason).To(Equal(server.ReasonMaintenance))
+		Expect(getUnavailable(framework, "test-cluster").body.Reason).To(Equal(server.ReasonMaintenance))
+
+		setMaintenance(false)
+		Expect(framework.GetHubServer().MaintenanceClusters()).To(BeEmpty())
+		Expect(getUnavailableAs(framework, "test-cluster", "alice").status).To(Equal(http.StatusOK))
+	})
+
+	// getOn sends a GET as the user on the client connection and reads its response
+	getOn := func(conn io.Writer, reader *bufio.Reader, user string) (*http.Response, error) {
+		fmt.Fprintf(conn, "GET /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub\r\nX-Remote-User: %s\r\n\r\n", user)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(io.Discard, resp.Body)
+		return resp, err
+	}
+
+	It("should close the client connections kept alive once the cluster goes under maintenance", func() {
+		conn, err := memNet.DialContext(context.Background(), "tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		resp, err := getOn(conn, reader, "alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Close).To(BeFalse())
+
+		setMaintenance(true)
+		_, err = getOn(conn, reader, "alice")
+		Expect(err).To(HaveOccurred())
+		Consistently(func() []MockRequest {
+			return mockServer.GetRequests()
+		}, time.Second, 100*time.Millisecond).Should(HaveLen(1))
+	})
+
+	It("should only forward the first request of a client connection under maintenance", func() {
+		setMaintenance(true)
+		conn, err := memNet.DialContext(context.Background(), "tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		resp, err := getOn(conn, reader, "controller")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Close).To(BeTrue())
+
+		// The client ignores Connection: close, the request of the user not allowed doesn't reach the cluster
+		_, err = getOn(conn, reader, "alice")
+		Expect(err).To(HaveOccurred())
+		Consistently(func() []MockRequest {
+			return mockServer.GetRequests()
+		}, time.Second, 100*time.Millisecond).Should(HaveLen(1))
+		Expect(mockServer.GetRequests()[0].Headers.Get("X-Remote-User")).To(Equal("controller"))
+	})
+})
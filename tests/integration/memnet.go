@@ -0,0 +1,116 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// memNetBufferSize is the size of the buffer of each in-memory connection, in each direction
+const memNetBufferSize = 1 << 20
+
+// memNet is the in-memory network of the frameworks created WithInMemoryNetwork. http.DefaultTransport dials
+// through it, so that the specs reach the in-memory Hub and mock servers with http.Get and the default clients
+var memNet = newMemNetwork()
+
+func init() {
+	http.DefaultTransport.(*http.Transport).DialContext = memNet.DialContext
+}
+
+// memNetwork is a registry of in-memory listeners, each named by a fake "<name>-<n>.memnet:80" address that the
+// dialers of the framework resolve to it. No TCP port is opened for them
+type memNetwork struct {
+	mu        sync.Mutex
+	next      int
+	listeners map[string]*memListener
+	// fallback dials the addresses that aren't in-memory, with the settings of the dialer of http.DefaultTransport
+	fallback net.Dialer
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		listeners: make(map[string]*memListener),
+		fallback:  net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// memAddr is the address of an in-memory listener
+type memAddr string
+
+func (a memAddr) Network() string { return "memnet" }
+func (a memAddr) String() string  { return string(a) }
+
+// memListener is an in-memory listener registered on a memNetwork until it's closed
+type memListener struct {
+	*bufconn.Listener
+	network *memNetwork
+	addr    memAddr
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *memListener) Close() error {
+	l.network.mu.Lock()
+	if l.network.listeners[string(l.addr)] == l {
+		delete(l.network.listeners, string(l.addr))
+	}
+	l.network.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// Listen creates an in-memory listener with a new address named after name
+func (n *memNetwork) Listen(name string) net.Listener {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.next++
+	listener := &memListener{
+		Listener: bufconn.Listen(memNetBufferSize),
+		network:  n,
+		addr:     memAddr(fmt.Sprintf("%s-%d.memnet:80", name, n.next)),
+	}
+	n.listeners[string(listener.addr)] = listener
+	return listener
+}
+
+// DialContext dials the in-memory addresses with dialMemory, and the other ones on the network, e.g. for the specs of
+// the frameworks that don't run in memory
+func (n *memNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil && strings.HasSuffix(host, ".memnet") {
+		return n.dialMemory(ctx, network, addr)
+	}
+	return n.fallback.DialContext(ctx, network, addr)
+}
+
+// dialMemory connects to the in-memory listener of the address, or refuses the connection if there is none. The
+// in-memory network doesn't resolve the host names that aren't in-memory, the agents dial with it so that they
+// never reach out of it
+func (n *memNetwork) dialMemory(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	listener := n.listeners[addr]
+	n.mu.Unlock()
+	if listener != nil {
+		return listener.DialContext(ctx)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if !strings.HasSuffix(host, ".memnet") {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Addr: memAddr(addr), Err: syscall.ECONNREFUSED}
+}
+
+// dialHub dials the in-memory Hub for the ContextDialer of the agents
+func (n *memNetwork) dialHub(ctx context.Context, addr string) (net.Conn, error) {
+	return n.dialMemory(ctx, "tcp", addr)
+}
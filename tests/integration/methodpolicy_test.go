@@ -0,0 +1,119 @@
+package integration
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("CORS and Method Policy", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.CORS = &server.CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}}
+				config.MethodPolicy = func(cluster, method string) error {
+					if method == http.MethodGet || method == http.MethodHead {
+						return nil
+					}
+					return errors.New("cluster is read-only")
+				}
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	do := func(method string, headers map[string]string) *http.Response {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s/test-cluster/api/v1/pods", framework.GetHubHTTPAddr()), nil)
+		Expect(err).NotTo(HaveOccurred())
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	It("should answer the preflights and deny the methods at the hub", func() {
+		resp := do(http.MethodOptions, map[string]string{
+			"Origin":                        "https://ui.example.com",
+			"Access-Control-Request-Method": http.MethodDelete,
+		})
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://ui.example.com"))
+
+		resp = do(http.MethodOptions, map[string]string{
+			"Origin":                        "https://evil.example.com",
+			"Access-Control-Request-Method": http.MethodGet,
+		})
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			resp = do(method, map[string]string{"Origin": "https://ui.example.com"})
+			Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed), method)
+			Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://ui.example.com"))
+		}
+
+		// No packet reached the agent
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+		Expect(framework.GetAgent("test-cluster").PacketConnMetrics().TotalPacketsRecv).To(BeZero())
+
+		resp = do(http.MethodGet, map[string]string{"Origin": "https://ui.example.com"})
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://ui.example.com"))
+		Expect(mockServer.GetRequests()).To(HaveLen(1))
+	})
+
+	It("should not let a second request through on the connection of an allowed one", func() {
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		_, err = fmt.Fprintf(conn, "GET /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub\r\n\r\n")
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.ReadResponse(reader, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Close).To(BeTrue())
+		_, err = io.Copy(io.Discard, resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The client ignores Connection: close and sends a denied method on the same connection, the hub closed it.
+		// The write may succeed before the client sees it
+		fmt.Fprintf(conn, "PUT /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub\r\nContent-Length: 2\r\n\r\n{}")
+		_, err = http.ReadResponse(reader, nil)
+		Expect(err).To(HaveOccurred())
+
+		Consistently(func() []MockRequest {
+			return mockServer.GetRequests()
+		}, time.Second, 100*time.Millisecond).Should(HaveLen(1))
+		Expect(mockServer.GetRequests()[0].Method).To(Equal(http.MethodGet))
+	})
+})
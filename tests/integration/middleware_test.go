@@ -0,0 +1,191 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server/middleware"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by the logger and the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var _ = Describe("HTTP Middlewares", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+	var middlewares []func(http.Handler) http.Handler
+
+	// setup starts the hub with the middlewares and an agent routing to a mock backend
+	setup := func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.HTTPMiddlewares = middlewares
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// do sends a request on a new connection, each tunneled connection runs the middlewares once
+	do := func(req *http.Request) (*http.Response, string) {
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp, string(body)
+	}
+
+	newRequest := func(method, path string) *http.Request {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", framework.GetHubHTTPAddr(), path), nil)
+		Expect(err).NotTo(HaveOccurred())
+		return req
+	}
+
+	BeforeEach(func() {
+		middlewares = nil
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should apply the middlewares in order", func() {
+		orderMiddleware := func(name string) func(http.Handler) http.Handler {
+			return func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					r.Header.Add("X-Middleware-Order", name)
+					next.ServeHTTP(w, r)
+				})
+			}
+		}
+		middlewares = []func(http.Handler) http.Handler{orderMiddleware("first"), orderMiddleware("second")}
+		setup()
+
+		resp, body := do(newRequest(http.MethodGet, "/test-cluster/api/v1/test"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+
+		requests := mockServer.GetRequests()
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Headers.Values("X-Middleware-Order")).To(Equal([]string{"first", "second"}))
+	})
+
+	It("should add X-Request-ID to the request and the response", func() {
+		middlewares = []func(http.Handler) http.Handler{middleware.NewRequestIDMiddleware()}
+		setup()
+
+		resp, _ := do(newRequest(http.MethodGet, "/test-cluster/api/v1/test"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		requestID := resp.Header.Get(middleware.RequestIDHeader)
+		Expect(requestID).To(HaveLen(32))
+
+		requests := mockServer.GetRequests()
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Headers.Get(middleware.RequestIDHeader)).To(Equal(requestID))
+
+		// A request ID sent by the client is kept
+		req := newRequest(http.MethodGet, "/test-cluster/api/v1/test")
+		req.Header.Set(middleware.RequestIDHeader, "client-request-id")
+		resp, _ = do(req)
+		Expect(resp.Header.Get(middleware.RequestIDHeader)).To(Equal("client-request-id"))
+
+		// Responses written by the hub have it as well
+		resp, _ = do(newRequest(http.MethodGet, "/health"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get(middleware.RequestIDHeader)).NotTo(BeEmpty())
+	})
+
+	It("should allow cross-origin requests from the configured origins", func() {
+		middlewares = []func(http.Handler) http.Handler{middleware.NewCORSMiddleware([]string{"https://ui.example.com"})}
+		setup()
+
+		// The preflight request is answered by the hub
+		req := newRequest(http.MethodOptions, "/test-cluster/api/v1/test")
+		req.Header.Set("Origin", "https://ui.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "Authorization")
+		resp, _ := do(req)
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://ui.example.com"))
+		Expect(resp.Header.Get("Access-Control-Allow-Methods")).To(ContainSubstring(http.MethodPost))
+		Expect(resp.Header.Get("Access-Control-Allow-Headers")).To(Equal("Authorization"))
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+
+		// The tunneled response has the CORS headers
+		req = newRequest(http.MethodGet, "/test-cluster/api/v1/test")
+		req.Header.Set("Origin", "https://ui.example.com")
+		resp, body := do(req)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://ui.example.com"))
+
+		// Other origins are not allowed
+		req = newRequest(http.MethodGet, "/test-cluster/api/v1/test")
+		req.Header.Set("Origin", "https://evil.example.com")
+		resp, _ = do(req)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+
+	It("should log the requests", func() {
+		logs := &syncBuffer{}
+		logger := slog.New(slog.NewJSONHandler(logs, nil))
+		middlewares = []func(http.Handler) http.Handler{
+			middleware.NewRequestIDMiddleware(),
+			middleware.NewRequestLoggingMiddleware(logger),
+		}
+		setup()
+
+		resp, _ := do(newRequest(http.MethodGet, "/test-cluster/api/v1/test"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		requestID := resp.Header.Get(middleware.RequestIDHeader)
+
+		resp, _ = do(newRequest(http.MethodGet, "/health"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		Eventually(logs.String, 5*time.Second).Should(And(
+			ContainSubstring(`"path":"/test-cluster/api/v1/test"`),
+			ContainSubstring(`"request_id":"`+requestID+`"`),
+			ContainSubstring(`"tunneled":true`),
+			ContainSubstring(`"path":"/health"`),
+			ContainSubstring(`"status":200`),
+		))
+	})
+})
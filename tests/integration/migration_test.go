@@ -0,0 +1,220 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+// partitionProxy forwards the agent connections to the Hub. Partition simulates a network partition seen only
+// by the agent: the agent side of the connections is closed, while the Hub side is left open and silent, so the
+// Hub keeps the old tunnel until the agent reconnects.
+type partitionProxy struct {
+	listener net.Listener
+	target   string
+
+	mu        sync.Mutex
+	agentConn []net.Conn
+	hubConn   []net.Conn
+	blocked   bool
+	wg        sync.WaitGroup
+}
+
+func newPartitionProxy(target string) (*partitionProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &partitionProxy{listener: listener, target: target}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+func (p *partitionProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *partitionProxy) serve() {
+	defer p.wg.Done()
+	for {
+		agentConn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		blocked := p.blocked
+		p.mu.Unlock()
+		if blocked {
+			agentConn.Close()
+			continue
+		}
+		hubConn, err := net.Dial("tcp", p.target)
+		if err != nil {
+			agentConn.Close()
+			continue
+		}
+
+		p.mu.Lock()
+		p.agentConn = append(p.agentConn, agentConn)
+		p.hubConn = append(p.hubConn, hubConn)
+		p.mu.Unlock()
+
+		p.wg.Add(2)
+		go func() {
+			defer p.wg.Done()
+			io.Copy(hubConn, agentConn)
+		}()
+		go func() {
+			defer p.wg.Done()
+			io.Copy(agentConn, hubConn)
+		}()
+	}
+}
+
+// Partition closes the agent side of the current connections and stops forwarding on them
+func (p *partitionProxy) Partition() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.agentConn {
+		conn.Close()
+	}
+	p.agentConn = nil
+}
+
+// Kill closes both sides of the current connections, like a reset of the TCP connections
+func (p *partitionProxy) Kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range append(p.agentConn, p.hubConn...) {
+		conn.Close()
+	}
+	p.agentConn, p.hubConn = nil, nil
+}
+
+// Block closes the new connections right away while blocked is true, so the agent can't reconnect
+func (p *partitionProxy) Block(blocked bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blocked = blocked
+}
+
+// Close closes the listener and all connections
+func (p *partitionProxy) Close() {
+	p.listener.Close()
+	p.mu.Lock()
+	for _, conn := range append(p.agentConn, p.hubConn...) {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+var _ = Describe("Connection Migration", func() {
+	var framework *TestFramework
+	var proxy *partitionProxy
+
+	// setup starts the hub and an agent connected through the partition proxy,
+	// the backend answers 1.5s after receiving a request so the request is in flight during the partition
+	setup := func(enableMigration bool) {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.EnableConnectionMigration = enableMigration
+			}).
+			WithAgentConfig(func(config *agent.Config) {
+				config.HubAddress = proxy.Addr()
+			})
+
+		// The proxy needs the Hub address, which is only known once the Hub is started
+		Expect(framework.Setup()).To(Succeed())
+		var err error
+		proxy, err = newPartitionProxy(framework.GetHubGRPCAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(1500 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// sendInFlightRequests sends requests and partitions the network while they are in flight
+	sendInFlightRequests := func(count int) []error {
+		errs := make([]error, count)
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				client := &http.Client{Timeout: 10 * time.Second}
+				resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/slow", framework.GetHubHTTPAddr()))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				switch {
+				case err != nil:
+					errs[i] = err
+				case resp.StatusCode != http.StatusOK || string(body) != "Hello from backend":
+					errs[i] = fmt.Errorf("unexpected response %d: %s", resp.StatusCode, body)
+				}
+			}(i)
+		}
+
+		// Partition while the backend is handling the requests, the agent reconnects within its backoff
+		time.Sleep(300 * time.Millisecond)
+		proxy.Partition()
+
+		wg.Wait()
+		return errs
+	}
+
+	AfterEach(func() {
+		if proxy != nil {
+			proxy.Close()
+		}
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should keep in-flight requests going when the agent reconnects", func() {
+		setup(true)
+
+		for i, err := range sendInFlightRequests(3) {
+			Expect(err).NotTo(HaveOccurred(), "request %d failed", i)
+		}
+
+		// New requests work on the new tunnel
+		resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should fail in-flight requests when connection migration is disabled", func() {
+		setup(false)
+
+		failed := 0
+		for _, err := range sendInFlightRequests(3) {
+			if err != nil {
+				failed++
+			}
+		}
+		Expect(failed).To(Equal(3))
+	})
+})
@@ -0,0 +1,105 @@
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Request Mirroring", func() {
+	var framework *TestFramework
+	var primary *MockServer
+
+	setupFramework := func(mirror server.MirrorConfig) {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithClusterNameParser(server.NewClusterNameParserImplt()).
+			WithServerConfig(func(config *server.Config) {
+				config.Mirror = &mirror
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		primary, err = framework.CreateMockServer("primary", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("cluster-a", primary.GetAddr())).To(Succeed())
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// sendRequests sends the requests to cluster-a and returns the longest time one took. Only the first request of a
+	// connection is mirrored, each request is sent on a new connection
+	sendRequests := func(method string, count int) time.Duration {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+		var slowest time.Duration
+		for i := 0; i < count; i++ {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://%s/cluster-a/api/v1/pods/%d", framework.GetHubHTTPAddr(), i), nil)
+			Expect(err).NotTo(HaveOccurred())
+			start := time.Now()
+			resp, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			slowest = max(slowest, time.Since(start))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+		return slowest
+	}
+
+	It("should mirror a share of the read-only requests to the target cluster", func() {
+		setupFramework(server.MirrorConfig{SourceCluster: "cluster-a", TargetCluster: "cluster-b", Percent: 50})
+		mirror, err := framework.CreateMockServer("mirror", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("discarded"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("cluster-b", mirror.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		sendRequests("GET", 200)
+		sendRequests("POST", 20)
+		Expect(primary.GetRequests()).To(HaveLen(220))
+
+		// The binomial distribution of 200 samples at 50% is within 60 and 140 with overwhelming probability
+		Eventually(func() int { return len(mirror.GetRequests()) }, 5*time.Second, 100*time.Millisecond).
+			Should(And(BeNumerically(">=", 60), BeNumerically("<=", 140)))
+		Consistently(func() int { return len(mirror.GetRequests()) }, 500*time.Millisecond).Should(BeNumerically("<=", 140))
+		for _, req := range mirror.GetRequests() {
+			Expect(req.Method).To(Equal("GET"))
+			Expect(req.Path).To(HavePrefix("/cluster-a/api/v1/pods/"))
+		}
+	})
+
+	It("should not affect the requests when the target cluster is down", func() {
+		setupFramework(server.MirrorConfig{SourceCluster: "cluster-a", TargetCluster: "cluster-b", Percent: 100})
+		time.Sleep(500 * time.Millisecond)
+
+		Expect(sendRequests("GET", 20)).To(BeNumerically("<", time.Second))
+		Expect(primary.GetRequests()).To(HaveLen(20))
+	})
+
+	It("should not wait for a slow target cluster", func() {
+		setupFramework(server.MirrorConfig{SourceCluster: "cluster-a", TargetCluster: "cluster-b", Percent: 100, MaxConcurrent: 2})
+		release := make(chan struct{})
+		mirror, err := framework.CreateMockServer("mirror", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("cluster-b", mirror.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		Expect(sendRequests("GET", 10)).To(BeNumerically("<", time.Second))
+		// Only the mirrored requests in flight up to the cap reach the mirror
+		Consistently(func() int { return len(mirror.GetRequests()) }, 500*time.Millisecond).Should(BeNumerically("<=", 2))
+		close(release)
+	})
+})
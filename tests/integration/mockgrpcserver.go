@@ -0,0 +1,178 @@
+package integration
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+)
+
+// MockGRPCServer is a Hub replaced by a gRPC server of the tunnel service, to test the agents with packet sequences
+// the Hub doesn't send, e.g. an ERROR before DATA. It records the tunnel streams of the agents
+type MockGRPCServer struct {
+	t        TestingInterface
+	listener net.Listener
+	server   *grpc.Server
+	addr     string
+	handler  v1.TunnelServiceServer
+
+	mu      sync.RWMutex
+	streams []*mockTunnelStream
+}
+
+// MockStream captures a tunnel stream opened by an agent
+type MockStream struct {
+	ClusterName string
+	Metadata    metadata.MD
+	// Packets are the packets received from the agent
+	Packets []*v1.Packet
+	// Closed is set once the stream ended
+	Closed bool
+}
+
+// mockTunnelStream records the packets received on the stream and serializes the sends of the handler with the
+// injected packets
+type mockTunnelStream struct {
+	v1.TunnelService_TunnelServer
+	server *MockGRPCServer
+	stream MockStream
+	sendMu sync.Mutex
+}
+
+func (s *mockTunnelStream) Recv() (*v1.Packet, error) {
+	packet, err := s.TunnelService_TunnelServer.Recv()
+	if err == nil {
+		s.server.mu.Lock()
+		s.stream.Packets = append(s.stream.Packets, packet)
+		s.server.mu.Unlock()
+	}
+	return packet, err
+}
+
+func (s *mockTunnelStream) Send(packet *v1.Packet) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.TunnelService_TunnelServer.Send(packet)
+}
+
+// mockTunnelService records the streams and passes them to the handler of the MockGRPCServer
+type mockTunnelService struct {
+	v1.UnimplementedTunnelServiceServer
+	server *MockGRPCServer
+}
+
+func (s *mockTunnelService) Tunnel(stream v1.TunnelService_TunnelServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	clusterName := ""
+	if values := md.Get("cluster-name"); len(values) > 0 {
+		clusterName = values[0]
+	}
+	recorded := &mockTunnelStream{
+		TunnelService_TunnelServer: stream,
+		server:                     s.server,
+		stream:                     MockStream{ClusterName: clusterName, Metadata: md},
+	}
+	s.server.mu.Lock()
+	s.server.streams = append(s.server.streams, recorded)
+	s.server.mu.Unlock()
+	defer func() {
+		s.server.mu.Lock()
+		recorded.stream.Closed = true
+		s.server.mu.Unlock()
+	}()
+
+	if s.server.handler != nil {
+		return s.server.handler.Tunnel(recorded)
+	}
+	// Only record the packets of the agent
+	for {
+		if _, err := recorded.Recv(); err != nil {
+			return err
+		}
+	}
+}
+
+// CreateMockGRPCServer starts a gRPC server of the tunnel service passing the streams of the agents to the handler,
+// it only records the packets of the agents if the handler is nil. It uses the TLS of the framework and is stopped
+// by Cleanup. The agents connect to it with CreateAgentWithHubAddress
+func (f *TestFramework) CreateMockGRPCServer(name string, handler v1.TunnelServiceServer) (*MockGRPCServer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create listener: %w", err)
+	}
+	var options []grpc.ServerOption
+	if f.useTLS {
+		options = append(options, grpc.Creds(credentials.NewTLS(f.grpcTLSConfig)))
+	}
+	mockServer := &MockGRPCServer{
+		t:        f.t,
+		listener: listener,
+		server:   grpc.NewServer(options...),
+		addr:     listener.Addr().String(),
+		handler:  handler,
+	}
+	v1.RegisterTunnelServiceServer(mockServer.server, &mockTunnelService{server: mockServer})
+
+	go func() {
+		if err := mockServer.server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+			f.t.Errorf("Mock gRPC server %s failed: %v", name, err)
+		}
+	}()
+
+	f.mockGRPCServers[name] = mockServer
+	return mockServer, nil
+}
+
+// Stop stops the mock gRPC server, the open streams are closed
+func (m *MockGRPCServer) Stop() {
+	m.server.Stop()
+}
+
+// GetAddr returns the server address
+func (m *MockGRPCServer) GetAddr() string {
+	return m.addr
+}
+
+// GetStreams returns the streams opened by the agents, in order
+func (m *MockGRPCServer) GetStreams() []MockStream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	streams := make([]MockStream, len(m.streams))
+	for i, s := range m.streams {
+		streams[i] = s.stream
+		streams[i].Packets = append([]*v1.Packet(nil), s.stream.Packets...)
+	}
+	return streams
+}
+
+// InjectPacket sends the packet to the agent of the cluster on its last open stream
+func (m *MockGRPCServer) InjectPacket(clusterName string, pkt *v1.Packet) {
+	m.mu.RLock()
+	var target *mockTunnelStream
+	for i := len(m.streams) - 1; i >= 0; i-- {
+		if s := m.streams[i]; s.stream.ClusterName == clusterName && !s.stream.Closed {
+			target = s
+			break
+		}
+	}
+	m.mu.RUnlock()
+
+	if target == nil {
+		m.t.Errorf("No open stream of cluster %s to inject a %v packet on", clusterName, pkt.Code)
+		return
+	}
+	if err := target.Send(pkt); err != nil {
+		m.t.Errorf("Failed to inject a %v packet to cluster %s: %v", pkt.Code, clusterName, err)
+		return
+	}
+	klog.V(4).InfoS("Injected packet", "cluster", clusterName, "conn_id", pkt.ConnId, "code", pkt.Code)
+}
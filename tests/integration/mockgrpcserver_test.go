@@ -0,0 +1,73 @@
+package integration
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+)
+
+var _ = Describe("Mock gRPC Hub", func() {
+	var framework *TestFramework
+	var hub *MockGRPCServer
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		hub, err = framework.CreateMockGRPCServer("hub", nil)
+		Expect(err).NotTo(HaveOccurred())
+		mockServer, err := framework.CreateMockServer("backend", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgentWithHubAddress("test-cluster", mockServer.GetAddr(), hub.GetAddr())).To(Succeed())
+		Eventually(hub.GetStreams, 3*time.Second, 50*time.Millisecond).Should(HaveLen(1))
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// packetsOf returns the packets the agent sent for the conn_id
+	packetsOf := func(connID int64) []*v1.Packet {
+		var packets []*v1.Packet
+		for _, packet := range hub.GetStreams()[0].Packets {
+			if packet.ConnId == connID {
+				packets = append(packets, packet)
+			}
+		}
+		return packets
+	}
+
+	It("should record the stream of the agent", func() {
+		stream := hub.GetStreams()[0]
+		Expect(stream.ClusterName).To(Equal("test-cluster"))
+		Expect(stream.Closed).To(BeFalse())
+		// The agent opens the stream with a PING
+		Expect(stream.Packets).NotTo(BeEmpty())
+		Expect(stream.Packets[0].Code).To(Equal(v1.ControlCode_PING))
+	})
+
+	It("should serve the injected connections and not answer an ERROR of an unknown one", func() {
+		hub.InjectPacket("test-cluster", &v1.Packet{ConnId: 7, Code: v1.ControlCode_DATA,
+			Data: []byte("GET /api HTTP/1.1\r\nHost: test-cluster\r\nConnection: close\r\n\r\n")})
+
+		// The response of the target is sent back on the connection
+		Eventually(func() string {
+			var response strings.Builder
+			for _, packet := range packetsOf(7) {
+				response.Write(packet.Data)
+			}
+			return response.String()
+		}, 5*time.Second, 50*time.Millisecond).Should(And(HavePrefix("HTTP/1.1 200 OK"), HaveSuffix("OK")))
+
+		// The Hub closes a connection the agent doesn't know, e.g. already closed, it's not answered
+		hub.InjectPacket("test-cluster", &v1.Packet{ConnId: 9, Code: v1.ControlCode_ERROR, ErrorMessage: "stale"})
+		Consistently(func() []*v1.Packet { return packetsOf(9) }, 500*time.Millisecond, 50*time.Millisecond).Should(BeEmpty())
+	})
+})
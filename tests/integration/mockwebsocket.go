@@ -0,0 +1,244 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/klog/v2"
+)
+
+// MockWebSocketDirection is the direction a WebSocket message was sent in, seen from the mock server
+type MockWebSocketDirection string
+
+const (
+	// WebSocketReceived is a message the client sent to the mock server
+	WebSocketReceived MockWebSocketDirection = "received"
+	// WebSocketSent is a message the mock server sent to the client
+	WebSocketSent MockWebSocketDirection = "sent"
+)
+
+// MockWebSocketMessage captures a data message of a WebSocket connection of a mock server, the control frames (ping,
+// pong and close) aren't captured
+type MockWebSocketMessage struct {
+	Path      string
+	Direction MockWebSocketDirection
+	// MessageType is websocket.TextMessage or websocket.BinaryMessage
+	MessageType int
+	Payload     []byte
+	Timestamp   time.Time
+}
+
+// ServeWebSocket upgrades the requests to path to WebSocket connections served by handler, the connection is closed
+// once handler returns. The messages of the connections are captured, see GetWebSocketMessages
+func (m *MockServer) ServeWebSocket(path string, handler func(*websocket.Conn)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.wsHandlers == nil {
+		m.wsHandlers = make(map[string]func(*websocket.Conn))
+	}
+	m.wsHandlers[path] = handler
+}
+
+// GetWebSocketMessages returns the messages captured on the WebSocket connections, in the order they were sent
+func (m *MockServer) GetWebSocketMessages() []MockWebSocketMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := make([]MockWebSocketMessage, len(m.wsMessages))
+	copy(messages, m.wsMessages)
+	return messages
+}
+
+// recordWebSocketMessage captures a message of a WebSocket connection
+func (m *MockServer) recordWebSocketMessage(message MockWebSocketMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wsMessages = append(m.wsMessages, message)
+}
+
+// serveWebSocket upgrades the request and serves the connection with handler
+func (m *MockServer) serveWebSocket(w http.ResponseWriter, r *http.Request, handler func(*websocket.Conn)) {
+	upgrader := websocket.Upgrader{
+		// With a read buffer of its own, the connection reads the frames from the hijacked connection and not from
+		// the buffer of the HTTP server, so that the recorder sees them
+		ReadBufferSize: 4096,
+		CheckOrigin:    func(*http.Request) bool { return true },
+	}
+	conn, err := upgrader.Upgrade(&recordingResponseWriter{ResponseWriter: w, server: m, path: r.URL.Path}, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error
+		klog.ErrorS(err, "Failed to upgrade WebSocket connection", "path", r.URL.Path)
+		return
+	}
+	m.mu.Lock()
+	if m.wsConns == nil {
+		m.wsConns = make(map[*websocket.Conn]struct{})
+	}
+	m.wsConns[conn] = struct{}{}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.wsConns, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+	handler(conn)
+}
+
+// closeWebSockets closes the open WebSocket connections, their handlers fail to read and write then
+func (m *MockServer) closeWebSockets() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for conn := range m.wsConns {
+		conn.Close()
+	}
+}
+
+// recordingResponseWriter hijacks the connection of a WebSocket upgrade as a wsRecordingConn
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	server *MockServer
+	path   string
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &wsRecordingConn{
+		Conn:     conn,
+		received: wsFrameParser{record: w.recorder(WebSocketReceived)},
+		sent:     wsFrameParser{record: w.recorder(WebSocketSent)},
+	}, brw, nil
+}
+
+// recorder returns the function capturing the messages of the direction
+func (w *recordingResponseWriter) recorder(direction MockWebSocketDirection) func(messageType int, payload []byte) {
+	return func(messageType int, payload []byte) {
+		w.server.recordWebSocketMessage(MockWebSocketMessage{
+			Path:        w.path,
+			Direction:   direction,
+			MessageType: messageType,
+			Payload:     payload,
+			Timestamp:   time.Now(),
+		})
+	}
+}
+
+// wsRecordingConn parses the WebSocket frames read and written on the connection, the upgrade response written
+// before the first frame is skipped
+type wsRecordingConn struct {
+	net.Conn
+	received wsFrameParser
+	sent     wsFrameParser
+	// upgraded is set once the upgrade response was written
+	upgraded bool
+	head     []byte
+}
+
+func (c *wsRecordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.feed(b[:n])
+	return n, err
+}
+
+func (c *wsRecordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	data := b[:n]
+	if !c.upgraded {
+		c.head = append(c.head, data...)
+		i := indexHeadEnd(c.head)
+		if i < 0 {
+			return n, err
+		}
+		c.upgraded = true
+		data, c.head = c.head[i:], nil
+	}
+	c.sent.feed(data)
+	return n, err
+}
+
+// indexHeadEnd returns the index following the end of the HTTP head in b, -1 if it's incomplete
+func indexHeadEnd(b []byte) int {
+	for i := 0; i+4 <= len(b); i++ {
+		if string(b[i:i+4]) == "\r\n\r\n" {
+			return i + 4
+		}
+	}
+	return -1
+}
+
+// wsFrameParser reassembles the data messages of the WebSocket frames of one direction, see RFC 6455 section 5.2
+type wsFrameParser struct {
+	record func(messageType int, payload []byte)
+	buf    []byte
+	// messageType and message are the type and the payload of the fragmented message being reassembled
+	messageType int
+	message     []byte
+}
+
+func (p *wsFrameParser) feed(data []byte) {
+	p.buf = append(p.buf, data...)
+	for {
+		if len(p.buf) < 2 {
+			return
+		}
+		fin := p.buf[0]&0x80 != 0
+		opcode := int(p.buf[0] & 0x0f)
+		masked := p.buf[1]&0x80 != 0
+		length := uint64(p.buf[1] & 0x7f)
+		headerLen := 2
+		switch length {
+		case 126:
+			if len(p.buf) < 4 {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(p.buf[2:4]))
+			headerLen = 4
+		case 127:
+			if len(p.buf) < 10 {
+				return
+			}
+			length = binary.BigEndian.Uint64(p.buf[2:10])
+			headerLen = 10
+		}
+		var maskKey []byte
+		if masked {
+			if len(p.buf) < headerLen+4 {
+				return
+			}
+			maskKey = p.buf[headerLen : headerLen+4]
+			headerLen += 4
+		}
+		if uint64(len(p.buf)-headerLen) < length {
+			return
+		}
+
+		payload := make([]byte, length)
+		copy(payload, p.buf[headerLen:])
+		for i := range payload {
+			if masked {
+				payload[i] ^= maskKey[i%4]
+			}
+		}
+		p.buf = p.buf[headerLen+int(length):]
+
+		// The control frames may be interleaved with the fragments of a message
+		if opcode >= 8 {
+			continue
+		}
+		if opcode != 0 {
+			p.messageType, p.message = opcode, nil
+		}
+		p.message = append(p.message, payload...)
+		if fin {
+			p.record(p.messageType, p.message)
+			p.message = nil
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("gRPC Message Size Limits", func() {
+	const maxRecvMsgSize = 1024 * 1024 // 1MB
+
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.MaxGRPCRecvMsgSize = maxRecvMsgSize
+		})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should reject packets exceeding the limit with a clean error", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, err := grpc.NewClient(framework.GetHubGRPCAddr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		// Act as a malicious agent sending an oversized packet
+		streamCtx := metadata.AppendToOutgoingContext(ctx, "cluster-name", "malicious-cluster")
+		stream, err := v1.NewTunnelServiceClient(conn).Tunnel(streamCtx)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = stream.Send(&v1.Packet{
+			ConnId: 1,
+			Code:   v1.ControlCode_DATA,
+			Data:   make([]byte, 2*maxRecvMsgSize),
+		})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		Expect(err).To(HaveOccurred())
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+		// The hub keeps serving well-behaved agents
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal("Hello from backend"))
+	})
+})
@@ -0,0 +1,126 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+)
+
+// recordingRequestProcessor records the paths of the requests it processes
+type recordingRequestProcessor struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (p *recordingRequestProcessor) Process(targetServiceURL string, r *http.Request) (error, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paths = append(p.paths, r.URL.Path)
+	return nil, http.StatusOK
+}
+
+func (p *recordingRequestProcessor) Paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.paths...)
+}
+
+var _ = Describe("Multiple Agent Proxies", func() {
+	var (
+		framework          *TestFramework
+		apiserverProcessor *recordingRequestProcessor
+		servicesProcessor  *recordingRequestProcessor
+	)
+
+	BeforeEach(func() {
+		apiserverProcessor = &recordingRequestProcessor{}
+		servicesProcessor = &recordingRequestProcessor{}
+		socketDir := GinkgoT().TempDir()
+
+		framework = NewTestFrameworkWithGinkgo(false).WithAgentConfig(func(config *agent.Config) {
+			config.Proxies = []agent.ProxySpec{
+				{
+					Name:             "apiserver",
+					SocketPath:       filepath.Join(socketDir, "apiserver.sock"),
+					RequestProcessor: apiserverProcessor,
+					// The agent receives the path of the request to the Hub, prefixed by the cluster name
+					Selector: func(r *http.Request) bool {
+						return strings.HasPrefix(r.URL.Path, "/test-cluster/api/") ||
+							strings.HasPrefix(r.URL.Path, "/test-cluster/apis/")
+					},
+				},
+				{
+					Name:             "services",
+					SocketPath:       filepath.Join(socketDir, "services.sock"),
+					RequestProcessor: servicesProcessor,
+					Selector: func(r *http.Request) bool {
+						return strings.HasPrefix(r.URL.Path, "/test-cluster/services/")
+					},
+				},
+			}
+		})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should route the requests to the proxy selected for them", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		// The proxy is selected per connection, the following requests on a connection go to the same proxy
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+		for _, path := range []string{"/api/v1/pods", "/apis/apps/v1/deployments", "/services/my-svc/data"} {
+			resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster%s", framework.GetHubHTTPAddr(), path))
+			Expect(err).NotTo(HaveOccurred())
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("Hello from backend"))
+		}
+
+		Expect(apiserverProcessor.Paths()).To(Equal([]string{"/test-cluster/api/v1/pods", "/test-cluster/apis/apps/v1/deployments"}))
+		Expect(servicesProcessor.Paths()).To(Equal([]string{"/test-cluster/services/my-svc/data"}))
+	})
+
+	It("should fail the requests no proxy is selected for", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/healthz", framework.GetHubHTTPAddr()))
+		if err == nil {
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).NotTo(Equal(http.StatusOK))
+		}
+
+		Expect(apiserverProcessor.Paths()).To(BeEmpty())
+		Expect(servicesProcessor.Paths()).To(BeEmpty())
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+	})
+})
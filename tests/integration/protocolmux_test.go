@@ -0,0 +1,92 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Protocol Mux", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	// setup starts the hub, configured by configure, and the backend of the agents
+	setup := func(configure func(config *server.Config)) {
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork().WithServerConfig(configure)
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello from " + r.URL.Path))
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	Context("with separate ports", func() {
+		BeforeEach(func() {
+			setup(func(config *server.Config) {})
+		})
+
+		It("should answer the HTTP requests to the gRPC port with the HTTP address", func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster/api", framework.GetHubGRPCAddr()))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(string(body)).To(ContainSubstring("tunnel gRPC port"))
+			Expect(string(body)).To(ContainSubstring(framework.GetHubHTTPAddr()))
+		})
+
+		It("should tell the agents connecting to the HTTP port to use the gRPC address", func() {
+			Expect(framework.CreateAgentWithHubAddress("test-cluster", mockServer.GetAddr(), framework.GetHubHTTPAddr())).To(Succeed())
+			Eventually(func() string {
+				return framework.GetAgent("test-cluster").Status().LastError
+			}, 5*time.Second).Should(And(
+				ContainSubstring(agent.ErrNotTunnelEndpoint.Error()),
+				ContainSubstring(framework.GetHubHTTPAddr())))
+			Consistently(framework.GetAgent("test-cluster").ReadyChan(), time.Second).ShouldNot(BeClosed())
+		})
+	})
+
+	Context("in single-port mode", func() {
+		BeforeEach(func() {
+			setup(func(config *server.Config) {
+				config.SinglePortMode = true
+				// The HTTP server is served on the gRPC listener
+				config.HTTPListener.Close()
+				config.HTTPListener = nil
+			})
+		})
+
+		It("should serve the agents and the HTTP requests on the gRPC port", func() {
+			Expect(framework.GetHubHTTPAddr()).To(Equal(framework.GetHubGRPCAddr()))
+			Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+			Eventually(framework.GetAgent("test-cluster").ReadyChan(), 5*time.Second).Should(BeClosed())
+
+			for range 3 {
+				resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/pods", framework.GetHubGRPCAddr()))
+				Expect(err).NotTo(HaveOccurred())
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(string(body)).To(Equal("hello from /test-cluster/api/v1/pods"))
+			}
+		})
+	})
+})
@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"golang.org/x/time/rate"
+)
+
+// countingClusterNameParser counts the requests that reach the inner parser
+type countingClusterNameParser struct {
+	TestClusterNameParser
+	calls atomic.Int32
+}
+
+func (p *countingClusterNameParser) ParseClusterName(r *http.Request) (string, error) {
+	p.calls.Add(1)
+	return p.TestClusterNameParser.ParseClusterName(r)
+}
+
+var _ = Describe("Cluster Name Rate Limiting", func() {
+	var framework *TestFramework
+	var inner *countingClusterNameParser
+
+	BeforeEach(func() {
+		inner = &countingClusterNameParser{}
+		// Allow a burst of 2 requests, the next token is only available after a minute
+		limiter := rate.NewLimiter(rate.Every(time.Minute), 2)
+
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithClusterNameParser(server.NewRateLimitingClusterNameParser(inner, limiter))
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should return too many requests once the limit is exceeded", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		// The hub hijacks the client connection, use a new connection for every request
+		// so that each of them goes through the cluster name parser
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		requestURL := fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr())
+
+		statusCodes := make([]int, 0, 4)
+		for i := 0; i < 4; i++ {
+			resp, err := client.Get(requestURL)
+			Expect(err).NotTo(HaveOccurred())
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statusCodes = append(statusCodes, resp.StatusCode)
+		}
+
+		Expect(statusCodes).To(Equal([]int{
+			http.StatusOK,
+			http.StatusOK,
+			http.StatusTooManyRequests,
+			http.StatusTooManyRequests,
+		}))
+		// Rate limited requests never reach the inner parser
+		Expect(inner.calls.Load()).To(Equal(int32(2)))
+	})
+
+	It("should rate limit requests for unknown clusters before resolving them", func() {
+		client := &http.Client{Timeout: 5 * time.Second}
+
+		var tooManyRequests int
+		for i := 0; i < 5; i++ {
+			resp, err := client.Get(fmt.Sprintf("http://%s/random-%d/api/v1/test", framework.GetHubHTTPAddr(), i))
+			Expect(err).NotTo(HaveOccurred())
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			if resp.StatusCode == http.StatusTooManyRequests {
+				tooManyRequests++
+				Expect(string(body)).To(ContainSubstring("Too many requests"))
+			} else {
+				// No agent is connected
+				Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			}
+		}
+
+		Expect(tooManyRequests).To(Equal(3))
+		Expect(inner.calls.Load()).To(Equal(int32(2)))
+	})
+})
@@ -0,0 +1,81 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Read Deadline", func() {
+	var framework *TestFramework
+	var release chan struct{}
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork()
+		Expect(framework.Setup()).To(Succeed())
+
+		// The backend hangs until the spec releases it, like an agent stuck writing to its target
+		release = make(chan struct{})
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/test-cluster/stream" {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("event\n"))
+				w.(http.Flusher).Flush()
+			}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(framework.GetAgent("test-cluster").ReadyChan(), 5*time.Second).Should(BeClosed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			close(release)
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should end the requests at the read deadline", func() {
+		client := &http.Client{Timeout: time.Minute}
+		streamDone := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/stream", framework.GetHubHTTPAddr()))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			body, _ := io.ReadAll(resp.Body)
+			streamDone <- string(body)
+		}()
+
+		// The agent never responds, the client gets 504 Gateway Timeout instead of waiting forever
+		start := time.Now()
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/hang", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusGatewayTimeout))
+		Expect(string(body)).To(ContainSubstring("read deadline exceeded"))
+		Expect(time.Since(start)).To(BeNumerically("~", 30*time.Second, 5*time.Second))
+
+		// The response already being written ends without an error response appended to it
+		var streamed string
+		Eventually(streamDone, 10*time.Second).Should(Receive(&streamed))
+		Expect(streamed).To(Equal("event\n"))
+
+		// The agent closes its connections to the backend
+		Eventually(func() int {
+			return framework.GetAgent("test-cluster").PacketConnMetrics().ActiveConnections
+		}, 5*time.Second).Should(BeZero())
+	})
+})
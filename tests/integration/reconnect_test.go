@@ -8,9 +8,22 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
 )
 
 var _ = Describe("Agent Reconnection", func() {
+	// Each spec creates its own frameworks, leakChecker only snapshots the goroutines running before the spec
+	var leakChecker *TestFramework
+
+	BeforeEach(func() {
+		leakChecker = NewTestFrameworkWithGinkgo(false)
+	})
+
+	AfterEach(func() {
+		leakChecker.Cleanup()
+		leakChecker.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+	})
+
 	It("should reconnect after hub restart", func() {
 		framework := NewTestFrameworkWithGinkgo(false)
 		defer framework.Cleanup()
@@ -128,7 +141,7 @@ var _ = Describe("Agent Reconnection", func() {
 	})
 
 	It("should handle multiple agents reconnecting", func() {
-		framework := NewTestFrameworkWithGinkgo(false)
+		framework := NewTestFrameworkWithGinkgo(false).WithClusterNameParser(server.NewClusterNameParserImplt())
 		defer framework.Cleanup()
 
 		Expect(framework.Setup()).To(Succeed())
@@ -287,7 +300,7 @@ var _ = Describe("Agent Reconnection", func() {
 	})
 
 	It("should handle concurrent reconnections from multiple agents", func() {
-		framework := NewTestFrameworkWithGinkgo(false)
+		framework := NewTestFrameworkWithGinkgo(false).WithClusterNameParser(server.NewClusterNameParserImplt())
 		defer framework.Cleanup()
 
 		Expect(framework.Setup()).To(Succeed())
@@ -0,0 +1,99 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Hub Replicas", func() {
+	var (
+		locator *server.MemoryTunnelLocator
+		// replica0 holds the tunnel of the agent, replica1 forwards the requests to it
+		replica0, replica1 *TestFramework
+	)
+
+	BeforeEach(func() {
+		locator = server.NewMemoryTunnelLocator()
+		withLocator := func(config *server.Config) {
+			config.TunnelLocator = locator
+		}
+		replica0 = NewTestFrameworkWithGinkgo(false).WithServerConfig(withLocator)
+		Expect(replica0.Setup()).To(Succeed())
+		replica1 = NewTestFrameworkWithGinkgo(false).WithServerConfig(withLocator)
+		Expect(replica1.Setup()).To(Succeed())
+
+		mockServer, err := replica0.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend: " + r.Method + " " + r.URL.Path + " " + string(body)))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replica0.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(func() bool {
+			_, ok := locator.Lookup("test-cluster")
+			return ok
+		}, 5*time.Second, 50*time.Millisecond).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		replica1.Cleanup()
+		replica0.Cleanup()
+		// replica0 was created first, it checks the goroutines of both
+		replica0.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+	})
+
+	// do sends the request to the HTTP server of the replica and returns the status and the body of the response
+	do := func(replica *TestFramework, method, path, body string, header http.Header) (int, string) {
+		req, err := http.NewRequest(method, "http://"+replica.GetHubHTTPAddr()+path, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(respBody)
+	}
+
+	It("should forward the requests for a cluster connected to another replica", func() {
+		Expect(replica1.GetHubServer().GetTunnel("test-cluster")).To(BeNil())
+
+		status, body := do(replica1, "GET", "/test-cluster/api/v1/pods", "", nil)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend: GET /test-cluster/api/v1/pods "))
+
+		status, body = do(replica1, "POST", "/test-cluster/api/v1/namespaces/default/pods", `{"kind":"Pod"}`, nil)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(`Hello from backend: POST /test-cluster/api/v1/namespaces/default/pods {"kind":"Pod"}`))
+
+		// The replica holding the tunnel serves the requests itself
+		status, _ = do(replica0, "GET", "/test-cluster/api/v1/pods", "", nil)
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	It("should not forward the requests forwarded by a replica", func() {
+		status, body := do(replica1, "GET", "/test-cluster/api/v1/pods", "", http.Header{server.ForwardedByHeader: {"http://hub-2:8080"}})
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(ContainSubstring("Cluster test-cluster not available"))
+	})
+
+	It("should stop forwarding once the agent disconnects", func() {
+		Expect(replica0.DrainAndWait("test-cluster", 10*time.Second)).To(Succeed())
+		Eventually(func() bool {
+			_, ok := locator.Lookup("test-cluster")
+			return ok
+		}, 5*time.Second, 50*time.Millisecond).Should(BeFalse())
+
+		status, _ := do(replica1, "GET", "/test-cluster/api/v1/pods", "", nil)
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+	})
+})
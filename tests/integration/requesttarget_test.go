@@ -0,0 +1,125 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Request Targets", func() {
+	var framework *TestFramework
+	var mockServer *MockServer
+
+	// setup starts the hub with the middleware if it's not nil, and an agent routing the requests to the backend
+	setup := func(middleware func(http.Handler) http.Handler) {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithClusterNameParser(server.NewClusterNameParserImplt()).
+			WithServerConfig(func(config *server.Config) {
+				if middleware != nil {
+					config.HTTPMiddlewares = append(config.HTTPMiddlewares, middleware)
+				}
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		var err error
+		mockServer, err = framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// send writes the raw request on a new TCP connection to the hub and reads its response
+	send := func(rawRequest string) (int, string) {
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = conn.Write([]byte(rawRequest))
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should forward an absolute-form request target in origin form", func() {
+		setup(nil)
+		hub := framework.GetHubHTTPAddr()
+
+		status, body := send(fmt.Sprintf("GET http://%s/test-cluster/api/v1/pods?watch=false HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", hub, hub))
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+
+		// The authority of the request target takes precedence over a different Host header
+		status, _ = send(fmt.Sprintf("GET http://%s/test-cluster/api/v1/pods HTTP/1.1\r\nHost: other.example.com\r\nConnection: close\r\n\r\n", hub))
+		Expect(status).To(Equal(http.StatusOK))
+
+		requests := mockServer.GetRequests()
+		Expect(requests).To(HaveLen(2))
+		for _, request := range requests {
+			Expect(request.Path).To(Equal("/test-cluster/api/v1/pods"))
+		}
+	})
+
+	It("should reject a request with duplicate Host headers", func() {
+		setup(nil)
+
+		status, _ := send("GET /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub.example.com\r\nHost: evil.example.com\r\nConnection: close\r\n\r\n")
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+	})
+
+	It("should send exactly one Host header when a middleware sets Host headers", func() {
+		setup(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Add("Host", "middleware.example.com")
+				r.Header.Add("Host", "other.example.com")
+				next.ServeHTTP(w, r)
+			})
+		})
+
+		// The agent's HTTP server rejects the requests with several Host headers
+		status, body := send("GET /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub.example.com\r\nConnection: close\r\n\r\n")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello from backend"))
+	})
+
+	It("should reject an absolute-form request whose Host a middleware changed", func() {
+		setup(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Host = "other.example.com"
+				next.ServeHTTP(w, r)
+			})
+		})
+		hub := framework.GetHubHTTPAddr()
+
+		status, body := send(fmt.Sprintf("GET http://%s/test-cluster/api/v1/pods HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", hub, hub))
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring("conflicts with Host other.example.com"))
+		Expect(mockServer.GetRequests()).To(BeEmpty())
+
+		// An origin-form request is routed by the Host the middleware set
+		status, _ = send("GET /test-cluster/api/v1/pods HTTP/1.1\r\nHost: hub.example.com\r\nConnection: close\r\n\r\n")
+		Expect(status).To(Equal(http.StatusOK))
+	})
+})
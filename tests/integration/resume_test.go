@@ -0,0 +1,155 @@
+package integration
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Connection Resumption", func() {
+	const (
+		chunkSize = 64 * 1024
+		chunks    = 64 // 4MB
+	)
+
+	var framework *TestFramework
+	var proxy *partitionProxy
+	// payload is streamed by the backend in flushed chunks, so the response is in flight when the connection is killed
+	payload := make([]byte, chunkSize*chunks)
+	for i := range payload {
+		payload[i] = byte(rand.IntN(256))
+	}
+	expected := sha256.Sum256(payload)
+
+	// setup starts the hub and an agent connected through the partition proxy with the resume windows, and the
+	// integrity check on both sides if integrity is set
+	setup := func(hubWindow, agentWindow time.Duration, integrity bool) {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.ResumeWindow = hubWindow
+				config.EnableIntegrityCheck = integrity
+			}).
+			WithAgentConfig(func(config *agent.Config) {
+				config.HubAddress = proxy.Addr()
+				config.ResumeWindow = agentWindow
+				config.EnableIntegrityCheck = integrity
+			})
+
+		// The proxy needs the Hub address, which is only known once the Hub is started
+		Expect(framework.Setup()).To(Succeed())
+		var err error
+		proxy, err = newPartitionProxy(framework.GetHubGRPCAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+			w.WriteHeader(http.StatusOK)
+			for i := 0; i < chunks; i++ {
+				if _, err := w.Write(payload[i*chunkSize : (i+1)*chunkSize]); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// download requests the payload, kill is called once the response is in flight
+	download := func(kill func()) ([32]byte, error) {
+		client := &http.Client{Timeout: 15 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/download", framework.GetHubHTTPAddr()))
+		if err != nil {
+			return [32]byte{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return [32]byte{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		// Read part of the response before the connection is killed
+		hash := sha256.New()
+		if _, err := io.CopyN(hash, resp.Body, 512*1024); err != nil {
+			return [32]byte{}, err
+		}
+		kill()
+		if _, err := io.Copy(hash, resp.Body); err != nil {
+			return [32]byte{}, err
+		}
+		var sum [32]byte
+		copy(sum[:], hash.Sum(nil))
+		return sum, nil
+	}
+
+	AfterEach(func() {
+		if proxy != nil {
+			proxy.Close()
+		}
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should resume an in-flight response bit-exact when the tunnel connection is killed", func() {
+		setup(5*time.Second, 5*time.Second, false)
+
+		sum, err := download(proxy.Kill)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sum).To(Equal(expected))
+
+		// New requests work on the new tunnel too
+		sum, err = download(func() {})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sum).To(Equal(expected))
+	})
+
+	It("should resume an in-flight response with the integrity check on", func() {
+		// The retransmitted packets are checksummed again for the new stream while the previous one may still be
+		// sending them, which the race detector of make test-integration checks
+		setup(5*time.Second, 5*time.Second, true)
+
+		sum, err := download(proxy.Kill)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sum).To(Equal(expected))
+	})
+
+	It("should fail the in-flight response when the agent doesn't reconnect within the resume window", func() {
+		setup(500*time.Millisecond, 500*time.Millisecond, false)
+
+		sum, err := download(func() {
+			proxy.Block(true)
+			proxy.Kill()
+			time.AfterFunc(2*time.Second, func() {
+				proxy.Block(false)
+			})
+		})
+		Expect(err != nil || sum != expected).To(BeTrue(), "expected the response to fail")
+
+		// The agent reconnects once it's unblocked
+		Eventually(func() error {
+			sum, err := download(func() {})
+			if err == nil && sum != expected {
+				err = fmt.Errorf("unexpected payload")
+			}
+			return err
+		}, 10*time.Second, 500*time.Millisecond).Should(Succeed())
+	})
+
+	It("should fail the in-flight response when the hub doesn't resume connections", func() {
+		setup(0, 5*time.Second, false)
+
+		sum, err := download(proxy.Kill)
+		Expect(err != nil || sum != expected).To(BeTrue(), "expected the response to fail")
+	})
+})
@@ -0,0 +1,88 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Response Rewriting", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		rewriter, err := server.NewHeaderResponseRewriter("")
+		Expect(err).NotTo(HaveOccurred())
+
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.ResponseRewriter = rewriter
+		})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should rewrite in-cluster Location and Set-Cookie headers", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Domain: "backend.default.svc", Path: "/"})
+			http.Redirect(w, r, "http://backend.default.svc:8080/login", http.StatusFound)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		hubHTTPAddr := framework.GetHubHTTPAddr()
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/dashboard", hubHTTPAddr))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+
+		Expect(resp.StatusCode).To(Equal(http.StatusFound))
+		Expect(resp.Header.Get("Location")).To(Equal(fmt.Sprintf("http://%s/test-cluster/login", hubHTTPAddr)))
+
+		cookies := resp.Cookies()
+		Expect(cookies).To(HaveLen(1))
+		Expect(cookies[0].Name).To(Equal("session"))
+		Expect(cookies[0].Domain).To(BeEmpty())
+		Expect(cookies[0].Path).To(Equal("/test-cluster/"))
+	})
+
+	It("should forward responses without in-cluster references unchanged", func() {
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", "https://example.com/docs")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Location")).To(Equal("https://example.com/docs"))
+		Expect(string(body)).To(Equal("Hello from backend"))
+	})
+})
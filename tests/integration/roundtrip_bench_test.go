@@ -0,0 +1,61 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+// BenchmarkRoundTrip measures the latency of a request proxied by the hub's RoundTrip, through the tunnel of an agent
+// to its backend. NewConn opens a packet connection for each request, ReusedConn reuses the idle ones
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, c := range []struct {
+		name      string
+		connReuse *server.ConnReuseConfig
+	}{
+		{name: "NewConn"},
+		{name: "ReusedConn", connReuse: &server.ConnReuseConfig{}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			framework := NewTestFramework(b, false).WithInMemoryNetwork().WithServerConfig(func(config *server.Config) {
+				config.ConnReuse = c.connReuse
+			})
+			if err := framework.Setup(); err != nil {
+				b.Fatalf("failed to set up: %v", err)
+			}
+			defer framework.Cleanup()
+
+			mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			})
+			if err != nil {
+				b.Fatalf("failed to create the backend: %v", err)
+			}
+			if err := framework.CreateAgent("test-cluster", mockServer.GetAddr()); err != nil {
+				b.Fatalf("failed to create the agent: %v", err)
+			}
+			// The agent is ready before the hub registers its tunnel
+			for deadline := time.Now().Add(5 * time.Second); framework.GetHubServer().GetTunnel("test-cluster") == nil; {
+				if time.Now().After(deadline) {
+					b.Fatalf("expected the tunnel of the agent to be registered")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			client := &http.Client{Transport: framework.GetHubServer().TransportFor("test-cluster")}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get("http://in-process/test-cluster/api")
+				if err != nil {
+					b.Fatalf("failed to send the request: %v", err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
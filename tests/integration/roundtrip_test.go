@@ -0,0 +1,168 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Hub RoundTrip", func() {
+	var framework *TestFramework
+	var release chan struct{}
+	var client *http.Client
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork()
+		Expect(framework.Setup()).To(Succeed())
+
+		release = make(chan struct{})
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/test-cluster/echo":
+				body, _ := io.ReadAll(r.Body)
+				w.Header().Set("X-Method", r.Method)
+				w.Write(body)
+			case "/test-cluster/slow":
+				// The response never comes until the spec releases it
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			default:
+				w.Write([]byte("hello from " + r.URL.Path))
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(framework.GetAgent("test-cluster").ReadyChan(), 5*time.Second).Should(BeClosed())
+		// The agent is ready once its stream is open, the hub registers the tunnel right after
+		Eventually(func() bool { return framework.GetHubServer().GetTunnel("test-cluster") != nil }, 5*time.Second).Should(BeTrue())
+
+		// The host is never dialed, the requests go through the tunnel without the HTTP listener
+		client = &http.Client{Transport: framework.GetHubServer().TransportFor("test-cluster")}
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			close(release)
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should proxy GET requests", func() {
+		for range 3 {
+			resp, err := client.Get("http://in-process/test-cluster/api/v1/pods?limit=1")
+			Expect(err).NotTo(HaveOccurred())
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("hello from /test-cluster/api/v1/pods"))
+		}
+
+		// Each request closes its connection once its body is closed
+		Eventually(func() int {
+			return framework.GetAgent("test-cluster").PacketConnMetrics().ActiveConnections
+		}, 5*time.Second).Should(BeZero())
+	})
+
+	It("should proxy the request bodies", func() {
+		payload := strings.Repeat("0123456789", 10*1024)
+		resp, err := client.Post("http://in-process/test-cluster/echo", "text/plain", strings.NewReader(payload))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Header.Get("X-Method")).To(Equal(http.MethodPost))
+		Expect(string(body)).To(Equal(payload))
+	})
+
+	It("should return once the context is canceled", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://in-process/test-cluster/slow", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		start := time.Now()
+		_, err = client.Do(req)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue(), "unexpected error: %v", err)
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		// The agent closes its connection to the backend
+		Eventually(func() int {
+			return framework.GetAgent("test-cluster").PacketConnMetrics().ActiveConnections
+		}, 5*time.Second).Should(BeZero())
+	})
+
+	It("should fail for a cluster without a tunnel", func() {
+		req, err := http.NewRequest(http.MethodGet, "http://in-process/unknown-cluster/api", nil)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := framework.GetHubServer().RoundTrip(context.Background(), "unknown-cluster", req)
+		Expect(errors.Is(err, server.ErrTunnelNotFound)).To(BeTrue(), "unexpected error: %v", err)
+		Expect(resp).To(BeNil())
+	})
+})
+
+var _ = Describe("Hub RoundTrip connection reuse", func() {
+	var framework *TestFramework
+	var client *http.Client
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork().WithServerConfig(func(config *server.Config) {
+			config.ConnReuse = &server.ConnReuseConfig{MaxRequestsPerConn: 3}
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello from " + r.URL.Path))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(func() *server.Tunnel {
+			return framework.GetHubServer().GetTunnel("test-cluster")
+		}, 5*time.Second).ShouldNot(BeNil())
+
+		client = &http.Client{Transport: framework.GetHubServer().TransportFor("test-cluster")}
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	get := func(path string) {
+		resp, err := client.Get("http://in-process" + path)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal("hello from " + path))
+	}
+
+	It("should send back-to-back requests on the same connection", func() {
+		activeConnections := func() int {
+			return framework.GetAgent("test-cluster").PacketConnMetrics().ActiveConnections
+		}
+
+		get("/test-cluster/api/v1/pods")
+		Expect(activeConnections()).To(Equal(1))
+		get("/test-cluster/api/v1/services")
+		Consistently(activeConnections, 500*time.Millisecond).Should(Equal(1))
+
+		// The connection is closed once it served MaxRequestsPerConn requests
+		get("/test-cluster/api/v1/nodes")
+		Eventually(activeConnections, 5*time.Second).Should(BeZero())
+	})
+})
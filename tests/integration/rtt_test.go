@@ -0,0 +1,160 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "github.com/xuezhaojun/multiclustertunnel/api/v1"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"google.golang.org/grpc"
+)
+
+const (
+	// injectedDelay is the artificial latency added to every PONG
+	injectedDelay = 100 * time.Millisecond
+	// rttPingInterval leaves room for the delayed PONGs, so they don't queue up
+	rttPingInterval = 200 * time.Millisecond
+)
+
+// delayPong delays a received PONG packet by injectedDelay
+func delayPong(m any) {
+	if packet, ok := m.(*v1.Packet); ok && packet.Code == v1.ControlCode_PONG {
+		time.Sleep(injectedDelay)
+	}
+}
+
+// delayedServerStream injects the delay into the PONGs received by the Hub
+type delayedServerStream struct {
+	grpc.ServerStream
+}
+
+func (s *delayedServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	delayPong(m)
+	return nil
+}
+
+// delayedClientStream injects the delay into the PONGs received by the agent
+type delayedClientStream struct {
+	grpc.ClientStream
+}
+
+func (s *delayedClientStream) RecvMsg(m any) error {
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	delayPong(m)
+	return nil
+}
+
+// gatherGauge returns the value of a gauge from the default Prometheus registry
+func gatherGauge(name string, labels map[string]string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+var _ = Describe("Tunnel RTT", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.PingInterval = rttPingInterval
+				config.EnableDebugEndpoints = true
+				config.StreamInterceptors = []grpc.StreamServerInterceptor{
+					func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+						return handler(srv, &delayedServerStream{ServerStream: ss})
+					},
+				}
+			}).
+			WithAgentConfig(func(config *agent.Config) {
+				config.PingInterval = rttPingInterval
+				config.DialOptions = append(config.DialOptions, grpc.WithStreamInterceptor(
+					func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+						cs, err := streamer(ctx, desc, cc, method, opts...)
+						if err != nil {
+							return nil, err
+						}
+						return &delayedClientStream{ClientStream: cs}, nil
+					}))
+			})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should converge near the injected latency on both sides", func() {
+		Expect(framework.CreateAgent("rtt-cluster", "localhost:0")).To(Succeed())
+		agentClient := framework.GetAgent("rtt-cluster")
+		Expect(agentClient).NotTo(BeNil())
+
+		nearInjectedDelay := And(
+			BeNumerically(">=", injectedDelay),
+			BeNumerically("<", injectedDelay+50*time.Millisecond),
+		)
+
+		// Hub side
+		Eventually(func() time.Duration {
+			tunnel := framework.hubServer.GetTunnel("rtt-cluster")
+			if tunnel == nil {
+				return 0
+			}
+			return tunnel.RTT()
+		}, 5*time.Second, rttPingInterval).Should(nearInjectedDelay)
+
+		// Agent side
+		Eventually(agentClient.RTT, 5*time.Second, rttPingInterval).Should(nearInjectedDelay)
+
+		// Prometheus gauges
+		hubRTT, ok := gatherGauge("multiclustertunnel_hub_tunnel_rtt_seconds", map[string]string{"cluster": "rtt-cluster"})
+		Expect(ok).To(BeTrue())
+		Expect(hubRTT).To(BeNumerically(">=", injectedDelay.Seconds()))
+		agentRTT, ok := gatherGauge("multiclustertunnel_agent_tunnel_rtt_seconds", nil)
+		Expect(ok).To(BeTrue())
+		Expect(agentRTT).To(BeNumerically(">=", injectedDelay.Seconds()))
+
+		// Debug endpoint
+		resp, err := http.Get(fmt.Sprintf("http://%s/debug/tunnels", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var tunnels []struct {
+			ClusterName string  `json:"cluster_name"`
+			RTTSeconds  float64 `json:"rtt_seconds"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&tunnels)).To(Succeed())
+		Expect(tunnels).To(HaveLen(1))
+		Expect(tunnels[0].ClusterName).To(Equal("rtt-cluster"))
+		Expect(tunnels[0].RTTSeconds).To(BeNumerically(">=", injectedDelay.Seconds()))
+	})
+})
@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("TLS Server Name", func() {
+	var framework *TestFramework
+
+	// setup starts the hub with a gRPC certificate for localhost only, and an agent connecting to it via 127.0.0.1
+	// with the TLS server name
+	setup := func(tlsServerName string) {
+		keyPair, err := getTestCerts().ca.IssueServer("localhost")
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := keyPair.TLSCertificate()
+		Expect(err).NotTo(HaveOccurred())
+
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.GRPCTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			}).
+			WithAgentConfig(func(config *agent.Config) {
+				// The credentials verify the certificate for the authority, they don't set the ServerName
+				config.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+					RootCAs: getTestCerts().ca.CertPool(),
+				}))}
+				config.TLSServerName = tlsServerName
+			})
+		Expect(framework.Setup()).To(Succeed())
+		Expect(framework.GetHubGRPCAddr()).To(HavePrefix("127.0.0.1:"))
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should verify the hub certificate for the TLS server name", func() {
+		setup("localhost")
+
+		Eventually(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") != nil
+		}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal("Hello from backend"))
+	})
+
+	It("should fail to connect without the TLS server name", func() {
+		setup("")
+
+		Consistently(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") != nil
+		}, 2*time.Second, 100*time.Millisecond).Should(BeFalse())
+	})
+})
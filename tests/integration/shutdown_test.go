@@ -0,0 +1,97 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Agent Shutdown", func() {
+	var framework *TestFramework
+	var release chan struct{}
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithInMemoryNetwork()
+		Expect(framework.Setup()).To(Succeed())
+
+		// The backend streams until the spec releases it, like a watch
+		release = make(chan struct{})
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("event\n"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(framework.GetAgent("test-cluster").ReadyChan(), 5*time.Second).Should(BeClosed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			close(release)
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should close the connections to the proxies before the agent stops", func() {
+		agentClient := framework.GetAgent("test-cluster")
+
+		// Open streams through the tunnel and read their first event
+		const streams = 5
+		var wg sync.WaitGroup
+		for i := range streams {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster/watch/%d", framework.GetHubHTTPAddr(), i))
+				if err != nil {
+					return
+				}
+				defer resp.Body.Close()
+				io.Copy(io.Discard, resp.Body)
+			}()
+		}
+		Eventually(func() int { return agentClient.PacketConnMetrics().ActiveConnections }, 5*time.Second).Should(Equal(streams))
+
+		// The agent waits for its connections to close, which happens as soon as it's stopped, not after the
+		// shutdown timeout
+		start := time.Now()
+		Expect(framework.StopAgent("test-cluster", 10*time.Second)).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(agentClient.PacketConnMetrics().ActiveConnections).To(BeZero())
+		Expect(agentClient.ListConnections()).To(BeEmpty())
+
+		// The streams of the clients end with the tunnel
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		Eventually(done, 10*time.Second).Should(BeClosed())
+		Eventually(func() bool { return framework.GetHubServer().GetTunnel("test-cluster") == nil }, 5*time.Second).Should(BeTrue())
+	})
+
+	It("should not wait for the shutdown timeout when no connection is open", func() {
+		agentClient := framework.GetAgent("test-cluster")
+		resp, err := http.Get(fmt.Sprintf("http://%s/test-cluster/api", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Eventually(func() int { return agentClient.PacketConnMetrics().ActiveConnections }, 5*time.Second).Should(BeZero())
+
+		start := time.Now()
+		Expect(framework.StopAgent("test-cluster", 10*time.Second)).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
@@ -0,0 +1,133 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Tunnel Connection Limits", func() {
+	var framework *TestFramework
+	var proxy *partitionProxy
+
+	AfterEach(func() {
+		if proxy != nil {
+			proxy.Close()
+			proxy = nil
+		}
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	// burst sends concurrent requests on new client connections and returns the responses by status code
+	burst := func(count int) map[int][]*http.Response {
+		var mu sync.Mutex
+		responses := map[int][]*http.Response{}
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				client := &http.Client{
+					Timeout:   10 * time.Second,
+					Transport: &http.Transport{DisableKeepAlives: true},
+				}
+				resp, err := client.Get(fmt.Sprintf("http://%s/test-cluster/api/v1/test", framework.GetHubHTTPAddr()))
+				Expect(err).NotTo(HaveOccurred())
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				mu.Lock()
+				responses[resp.StatusCode] = append(responses[resp.StatusCode], resp)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return responses
+	}
+
+	It("should shape a burst of requests right after the agent reconnects", func() {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.SlowStartWindow = 2 * time.Second
+				config.SlowStartQPS = 2
+				config.SlowStartBurst = 1
+			}).
+			WithAgentConfig(func(config *agent.Config) {
+				config.HubAddress = proxy.Addr()
+			})
+		Expect(framework.Setup()).To(Succeed())
+		var err error
+		proxy, err = newPartitionProxy(framework.GetHubGRPCAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+
+		// Let the slow start window of the first connection pass
+		time.Sleep(2500 * time.Millisecond)
+		responses := burst(6)
+		Expect(responses[http.StatusOK]).To(HaveLen(6))
+
+		By("Reconnecting the agent")
+		proxy.Partition()
+		time.Sleep(500 * time.Millisecond)
+
+		// 2 connections per second, each queued for at most a second
+		responses = burst(8)
+		Expect(len(responses[http.StatusOK])).To(BeNumerically(">=", 1))
+		Expect(len(responses[http.StatusOK])).To(BeNumerically("<=", 4))
+		Expect(responses[http.StatusServiceUnavailable]).NotTo(BeEmpty())
+		Expect(len(responses[http.StatusOK]) + len(responses[http.StatusServiceUnavailable])).To(Equal(8))
+		for _, resp := range responses[http.StatusServiceUnavailable] {
+			Expect(resp.Header.Get("Retry-After")).To(Equal("1"))
+		}
+
+		By("Lifting the cap after the slow start window")
+		time.Sleep(2 * time.Second)
+		responses = burst(8)
+		Expect(responses[http.StatusOK]).To(HaveLen(8))
+	})
+
+	It("should reject connections beyond the maximum per tunnel", func() {
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithServerConfig(func(config *server.Config) {
+				config.MaxPacketConnsPerTunnel = 2
+			})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(1 * time.Second)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Hello from backend"))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		responses := burst(4)
+		Expect(responses[http.StatusOK]).To(HaveLen(2))
+		Expect(responses[http.StatusTooManyRequests]).To(HaveLen(2))
+		for _, resp := range responses[http.StatusTooManyRequests] {
+			Expect(resp.Header.Get("Retry-After")).To(Equal("1"))
+		}
+
+		// The connections are released once the requests are done
+		responses = burst(2)
+		Expect(responses[http.StatusOK]).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/agent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var _ = Describe("Agent Startup", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should close the ready channel once connected to the hub", func() {
+		Expect(framework.CreateAgent("test-cluster", "localhost:0")).To(Succeed())
+
+		agentClient := framework.GetAgent("test-cluster")
+		Expect(agentClient).NotTo(BeNil())
+		Eventually(agentClient.ReadyChan(), 5*time.Second).Should(BeClosed())
+	})
+
+	It("should return ErrInitialConnectTimeout when the hub is unreachable", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Nothing listens on a listener that has been closed
+		listener, err := framework.GetGRPCListener()
+		Expect(err).NotTo(HaveOccurred())
+		unreachableAddr := listener.Addr().String()
+		listener.Close()
+
+		config := &agent.Config{
+			HubAddress:    unreachableAddr,
+			ClusterName:   "unreachable-cluster",
+			UDSSocketPath: filepath.Join(GinkgoT().TempDir(), "agent.sock"),
+			DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			BackoffFactory: func() backoff.BackOff {
+				b := backoff.NewExponentialBackOff()
+				b.InitialInterval = 100 * time.Millisecond
+				b.MaxInterval = 200 * time.Millisecond
+				return b
+			},
+			InitialConnectTimeout: 1 * time.Second,
+		}
+		agentClient := agent.New(ctx, config, &TestRequestProcessor{}, &TestCertificateProvider{}, &TestRouter{})
+
+		start := time.Now()
+		err = agentClient.Run(ctx)
+		Expect(errors.Is(err, agent.ErrInitialConnectTimeout)).To(BeTrue(), "unexpected error: %v", err)
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(agentClient.ReadyChan()).NotTo(BeClosed())
+	})
+})
@@ -0,0 +1,78 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP Trailers", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should forward the trailers of a chunked response after the final chunk", func() {
+		// A watch-like response streaming events in chunks, with a declared and an undeclared trailer
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			for _, event := range []string{`{"type":"ADDED"}`, `{"type":"MODIFIED"}`} {
+				w.Write([]byte(event + "\n"))
+				w.(http.Flusher).Flush()
+			}
+			w.Header().Set("Grpc-Status", "0")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("GET /test-cluster/api/v1/pods?watch=true HTTP/1.1\r\nHost: hub.example.com\r\nConnection: close\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		// The raw bytes of the response are recorded while the client reads it up to the trailers
+		var raw bytes.Buffer
+		resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(conn, &raw)), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		events, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(events)).To(Equal("{\"type\":\"ADDED\"}\n{\"type\":\"MODIFIED\"}\n"))
+		Expect(resp.Trailer.Get("Grpc-Status")).To(Equal("0"))
+		Expect(resp.Trailer.Get("Grpc-Message")).To(Equal("done"))
+
+		// The hub forwards the bytes of the response as they are: the trailers follow the final, empty chunk
+		head, body, found := strings.Cut(raw.String(), "\r\n\r\n")
+		Expect(found).To(BeTrue())
+		Expect(head).To(ContainSubstring("Transfer-Encoding: chunked"))
+		Expect(head).To(ContainSubstring("Trailer: Grpc-Status"))
+		lastChunk := strings.LastIndex(body, "\r\n0\r\n")
+		Expect(lastChunk).To(BeNumerically(">=", 0))
+		trailers := body[lastChunk+len("\r\n0\r\n"):]
+		Expect(trailers).To(ContainSubstring("Grpc-Status: 0\r\n"))
+		Expect(trailers).To(ContainSubstring("Grpc-Message: done\r\n"))
+		Expect(trailers).To(HaveSuffix("\r\n\r\n"))
+		Expect(body[:lastChunk]).NotTo(ContainSubstring("Grpc-Status"))
+	})
+})
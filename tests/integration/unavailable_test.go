@@ -0,0 +1,228 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"golang.org/x/time/rate"
+)
+
+// unavailableResponse is a response of the hub to a request it can't forward to its cluster
+type unavailableResponse struct {
+	status     int
+	retryAfter string
+	body       server.ClusterUnavailable
+}
+
+// getUnavailable sends a request to the cluster on a new client connection, and decodes the body of a response
+// other than 200 OK
+func getUnavailable(framework *TestFramework, clusterName string) unavailableResponse {
+	return getUnavailableAs(framework, clusterName, "")
+}
+
+// getUnavailableAs is getUnavailable for the request of a user identified by X-Remote-User, none if empty
+func getUnavailableAs(framework *TestFramework, clusterName, user string) unavailableResponse {
+	return pollUnavailable(Default, framework, clusterName, user)
+}
+
+// pollUnavailable is getUnavailableAs asserting with g, so that Eventually retries the responses of a cluster whose
+// tunnel the hub didn't remove yet, e.g. a plain text 502 Bad Gateway
+func pollUnavailable(g Gomega, framework *TestFramework, clusterName, user string) unavailableResponse {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/%s/api/v1/test", framework.GetHubHTTPAddr(), clusterName), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	if user != "" {
+		req.Header.Set("X-Remote-User", user)
+	}
+	// A clone of http.DefaultTransport dials through the in-memory network too
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	resp, err := client.Do(req)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer resp.Body.Close()
+
+	response := unavailableResponse{status: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After")}
+	if resp.StatusCode != http.StatusOK {
+		g.Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		g.Expect(json.NewDecoder(resp.Body).Decode(&response.body)).To(Succeed())
+	}
+	return response
+}
+
+var _ = Describe("Cluster Unavailable Responses", func() {
+	var framework *TestFramework
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should tell draining from disconnected clusters, and when they were last seen", func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+
+		inFlight := make(chan struct{})
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			close(inFlight)
+			time.Sleep(1500 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		By("Draining the agent while a request is in flight")
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			Expect(getUnavailable(framework, "test-cluster").status).To(Equal(http.StatusOK))
+		}()
+		Eventually(inFlight, 3*time.Second).Should(BeClosed())
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			Expect(framework.DrainAndWait("test-cluster", 5*time.Second)).To(Succeed())
+		}()
+
+		var response unavailableResponse
+		Eventually(func(g Gomega) string {
+			response = pollUnavailable(g, framework, "test-cluster", "")
+			return response.body.Reason
+		}, 3*time.Second, 50*time.Millisecond).Should(Equal(server.ReasonDraining))
+		Expect(response.status).To(Equal(http.StatusServiceUnavailable))
+		Expect(response.retryAfter).To(Equal("1"))
+		Expect(response.body.Cluster).To(Equal("test-cluster"))
+		Expect(response.body.RetryAfterSeconds).To(Equal(1))
+		Expect(response.body.LastSeen).NotTo(BeNil())
+		Expect(response.body.Message).To(ContainSubstring("is draining"))
+
+		By("Requesting the cluster once the agent stopped")
+		wg.Wait()
+		disconnected := time.Now()
+		Eventually(func(g Gomega) string {
+			response = pollUnavailable(g, framework, "test-cluster", "")
+			return response.body.Reason
+		}, 3*time.Second, 50*time.Millisecond).Should(Equal(server.ReasonNoTunnel))
+		Expect(response.status).To(Equal(http.StatusServiceUnavailable))
+		Expect(response.retryAfter).To(Equal("5"))
+		Expect(response.body.RetryAfterSeconds).To(Equal(5))
+		Expect(response.body.LastSeen).NotTo(BeNil())
+		Expect(*response.body.LastSeen).To(BeTemporally("~", disconnected, 2*time.Second))
+
+		// The last seen time stays the same while the cluster is disconnected
+		time.Sleep(1100 * time.Millisecond)
+		later := getUnavailable(framework, "test-cluster")
+		Expect(later.body.LastSeen).NotTo(BeNil())
+		Expect(*later.body.LastSeen).To(Equal(*response.body.LastSeen))
+	})
+
+	It("should not remember the last seen time without a retention", func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.TunnelLastSeenRetention = -1
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+		Expect(framework.DrainAndWait("test-cluster", 5*time.Second)).To(Succeed())
+
+		var response unavailableResponse
+		Eventually(func(g Gomega) string {
+			response = pollUnavailable(g, framework, "test-cluster", "")
+			return response.body.Reason
+		}, 3*time.Second, 50*time.Millisecond).Should(Equal(server.ReasonNoTunnel))
+		Expect(response.body.LastSeen).To(BeNil())
+	})
+
+	It("should report a cluster in its slow start as connecting", func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.SlowStartWindow = 10 * time.Second
+			config.SlowStartQPS = 0.1
+			config.SlowStartBurst = 1
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		// The burst takes the only connection of the slow start, the next one waits for a second at most
+		Expect(getUnavailable(framework, "test-cluster").status).To(Equal(http.StatusOK))
+		response := getUnavailable(framework, "test-cluster")
+		Expect(response.status).To(Equal(http.StatusServiceUnavailable))
+		Expect(response.retryAfter).To(Equal("1"))
+		Expect(response.body.Cluster).To(Equal("test-cluster"))
+		Expect(response.body.Reason).To(Equal(server.ReasonConnecting))
+		Expect(response.body.RetryAfterSeconds).To(Equal(1))
+		Expect(response.body.LastSeen).NotTo(BeNil())
+		Expect(*response.body.LastSeen).To(BeTemporally("~", time.Now(), 2*time.Second))
+	})
+
+	It("should report a cluster with too many connections with 429", func() {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.MaxPacketConnsPerTunnel = 1
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		inFlight := make(chan struct{})
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			close(inFlight)
+			time.Sleep(time.Second)
+			w.WriteHeader(http.StatusOK)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			Expect(getUnavailable(framework, "test-cluster").status).To(Equal(http.StatusOK))
+		}()
+		Eventually(inFlight, 3*time.Second).Should(BeClosed())
+
+		response := getUnavailable(framework, "test-cluster")
+		Expect(response.status).To(Equal(http.StatusTooManyRequests))
+		Expect(response.retryAfter).To(Equal("1"))
+		Expect(response.body.Cluster).To(Equal("test-cluster"))
+		Expect(response.body.Reason).To(Equal(server.ReasonTooManyConnections))
+		Expect(response.body.RetryAfterSeconds).To(Equal(1))
+		Expect(response.body.LastSeen).NotTo(BeNil())
+		Eventually(done, 5*time.Second).Should(BeClosed())
+	})
+
+	It("should report rate limited requests without their cluster", func() {
+		limiter := rate.NewLimiter(rate.Every(time.Minute), 1)
+		framework = NewTestFrameworkWithGinkgo(false).
+			WithClusterNameParser(server.NewRateLimitingClusterNameParser(&TestClusterNameParser{}, limiter))
+		Expect(framework.Setup()).To(Succeed())
+
+		Expect(getUnavailable(framework, "test-cluster").body.Reason).To(Equal(server.ReasonNoTunnel))
+		response := getUnavailable(framework, "test-cluster")
+		Expect(response.status).To(Equal(http.StatusTooManyRequests))
+		Expect(response.retryAfter).To(Equal("1"))
+		Expect(response.body).To(Equal(server.ClusterUnavailable{
+			Reason:            server.ReasonRateLimited,
+			RetryAfterSeconds: 1,
+			Message:           "Too many requests",
+		}))
+	})
+})
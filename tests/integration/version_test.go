@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/version"
+)
+
+var _ = Describe("Version Information", func() {
+	var framework *TestFramework
+	var savedVersion string
+
+	BeforeEach(func() {
+		// The hub and the agent run in the test binary, they report the same version
+		savedVersion = version.Version
+		version.Version = "v1.2.3-test"
+
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.EnableDebugEndpoints = true
+		})
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+		version.Version = savedVersion
+	})
+
+	It("should list the version the agent sent in the tunnel metadata", func() {
+		Expect(framework.CreateAgent("version-cluster", "localhost:8080")).To(Succeed())
+		Eventually(func() string {
+			tunnel := framework.GetHubServer().GetTunnel("version-cluster")
+			if tunnel == nil {
+				return ""
+			}
+			return tunnel.AgentVersion()
+		}, 3*time.Second, 50*time.Millisecond).Should(Equal("v1.2.3-test"))
+		Expect(framework.GetAgent("version-cluster").Version().Version).To(Equal("v1.2.3-test"))
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/debug/tunnels", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var tunnels []struct {
+			ClusterName  string `json:"cluster_name"`
+			AgentVersion string `json:"agent_version"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&tunnels)).To(Succeed())
+		Expect(tunnels).To(HaveLen(1))
+		Expect(tunnels[0].ClusterName).To(Equal("version-cluster"))
+		Expect(tunnels[0].AgentVersion).To(Equal("v1.2.3-test"))
+	})
+
+	It("should serve the version of the hub", func() {
+		Expect(framework.GetHubServer().Version()).To(Equal(version.Get()))
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/version", framework.GetHubHTTPAddr()))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var info version.Info
+		Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+		Expect(info).To(Equal(version.Get()))
+	})
+})
@@ -0,0 +1,104 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocket", func() {
+	var framework *TestFramework
+
+	BeforeEach(func() {
+		framework = NewTestFrameworkWithGinkgo(false)
+		Expect(framework.Setup()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should forward the messages of a WebSocket connection in both directions", func() {
+		mockServer, err := framework.CreateMockServer("backend", nil)
+		Expect(err).NotTo(HaveOccurred())
+		// The agent forwards the path of the request to the Hub, prefixed by the cluster name
+		mockServer.ServeWebSocket("/test-cluster/ws", func(conn *websocket.Conn) {
+			for {
+				messageType, payload, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if messageType == websocket.TextMessage {
+					payload = append([]byte("echo: "), payload...)
+				}
+				if err := conn.WriteMessage(messageType, payload); err != nil {
+					return
+				}
+			}
+		})
+
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		Eventually(func() bool {
+			return framework.GetHubServer().GetTunnel("test-cluster") != nil
+		}, 5*time.Second, 50*time.Millisecond).Should(BeTrue())
+
+		conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/test-cluster/ws", framework.GetHubHTTPAddr()), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+		// The last message is larger than a DATA packet and a frame with a 16-bit length
+		binaryPayload := bytes.Repeat([]byte{0x00, 0xff, 0x7e}, 40*1024)
+		sent := []struct {
+			messageType int
+			payload     []byte
+		}{
+			{websocket.TextMessage, []byte("message-1")},
+			{websocket.TextMessage, []byte("message-2")},
+			{websocket.TextMessage, []byte("message-3")},
+			{websocket.TextMessage, []byte("message-4")},
+			{websocket.BinaryMessage, binaryPayload},
+		}
+		for _, m := range sent {
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			Expect(conn.WriteMessage(m.messageType, m.payload)).To(Succeed())
+			messageType, payload, err := conn.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messageType).To(Equal(m.messageType))
+			if m.messageType == websocket.TextMessage {
+				Expect(string(payload)).To(Equal("echo: " + string(m.payload)))
+			} else {
+				Expect(payload).To(Equal(m.payload))
+			}
+		}
+		Expect(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))).To(Succeed())
+
+		// The mock server captured each message and its echo, in order
+		Eventually(func() int {
+			return len(mockServer.GetWebSocketMessages())
+		}, 5*time.Second, 50*time.Millisecond).Should(Equal(2 * len(sent)))
+		messages := mockServer.GetWebSocketMessages()
+		for i, m := range sent {
+			received, echoed := messages[2*i], messages[2*i+1]
+			Expect(received.Path).To(Equal("/test-cluster/ws"))
+			Expect(received.Direction).To(Equal(WebSocketReceived))
+			Expect(received.MessageType).To(Equal(m.messageType))
+			Expect(received.Payload).To(Equal(m.payload))
+			Expect(echoed.Direction).To(Equal(WebSocketSent))
+			Expect(echoed.MessageType).To(Equal(m.messageType))
+			if m.messageType == websocket.TextMessage {
+				Expect(string(echoed.Payload)).To(Equal("echo: " + string(m.payload)))
+			} else {
+				Expect(echoed.Payload).To(Equal(m.payload))
+			}
+		}
+	})
+})
@@ -0,0 +1,86 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/xuezhaojun/multiclustertunnel/pkg/server"
+)
+
+var _ = Describe("Client Write Timeout", func() {
+	// responseSize exceeds what the socket buffers of the hub and the client hold while the client pauses
+	const responseSize = 32 * 1024 * 1024
+
+	var framework *TestFramework
+
+	// setup starts the hub with a small buffer budget for each packet connection and the write timeout
+	setup := func(writeTimeout time.Duration) {
+		framework = NewTestFrameworkWithGinkgo(false).WithServerConfig(func(config *server.Config) {
+			config.MaxPacketConnBufferedBytes = 64 * 1024
+			config.ClientWriteTimeout = writeTimeout
+		})
+		Expect(framework.Setup()).To(Succeed())
+
+		mockServer, err := framework.CreateMockServer("backend", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(responseSize))
+			w.WriteHeader(http.StatusOK)
+			w.Write(make([]byte, responseSize))
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(framework.CreateAgent("test-cluster", mockServer.GetAddr())).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// download requests the large response, pauses reading once the head is read and returns the bytes of
+	// the body read
+	download := func(pause time.Duration) int64 {
+		conn, err := net.Dial("tcp", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(conn, "GET /test-cluster/api/v1/large HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", framework.GetHubHTTPAddr())
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		time.Sleep(pause)
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		n, _ := io.Copy(io.Discard, resp.Body)
+		return n
+	}
+
+	AfterEach(func() {
+		if framework != nil {
+			framework.Cleanup()
+			framework.AssertNoGoroutineLeak(&GinkgoTestingAdapter{GinkgoT()})
+		}
+	})
+
+	It("should truncate the response of a paused client without a write timeout", func() {
+		setup(0)
+		Expect(download(time.Second)).To(BeNumerically("<", responseSize))
+	})
+
+	It("should complete the response of a client pausing within the write timeout", func() {
+		setup(3 * time.Second)
+		Expect(download(time.Second)).To(Equal(int64(responseSize)))
+	})
+
+	It("should truncate the response of a client pausing longer than the write timeout", func() {
+		setup(time.Second)
+		Expect(download(3 * time.Second)).To(BeNumerically("<", responseSize))
+
+		tun := framework.GetHubServer().GetTunnel("test-cluster")
+		Expect(tun).NotTo(BeNil())
+		Eventually(tun.PacketConnStats, 3*time.Second, 100*time.Millisecond).Should(BeEmpty())
+	})
+})